@@ -0,0 +1,120 @@
+// Command lockbox-helper is the small privileged helper behind lockbox's
+// multi-user mode. It is installed setgid to the "lockbox" group, which owns
+// /var/lib/lockbox, and does only two things on behalf of the real user:
+//
+//	lockbox-helper provision        create /var/lib/lockbox/<uid> for the caller
+//	lockbox-helper get GROUP KEY    read KEY from the shared store of GROUP
+//
+// It deliberately ignores LOCKBOX_* environment variables, since those are
+// controlled by the unprivileged caller.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/keysource"
+	"github.com/MQ37/lockbox/internal/multiuser"
+)
+
+const usage = `Usage:
+  lockbox-helper provision
+  lockbox-helper get GROUP KEY
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch {
+	case os.Args[1] == "provision" && len(os.Args) == 2:
+		dir, err := multiuser.Provision(multiuser.DefaultSystemDir, os.Getuid())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(dir)
+
+	case os.Args[1] == "get" && len(os.Args) == 4:
+		value, err := getShared(os.Args[2], os.Args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(value)
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// getShared decrypts key from the shared store of group after checking the
+// real user belongs to group
+func getShared(group, key string) ([]byte, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return nil, fmt.Errorf("unknown group '%s'", group)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid for group '%s'", group)
+	}
+
+	member, err := multiuser.IsMember(gid)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, fmt.Errorf("permission denied: not a member of group '%s'", group)
+	}
+
+	path, err := multiuser.SharedStorePath(multiuser.DefaultSystemDir, group)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no shared store for group '%s'", group)
+	}
+
+	// Never create or migrate a store while holding the group's privileges
+	store, err := db.OpenExisting(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared store: %w", err)
+	}
+	defer store.Close()
+
+	keyHex, err := store.GetConfig("encryption_key")
+	if err != nil {
+		// The helper has no passphrase to ask for and no user keychain
+		if backend, berr := keysource.Backend(store); berr == nil {
+			return nil, fmt.Errorf("shared store for group '%s' keeps its key in the %s backend, which the helper cannot use", group, backend)
+		}
+		return nil, fmt.Errorf("shared store for group '%s' is not initialized", group)
+	}
+	encKey, err := hex.DecodeString(string(keyHex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encryption key: %w", err)
+	}
+
+	encrypted, err := store.GetSecret(key)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return nil, fmt.Errorf("secret '%s' not found", key)
+		}
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	decrypted, err := crypto.Decrypt(encrypted, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return decrypted, nil
+}
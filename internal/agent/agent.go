@@ -0,0 +1,263 @@
+// Package agent keeps unwrapped store keys in the memory of a long-running
+// per-user process, like ssh-agent, so a passphrase is asked once and later
+// commands fetch the key over a unix socket only the user can open. Keys
+// are forgotten after going unused for the idle timeout, or on lock.
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/server"
+)
+
+var (
+	// ErrNotRunning means no agent listens on the socket
+	ErrNotRunning = errors.New("agent is not running")
+	// ErrLocked means the agent holds no key for the store
+	ErrLocked = errors.New("agent holds no key for this store")
+)
+
+// dialTimeout bounds how long a command waits for the agent
+const dialTimeout = time.Second
+
+// SocketPath returns $LOCKBOX_AGENT_SOCK, else agent.sock in
+// $XDG_RUNTIME_DIR or else in ~/.lockbox, directories only the user can
+// enter
+func SocketPath() (string, error) {
+	if path := os.Getenv("LOCKBOX_AGENT_SOCK"); path != "" {
+		return path, nil
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "lockbox-agent.sock"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".lockbox", "agent.sock"), nil
+}
+
+// request is one line sent to the agent
+type request struct {
+	Op    string `json:"op"`
+	Store string `json:"store,omitempty"`
+	Key   []byte `json:"key,omitempty"`
+}
+
+// response is the agent's answer to a request
+type response struct {
+	Key    []byte `json:"key,omitempty"`
+	Stores int    `json:"stores,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// entry is a key held for one store
+type entry struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// Agent holds keys by store path
+type Agent struct {
+	idle time.Duration
+	uid  int
+	mu   sync.Mutex
+	keys map[string]*entry
+}
+
+// New returns an agent forgetting keys unused for idle
+func New(idle time.Duration) *Agent {
+	return &Agent{idle: idle, uid: os.Getuid(), keys: map[string]*entry{}}
+}
+
+// Serve answers requests on ln until it is closed. Connections from
+// processes of other users are dropped, whatever the socket's permissions.
+func (a *Agent) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !a.trusted(conn) {
+			conn.Close()
+			continue
+		}
+		go a.serveConn(conn)
+	}
+}
+
+// trusted reports whether conn comes from a process of the agent's user.
+// Where peer credentials cannot be read, the socket's permissions are
+// all that guards it.
+func (a *Agent) trusted(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	cred, err := server.ConnPeerCred(uc)
+	if errors.Is(err, server.ErrNoPeerCred) {
+		return true
+	}
+	return err == nil && int(cred.UID) == a.uid
+}
+
+// serveConn answers one request per line
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req request
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = "invalid request"
+		} else {
+			resp = a.handle(req)
+		}
+		if enc.Encode(resp) != nil {
+			return
+		}
+	}
+}
+
+func (a *Agent) handle(req request) response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.Op {
+	case "get":
+		e, ok := a.keys[req.Store]
+		if !ok {
+			return response{Error: ErrLocked.Error()}
+		}
+		e.timer.Reset(a.idle)
+		// A copy, as the key may be wiped before it is sent
+		return response{Key: slices.Clone(e.key)}
+	case "add":
+		if len(req.Key) == 0 {
+			return response{Error: "no key given"}
+		}
+		a.forget(req.Store)
+		e := &entry{key: req.Key}
+		store := req.Store
+		e.timer = time.AfterFunc(a.idle, func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.keys[store] == e {
+				a.forget(store)
+			}
+		})
+		a.keys[store] = e
+		return response{}
+	case "drop":
+		a.forget(req.Store)
+		return response{}
+	case "lock":
+		n := len(a.keys)
+		a.forgetAll()
+		return response{Stores: n}
+	}
+	return response{Error: fmt.Sprintf("unknown op '%s'", req.Op)}
+}
+
+// Lock forgets every key
+func (a *Agent) Lock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forgetAll()
+}
+
+// forgetAll wipes every key. The caller must hold a.mu.
+func (a *Agent) forgetAll() {
+	for store := range a.keys {
+		a.forget(store)
+	}
+}
+
+// forget wipes and removes the key of store. The caller must hold a.mu.
+func (a *Agent) forget(store string) {
+	e, ok := a.keys[store]
+	if !ok {
+		return
+	}
+	e.timer.Stop()
+	clear(e.key)
+	delete(a.keys, store)
+}
+
+// storeID is the absolute path of a store, as the agent knows it
+func storeID(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// call sends req to the agent on the socket and returns its answer
+func call(req request) (response, error) {
+	path, err := SocketPath()
+	if err != nil {
+		return response{}, err
+	}
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return response{}, ErrNotRunning
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return response{}, err
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return response{}, fmt.Errorf("bad answer from agent: %w", err)
+	}
+	if resp.Error == ErrLocked.Error() {
+		return resp, ErrLocked
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Get returns the key the agent holds for the store at path
+func Get(path string) ([]byte, error) {
+	resp, err := call(request{Op: "get", Store: storeID(path)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+// Add hands the key of the store at path to the agent
+func Add(path string, key []byte) error {
+	_, err := call(request{Op: "add", Store: storeID(path), Key: key})
+	return err
+}
+
+// Drop makes the agent forget the key of the store at path
+func Drop(path string) error {
+	_, err := call(request{Op: "drop", Store: storeID(path)})
+	return err
+}
+
+// Lock makes the agent forget every key, returning how many stores it
+// held keys for
+func Lock() (int, error) {
+	resp, err := call(request{Op: "lock"})
+	return resp.Stores, err
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startAgent runs an agent on a socket in a temporary directory
+func startAgent(t *testing.T, idle time.Duration) *Agent {
+	t.Helper()
+	return startAgentFor(t, New(idle))
+}
+
+// startAgentFor serves a on a socket in a temporary directory
+func startAgentFor(t *testing.T, a *Agent) *Agent {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	t.Setenv("LOCKBOX_AGENT_SOCK", path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go a.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return a
+}
+
+func TestAgent(t *testing.T) {
+	startAgent(t, time.Minute)
+
+	if _, err := Get("/tmp/a.db"); err != ErrLocked {
+		t.Fatalf("Get before Add = %v, want ErrLocked", err)
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := Add("/tmp/a.db", key); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	Add("/tmp/b.db", []byte("other"))
+
+	got, err := Get("/tmp/../tmp/a.db")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Get = %q, %v; want the added key", got, err)
+	}
+
+	if err := Drop("/tmp/b.db"); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	if _, err := Get("/tmp/b.db"); err != ErrLocked {
+		t.Errorf("Get after Drop = %v, want ErrLocked", err)
+	}
+
+	n, err := Lock()
+	if err != nil || n != 1 {
+		t.Fatalf("Lock = %d, %v; want 1 store", n, err)
+	}
+	if _, err := Get("/tmp/a.db"); err != ErrLocked {
+		t.Errorf("Get after Lock = %v, want ErrLocked", err)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	startAgent(t, 100*time.Millisecond)
+
+	Add("/tmp/a.db", []byte("key"))
+	for range 3 {
+		time.Sleep(60 * time.Millisecond)
+		if _, err := Get("/tmp/a.db"); err != nil {
+			t.Fatalf("Get while in use = %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := Get("/tmp/a.db"); err != ErrLocked {
+		t.Errorf("Get after idling = %v, want ErrLocked", err)
+	}
+}
+
+func TestNotRunning(t *testing.T) {
+	t.Setenv("LOCKBOX_AGENT_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+	if _, err := Get("/tmp/a.db"); err != ErrNotRunning {
+		t.Errorf("Get = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestOtherUser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are read on Linux only")
+	}
+	// An agent run by another user, as seen from this one
+	a := New(time.Minute)
+	a.uid = os.Getuid() + 1
+	startAgentFor(t, a)
+
+	if err := Add("/tmp/a.db", []byte("key")); err == nil {
+		t.Error("Add from another user succeeded")
+	}
+	if _, err := Get("/tmp/a.db"); err == nil || err == ErrLocked {
+		t.Errorf("Get from another user = %v, want the connection dropped", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.keys) != 0 {
+		t.Error("The agent took a key from another user")
+	}
+}
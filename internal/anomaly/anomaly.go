@@ -0,0 +1,246 @@
+// Package anomaly flags unusual secret reads against baselines learned
+// from the store's access log: how many keys each identity reads at once,
+// which identities read over the server, when each key is usually read,
+// and how long it has been since a key was last read.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// Kinds of anomaly
+const (
+	// Enumeration is an identity reading more keys at once than it
+	// usually does
+	Enumeration = "enumeration"
+	// NewIdentity is the first read by a remote identity
+	NewIdentity = "new-identity"
+	// Dormant is a read of a key nobody read for a long time
+	Dormant = "dormant"
+	// UnusualHour is a read of a key at an hour it is never read
+	UnusualHour = "unusual-hour"
+)
+
+// checkedConfig is the config entry holding when Check last ran
+const checkedConfig = "anomaly_checked"
+
+// Options tunes detection. Zero fields take the matching default.
+type Options struct {
+	// Baseline is how much history reads are compared against
+	Baseline time.Duration
+	// Window is the period an identity's reads count as one burst
+	Window time.Duration
+	// Keys is the fewest distinct keys in a burst that can be an
+	// enumeration
+	Keys int
+	// Dormant is how long a key goes unread before a read is unusual
+	Dormant time.Duration
+	// Samples is the fewest reads of a key before its hours are trusted
+	Samples int
+}
+
+// Defaults are the Options used for zero fields
+var Defaults = Options{
+	Baseline: 30 * 24 * time.Hour,
+	Window:   5 * time.Minute,
+	Keys:     20,
+	Dormant:  90 * 24 * time.Hour,
+	Samples:  20,
+}
+
+func (o Options) withDefaults() Options {
+	if o.Baseline == 0 {
+		o.Baseline = Defaults.Baseline
+	}
+	if o.Window == 0 {
+		o.Window = Defaults.Window
+	}
+	if o.Keys == 0 {
+		o.Keys = Defaults.Keys
+	}
+	if o.Dormant == 0 {
+		o.Dormant = Defaults.Dormant
+	}
+	if o.Samples == 0 {
+		o.Samples = Defaults.Samples
+	}
+	return o
+}
+
+// History is how far back reads must be loaded to detect anomalies
+func (o Options) History() time.Duration {
+	o = o.withDefaults()
+	return max(o.Baseline, o.Dormant)
+}
+
+// Anomaly is an unusual read. Fields name keys and identities, never
+// values.
+type Anomaly struct {
+	Kind     string
+	At       time.Time
+	Key      string
+	Identity string
+	Source   string
+	Detail   string
+}
+
+// burst is an identity's reads within the current window
+type burst struct {
+	start   time.Time
+	keys    map[string]bool
+	flagged bool
+}
+
+// Detect returns the anomalies among accesses at or after since, judged
+// against the accesses before them. accesses must be oldest first.
+func Detect(accesses []db.Access, since time.Time, opts Options) []Anomaly {
+	return detect(accesses, func(a db.Access) bool { return !a.At.Before(since) }, opts)
+}
+
+// detect is Detect for the accesses checking selects
+func detect(accesses []db.Access, checking func(db.Access) bool, opts Options) []Anomaly {
+	opts = opts.withDefaults()
+
+	var (
+		found      []Anomaly
+		lastRead   = map[string]time.Time{}
+		hours      = map[string]*[24]int{}
+		identities = map[string]bool{}
+		bursts     = map[string]*burst{}
+		usual      = map[string]int{}
+		history    = false
+	)
+	for _, a := range accesses {
+		checking := checking(a)
+		flag := func(kind, detail string) {
+			if checking {
+				found = append(found, Anomaly{Kind: kind, At: a.At, Key: a.Key, Identity: a.Identity, Source: a.Source, Detail: detail})
+			}
+		}
+		if !checking {
+			history = true
+		}
+
+		// A remote identity nobody has seen before, once history exists
+		if a.Source == "server" && !identities[a.Identity] && history {
+			flag(NewIdentity, fmt.Sprintf("first read over the server by %s", a.Identity))
+		}
+		identities[a.Identity] = true
+
+		// A key read again after a long time
+		if last, ok := lastRead[a.Key]; ok && a.At.Sub(last) > opts.Dormant {
+			flag(Dormant, fmt.Sprintf("%s read after %d days unread", a.Key, int(a.At.Sub(last).Hours()/24)))
+		}
+		lastRead[a.Key] = a.At
+
+		// An hour a well-read key is never read at
+		h := hours[a.Key]
+		if h == nil {
+			h = &[24]int{}
+			hours[a.Key] = h
+		}
+		hour, samples := a.At.Local().Hour(), 0
+		for _, n := range h {
+			samples += n
+		}
+		if samples >= opts.Samples && h[hour] == 0 {
+			flag(UnusualHour, fmt.Sprintf("%s read at %02d:00, outside its usual hours", a.Key, hour))
+		}
+		h[hour]++
+
+		// More keys in one burst than the identity usually reads
+		b := bursts[a.Identity]
+		if b == nil || a.At.Sub(b.start) > opts.Window {
+			b = &burst{start: a.At, keys: map[string]bool{}}
+			bursts[a.Identity] = b
+		}
+		b.keys[a.Key] = true
+		n := len(b.keys)
+		if n >= opts.Keys && n > usual[a.Identity] && !b.flagged {
+			flag(Enumeration, fmt.Sprintf("%s read %d or more keys within %s", a.Identity, n, opts.Window))
+			b.flagged = checking
+		}
+		if !checking {
+			usual[a.Identity] = max(usual[a.Identity], n)
+		}
+	}
+	return found
+}
+
+// Group collapses anomalies of the same kind by the same identity into
+// the first of them, so one bulk read raises one alert
+func Group(found []Anomaly) []Anomaly {
+	var grouped []Anomaly
+	index, counts := map[[2]string]int{}, map[[2]string]int{}
+	for _, a := range found {
+		k := [2]string{a.Kind, a.Identity}
+		if _, ok := index[k]; !ok {
+			index[k] = len(grouped)
+			grouped = append(grouped, a)
+		}
+		counts[k]++
+	}
+	for k, i := range index {
+		if n := counts[k] - 1; n > 0 {
+			grouped[i].Detail += fmt.Sprintf(" (and %d more)", n)
+		}
+	}
+	return grouped
+}
+
+// Find loads the access log and returns the anomalies at or after since
+func Find(store *db.Store, since time.Time, opts Options) ([]Anomaly, error) {
+	accesses, err := store.Accesses(since.Add(-opts.History()))
+	if err != nil {
+		return nil, err
+	}
+	return Detect(accesses, since, opts), nil
+}
+
+// Check returns the anomalies among reads logged since the previous
+// Check, then forgets reads too old to matter for later checks
+func Check(store *db.Store, now time.Time, opts Options) ([]Anomaly, error) {
+	var checked int64 = -1
+	if raw, err := store.GetConfig(checkedConfig); err == nil {
+		checked, _ = strconv.ParseInt(string(raw), 10, 64)
+	}
+	accesses, err := store.Accesses(now.Add(-opts.History()))
+	if err != nil {
+		return nil, err
+	}
+	if len(accesses) == 0 {
+		return nil, nil
+	}
+	last := accesses[len(accesses)-1].ID
+	if checked < 0 {
+		// The first check only learns the baseline
+		checked = last
+	}
+	found := detect(accesses, func(a db.Access) bool { return a.ID > checked }, opts)
+	if err := store.SetConfig(checkedConfig, []byte(strconv.FormatInt(last, 10))); err != nil {
+		return nil, err
+	}
+	return found, store.PruneAccesses(now.Add(-opts.History()))
+}
+
+// Schedule runs Check every interval until ctx is done, calling report
+// with any anomalies found or error
+func Schedule(ctx context.Context, store *db.Store, interval time.Duration, opts Options, report func([]Anomaly, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if found, err := Check(store, time.Now().UTC(), opts); len(found) > 0 || err != nil {
+			report(found, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
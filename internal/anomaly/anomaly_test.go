@@ -0,0 +1,105 @@
+package anomaly
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+
+// read is an access of key by identity over the server, days and hours
+// after start
+func read(days, hours int, key, identity string) db.Access {
+	return db.Access{At: start.AddDate(0, 0, days).Add(time.Duration(hours) * time.Hour), Key: key, Source: "server", Identity: identity}
+}
+
+func kinds(found []Anomaly) []string {
+	var k []string
+	for _, a := range found {
+		k = append(k, a.Kind+" "+a.Key)
+	}
+	return k
+}
+
+func TestDetect(t *testing.T) {
+	var history []db.Access
+	// KEY is read by token:app each day at 10:00, APP_* in bursts of 25
+	for d := range 30 {
+		history = append(history, read(d, 10, "KEY", "token:app"))
+	}
+	for i := range 25 {
+		history = append(history, read(80, 12, fmt.Sprintf("APP_%d", i), "token:app"))
+	}
+	history = append(history, read(0, 9, "OLD", "token:app"))
+	slices.SortStableFunc(history, func(a, b db.Access) int { return a.At.Compare(b.At) })
+	since := start.AddDate(0, 0, 100)
+
+	tests := []struct {
+		name string
+		new  []db.Access
+		want []string
+	}{
+		{"usual read", []db.Access{read(100, 10, "KEY", "token:app")}, nil},
+		{"unusual hour", []db.Access{read(100, 3, "KEY", "token:app")}, []string{"unusual-hour KEY"}},
+		{"dormant key", []db.Access{read(100, 9, "OLD", "token:app")}, []string{"dormant OLD"}},
+		{"new identity", []db.Access{read(100, 10, "KEY", "remote:10.0.0.9"), read(100, 10, "KEY", "remote:10.0.0.9")}, []string{"new-identity KEY"}},
+		{"usual burst", bulkRead(25, "token:app"), nil},
+		{"enumeration", bulkRead(30, "token:app"), []string{"enumeration APP_25"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := kinds(Detect(append(history[:len(history):len(history)], tt.new...), since, Options{}))
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Detect = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// bulkRead is n distinct APP_ keys read by identity within a minute
+func bulkRead(n int, identity string) []db.Access {
+	var reads []db.Access
+	for i := range n {
+		reads = append(reads, read(100, 12, fmt.Sprintf("APP_%d", i), identity))
+	}
+	return reads
+}
+
+func TestGroup(t *testing.T) {
+	found := []Anomaly{
+		{Kind: UnusualHour, Identity: "uid:1", Detail: "A"},
+		{Kind: UnusualHour, Identity: "uid:1", Detail: "B"},
+		{Kind: Dormant, Identity: "uid:1", Detail: "C"},
+	}
+	got := Group(found)
+	if len(got) != 2 || got[0].Detail != "A (and 1 more)" || got[1].Detail != "C" {
+		t.Errorf("Group = %+v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	opts := Options{Keys: 3}
+	store.RecordAccess("cli", "uid:1000", []string{"A"})
+	if found, err := Check(store, time.Now(), opts); err != nil || len(found) != 0 {
+		t.Fatalf("first Check = %v, %v, want only the baseline learned", kinds(found), err)
+	}
+	store.RecordAccess("cli", "uid:1000", []string{"B", "C"})
+	found, err := Check(store, time.Now(), opts)
+	if err != nil || len(found) != 1 || found[0].Kind != Enumeration {
+		t.Fatalf("Check = %v, %v, want one enumeration", kinds(found), err)
+	}
+	if found, _ := Check(store, time.Now(), opts); len(found) != 0 {
+		t.Errorf("third Check repeated %v", kinds(found))
+	}
+}
@@ -0,0 +1,366 @@
+// Package archive writes and restores .lbx archives: every secret of every
+// vault of a store in one file, for moving secrets to another store.
+//
+// An archive is a JSON header line followed by the archive body encrypted
+// and authenticated with AES-256-GCM under the store key. The body repeats
+// the header, so a header altered on disk is detected when the body is
+// opened. Optionally the header carries the store key wrapped with a
+// passphrase, so the archive can be restored into a store with a different
+// key; without it, only a store sharing the key can open the archive.
+// Temporary secrets are left out.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/selector"
+)
+
+// Format identifies the header line of an archive
+const Format = "lockbox-archive/1"
+
+// ErrWrongKey is returned by Open when the archive was encrypted with
+// another key
+var ErrWrongKey = errors.New("archive is encrypted with another store key")
+
+// Header is the first line of an archive, readable without the key
+type Header struct {
+	Format  string    `json:"format"`
+	Created time.Time `json:"created"`
+	Secrets int       `json:"secrets"`
+	// Key is the store key wrapped with a passphrase, when the archive
+	// carries it
+	Key []byte `json:"key,omitempty"`
+	// NoCopyOut is set when the store forbids copying its secrets out, and
+	// Source is then the fingerprint of its key: the archive restores only
+	// into a store with that key
+	NoCopyOut bool   `json:"no_copy_out,omitempty"`
+	Source    string `json:"source,omitempty"`
+}
+
+// Entry is one secret of an archive
+type Entry struct {
+	Vault   string    `json:"vault,omitempty"`
+	Key     string    `json:"key"`
+	Kind    string    `json:"kind,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Blob is set for values kept in the store's shared blobs, those of
+	// ordinary secrets
+	Blob  bool   `json:"blob,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// Archive is the opened body of an archive
+type Archive struct {
+	Header Header `json:"header"`
+	// Vaults names every vault but the default
+	Vaults  []string `json:"vaults"`
+	Entries []Entry  `json:"secrets"`
+}
+
+// Wipe clears the values held by a
+func (a *Archive) Wipe() {
+	for _, e := range a.Entries {
+		clear(e.Value)
+	}
+}
+
+// Write writes every secret of every vault of store to w, encrypted with
+// storeKey, and returns the archive's header. A non-empty passphrase
+// includes storeKey in the header, wrapped with it.
+func Write(w io.Writer, store *db.Store, storeKey []byte, passphrase string, now time.Time) (Header, error) {
+	a := Archive{Header: Header{Format: Format, Created: now.UTC()}}
+	defer a.Wipe()
+
+	noCopyOut, err := policy.CopyOutForbidden(store)
+	if err != nil {
+		return a.Header, err
+	}
+	if noCopyOut {
+		a.Header.NoCopyOut = true
+		if a.Header.Source, err = crypto.Fingerprint(storeKey); err != nil {
+			return a.Header, err
+		}
+	}
+
+	vaults, err := store.ListVaults()
+	if err != nil {
+		return a.Header, err
+	}
+	for _, v := range vaults {
+		a.Vaults = append(a.Vaults, v.Name)
+	}
+	err = store.Changes(0, func(c db.Change) error {
+		if c.Deleted || !c.Expires.IsZero() {
+			return nil
+		}
+		value, err := crypto.Decrypt(c.Value, storeKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", c.Key, err)
+		}
+		a.Entries = append(a.Entries, Entry{
+			Vault: c.Vault, Key: c.Key, Kind: c.Kind, Owner: c.Owner,
+			Created: c.Created, Updated: c.Updated, Blob: c.Digest != "", Value: value,
+		})
+		return nil
+	})
+	if err != nil {
+		return a.Header, err
+	}
+	slices.SortFunc(a.Entries, func(x, y Entry) int {
+		if x.Vault != y.Vault {
+			return cmpString(x.Vault, y.Vault)
+		}
+		return cmpString(x.Key, y.Key)
+	})
+	a.Header.Secrets = len(a.Entries)
+	if passphrase != "" {
+		if a.Header.Key, err = crypto.WrapKey(storeKey, passphrase); err != nil {
+			return a.Header, err
+		}
+	}
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		return a.Header, err
+	}
+	sealed, err := crypto.Encrypt(body, storeKey)
+	clear(body)
+	if err != nil {
+		return a.Header, fmt.Errorf("failed to encrypt archive: %w", err)
+	}
+
+	header, err := json.Marshal(a.Header)
+	if err != nil {
+		return a.Header, err
+	}
+	if _, err := w.Write(append(header, '\n')); err != nil {
+		return a.Header, err
+	}
+	if _, err := w.Write(sealed); err != nil {
+		return a.Header, err
+	}
+	return a.Header, nil
+}
+
+// cmpString orders strings for sorting entries
+func cmpString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Sealed is an archive read from disk that has not been opened yet
+type Sealed struct {
+	Header Header
+	header []byte
+	body   []byte
+}
+
+// Read reads an archive from r without opening it
+func Read(r io.Reader) (*Sealed, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("not a lockbox archive: %w", err)
+	}
+	s := &Sealed{header: bytes.TrimSuffix(line, []byte("\n"))}
+	if err := json.Unmarshal(s.header, &s.Header); err != nil || s.Header.Format != Format {
+		return nil, fmt.Errorf("not a lockbox archive")
+	}
+	if s.body, err = io.ReadAll(br); err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return s, nil
+}
+
+// UnwrapKey returns the store key included in the archive, unwrapped with
+// passphrase. It fails if the archive does not include the key.
+func (s *Sealed) UnwrapKey(passphrase string) ([]byte, error) {
+	if len(s.Header.Key) == 0 {
+		return nil, fmt.Errorf("archive does not include its key")
+	}
+	return crypto.UnwrapKey(s.Header.Key, passphrase)
+}
+
+// Open decrypts the archive with key, checking that its header was not
+// altered
+func (s *Sealed) Open(key []byte) (*Archive, error) {
+	body, err := crypto.Decrypt(s.body, key)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	defer clear(body)
+
+	var a Archive
+	if err := json.Unmarshal(body, &a); err != nil {
+		return nil, fmt.Errorf("archive is corrupt: %w", err)
+	}
+	var header Header
+	if err := json.Unmarshal(s.header, &header); err != nil || !sameHeader(header, a.Header) {
+		a.Wipe()
+		return nil, fmt.Errorf("archive header was altered")
+	}
+	return &a, nil
+}
+
+// sameHeader reports whether two headers are equal
+func sameHeader(a, b Header) bool {
+	return a.Format == b.Format && a.Created.Equal(b.Created) && a.Secrets == b.Secrets && bytes.Equal(a.Key, b.Key) &&
+		a.NoCopyOut == b.NoCopyOut && a.Source == b.Source
+}
+
+// Strategy decides what Restore does with secrets the store already has
+type Strategy int
+
+const (
+	// Fail restores nothing if any secret exists
+	Fail Strategy = iota
+	// Skip keeps existing secrets
+	Skip
+	// Overwrite replaces existing secrets, archiving their values to escrow
+	Overwrite
+)
+
+// ConflictError is returned by Restore with Fail when secrets of the
+// archive already exist in the store
+type ConflictError struct {
+	// Keys are the existing secrets, qualified with their vault
+	Keys []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%d secret(s) already exist: %s", len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// Result counts what Restore did
+type Result struct {
+	Created     int
+	Overwritten int
+	Skipped     int
+}
+
+// Restore writes the secrets of a to store, encrypted with storeKey, in one
+// transaction, creating the vaults they are in. Secrets keep their kind,
+// owner and timestamps. An archive of a store forbidding copies out is
+// only restored into a store with the same key.
+func Restore(store *db.Store, storeKey []byte, a *Archive, strategy Strategy) (Result, error) {
+	var result Result
+	if a.Header.NoCopyOut {
+		fingerprint, err := crypto.Fingerprint(storeKey)
+		if err != nil {
+			return result, err
+		}
+		if fingerprint != a.Header.Source {
+			return result, policy.ErrCopyOut
+		}
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for _, v := range a.Vaults {
+		if err := tx.AddVault(v); err != nil {
+			return result, err
+		}
+	}
+
+	var conflicts []string
+	for _, e := range a.Entries {
+		if e.Vault != "" {
+			if err := tx.AddVault(e.Vault); err != nil {
+				return result, err
+			}
+		}
+		_, err := tx.InVault(e.Vault).SecretOwner(e.Key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return result, err
+		}
+		exists := err == nil
+		if exists {
+			switch strategy {
+			case Fail:
+				conflicts = append(conflicts, qualify(e.Vault, e.Key))
+				continue
+			case Skip:
+				result.Skipped++
+				continue
+			}
+		}
+
+		c := db.Change{Vault: e.Vault, Key: e.Key, Kind: e.Kind, Owner: e.Owner, Created: e.Created, Updated: e.Updated}
+		if c.Value, err = crypto.Encrypt(e.Value, storeKey); err != nil {
+			return result, fmt.Errorf("failed to encrypt '%s': %w", e.Key, err)
+		}
+		if e.Blob {
+			if c.Digest, err = crypto.Digest(e.Value, storeKey); err != nil {
+				return result, err
+			}
+		}
+		if err := tx.ImportChange(c); err != nil {
+			return result, err
+		}
+		if exists {
+			result.Overwritten++
+		} else {
+			result.Created++
+		}
+	}
+	if len(conflicts) > 0 {
+		return Result{}, &ConflictError{Keys: conflicts}
+	}
+	if err := tx.Commit(); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// Select returns the archive narrowed to the secrets patterns select,
+// matched against keys qualified with their vault as vault/key outside the
+// default vault. Each pattern must select something, as for
+// selector.Resolve.
+func (a *Archive) Select(patterns []string) (*Archive, error) {
+	keys := make([]string, len(a.Entries))
+	for i, e := range a.Entries {
+		keys[i] = qualify(e.Vault, e.Key)
+	}
+	selected, err := selector.Resolve(keys, patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	narrowed := &Archive{Header: a.Header}
+	for i, e := range a.Entries {
+		if slices.Contains(selected, keys[i]) {
+			narrowed.Entries = append(narrowed.Entries, e)
+		}
+	}
+	return narrowed, nil
+}
+
+// qualify names key with its vault, as vault/key outside the default vault
+func qualify(vault, key string) string {
+	if vault == "" {
+		return key
+	}
+	return vault + "/" + key
+}
@@ -0,0 +1,197 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func newTestStore(t *testing.T) (*db.Store, []byte) {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	return store, key
+}
+
+func set(t *testing.T, store *db.Store, key []byte, vault, name, value string) {
+	t.Helper()
+	encrypted, _ := crypto.Encrypt([]byte(value), key)
+	digest, _ := crypto.Digest([]byte(value), key)
+	tx, _ := store.Begin()
+	if vault != "" {
+		tx.AddVault(vault)
+	}
+	if err := tx.ApplyChange(db.Change{Vault: vault, Key: name, Owner: "uid:1000", Digest: digest, Value: encrypted}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+}
+
+func get(t *testing.T, store *db.Store, key []byte, vault, name string) string {
+	t.Helper()
+	encrypted, err := store.InVault(vault).GetSecret(name)
+	if err != nil {
+		return ""
+	}
+	value, err := crypto.Decrypt(encrypted, key)
+	if err != nil {
+		t.Fatalf("Failed to decrypt %s: %v", name, err)
+	}
+	return string(value)
+}
+
+func TestWriteAndRestore(t *testing.T) {
+	src, srcKey := newTestStore(t)
+	set(t, src, srcKey, "", "API_KEY", "abc")
+	set(t, src, srcKey, "", "DB_PASSWORD", "hunter2")
+	set(t, src, srcKey, "prod", "API_KEY", "prod-abc")
+	src.CreateVault("empty")
+	encrypted, _ := crypto.Encrypt([]byte("x"), srcKey)
+	tx, _ := src.Begin()
+	tx.ApplyChange(db.Change{Key: "TEMP", Value: encrypted, Expires: time.Now().Add(time.Hour)})
+	tx.Commit()
+
+	var buf bytes.Buffer
+	header, err := Write(&buf, src, srcKey, "archive pass", time.Now())
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if header.Secrets != 3 {
+		t.Errorf("Archive holds %d secrets, expected 3 without the temporary one", header.Secrets)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Error("Archive holds a plaintext value")
+	}
+	data := buf.Bytes()
+
+	// A store with another key needs the included key
+	dst, dstKey := newTestStore(t)
+	sealed, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, err := sealed.Open(dstKey); err != ErrWrongKey {
+		t.Errorf("Open with another key = %v, expected ErrWrongKey", err)
+	}
+	if _, err := sealed.UnwrapKey("wrong"); err == nil {
+		t.Error("UnwrapKey accepted a wrong passphrase")
+	}
+	archiveKey, err := sealed.UnwrapKey("archive pass")
+	if err != nil {
+		t.Fatalf("UnwrapKey failed: %v", err)
+	}
+	a, err := sealed.Open(archiveKey)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	result, err := Restore(dst, dstKey, a, Fail)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if result.Created != 3 {
+		t.Errorf("Restore created %d secrets, expected 3", result.Created)
+	}
+	if v := get(t, dst, dstKey, "prod", "API_KEY"); v != "prod-abc" {
+		t.Errorf("prod/API_KEY = %q", v)
+	}
+	if owner, _ := dst.SecretOwner("DB_PASSWORD"); owner != "uid:1000" {
+		t.Errorf("Owner = %q, expected it kept", owner)
+	}
+	if ok, _ := dst.HasVault("empty"); !ok {
+		t.Error("Empty vault was not restored")
+	}
+
+	// Conflicts
+	set(t, dst, dstKey, "", "API_KEY", "changed")
+	dst.DeleteSecret("DB_PASSWORD")
+	var conflict *ConflictError
+	if _, err := Restore(dst, dstKey, a, Fail); !errors.As(err, &conflict) || len(conflict.Keys) != 2 {
+		t.Errorf("Restore with Fail = %v, expected a conflict on 2 keys", err)
+	}
+	if _, err := dst.GetSecret("DB_PASSWORD"); err != db.ErrNotFound {
+		t.Error("Failed restore was partly applied")
+	}
+	result, err = Restore(dst, dstKey, a, Skip)
+	if err != nil || result.Created != 1 || result.Skipped != 2 {
+		t.Errorf("Restore with Skip = %+v, %v", result, err)
+	}
+	if v := get(t, dst, dstKey, "", "API_KEY"); v != "changed" {
+		t.Errorf("Skip replaced API_KEY with %q", v)
+	}
+	result, err = Restore(dst, dstKey, a, Overwrite)
+	if err != nil || result.Overwritten != 3 {
+		t.Errorf("Restore with Overwrite = %+v, %v", result, err)
+	}
+	if v := get(t, dst, dstKey, "", "API_KEY"); v != "abc" {
+		t.Errorf("Overwrite left API_KEY at %q", v)
+	}
+}
+
+func TestTamperedArchive(t *testing.T) {
+	store, key := newTestStore(t)
+	set(t, store, key, "", "API_KEY", "abc")
+
+	var buf bytes.Buffer
+	if _, err := Write(&buf, store, key, "", time.Now()); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	sealed, _ := Read(bytes.NewReader(buf.Bytes()))
+	if _, err := sealed.UnwrapKey("x"); err == nil {
+		t.Error("UnwrapKey succeeded on an archive without its key")
+	}
+
+	altered := bytes.Replace(buf.Bytes(), []byte(`"secrets":1`), []byte(`"secrets":9`), 1)
+	sealed, err := Read(bytes.NewReader(altered))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, err := sealed.Open(key); err == nil {
+		t.Error("Open accepted an altered header")
+	}
+
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[len(corrupt)-1] ^= 1
+	sealed, _ = Read(bytes.NewReader(corrupt))
+	if _, err := sealed.Open(key); err == nil {
+		t.Error("Open accepted a corrupt body")
+	}
+
+	if _, err := Read(bytes.NewReader([]byte("API_KEY=abc\n"))); err == nil {
+		t.Error("Read accepted a file that is not an archive")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	a := &Archive{Entries: []Entry{
+		{Key: "PROD_DB_USER"},
+		{Key: "PROD_DB_PASSWORD"},
+		{Key: "API_KEY"},
+		{Vault: "prod", Key: "PROD_DB_USER"},
+	}}
+
+	narrowed, err := a.Select([]string{"PROD_DB_*", "prod/*"})
+	if err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+	var got []string
+	for _, e := range narrowed.Entries {
+		got = append(got, qualify(e.Vault, e.Key))
+	}
+	if want := []string{"PROD_DB_USER", "PROD_DB_PASSWORD", "prod/PROD_DB_USER"}; !slices.Equal(got, want) {
+		t.Errorf("Select = %v, want %v", got, want)
+	}
+
+	if _, err := a.Select([]string{"MISSING_*"}); err == nil {
+		t.Error("Expected a pattern matching nothing to fail")
+	}
+}
@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"time"
+)
+
+// What happened to a key between two archives
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Difference is a key that differs between two archives. Values are
+// compared but never reported.
+type Difference struct {
+	// Key is qualified with its vault, as vault/key outside the default
+	Key    string    `json:"key"`
+	Change string    `json:"change"`
+	Old    time.Time `json:"old_updated,omitzero"`
+	New    time.Time `json:"new_updated,omitzero"`
+}
+
+// Diff compares the secrets of two opened archives by key and returns
+// those added, removed or changed from old to new, sorted by key, and how
+// many are unchanged. A secret changed when its value or kind did.
+func Diff(old, new *Archive) (diffs []Difference, unchanged int) {
+	before := map[string]Entry{}
+	for _, e := range old.Entries {
+		before[qualify(e.Vault, e.Key)] = e
+	}
+
+	for _, e := range new.Entries {
+		key := qualify(e.Vault, e.Key)
+		o, ok := before[key]
+		delete(before, key)
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Key: key, Change: Added, New: e.Updated})
+		case !bytes.Equal(o.Value, e.Value) || o.Kind != e.Kind:
+			diffs = append(diffs, Difference{Key: key, Change: Changed, Old: o.Updated, New: e.Updated})
+		default:
+			unchanged++
+		}
+	}
+	for key, o := range before {
+		diffs = append(diffs, Difference{Key: key, Change: Removed, Old: o.Updated})
+	}
+
+	slices.SortFunc(diffs, func(a, b Difference) int { return strings.Compare(a.Key, b.Key) })
+	return diffs, unchanged
+}
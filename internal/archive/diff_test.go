@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	t1 := time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+	t2 := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	old := &Archive{Entries: []Entry{
+		{Key: "SAME", Value: []byte("a"), Updated: t1},
+		{Key: "VALUE", Value: []byte("old"), Updated: t1},
+		{Key: "KIND", Value: []byte("x"), Updated: t1},
+		{Key: "GONE", Value: []byte("x"), Updated: t1},
+		{Vault: "prod", Key: "SAME", Value: []byte("p"), Updated: t1},
+	}}
+	new := &Archive{Entries: []Entry{
+		{Key: "SAME", Value: []byte("a"), Updated: t1},
+		{Key: "VALUE", Value: []byte("new"), Updated: t2},
+		{Key: "KIND", Kind: "note", Value: []byte("x"), Updated: t2},
+		{Key: "NEW", Value: []byte("x"), Updated: t2},
+		{Vault: "prod", Key: "SAME", Value: []byte("p"), Updated: t1},
+		{Vault: "prod", Key: "VALUE", Value: []byte("p"), Updated: t2},
+	}}
+
+	diffs, unchanged := Diff(old, new)
+	if unchanged != 2 {
+		t.Errorf("unchanged = %d, want 2", unchanged)
+	}
+	want := []Difference{
+		{Key: "GONE", Change: Removed, Old: t1},
+		{Key: "KIND", Change: Changed, Old: t1, New: t2},
+		{Key: "NEW", Change: Added, New: t2},
+		{Key: "VALUE", Change: Changed, Old: t1, New: t2},
+		{Key: "prod/VALUE", Change: Added, New: t2},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("Diff = %+v, want %+v", diffs, want)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("diffs[%d] = %+v, want %+v", i, diffs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package autotype types secrets into the focused window through the OS
+// input APIs, for GUIs and remote desktop sessions that block paste:
+// xdotool on X11, wtype on Wayland, System Events on macOS and SendKeys on
+// Windows. The text reaches those tools on stdin, never in arguments.
+package autotype
+
+import (
+	"errors"
+	"time"
+)
+
+// Keyboard types into whichever window has the focus
+type Keyboard interface {
+	// Focused identifies the focused window, or returns ErrNoFocus if the
+	// platform does not tell
+	Focused() (string, error)
+	Type(text string) error
+}
+
+var (
+	// ErrUnavailable means there is no way to type into other windows
+	ErrUnavailable = errors.New("no way to type into other windows on this machine")
+	// ErrNoFocus means the focused window cannot be told, so a delay has
+	// to stand in for waiting on it
+	ErrNoFocus = errors.New("the focused window cannot be told on this machine")
+	// ErrTimeout means no other window was focused in time
+	ErrTimeout = errors.New("no other window was focused in time")
+)
+
+// keyboard is the platform's keyboard, replaced in tests
+var keyboard Keyboard = platformKeyboard()
+
+// DefaultDelay is how long to wait before typing where the focused window
+// cannot be told
+const DefaultDelay = 3 * time.Second
+
+// PollInterval is how often the focused window is checked
+var PollInterval = 100 * time.Millisecond
+
+// settle is how long a newly focused window gets before it is typed into
+var settle = 300 * time.Millisecond
+
+// WaitForFocus returns once another window than the one focused now has
+// the focus, or ErrTimeout after timeout
+func WaitForFocus(timeout time.Duration) error {
+	start, err := keyboard.Focused()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(PollInterval)
+		id, err := keyboard.Focused()
+		if err != nil {
+			return err
+		}
+		if id != start {
+			time.Sleep(settle)
+			return nil
+		}
+	}
+	return ErrTimeout
+}
+
+// Type types text into the focused window
+func Type(text string) error {
+	return keyboard.Type(text)
+}
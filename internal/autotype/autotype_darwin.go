@@ -0,0 +1,44 @@
+package autotype
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// darwinKeyboard types through System Events, which needs lockbox's
+// terminal to be allowed under Accessibility in Privacy & Security
+type darwinKeyboard struct{}
+
+func platformKeyboard() Keyboard { return darwinKeyboard{} }
+
+func (darwinKeyboard) Focused() (string, error) {
+	out, err := osascript(`tell application "System Events" to get unix id of first process whose frontmost is true`)
+	return strings.TrimSpace(out), err
+}
+
+// Type passes the script on stdin, so the text is never in arguments
+func (darwinKeyboard) Type(text string) error {
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+	_, err := osascript(`tell application "System Events" to keystroke "` + quoted + `"`)
+	return err
+}
+
+func osascript(script string) (string, error) {
+	cmd := exec.Command("osascript", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%w: osascript not found", ErrUnavailable)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("System Events failed: %s", msg)
+		}
+		return "", fmt.Errorf("System Events failed: %w", err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,65 @@
+package autotype
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Xdotool and Wtype are the X11 and Wayland typing tools, replaced in
+// tests
+var (
+	Xdotool = "xdotool"
+	Wtype   = "wtype"
+)
+
+// linuxKeyboard types with wtype under Wayland, which uses the virtual
+// keyboard protocol, and xdotool under X11. Wayland does not let clients
+// see which window is focused.
+type linuxKeyboard struct{}
+
+func platformKeyboard() Keyboard { return linuxKeyboard{} }
+
+func (linuxKeyboard) Focused() (string, error) {
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		return "", ErrNoFocus
+	case os.Getenv("DISPLAY") == "":
+		return "", fmt.Errorf("%w: no graphical session", ErrUnavailable)
+	}
+	out, err := run(Xdotool, "", "getactivewindow")
+	return strings.TrimSpace(out), err
+}
+
+func (linuxKeyboard) Type(text string) error {
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		_, err := run(Wtype, text, "-")
+		return err
+	case os.Getenv("DISPLAY") == "":
+		return fmt.Errorf("%w: no graphical session", ErrUnavailable)
+	}
+	_, err := run(Xdotool, text, "type", "--clearmodifiers", "--file", "-")
+	return err
+}
+
+// run runs tool with stdin, returning its output
+func run(tool, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%w: install %s", ErrUnavailable, tool)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s failed: %s", tool, msg)
+		}
+		return "", fmt.Errorf("%s failed: %w", tool, err)
+	}
+	return string(out), nil
+}
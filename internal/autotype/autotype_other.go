@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !windows
+
+package autotype
+
+// noKeyboard is the keyboard of platforms lockbox cannot type on
+type noKeyboard struct{}
+
+func platformKeyboard() Keyboard { return noKeyboard{} }
+
+func (noKeyboard) Focused() (string, error) { return "", ErrUnavailable }
+func (noKeyboard) Type(string) error        { return ErrUnavailable }
@@ -0,0 +1,61 @@
+package autotype
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeKeyboard moves the focus to window 2 after switchAfter polls
+type fakeKeyboard struct {
+	polls, switchAfter int
+	err                error
+	typed              string
+}
+
+func (k *fakeKeyboard) Focused() (string, error) {
+	if k.err != nil {
+		return "", k.err
+	}
+	k.polls++
+	if k.switchAfter > 0 && k.polls > k.switchAfter {
+		return "2", nil
+	}
+	return "1", nil
+}
+
+func (k *fakeKeyboard) Type(text string) error {
+	k.typed += text
+	return nil
+}
+
+func useKeyboard(t *testing.T, k Keyboard) {
+	t.Helper()
+	saved, savedPoll, savedSettle := keyboard, PollInterval, settle
+	keyboard, PollInterval, settle = k, time.Millisecond, 0
+	t.Cleanup(func() { keyboard, PollInterval, settle = saved, savedPoll, savedSettle })
+}
+
+func TestWaitForFocus(t *testing.T) {
+	k := &fakeKeyboard{switchAfter: 3}
+	useKeyboard(t, k)
+	if err := WaitForFocus(time.Second); err != nil {
+		t.Fatalf("WaitForFocus: %v", err)
+	}
+	if k.polls != 4 {
+		t.Errorf("Expected 4 polls, got %d", k.polls)
+	}
+	if err := Type("s3cr3t"); err != nil || k.typed != "s3cr3t" {
+		t.Errorf("Type typed %q, %v", k.typed, err)
+	}
+
+	useKeyboard(t, &fakeKeyboard{})
+	if err := WaitForFocus(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout when the focus stays, got %v", err)
+	}
+
+	useKeyboard(t, &fakeKeyboard{err: ErrNoFocus})
+	if err := WaitForFocus(time.Second); !errors.Is(err, ErrNoFocus) {
+		t.Errorf("Expected ErrNoFocus, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package autotype
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// typeScript reads the text from stdin and sends it with SendKeys, braced
+// so that characters SendKeys treats as keys are typed as themselves
+const typeScript = `Add-Type -AssemblyName System.Windows.Forms
+$text = [Console]::In.ReadToEnd() -replace '[+^%~(){}\[\]]', '{$0}' -replace "\r?\n", '{ENTER}'
+[System.Windows.Forms.SendKeys]::SendWait($text)`
+
+// windowsKeyboard types with SendKeys. Telling the focused window would
+// start PowerShell on every poll, so a delay is used instead.
+type windowsKeyboard struct{}
+
+func platformKeyboard() Keyboard { return windowsKeyboard{} }
+
+func (windowsKeyboard) Focused() (string, error) {
+	return "", ErrNoFocus
+}
+
+func (windowsKeyboard) Type(text string) error {
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", typeScript)
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("SendKeys failed: %s", msg)
+		}
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return nil
+}
@@ -0,0 +1,630 @@
+// Package backup writes chains of store backups to a directory: a full
+// copy of the store followed by increments holding only the secrets
+// written or deleted since the previous backup, found through the
+// per-secret versions the store keeps.
+//
+// A manifest.json in the directory lists every backup with its SHA-256,
+// so a chain can be verified before anything is restored from it. A full
+// backup is a SQLite copy of the store; an increment is JSON lines, a
+// header followed by one db.Change per line. Both hold ciphertexts still
+// encrypted with the store key, and the store key itself. A chain can be
+// sealed (see seal.go): compressed, and encrypted to recipients of its own
+// so that restoring does not depend on the store key. Temporary secrets
+// are left out of a chain unless it is started with IncludeTemp.
+package backup
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/health"
+)
+
+// Store config entries naming the chain the store's increments extend, how
+// its files are sealed and whether they hold temporary secrets
+const (
+	ChainConfig   = "backup_chain"
+	SealingConfig = "backup_sealing"
+	TempConfig    = "backup_temp"
+)
+
+// manifestName is the manifest file in a backup directory
+const manifestName = "manifest.json"
+
+// incrementFormat identifies the header line of an increment
+const incrementFormat = "lockbox-increment/1"
+
+// Backup types
+const (
+	TypeFull        = "full"
+	TypeIncremental = "incremental"
+)
+
+// Backup is one file of a chain
+type Backup struct {
+	File  string `json:"file"`
+	Chain string `json:"chain"`
+	Type  string `json:"type"`
+	// Since is the revision the increment starts after
+	Since uint64 `json:"since,omitzero"`
+	// Revision is the store revision the backup covers
+	Revision uint64    `json:"revision"`
+	Created  time.Time `json:"created"`
+	Changes  int       `json:"changes,omitzero"`
+	SHA256   string    `json:"sha256"`
+	// Compression is set for sealed files, and Recipients for encrypted
+	// ones; plain files have neither
+	Compression string   `json:"compression,omitempty"`
+	Recipients  []string `json:"recipients,omitempty"`
+}
+
+// Manifest lists the backups in a directory, oldest first
+type Manifest struct {
+	Backups []Backup `json:"backups"`
+}
+
+// header is the first line of an increment
+type header struct {
+	Format   string    `json:"format"`
+	Chain    string    `json:"chain"`
+	Since    uint64    `json:"since"`
+	Revision uint64    `json:"revision"`
+	Created  time.Time `json:"created"`
+	// Config is every store config entry, which is small and unversioned
+	Config map[string][]byte `json:"config"`
+	// Vaults names every vault but the default, likewise unversioned;
+	// increments written before vaults existed have none
+	Vaults []string `json:"vaults"`
+}
+
+// change is one line of an increment after the header
+type change struct {
+	Vault       string    `json:"vault,omitempty"`
+	Key         string    `json:"key"`
+	Version     uint64    `json:"version"`
+	Deleted     bool      `json:"deleted,omitempty"`
+	Kind        string    `json:"kind,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Created     time.Time `json:"created,omitzero"`
+	Updated     time.Time `json:"updated,omitzero"`
+	Digest      string    `json:"digest,omitempty"`
+	Value       []byte    `json:"value,omitempty"`
+	Expires     time.Time `json:"expires,omitzero"`
+	Expiry      time.Time `json:"expiry,omitzero"`
+	Tags        []string  `json:"tags,omitempty"`
+	Description string    `json:"description,omitempty"`
+}
+
+// ReadManifest reads the manifest of dir; a directory without one has no
+// backups
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return m, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("backup manifest is corrupt: %w", err)
+	}
+	return m, nil
+}
+
+// Last returns the newest backup
+func (m Manifest) Last() (Backup, bool) {
+	if len(m.Backups) == 0 {
+		return Backup{}, false
+	}
+	return m.Backups[len(m.Backups)-1], true
+}
+
+// Chain returns the backups of chain id, oldest first
+func (m Manifest) Chain(id string) []Backup {
+	var chain []Backup
+	for _, b := range m.Backups {
+		if b.Chain == id {
+			chain = append(chain, b)
+		}
+	}
+	return chain
+}
+
+// write replaces the manifest of dir
+func (m Manifest) write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+	return writeFile(filepath.Join(dir, manifestName), append(data, '\n'))
+}
+
+// writeFile writes data to path through a synced temporary file, so path
+// is either old or complete
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// fileName names the nth backup in a directory
+func fileName(n int, kind string) string {
+	if kind == TypeFull {
+		return fmt.Sprintf("%04d-full.db", n)
+	}
+	return fmt.Sprintf("%04d-incremental.jsonl", n)
+}
+
+// hashFile returns the hex SHA-256 of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// record appends b to the manifest of dir and notes the backup time in
+// store for the readiness check
+func record(store *db.Store, dir string, m Manifest, b Backup) error {
+	m.Backups = append(m.Backups, b)
+	if err := m.write(dir); err != nil {
+		return err
+	}
+	return store.SetConfig(health.LastBackupConfigKey, []byte(b.Created.Format(time.RFC3339)))
+}
+
+// Options chooses how the files of a new chain are written. With no
+// compression and no recipients they are written plain.
+type Options struct {
+	// Compression names one of Compressors
+	Compression string
+	// Recipients can each decrypt the chain on their own; none leaves it
+	// readable by anyone holding the files
+	Recipients []Recipient
+	// IncludeTemp keeps temporary secrets in the chain, which otherwise
+	// leaves them out as if they did not exist
+	IncludeTemp bool
+}
+
+// Full writes a full backup of store, whose key is storeKey, to dir,
+// starting a new chain sealed as opts asks
+func Full(store *db.Store, storeKey []byte, dir string, opts Options) (Backup, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return Backup{}, err
+	}
+	seal, err := newSealing(opts, storeKey)
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Backup{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	b := Backup{
+		File:    fileName(len(m.Backups)+1, TypeFull),
+		Chain:   hex.EncodeToString(id),
+		Type:    TypeFull,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if seal != nil {
+		b.Compression, b.Recipients = seal.Compression, seal.Described
+		data, _ := json.Marshal(seal)
+		err = store.SetConfig(SealingConfig, data)
+	} else {
+		err = store.DeleteConfig(SealingConfig)
+	}
+	if err != nil {
+		return Backup{}, err
+	}
+	if opts.IncludeTemp {
+		err = store.SetConfig(TempConfig, []byte("on"))
+	} else {
+		err = store.DeleteConfig(TempConfig)
+	}
+	if err != nil {
+		return Backup{}, err
+	}
+	// The copy records the chain too; restores drop it
+	if err := store.SetConfig(ChainConfig, []byte(b.Chain)); err != nil {
+		return Backup{}, err
+	}
+	// Read the revision before copying: writes racing the copy are then
+	// repeated by the next increment rather than missed
+	if b.Revision, err = store.Revision(); err != nil {
+		return Backup{}, err
+	}
+
+	path := filepath.Join(dir, b.File)
+	snapshot := filepath.Join(dir, "."+b.File+".snapshot")
+	if err := db.Backup(store.Path(), snapshot); err != nil {
+		return Backup{}, err
+	}
+	defer os.Remove(snapshot)
+	if !opts.IncludeTemp {
+		if err := dropTempSecrets(snapshot); err != nil {
+			return Backup{}, err
+		}
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer f.Close()
+	out, err := create(path, seal)
+	if err != nil {
+		return Backup{}, err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.abort()
+		return Backup{}, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if b.SHA256, err = out.commit(); err != nil {
+		return Backup{}, err
+	}
+	return b, record(store, dir, m, b)
+}
+
+// Incremental writes the secrets written or deleted since the last backup
+// in dir, which must be of store's chain, sealed like the rest of the chain
+func Incremental(store *db.Store, storeKey []byte, dir string) (Backup, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return Backup{}, err
+	}
+	last, ok := m.Last()
+	if !ok {
+		return Backup{}, fmt.Errorf("no backups in %s; take a full backup first", dir)
+	}
+	chain, err := store.GetConfig(ChainConfig)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return Backup{}, err
+	}
+	if string(chain) != last.Chain {
+		return Backup{}, fmt.Errorf("the last backup in %s is not of this store; take a full backup first", dir)
+	}
+	var seal *sealing
+	if data, err := store.GetConfig(SealingConfig); err == nil {
+		if seal, err = loadSealing(data, storeKey); err != nil {
+			return Backup{}, err
+		}
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return Backup{}, err
+	}
+
+	b := Backup{
+		File:    fileName(len(m.Backups)+1, TypeIncremental),
+		Chain:   last.Chain,
+		Type:    TypeIncremental,
+		Since:   last.Revision,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if seal != nil {
+		b.Compression, b.Recipients = seal.Compression, seal.Described
+	}
+	if b.Revision, err = store.Revision(); err != nil {
+		return Backup{}, err
+	}
+	_, err = store.GetConfig(TempConfig)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return Backup{}, err
+	}
+	includeTemp := err == nil
+	if b.Revision < b.Since {
+		return Backup{}, fmt.Errorf("store revision %d is older than the last backup's %d", b.Revision, b.Since)
+	}
+	config, err := store.ListConfig()
+	if err != nil {
+		return Backup{}, err
+	}
+	vaults, err := store.ListVaults()
+	if err != nil {
+		return Backup{}, err
+	}
+	names := []string{}
+	for _, v := range vaults {
+		names = append(names, v.Name)
+	}
+
+	out, err := create(filepath.Join(dir, b.File), seal)
+	if err != nil {
+		return Backup{}, err
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	enc.Encode(header{Format: incrementFormat, Chain: b.Chain, Since: b.Since, Revision: b.Revision, Created: b.Created, Config: config, Vaults: names})
+	err = store.Changes(b.Since, func(c db.Change) error {
+		b.Changes++
+		if !c.Expires.IsZero() && !includeTemp {
+			// Left out of the chain, so gone from it
+			return enc.Encode(change{Vault: c.Vault, Key: c.Key, Version: c.Version, Deleted: true})
+		}
+		return enc.Encode(change{
+			Vault: c.Vault, Key: c.Key, Version: c.Version, Deleted: c.Deleted, Kind: c.Kind, Owner: c.Owner,
+			Created: c.Created.UTC(), Updated: c.Updated.UTC(), Digest: c.Digest, Value: c.Value, Expires: c.Expires,
+			Expiry: c.Expiry.UTC(), Tags: c.Tags, Description: c.Description,
+		})
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		out.abort()
+		return Backup{}, fmt.Errorf("failed to write increment: %w", err)
+	}
+	if b.SHA256, err = out.commit(); err != nil {
+		return Backup{}, err
+	}
+	return b, record(store, dir, m, b)
+}
+
+// Verify checks every chain in dir: each file must match its recorded
+// SHA-256, each chain must start with a full backup, and each increment
+// must start at the revision where the previous backup ended and parse.
+// Encrypted increments are only parsed when one of ids can decrypt them.
+// It returns the newest chain, ready for Restore.
+func Verify(dir string, ids ...Identity) ([]Backup, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	last, ok := m.Last()
+	if !ok {
+		return nil, fmt.Errorf("no backups in %s", dir)
+	}
+
+	o := newOpener(ids)
+	prev := map[string]Backup{}
+	for _, b := range m.Backups {
+		sum, err := hashFile(filepath.Join(dir, b.File))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.File, err)
+		}
+		if sum != b.SHA256 {
+			return nil, fmt.Errorf("%s: checksum mismatch, the file is corrupt or was modified", b.File)
+		}
+
+		p, ok := prev[b.Chain]
+		switch {
+		case b.Type == TypeFull && ok:
+			return nil, fmt.Errorf("%s: second full backup in chain %s", b.File, b.Chain)
+		case b.Type == TypeIncremental && !ok:
+			return nil, fmt.Errorf("%s: chain %s has no full backup before it", b.File, b.Chain)
+		case b.Type == TypeIncremental && b.Since != p.Revision:
+			return nil, fmt.Errorf("%s: starts after revision %d but %s ends at %d", b.File, b.Since, p.File, p.Revision)
+		case b.Type != TypeFull && b.Type != TypeIncremental:
+			return nil, fmt.Errorf("%s: unknown backup type %q", b.File, b.Type)
+		}
+		if b.Type == TypeIncremental {
+			_, err := readIncrement(o, dir, b, func(db.Change) error { return nil })
+			if errors.Is(err, errNoIdentity) && len(ids) == 0 {
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		prev[b.Chain] = b
+	}
+	return m.Chain(last.Chain), nil
+}
+
+// readIncrement reads the increment b in dir, checking its header against
+// the manifest, and calls fn with each change
+func readIncrement(o *opener, dir string, b Backup, fn func(db.Change) error) (header, error) {
+	var h header
+	f, err := o.open(filepath.Join(dir, b.File), b)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return h, fmt.Errorf("%s: %w", b.File, err)
+		}
+		return h, fmt.Errorf("%s: increment is empty", b.File)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Format != incrementFormat {
+		return h, fmt.Errorf("%s: not a lockbox increment", b.File)
+	}
+	if h.Chain != b.Chain || h.Since != b.Since || h.Revision != b.Revision {
+		return h, fmt.Errorf("%s: header does not match the manifest", b.File)
+	}
+	n := 0
+	for line := 2; scanner.Scan(); line++ {
+		var c change
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return h, fmt.Errorf("%s: line %d is corrupt: %w", b.File, line, err)
+		}
+		n++
+		err := fn(db.Change{
+			Vault: c.Vault, Key: c.Key, Version: c.Version, Deleted: c.Deleted, Kind: c.Kind, Owner: c.Owner,
+			Created: c.Created, Updated: c.Updated, Digest: c.Digest, Value: c.Value, Expires: c.Expires,
+			Expiry: c.Expiry, Tags: c.Tags, Description: c.Description,
+		})
+		if err != nil {
+			return h, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return h, fmt.Errorf("%s: %w", b.File, err)
+	}
+	if n != b.Changes {
+		return h, fmt.Errorf("%s: has %d changes, the manifest records %d", b.File, n, b.Changes)
+	}
+	return h, nil
+}
+
+// Restore verifies dir and rebuilds the store as of its newest backup at
+// dest, which must not exist: the chain's full backup with each increment
+// applied in order. An encrypted chain needs one of ids. The restored
+// store starts no chain of its own.
+func Restore(dir, dest string, ids ...Identity) ([]Backup, error) {
+	chain, err := Verify(dir, ids...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%s already exists", dest)
+	}
+
+	o := newOpener(ids)
+	if err := restoreFull(o, dir, chain[0], dest); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+	if err := apply(o, dir, chain[1:], dest); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+	return chain, nil
+}
+
+// restoreFull writes the store in the full backup b to dest
+func restoreFull(o *opener, dir string, b Backup, dest string) error {
+	r, err := o.open(filepath.Join(dir, b.File), b)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", b.File, err)
+	}
+	return f.Close()
+}
+
+// apply writes the increments in dir to the store at dest
+func apply(o *opener, dir string, increments []Backup, dest string) error {
+	store, err := db.OpenStore(dest)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var config map[string][]byte
+	var vaults []string
+	for _, b := range increments {
+		h, err := readIncrement(o, dir, b, tx.ApplyChange)
+		if err != nil {
+			return err
+		}
+		config, vaults = h.Config, h.Vaults
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Vaults are also whole in every increment; the secrets of a deleted
+	// vault are already gone with their tombstones
+	if vaults != nil {
+		current, err := store.ListVaults()
+		if err != nil {
+			return err
+		}
+		for _, v := range current {
+			if !slices.Contains(vaults, v.Name) {
+				if _, err := store.DeleteVault(v.Name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, name := range vaults {
+			if ok, err := store.HasVault(name); err != nil {
+				return err
+			} else if !ok {
+				if err := store.CreateVault(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Config is whole in every increment, so the newest replaces the base's
+	if config != nil {
+		current, err := store.ListConfig()
+		if err != nil {
+			return err
+		}
+		for key := range current {
+			if _, ok := config[key]; !ok {
+				if err := store.DeleteConfig(key); err != nil {
+					return err
+				}
+			}
+		}
+		for key, value := range config {
+			if err := store.SetConfig(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{SealingConfig, TempConfig} {
+		if err := store.DeleteConfig(key); err != nil {
+			return err
+		}
+	}
+	return store.DeleteConfig(ChainConfig)
+}
+
+// dropTempSecrets deletes the temporary secrets from the store copy at
+// path, vacuuming so that no trace of their ciphertexts is left
+func dropTempSecrets(path string) error {
+	store, err := db.OpenStore(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if n, err := store.DropTempSecrets(); err != nil || n == 0 {
+		return err
+	}
+	return store.Vacuum()
+}
@@ -0,0 +1,293 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+var testKey = make([]byte, 32)
+
+func newStore(t *testing.T, path string) *db.Store {
+	t.Helper()
+	store, err := db.OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// contents returns every secret of store as key => kind/owner/value
+func contents(t *testing.T, store *db.Store) map[string]string {
+	t.Helper()
+	keys, err := store.ListAllSecrets()
+	if err != nil {
+		t.Fatalf("Failed to list secrets: %v", err)
+	}
+	m := map[string]string{}
+	for _, key := range keys {
+		value, err := store.GetSecret(key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		owner, _ := store.SecretOwner(key)
+		m[key] = owner + "/" + string(value)
+	}
+	return m
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	store.SetConfig("encryption_key", []byte("k1"))
+	store.SetSecret("KEEP", []byte("keep"))
+	store.SetSecret("CHANGE", []byte("old"))
+	store.SetSecret("DELETE", []byte("gone"))
+	setTemp(t, store, "TEMP", "temp")
+
+	if _, err := Incremental(store, testKey, backups); err == nil {
+		t.Error("Incremental succeeded without a full backup")
+	}
+	full, err := Full(store, testKey, backups, Options{})
+	if err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+
+	store.SetSecretBlob("CHANGE", "digest-new", []byte("new"))
+	store.SetSecretBlob("SHARED", "digest-new", []byte("new"))
+	store.DeleteSecret("DELETE")
+	store.SetKindSecret("note", "note/n", []byte("note"))
+	store.SetSecretOwner("KEEP", "uid:1000")
+	store.SetConfig("escrow_archive", []byte("/tmp/escrow"))
+	store.CreateVault("team")
+	store.InVault("team").SetSecret("KEEP", []byte("team"))
+	setTemp(t, store, "TEMP_TOO", "temp")
+	first, err := Incremental(store, testKey, backups)
+	if err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+	if first.Since != full.Revision || first.Changes != 7 {
+		t.Errorf("increment since %d with %d changes, want since %d with 7", first.Since, first.Changes, full.Revision)
+	}
+
+	store.SetSecret("DELETE", []byte("back"))
+	second, err := Incremental(store, testKey, backups)
+	if err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+	if second.Since != first.Revision || second.Changes != 1 {
+		t.Errorf("increment since %d with %d changes, want since %d with 1", second.Since, second.Changes, first.Revision)
+	}
+
+	chain, err := Verify(backups)
+	if err != nil || len(chain) != 3 {
+		t.Fatalf("Verify = %d backups, %v", len(chain), err)
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backups, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	rs := newStore(t, restored)
+	want, got := contents(t, store), contents(t, rs)
+	// Temporary secrets are not backed up
+	delete(want, "TEMP")
+	delete(want, "TEMP_TOO")
+	if len(got) != len(want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("restored %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if ok, _ := rs.HasVault("team"); !ok {
+		t.Error("vault not restored")
+	}
+	if v, _ := rs.InVault("team").GetSecret("KEEP"); string(v) != "team" {
+		t.Errorf("restored team/KEEP = %q", v)
+	}
+	if v, _ := rs.GetConfig("escrow_archive"); string(v) != "/tmp/escrow" {
+		t.Errorf("config not restored, escrow_archive = %q", v)
+	}
+	if _, err := rs.GetConfig(ChainConfig); err != db.ErrNotFound {
+		t.Errorf("restored store still extends the chain: %v", err)
+	}
+	if _, err := Restore(backups, restored); err == nil {
+		t.Error("Restore overwrote an existing store")
+	}
+
+	// The restored store is not the chain's source
+	if _, err := Incremental(rs, testKey, backups); err == nil {
+		t.Error("Incremental extended another store's chain")
+	}
+}
+
+// setTemp writes a temporary secret expiring in an hour
+func setTemp(t *testing.T, store *db.Store, key, value string) {
+	t.Helper()
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	if err := tx.SetSecretBlob(key, "digest-"+value, []byte(value)); err != nil {
+		t.Fatalf("Failed to set %s: %v", key, err)
+	}
+	if err := tx.SetTemporary(key, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to make %s temporary: %v", key, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+}
+
+func TestIncludeTemp(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	setTemp(t, store, "TEMP", "temp")
+	if _, err := Full(store, testKey, backups, Options{IncludeTemp: true}); err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+	setTemp(t, store, "TEMP_TOO", "temp")
+	if _, err := Incremental(store, testKey, backups); err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backups, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	temp, err := newStore(t, restored).TempSecrets()
+	if err != nil || len(temp) != 2 {
+		t.Fatalf("restored temporary secrets = %v, %v", temp, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	soon := time.Now().Add(time.Hour).Truncate(time.Second)
+	later := soon.Add(time.Hour)
+	store.SetSecret("EXPIRING", []byte("old"))
+	store.SetExpiry("EXPIRING", soon)
+	store.SetSecret("LATER", []byte("later"))
+	if _, err := Full(store, testKey, backups, Options{}); err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+
+	store.SetSecret("EXPIRING", []byte("new"))
+	store.SetExpiry("EXPIRING", soon)
+	store.SetExpiry("LATER", later)
+	if _, err := Incremental(store, testKey, backups); err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backups, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	rs := newStore(t, restored)
+	for key, want := range map[string]time.Time{"EXPIRING": soon, "LATER": later} {
+		if got, err := rs.SecretExpiry(key); err != nil || !got.Equal(want) {
+			t.Errorf("restored expiry of %s = %v, %v, want %v", key, got, err, want)
+		}
+	}
+	if temp, _ := rs.TempSecrets(); len(temp) != 0 {
+		t.Errorf("expiring secrets restored as temporary: %v", temp)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	store.SetSecret("TAGGED", []byte("tagged"))
+	store.SetSecretMeta("TAGGED", db.Meta{Tags: []string{"old"}, Description: "before"})
+	store.SetSecret("UNTAGGED", []byte("untagged"))
+	store.SetSecretMeta("UNTAGGED", db.Meta{Tags: []string{"gone"}})
+	store.SetSecret("NEW", []byte("new"))
+	full, err := Full(store, testKey, backups, Options{})
+	if err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+
+	// Metadata-only changes
+	store.SetSecretMeta("TAGGED", db.Meta{Tags: []string{"prod", "db"}, Description: "after"})
+	store.SetSecretMeta("UNTAGGED", db.Meta{})
+	store.SetSecretMeta("NEW", db.Meta{Description: "added"})
+	inc, err := Incremental(store, testKey, backups)
+	if err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+	if inc.Since != full.Revision || inc.Changes != 3 {
+		t.Errorf("increment since %d with %d changes, want since %d with 3", inc.Since, inc.Changes, full.Revision)
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if _, err := Restore(backups, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	rs := newStore(t, restored)
+	for _, key := range []string{"TAGGED", "UNTAGGED", "NEW"} {
+		want, _ := store.SecretMeta(key)
+		got, err := rs.SecretMeta(key)
+		if err != nil || strings.Join(got.Tags, ",") != strings.Join(want.Tags, ",") || got.Description != want.Description {
+			t.Errorf("restored metadata of %s = %+v, %v, want %+v", key, got, err, want)
+		}
+	}
+}
+
+func TestVerifyDetectsDamage(t *testing.T) {
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		store := newStore(t, filepath.Join(dir, "lockbox.db"))
+		store.SetSecret("A", []byte("a"))
+		if _, err := Full(store, testKey, dir, Options{}); err != nil {
+			t.Fatalf("Full failed: %v", err)
+		}
+		store.SetSecret("B", []byte("b"))
+		if _, err := Incremental(store, testKey, dir); err != nil {
+			t.Fatalf("Incremental failed: %v", err)
+		}
+		return dir
+	}
+
+	t.Run("modified increment", func(t *testing.T) {
+		dir := setup(t)
+		path := filepath.Join(dir, "0002-incremental.jsonl")
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path, append(data, '\n'), 0600)
+		if _, err := Verify(dir); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("Verify = %v, want checksum error", err)
+		}
+	})
+
+	t.Run("missing base", func(t *testing.T) {
+		dir := setup(t)
+		os.Remove(filepath.Join(dir, "0001-full.db"))
+		if _, err := Verify(dir); err == nil {
+			t.Error("Verify passed without the full backup")
+		}
+	})
+
+	t.Run("gap in chain", func(t *testing.T) {
+		dir := setup(t)
+		m, _ := ReadManifest(dir)
+		m.Backups[1].Since--
+		data, _ := json.Marshal(m)
+		os.WriteFile(filepath.Join(dir, manifestName), data, 0600)
+		if _, err := Verify(dir); err == nil || !strings.Contains(err.Error(), "starts after") {
+			t.Errorf("Verify = %v, want chain error", err)
+		}
+	})
+}
@@ -0,0 +1,529 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// A sealed backup file starts with a JSON header line recording how the
+// rest of it was written: compressed by a Compressor, then, when the chain
+// has recipients, encrypted in chunks with a key derived from a random
+// chain key. The chain key is wrapped to each recipient in the header, so
+// any one of them can restore without the store key.
+
+// sealedFormat identifies the header line of a sealed file
+const sealedFormat = "lockbox-backup-file/1"
+
+// Cipher names recorded in headers
+const cipherName = "aes-256-gcm-stream"
+
+// chunkSize is the plaintext size of each encrypted chunk
+const chunkSize = 64 << 10
+
+// Info strings binding derived keys to their use
+const (
+	wrapInfo = "lockbox backup key v1"
+	fileInfo = "lockbox backup file v1\n"
+)
+
+// passphraseIterations is the PBKDF2-SHA256 work factor for new passphrase
+// recipients
+var passphraseIterations = 600_000
+
+// Compressor compresses backup files
+type Compressor struct {
+	Writer func(w io.Writer) io.WriteCloser
+	Reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Compressors are the compressions a sealed file can record, by name
+var Compressors = map[string]Compressor{
+	"none": {
+		Writer: func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+		Reader: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil },
+	},
+	"gzip": {
+		Writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		Reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Stanza is a chain key wrapped to one recipient
+type Stanza struct {
+	Type string `json:"type"`
+	// Fingerprint and Ephemeral are set for x25519 recipients
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Ephemeral   []byte `json:"ephemeral,omitempty"`
+	// Salt and Iterations are set for passphrase recipients
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Wrapped    []byte `json:"wrapped"`
+}
+
+// Recipient can be given the chain key of a backup
+type Recipient interface {
+	Wrap(chainKey []byte) (Stanza, error)
+	String() string
+}
+
+// Identity recovers a chain key from a stanza, returning ErrNotRecipient
+// for stanzas wrapped to someone else
+type Identity interface {
+	Unwrap(s Stanza) ([]byte, error)
+}
+
+// ErrNotRecipient means a stanza is not for the identity
+var ErrNotRecipient = errors.New("not a recipient")
+
+// X25519Recipient wraps to an X25519 public key, such as one made by
+// 'lockbox bundle keygen'
+type X25519Recipient struct {
+	Key *ecdh.PublicKey
+}
+
+func (r X25519Recipient) Wrap(chainKey []byte) (Stanza, error) {
+	ephemeral, wrapped, err := crypto.Seal(chainKey, r.Key, wrapInfo)
+	if err != nil {
+		return Stanza{}, err
+	}
+	return Stanza{Type: "x25519", Fingerprint: bundle.Fingerprint(r.Key.Bytes()), Ephemeral: ephemeral, Wrapped: wrapped}, nil
+}
+
+func (r X25519Recipient) String() string {
+	return "x25519 " + bundle.Fingerprint(r.Key.Bytes())
+}
+
+// X25519Identity is the private half of an X25519Recipient
+type X25519Identity struct {
+	Key *ecdh.PrivateKey
+}
+
+func (id X25519Identity) Unwrap(s Stanza) ([]byte, error) {
+	if s.Type != "x25519" || s.Fingerprint != bundle.Fingerprint(id.Key.PublicKey().Bytes()) {
+		return nil, ErrNotRecipient
+	}
+	return crypto.Unseal(s.Ephemeral, s.Wrapped, id.Key, wrapInfo)
+}
+
+// PassphraseRecipient wraps with a key derived from a passphrase
+type PassphraseRecipient struct {
+	Passphrase string
+}
+
+func (r PassphraseRecipient) Wrap(chainKey []byte) (Stanza, error) {
+	s := Stanza{Type: "passphrase", Salt: make([]byte, 16), Iterations: passphraseIterations}
+	rand.Read(s.Salt)
+	key, err := pbkdf2.Key(sha256.New, r.Passphrase, s.Salt, s.Iterations, crypto.KeySize)
+	if err != nil {
+		return Stanza{}, fmt.Errorf("failed to derive passphrase key: %w", err)
+	}
+	if s.Wrapped, err = crypto.Encrypt(chainKey, key); err != nil {
+		return Stanza{}, err
+	}
+	return s, nil
+}
+
+func (PassphraseRecipient) String() string {
+	return "passphrase"
+}
+
+// PassphraseIdentity unwraps stanzas of a PassphraseRecipient
+type PassphraseIdentity struct {
+	Passphrase string
+}
+
+func (id PassphraseIdentity) Unwrap(s Stanza) ([]byte, error) {
+	if s.Type != "passphrase" {
+		return nil, ErrNotRecipient
+	}
+	key, err := pbkdf2.Key(sha256.New, id.Passphrase, s.Salt, s.Iterations, crypto.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive passphrase key: %w", err)
+	}
+	chainKey, err := crypto.Decrypt(s.Wrapped, key)
+	if err != nil {
+		// A wrong passphrase is indistinguishable from another passphrase
+		return nil, ErrNotRecipient
+	}
+	return chainKey, nil
+}
+
+// sealedHeader is the first line of a sealed file
+type sealedHeader struct {
+	Format      string   `json:"format"`
+	Compression string   `json:"compression"`
+	Cipher      string   `json:"cipher,omitempty"`
+	Salt        []byte   `json:"salt,omitempty"`
+	Recipients  []Stanza `json:"recipients,omitempty"`
+}
+
+// sealing is how the files of a chain are sealed. It is kept in the store
+// so increments can be written without any recipient's secret.
+type sealing struct {
+	Compression string   `json:"compression"`
+	Recipients  []Stanza `json:"recipients,omitempty"`
+	Described   []string `json:"described,omitempty"`
+	// Key is the chain key, encrypted with the store key
+	Key []byte `json:"key,omitempty"`
+
+	chainKey []byte
+}
+
+// newSealing returns the sealing for a new chain with opts
+func newSealing(opts Options, storeKey []byte) (*sealing, error) {
+	if opts.Compression == "" && len(opts.Recipients) == 0 {
+		return nil, nil
+	}
+	s := &sealing{Compression: opts.Compression}
+	if s.Compression == "" {
+		s.Compression = "none"
+	}
+	if _, ok := Compressors[s.Compression]; !ok {
+		return nil, fmt.Errorf("unknown compression %q", s.Compression)
+	}
+	if len(opts.Recipients) == 0 {
+		return s, nil
+	}
+
+	s.chainKey = make([]byte, crypto.KeySize)
+	rand.Read(s.chainKey)
+	for _, r := range opts.Recipients {
+		stanza, err := r.Wrap(s.chainKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap backup key to %s: %w", r, err)
+		}
+		s.Recipients = append(s.Recipients, stanza)
+		s.Described = append(s.Described, r.String())
+	}
+	var err error
+	if s.Key, err = crypto.Encrypt(s.chainKey, storeKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rekey returns the store's sealing config with the chain key
+// re-encrypted from oldKey to newKey, for the caller to write along with
+// the rest of a key rotation. It is empty when the chain is not sealed.
+func Rekey(store *db.Store, oldKey, newKey []byte) (map[string][]byte, error) {
+	data, err := store.GetConfig(SealingConfig)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s, err := loadSealing(data, oldKey)
+	if err != nil || s.chainKey == nil {
+		return nil, err
+	}
+	defer clear(s.chainKey)
+	if s.Key, err = crypto.Encrypt(s.chainKey, newKey); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(s); err != nil {
+		return nil, err
+	}
+	return map[string][]byte{SealingConfig: data}, nil
+}
+
+// loadSealing returns the sealing of store's chain, nil if it is plain
+func loadSealing(data []byte, storeKey []byte) (*sealing, error) {
+	var s sealing
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("stored backup settings are corrupt: %w", err)
+	}
+	if len(s.Key) > 0 {
+		var err error
+		if s.chainKey, err = crypto.Decrypt(s.Key, storeKey); err != nil {
+			return nil, fmt.Errorf("failed to decrypt backup key: %w", err)
+		}
+	}
+	return &s, nil
+}
+
+// fileKey derives the key of one file from the chain key and its header
+func fileKey(chainKey []byte, headerLine []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, chainKey, salt, fileInfo+string(headerLine), crypto.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive file key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of chunk n: its big-endian index, then 1 for the
+// final chunk, so reordered, dropped or truncated chunks fail to open
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// output writes a backup file through a temporary file, sealed as the
+// chain requires, hashing what reaches the disk
+type output struct {
+	f      *os.File
+	path   string
+	hash   hash.Hash
+	w      io.Writer
+	layers []io.Closer
+}
+
+// create starts writing the backup file path, sealed with s if not nil
+func create(path string, s *sealing) (*output, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	o := &output{f: f, path: path, hash: sha256.New()}
+	o.w = io.MultiWriter(f, o.hash)
+	if s == nil {
+		return o, nil
+	}
+
+	h := sealedHeader{Format: sealedFormat, Compression: s.Compression}
+	if s.chainKey != nil {
+		h.Cipher = cipherName
+		h.Salt = make([]byte, 16)
+		rand.Read(h.Salt)
+		h.Recipients = s.Recipients
+	}
+	line, _ := json.Marshal(h)
+	if _, err := o.w.Write(append(line, '\n')); err != nil {
+		o.abort()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if s.chainKey != nil {
+		aead, err := fileKey(s.chainKey, line, h.Salt)
+		if err != nil {
+			o.abort()
+			return nil, err
+		}
+		enc := &chunkWriter{aead: aead, w: o.w}
+		o.w = enc
+		o.layers = append(o.layers, enc)
+	}
+	comp := Compressors[s.Compression].Writer(o.w)
+	o.w = comp
+	o.layers = append(o.layers, comp)
+	return o, nil
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+// commit finishes the file and moves it into place, returning its SHA-256
+func (o *output) commit() (string, error) {
+	var err error
+	for i := len(o.layers) - 1; i >= 0 && err == nil; i-- {
+		err = o.layers[i].Close()
+	}
+	if err == nil {
+		err = o.f.Sync()
+	}
+	if err == nil {
+		err = o.f.Close()
+	}
+	if err == nil {
+		err = os.Rename(o.path+".tmp", o.path)
+	}
+	if err != nil {
+		o.abort()
+		return "", fmt.Errorf("failed to write %s: %w", o.path, err)
+	}
+	return hex.EncodeToString(o.hash.Sum(nil)), nil
+}
+
+// abort removes the partly written file
+func (o *output) abort() {
+	o.f.Close()
+	os.Remove(o.path + ".tmp")
+}
+
+// chunkWriter encrypts a stream in fixed-size chunks
+type chunkWriter struct {
+	aead cipher.AEAD
+	w    io.Writer
+	buf  []byte
+	n    uint64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	// Hold back a full chunk: only Close knows which chunk is last
+	for len(c.buf) > chunkSize {
+		if err := c.emit(c.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		c.buf = append(c.buf[:0], c.buf[chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (c *chunkWriter) Close() error {
+	return c.emit(c.buf, true)
+}
+
+func (c *chunkWriter) emit(chunk []byte, last bool) error {
+	_, err := c.w.Write(c.aead.Seal(nil, chunkNonce(c.n, last), chunk, nil))
+	c.n++
+	return err
+}
+
+// chunkReader decrypts the output of a chunkWriter
+type chunkReader struct {
+	aead cipher.AEAD
+	r    *bufio.Reader
+	out  []byte
+	n    uint64
+	done bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		buf := make([]byte, chunkSize+c.aead.Overhead())
+		n, err := io.ReadFull(c.r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			_, err := c.r.Peek(1)
+			last = err == io.EOF
+		}
+		plain, err := c.aead.Open(nil, chunkNonce(c.n, last), buf[:n], nil)
+		if err != nil {
+			return 0, errors.New("backup file is corrupt or truncated")
+		}
+		c.n++
+		c.done = last
+		c.out = plain
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// opener opens backup files, unwrapping each chain key once
+type opener struct {
+	ids  []Identity
+	keys map[string][]byte
+}
+
+func newOpener(ids []Identity) *opener {
+	return &opener{ids: ids, keys: map[string][]byte{}}
+}
+
+// errNoIdentity means a sealed file could not be decrypted with the
+// identities given
+var errNoIdentity = errors.New("no identity given can decrypt it")
+
+// chainKey unwraps the chain key from stanzas
+func (o *opener) chainKey(stanzas []Stanza) ([]byte, error) {
+	id, _ := json.Marshal(stanzas)
+	if key, ok := o.keys[string(id)]; ok {
+		return key, nil
+	}
+	for _, s := range stanzas {
+		for _, identity := range o.ids {
+			key, err := identity.Unwrap(s)
+			if errors.Is(err, ErrNotRecipient) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			o.keys[string(id)] = key
+			return key, nil
+		}
+	}
+	return nil, errNoIdentity
+}
+
+// open returns the contents of backup b in dir
+func (o *opener) open(path string, b Backup) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.File, err)
+	}
+	if b.Compression == "" {
+		return f, nil
+	}
+
+	r := bufio.NewReaderSize(f, chunkSize)
+	line, err := r.ReadBytes('\n')
+	var h sealedHeader
+	if err == nil {
+		err = json.Unmarshal(bytes.TrimSuffix(line, []byte("\n")), &h)
+	}
+	if err != nil || h.Format != sealedFormat {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a sealed backup file", b.File)
+	}
+	comp, ok := Compressors[h.Compression]
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s: unknown compression %q", b.File, h.Compression)
+	}
+
+	var body io.Reader = r
+	if h.Cipher != "" {
+		if h.Cipher != cipherName {
+			f.Close()
+			return nil, fmt.Errorf("%s: unknown cipher %q", b.File, h.Cipher)
+		}
+		key, err := o.chainKey(h.Recipients)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", b.File, err)
+		}
+		aead, err := fileKey(key, bytes.TrimSuffix(line, []byte("\n")), h.Salt)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		body = &chunkReader{aead: aead, r: r}
+	}
+	dec, err := comp.Reader(body)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", b.File, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dec, f}, nil
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func init() {
+	// Keep passphrase tests fast
+	passphraseIterations = 1000
+}
+
+func TestSealedChain(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	store.SetSecret("A", []byte("a"))
+
+	admin, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	opts := Options{
+		Compression: "gzip",
+		Recipients:  []Recipient{X25519Recipient{admin.PublicKey()}, PassphraseRecipient{"correct horse"}},
+	}
+	full, err := Full(store, testKey, backups, opts)
+	if err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+	if full.Compression != "gzip" || len(full.Recipients) != 2 {
+		t.Errorf("manifest records %q to %v", full.Compression, full.Recipients)
+	}
+	data, _ := os.ReadFile(filepath.Join(backups, full.File))
+	if bytes.Contains(data, []byte("SQLite format")) {
+		t.Error("full backup is not encrypted")
+	}
+
+	// Increments are sealed the same way without any recipient secret
+	store.SetSecret("B", []byte("b"))
+	inc, err := Incremental(store, testKey, backups)
+	if err != nil {
+		t.Fatalf("Incremental failed: %v", err)
+	}
+	if inc.Compression != "gzip" || len(inc.Recipients) != 2 {
+		t.Errorf("increment sealed with %q to %v", inc.Compression, inc.Recipients)
+	}
+
+	// Checksums and the chain are checked without a key
+	if _, err := Verify(backups); err != nil {
+		t.Errorf("Verify without identities failed: %v", err)
+	}
+	if _, err := Restore(backups, filepath.Join(dir, "none.db")); !errors.Is(err, errNoIdentity) {
+		t.Errorf("Restore without identities = %v, want errNoIdentity", err)
+	}
+	if _, err := Restore(backups, filepath.Join(dir, "other.db"), X25519Identity{other}); !errors.Is(err, errNoIdentity) {
+		t.Errorf("Restore with another key = %v, want errNoIdentity", err)
+	}
+	if _, err := Restore(backups, filepath.Join(dir, "wrong.db"), PassphraseIdentity{"wrong"}); !errors.Is(err, errNoIdentity) {
+		t.Errorf("Restore with a wrong passphrase = %v, want errNoIdentity", err)
+	}
+
+	for name, id := range map[string]Identity{"x25519": X25519Identity{admin}, "passphrase": PassphraseIdentity{"correct horse"}} {
+		dest := filepath.Join(dir, name+".db")
+		if _, err := Restore(backups, dest, id); err != nil {
+			t.Fatalf("Restore with %s failed: %v", name, err)
+		}
+		rs := newStore(t, dest)
+		if got := contents(t, rs); got["A"] != "/a" || got["B"] != "/b" {
+			t.Errorf("restored with %s: %v", name, got)
+		}
+		if _, err := rs.GetConfig(SealingConfig); err != db.ErrNotFound {
+			t.Errorf("restored store kept the chain's sealing: %v", err)
+		}
+	}
+}
+
+func TestSealedFile(t *testing.T) {
+	chainKey := make([]byte, 32)
+	plain := bytes.Repeat([]byte("lockbox "), 3*chunkSize/8+100)
+
+	for _, size := range []int{0, 1, chunkSize, 2 * chunkSize, len(plain)} {
+		for _, comp := range []string{"none", "gzip"} {
+			path := filepath.Join(t.TempDir(), "file")
+			s := &sealing{Compression: comp, chainKey: chainKey, Recipients: []Stanza{{Type: "test"}}}
+			out, err := create(path, s)
+			if err != nil {
+				t.Fatalf("create failed: %v", err)
+			}
+			out.Write(plain[:size])
+			if _, err := out.commit(); err != nil {
+				t.Fatalf("commit failed: %v", err)
+			}
+
+			o := newOpener([]Identity{testIdentity(chainKey)})
+			b := Backup{File: "file", Compression: comp}
+			got, err := readAll(o, path, b)
+			if err != nil || !bytes.Equal(got, plain[:size]) {
+				t.Errorf("%s, %d bytes: read back %d bytes, %v", comp, size, len(got), err)
+			}
+
+			// Dropping the final chunk must not pass as a shorter file
+			data, _ := os.ReadFile(path)
+			if size > chunkSize && comp == "none" {
+				os.WriteFile(path, data[:len(data)-(size%chunkSize)-16], 0600)
+				if _, err := readAll(o, path, b); err == nil || !strings.Contains(err.Error(), "truncated") {
+					t.Errorf("%d bytes: truncated file read with %v", size, err)
+				}
+			}
+		}
+	}
+}
+
+// testIdentity unwraps every stanza to key
+type testIdentity []byte
+
+func (id testIdentity) Unwrap(Stanza) ([]byte, error) { return id, nil }
+
+func readAll(o *opener, path string, b Backup) ([]byte, error) {
+	r, err := o.open(path, b)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	store := newStore(t, filepath.Join(dir, "lockbox.db"))
+	store.SetSecret("A", []byte("a"))
+	if entries, err := Rekey(store, testKey, testKey); err != nil || len(entries) != 0 {
+		t.Errorf("Rekey of an unsealed store = %v, %v", entries, err)
+	}
+
+	opts := Options{Recipients: []Recipient{PassphraseRecipient{"correct horse"}}}
+	if _, err := Full(store, testKey, backups, opts); err != nil {
+		t.Fatalf("Full failed: %v", err)
+	}
+	newKey := bytes.Repeat([]byte{7}, 32)
+	entries, err := Rekey(store, testKey, newKey)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Rekey = %v, %v", entries, err)
+	}
+	for name, data := range entries {
+		store.SetConfig(name, data)
+	}
+
+	// The chain continues under the new store key
+	store.SetSecret("B", []byte("b"))
+	if _, err := Incremental(store, newKey, backups); err != nil {
+		t.Fatalf("Incremental with the new key failed: %v", err)
+	}
+	if _, err := Incremental(store, testKey, backups); err == nil {
+		t.Error("Incremental with the old key succeeded")
+	}
+}
@@ -0,0 +1,288 @@
+// Package batch runs newline-delimited JSON commands against a store in a
+// single transaction, streaming one JSON result per command.
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/selector"
+)
+
+// Secrets is what commands run against: a *db.Store or a *db.Tx
+type Secrets interface {
+	SetSecretBlob(key string, digest string, encryptedValue []byte) error
+	GetSecret(key string) ([]byte, error)
+	DeleteSecret(key string) error
+	ListSecrets() ([]string, error)
+	SecretOwner(key string) (string, error)
+	SetSecretOwner(key, owner string) error
+	SecretMeta(key string) (db.Meta, error)
+	SetSecretMeta(key string, m db.Meta) error
+	SetExpiry(key string, expires time.Time) error
+	RenameSecret(oldKey, newKey string, force bool) error
+}
+
+// Actor is the identity commands run as
+type Actor struct {
+	// Owner is recorded as the owner of secrets the actor creates without
+	// naming one; empty leaves them unowned
+	Owner string
+	// Subjects are the policy subjects the actor acts as
+	Subjects []string
+	// Admin actors may modify secrets owned by anyone
+	Admin bool
+}
+
+// OwnerError is returned when actor may not modify a secret because it is
+// owned by someone else
+type OwnerError struct {
+	Key   string
+	Owner string
+}
+
+func (e *OwnerError) Error() string {
+	return fmt.Sprintf("secret '%s' is owned by %s", e.Key, policy.Describe(e.Owner))
+}
+
+// Command is one line of batch input
+type Command struct {
+	// ID is echoed back in the result to correlate it with the command
+	ID    json.RawMessage `json:"id,omitempty"`
+	Op    string          `json:"op"`
+	Key   string          `json:"key,omitempty"`
+	Value *string         `json:"value,omitempty"`
+	// Owner is the policy subject to own the secret written by set,
+	// e.g. "uid:1000"; empty keeps the current owner
+	Owner string `json:"owner,omitempty"`
+	// Tags replace the tags of the secret written by set, and Description
+	// its description; nil keeps them
+	Tags        []string `json:"tags,omitzero"`
+	Description *string  `json:"description,omitempty"`
+	// Expires is when the secret written by set expires; zero for never
+	Expires time.Time `json:"expires,omitzero"`
+	// To is the new key of the secret rename renames, which must not
+	// exist unless Force replaces it
+	To    string `json:"to,omitempty"`
+	Force bool   `json:"force,omitempty"`
+}
+
+// Result is one line of batch output
+type Result struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Op     string          `json:"op"`
+	Key    string          `json:"key,omitempty"`
+	OK     bool            `json:"ok"`
+	Value  *string         `json:"value,omitempty"`
+	Exists *bool           `json:"exists,omitempty"`
+	Keys   []string        `json:"keys,omitzero"`
+	Count  int             `json:"count,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Run executes the commands read from r in one transaction, writing each
+// result to w as soon as its command has run. The first failing command
+// stops the batch and rolls back every write. A final commit or rollback
+// result reports the outcome; Run returns an error when rolled back.
+//
+// Supported ops are set (key, value, optional owner, tags, description
+// and expires), get (key), delete (key), rename (key, to and optional
+// force), exists (key) and list (optional glob pattern in key). Writes are
+// made as actor.
+func Run(r io.Reader, w io.Writer, store *db.Store, key []byte, actor Actor) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	count := 0
+	for {
+		var cmd Command
+		if err := dec.Decode(&cmd); err == io.EOF {
+			break
+		} else if err != nil {
+			return rollback(enc, fmt.Errorf("invalid command %d: %w", count+1, err))
+		}
+
+		result, err := Execute(tx, key, actor, cmd)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		enc.Encode(result)
+		if err != nil {
+			return rollback(enc, fmt.Errorf("command %d (%s) failed: %w", count+1, cmd.Op, err))
+		}
+		count++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rollback(enc, err)
+	}
+	enc.Encode(Result{Op: "commit", OK: true, Count: count})
+	return nil
+}
+
+// rollback reports that the batch was rolled back because of err
+func rollback(enc *json.Encoder, err error) error {
+	enc.Encode(Result{Op: "rollback", Error: err.Error()})
+	return err
+}
+
+// Execute runs one command against s as actor. Failed commands return
+// their partial result and the error.
+func Execute(s Secrets, key []byte, actor Actor, cmd Command) (Result, error) {
+	result := Result{ID: cmd.ID, Op: cmd.Op, Key: cmd.Key}
+	if cmd.Key == "" && cmd.Op != "list" {
+		return result, fmt.Errorf("key is required")
+	}
+
+	switch cmd.Op {
+	case "set":
+		if cmd.Value == nil {
+			return result, fmt.Errorf("value is required")
+		}
+		if cmd.Owner != "" {
+			if err := policy.ValidateSubject(cmd.Owner); err != nil {
+				return result, err
+			}
+		}
+		for _, tag := range cmd.Tags {
+			if err := db.ValidateTag(tag); err != nil {
+				return result, err
+			}
+		}
+		if !cmd.Expires.IsZero() && !cmd.Expires.After(time.Now()) {
+			return result, fmt.Errorf("expiry %s has already passed", cmd.Expires.Format(time.RFC3339))
+		}
+		exists, err := authorize(s, actor, cmd.Key)
+		if err != nil {
+			return result, err
+		}
+		encrypted, err := crypto.Encrypt([]byte(*cmd.Value), key)
+		if err != nil {
+			return result, fmt.Errorf("failed to encrypt value: %w", err)
+		}
+		digest, err := crypto.Digest([]byte(*cmd.Value), key)
+		if err != nil {
+			return result, fmt.Errorf("failed to digest value: %w", err)
+		}
+		if err := s.SetSecretBlob(cmd.Key, digest, encrypted); err != nil {
+			return result, err
+		}
+		if owner := cmd.Owner; owner != "" || !exists {
+			if owner == "" {
+				owner = actor.Owner
+			}
+			if err := s.SetSecretOwner(cmd.Key, owner); err != nil {
+				return result, err
+			}
+		}
+		if cmd.Tags != nil || cmd.Description != nil {
+			m, err := s.SecretMeta(cmd.Key)
+			if err != nil {
+				return result, err
+			}
+			if cmd.Tags != nil {
+				m.Tags = cmd.Tags
+			}
+			if cmd.Description != nil {
+				m.Description = *cmd.Description
+			}
+			if err := s.SetSecretMeta(cmd.Key, m); err != nil {
+				return result, err
+			}
+		}
+		if !cmd.Expires.IsZero() {
+			if err := s.SetExpiry(cmd.Key, cmd.Expires); err != nil {
+				return result, err
+			}
+		}
+	case "get":
+		encrypted, err := s.GetSecret(cmd.Key)
+		if err == db.ErrNotFound {
+			return result, fmt.Errorf("secret '%s' not found", cmd.Key)
+		} else if err != nil {
+			return result, err
+		}
+		decrypted, err := crypto.Decrypt(encrypted, key)
+		if err != nil {
+			return result, fmt.Errorf("failed to decrypt secret: %w", err)
+		}
+		value := string(decrypted)
+		result.Value = &value
+	case "delete":
+		if exists, err := authorize(s, actor, cmd.Key); err != nil {
+			return result, err
+		} else if !exists {
+			return result, fmt.Errorf("secret '%s' not found", cmd.Key)
+		}
+		if err := s.DeleteSecret(cmd.Key); err != nil {
+			return result, err
+		}
+	case "rename":
+		if cmd.To == "" {
+			return result, fmt.Errorf("to is required")
+		}
+		if exists, err := authorize(s, actor, cmd.Key); err != nil {
+			return result, err
+		} else if !exists {
+			return result, fmt.Errorf("secret '%s' not found", cmd.Key)
+		}
+		// Replacing a secret needs the right to modify it
+		if _, err := authorize(s, actor, cmd.To); err != nil {
+			return result, err
+		}
+		if err := s.RenameSecret(cmd.Key, cmd.To, cmd.Force); err == db.ErrExists {
+			return result, fmt.Errorf("secret '%s' already exists", cmd.To)
+		} else if err != nil {
+			return result, err
+		}
+	case "exists":
+		_, err := s.GetSecret(cmd.Key)
+		if err != nil && err != db.ErrNotFound {
+			return result, err
+		}
+		exists := err == nil
+		result.Exists = &exists
+	case "list":
+		keys, err := s.ListSecrets()
+		if err != nil {
+			return result, err
+		}
+		if cmd.Key != "" {
+			if keys, err = selector.Match(keys, cmd.Key); err != nil {
+				return result, err
+			}
+		}
+		result.Keys = append([]string{}, keys...)
+	default:
+		return result, fmt.Errorf("unknown op '%s'", cmd.Op)
+	}
+
+	result.OK = true
+	return result, nil
+}
+
+// authorize reports whether key exists, returning an error if it is owned
+// by someone actor may not act for. Missing secrets may be created by
+// anyone.
+func authorize(s Secrets, actor Actor, key string) (bool, error) {
+	owner, err := s.SecretOwner(key)
+	if err == db.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !policy.CanModify(owner, actor.Subjects, actor.Admin) {
+		return true, &OwnerError{Key: key, Owner: owner}
+	}
+	return true, nil
+}
@@ -0,0 +1,211 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// newTestStore returns an empty store and its key
+func newTestStore(t *testing.T) (*db.Store, []byte) {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	return store, key
+}
+
+// decode parses the result lines of a batch
+func decode(t *testing.T, out string) []Result {
+	t.Helper()
+	var results []Result
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var r Result
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Invalid result line %q: %v", line, err)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func TestRun(t *testing.T) {
+	store, key := newTestStore(t)
+
+	in := `{"id":1,"op":"set","key":"A","value":"alpha"}
+{"id":2,"op":"set","key":"B","value":""}
+{"id":3,"op":"get","key":"A"}
+{"op":"exists","key":"C"}
+{"op":"delete","key":"B"}
+{"op":"list","key":"*"}
+`
+	var out bytes.Buffer
+	if err := Run(strings.NewReader(in), &out, store, key, Actor{}); err != nil {
+		t.Fatalf("Run failed: %v\n%s", err, out.String())
+	}
+
+	results := decode(t, out.String())
+	if len(results) != 7 {
+		t.Fatalf("Expected 7 results, got %d:\n%s", len(results), out.String())
+	}
+	if string(results[0].ID) != "1" || !results[0].OK {
+		t.Errorf("Unexpected set result %+v", results[0])
+	}
+	if results[2].Value == nil || *results[2].Value != "alpha" {
+		t.Errorf("Unexpected get result %+v", results[2])
+	}
+	if results[3].Exists == nil || *results[3].Exists {
+		t.Errorf("Unexpected exists result %+v", results[3])
+	}
+	if len(results[5].Keys) != 1 || results[5].Keys[0] != "A" {
+		t.Errorf("Unexpected list result %+v", results[5])
+	}
+	if last := results[6]; last.Op != "commit" || !last.OK || last.Count != 6 {
+		t.Errorf("Unexpected final result %+v", last)
+	}
+
+	if keys, _ := store.ListSecrets(); len(keys) != 1 || keys[0] != "A" {
+		t.Errorf("Expected only A after commit, got %v", keys)
+	}
+}
+
+func TestRunRollsBack(t *testing.T) {
+	store, key := newTestStore(t)
+
+	in := `{"op":"set","key":"A","value":"alpha"}
+{"op":"delete","key":"MISSING"}
+{"op":"set","key":"B","value":"beta"}
+`
+	var out bytes.Buffer
+	if err := Run(strings.NewReader(in), &out, store, key, Actor{}); err == nil {
+		t.Fatalf("Expected Run to fail")
+	}
+
+	results := decode(t, out.String())
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got:\n%s", out.String())
+	}
+	if results[1].OK || !strings.Contains(results[1].Error, "not found") {
+		t.Errorf("Unexpected delete result %+v", results[1])
+	}
+	if results[2].Op != "rollback" || results[2].OK {
+		t.Errorf("Unexpected final result %+v", results[2])
+	}
+	if keys, _ := store.ListSecrets(); len(keys) != 0 {
+		t.Errorf("Expected nothing written after rollback, got %v", keys)
+	}
+
+	out.Reset()
+	if err := Run(strings.NewReader("not json\n"), &out, store, key, Actor{}); err == nil || !strings.Contains(out.String(), `"op":"rollback"`) {
+		t.Errorf("Expected malformed input to roll back, got %v:\n%s", err, out.String())
+	}
+}
+
+func TestExecuteOwnership(t *testing.T) {
+	store, key := newTestStore(t)
+	alice := Actor{Owner: "uid:1000", Subjects: []string{"uid:1000", "gid:100"}}
+	bob := Actor{Owner: "uid:1001", Subjects: []string{"uid:1001", "gid:100"}}
+	value := "v"
+
+	// New secrets are owned by their creator unless another owner is named
+	if _, err := Execute(store, key, alice, Command{Op: "set", Key: "A", Value: &value}); err != nil {
+		t.Fatalf("Failed to set A: %v", err)
+	}
+	if _, err := Execute(store, key, alice, Command{Op: "set", Key: "G", Value: &value, Owner: "gid:100"}); err != nil {
+		t.Fatalf("Failed to set G: %v", err)
+	}
+	if owner, _ := store.SecretOwner("A"); owner != "uid:1000" {
+		t.Errorf("Expected A to be owned by uid:1000, got %q", owner)
+	}
+
+	// Others may read but not modify
+	if _, err := Execute(store, key, bob, Command{Op: "get", Key: "A"}); err != nil {
+		t.Errorf("Expected bob to read A, got %v", err)
+	}
+	if _, err := Execute(store, key, bob, Command{Op: "set", Key: "A", Value: &value}); err == nil || !strings.Contains(err.Error(), "owned by") {
+		t.Errorf("Expected bob's overwrite of A to be refused, got %v", err)
+	}
+	if _, err := Execute(store, key, bob, Command{Op: "delete", Key: "A"}); err == nil {
+		t.Errorf("Expected bob's delete of A to be refused")
+	}
+
+	// Group owners and admins may modify
+	if _, err := Execute(store, key, bob, Command{Op: "set", Key: "G", Value: &value}); err != nil {
+		t.Errorf("Expected a group member to modify G, got %v", err)
+	}
+	if owner, _ := store.SecretOwner("G"); owner != "gid:100" {
+		t.Errorf("Expected an overwrite to keep the owner, got %q", owner)
+	}
+	bob.Admin = true
+	if _, err := Execute(store, key, bob, Command{Op: "delete", Key: "A"}); err != nil {
+		t.Errorf("Expected an admin to delete A, got %v", err)
+	}
+
+	if _, err := Execute(store, key, alice, Command{Op: "set", Key: "B", Value: &value, Owner: "alice"}); err == nil {
+		t.Errorf("Expected an invalid owner subject to be rejected")
+	}
+}
+
+func TestExecuteMeta(t *testing.T) {
+	store, key := newTestStore(t)
+	value, description := "v", "Primary database"
+	set := func(cmd Command) error {
+		cmd.Op, cmd.Key, cmd.Value = "set", "DB_PASSWORD", &value
+		_, err := Execute(store, key, Actor{}, cmd)
+		return err
+	}
+
+	if err := set(Command{Tags: []string{"prod", "db", "prod"}, Description: &description}); err != nil {
+		t.Fatalf("set with tags failed: %v", err)
+	}
+	// Writing the value again keeps the tags and description
+	set(Command{})
+	if m, err := store.SecretMeta("DB_PASSWORD"); err != nil || !slices.Equal(m.Tags, []string{"db", "prod"}) || m.Description != description {
+		t.Errorf("SecretMeta = %+v, %v", m, err)
+	}
+	set(Command{Tags: []string{}})
+	if m, _ := store.SecretMeta("DB_PASSWORD"); len(m.Tags) != 0 || m.Description != description {
+		t.Errorf("SecretMeta after clearing the tags = %+v", m)
+	}
+
+	if err := set(Command{Tags: []string{"has space"}}); err == nil {
+		t.Error("set with an invalid tag succeeded")
+	}
+}
+
+func TestExecuteRename(t *testing.T) {
+	store, key := newTestStore(t)
+	alice := Actor{Owner: "uid:1000", Subjects: []string{"uid:1000"}}
+	bob := Actor{Owner: "uid:1001", Subjects: []string{"uid:1001"}}
+	value := "v"
+	Execute(store, key, alice, Command{Op: "set", Key: "A", Value: &value})
+	Execute(store, key, bob, Command{Op: "set", Key: "B", Value: &value})
+
+	if _, err := Execute(store, key, bob, Command{Op: "rename", Key: "A", To: "C"}); err == nil || !strings.Contains(err.Error(), "owned by") {
+		t.Errorf("Expected bob's rename of A to be refused, got %v", err)
+	}
+	if _, err := Execute(store, key, alice, Command{Op: "rename", Key: "A", To: "B", Force: true}); err == nil || !strings.Contains(err.Error(), "owned by") {
+		t.Errorf("Expected alice's rename over bob's B to be refused, got %v", err)
+	}
+	if _, err := Execute(store, key, alice, Command{Op: "rename", Key: "A"}); err == nil {
+		t.Error("Expected a rename without to to be refused")
+	}
+	bob.Admin = true
+	if _, err := Execute(store, key, bob, Command{Op: "rename", Key: "A", To: "B"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected a rename onto B to be refused without force, got %v", err)
+	}
+	if _, err := Execute(store, key, bob, Command{Op: "rename", Key: "A", To: "C"}); err != nil {
+		t.Fatalf("Failed to rename A: %v", err)
+	}
+	if keys, _ := store.ListSecrets(); !slices.Equal(keys, []string{"B", "C"}) {
+		t.Errorf("Secrets after rename = %v", keys)
+	}
+}
@@ -0,0 +1,136 @@
+// Package bulk spreads per-secret work, such as decrypting every value in a
+// store, across a bounded pool of workers while delivering results in the
+// order the secrets were given, so output stays deterministic.
+package bulk
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+)
+
+// Workers is the pool size used by Decrypt; 0 means one worker per CPU
+var Workers = 0
+
+// result is the outcome of one item, handed from a worker to the caller
+type result[O any] struct {
+	value O
+	err   error
+}
+
+// job is one item waiting for a worker
+type job[I, O any] struct {
+	item I
+	out  chan result[O]
+}
+
+// Map calls fn for every item on up to workers goroutines, or one per CPU
+// when workers is 0, and passes each result to emit in the order of items.
+// Only a few results per worker are held at once, so memory stays bounded
+// however many items there are.
+// An error from fn is passed to emit; an error from emit stops Map, which
+// returns it once the workers have finished their current items.
+func Map[I, O any](items []I, workers int, fn func(I) (O, error), emit func(item I, value O, err error) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = max(1, min(workers, len(items)))
+
+	// pending holds each item's result channel in input order; its
+	// capacity bounds how far the workers run ahead of emit
+	pending := make(chan chan result[O], 2*workers)
+	jobs := make(chan job[I, O])
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				value, err := fn(j.item)
+				j.out <- result[O]{value, err}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+		defer close(jobs)
+		for _, item := range items {
+			out := make(chan result[O], 1)
+			select {
+			case pending <- out:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job[I, O]{item, out}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var err error
+	i := 0
+	for out := range pending {
+		r := <-out
+		if err = emit(items[i], r.value, r.err); err != nil {
+			break
+		}
+		i++
+	}
+	if err != nil {
+		close(done)
+	}
+	wg.Wait()
+	return err
+}
+
+// Source reads encrypted values by key; *db.Store is a Source
+type Source interface {
+	GetSecret(key string) ([]byte, error)
+}
+
+// Decrypt reads and decrypts the value of every key on Workers goroutines,
+// passing each to emit in the order of keys. A failed read or decrypt is
+// passed to emit with the key in its message. Values are not used again
+// once emit returns, so emit may wipe them.
+func Decrypt(src Source, encKey []byte, keys []string, emit func(key string, value []byte, err error) error) error {
+	return Map(keys, Workers, func(key string) ([]byte, error) {
+		encrypted, err := src.GetSecret(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret '%s': %w", key, err)
+		}
+		value, err := crypto.Decrypt(encrypted, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret '%s': %w", key, err)
+		}
+		return value, nil
+	}, emit)
+}
+
+// Failure is a key whose value could not be read or decrypted
+type Failure struct {
+	Key string
+	Err error
+}
+
+// Check decrypts the value of every key on Workers goroutines without
+// keeping it, returning the keys that fail in the order of keys
+func Check(src Source, encKey []byte, keys []string) []Failure {
+	var failures []Failure
+	Decrypt(src, encKey, keys, func(key string, value []byte, err error) error {
+		if err != nil {
+			failures = append(failures, Failure{Key: key, Err: err})
+		}
+		clear(value)
+		return nil
+	})
+	return failures
+}
@@ -0,0 +1,211 @@
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestMapOrder(t *testing.T) {
+	items := make([]int, 1000)
+	for i := range items {
+		items[i] = i
+	}
+
+	var got []int
+	err := Map(items, 8, func(i int) (int, error) {
+		// Finish out of order
+		if i%7 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return i * 2, nil
+	}, func(item, value int, err error) error {
+		if value != item*2 {
+			t.Errorf("item %d got value %d", item, value)
+		}
+		got = append(got, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	for i, item := range got {
+		if item != i {
+			t.Fatalf("result %d was item %d, want input order", i, item)
+		}
+	}
+	if len(got) != len(items) {
+		t.Errorf("got %d results, want %d", len(got), len(items))
+	}
+}
+
+func TestMapErrors(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4, 5}
+	fail := errors.New("odd")
+
+	// Errors from fn are reported and do not stop Map
+	var failed []int
+	err := Map(items, 3, func(i int) (int, error) {
+		if i%2 == 1 {
+			return 0, fail
+		}
+		return i, nil
+	}, func(item, _ int, err error) error {
+		if err != nil {
+			failed = append(failed, item)
+		}
+		return nil
+	})
+	if err != nil || fmt.Sprint(failed) != "[1 3 5]" {
+		t.Errorf("Map = %v with failures %v, want nil with [1 3 5]", err, failed)
+	}
+
+	// An error from emit stops Map
+	stop := errors.New("stop")
+	var emitted int
+	err = Map(items, 3, func(i int) (int, error) { return i, nil }, func(item, _ int, _ error) error {
+		emitted++
+		if item == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || emitted != 3 {
+		t.Errorf("Map = %v after %d results, want stop after 3", err, emitted)
+	}
+}
+
+func TestMapBounded(t *testing.T) {
+	items := make([]int, 500)
+	var started atomic.Int64
+	var emitted int64
+	err := Map(items, 4, func(int) (int, error) {
+		started.Add(1)
+		return 0, nil
+	}, func(int, int, error) error {
+		emitted++
+		// Workers may only run a fixed distance ahead of emit
+		if ahead := started.Load() - emitted; ahead > 3*4 {
+			return fmt.Errorf("%d items started ahead of emit", ahead)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMapEmpty(t *testing.T) {
+	err := Map(nil, 4, func(int) (int, error) { return 0, nil }, func(int, int, error) error {
+		t.Error("emit called for no items")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Map failed: %v", err)
+	}
+}
+
+// newStore creates a store holding n secrets encrypted with key
+func newStore(tb testing.TB, n int, key []byte) (*db.Store, []string) {
+	tb.Helper()
+	store, err := db.OpenStore(filepath.Join(tb.TempDir(), "lockbox.db"))
+	if err != nil {
+		tb.Fatalf("Failed to create store: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+
+	tx, err := store.Begin()
+	if err != nil {
+		tb.Fatalf("Failed to begin: %v", err)
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("KEY_%06d", i)
+		encrypted, _ := crypto.Encrypt([]byte("value-"+keys[i]), key)
+		if err := tx.SetSecretBlob(keys[i], keys[i], encrypted); err != nil {
+			tb.Fatalf("Failed to set secret: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatalf("Failed to commit: %v", err)
+	}
+	return store, keys
+}
+
+func TestDecrypt(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	store, keys := newStore(t, 200, key)
+	keys = append(keys, "MISSING")
+
+	var i int
+	err := Decrypt(store, key, keys, func(k string, value []byte, err error) error {
+		if k != keys[i] {
+			t.Errorf("result %d was %s, want %s", i, k, keys[i])
+		}
+		i++
+		if k == "MISSING" {
+			if !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("MISSING: err = %v, want ErrNotFound", err)
+			}
+			return nil
+		}
+		if err != nil || string(value) != "value-"+k {
+			t.Errorf("%s = %q, %v", k, value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if i != len(keys) {
+		t.Errorf("got %d results, want %d", i, len(keys))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	store, keys := newStore(t, 50, key)
+	if failures := Check(store, key, keys); len(failures) != 0 {
+		t.Fatalf("Check of good values = %v", failures)
+	}
+
+	// A value encrypted with another key, and one that is missing
+	other, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("x"), other)
+	store.SetSecret("KEY_000010", encrypted)
+	failures := Check(store, key, append(keys, "MISSING"))
+	if len(failures) != 2 || failures[0].Key != "KEY_000010" || failures[1].Key != "MISSING" {
+		t.Fatalf("Check = %v, want KEY_000010 and MISSING", failures)
+	}
+	if !errors.Is(failures[1].Err, db.ErrNotFound) {
+		t.Errorf("MISSING: err = %v, want ErrNotFound", failures[1].Err)
+	}
+}
+
+// BenchmarkDecrypt reads and decrypts a 5k secret store serially and with
+// one worker per CPU; run with -cpu to compare pool sizes
+func BenchmarkDecrypt(b *testing.B) {
+	key, _ := crypto.GenerateKey()
+	store, keys := newStore(b, 5000, key)
+
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			saved := Workers
+			Workers = workers
+			defer func() { Workers = saved }()
+
+			for i := 0; i < b.N; i++ {
+				err := Decrypt(store, key, keys, func(string, []byte, error) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+// Package bundle creates read-only share bundles: signed, expiring
+// snapshots of selected secrets encrypted to one recipient's X25519 key, so
+// a third party such as an auditor can review values without access to
+// the store or the server.
+//
+// A bundle's values are encrypted with AES-256-GCM under a key derived by
+// HKDF-SHA256 from an X25519 exchange between a fresh ephemeral key and the
+// recipient's key. The store's Ed25519 signing key signs the header and
+// ciphertext, so anyone can check a bundle's origin and expiry without the
+// recipient's private key.
+package bundle
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// Version is the bundle format written by Create
+const Version = 1
+
+// sealInfo binds bundle ciphertexts to this format
+const sealInfo = "lockbox bundle v1"
+
+// signingKeyConfig is the store config entry holding the Ed25519 seed
+const signingKeyConfig = "bundle_signing_key"
+
+// ErrExpired is returned for a bundle past its expiry
+var ErrExpired = errors.New("bundle has expired")
+
+// Bundle is the file format of a share bundle
+type Bundle struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Recipient is the fingerprint of the key the bundle is encrypted to
+	Recipient string `json:"recipient"`
+	// Signer is the Ed25519 public key of the store that made the bundle
+	Signer     []byte `json:"signer"`
+	Ephemeral  []byte `json:"ephemeral"`
+	Ciphertext []byte `json:"ciphertext"`
+	Signature  []byte `json:"signature"`
+}
+
+// contents is the encrypted payload of a bundle. The expiry is repeated
+// inside so it is bound to the values even if the signature is stripped.
+type contents struct {
+	Expires time.Time         `json:"expires"`
+	Secrets map[string]string `json:"secrets"`
+}
+
+// Create returns a bundle of secrets for recipient, signed with signer and
+// valid until expires
+func Create(secrets map[string]string, recipient *ecdh.PublicKey, signer ed25519.PrivateKey, created, expires time.Time) ([]byte, error) {
+	payload, err := json.Marshal(contents{Expires: expires.UTC(), Secrets: secrets})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode bundle: %w", err)
+	}
+	ephemeral, ciphertext, err := crypto.Seal(payload, recipient, sealInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	b := Bundle{
+		Version:    Version,
+		Created:    created.UTC().Truncate(time.Second),
+		Expires:    expires.UTC().Truncate(time.Second),
+		Recipient:  Fingerprint(recipient.Bytes()),
+		Signer:     signer.Public().(ed25519.PublicKey),
+		Ephemeral:  ephemeral,
+		Ciphertext: ciphertext,
+	}
+	b.Signature = ed25519.Sign(signer, b.signed())
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// Verify parses a bundle and checks its signature and expiry at now. The
+// bundle is returned with ErrExpired when it verifies but has expired.
+func Verify(data []byte, now time.Time) (*Bundle, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("not a lockbox bundle: %w", err)
+	}
+	if b.Version != Version {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	if len(b.Signer) != ed25519.PublicKeySize || !ed25519.Verify(b.Signer, b.signed(), b.Signature) {
+		return nil, errors.New("bundle signature is invalid")
+	}
+	if !now.Before(b.Expires) {
+		return &b, ErrExpired
+	}
+	return &b, nil
+}
+
+// Open verifies a bundle and decrypts its secrets with the recipient's key
+func Open(data []byte, key *ecdh.PrivateKey, now time.Time) (*Bundle, map[string]string, error) {
+	b, err := Verify(data, now)
+	if err != nil {
+		return b, nil, err
+	}
+	if b.Recipient != Fingerprint(key.PublicKey().Bytes()) {
+		return b, nil, fmt.Errorf("bundle is for key %s, not this key", b.Recipient)
+	}
+
+	payload, err := crypto.Unseal(b.Ephemeral, b.Ciphertext, key, sealInfo)
+	if err != nil {
+		return b, nil, fmt.Errorf("failed to decrypt bundle: %w", err)
+	}
+
+	var c contents
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return b, nil, fmt.Errorf("failed to decode bundle: %w", err)
+	}
+	if !now.Before(c.Expires) {
+		return b, nil, ErrExpired
+	}
+	return b, c.Secrets, nil
+}
+
+// signed returns the bytes covered by the signature
+func (b *Bundle) signed() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "lockbox-bundle\n%d\n%s\n%s\n%s\n", b.Version, b.Created.Format(time.RFC3339), b.Expires.Format(time.RFC3339), b.Recipient)
+	for _, field := range [][]byte{b.Signer, b.Ephemeral, b.Ciphertext} {
+		buf.WriteString(base64.StdEncoding.EncodeToString(field))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Fingerprint identifies a public key: SHA256: followed by the unpadded
+// base64 of its SHA-256 digest
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new recipient key pair
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// MarshalPrivateKey encodes a recipient key as a PKCS #8 PEM block
+func MarshalPrivateKey(key *ecdh.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKey encodes a recipient public key as a PKIX PEM block
+func MarshalPublicKey(key *ecdh.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey decodes an X25519 private key in PEM, as written by
+// MarshalPrivateKey or 'openssl genpkey -algorithm X25519'
+func ParsePrivateKey(data []byte) (*ecdh.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("expected a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if k, ok := key.(*ecdh.PrivateKey); ok && k.Curve() == ecdh.X25519() {
+		return k, nil
+	}
+	return nil, errors.New("private key is not an X25519 key")
+}
+
+// ParsePublicKey decodes an X25519 public key in PEM
+func ParsePublicKey(data []byte) (*ecdh.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if k, ok := key.(*ecdh.PublicKey); ok && k.Curve() == ecdh.X25519() {
+		return k, nil
+	}
+	return nil, errors.New("public key is not an X25519 key")
+}
+
+// SigningKey returns the store's bundle signing key, creating it on first
+// use
+func SigningKey(store *db.Store) (ed25519.PrivateKey, error) {
+	seedHex, err := store.GetConfig(signingKeyConfig)
+	if err == db.ErrNotFound {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		if err := store.SetConfig(signingKeyConfig, []byte(hex.EncodeToString(key.Seed()))); err != nil {
+			return nil, err
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(string(seedHex))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("stored bundle signing key is corrupt")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseExpiry parses a validity period: a Go duration such as 36h, or a
+// number of days such as 7d
+func ParseExpiry(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expiry '%s': expected a positive duration such as 7d or 12h", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,116 @@
+package bundle
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestCreateAndOpen(t *testing.T) {
+	recipient, _ := GenerateKey()
+	_, signer, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	secrets := map[string]string{"PROD_DB": "postgres://", "PROD_KEY": "k"}
+
+	data, err := Create(secrets, recipient.PublicKey(), signer, now, now.Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if strings.Contains(string(data), "postgres") {
+		t.Fatalf("Bundle contains a plaintext value:\n%s", data)
+	}
+
+	b, opened, err := Open(data, recipient, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if len(opened) != 2 || opened["PROD_DB"] != "postgres://" {
+		t.Errorf("Open returned %v", opened)
+	}
+	if Fingerprint(b.Signer) != Fingerprint(signer.Public().(ed25519.PublicKey)) {
+		t.Errorf("Unexpected signer %x", b.Signer)
+	}
+
+	// Past its expiry the bundle still verifies but will not open
+	if _, err := Verify(data, now.Add(8*24*time.Hour)); err != ErrExpired {
+		t.Errorf("Expected ErrExpired from Verify, got %v", err)
+	}
+	if _, _, err := Open(data, recipient, now.Add(8*24*time.Hour)); err != ErrExpired {
+		t.Errorf("Expected ErrExpired from Open, got %v", err)
+	}
+
+	// Other keys cannot open it
+	other, _ := GenerateKey()
+	if _, _, err := Open(data, other, now); err == nil {
+		t.Errorf("Expected Open with another key to fail")
+	}
+
+	// Tampering with the header breaks the signature
+	var raw map[string]any
+	json.Unmarshal(data, &raw)
+	raw["expires"] = now.Add(365 * 24 * time.Hour).Format(time.RFC3339)
+	tampered, _ := json.Marshal(raw)
+	if _, err := Verify(tampered, now); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Expected a signature error for a tampered bundle, got %v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key, _ := GenerateKey()
+	privPEM, err := MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey failed: %v", err)
+	}
+	pubPEM, err := MarshalPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatalf("MarshalPublicKey failed: %v", err)
+	}
+
+	priv, err := ParsePrivateKey(privPEM)
+	if err != nil || !priv.Equal(key) {
+		t.Errorf("ParsePrivateKey round trip failed: %v", err)
+	}
+	pub, err := ParsePublicKey(pubPEM)
+	if err != nil || !pub.Equal(key.PublicKey()) {
+		t.Errorf("ParsePublicKey round trip failed: %v", err)
+	}
+	if _, err := ParsePublicKey(privPEM); err == nil {
+		t.Errorf("Expected ParsePublicKey to reject a private key")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	first, err := SigningKey(store)
+	if err != nil {
+		t.Fatalf("SigningKey failed: %v", err)
+	}
+	second, _ := SigningKey(store)
+	if !first.Equal(second) {
+		t.Errorf("Expected the signing key to be stable")
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := map[string]time.Duration{"7d": 7 * 24 * time.Hour, "12h": 12 * time.Hour, "90m": 90 * time.Minute}
+	for in, want := range tests {
+		if got, err := ParseExpiry(in); err != nil || got != want {
+			t.Errorf("ParseExpiry(%q) = %v, %v; expected %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0d", "-1h", "week", "d"} {
+		if _, err := ParseExpiry(in); err == nil {
+			t.Errorf("ParseExpiry(%q) succeeded", in)
+		}
+	}
+}
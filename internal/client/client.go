@@ -0,0 +1,483 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/oidc"
+	"github.com/MQ37/lockbox/internal/signing"
+)
+
+const (
+	// DefaultTimeout bounds a whole request including reading the body
+	DefaultTimeout = 30 * time.Second
+	// DefaultConcurrency is how many secrets FetchAll requests at once
+	DefaultConcurrency = 8
+)
+
+// Options configures a Client
+type Options struct {
+	// Timeout bounds each request (DefaultTimeout if zero)
+	Timeout time.Duration
+	// Concurrency is the number of parallel fetches in FetchAll
+	// (DefaultConcurrency if zero)
+	Concurrency int
+	// H2C talks HTTP/2 with prior knowledge to plain http and unix
+	// remotes instead of HTTP/1.1, multiplexing requests over one
+	// connection; the server and any proxy in between must support it
+	H2C bool
+	// Token is sent as a bearer token on every request when set
+	Token string
+	// RefreshToken, when set, is redeemed for a new token once the server
+	// rejects Token
+	RefreshToken string
+	// OnRefresh is called with the new credential after a refresh, so it
+	// can be saved
+	OnRefresh func(Credential)
+	// RootCAs verifies https servers instead of the system roots when set
+	RootCAs *x509.CertPool
+	// Insecure accepts any https server certificate
+	Insecure bool
+	// Verifier, when set, rejects every response not signed by its key
+	Verifier *signing.Verifier
+}
+
+// LoadCA returns a pool of the PEM certificates in the file at path, for
+// Options.RootCAs
+func LoadCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// Client talks to a lockbox server. It keeps one transport for its lifetime
+// so connections are reused across requests.
+type Client struct {
+	base string
+	http *http.Client
+
+	mu   sync.Mutex // guards opts.Token and opts.RefreshToken
+	opts Options
+}
+
+// unixScheme prefixes remotes that are unix socket paths
+const unixScheme = "unix://"
+
+// New returns a client for remote, which is host:port, a full http:// or
+// https:// URL, or unix:///path/to/socket. Plain http and unix remotes use
+// HTTP/1.1 with keep-alive unless H2C is set; https remotes negotiate
+// HTTP/2 via ALPN.
+func New(remote string, opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+
+	var socket string
+	base := remote
+	switch {
+	case strings.HasPrefix(base, unixScheme):
+		// The host is never resolved; every connection dials the socket
+		socket = strings.TrimPrefix(base, unixScheme)
+		base = "http://lockbox"
+	case !strings.Contains(base, "://"):
+		base = "http://" + base
+	}
+	base = strings.TrimRight(base, "/")
+
+	var transport http.RoundTripper = newTransport(base, socket, opts)
+	if opts.Verifier != nil {
+		transport = &verifyingTransport{next: transport, verifier: opts.Verifier}
+	}
+	return &Client{
+		base: base,
+		http: &http.Client{Timeout: opts.Timeout, Transport: transport},
+		opts: opts,
+	}
+}
+
+// verifyingTransport checks the signature of every response it returns
+type verifyingTransport struct {
+	next     http.RoundTripper
+	verifier *signing.Verifier
+}
+
+func (t *verifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Streamed responses are signed in a trailer, known once the body is
+	// read
+	h := resp.Header
+	if h.Get(signing.Header) == "" {
+		h = resp.Trailer
+	}
+	if err := t.verifier.Verify(h, req.Method, req.URL.RequestURI(), resp.StatusCode, body, time.Now()); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// newTransport returns a pooled transport speaking the protocols suited to
+// the scheme of base, dialing socket instead of TCP when it is set
+func newTransport(base, socket string, opts Options) *http.Transport {
+	var protocols http.Protocols
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case opts.H2C:
+		// HTTP1 must be off for the transport to use h2c prior knowledge
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	proxy := http.ProxyFromEnvironment
+	if socket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		proxy = nil
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSClientConfig:       &tls.Config{RootCAs: opts.RootCAs, InsecureSkipVerify: opts.Insecure},
+		Protocols:             &protocols,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.Concurrency,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// Close releases idle connections held by the client
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// Get performs a GET on path and returns the response. The caller must
+// close the body. When the server rejects the token and a refresh token is
+// set, the token is refreshed and the request retried once.
+func (c *Client) Get(path string) (*http.Response, error) {
+	return c.Do(http.MethodGet, path, "", nil)
+}
+
+// Do performs a request with an optional body of contentType, like Get
+func (c *Client) Do(method, path, contentType string, body []byte) (*http.Response, error) {
+	c.mu.Lock()
+	tok, refreshable := c.opts.Token, c.opts.RefreshToken != ""
+	c.mu.Unlock()
+
+	resp, err := c.do(method, path, contentType, body, tok)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !refreshable {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	if tok, err = c.refresh(tok); err != nil {
+		return nil, err
+	}
+	return c.do(method, path, contentType, body, tok)
+}
+
+// do performs a request authenticated with tok
+func (c *Client) do(method, path, contentType string, body []byte, tok string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	return c.http.Do(req)
+}
+
+// refresh redeems the refresh token after stale was rejected, returning
+// the new token. Concurrent callers that saw the same stale token share
+// one refresh, since refresh tokens are single use.
+func (c *Client) refresh(stale string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.Token != stale {
+		return c.opts.Token, nil
+	}
+
+	cred, err := c.Refresh(c.opts.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	c.opts.Token, c.opts.RefreshToken = cred.Token, cred.RefreshToken
+	if c.opts.OnRefresh != nil {
+		c.opts.OnRefresh(cred)
+	}
+	return cred.Token, nil
+}
+
+// OIDCConfig returns the identity provider the server accepts logins from
+func (c *Client) OIDCConfig() (oidc.Config, error) {
+	var config oidc.Config
+	resp, err := c.Get("/v1/auth/oidc/config")
+	if err != nil {
+		return config, fmt.Errorf("failed to reach remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return config, fmt.Errorf("remote server returned status %d: %s", resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return config, fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return config, nil
+}
+
+// Login exchanges an ID token from the server's identity provider for a
+// short-lived lockbox token
+func (c *Client) Login(idToken string) (Credential, error) {
+	return c.postCredential("/v1/auth/oidc/login", map[string]string{"id_token": idToken}, "login")
+}
+
+// Refresh redeems a refresh token for a new token and refresh token
+func (c *Client) Refresh(refreshToken string) (Credential, error) {
+	return c.postCredential("/v1/auth/token/refresh", map[string]string{"refresh_token": refreshToken}, "token refresh")
+}
+
+// postCredential posts a JSON body to path and decodes the issued
+// credential
+func (c *Client) postCredential(path string, body map[string]string, action string) (Credential, error) {
+	var cred Credential
+	data, _ := json.Marshal(body)
+	resp, err := c.http.Post(c.base+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return cred, fmt.Errorf("failed to reach remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return cred, fmt.Errorf("%s failed with status %d: %s", action, resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cred); err != nil {
+		return cred, fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return cred, nil
+}
+
+// ListSecrets returns the keys of all secrets on the server
+func (c *Client) ListSecrets() ([]string, error) {
+	resp, err := c.Get("/secrets")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch secrets from remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("remote server returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var keys []string
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return keys, nil
+}
+
+// SecretInfo is a secret's key and when it was last updated
+type SecretInfo struct {
+	Key     string    `json:"key"`
+	Updated time.Time `json:"updated"`
+	// Expires is when a temporary secret expires; zero if never
+	Expires time.Time `json:"expires"`
+}
+
+// ListSecretInfo returns the keys of all secrets on the server with when
+// each was last updated
+func (c *Client) ListSecretInfo() ([]SecretInfo, error) {
+	resp, err := c.Get("/secrets?meta=true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch secrets from remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("remote server returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var infos []SecretInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return nil, fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return infos, nil
+}
+
+// GetSecret returns the decrypted value of a single secret
+func (c *Client) GetSecret(key string) (string, error) {
+	resp, err := c.Get("/secrets/" + url.PathEscape(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch secret '%s' from remote: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("remote server returned status %d for '%s': %s", resp.StatusCode, key, body)
+	}
+
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret '%s' from remote: %w", key, err)
+	}
+	return string(value), nil
+}
+
+// SetSecret sets a single secret on the server, reporting whether it was
+// created rather than overwritten
+func (c *Client) SetSecret(key, value string) (bool, error) {
+	resp, err := c.Do(http.MethodPut, "/secrets/"+url.PathEscape(key), "text/plain", []byte(value))
+	if err != nil {
+		return false, fmt.Errorf("failed to set secret '%s' on remote: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("remote server returned status %d for '%s': %s", resp.StatusCode, key, body)
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// SetSecrets sets several secrets on the server at once: either all are
+// written or none are. It returns the keys that were created.
+func (c *Client) SetSecrets(secrets map[string]string) ([]string, error) {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(http.MethodPost, "/secrets", "application/json", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set secrets on remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("remote server returned status %d: %s", resp.StatusCode, body)
+	}
+	var result struct {
+		Created []string `json:"created"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return result.Created, nil
+}
+
+// DeleteSecret deletes a single secret on the server
+func (c *Client) DeleteSecret(key string) error {
+	resp, err := c.Do(http.MethodDelete, "/secrets/"+url.PathEscape(key), "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete secret '%s' on remote: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remote server returned status %d for '%s': %s", resp.StatusCode, key, body)
+	}
+	return nil
+}
+
+// FetchAll returns every secret on the server, fetching values in parallel
+// over the client's pooled connections
+func (c *Client) FetchAll() (map[string]string, error) {
+	keys, err := c.ListSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return c.Fetch(keys)
+}
+
+// Fetch returns the values of keys, fetched in parallel
+func (c *Client) Fetch(keys []string) (map[string]string, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		secrets  = make(map[string]string, len(keys))
+		sem      = make(chan struct{}, c.opts.Concurrency)
+	)
+
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			value, err := c.GetSecret(key)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			secrets[key] = value
+		}(key)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return secrets, nil
+}
@@ -0,0 +1,447 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/signing"
+)
+
+// numSecrets is the size of the store served by the fake server
+const numSecrets = 50
+
+// newFakeServer serves numSecrets secrets with the same routes as lockbox
+// serve, accepting HTTP/1.1 and h2c. Each request records its protocol.
+func newFakeServer(tb testing.TB, delay time.Duration) (*httptest.Server, *sync.Map) {
+	tb.Helper()
+
+	protos := &sync.Map{}
+	keys := make([]string, numSecrets)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("KEY_%02d", i)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/secrets", func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.Proto, true)
+		json.NewEncoder(w).Encode(keys)
+	})
+	mux.HandleFunc("/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.Proto, true)
+		time.Sleep(delay)
+		fmt.Fprintf(w, "value-of-%s", strings.TrimPrefix(r.URL.Path, "/secrets/"))
+	})
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.Protocols = &http.Protocols{}
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	tb.Cleanup(ts.Close)
+
+	return ts, protos
+}
+
+func TestFetchAll(t *testing.T) {
+	ts, protos := newFakeServer(t, 0)
+
+	c := New(ts.URL, Options{H2C: true})
+	defer c.Close()
+
+	secrets, err := c.FetchAll()
+	if err != nil {
+		t.Fatalf("FetchAll failed: %v", err)
+	}
+	if len(secrets) != numSecrets {
+		t.Fatalf("Expected %d secrets, got %d", numSecrets, len(secrets))
+	}
+	if secrets["KEY_07"] != "value-of-KEY_07" {
+		t.Errorf("Unexpected value for KEY_07: %q", secrets["KEY_07"])
+	}
+	if _, ok := protos.Load("HTTP/2.0"); !ok {
+		t.Errorf("Expected requests over h2c")
+	}
+}
+
+func TestFetchAllHTTP1(t *testing.T) {
+	ts, protos := newFakeServer(t, 0)
+
+	c := New(strings.TrimPrefix(ts.URL, "http://"), Options{})
+	defer c.Close()
+
+	if _, err := c.FetchAll(); err != nil {
+		t.Fatalf("FetchAll failed: %v", err)
+	}
+	if _, ok := protos.Load("HTTP/2.0"); ok {
+		t.Errorf("Expected no HTTP/2 requests without H2C")
+	}
+}
+
+func TestGetSecretError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: secret 'MISSING' not found")
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{})
+	defer c.Close()
+
+	_, err := c.GetSecret("MISSING")
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("Expected status 404 error, got: %v", err)
+	}
+}
+
+// BenchmarkFetchAll compares the bulk fetch done by `run --remote` under
+// concurrent callers. "unpooled" mimics the previous client: one fresh
+// HTTP/1.1 connection per secret, fetched sequentially. Run with
+//
+//	go test ./internal/client -bench FetchAll -benchtime 200x
+//
+// and compare the p99-ms metric.
+func BenchmarkFetchAll(b *testing.B) {
+	ts, _ := newFakeServer(b, 200*time.Microsecond)
+
+	clients := []struct {
+		name   string
+		client *Client
+	}{
+		{"unpooled", &Client{
+			base: ts.URL,
+			http: &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+			opts: Options{Concurrency: 1},
+		}},
+		{"http1-pooled", New(ts.URL, Options{})},
+		{"h2c", New(ts.URL, Options{H2C: true})},
+	}
+
+	for _, tc := range clients {
+		b.Run(tc.name, func(b *testing.B) {
+			defer tc.client.Close()
+
+			var mu sync.Mutex
+			latencies := make([]time.Duration, 0, b.N)
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					if _, err := tc.client.FetchAll(); err != nil {
+						b.Error(err)
+						return
+					}
+					elapsed := time.Since(start)
+
+					mu.Lock()
+					latencies = append(latencies, elapsed)
+					mu.Unlock()
+				}
+			})
+			b.StopTimer()
+
+			if len(latencies) == 0 {
+				return
+			}
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			// Nearest-rank percentile
+			p99 := latencies[(len(latencies)*99+99)/100-1]
+			b.ReportMetric(float64(p99.Microseconds())/1000, "p99-ms")
+		})
+	}
+}
+
+func TestFetchAllUnix(t *testing.T) {
+	path := t.TempDir() + "/lockbox.sock"
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ts, _ := newFakeServer(t, 0)
+	ts.Listener.Close()
+	srv := &http.Server{Handler: ts.Config.Handler, Protocols: ts.Config.Protocols}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	c := New("unix://"+path, Options{})
+	defer c.Close()
+
+	secrets, err := c.FetchAll()
+	if err != nil {
+		t.Fatalf("FetchAll over unix socket failed: %v", err)
+	}
+	if len(secrets) != numSecrets {
+		t.Errorf("Expected %d secrets, got %d", numSecrets, len(secrets))
+	}
+}
+
+func TestFetchAllTLS(t *testing.T) {
+	ts, protos := newFakeServer(t, 0)
+	ts.Close()
+	ts = httptest.NewUnstartedServer(ts.Config.Handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644)
+	pool, err := LoadCA(caFile)
+	if err != nil {
+		t.Fatalf("LoadCA failed: %v", err)
+	}
+	if _, err := LoadCA(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("LoadCA accepted a missing file")
+	}
+
+	// The server's certificate is not signed by a system root
+	if _, err := New(ts.URL, Options{}).FetchAll(); err == nil {
+		t.Error("FetchAll trusted an unknown certificate")
+	}
+	for _, opts := range []Options{{RootCAs: pool}, {Insecure: true}} {
+		c := New(ts.URL, opts)
+		secrets, err := c.FetchAll()
+		c.Close()
+		if err != nil || len(secrets) != numSecrets {
+			t.Errorf("FetchAll with %+v = %d secrets, %v", opts, len(secrets), err)
+		}
+	}
+	if _, ok := protos.Load("HTTP/2.0"); !ok {
+		t.Error("Expected HTTP/2 over TLS")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	path := t.TempDir() + "/credentials.json"
+
+	if _, ok := LoadCredential(path, "prod:8100"); ok {
+		t.Errorf("Expected no credential before login")
+	}
+	if remotes, err := Remotes(path); err != nil || len(remotes) != 0 {
+		t.Errorf("Remotes before login = %v, %v", remotes, err)
+	}
+
+	SaveCredential(path, "stale:8100", Credential{Token: "old", ExpiresAt: time.Now().Add(-time.Minute)})
+	if err := SaveCredential(path, "prod:8100", Credential{Token: "lbx_1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("SaveCredential failed: %v", err)
+	}
+
+	cred, ok := LoadCredential(path, "prod:8100")
+	if !ok || cred.Token != "lbx_1" {
+		t.Errorf("LoadCredential = %+v, %v", cred, ok)
+	}
+	if _, ok := LoadCredential(path, "stale:8100"); ok {
+		t.Errorf("Expected expired credentials to be ignored")
+	}
+	if creds, _ := readCredentials(path); len(creds) != 1 {
+		t.Errorf("Expected expired credentials to be dropped on save, got %v", creds)
+	}
+	SaveCredential(path, "dev:8100", Credential{Token: "lbx_2"})
+	if remotes, _ := Remotes(path); !slices.Equal(remotes, []string{"dev:8100", "prod:8100"}) {
+		t.Errorf("Remotes = %v", remotes)
+	}
+}
+
+func TestRefreshOnUnauthorized(t *testing.T) {
+	var mu sync.Mutex
+	current, refreshes := "old", 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		if body["refresh_token"] != "r1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		refreshes++
+		current = "new"
+		json.NewEncoder(w).Encode(Credential{Token: "new", RefreshToken: "r2"})
+	})
+	mux.HandleFunc("/secrets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]string{"A", "B", "C"})
+	})
+	mux.HandleFunc("/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ok := r.Header.Get("Authorization") == "Bearer "+current
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "v")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var saved Credential
+	c := New(ts.URL, Options{Token: "stale", RefreshToken: "r1", OnRefresh: func(cred Credential) { saved = cred }})
+	defer c.Close()
+
+	secrets, err := c.FetchAll()
+	if err != nil {
+		t.Fatalf("FetchAll failed: %v", err)
+	}
+	if len(secrets) != 3 {
+		t.Errorf("Expected 3 secrets, got %v", secrets)
+	}
+	if refreshes != 1 {
+		t.Errorf("Expected one shared refresh, got %d", refreshes)
+	}
+	if saved.RefreshToken != "r2" {
+		t.Errorf("OnRefresh got %+v", saved)
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	var mu sync.Mutex
+	stored := map[string]string{}
+	rejected := false
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Credential{Token: "new", RefreshToken: "r2"})
+	})
+	mux.HandleFunc("/secrets", func(w http.ResponseWriter, r *http.Request) {
+		var secrets map[string]string
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&secrets) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		created := []string{}
+		for k, v := range secrets {
+			if _, ok := stored[k]; !ok {
+				created = append(created, k)
+			}
+			stored[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"created": created, "updated": {}})
+	})
+	mux.HandleFunc("/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/secrets/")
+		mu.Lock()
+		defer mu.Unlock()
+		// The first write is rejected so the body must be sent again
+		if !rejected {
+			rejected = true
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			_, exists := stored[key]
+			stored[key] = string(body)
+			if exists {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+		case http.MethodDelete:
+			if _, ok := stored[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(stored, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := New(ts.URL, Options{Token: "stale", RefreshToken: "r1"})
+	defer c.Close()
+
+	if created, err := c.SetSecret("API_KEY", "v1"); err != nil || !created {
+		t.Fatalf("SetSecret = %v, %v", created, err)
+	}
+	if stored["API_KEY"] != "v1" {
+		t.Errorf("Body was not resent after refresh: %q", stored["API_KEY"])
+	}
+	if created, err := c.SetSecret("API_KEY", "v2"); err != nil || created {
+		t.Errorf("Overwrite = %v, %v", created, err)
+	}
+	created, err := c.SetSecrets(map[string]string{"API_KEY": "v3", "DB_USER": "app"})
+	if err != nil || len(created) != 1 || created[0] != "DB_USER" {
+		t.Errorf("SetSecrets = %v, %v", created, err)
+	}
+	if err := c.DeleteSecret("API_KEY"); err != nil {
+		t.Errorf("DeleteSecret failed: %v", err)
+	}
+	if err := c.DeleteSecret("API_KEY"); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("Expected a 404 error deleting a missing key, got %v", err)
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signer := &signing.Signer{Name: "test", Key: priv}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte("value")
+		switch r.URL.Path {
+		case "/secrets/GOOD":
+			signer.Sign(w.Header(), r.Method, r.RequestURI, http.StatusOK, body, time.Now())
+		case "/secrets/SWAPPED":
+			// A response signed for another request
+			signer.Sign(w.Header(), r.Method, "/secrets/GOOD", http.StatusOK, body, time.Now())
+		case "/secrets/ALTERED":
+			signer.Sign(w.Header(), r.Method, r.RequestURI, http.StatusOK, body, time.Now())
+			body = []byte("evil")
+		case "/secrets/STREAMED":
+			// Signed in a trailer after the body
+			st := signer.Stream(r.Method, r.RequestURI, http.StatusOK, time.Now())
+			w.Header().Set("Trailer", signing.Header)
+			st.Write(body)
+			w.Write(body)
+			w.(http.Flusher).Flush()
+			st.Sign(w.Header())
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, Options{Verifier: &signing.Verifier{Name: "test", Key: pub}})
+	defer c.Close()
+
+	for _, key := range []string{"GOOD", "STREAMED"} {
+		if value, err := c.GetSecret(key); err != nil || value != "value" {
+			t.Errorf("GetSecret(%s) of a signed response = %q, %v", key, value, err)
+		}
+	}
+	for _, key := range []string{"SWAPPED", "ALTERED"} {
+		if _, err := c.GetSecret(key); err == nil || !strings.Contains(err.Error(), "signature is invalid") {
+			t.Errorf("GetSecret(%s) = %v, expected an invalid signature", key, err)
+		}
+	}
+	if _, err := c.GetSecret("UNSIGNED"); !errors.Is(err, signing.ErrUnsigned) {
+		t.Errorf("GetSecret of an unsigned response = %v, expected ErrUnsigned", err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	c = New(ts.URL, Options{Verifier: &signing.Verifier{Name: "test", Key: other}})
+	defer c.Close()
+	if _, err := c.GetSecret("GOOD"); err == nil {
+		t.Error("GetSecret accepted a response signed by another key")
+	}
+}
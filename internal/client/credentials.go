@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Credential is a token obtained with 'lockbox login' for one remote
+type Credential struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// Valid reports whether the credential can still be used at now, directly
+// or by refreshing it
+func (c Credential) Valid(now time.Time) bool {
+	return c.Token != "" && (c.ExpiresAt.IsZero() || now.Before(c.ExpiresAt) || c.RefreshToken != "")
+}
+
+// LoadCredential returns the credential saved in the file at path for
+// remote, if there is a usable one
+func LoadCredential(path, remote string) (Credential, bool) {
+	creds, err := readCredentials(path)
+	if err != nil {
+		return Credential{}, false
+	}
+	cred, ok := creds[remote]
+	if !ok || !cred.Valid(time.Now()) {
+		return Credential{}, false
+	}
+	return cred, true
+}
+
+// Remotes returns the remotes credentials are saved for in the file at
+// path, sorted, including those whose credential has expired
+func Remotes(path string) ([]string, error) {
+	creds, err := readCredentials(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	remotes := make([]string, 0, len(creds))
+	for r := range creds {
+		remotes = append(remotes, r)
+	}
+	sort.Strings(remotes)
+	return remotes, nil
+}
+
+// SaveCredential stores cred for remote in the file at path, which is only
+// readable by the current user, dropping expired credentials
+func SaveCredential(path, remote string, cred Credential) error {
+	creds, err := readCredentials(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if creds == nil {
+		creds = map[string]Credential{}
+	}
+
+	now := time.Now()
+	for r, c := range creds {
+		if !c.Valid(now) {
+			delete(creds, r)
+		}
+	}
+	creds[remote] = cred
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	return nil
+}
+
+// readCredentials reads the credentials file, keyed by remote
+func readCredentials(path string) (map[string]Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds map[string]Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	return creds, nil
+}
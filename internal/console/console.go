@@ -0,0 +1,395 @@
+// Package console implements 'lockbox console', an interactive shell that
+// keeps one store connection and the unlocked key for a whole session.
+package console
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/output"
+	"github.com/MQ37/lockbox/internal/selector"
+)
+
+// maxHistory is how many history lines are kept
+const maxHistory = 1000
+
+// prompt is shown before each command on a terminal
+const prompt = "lockbox> "
+
+// commands are the console's commands, for help and completion
+var commands = []struct{ name, usage, help string }{
+	{"get", "get KEY...", "print secrets"},
+	{"set", "set KEY [VALUE]", "store a secret, prompting for a hidden value if omitted"},
+	{"delete", "delete KEY... [--force]", "delete secrets; patterns need --force"},
+	{"list", "list [PATTERN...]", "list keys"},
+	{"exists", "exists KEY...", "report whether secrets exist"},
+	{"history", "history", "show the command history"},
+	{"help", "help", "show this help"},
+	{"exit", "exit", "leave the console (also Ctrl-D)"},
+}
+
+// Options configures a console
+type Options struct {
+	// HistoryPath is where redacted history is kept between sessions;
+	// empty keeps history in memory only
+	HistoryPath string
+	// Actor is who writes are made as
+	Actor batch.Actor
+}
+
+// Console runs commands against one open store
+type Console struct {
+	store   *db.Store
+	key     []byte
+	opts    Options
+	history []string
+
+	// readSecret reads a value without echoing it; nil when the input is
+	// not a terminal
+	readSecret func(prompt string) (string, error)
+}
+
+// New returns a console over store, decrypting with key
+func New(store *db.Store, key []byte, opts Options) *Console {
+	return &Console{store: store, key: key, opts: opts}
+}
+
+// Run reads and runs commands from in until EOF or exit. Terminals get
+// line editing, history and tab completion where supported, except in
+// plain mode, whose readers cannot follow the escape sequences it draws.
+func (c *Console) Run(in *os.File, out io.Writer) error {
+	c.loadHistory()
+
+	info, err := in.Stat()
+	interactive := err == nil && info.Mode()&os.ModeCharDevice != 0
+	if interactive && !output.Plain() {
+		if restore, err := makeRaw(in); err == nil {
+			defer restore()
+			return c.runEditor(in, out)
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		if interactive {
+			fmt.Fprint(out, prompt)
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		if c.runLine(scanner.Text(), out) {
+			return nil
+		}
+	}
+}
+
+// runEditor is Run on a terminal in raw mode
+func (c *Console) runEditor(in *os.File, out io.Writer) error {
+	out = crlfWriter{out}
+	e := &editor{in: bufio.NewReader(in), out: out, history: c.history, complete: c.complete}
+	c.readSecret = e.readHidden
+
+	for {
+		e.history = c.history
+		line, err := e.readLine(prompt)
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c.runLine(line, out) {
+			return nil
+		}
+	}
+}
+
+// runLine records and runs one command line, reporting whether the
+// console should exit
+func (c *Console) runLine(line string, out io.Writer) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	c.addHistory(redact(line))
+
+	args, err := splitArgs(line)
+	if err == nil {
+		var quit bool
+		quit, err = c.exec(args, out)
+		if quit {
+			return true
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Error: %v\n", err)
+	}
+	return false
+}
+
+// exec runs one command, reporting whether the console should exit
+func (c *Console) exec(args []string, out io.Writer) (bool, error) {
+	name, args := args[0], args[1:]
+	switch name {
+	case "exit", "quit":
+		return true, nil
+	case "help":
+		for _, cmd := range commands {
+			fmt.Fprintf(out, "  %-24s %s\n", cmd.usage, cmd.help)
+		}
+	case "history":
+		for i, line := range c.history {
+			fmt.Fprintf(out, "%5d  %s\n", i+1, line)
+		}
+	case "get":
+		keys, err := c.resolve(args)
+		if err != nil {
+			return false, err
+		}
+		// Values are labelled unless one key was asked for by name
+		named := len(keys) > 1 || slices.ContainsFunc(args, selector.IsPattern)
+		for _, key := range keys {
+			result, err := batch.Execute(c.store, c.key, c.opts.Actor, batch.Command{Op: "get", Key: key})
+			if err != nil {
+				return false, err
+			}
+			if !named {
+				fmt.Fprintln(out, *result.Value)
+			} else {
+				fmt.Fprintf(out, "%s=%s\n", key, *result.Value)
+			}
+		}
+	case "set":
+		return false, c.set(args, out)
+	case "delete":
+		force := slices.Contains(args, "--force")
+		args = slices.DeleteFunc(args, func(a string) bool { return a == "--force" })
+		for _, arg := range args {
+			if selector.IsPattern(arg) && !force {
+				return false, fmt.Errorf("'%s' is a pattern; add --force to delete every secret it matches", arg)
+			}
+		}
+		keys, err := c.resolve(args)
+		if err != nil {
+			return false, err
+		}
+		for _, key := range keys {
+			if _, err := batch.Execute(c.store, c.key, c.opts.Actor, batch.Command{Op: "delete", Key: key}); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(out, "%s Secret '%s' deleted successfully\n", output.OK, key)
+		}
+	case "list":
+		keys, err := c.store.ListSecrets()
+		if err != nil {
+			return false, err
+		}
+		if len(args) > 0 {
+			if keys, err = selector.Resolve(keys, args); err != nil {
+				return false, err
+			}
+		}
+		for _, key := range keys {
+			fmt.Fprintln(out, key)
+		}
+	case "exists":
+		if len(args) == 0 {
+			return false, fmt.Errorf("usage: exists KEY...")
+		}
+		keys, err := c.store.ListSecrets()
+		if err != nil {
+			return false, err
+		}
+		for _, arg := range args {
+			matched, err := selector.Match(keys, arg)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintf(out, "%s\t%v\n", arg, len(matched) > 0)
+		}
+	default:
+		return false, fmt.Errorf("unknown command '%s'; type 'help' for a list", name)
+	}
+	return false, nil
+}
+
+// set stores a secret, reading the value without echo when not given
+func (c *Console) set(args []string, out io.Writer) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: set KEY [VALUE]; quote values containing spaces")
+	}
+	if len(args) == 1 {
+		if c.readSecret == nil {
+			return fmt.Errorf("usage: set KEY VALUE")
+		}
+		value, err := c.readSecret("Value for " + args[0] + ": ")
+		if err != nil {
+			return err
+		}
+		args = append(args, value)
+	}
+
+	value := args[1]
+	if _, err := batch.Execute(c.store, c.key, c.opts.Actor, batch.Command{Op: "set", Key: args[0], Value: &value}); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s Secret '%s' set successfully\n", output.OK, args[0])
+	return nil
+}
+
+// resolve expands key arguments against the store
+func (c *Console) resolve(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("at least one key is required")
+	}
+	keys, err := c.store.ListSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return selector.Resolve(keys, args)
+}
+
+// complete returns command names for the first word and secret keys for
+// the others
+func (c *Console) complete(line string) []string {
+	word := line[strings.LastIndex(line, " ")+1:]
+
+	var names []string
+	if !strings.Contains(line, " ") {
+		for _, cmd := range commands {
+			names = append(names, cmd.name)
+		}
+	} else {
+		names, _ = c.store.ListSecrets()
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) {
+			candidates = append(candidates, name)
+		}
+	}
+	return candidates
+}
+
+// redact hides the value of set commands so history never holds secrets
+func redact(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) >= 3 && fields[0] == "set" {
+		return "set " + fields[1] + " <redacted>"
+	}
+	return strings.TrimSpace(line)
+}
+
+// addHistory records a line in memory and in the history file
+func (c *Console) addHistory(line string) {
+	if n := len(c.history); n > 0 && c.history[n-1] == line {
+		return
+	}
+	c.history = append(c.history, line)
+	if len(c.history) > maxHistory {
+		c.history = c.history[len(c.history)-maxHistory:]
+	}
+
+	if c.opts.HistoryPath == "" {
+		return
+	}
+	f, err := os.OpenFile(c.opts.HistoryPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// loadHistory reads the history of previous sessions
+func (c *Console) loadHistory() {
+	if c.opts.HistoryPath == "" {
+		return
+	}
+	data, err := os.ReadFile(c.opts.HistoryPath)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	c.history = slices.DeleteFunc(lines, func(l string) bool { return l == "" })
+}
+
+// splitArgs splits a command line into words, honoring single and double
+// quotes and backslash escapes
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// crlfWriter translates newlines for a terminal in raw mode
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	s := strings.ReplaceAll(strings.ReplaceAll(string(p), "\r\n", "\n"), "\n", "\r\n")
+	if _, err := io.WriteString(c.w, s); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
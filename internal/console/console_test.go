@@ -0,0 +1,169 @@
+package console
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// newTestConsole returns a console over a fresh store keeping history in
+// a temporary file
+func newTestConsole(t *testing.T) *Console {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := db.OpenStore(dir + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	return New(store, key, Options{HistoryPath: dir + "/console_history"})
+}
+
+// run feeds input to the console through a pipe and returns its output
+func run(t *testing.T, c *Console, input string) string {
+	t.Helper()
+	r, w, _ := os.Pipe()
+	go func() {
+		io.WriteString(w, input)
+		w.Close()
+	}()
+	var out bytes.Buffer
+	if err := c.Run(r, &out); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	r.Close()
+	return out.String()
+}
+
+func TestConsole(t *testing.T) {
+	c := newTestConsole(t)
+
+	out := run(t, c, `set API_KEY "sk live"
+set DB_USER admin
+get API_KEY
+get DB_*
+list
+exists API_KEY MISSING
+delete DB_*
+delete DB_* --force
+bogus
+exit
+get API_KEY
+`)
+	for _, want := range []string{
+		"✓ Secret 'API_KEY' set successfully\n",
+		"sk live\n",
+		"DB_USER=admin\n",
+		"API_KEY\nDB_USER\n",
+		"API_KEY\ttrue\nMISSING\tfalse\n",
+		"Error: 'DB_*' is a pattern",
+		"✓ Secret 'DB_USER' deleted successfully\n",
+		"Error: unknown command 'bogus'",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "sk live") != 1 {
+		t.Errorf("Commands after exit were run:\n%s", out)
+	}
+
+	history, _ := os.ReadFile(c.opts.HistoryPath)
+	if strings.Contains(string(history), "sk live") || strings.Contains(string(history), "admin") {
+		t.Errorf("History contains a secret value:\n%s", history)
+	}
+	if !strings.Contains(string(history), "set API_KEY <redacted>\n") {
+		t.Errorf("History is missing the redacted set:\n%s", history)
+	}
+
+	// A new session picks up the saved history
+	next := New(c.store, c.key, c.opts)
+	if out := run(t, next, "history\n"); !strings.Contains(out, "set DB_USER <redacted>") {
+		t.Errorf("History was not loaded:\n%s", out)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := map[string][]string{
+		`set KEY value`:          {"set", "KEY", "value"},
+		`set KEY "two words"`:    {"set", "KEY", "two words"},
+		`set KEY 'it''s'`:        {"set", "KEY", "its"},
+		`set KEY a\ b "q\"uote"`: {"set", "KEY", "a b", `q"uote`},
+		`  list  `:               {"list"},
+		`set KEY ''`:             {"set", "KEY", ""},
+	}
+	for line, want := range tests {
+		got, err := splitArgs(line)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("splitArgs(%q) = %q, %v; expected %q", line, got, err, want)
+		}
+	}
+	if _, err := splitArgs(`set KEY "open`); err == nil {
+		t.Errorf("Expected an error for an unterminated quote")
+	}
+}
+
+func TestEditor(t *testing.T) {
+	complete := func(line string) []string {
+		word := line[strings.LastIndex(line, " ")+1:]
+		var out []string
+		for _, c := range []string{"DB_USER", "DB_PASSWORD", "API_KEY"} {
+			if strings.HasPrefix(c, word) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	read := func(input string, history ...string) string {
+		e := &editor{in: bufio.NewReader(strings.NewReader(input)), out: io.Discard, history: history, complete: complete}
+		line, err := e.readLine("> ")
+		if err != nil {
+			t.Fatalf("readLine(%q) failed: %v", input, err)
+		}
+		return line
+	}
+
+	tests := []struct {
+		input   string
+		history []string
+		want    string
+	}{
+		{"get X\r", nil, "get X"},
+		{"get XY\x7f\r", nil, "get X"},
+		{"et\x1b[D\x1b[Dg\r", nil, "get"},
+		{"get A\t\r", nil, "get API_KEY "},
+		{"get D\tU\t\r", nil, "get DB_USER "},
+		{"\x1b[A\x1b[A\r", []string{"list", "get A"}, "list"},
+		{"\x1b[A\x1b[B\r", []string{"list"}, ""},
+		{"get X\x01\x0b\r", nil, ""},
+		{"get KEY\x17\r", nil, "get "},
+	}
+	for _, tt := range tests {
+		if got := read(tt.input, tt.history...); got != tt.want {
+			t.Errorf("readLine(%q) = %q, expected %q", tt.input, got, tt.want)
+		}
+	}
+
+	e := &editor{in: bufio.NewReader(strings.NewReader("\x04")), out: io.Discard}
+	if _, err := e.readLine("> "); err != io.EOF {
+		t.Errorf("Expected io.EOF for Ctrl-D, got %v", err)
+	}
+	e = &editor{in: bufio.NewReader(strings.NewReader("abc\x03")), out: io.Discard}
+	if _, err := e.readLine("> "); err != errInterrupted {
+		t.Errorf("Expected errInterrupted for Ctrl-C, got %v", err)
+	}
+
+	var echo bytes.Buffer
+	e = &editor{in: bufio.NewReader(strings.NewReader("hunter2\r")), out: &echo}
+	if value, _ := e.readHidden("Value: "); value != "hunter2" || strings.Contains(echo.String(), "hunter2") {
+		t.Errorf("readHidden = %q, echoed %q", value, echo.String())
+	}
+}
@@ -0,0 +1,272 @@
+package console
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errInterrupted is returned by readLine when the user presses Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// Key codes the editor handles
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCR        = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyBackspace = 127
+)
+
+// editor reads lines from a terminal in raw mode with cursor movement,
+// history and tab completion
+type editor struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// history holds previous lines, oldest first
+	history []string
+	// complete returns the candidates for the word ending at the end of
+	// line
+	complete func(line string) []string
+}
+
+// readLine shows prompt and returns the line the user enters. io.EOF is
+// returned for Ctrl-D on an empty line and errInterrupted for Ctrl-C.
+func (e *editor) readLine(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	hist := len(e.history)
+	var saved []rune // the line being edited before browsing history
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	insert := func(rs ...rune) {
+		line = append(line[:pos], append(rs, line[pos:]...)...)
+		pos += len(rs)
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if hist == len(e.history) {
+			saved = append([]rune(nil), line...)
+		}
+		hist = i
+		if i == len(e.history) {
+			line = append([]rune(nil), saved...)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+	}
+
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyCR, keyLF:
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case keyBackspace, keyCtrlH:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case keyCtrlA:
+			pos = 0
+		case keyCtrlE:
+			pos = len(line)
+		case keyCtrlB:
+			if pos > 0 {
+				pos--
+			}
+		case keyCtrlF:
+			if pos < len(line) {
+				pos++
+			}
+		case keyCtrlK:
+			line = line[:pos]
+		case keyCtrlU:
+			line, pos = line[pos:], 0
+		case keyCtrlW:
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line, pos = append(line[:start], line[pos:]...), start
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case keyCtrlP:
+			recall(hist - 1)
+		case keyCtrlN:
+			recall(hist + 1)
+		case keyTab:
+			if pos != len(line) || e.complete == nil {
+				break
+			}
+			if extra, shown := e.completeLine(string(line)); shown {
+				fmt.Fprint(e.out, extra)
+			} else {
+				insert([]rune(extra)...)
+			}
+		case keyEscape:
+			switch e.readEscape() {
+			case 'A':
+				recall(hist - 1)
+			case 'B':
+				recall(hist + 1)
+			case 'C':
+				if pos < len(line) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '~':
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				insert(r)
+			}
+		}
+		redraw()
+	}
+}
+
+// readEscape consumes the rest of an escape sequence and returns its final
+// byte: A-D for arrows, H and F for home and end, ~ for delete. Other
+// sequences return 0.
+func (e *editor) readEscape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	var params []byte
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if c >= '0' && c <= '9' || c == ';' {
+			params = append(params, c)
+			continue
+		}
+		switch {
+		case c == '~' && string(params) == "3":
+			return '~'
+		case c == '~' && (string(params) == "1" || string(params) == "7"):
+			return 'H'
+		case c == '~' && (string(params) == "4" || string(params) == "8"):
+			return 'F'
+		case c == '~':
+			return 0
+		}
+		return c
+	}
+}
+
+// completeLine completes the last word of line. It returns the text to
+// insert, or, when the candidates share no longer prefix, a listing of
+// them to print above the prompt.
+func (e *editor) completeLine(line string) (string, bool) {
+	word := line[strings.LastIndex(line, " ")+1:]
+	candidates := e.complete(line)
+	switch len(candidates) {
+	case 0:
+		return "", false
+	case 1:
+		return strings.TrimPrefix(candidates[0], word) + " ", false
+	}
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		return strings.TrimPrefix(prefix, word), false
+	}
+	return "\r\n" + strings.Join(candidates, "  ") + "\r\n", true
+}
+
+// readHidden reads a line without echoing it, for secret values
+func (e *editor) readHidden(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	var line []rune
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case keyCR, keyLF:
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyCtrlH:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case keyCtrlU:
+			line = nil
+		default:
+			if r >= ' ' {
+				line = append(line, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package console
+
+import (
+	"fmt"
+	"os"
+)
+
+// makeRaw is only supported on Linux; elsewhere the console reads whole
+// lines without editing or completion
+func makeRaw(f *os.File) (func(), error) {
+	return nil, fmt.Errorf("line editing is not supported on this platform")
+}
@@ -0,0 +1,32 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// digestContext separates the HMAC subkey from the encryption key so the
+// digest of a value can never be confused with any other use of the key.
+const digestContext = "lockbox/value-digest/v1"
+
+// Digest returns a hex-encoded HMAC-SHA256 of plaintext keyed by a subkey
+// derived from the store key. Equal plaintexts yield equal digests, which
+// allows identical values to share one ciphertext blob without revealing
+// anything to a reader who does not hold the key.
+func Digest(plaintext []byte, key []byte) (string, error) {
+	// Validate key size
+	if len(key) != KeySize {
+		return "", fmt.Errorf("invalid key size: expected %d bytes, got %d", KeySize, len(key))
+	}
+
+	// Derive the digest subkey
+	sub := hmac.New(sha256.New, key)
+	sub.Write([]byte(digestContext))
+	subkey := sub.Sum(nil)
+
+	mac := hmac.New(sha256.New, subkey)
+	mac.Write(plaintext)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+
+	d1, err := Digest([]byte("same value"), key)
+	if err != nil {
+		t.Fatalf("Digest() failed: %v", err)
+	}
+	d2, err := Digest([]byte("same value"), key)
+	if err != nil {
+		t.Fatalf("Digest() failed: %v", err)
+	}
+	if d1 != d2 {
+		t.Errorf("Digest() not deterministic: %s != %s", d1, d2)
+	}
+
+	d3, err := Digest([]byte("other value"), key)
+	if err != nil {
+		t.Fatalf("Digest() failed: %v", err)
+	}
+	if d1 == d3 {
+		t.Error("Digest() returned the same digest for different values")
+	}
+
+	// A different key must produce a different digest for the same value
+	key2, _ := GenerateKey()
+	d4, err := Digest([]byte("same value"), key2)
+	if err != nil {
+		t.Fatalf("Digest() failed: %v", err)
+	}
+	if d1 == d4 {
+		t.Error("Digest() returned the same digest under different keys")
+	}
+}
+
+func TestDigestInvalidKey(t *testing.T) {
+	if _, err := Digest([]byte("value"), []byte("short")); err == nil {
+		t.Error("Digest() should fail with an invalid key size")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	key, _ := GenerateKey()
+	f1, err := Fingerprint(key)
+	if err != nil {
+		t.Fatalf("Fingerprint() failed: %v", err)
+	}
+	if len(f1) != 24 || strings.Count(f1, "-") != 4 || strings.ToUpper(f1) != f1 {
+		t.Errorf("Fingerprint() = %q, want five dash-separated groups of four hex digits", f1)
+	}
+	if f2, _ := Fingerprint(key); f1 != f2 {
+		t.Errorf("Fingerprint() not deterministic: %s != %s", f1, f2)
+	}
+
+	// The fingerprint must not be the value digest of anything under the key
+	if d, _ := Digest([]byte(fingerprintContext), key); strings.HasPrefix(d, strings.ToLower(strings.ReplaceAll(f1, "-", ""))) {
+		t.Error("Fingerprint() matches a value digest")
+	}
+	key2, _ := GenerateKey()
+	if f3, _ := Fingerprint(key2); f1 == f3 {
+		t.Error("Fingerprint() returned the same fingerprint for different keys")
+	}
+	if _, err := Fingerprint(key[:16]); err == nil {
+		t.Error("Fingerprint() accepted a short key")
+	}
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// fingerprintContext separates the fingerprint from any other use of the
+// key
+const fingerprintContext = "lockbox/key-fingerprint/v1"
+
+// fingerprintBytes is how much of the MAC a fingerprint shows: 80 bits,
+// five groups of four hex digits
+const fingerprintBytes = 10
+
+// Fingerprint returns a short code identifying key, such as
+// 4F2A-91C0-7B44-E5D1-0A3C, for people to compare by eye. It is a MAC
+// keyed by key, so it reveals nothing about the key and only a holder of
+// the key can produce it.
+func Fingerprint(key []byte) (string, error) {
+	if len(key) != KeySize {
+		return "", fmt.Errorf("invalid key size: expected %d bytes, got %d", KeySize, len(key))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fingerprintContext))
+	digits := strings.ToUpper(hex.EncodeToString(mac.Sum(nil)[:fingerprintBytes]))
+
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
@@ -0,0 +1,60 @@
+package crypto
+
+// GuardedKey holds an encryption key in memory that is locked against
+// swapping, surrounded by inaccessible guard pages and read-only once
+// written, where the platform allows it
+type GuardedKey struct {
+	key    []byte
+	region []byte
+	locked bool
+}
+
+// NewGuardedKey copies key into a guarded region and wipes the original.
+// When the region cannot be set up the key is kept in ordinary memory and
+// Locked reports false.
+func NewGuardedKey(key []byte) *GuardedKey {
+	g := &GuardedKey{}
+	region, buf, err := allocGuarded(len(key))
+	if err == nil {
+		copy(buf, key)
+		if err = sealGuarded(region, buf); err != nil {
+			freeGuarded(region, buf)
+		}
+	}
+	if err == nil {
+		g.key, g.region, g.locked = buf, region, true
+	} else {
+		g.key = append([]byte(nil), key...)
+	}
+	wipe(key)
+	return g
+}
+
+// Bytes returns the key. On guarded platforms the slice is read-only;
+// writing to it faults.
+func (g *GuardedKey) Bytes() []byte {
+	return g.key
+}
+
+// Locked reports whether the key lives in a guarded region
+func (g *GuardedKey) Locked() bool {
+	return g.locked
+}
+
+// Destroy wipes the key and releases its region. The key must not be used
+// afterwards.
+func (g *GuardedKey) Destroy() {
+	if g.locked {
+		freeGuarded(g.region, g.key)
+	} else {
+		wipe(g.key)
+	}
+	g.key, g.region, g.locked = nil, nil, false
+}
+
+// wipe zeroes b
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
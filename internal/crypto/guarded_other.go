@@ -0,0 +1,14 @@
+//go:build !unix
+
+package crypto
+
+import "fmt"
+
+// allocGuarded is unsupported; keys stay in ordinary memory
+func allocGuarded(size int) (region, buf []byte, err error) {
+	return nil, nil, fmt.Errorf("guarded memory is not supported on this platform")
+}
+
+func sealGuarded(region, buf []byte) error { return nil }
+
+func freeGuarded(region, buf []byte) {}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+func TestGuardedKey(t *testing.T) {
+	key, _ := GenerateKey()
+	want := append([]byte(nil), key...)
+
+	g := NewGuardedKey(key)
+	defer g.Destroy()
+
+	if !bytes.Equal(g.Bytes(), want) {
+		t.Fatalf("Guarded key does not match the original")
+	}
+	if !bytes.Equal(key, make([]byte, KeySize)) {
+		t.Errorf("Expected the original key to be wiped")
+	}
+	if runtime.GOOS == "linux" && !g.Locked() {
+		t.Logf("Guarded memory unavailable (RLIMIT_MEMLOCK?); key kept in ordinary memory")
+	}
+
+	ciphertext, _ := Encrypt([]byte("value"), want)
+	plaintext, err := Decrypt(ciphertext, g.Bytes())
+	if err != nil || string(plaintext) != "value" {
+		t.Errorf("Decrypt with guarded key = %q, %v", plaintext, err)
+	}
+
+	g.Destroy()
+	if g.Bytes() != nil || g.Locked() {
+		t.Errorf("Expected Destroy to release the key")
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package crypto
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocGuarded maps size bytes of locked memory between two PROT_NONE
+// guard pages, returning the whole mapping and the usable slice
+func allocGuarded(size int) (region, buf []byte, err error) {
+	page := os.Getpagesize()
+	inner := (size + page - 1) / page * page
+
+	region, err = unix.Mmap(-1, 0, inner+2*page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map guarded memory: %w", err)
+	}
+
+	if err := unix.Mprotect(region[:page], unix.PROT_NONE); err != nil {
+		unix.Munmap(region)
+		return nil, nil, fmt.Errorf("failed to protect guard page: %w", err)
+	}
+	if err := unix.Mprotect(region[page+inner:], unix.PROT_NONE); err != nil {
+		unix.Munmap(region)
+		return nil, nil, fmt.Errorf("failed to protect guard page: %w", err)
+	}
+	if err := unix.Mlock(region[page : page+inner]); err != nil {
+		unix.Munmap(region)
+		return nil, nil, fmt.Errorf("failed to lock guarded memory: %w", err)
+	}
+
+	// Right-align the key so overruns hit the trailing guard page
+	return region, region[page+inner-size : page+inner], nil
+}
+
+// sealGuarded makes the pages holding buf read-only
+func sealGuarded(region, buf []byte) error {
+	page := os.Getpagesize()
+	if err := unix.Mprotect(region[page:len(region)-page], unix.PROT_READ); err != nil {
+		return fmt.Errorf("failed to seal guarded memory: %w", err)
+	}
+	return nil
+}
+
+// freeGuarded wipes buf and unmaps region
+func freeGuarded(region, buf []byte) {
+	page := os.Getpagesize()
+	inner := region[page : len(region)-page]
+	unix.Mprotect(inner, unix.PROT_READ|unix.PROT_WRITE)
+	wipe(buf)
+	unix.Munlock(inner)
+	unix.Munmap(region)
+}
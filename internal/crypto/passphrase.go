@@ -0,0 +1,107 @@
+package crypto
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id cost of newly wrapped keys, the second recommendation of RFC
+// 9106: 3 passes over 64 MiB with 4 lanes
+var (
+	PassphraseTime    uint32 = 3
+	PassphraseMemory  uint32 = 64 * 1024
+	PassphraseThreads uint8  = 4
+)
+
+// PassphraseIterations is the PBKDF2-SHA256 work factor, used for keys
+// wrapped before Argon2id became the default and by recovery kits
+var PassphraseIterations = 600_000
+
+// Key derivations recorded in wrapped keys. Keys are wrapped with
+// Argon2id; PBKDF2 wraps are still unwrapped.
+const (
+	kdfArgon2id = "argon2id"
+	kdfPBKDF2   = "pbkdf2-sha256"
+)
+
+// ErrWrongPassphrase is returned by UnwrapKey when the passphrase does not
+// unwrap the key
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// wrappedKey is the stored form of a key wrapped with a passphrase.
+// Iterations is the PBKDF2 work factor; Time, Memory (KiB) and Threads the
+// Argon2id cost.
+type wrappedKey struct {
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations,omitempty"`
+	Time       uint32 `json:"time,omitempty"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	Wrapped    []byte `json:"wrapped"`
+}
+
+// kek derives the key encrypting the wrapped key from passphrase
+func (w wrappedKey) kek(passphrase string) ([]byte, error) {
+	switch w.KDF {
+	case kdfArgon2id:
+		if w.Time == 0 || w.Memory == 0 || w.Threads == 0 {
+			return nil, fmt.Errorf("invalid Argon2id parameters in wrapped key")
+		}
+		return argon2.IDKey([]byte(passphrase), w.Salt, w.Time, w.Memory, w.Threads, KeySize), nil
+	case kdfPBKDF2:
+		kek, err := pbkdf2.Key(sha256.New, passphrase, w.Salt, w.Iterations, KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive passphrase key: %w", err)
+		}
+		return kek, nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation '%s'", w.KDF)
+}
+
+// WrapKey encrypts key with a key derived from passphrase with Argon2id
+func WrapKey(key []byte, passphrase string) ([]byte, error) {
+	return wrapKey(key, passphrase, wrappedKey{KDF: kdfArgon2id, Time: PassphraseTime, Memory: PassphraseMemory, Threads: PassphraseThreads})
+}
+
+// wrapKey encrypts key with a key derived from passphrase as w describes
+func wrapKey(key []byte, passphrase string, w wrappedKey) ([]byte, error) {
+	w.Salt = make([]byte, 16)
+	if _, err := rand.Read(w.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	kek, err := w.kek(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	if w.Wrapped, err = Encrypt(key, kek); err != nil {
+		return nil, err
+	}
+	return json.Marshal(w)
+}
+
+// UnwrapKey recovers a key wrapped by WrapKey, with whichever key
+// derivation it was wrapped with
+func UnwrapKey(data []byte, passphrase string) ([]byte, error) {
+	var w wrappedKey
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, fmt.Errorf("failed to parse wrapped key: %w", err)
+	}
+	kek, err := w.kek(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	key, err := Decrypt(w.Wrapped, kek)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWrapKey(t *testing.T) {
+	defer func(m uint32) { PassphraseMemory = m }(PassphraseMemory)
+	PassphraseMemory = 1024
+
+	key, _ := GenerateKey()
+	wrapped, err := WrapKey(key, "correct horse")
+	if err != nil {
+		t.Fatalf("WrapKey failed: %v", err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Error("wrapped key holds the key")
+	}
+	var w wrappedKey
+	if json.Unmarshal(wrapped, &w); w.KDF != "argon2id" || w.Memory != 1024 || w.Time != PassphraseTime || w.Threads != PassphraseThreads {
+		t.Errorf("Unexpected key derivation %+v", w)
+	}
+
+	got, err := UnwrapKey(wrapped, "correct horse")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("UnwrapKey = %x, %v, want %x", got, err, key)
+	}
+	if _, err := UnwrapKey(wrapped, "battery staple"); err != ErrWrongPassphrase {
+		t.Errorf("UnwrapKey with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestUnwrapPBKDF2Key(t *testing.T) {
+	// Keys wrapped before Argon2id became the default
+	key, _ := GenerateKey()
+	wrapped, err := wrapKey(key, "correct horse", wrappedKey{KDF: "pbkdf2-sha256", Iterations: 1000})
+	if err != nil {
+		t.Fatalf("wrapKey failed: %v", err)
+	}
+	got, err := UnwrapKey(wrapped, "correct horse")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("UnwrapKey = %x, %v, want %x", got, err, key)
+	}
+	if _, err := UnwrapKey(wrapped, "battery staple"); err != ErrWrongPassphrase {
+		t.Errorf("UnwrapKey with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+
+	if _, err := UnwrapKey([]byte(`{"kdf":"scrypt","salt":"AA==","wrapped":"AA=="}`), "x"); err == nil {
+		t.Error("UnwrapKey accepted an unknown key derivation")
+	}
+	if _, err := UnwrapKey([]byte(`{"kdf":"argon2id","salt":"AA==","wrapped":"AA=="}`), "x"); err == nil {
+		t.Error("UnwrapKey accepted Argon2id without parameters")
+	}
+}
@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Seal encrypts plaintext to an X25519 public key. A fresh ephemeral key is
+// exchanged with recipient and the result, bound to both public keys and
+// info, is expanded by HKDF-SHA256 into an AES-256-GCM key. The ephemeral
+// public key must be passed to Unseal along with the ciphertext.
+func Seal(plaintext []byte, recipient *ecdh.PublicKey, info string) (ephemeral, ciphertext []byte, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	key, err := sealKey(priv, recipient, priv.PublicKey(), recipient, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err = Encrypt(plaintext, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv.PublicKey().Bytes(), ciphertext, nil
+}
+
+// Unseal decrypts a ciphertext produced by Seal with the recipient's key
+func Unseal(ephemeral, ciphertext []byte, key *ecdh.PrivateKey, info string) ([]byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	secret, err := sealKey(key, peer, peer, key.PublicKey(), info)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(ciphertext, secret)
+}
+
+// sealKey derives the content key from an X25519 exchange between priv and
+// peer
+func sealKey(priv *ecdh.PrivateKey, peer, ephemeral, recipient *ecdh.PublicKey, info string) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, salt, info, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,37 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSealUnseal(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	ephemeral, ciphertext, err := Seal([]byte("secret"), key.PublicKey(), "test")
+	if err != nil {
+		t.Fatalf("Seal() failed: %v", err)
+	}
+	plaintext, err := Unseal(ephemeral, ciphertext, key, "test")
+	if err != nil || !bytes.Equal(plaintext, []byte("secret")) {
+		t.Errorf("Unseal() = %q, %v", plaintext, err)
+	}
+
+	// The context string is part of the key
+	if _, err := Unseal(ephemeral, ciphertext, key, "other"); err == nil {
+		t.Error("Unseal() succeeded with a different context")
+	}
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := Unseal(ephemeral, ciphertext, other, "test"); err == nil {
+		t.Error("Unseal() succeeded with another key")
+	}
+	if _, err := Unseal([]byte{1, 2, 3}, ciphertext, key, "test"); err == nil {
+		t.Error("Unseal() accepted an invalid ephemeral key")
+	}
+}
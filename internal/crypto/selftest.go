@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Known-answer vectors: AES-256-GCM from the GCM specification (test case
+// 14), HMAC-SHA256 from RFC 4231 (test case 2) and X25519 from RFC 7748
+// (section 6.1)
+const (
+	katGCMCiphertext = "000000000000000000000000" + "cea7403d4d606b6e074ec5d3baf39d18" + "d0d1c8a799996bf0265b98b5d48ab919"
+	katHMACKey       = "Jefe"
+	katHMACData      = "what do ya want for nothing?"
+	katHMAC          = "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	katX25519Private = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	katX25519Peer    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	katX25519Shared  = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+)
+
+// SelfTest checks the primitives lockbox depends on against known answers
+// and round-trips a freshly encrypted value, so a broken crypto backend is
+// caught before it touches a store
+func SelfTest() error {
+	// AES-256-GCM: all-zero key and nonce, 16 zero bytes of plaintext
+	ciphertext, _ := hex.DecodeString(katGCMCiphertext)
+	plaintext, err := Decrypt(ciphertext, make([]byte, KeySize))
+	if err != nil || !bytes.Equal(plaintext, make([]byte, 16)) {
+		return errors.New("AES-256-GCM known-answer test failed")
+	}
+
+	mac := hmac.New(sha256.New, []byte(katHMACKey))
+	mac.Write([]byte(katHMACData))
+	if hex.EncodeToString(mac.Sum(nil)) != katHMAC {
+		return errors.New("HMAC-SHA256 known-answer test failed")
+	}
+
+	priv, _ := hex.DecodeString(katX25519Private)
+	peer, _ := hex.DecodeString(katX25519Peer)
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("X25519 known-answer test failed: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return fmt.Errorf("X25519 known-answer test failed: %w", err)
+	}
+	if shared, err := key.ECDH(pub); err != nil || hex.EncodeToString(shared) != katX25519Shared {
+		return errors.New("X25519 known-answer test failed")
+	}
+
+	// Fresh nonces from the system RNG must round-trip and differ
+	roundTripKey, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	first, err := Encrypt([]byte("lockbox"), roundTripKey)
+	if err != nil {
+		return err
+	}
+	second, err := Encrypt([]byte("lockbox"), roundTripKey)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(first, second) {
+		return errors.New("encryption is not randomized; nonces repeat")
+	}
+	if plaintext, err := Decrypt(first, roundTripKey); err != nil || string(plaintext) != "lockbox" {
+		return errors.New("encryption round trip failed")
+	}
+	return nil
+}
+
+// sentinelPlaintext is the known value sealed in a store's sentinel
+const sentinelPlaintext = "lockbox key check v1"
+
+// ErrWrongKey is returned by CheckSentinel when the key does not decrypt
+// the sentinel
+var ErrWrongKey = errors.New("encryption key does not match this store; the key or store may be corrupt")
+
+// NewSentinel encrypts a known value with key. Storing it alongside the
+// secrets lets CheckSentinel later confirm the key is the one they were
+// written with.
+func NewSentinel(key []byte) ([]byte, error) {
+	return Encrypt([]byte(sentinelPlaintext), key)
+}
+
+// CheckSentinel confirms that sentinel, from NewSentinel, decrypts with key
+func CheckSentinel(sentinel, key []byte) error {
+	plaintext, err := Decrypt(sentinel, key)
+	if err != nil || string(plaintext) != sentinelPlaintext {
+		return ErrWrongKey
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatalf("SelfTest() failed: %v", err)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	key, _ := GenerateKey()
+	sentinel, err := NewSentinel(key)
+	if err != nil {
+		t.Fatalf("NewSentinel() failed: %v", err)
+	}
+	if err := CheckSentinel(sentinel, key); err != nil {
+		t.Errorf("CheckSentinel() failed with the right key: %v", err)
+	}
+
+	other, _ := GenerateKey()
+	if err := CheckSentinel(sentinel, other); err != ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey for another key, got %v", err)
+	}
+	if err := CheckSentinel(sentinel, key[:16]); err != ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey for a truncated key, got %v", err)
+	}
+
+	// A sentinel over another value is not accepted
+	forged, _ := Encrypt([]byte("something else"), key)
+	if err := CheckSentinel(forged, key); err != ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey for a forged sentinel, got %v", err)
+	}
+}
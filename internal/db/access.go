@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Access is a recorded read of a secret
+type Access struct {
+	ID  int64
+	At  time.Time
+	Key string
+	// Source is how the secret was read, e.g. cli or server
+	Source string
+	// Identity is who read it, e.g. uid:1000, token:ci or remote:10.0.0.5
+	Identity string
+}
+
+// RecordAccess logs a read of keys by identity through source. Keys in a
+// vault are logged qualified, as VAULT/KEY.
+func (s *Store) RecordAccess(source, identity string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		if _, err := tx.Exec("INSERT INTO access_log (key, source, identity) VALUES (?, ?, ?)", s.Qualify(key), source, identity); err != nil {
+			return fmt.Errorf("failed to record access: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record access: %w", err)
+	}
+	return nil
+}
+
+// Accesses returns the reads recorded at or after since, oldest first
+func (s *Store) Accesses(since time.Time) ([]Access, error) {
+	rows, err := s.db.Query(
+		"SELECT id, at, key, source, identity FROM access_log WHERE at >= ? ORDER BY id ASC",
+		since.UTC().Format(time.DateTime),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log: %w", err)
+	}
+	defer rows.Close()
+
+	var accesses []Access
+	for rows.Next() {
+		var a Access
+		if err := rows.Scan(&a.ID, &a.At, &a.Key, &a.Source, &a.Identity); err != nil {
+			return nil, fmt.Errorf("failed to scan access: %w", err)
+		}
+		accesses = append(accesses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating access log: %w", err)
+	}
+	return accesses, nil
+}
+
+// LoadAccessed sets the Accessed time of each of infos, secrets of the
+// current vault, to its latest read in the access log
+func (s *Store) LoadAccessed(infos []SecretInfo) error {
+	rows, err := s.db.Query("SELECT key, at FROM access_log WHERE id IN (SELECT MAX(id) FROM access_log GROUP BY key)")
+	if err != nil {
+		return fmt.Errorf("failed to read access log: %w", err)
+	}
+	defer rows.Close()
+
+	last := map[string]time.Time{}
+	for rows.Next() {
+		var key string
+		var at time.Time
+		if err := rows.Scan(&key, &at); err != nil {
+			return fmt.Errorf("failed to scan access: %w", err)
+		}
+		last[key] = at
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating access log: %w", err)
+	}
+	for i := range infos {
+		infos[i].Accessed = last[s.Qualify(infos[i].Key)]
+	}
+	return nil
+}
+
+// PruneAccesses forgets reads recorded before before
+func (s *Store) PruneAccesses(before time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM access_log WHERE at < ?", before.UTC().Format(time.DateTime)); err != nil {
+		return fmt.Errorf("failed to prune access log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditEvent is an entry of the audit log
+type AuditEvent struct {
+	ID int64
+	At time.Time
+	// Actor is the policy subject that acted, e.g. uid:1000
+	Actor  string
+	Action string
+	// Detail describes the action; it never holds secret values
+	Detail string
+}
+
+// Audit appends an event to the audit log
+func (s *Store) Audit(actor, action, detail string) error {
+	return audit(s.db, actor, action, detail)
+}
+
+// Audit is Store.Audit within the transaction, so the event is recorded
+// only if the transaction commits
+func (t *Tx) Audit(actor, action, detail string) error {
+	return audit(t.tx, actor, action, detail)
+}
+
+// audit is Audit against e
+func audit(e execer, actor, action, detail string) error {
+	if _, err := e.Exec("INSERT INTO audit_log (actor, action, detail) VALUES (?, ?, ?)", actor, action, detail); err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// AuditEvents returns the audit log oldest first, only events of action
+// unless it is ""
+func (s *Store) AuditEvents(action string) ([]AuditEvent, error) {
+	rows, err := s.db.Query(
+		"SELECT id, at, actor, action, detail FROM audit_log WHERE ? = '' OR action = ? ORDER BY id ASC",
+		action, action,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audit log: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Change is the current state of a secret written after some revision, or
+// a record that it was deleted
+type Change struct {
+	// Vault is the secret's vault, "" for the default vault
+	Vault string
+	Key   string
+	// Version is the store revision of the write or delete
+	Version uint64
+	Deleted bool
+	Kind    string
+	Owner   string
+	Created time.Time
+	Updated time.Time
+	// Digest names the shared blob holding the value, "" for inline values
+	Digest string
+	// Value is the ciphertext, still encrypted with the store key
+	Value []byte
+	// Expires is when a temporary secret expires, zero for permanent ones
+	Expires time.Time
+	// Expiry is when the secret expires under set --ttl or --expires, zero
+	// for never; unlike a temporary secret it is kept until pruned
+	Expiry      time.Time
+	Tags        []string
+	Description string
+}
+
+// Changes calls fn with every secret in every vault written or deleted
+// after revision since, deletes first and then writes in version order
+func (s *Store) Changes(since uint64, fn func(Change) error) error {
+	rows, err := s.db.Query("SELECT vault, key, version FROM tombstones WHERE version > ? ORDER BY version ASC, vault ASC, key ASC", since)
+	if err != nil {
+		return fmt.Errorf("failed to list deleted secrets: %w", err)
+	}
+	var deleted []Change
+	for rows.Next() {
+		c := Change{Deleted: true}
+		if err := rows.Scan(&c.Vault, &c.Key, &c.Version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan deleted secret: %w", err)
+		}
+		deleted = append(deleted, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating deleted secrets: %w", err)
+	}
+	for _, c := range deleted {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+
+	rows, err = s.db.Query(
+		`SELECT s.vault, s.key, s.version, s.kind, s.owner, s.created_at, s.updated_at, COALESCE(s.digest, ''), COALESCE(b.value, s.value), COALESCE(t.expires_at, 0), s.expires_at,
+		        COALESCE(m.tags, ''), COALESCE(m.description, '')
+		 FROM secrets s LEFT JOIN blobs b ON b.digest = s.digest
+		 LEFT JOIN temp_secrets t ON t.vault = s.vault AND t.key = s.key
+		 LEFT JOIN secret_meta m ON m.vault = s.vault AND m.key = s.key
+		 WHERE s.version > ? ORDER BY s.version ASC, s.vault ASC, s.key ASC`,
+		since,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list changed secrets: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Change
+		var expires, expiry int64
+		var tags string
+		if err := rows.Scan(&c.Vault, &c.Key, &c.Version, &c.Kind, &c.Owner, &c.Created, &c.Updated, &c.Digest, &c.Value, &expires, &expiry, &tags, &c.Description); err != nil {
+			return fmt.Errorf("failed to scan changed secret: %w", err)
+		}
+		c.Expires, c.Expiry, c.Tags = timeOrZero(expires), timeOrZero(expiry), splitLines(tags)
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating changed secrets: %w", err)
+	}
+	return nil
+}
+
+// ApplyChange writes c, as read by Changes from another store, to its vault
+// keeping its kind, owner, timestamps, expiries, tags and description.
+// Nothing is archived to escrow: the change restores a value rather than
+// replacing one. Nor is it indexed; searches decrypt it until its search
+// index entry is rebuilt.
+func (t *Tx) ApplyChange(c Change) error {
+	if err := t.applyChange(c, nil, nil); err != nil || c.Deleted {
+		return err
+	}
+	return setSecretMeta(t.tx, c.Vault, c.Key, Meta{Tags: c.Tags, Description: c.Description})
+}
+
+// ImportChange is ApplyChange for a value new to the store, such as one
+// imported from an archive: the value it replaces is archived to escrow
+// and the new one is indexed. Tags and description already on the secret
+// are kept.
+func (t *Tx) ImportChange(c Change) error {
+	return t.applyChange(c, t.escrow, t.index)
+}
+
+// applyChange is ApplyChange archiving replaced values to esc and
+// indexing new ones with ix
+func (t *Tx) applyChange(c Change, esc Escrow, ix Indexer) error {
+	if c.Deleted {
+		if err := deleteSecret(t.tx, esc, c.Vault, c.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	var err error
+	if c.Digest != "" {
+		err = setSecretBlob(t.tx, esc, c.Vault, c.Key, c.Digest, c.Value)
+		if err == nil {
+			err = indexSecret(t.tx, ix, c.Vault, c.Key, c.Digest, c.Value)
+		}
+	} else {
+		err = setKindSecret(t.tx, esc, c.Vault, c.Kind, c.Key, c.Value)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.Exec(
+		"UPDATE secrets SET kind = ?, owner = ?, created_at = ?, updated_at = ?, expires_at = ? WHERE vault = ? AND key = ?",
+		c.Kind, c.Owner, c.Created.UTC().Format(time.DateTime), c.Updated.UTC().Format(time.DateTime), unixOrZero(c.Expiry), c.Vault, c.Key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to restore secret '%s': %w", c.Key, err)
+	}
+	if !c.Expires.IsZero() {
+		return setTemporary(t.tx, c.Vault, c.Key, c.Expires)
+	}
+	return nil
+}
+
+// ListConfig returns every configuration entry
+func (s *Store) ListConfig() (map[string][]byte, error) {
+	rows, err := s.db.Query("SELECT key, value FROM config")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config: %w", err)
+	}
+	defer rows.Close()
+
+	config := map[string][]byte{}
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan config: %w", err)
+		}
+		config[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating config: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCheckedOut is returned when a secret is checked out by someone else
+var ErrCheckedOut = errors.New("checked out by someone else")
+
+// Checkout records who holds a shared secret and until when. Checkouts
+// coordinate people; they do not stop anyone reading the secret.
+type Checkout struct {
+	// Vault is the secret's vault, "" for the default vault
+	Vault string
+	Key   string
+	// Holder is the policy subject holding the secret, e.g. "uid:1000"
+	Holder  string
+	At      time.Time
+	Expires time.Time
+}
+
+// Expired reports whether the checkout has run out at now. An expired
+// checkout no longer blocks others until it is checked in.
+func (c Checkout) Expired(now time.Time) bool {
+	return !now.Before(c.Expires)
+}
+
+// checkoutColumns are the columns read by scanCheckout
+const checkoutColumns = "vault, key, holder, checked_out_at, expires_at"
+
+// scanCheckout reads a checkout selected with checkoutColumns
+func scanCheckout(row interface{ Scan(...any) error }) (Checkout, error) {
+	var c Checkout
+	var at, expires int64
+	if err := row.Scan(&c.Vault, &c.Key, &c.Holder, &at, &expires); err != nil {
+		return c, err
+	}
+	c.At, c.Expires = time.Unix(at, 0), time.Unix(expires, 0)
+	return c, nil
+}
+
+// CheckOut records that holder holds key until expires, returning the
+// checkout it replaces, if any. If someone else holds key and their
+// checkout has not expired, it returns their checkout and ErrCheckedOut
+// unless force is set. Checking out a missing secret returns ErrNotFound.
+func (s *Store) CheckOut(key, holder string, expires time.Time, force bool) (Checkout, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Checkout{}, fmt.Errorf("failed to check out '%s': %w", key, err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM secrets WHERE vault = ? AND key = ?)", s.vault, key).Scan(&exists); err != nil {
+		return Checkout{}, fmt.Errorf("failed to check out '%s': %w", key, err)
+	} else if !exists {
+		return Checkout{}, ErrNotFound
+	}
+	now := time.Now()
+	prev, err := scanCheckout(tx.QueryRow("SELECT "+checkoutColumns+" FROM checkouts WHERE vault = ? AND key = ?", s.vault, key))
+	if err != nil && err != sql.ErrNoRows {
+		return Checkout{}, fmt.Errorf("failed to read checkout: %w", err)
+	}
+	if err == nil && prev.Holder != holder && !prev.Expired(now) && !force {
+		return prev, ErrCheckedOut
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO checkouts (vault, key, holder, checked_out_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		s.vault, key, holder, now.Unix(), expires.Unix(),
+	)
+	if err != nil {
+		return Checkout{}, fmt.Errorf("failed to check out '%s': %w", key, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Checkout{}, fmt.Errorf("failed to check out '%s': %w", key, err)
+	}
+	return prev, nil
+}
+
+// CheckIn ends the checkout of key, returning it. It returns ErrNotFound
+// if key is not checked out, and ErrCheckedOut if someone other than
+// holder holds it, unless force is set.
+func (s *Store) CheckIn(key, holder string, force bool) (Checkout, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Checkout{}, fmt.Errorf("failed to check in '%s': %w", key, err)
+	}
+	defer tx.Rollback()
+
+	c, err := scanCheckout(tx.QueryRow("SELECT "+checkoutColumns+" FROM checkouts WHERE vault = ? AND key = ?", s.vault, key))
+	if err == sql.ErrNoRows {
+		return Checkout{}, ErrNotFound
+	} else if err != nil {
+		return Checkout{}, fmt.Errorf("failed to read checkout: %w", err)
+	}
+	if c.Holder != holder && !force {
+		return c, ErrCheckedOut
+	}
+	if _, err := tx.Exec("DELETE FROM checkouts WHERE vault = ? AND key = ?", s.vault, key); err != nil {
+		return Checkout{}, fmt.Errorf("failed to check in '%s': %w", key, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Checkout{}, fmt.Errorf("failed to check in '%s': %w", key, err)
+	}
+	return c, nil
+}
+
+// Checkouts returns the checkouts in s's vault, sorted by key
+func (s *Store) Checkouts() ([]Checkout, error) {
+	return s.queryCheckouts("SELECT "+checkoutColumns+" FROM checkouts WHERE vault = ? ORDER BY key ASC", s.vault)
+}
+
+// ExpiredCheckouts returns the checkouts of every vault that have expired
+// at now and were not returned before, so each expiry is reported once
+func (s *Store) ExpiredCheckouts(now time.Time) ([]Checkout, error) {
+	expired, err := s.queryCheckouts(
+		"SELECT "+checkoutColumns+" FROM checkouts WHERE reminded = 0 AND expires_at <= ? ORDER BY vault ASC, key ASC",
+		now.Unix(),
+	)
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+	for _, c := range expired {
+		_, err := s.db.Exec(
+			"UPDATE checkouts SET reminded = 1 WHERE vault = ? AND key = ? AND checked_out_at = ?",
+			c.Vault, c.Key, c.At.Unix(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update checkout: %w", err)
+		}
+	}
+	return expired, nil
+}
+
+// queryCheckouts returns the checkouts selected by query
+func (s *Store) queryCheckouts(query string, args ...any) ([]Checkout, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkouts: %w", err)
+	}
+	defer rows.Close()
+
+	var checkouts []Checkout
+	for rows.Next() {
+		c, err := scanCheckout(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan checkout: %w", err)
+		}
+		checkouts = append(checkouts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating checkouts: %w", err)
+	}
+	return checkouts, nil
+}
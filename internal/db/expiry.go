@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SetExpiry makes the secret key expire at expires; zero means never.
+// Expired secrets are left out of ListSecrets, so env, run and the server
+// stop handing them out, but are kept until PruneExpired.
+func (s *Store) SetExpiry(key string, expires time.Time) error {
+	return setExpiry(s.db, s.vault, key, expires)
+}
+
+// SetExpiry is Store.SetExpiry within the transaction
+func (t *Tx) SetExpiry(key string, expires time.Time) error {
+	return setExpiry(t.tx, t.vault, key, expires)
+}
+
+// setExpiry is SetExpiry against e
+func setExpiry(e execer, vault, key string, expires time.Time) error {
+	result, err := e.Exec("UPDATE secrets SET expires_at = ? WHERE vault = ? AND key = ?", unixOrZero(expires), vault, key)
+	if err != nil {
+		return fmt.Errorf("failed to set expiry of '%s': %w", key, err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SecretExpiry returns when the secret key expires, zero if never, or
+// ErrNotFound if it does not exist
+func (s *Store) SecretExpiry(key string) (time.Time, error) {
+	var expires int64
+	if err := s.db.QueryRow("SELECT expires_at FROM secrets WHERE vault = ? AND key = ?", s.vault, key).Scan(&expires); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, ErrNotFound
+		}
+		return time.Time{}, fmt.Errorf("failed to get secret expiry: %w", err)
+	}
+	return timeOrZero(expires), nil
+}
+
+// ListExpiredSecrets returns the keys of the secrets in s's vault that
+// have expired at now
+func (s *Store) ListExpiredSecrets(now time.Time) ([]string, error) {
+	rows, err := s.db.Query(
+		"SELECT key FROM secrets WHERE vault = ? AND kind = '' AND expires_at != 0 AND expires_at <= ? ORDER BY key ASC",
+		s.vault, now.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan secret key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+	return keys, nil
+}
+
+// PruneExpired deletes the secrets in s's vault that have expired at now
+// in one transaction, archiving them to escrow like any delete, and
+// returns their keys
+func (s *Store) PruneExpired(now time.Time) ([]string, error) {
+	keys, err := s.ListExpiredSecrets(now)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune secrets: %w", err)
+	}
+	defer tx.Rollback()
+	for _, key := range keys {
+		if err := deleteSecret(tx, s.escrow, s.vault, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to prune secrets: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// GCOptions says what CollectGarbage prunes besides orphaned rows
+type GCOptions struct {
+	// LogsBefore prunes audit and access log entries recorded before it;
+	// the zero time keeps them
+	LogsBefore time.Time
+	// MaxAuditID is the newest audit event that may be pruned, so events
+	// still to be copied elsewhere are kept however old
+	MaxAuditID int64
+	// Now is the time token read counts are judged at
+	Now time.Time
+}
+
+// GCResult counts the rows CollectGarbage deleted
+type GCResult struct {
+	AuditEvents int
+	Accesses    int
+	// Orphans are rows nothing refers to any more: unreferenced blobs,
+	// stale search index entries, token read counts of earlier days, and
+	// snapshot values, expiries and checkouts whose owner is gone
+	Orphans int
+}
+
+// CollectGarbage prunes the store in one transaction, in every vault
+func (s *Store) CollectGarbage(opts GCOptions) (GCResult, error) {
+	var result GCResult
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+	defer tx.Rollback()
+
+	exec := func(count *int, query string, args ...any) error {
+		r, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to collect garbage: %w", err)
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		*count += int(n)
+		return nil
+	}
+
+	if !opts.LogsBefore.IsZero() {
+		before := opts.LogsBefore.UTC().Format(time.DateTime)
+		if err := exec(&result.AuditEvents, "DELETE FROM audit_log WHERE at < ? AND id <= ?", before, opts.MaxAuditID); err != nil {
+			return result, err
+		}
+		if err := exec(&result.Accesses, "DELETE FROM access_log WHERE at < ?", before); err != nil {
+			return result, err
+		}
+	}
+
+	day, _ := quotaDay(opts.Now)
+	for _, q := range []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM blobs WHERE digest NOT IN (SELECT digest FROM secrets WHERE digest IS NOT NULL)", nil},
+		{"DELETE FROM search_index WHERE NOT EXISTS (SELECT 1 FROM secrets s WHERE s.vault = search_index.vault AND s.key = search_index.key AND s.digest = search_index.digest)", nil},
+		{"DELETE FROM token_reads WHERE day < ?", []any{day}},
+		{"DELETE FROM token_keys WHERE name NOT IN (SELECT name FROM tokens)", nil},
+		{"DELETE FROM snapshot_secrets WHERE NOT EXISTS (SELECT 1 FROM snapshots sn WHERE sn.vault = snapshot_secrets.vault AND sn.name = snapshot_secrets.snapshot)", nil},
+		{"DELETE FROM temp_secrets WHERE NOT EXISTS (SELECT 1 FROM secrets s WHERE s.vault = temp_secrets.vault AND s.key = temp_secrets.key)", nil},
+		{"DELETE FROM checkouts WHERE NOT EXISTS (SELECT 1 FROM secrets s WHERE s.vault = checkouts.vault AND s.key = checkouts.key)", nil},
+	} {
+		if err := exec(&result.Orphans, q.query, q.args...); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+	return result, nil
+}
+
+// Size returns the size of the database in bytes, including free pages
+// that Vacuum would reclaim
+func (s *Store) Size() (int64, error) {
+	var pages, size int64
+	if err := s.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, fmt.Errorf("failed to read store size: %w", err)
+	}
+	if err := s.db.QueryRow("PRAGMA page_size").Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to read store size: %w", err)
+	}
+	return pages * size, nil
+}
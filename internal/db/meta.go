@@ -0,0 +1,120 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Meta describes a secret for the people using it: tags to group and
+// find secrets by, such as prod or db, and a free-form description
+type Meta struct {
+	// Tags are sorted and unique
+	Tags        []string
+	Description string
+}
+
+// HasTags reports whether m carries every one of tags
+func (m Meta) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(m.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateTag checks that tag is usable as a tag
+func ValidateTag(tag string) error {
+	if tag == "" || len(tag) > 64 || strings.IndexFunc(tag, func(r rune) bool {
+		return !(r == '-' || r == '_' || r == '.' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		return fmt.Errorf("invalid tag '%s': use up to 64 letters, digits, dashes, underscores, dots and colons", tag)
+	}
+	return nil
+}
+
+// SecretMeta returns the tags and description of key, which are empty if
+// none were set, or ErrNotFound if the secret does not exist
+func (s *Store) SecretMeta(key string) (Meta, error) {
+	return secretMeta(s.db, s.vault, key)
+}
+
+// SecretMeta is Store.SecretMeta within the transaction
+func (t *Tx) SecretMeta(key string) (Meta, error) {
+	return secretMeta(t.tx, t.vault, key)
+}
+
+// secretMeta is SecretMeta against q
+func secretMeta(q querier, vault, key string) (Meta, error) {
+	var m Meta
+	var tags string
+	err := q.QueryRow(
+		`SELECT COALESCE(m.tags, ''), COALESCE(m.description, '') FROM secrets s
+		 LEFT JOIN secret_meta m ON m.vault = s.vault AND m.key = s.key
+		 WHERE s.vault = ? AND s.key = ?`,
+		vault, key,
+	).Scan(&tags, &m.Description)
+	if err == sql.ErrNoRows {
+		return m, ErrNotFound
+	} else if err != nil {
+		return m, fmt.Errorf("failed to get secret metadata: %w", err)
+	}
+	m.Tags = splitLines(tags)
+	return m, nil
+}
+
+// SetSecretMeta replaces the tags and description of key, which must
+// exist
+func (s *Store) SetSecretMeta(key string, m Meta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to set secret metadata: %w", err)
+	}
+	defer tx.Rollback()
+	if err := setSecretMeta(tx, s.vault, key, m); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to set secret metadata: %w", err)
+	}
+	return nil
+}
+
+// SetSecretMeta is Store.SetSecretMeta within the transaction
+func (t *Tx) SetSecretMeta(key string, m Meta) error {
+	return setSecretMeta(t.tx, t.vault, key, m)
+}
+
+// setSecretMeta is SetSecretMeta within tx
+func setSecretMeta(tx *sql.Tx, vault, key string, m Meta) error {
+	for _, tag := range m.Tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM secrets WHERE vault = ? AND key = ?)", vault, key).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to set secret metadata: %w", err)
+	} else if !exists {
+		return ErrNotFound
+	}
+
+	tags := slices.Compact(slices.Sorted(slices.Values(m.Tags)))
+	if len(tags) == 0 && m.Description == "" {
+		_, err := tx.Exec("DELETE FROM secret_meta WHERE vault = ? AND key = ?", vault, key)
+		if err != nil {
+			return fmt.Errorf("failed to set secret metadata: %w", err)
+		}
+		return nil
+	}
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO secret_meta (vault, key, tags, description) VALUES (?, ?, ?, ?)",
+		vault, key, strings.Join(tags, "\n"), m.Description,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set secret metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Pairing is a pending pairing of a device. Its one-time code is redeemed
+// for an API token called Name carrying Scopes; only the code's hash is
+// stored.
+type Pairing struct {
+	Name      string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// CreatePairing stores the hash of a new pairing code, replacing any
+// pending pairing of the same name. Expired pairings are dropped.
+func (s *Store) CreatePairing(p Pairing, hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM pairings WHERE name = ? OR expires_at <= ?", p.Name, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to delete old pairings: %w", err)
+	}
+	_, err = tx.Exec("INSERT INTO pairings (hash, name, scopes, expires_at) VALUES (?, ?, ?, ?)",
+		hash, p.Name, strings.Join(p.Scopes, "\n"), p.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to create pairing '%s': %w", p.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RedeemPairing redeems the pairing code with hash for a token with
+// tokenHash, in one transaction. Codes are single use; ErrNotFound is
+// returned for unknown or expired ones.
+func (s *Store) RedeemPairing(hash, tokenHash string, now time.Time) (Pairing, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Pairing{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		p       Pairing
+		scopes  string
+		expires int64
+	)
+	err = tx.QueryRow("SELECT name, scopes, expires_at FROM pairings WHERE hash = ?", hash).Scan(&p.Name, &scopes, &expires)
+	if err == sql.ErrNoRows {
+		return Pairing{}, ErrNotFound
+	} else if err != nil {
+		return Pairing{}, fmt.Errorf("failed to look up pairing: %w", err)
+	}
+	p.Scopes = splitLines(scopes)
+	p.ExpiresAt = time.Unix(expires, 0)
+	if !now.Before(p.ExpiresAt) {
+		return Pairing{}, ErrNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM pairings WHERE hash = ?", hash); err != nil {
+		return Pairing{}, fmt.Errorf("failed to redeem pairing: %w", err)
+	}
+	if err := createToken(tx, Token{Name: p.Name, Scopes: p.Scopes}, tokenHash, ""); err != nil {
+		return Pairing{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Pairing{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return p, nil
+}
+
+// PairingPending reports whether a pairing called name is waiting to be
+// redeemed
+func (s *Store) PairingPending(name string) (bool, error) {
+	var pending bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pairings WHERE name = ? AND expires_at > ?)", name, time.Now().Unix()).Scan(&pending)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up pairing: %w", err)
+	}
+	return pending, nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuotaError is returned when a read would take a token past its quota
+type QuotaError struct {
+	Token string
+	// Limit names the quota that would be exceeded: "reads" or "keys"
+	Limit string
+	Max   int
+	// Reset is when the quota allows reads again; zero if it never does
+	Reset time.Time
+}
+
+func (e *QuotaError) Error() string {
+	if e.Limit == "reads" {
+		return fmt.Sprintf("token '%s' exceeded its quota of %d reads per day", e.Token, e.Max)
+	}
+	return fmt.Sprintf("token '%s' exceeded its quota of %d distinct keys", e.Token, e.Max)
+}
+
+// TokenUsage is what a token has spent of its quotas
+type TokenUsage struct {
+	// Reads is how many values the token read on the current UTC day
+	Reads int
+	// Keys is how many distinct keys the token has read
+	Keys int
+}
+
+// quotaDay returns the UTC day now falls on, and when the next one starts
+func quotaDay(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return day.Format(time.DateOnly), day.AddDate(0, 0, 1)
+}
+
+// SpendTokenQuota counts reading keys in s's vault at now against the
+// quotas of t, returning the usage after the reads. Either every read is
+// counted or, when one would exceed a quota, none is and a *QuotaError is
+// returned. Tokens without quotas are not counted.
+func (s *Store) SpendTokenQuota(t Token, keys []string, now time.Time) (TokenUsage, error) {
+	var usage TokenUsage
+	if t.MaxReads == 0 && t.MaxKeys == 0 {
+		return usage, nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return usage, fmt.Errorf("failed to count token usage: %w", err)
+	}
+	defer tx.Rollback()
+
+	day, reset := quotaDay(now)
+	if err := tx.QueryRow("SELECT COALESCE(SUM(reads), 0) FROM token_reads WHERE name = ? AND day = ?", t.Name, day).Scan(&usage.Reads); err != nil {
+		return usage, fmt.Errorf("failed to read token usage: %w", err)
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM token_keys WHERE name = ?", t.Name).Scan(&usage.Keys); err != nil {
+		return usage, fmt.Errorf("failed to read token usage: %w", err)
+	}
+
+	usage.Reads += len(keys)
+	if t.MaxReads > 0 && usage.Reads > t.MaxReads {
+		return usage, &QuotaError{Token: t.Name, Limit: "reads", Max: t.MaxReads, Reset: reset}
+	}
+	for _, key := range keys {
+		result, err := tx.Exec("INSERT OR IGNORE INTO token_keys (name, key) VALUES (?, ?)", t.Name, s.Qualify(key))
+		if err != nil {
+			return usage, fmt.Errorf("failed to count token usage: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			usage.Keys++
+		}
+	}
+	if t.MaxKeys > 0 && usage.Keys > t.MaxKeys {
+		return usage, &QuotaError{Token: t.Name, Limit: "keys", Max: t.MaxKeys}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO token_reads (name, day, reads) VALUES (?, ?, ?) ON CONFLICT (name, day) DO UPDATE SET reads = reads + excluded.reads",
+		t.Name, day, len(keys),
+	)
+	if err != nil {
+		return usage, fmt.Errorf("failed to count token usage: %w", err)
+	}
+	// Earlier days no longer count against anything
+	if _, err := tx.Exec("DELETE FROM token_reads WHERE name = ? AND day < ?", t.Name, day); err != nil {
+		return usage, fmt.Errorf("failed to count token usage: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return usage, fmt.Errorf("failed to count token usage: %w", err)
+	}
+	return usage, nil
+}
+
+// TokenUsage returns what the token called name has spent of its quotas
+// at now
+func (s *Store) TokenUsage(name string, now time.Time) (TokenUsage, error) {
+	var usage TokenUsage
+	day, _ := quotaDay(now)
+	err := s.db.QueryRow(
+		`SELECT (SELECT COALESCE(SUM(reads), 0) FROM token_reads WHERE name = ? AND day = ?),
+		        (SELECT COUNT(*) FROM token_keys WHERE name = ?)`,
+		name, day, name,
+	).Scan(&usage.Reads, &usage.Keys)
+	if err != nil {
+		return usage, fmt.Errorf("failed to read token usage: %w", err)
+	}
+	return usage, nil
+}
+
+// SetTokenQuota changes the quotas of the live token called name; zero
+// removes a quota. ErrNotFound is returned if there is no such token.
+func (s *Store) SetTokenQuota(name string, maxReads, maxKeys int) error {
+	result, err := s.db.Exec("UPDATE tokens SET max_reads = ?, max_keys = ? WHERE name = ? AND revoked_at = 0", maxReads, maxKeys, name)
+	if err != nil {
+		return fmt.Errorf("failed to set token quota: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrExists means the key a secret is renamed to is taken
+var ErrExists = errors.New("key already exists")
+
+// renamed are the tables holding per-secret state that moves with a
+// rename. Snapshots, escrow and the access log keep the old key, as it was
+// when they were recorded.
+var renamed = []string{"secret_meta", "temp_secrets", "checkouts", "search_index"}
+
+// RenameSecret renames the secret oldKey to newKey in one transaction,
+// keeping its value, owner, metadata and expiry. If newKey exists it
+// returns ErrExists, unless force is set, in which case that secret is
+// deleted first, archived to escrow like any delete.
+func (s *Store) RenameSecret(oldKey, newKey string, force bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to rename secret: %w", err)
+	}
+	defer tx.Rollback()
+	if err := renameSecret(tx, s.escrow, s.vault, oldKey, newKey, force); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rename secret: %w", err)
+	}
+	return nil
+}
+
+// RenameSecret is Store.RenameSecret within the transaction
+func (t *Tx) RenameSecret(oldKey, newKey string, force bool) error {
+	return renameSecret(t.tx, t.escrow, t.vault, oldKey, newKey, force)
+}
+
+// renameSecret is RenameSecret within tx
+func renameSecret(tx *sql.Tx, esc Escrow, vault, oldKey, newKey string, force bool) error {
+	if oldKey == newKey {
+		return nil
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM secrets WHERE vault = ? AND key = ? AND kind = '')", vault, oldKey).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to rename secret: %w", err)
+	} else if !exists {
+		return ErrNotFound
+	}
+
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM secrets WHERE vault = ? AND key = ?)", vault, newKey).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to rename secret: %w", err)
+	}
+	if exists {
+		if !force {
+			return ErrExists
+		}
+		if err := deleteSecret(tx, esc, vault, newKey); err != nil {
+			return err
+		}
+	}
+
+	// Updating the key tombstones the old one, so sync sees the rename
+	if _, err := tx.Exec("UPDATE secrets SET key = ? WHERE vault = ? AND key = ?", newKey, vault, oldKey); err != nil {
+		return fmt.Errorf("failed to rename secret: %w", err)
+	}
+	for _, table := range renamed {
+		if _, err := tx.Exec("UPDATE "+table+" SET key = ? WHERE vault = ? AND key = ?", newKey, vault, oldKey); err != nil {
+			return fmt.Errorf("failed to rename secret: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Indexer builds the search index entry of a value from its ciphertext.
+// An error from Entry aborts the write.
+type Indexer interface {
+	Entry(encryptedValue []byte) ([]byte, error)
+}
+
+// SetIndexer makes every later SetSecretBlob through s, or through its
+// transactions, store the value's search index entry from ix. A nil ix
+// stops maintaining the index.
+func (s *Store) SetIndexer(ix Indexer) {
+	s.index = ix
+}
+
+// indexSecret stores the index entry of the value just written to key in
+// vault, if there is an indexer
+func indexSecret(tx *sql.Tx, ix Indexer, vault, key, digest string, encryptedValue []byte) error {
+	if ix == nil {
+		return nil
+	}
+	entry, err := ix.Entry(encryptedValue)
+	if err != nil {
+		return fmt.Errorf("failed to index secret '%s': %w", key, err)
+	}
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO search_index (vault, key, digest, entry) VALUES (?, ?, ?, ?)",
+		vault, key, digest, entry,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index secret '%s': %w", key, err)
+	}
+	return nil
+}
+
+// SearchEntry is a secret with its search index entry
+type SearchEntry struct {
+	Key string
+	// Digest identifies the secret's current value, "" for values stored
+	// inline, which are never indexed
+	Digest string
+	// Entry is nil when the secret has no entry for its current value
+	Entry []byte
+}
+
+// searchPage is how many entries EachSearchEntry reads at a time
+const searchPage = 256
+
+// EachSearchEntry calls fn with every unexpired secret in s's vault,
+// excluding secrets of other kinds, and its search index entry, in key
+// order. Entries are read a page at a time, so memory stays flat however
+// large the store is, and no query is open while fn runs, so fn may read
+// and write through s. An error from fn stops the iteration and is
+// returned.
+func (s *Store) EachSearchEntry(fn func(SearchEntry) error) error {
+	after := ""
+	for {
+		page, err := s.searchEntries(after, searchPage)
+		if err != nil {
+			return err
+		}
+		for _, e := range page {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(page) < searchPage {
+			return nil
+		}
+		after = page[len(page)-1].Key
+	}
+}
+
+// searchEntries returns up to limit entries for keys after after
+func (s *Store) searchEntries(after string, limit int) ([]SearchEntry, error) {
+	rows, err := s.db.Query(
+		`SELECT s.key, COALESCE(s.digest, ''), i.entry FROM secrets s
+		 LEFT JOIN search_index i ON i.vault = s.vault AND i.key = s.key AND i.digest = s.digest
+		 WHERE s.vault = ? AND s.kind = '' AND s.key > ? AND (s.expires_at = 0 OR s.expires_at > ?)
+		 ORDER BY s.key ASC LIMIT ?`,
+		s.vault, after, time.Now().Unix(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read search index: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []SearchEntry
+	for rows.Next() {
+		var e SearchEntry
+		if err := rows.Scan(&e.Key, &e.Digest, &e.Entry); err != nil {
+			return nil, fmt.Errorf("failed to scan search index: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search index: %w", err)
+	}
+	return entries, nil
+}
+
+// SetSearchEntry stores entry as the search index entry of key, built from
+// the value with digest. Nothing is stored if key no longer has that
+// value.
+func (s *Store) SetSearchEntry(key, digest string, entry []byte) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO search_index (vault, key, digest, entry)
+		 SELECT vault, key, digest, ? FROM secrets WHERE vault = ? AND key = ? AND digest = ?`,
+		entry, s.vault, key, digest,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index secret '%s': %w", key, err)
+	}
+	return nil
+}
+
+// ClearSearchIndex deletes the search index entries of every vault
+func (s *Store) ClearSearchIndex() error {
+	if _, err := s.db.Exec("DELETE FROM search_index"); err != nil {
+		return fmt.Errorf("failed to clear search index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Snapshot is a named copy of a vault's secrets as they were when it was
+// taken, kept however the secrets change afterwards
+type Snapshot struct {
+	Name string
+	// Vault is the snapshotted vault, "" for the default vault
+	Vault string
+	// Revision is the store revision the snapshot was taken at
+	Revision  uint64
+	Created   time.Time
+	CreatedBy string
+	Secrets   int
+}
+
+// SnapshotSecret is a secret as a snapshot holds it
+type SnapshotSecret struct {
+	Key string
+	// Version is the secret's version when it was snapshotted
+	Version uint64
+	// Value is the ciphertext, encrypted with the store key
+	Value []byte
+}
+
+// snapshotColumns are the columns read by scanSnapshot
+const snapshotColumns = "name, vault, revision, created_at, created_by, (SELECT COUNT(*) FROM snapshot_secrets ss WHERE ss.vault = snapshots.vault AND ss.snapshot = snapshots.name)"
+
+// scanSnapshot reads a snapshot selected with snapshotColumns
+func scanSnapshot(row interface{ Scan(...any) error }) (Snapshot, error) {
+	var sn Snapshot
+	var created int64
+	if err := row.Scan(&sn.Name, &sn.Vault, &sn.Revision, &created, &sn.CreatedBy, &sn.Secrets); err != nil {
+		return sn, err
+	}
+	sn.Created = time.Unix(created, 0)
+	return sn, nil
+}
+
+// CreateSnapshot copies the given secrets of s's vault, or all of them if
+// keys is nil, into a new snapshot called name taken by createdBy
+func (s *Store) CreateSnapshot(name, createdBy string, keys []string, now time.Time) (Snapshot, error) {
+	if err := ValidateVault(name); err != nil {
+		return Snapshot{}, fmt.Errorf("invalid snapshot '%s': use up to 64 letters, digits, dashes and underscores", name)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	var revision uint64
+	if err := tx.QueryRow("SELECT value FROM revision WHERE id = 1").Scan(&revision); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read revision: %w", err)
+	}
+	result, err := tx.Exec(
+		"INSERT OR IGNORE INTO snapshots (vault, name, revision, created_at, created_by) VALUES (?, ?, ?, ?, ?)",
+		s.vault, name, revision, now.Unix(), createdBy,
+	)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return Snapshot{}, fmt.Errorf("snapshot '%s' already exists", name)
+	}
+
+	if keys == nil {
+		if keys, err = listKindSecrets(tx, s.vault, ""); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	for _, key := range keys {
+		result, err := tx.Exec(
+			`INSERT INTO snapshot_secrets (vault, snapshot, key, version, value)
+			 SELECT s.vault, ?, s.key, s.version, COALESCE(b.value, s.value)
+			 FROM secrets s LEFT JOIN blobs b ON b.digest = s.digest
+			 WHERE s.vault = ? AND s.key = ? AND s.kind = ''`,
+			name, s.vault, key,
+		)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("failed to snapshot '%s': %w", key, err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return Snapshot{}, fmt.Errorf("secret '%s' not found", key)
+		}
+	}
+
+	sn, err := scanSnapshot(tx.QueryRow("SELECT "+snapshotColumns+" FROM snapshots WHERE vault = ? AND name = ?", s.vault, name))
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return sn, nil
+}
+
+// GetSnapshot returns the snapshot of s's vault called name and its
+// secrets, sorted by key. ErrNotFound is returned if there is none.
+func (s *Store) GetSnapshot(name string) (Snapshot, []SnapshotSecret, error) {
+	sn, err := scanSnapshot(s.db.QueryRow("SELECT "+snapshotColumns+" FROM snapshots WHERE vault = ? AND name = ?", s.vault, name))
+	if err == sql.ErrNoRows {
+		return sn, nil, ErrNotFound
+	} else if err != nil {
+		return sn, nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	rows, err := s.db.Query("SELECT key, version, value FROM snapshot_secrets WHERE vault = ? AND snapshot = ? ORDER BY key ASC", s.vault, name)
+	if err != nil {
+		return sn, nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer rows.Close()
+	var secrets []SnapshotSecret
+	for rows.Next() {
+		var sec SnapshotSecret
+		if err := rows.Scan(&sec.Key, &sec.Version, &sec.Value); err != nil {
+			return sn, nil, fmt.Errorf("failed to scan snapshot secret: %w", err)
+		}
+		secrets = append(secrets, sec)
+	}
+	if err := rows.Err(); err != nil {
+		return sn, nil, fmt.Errorf("error iterating snapshot secrets: %w", err)
+	}
+	return sn, secrets, nil
+}
+
+// ListSnapshots returns the snapshots of s's vault, oldest first
+func (s *Store) ListSnapshots() ([]Snapshot, error) {
+	rows, err := s.db.Query("SELECT "+snapshotColumns+" FROM snapshots WHERE vault = ? ORDER BY created_at ASC, name ASC", s.vault)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	defer rows.Close()
+	var snapshots []Snapshot
+	for rows.Next() {
+		sn, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		snapshots = append(snapshots, sn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes the snapshot of s's vault called name and the
+// values it holds. ErrNotFound is returned if there is none.
+func (s *Store) DeleteSnapshot(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	defer tx.Rollback()
+	if err := deleteSnapshots(tx, s.vault, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteSnapshots deletes the snapshot of vault called name, or all of the
+// vault's snapshots if name is empty
+func deleteSnapshots(tx *sql.Tx, vault, name string) error {
+	where, args := "vault = ?", []any{vault}
+	if name != "" {
+		where, args = "vault = ? AND name = ?", []any{vault, name}
+	}
+	result, err := tx.Exec("DELETE FROM snapshots WHERE "+where, args...)
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 && name != "" {
+		return ErrNotFound
+	}
+	if name != "" {
+		where = "vault = ? AND snapshot = ?"
+	}
+	if _, err := tx.Exec("DELETE FROM snapshot_secrets WHERE "+where, args...); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
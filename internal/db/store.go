@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/MQ37/lockbox/internal/multiuser"
+	"github.com/MQ37/lockbox/internal/workspace"
 	_ "modernc.org/sqlite"
 )
 
@@ -15,37 +19,135 @@ var ErrNotFound = errors.New("key not found")
 
 // Store provides access to the SQLite database
 type Store struct {
-	db *sql.DB
+	db     *sql.DB
+	path   string
+	escrow Escrow
+	index  Indexer
+	// vault scopes secrets; "" is the default vault
+	vault string
 }
 
-// NewStore opens or creates the SQLite database and runs migrations
+// NewStore opens or creates the SQLite database at ResolvePath and runs
+// migrations
 func NewStore() (*Store, error) {
+	dbPath, err := ResolvePath()
+	if err != nil {
+		return nil, err
+	}
+	return OpenStore(dbPath)
+}
+
+// ResolvePath returns the database path: the store of LOCKBOX_PROFILE if
+// set, otherwise that of the workspace around the working directory with
+// LOCKBOX_WORKSPACE=1, otherwise LOCKBOX_DB_PATH, then the user's
+// provisioned directory in multi-user mode, then ~/.lockbox/lockbox.db.
+// The containing directory is created if needed.
+func ResolvePath() (string, error) {
+	profile := os.Getenv("LOCKBOX_PROFILE")
+	inWorkspace := os.Getenv("LOCKBOX_WORKSPACE") == "1"
+	if profile != "" && inWorkspace {
+		return "", fmt.Errorf("a profile and a workspace cannot be used together")
+	}
+	if profile != "" {
+		return ProfilePath(profile)
+	}
+	if inWorkspace {
+		return WorkspacePath()
+	}
+	return DefaultPath()
+}
+
+// WorkspacePath returns the store of the nearest workspace at or above the
+// working directory
+func WorkspacePath() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root, err := workspace.Find(wd)
+	if err != nil {
+		return "", err
+	}
+	return workspace.StorePath(root), nil
+}
+
+// ProfilePath returns the store of a named profile, such as staging or
+// prod, kept in a profiles directory next to the default store
+func ProfilePath(name string) (string, error) {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		return "", fmt.Errorf("invalid profile '%s': use letters, digits, dashes and underscores", name)
+	}
+	base, err := DefaultPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(filepath.Dir(base), "profiles")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create profiles directory: %w", err)
+	}
+	return filepath.Join(dir, name+".db"), nil
+}
+
+// ListProfiles returns the names of the profiles that have a store, sorted
+func ListProfiles() ([]string, error) {
+	base, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(base), "profiles"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".db"); ok && e.Type().IsRegular() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// DefaultPath is ResolvePath without profiles: the default store
+func DefaultPath() (string, error) {
 	// Check for custom database path via environment variable
-	var dbPath string
 	if customPath := os.Getenv("LOCKBOX_DB_PATH"); customPath != "" {
-		dbPath = customPath
 		// Ensure the directory exists
-		dir := filepath.Dir(dbPath)
+		dir := filepath.Dir(customPath)
 		if err := os.MkdirAll(dir, 0700); err != nil {
-			return nil, fmt.Errorf("failed to create database directory: %w", err)
-		}
-	} else {
-		// Use default ~/.lockbox/lockbox.db
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get home directory: %w", err)
+			return "", fmt.Errorf("failed to create database directory: %w", err)
 		}
+		return customPath, nil
+	}
 
-		lockboxDir := filepath.Join(homeDir, ".lockbox")
-		if err := os.MkdirAll(lockboxDir, 0700); err != nil {
-			return nil, fmt.Errorf("failed to create lockbox directory: %w", err)
-		}
+	// Multi-user mode: the helper provisioned an isolated directory
+	if userPath, ok := multiuser.UserStorePath(multiuser.SystemDir(), os.Getuid()); ok {
+		return userPath, nil
+	}
+
+	// Use default ~/.lockbox/lockbox.db
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
 
-		dbPath = filepath.Join(lockboxDir, "lockbox.db")
+	lockboxDir := filepath.Join(homeDir, ".lockbox")
+	if err := os.MkdirAll(lockboxDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create lockbox directory: %w", err)
 	}
 
-	// Open database connection
-	db, err := sql.Open("sqlite", "file:"+dbPath+"?cache=shared&mode=rwc")
+	return filepath.Join(lockboxDir, "lockbox.db"), nil
+}
+
+// OpenStore opens or creates the SQLite database at dbPath and runs
+// migrations
+func OpenStore(dbPath string) (*Store, error) {
+	// Open database connection. Other lockbox processes, such as a running
+	// server, may hold the lock briefly, so wait for it instead of failing.
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?cache=shared&mode=rwc&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -56,7 +158,7 @@ func NewStore() (*Store, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	store := &Store{db: db}
+	store := &Store{db: db, path: dbPath}
 
 	// Run migrations
 	if err := store.migrate(); err != nil {
@@ -67,7 +169,362 @@ func NewStore() (*Store, error) {
 	return store, nil
 }
 
-// migrate creates the necessary tables if they don't exist
+// ErrNotCurrent is returned by OpenExisting for a store whose schema is
+// older or newer than this build's
+var ErrNotCurrent = errors.New("store schema is not current; run 'lockbox upgrade-store' as its owner")
+
+// OpenExisting opens the SQLite database at dbPath without creating it or
+// running migrations, for callers holding privileges the store's owner
+// does not, such as the setgid helper. It fails unless the schema is
+// current.
+func OpenExisting(dbPath string) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?cache=shared&mode=rw&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version != len(migrations) {
+		db.Close()
+		return nil, ErrNotCurrent
+	}
+	return &Store{db: db, path: dbPath}, nil
+}
+
+// migrations are applied in order on top of the base schema. The index of
+// the last applied migration plus one is recorded in PRAGMA user_version,
+// so entries must only ever be appended.
+var migrations = []string{
+	// 1: content-addressed ciphertext blobs shared by secrets with equal values
+	`
+	CREATE TABLE IF NOT EXISTS blobs (
+		digest TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 0
+	);
+
+	ALTER TABLE secrets ADD COLUMN digest TEXT;
+	`,
+	// 2: access policies granting OS users and groups a key pattern
+	`
+	CREATE TABLE IF NOT EXISTS policies (
+		subject TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		PRIMARY KEY (subject, pattern)
+	);
+	`,
+	// 3: secret kinds; rows with a non-empty kind are kept out of ListSecrets
+	`
+	ALTER TABLE secrets ADD COLUMN kind TEXT NOT NULL DEFAULT '';
+	`,
+	// 4: a revision counter bumped by every write to secrets, including
+	// writes from other processes
+	`
+	CREATE TABLE IF NOT EXISTS revision (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		value INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO revision (id, value) VALUES (1, 1);
+
+	CREATE TRIGGER IF NOT EXISTS secrets_insert_revision AFTER INSERT ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+	CREATE TRIGGER IF NOT EXISTS secrets_update_revision AFTER UPDATE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+	CREATE TRIGGER IF NOT EXISTS secrets_delete_revision AFTER DELETE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+	`,
+	// 5: API tokens, stored as SHA-256 hashes
+	`
+	CREATE TABLE IF NOT EXISTS tokens (
+		name TEXT PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+	// 6: token expiry (unix seconds, 0 for never) and extra policy subjects,
+	// newline separated, for tokens issued on login
+	`
+	ALTER TABLE tokens ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tokens ADD COLUMN subjects TEXT NOT NULL DEFAULT '';
+	`,
+	// 7: token scopes, single-use refresh tokens that extend a token by its
+	// ttl (seconds), and revocation (unix seconds, 0 if not revoked)
+	`
+	ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+	ALTER TABLE tokens ADD COLUMN ttl INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tokens ADD COLUMN refresh_hash TEXT;
+	ALTER TABLE tokens ADD COLUMN refresh_expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tokens ADD COLUMN revoked_at INTEGER NOT NULL DEFAULT 0;
+	CREATE UNIQUE INDEX IF NOT EXISTS tokens_refresh_hash ON tokens (refresh_hash);
+	`,
+	// 8: the policy subject owning a secret, '' for unowned secrets
+	`
+	ALTER TABLE secrets ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+	`,
+	// 9: per-secret versions for incremental backups. Every write stamps
+	// the row with a freshly bumped revision, and deletes (and the old key
+	// of a rename) leave a tombstone carrying the revision of the delete.
+	`
+	ALTER TABLE secrets ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS tombstones (
+		key TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS secrets_insert_version AFTER INSERT ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE key = NEW.key;
+		DELETE FROM tombstones WHERE key = NEW.key;
+	END;
+	CREATE TRIGGER IF NOT EXISTS secrets_update_version AFTER UPDATE ON secrets
+	WHEN NEW.version = OLD.version
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE key = NEW.key;
+		DELETE FROM tombstones WHERE key = NEW.key;
+		INSERT OR REPLACE INTO tombstones (key, version)
+		SELECT OLD.key, value FROM revision WHERE id = 1 AND OLD.key != NEW.key;
+	END;
+	CREATE TRIGGER IF NOT EXISTS secrets_delete_version AFTER DELETE ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		INSERT OR REPLACE INTO tombstones (key, version)
+		SELECT OLD.key, value FROM revision WHERE id = 1;
+	END;
+	`,
+	// 10: append-only audit log of administrative actions
+	`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	`,
+	// 11: secret reads, the baseline of anomaly detection
+	`
+	CREATE TABLE IF NOT EXISTS access_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		key TEXT NOT NULL,
+		source TEXT NOT NULL,
+		identity TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS access_log_at ON access_log (at);
+	`,
+	// 12: roles; every policy binds a subject to a role on a key pattern,
+	// existing policies become reader bindings
+	`
+	CREATE TABLE policies_new (
+		subject TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'reader',
+		PRIMARY KEY (subject, pattern, role)
+	);
+	INSERT INTO policies_new (subject, pattern) SELECT subject, pattern FROM policies;
+	DROP TABLE policies;
+	ALTER TABLE policies_new RENAME TO policies;
+
+	CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY,
+		permissions TEXT NOT NULL
+	);
+	`,
+	// 13: vaults, isolated sets of secrets in one store. Secrets and
+	// tombstones are keyed by vault and key; existing ones are in the
+	// default vault ''.
+	`
+	CREATE TABLE IF NOT EXISTS vaults (
+		name TEXT PRIMARY KEY,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE secrets_new (
+		vault TEXT NOT NULL DEFAULT '',
+		key TEXT NOT NULL,
+		value BLOB NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		digest TEXT,
+		kind TEXT NOT NULL DEFAULT '',
+		owner TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (vault, key)
+	);
+	INSERT INTO secrets_new (key, value, created_at, updated_at, digest, kind, owner, version)
+	SELECT key, value, created_at, updated_at, digest, kind, owner, version FROM secrets;
+	DROP TABLE secrets;
+	ALTER TABLE secrets_new RENAME TO secrets;
+
+	CREATE TABLE tombstones_new (
+		vault TEXT NOT NULL DEFAULT '',
+		key TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		PRIMARY KEY (vault, key)
+	);
+	INSERT INTO tombstones_new (key, version) SELECT key, version FROM tombstones;
+	DROP TABLE tombstones;
+	ALTER TABLE tombstones_new RENAME TO tombstones;
+
+	CREATE TRIGGER secrets_insert_revision AFTER INSERT ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+	CREATE TRIGGER secrets_update_revision AFTER UPDATE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+	CREATE TRIGGER secrets_delete_revision AFTER DELETE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+
+	CREATE TRIGGER secrets_insert_version AFTER INSERT ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE vault = NEW.vault AND key = NEW.key;
+		DELETE FROM tombstones WHERE vault = NEW.vault AND key = NEW.key;
+	END;
+	CREATE TRIGGER secrets_update_version AFTER UPDATE ON secrets
+	WHEN NEW.version = OLD.version
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE vault = NEW.vault AND key = NEW.key;
+		DELETE FROM tombstones WHERE vault = NEW.vault AND key = NEW.key;
+		INSERT OR REPLACE INTO tombstones (vault, key, version)
+		SELECT OLD.vault, OLD.key, value FROM revision WHERE id = 1 AND (OLD.vault != NEW.vault OR OLD.key != NEW.key);
+	END;
+	CREATE TRIGGER secrets_delete_version AFTER DELETE ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		INSERT OR REPLACE INTO tombstones (vault, key, version)
+		SELECT OLD.vault, OLD.key, value FROM revision WHERE id = 1;
+	END;
+	`,
+	// 14: the optional search index; an entry only counts while its digest
+	// matches the secret's
+	`
+	CREATE TABLE IF NOT EXISTS search_index (
+		vault TEXT NOT NULL,
+		key TEXT NOT NULL,
+		digest TEXT NOT NULL,
+		entry BLOB NOT NULL,
+		PRIMARY KEY (vault, key)
+	);
+	CREATE TRIGGER search_index_delete AFTER DELETE ON secrets
+	BEGIN DELETE FROM search_index WHERE vault = OLD.vault AND key = OLD.key; END;
+	`,
+	// 15: temporary secrets and when they expire. Writing a secret, which
+	// inserts its row, makes it permanent again.
+	`
+	CREATE TABLE IF NOT EXISTS temp_secrets (
+		vault TEXT NOT NULL,
+		key TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (vault, key)
+	);
+	CREATE TRIGGER temp_secrets_insert AFTER INSERT ON secrets
+	BEGIN DELETE FROM temp_secrets WHERE vault = NEW.vault AND key = NEW.key; END;
+	CREATE TRIGGER temp_secrets_delete AFTER DELETE ON secrets
+	BEGIN DELETE FROM temp_secrets WHERE vault = OLD.vault AND key = OLD.key; END;
+	`,
+	// 16: who holds a checked out secret, and until when
+	`
+	CREATE TABLE IF NOT EXISTS checkouts (
+		vault TEXT NOT NULL,
+		key TEXT NOT NULL,
+		holder TEXT NOT NULL,
+		checked_out_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		reminded INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (vault, key)
+	);
+	CREATE TRIGGER checkouts_delete AFTER DELETE ON secrets
+	BEGIN DELETE FROM checkouts WHERE vault = OLD.vault AND key = OLD.key; END;
+	`,
+	// 17: token quotas (0 for none) and the usage counted against them:
+	// reads per UTC day and the distinct keys a token has read
+	`
+	ALTER TABLE tokens ADD COLUMN max_reads INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tokens ADD COLUMN max_keys INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS token_reads (
+		name TEXT NOT NULL,
+		day TEXT NOT NULL,
+		reads INTEGER NOT NULL,
+		PRIMARY KEY (name, day)
+	);
+	CREATE TABLE IF NOT EXISTS token_keys (
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		PRIMARY KEY (name, key)
+	);
+	CREATE TRIGGER token_usage_delete AFTER DELETE ON tokens
+	BEGIN
+		DELETE FROM token_reads WHERE name = OLD.name;
+		DELETE FROM token_keys WHERE name = OLD.name;
+	END;
+	`,
+	// 18: named snapshots of a vault's secrets, holding copies of the
+	// values so they outlive rotations and deletes
+	`
+	CREATE TABLE IF NOT EXISTS snapshots (
+		vault TEXT NOT NULL,
+		name TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (vault, name)
+	);
+	CREATE TABLE IF NOT EXISTS snapshot_secrets (
+		vault TEXT NOT NULL,
+		snapshot TEXT NOT NULL,
+		key TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		value BLOB NOT NULL,
+		PRIMARY KEY (vault, snapshot, key)
+	);
+	`,
+	// 19: tags, one per line, and descriptions of secrets. They are kept
+	// when a secret is overwritten and go with it when deleted.
+	`
+	CREATE TABLE IF NOT EXISTS secret_meta (
+		vault TEXT NOT NULL,
+		key TEXT NOT NULL,
+		tags TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (vault, key)
+	);
+	CREATE TRIGGER secret_meta_delete AFTER DELETE ON secrets
+	BEGIN DELETE FROM secret_meta WHERE vault = OLD.vault AND key = OLD.key; END;
+	`,
+	// 20: when a secret expires, in Unix seconds, or 0 for never. Expired
+	// secrets are kept, unlisted, until pruned; writing one clears it.
+	`
+	ALTER TABLE secrets ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	`,
+	// 21: pending device pairings: the SHA-256 hash of a one-time pairing
+	// code, and the name and scopes of the token it is redeemed for
+	`
+	CREATE TABLE IF NOT EXISTS pairings (
+		hash TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL DEFAULT '',
+		expires_at INTEGER NOT NULL
+	);
+	`,
+	// 22: a change to the tags or description of a secret is a change to
+	// the secret, so incremental backups pick it up
+	`
+	CREATE TRIGGER secret_meta_insert_version AFTER INSERT ON secret_meta
+	BEGIN UPDATE secrets SET version = version WHERE vault = NEW.vault AND key = NEW.key; END;
+	CREATE TRIGGER secret_meta_update_version AFTER UPDATE ON secret_meta
+	BEGIN UPDATE secrets SET version = version WHERE vault = NEW.vault AND key = NEW.key; END;
+	CREATE TRIGGER secret_meta_delete_version AFTER DELETE ON secret_meta
+	BEGIN UPDATE secrets SET version = version WHERE vault = OLD.vault AND key = OLD.key; END;
+	`,
+}
+
+// migrate creates the necessary tables if they don't exist and applies any
+// pending migrations
 func (s *Store) migrate() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS config (
@@ -88,6 +545,29 @@ func (s *Store) migrate() error {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
 	return nil
 }
 
@@ -99,6 +579,33 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// Path returns the filesystem path of the database file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Ping verifies the database connection is still alive
+func (s *Store) Ping() error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM secrets").Scan(&n); err != nil {
+		return fmt.Errorf("failed to query database: %w", err)
+	}
+	return nil
+}
+
+// Revision returns a counter that increases whenever any secret is added,
+// changed or deleted
+func (s *Store) Revision() (uint64, error) {
+	var rev uint64
+	if err := s.db.QueryRow("SELECT value FROM revision WHERE id = 1").Scan(&rev); err != nil {
+		return 0, fmt.Errorf("failed to read revision: %w", err)
+	}
+	return rev, nil
+}
+
 // GetConfig retrieves a configuration value by key
 func (s *Store) GetConfig(key string) ([]byte, error) {
 	var value []byte
@@ -114,7 +621,12 @@ func (s *Store) GetConfig(key string) ([]byte, error) {
 
 // SetConfig stores a configuration value
 func (s *Store) SetConfig(key string, value []byte) error {
-	_, err := s.db.Exec(
+	return setConfig(s.db, key, value)
+}
+
+// setConfig is SetConfig against e
+func setConfig(e execer, key string, value []byte) error {
+	_, err := e.Exec(
 		"INSERT OR REPLACE INTO config (key, value) VALUES (?, ?)",
 		key, value,
 	)
@@ -124,23 +636,205 @@ func (s *Store) SetConfig(key string, value []byte) error {
 	return nil
 }
 
-// SetSecret stores an encrypted secret value
+// DeleteConfig removes a configuration value. Removing a missing value is
+// not an error.
+func (s *Store) DeleteConfig(key string) error {
+	return deleteConfig(s.db, key)
+}
+
+// deleteConfig is DeleteConfig against e
+func deleteConfig(e execer, key string) error {
+	if _, err := e.Exec("DELETE FROM config WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to delete config: %w", err)
+	}
+	return nil
+}
+
+// keepOwner is the owner column of a secret being replaced, bound to its
+// vault and key, so overwriting a value does not change who owns it
+const keepOwner = "COALESCE((SELECT owner FROM secrets WHERE vault = ? AND key = ?), '')"
+
+// SetSecret stores an encrypted secret value inline in the secrets table
 func (s *Store) SetSecret(key string, encryptedValue []byte) error {
-	_, err := s.db.Exec(
-		`INSERT OR REPLACE INTO secrets (key, value, created_at, updated_at)
-		 VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
-		key, encryptedValue,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := archiveSecret(tx, s.escrow, s.vault, key, "overwrite"); err != nil {
+		return err
+	}
+	if err := releaseBlob(tx, s.vault, key); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO secrets (vault, key, value, digest, owner, created_at, updated_at)
+		 VALUES (?, ?, ?, NULL, `+keepOwner+`, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		s.vault, key, encryptedValue, s.vault, key,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to set secret: %w", err)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
 	return nil
 }
 
+// SetSecretBlob stores a secret whose ciphertext lives in the shared blobs
+// table under digest. If a blob with the same digest already exists its
+// ciphertext is reused and its reference count incremented; otherwise
+// encryptedValue becomes the new blob.
+func (s *Store) SetSecretBlob(key string, digest string, encryptedValue []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := setSecretBlob(tx, s.escrow, s.vault, key, digest, encryptedValue); err != nil {
+		return err
+	}
+	if err := indexSecret(tx, s.index, s.vault, key, digest, encryptedValue); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	return nil
+}
+
+// setSecretBlob is SetSecretBlob within tx
+func setSecretBlob(tx *sql.Tx, esc Escrow, vault, key string, digest string, encryptedValue []byte) error {
+	if err := archiveSecret(tx, esc, vault, key, "overwrite"); err != nil {
+		return err
+	}
+	if err := releaseBlob(tx, vault, key); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO blobs (digest, value, refcount) VALUES (?, ?, 1)
+		 ON CONFLICT(digest) DO UPDATE SET refcount = refcount + 1`,
+		digest, encryptedValue,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	// The value column is NOT NULL in the original schema, so blob-backed
+	// rows carry an empty placeholder.
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO secrets (vault, key, value, digest, owner, created_at, updated_at)
+		 VALUES (?, ?, x'', ?, `+keepOwner+`, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		vault, key, digest, vault, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	return nil
+}
+
+// releaseBlob drops the blob reference held by key in vault, if any,
+// deleting the blob once nothing references it
+func releaseBlob(tx *sql.Tx, vault, key string) error {
+	var digest sql.NullString
+	err := tx.QueryRow("SELECT digest FROM secrets WHERE vault = ? AND key = ?", vault, key).Scan(&digest)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to look up blob reference: %w", err)
+	}
+	if !digest.Valid {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET refcount = refcount - 1 WHERE digest = ?", digest.String); err != nil {
+		return fmt.Errorf("failed to release blob: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE digest = ? AND refcount <= 0", digest.String); err != nil {
+		return fmt.Errorf("failed to release blob: %w", err)
+	}
+	return nil
+}
+
+// Escrow archives a secret before a write destroys its value. An error
+// from Archive aborts the write.
+type Escrow interface {
+	Archive(a Archived) error
+}
+
+// Archived is a secret as it was just before a delete or overwrite
+type Archived struct {
+	// Op is "delete" or "overwrite"
+	Op string
+	// Vault is the secret's vault, "" for the default vault
+	Vault   string
+	Key     string
+	Kind    string
+	Owner   string
+	Created time.Time
+	Updated time.Time
+	// Value is the ciphertext, still encrypted with the store key
+	Value []byte
+}
+
+// SetEscrow makes every later delete or overwrite through s, or through
+// its transactions, archive the previous value to e first. A nil e turns
+// escrow off.
+func (s *Store) SetEscrow(e Escrow) {
+	s.escrow = e
+}
+
+// archiveSecret hands the current state of key in vault to esc, if there
+// is an escrow and key exists
+func archiveSecret(tx *sql.Tx, esc Escrow, vault, key, op string) error {
+	if esc == nil {
+		return nil
+	}
+	a := Archived{Op: op, Vault: vault, Key: key}
+	err := tx.QueryRow(
+		`SELECT s.kind, s.owner, s.created_at, s.updated_at, COALESCE(b.value, s.value) FROM secrets s
+		 LEFT JOIN blobs b ON b.digest = s.digest
+		 WHERE s.vault = ? AND s.key = ?`,
+		vault, key,
+	).Scan(&a.Kind, &a.Owner, &a.Created, &a.Updated, &a.Value)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read secret for escrow: %w", err)
+	}
+	if err := esc.Archive(a); err != nil {
+		return fmt.Errorf("escrow failed, secret '%s' left unchanged: %w", key, err)
+	}
+	return nil
+}
+
+// querier is a *sql.DB or *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
 // GetSecret retrieves an encrypted secret value by key
 func (s *Store) GetSecret(key string) ([]byte, error) {
+	return getSecret(s.db, s.vault, key)
+}
+
+// getSecret is GetSecret against q
+func getSecret(q querier, vault, key string) ([]byte, error) {
 	var value []byte
-	err := s.db.QueryRow("SELECT value FROM secrets WHERE key = ?", key).Scan(&value)
+	err := q.QueryRow(
+		`SELECT COALESCE(b.value, s.value) FROM secrets s
+		 LEFT JOIN blobs b ON b.digest = s.digest
+		 WHERE s.vault = ? AND s.key = ?`,
+		vault, key,
+	).Scan(&value)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrNotFound
@@ -150,9 +844,146 @@ func (s *Store) GetSecret(key string) ([]byte, error) {
 	return value, nil
 }
 
+// SecretTimes returns when a secret was created and last updated
+func (s *Store) SecretTimes(key string) (created, updated time.Time, err error) {
+	err = s.db.QueryRow("SELECT created_at, updated_at FROM secrets WHERE vault = ? AND key = ?", s.vault, key).Scan(&created, &updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return created, updated, ErrNotFound
+		}
+		return created, updated, fmt.Errorf("failed to get secret times: %w", err)
+	}
+	return created, updated, nil
+}
+
+// SecretInfo describes a secret without its value
+type SecretInfo struct {
+	Key     string
+	Created time.Time
+	Updated time.Time
+	// Shared is how many other secrets hold the identical value
+	Shared int
+	// Owner is the policy subject owning the secret; empty if unowned
+	Owner string
+	// Expires is when the secret expires; zero if never
+	Expires time.Time
+	// Accessed is when the secret was last read per the access log, set
+	// by LoadAccessed; zero if no read is logged
+	Accessed time.Time
+	Meta
+}
+
+// Expired reports whether the secret has expired at now
+func (info SecretInfo) Expired(now time.Time) bool {
+	return !info.Expires.IsZero() && !now.Before(info.Expires)
+}
+
+// ListSecretInfo returns metadata for all secrets, excluding secrets of
+// other kinds, sorted by key
+func (s *Store) ListSecretInfo() ([]SecretInfo, error) {
+	rows, err := s.db.Query(
+		`SELECT s.key, s.created_at, s.updated_at, COALESCE(b.refcount, 1) - 1, s.owner, s.expires_at,
+		 COALESCE(m.tags, ''), COALESCE(m.description, '') FROM secrets s
+		 LEFT JOIN blobs b ON b.digest = s.digest
+		 LEFT JOIN secret_meta m ON m.vault = s.vault AND m.key = s.key
+		 WHERE s.vault = ? AND s.kind = '' ORDER BY s.key ASC`,
+		s.vault,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var infos []SecretInfo
+	for rows.Next() {
+		var info SecretInfo
+		var tags string
+		var expires int64
+		if err := rows.Scan(&info.Key, &info.Created, &info.Updated, &info.Shared, &info.Owner, &expires, &tags, &info.Description); err != nil {
+			return nil, fmt.Errorf("failed to scan secret: %w", err)
+		}
+		info.Expires, info.Tags = timeOrZero(expires), splitLines(tags)
+		infos = append(infos, info)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+
+	return infos, nil
+}
+
+// SecretOwner returns the policy subject owning a secret, or "" if it is
+// unowned
+func (s *Store) SecretOwner(key string) (string, error) {
+	return secretOwner(s.db, s.vault, key)
+}
+
+// secretOwner is SecretOwner against q
+func secretOwner(q querier, vault, key string) (string, error) {
+	var owner string
+	if err := q.QueryRow("SELECT owner FROM secrets WHERE vault = ? AND key = ?", vault, key).Scan(&owner); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("failed to get secret owner: %w", err)
+	}
+	return owner, nil
+}
+
+// SetSecretOwner records the policy subject owning a secret; "" makes it
+// unowned
+func (s *Store) SetSecretOwner(key, owner string) error {
+	return setSecretOwner(s.db, s.vault, key, owner)
+}
+
+// execer is a *sql.DB or *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// setSecretOwner is SetSecretOwner against e
+func setSecretOwner(e execer, vault, key, owner string) error {
+	result, err := e.Exec("UPDATE secrets SET owner = ? WHERE vault = ? AND key = ?", owner, vault, key)
+	if err != nil {
+		return fmt.Errorf("failed to set secret owner: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // DeleteSecret removes a secret by key
 func (s *Store) DeleteSecret(key string) error {
-	result, err := s.db.Exec("DELETE FROM secrets WHERE key = ?", key)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSecret(tx, s.escrow, s.vault, key); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+	return nil
+}
+
+// deleteSecret is DeleteSecret within tx
+func deleteSecret(tx *sql.Tx, esc Escrow, vault, key string) error {
+	if err := archiveSecret(tx, esc, vault, key, "delete"); err != nil {
+		return err
+	}
+	if err := releaseBlob(tx, vault, key); err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM secrets WHERE vault = ? AND key = ?", vault, key)
 	if err != nil {
 		return fmt.Errorf("failed to delete secret: %w", err)
 	}
@@ -165,13 +996,58 @@ func (s *Store) DeleteSecret(key string) error {
 	if rowsAffected == 0 {
 		return ErrNotFound
 	}
-
 	return nil
 }
 
-// ListSecrets returns all secret keys
+// ListSecrets returns all secret keys, excluding secrets of other kinds
+// and expired secrets
 func (s *Store) ListSecrets() ([]string, error) {
-	rows, err := s.db.Query("SELECT key FROM secrets ORDER BY key ASC")
+	return s.ListKindSecrets("")
+}
+
+// SetKindSecret stores an encrypted value inline under key, tagged with
+// kind. Secrets with a kind are never listed by ListSecrets, so they are
+// not exported by env or run.
+func (s *Store) SetKindSecret(kind, key string, encryptedValue []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := setKindSecret(tx, s.escrow, s.vault, kind, key, encryptedValue); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	return nil
+}
+
+// setKindSecret is SetKindSecret within tx
+func setKindSecret(tx *sql.Tx, esc Escrow, vault, kind, key string, encryptedValue []byte) error {
+	if err := archiveSecret(tx, esc, vault, key, "overwrite"); err != nil {
+		return err
+	}
+	if err := releaseBlob(tx, vault, key); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+
+	_, err := tx.Exec(
+		`INSERT OR REPLACE INTO secrets (vault, key, value, digest, kind, owner, created_at, updated_at)
+		 VALUES (?, ?, ?, NULL, ?, `+keepOwner+`, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		vault, key, encryptedValue, kind, vault, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+	return nil
+}
+
+// ListAllSecrets returns the keys of all secrets of every kind
+func (s *Store) ListAllSecrets() ([]string, error) {
+	rows, err := s.db.Query("SELECT key FROM secrets WHERE vault = ? ORDER BY key ASC", s.vault)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list secrets: %w", err)
 	}
@@ -192,3 +1068,457 @@ func (s *Store) ListSecrets() ([]string, error) {
 
 	return keys, nil
 }
+
+// ListKindSecrets returns the keys of all secrets of the given kind that
+// have not expired
+func (s *Store) ListKindSecrets(kind string) ([]string, error) {
+	return listKindSecrets(s.db, s.vault, kind)
+}
+
+// listKindSecrets is ListKindSecrets against q
+func listKindSecrets(q querier, vault, kind string) ([]string, error) {
+	rows, err := q.Query(
+		"SELECT key FROM secrets WHERE vault = ? AND kind = ? AND (expires_at = 0 OR expires_at > ?) ORDER BY key ASC",
+		vault, kind, time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan secret key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+
+	return keys, nil
+}
+
+// Digests returns the value digest of every plain secret in s's vault
+// that has not expired, by key. Secrets stored before digests were kept
+// map to "".
+func (s *Store) Digests() (map[string]string, error) {
+	rows, err := s.db.Query(
+		"SELECT key, COALESCE(digest, '') FROM secrets WHERE vault = ? AND kind = '' AND (expires_at = 0 OR expires_at > ?)",
+		s.vault, time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list digests: %w", err)
+	}
+	defer rows.Close()
+
+	digests := map[string]string{}
+	for rows.Next() {
+		var key, digest string
+		if err := rows.Scan(&key, &digest); err != nil {
+			return nil, fmt.Errorf("failed to scan digest: %w", err)
+		}
+		digests[key] = digest
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating digests: %w", err)
+	}
+	return digests, nil
+}
+
+// CountKinds returns how many secrets of each kind in s's vault have not
+// expired at now, with plain secrets under ""
+func (s *Store) CountKinds(now time.Time) (map[string]int, error) {
+	rows, err := s.db.Query(
+		"SELECT kind, COUNT(*) FROM secrets WHERE vault = ? AND (expires_at = 0 OR expires_at > ?) GROUP BY kind",
+		s.vault, now.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count secrets: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, fmt.Errorf("failed to count secrets: %w", err)
+		}
+		counts[kind] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+	return counts, nil
+}
+
+// Policy binds a subject ("uid:N", "gid:N", "token:NAME" or
+// "claim:NAME=VALUE") to a role on keys matching a glob pattern
+type Policy struct {
+	Subject string
+	Pattern string
+	Role    string
+}
+
+// AddPolicy grants subject role on keys matching pattern. Adding an
+// existing policy is a no-op.
+func (s *Store) AddPolicy(subject, pattern, role string) error {
+	_, err := s.db.Exec(
+		"INSERT OR IGNORE INTO policies (subject, pattern, role) VALUES (?, ?, ?)",
+		subject, pattern, role,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add policy: %w", err)
+	}
+	return nil
+}
+
+// RemovePolicy revokes a policy, returning ErrNotFound if it does not exist
+func (s *Store) RemovePolicy(subject, pattern, role string) error {
+	result, err := s.db.Exec(
+		"DELETE FROM policies WHERE subject = ? AND pattern = ? AND role = ?",
+		subject, pattern, role,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove policy: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListPolicies returns all policies ordered by subject, pattern and role
+func (s *Store) ListPolicies() ([]Policy, error) {
+	rows, err := s.db.Query("SELECT subject, pattern, role FROM policies ORDER BY subject ASC, pattern ASC, role ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []Policy
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&p.Subject, &p.Pattern, &p.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan policy: %w", err)
+		}
+		policies = append(policies, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating policies: %w", err)
+	}
+
+	return policies, nil
+}
+
+// Role is a named set of permissions defined by the user. The built-in
+// roles are not stored.
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+// SetRole creates or replaces a role
+func (s *Store) SetRole(name string, permissions []string) error {
+	_, err := s.db.Exec(
+		"INSERT INTO roles (name, permissions) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET permissions = excluded.permissions",
+		name, strings.Join(permissions, ","),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save role: %w", err)
+	}
+	return nil
+}
+
+// DeleteRole deletes a role and the policies that bind it, returning
+// ErrNotFound if it does not exist
+func (s *Store) DeleteRole(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM roles WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM policies WHERE role = ?", name); err != nil {
+		return fmt.Errorf("failed to delete role policies: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	return nil
+}
+
+// ListRoles returns the user-defined roles ordered by name
+func (s *Store) ListRoles() ([]Role, error) {
+	rows, err := s.db.Query("SELECT name, permissions FROM roles ORDER BY name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var r Role
+		var permissions string
+		if err := rows.Scan(&r.Name, &permissions); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		if permissions != "" {
+			r.Permissions = strings.Split(permissions, ",")
+		}
+		roles = append(roles, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating roles: %w", err)
+	}
+
+	return roles, nil
+}
+
+// Token is a named API token. Only the hash of the token is stored.
+type Token struct {
+	Name      string
+	CreatedAt time.Time
+	// ExpiresAt is when the token stops being accepted; zero means never
+	ExpiresAt time.Time
+	// Subjects are policy subjects the token acts as besides its own name,
+	// e.g. the claims of an OIDC login
+	Subjects []string
+	// Scopes are grants carried by the token itself, e.g. "read:APP_*"
+	Scopes []string
+	// TTL is how far a refresh extends the token
+	TTL time.Duration
+	// RefreshExpiresAt is when the token's refresh token stops being
+	// accepted; zero means never
+	RefreshExpiresAt time.Time
+	// Refreshable reports whether the token has a refresh token
+	Refreshable bool
+	// RevokedAt is when the token was revoked; zero if it is live
+	RevokedAt time.Time
+	// MaxReads limits how many values the token may read per UTC day;
+	// zero means no limit
+	MaxReads int
+	// MaxKeys limits how many distinct keys the token may ever read; zero
+	// means no limit
+	MaxKeys int
+}
+
+// Expired reports whether the token has expired at now
+func (t Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// Revoked reports whether the token has been revoked
+func (t Token) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// unixOrZero returns the unix time of t, or 0 for the zero time
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// timeOrZero is the inverse of unixOrZero
+func timeOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// splitLines splits a newline separated column, returning nil for ""
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// CreateToken stores the hash of a new token, and of its refresh token
+// unless refreshHash is empty. CreatedAt, Refreshable and RevokedAt are
+// ignored.
+func (s *Store) CreateToken(t Token, hash, refreshHash string) error {
+	return createToken(s.db, t, hash, refreshHash)
+}
+
+// createToken is CreateToken against e
+func createToken(e execer, t Token, hash, refreshHash string) error {
+	var refresh any
+	if refreshHash != "" {
+		refresh = refreshHash
+	}
+	_, err := e.Exec(`INSERT INTO tokens (name, hash, expires_at, subjects, scopes, ttl, refresh_hash, refresh_expires_at, max_reads, max_keys)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Name, hash, unixOrZero(t.ExpiresAt), strings.Join(t.Subjects, "\n"), strings.Join(t.Scopes, "\n"),
+		int64(t.TTL/time.Second), refresh, unixOrZero(t.RefreshExpiresAt), t.MaxReads, t.MaxKeys)
+	if err != nil {
+		return fmt.Errorf("failed to create token '%s': %w", t.Name, err)
+	}
+	return nil
+}
+
+// tokenColumns are the columns read by scanToken
+const tokenColumns = "name, created_at, expires_at, subjects, scopes, ttl, refresh_hash IS NOT NULL, refresh_expires_at, revoked_at, max_reads, max_keys"
+
+// scanToken reads a token selected with tokenColumns
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	var (
+		t                                Token
+		expires, refreshExpires, revoked int64
+		ttl                              int64
+		subjects, scopes                 string
+	)
+	err := row.Scan(&t.Name, &t.CreatedAt, &expires, &subjects, &scopes, &ttl, &t.Refreshable, &refreshExpires, &revoked, &t.MaxReads, &t.MaxKeys)
+	if err != nil {
+		return t, err
+	}
+	t.ExpiresAt = timeOrZero(expires)
+	t.RefreshExpiresAt = timeOrZero(refreshExpires)
+	t.RevokedAt = timeOrZero(revoked)
+	t.TTL = time.Duration(ttl) * time.Second
+	t.Subjects = splitLines(subjects)
+	t.Scopes = splitLines(scopes)
+	return t, nil
+}
+
+// LookupToken returns the token with the given hash, or ErrNotFound if
+// there is none or it has expired or been revoked
+func (s *Store) LookupToken(hash string) (Token, error) {
+	t, err := scanToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE hash = ?", hash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, ErrNotFound
+		}
+		return t, fmt.Errorf("failed to look up token: %w", err)
+	}
+	if t.Expired(time.Now()) || t.Revoked() {
+		return Token{}, ErrNotFound
+	}
+	return t, nil
+}
+
+// RefreshToken redeems the refresh token with hash refreshHash: the token
+// is given newHash and newRefreshHash, and its expiry is extended by its
+// TTL from now. Refresh tokens are single use; ErrNotFound is returned for
+// unknown, expired or revoked ones.
+func (s *Store) RefreshToken(refreshHash, newHash, newRefreshHash string, now time.Time) (Token, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := scanToken(tx.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE refresh_hash = ?", refreshHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Token{}, ErrNotFound
+		}
+		return Token{}, fmt.Errorf("failed to look up refresh token: %w", err)
+	}
+	if t.Revoked() || !t.RefreshExpiresAt.IsZero() && !now.Before(t.RefreshExpiresAt) {
+		return Token{}, ErrNotFound
+	}
+
+	t.ExpiresAt = time.Time{}
+	if t.TTL > 0 {
+		t.ExpiresAt = now.Add(t.TTL)
+	}
+	_, err = tx.Exec("UPDATE tokens SET hash = ?, refresh_hash = ?, expires_at = ? WHERE name = ?",
+		newHash, newRefreshHash, unixOrZero(t.ExpiresAt), t.Name)
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Token{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return t, nil
+}
+
+// RevokeToken revokes a token and its refresh token by name. Revoked
+// tokens stay listed until they expire. ErrNotFound is returned if there
+// is no live token called name.
+func (s *Store) RevokeToken(name string) error {
+	result, err := s.db.Exec("UPDATE tokens SET revoked_at = ?, refresh_hash = NULL WHERE name = ? AND revoked_at = 0",
+		time.Now().Unix(), name)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpiredTokens removes tokens that expired before now and can no
+// longer be refreshed, and returns how many were removed
+func (s *Store) DeleteExpiredTokens(now time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM tokens WHERE expires_at != 0 AND expires_at <= ?
+		AND (refresh_hash IS NULL OR (refresh_expires_at != 0 AND refresh_expires_at <= ?))`, now.Unix(), now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ListTokens returns all tokens ordered by name
+func (s *Store) ListTokens() ([]Token, error) {
+	rows, err := s.db.Query("SELECT " + tokenColumns + " FROM tokens ORDER BY name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Vacuum rebuilds the database file, so content deleted from it, such as
+// a replaced key, no longer lingers in free pages
+func (s *Store) Vacuum() error {
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum store: %w", err)
+	}
+	return nil
+}
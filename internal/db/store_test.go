@@ -1,9 +1,11 @@
 package db
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -102,3 +104,982 @@ func TestStoreBasicOperations(t *testing.T) {
 		t.Fatalf("Expected ErrNotFound for non-existent config, got: %v", err)
 	}
 }
+
+// newTestStore opens a store backed by a fresh temporary database
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	tmpDir := fmt.Sprintf("/tmp/lockbox-db-test-%d", time.Now().UnixNano())
+	os.MkdirAll(tmpDir, 0700)
+	os.Setenv("LOCKBOX_DB_PATH", tmpDir+"/lockbox.db")
+
+	store, err := NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+		os.Unsetenv("LOCKBOX_DB_PATH")
+		os.RemoveAll(tmpDir)
+	})
+
+	return store
+}
+
+func TestStoreSharedBlobs(t *testing.T) {
+	store := newTestStore(t)
+
+	// Two keys with the same digest share one blob
+	if err := store.SetSecretBlob("A", "d1", []byte("cipher-1")); err != nil {
+		t.Fatalf("Failed to set A: %v", err)
+	}
+	if err := store.SetSecretBlob("B", "d1", []byte("cipher-2")); err != nil {
+		t.Fatalf("Failed to set B: %v", err)
+	}
+
+	for _, key := range []string{"A", "B"} {
+		value, err := store.GetSecret(key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		if string(value) != "cipher-1" {
+			t.Errorf("Expected shared ciphertext for %s, got %q", key, value)
+		}
+	}
+
+	var blobCount int
+	store.db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobCount)
+	if blobCount != 1 {
+		t.Errorf("Expected 1 blob, got %d", blobCount)
+	}
+
+	store.SetSecret("C", []byte("inline"))
+	store.SetKindSecret("note", "N", []byte("hidden"))
+	infos, err := store.ListSecretInfo()
+	if err != nil {
+		t.Fatalf("Failed to list secret info: %v", err)
+	}
+	if len(infos) != 3 || infos[0].Key != "A" || infos[0].Shared != 1 || infos[1].Shared != 1 || infos[2].Key != "C" || infos[2].Shared != 0 || infos[2].Created.IsZero() {
+		t.Errorf("Unexpected secret info: %+v", infos)
+	}
+	store.DeleteSecret("C")
+
+	// Deleting one reference keeps the blob alive for the other
+	if err := store.DeleteSecret("A"); err != nil {
+		t.Fatalf("Failed to delete A: %v", err)
+	}
+	if value, err := store.GetSecret("B"); err != nil || string(value) != "cipher-1" {
+		t.Fatalf("Expected B to survive deletion of A, got %q, %v", value, err)
+	}
+
+	// Overwriting the last reference with an inline value frees the blob
+	if err := store.SetSecret("B", []byte("inline")); err != nil {
+		t.Fatalf("Failed to overwrite B: %v", err)
+	}
+	store.db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobCount)
+	if blobCount != 0 {
+		t.Errorf("Expected orphaned blob to be removed, got %d blobs", blobCount)
+	}
+	if value, _ := store.GetSecret("B"); string(value) != "inline" {
+		t.Errorf("Expected inline value for B, got %q", value)
+	}
+}
+
+func TestStorePolicies(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := store.AddPolicy("uid:1000", "APP_*", "reader"); err != nil {
+		t.Fatalf("Failed to add policy: %v", err)
+	}
+	// Adding the same policy again is a no-op
+	if err := store.AddPolicy("uid:1000", "APP_*", "reader"); err != nil {
+		t.Fatalf("Failed to re-add policy: %v", err)
+	}
+	store.AddPolicy("gid:50", "DEPLOY_*", "operator")
+
+	policies, err := store.ListPolicies()
+	if err != nil {
+		t.Fatalf("Failed to list policies: %v", err)
+	}
+	if len(policies) != 2 || policies[0].Role != "operator" || policies[1].Pattern != "APP_*" {
+		t.Fatalf("Unexpected policies: %+v", policies)
+	}
+
+	if err := store.RemovePolicy("uid:1000", "APP_*", "operator"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound removing a policy for another role, got %v", err)
+	}
+	if err := store.RemovePolicy("uid:1000", "APP_*", "reader"); err != nil {
+		t.Fatalf("Failed to remove policy: %v", err)
+	}
+	if err := store.RemovePolicy("uid:1000", "APP_*", "reader"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound removing a missing policy, got %v", err)
+	}
+}
+
+func TestStoreRoles(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := store.SetRole("deployer", []string{"read", "write"}); err != nil {
+		t.Fatalf("Failed to save role: %v", err)
+	}
+	store.SetRole("deployer", []string{"read"})
+	store.AddPolicy("gid:50", "DEPLOY_*", "deployer")
+	store.AddPolicy("gid:50", "DEPLOY_*", "reader")
+
+	roles, err := store.ListRoles()
+	if err != nil {
+		t.Fatalf("Failed to list roles: %v", err)
+	}
+	if len(roles) != 1 || roles[0].Name != "deployer" || len(roles[0].Permissions) != 1 {
+		t.Fatalf("Unexpected roles: %+v", roles)
+	}
+
+	if err := store.DeleteRole("deployer"); err != nil {
+		t.Fatalf("Failed to delete role: %v", err)
+	}
+	if err := store.DeleteRole("deployer"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting a missing role, got %v", err)
+	}
+	// Deleting a role drops its policies and keeps the others
+	if policies, _ := store.ListPolicies(); len(policies) != 1 || policies[0].Role != "reader" {
+		t.Errorf("Unexpected policies after deleting the role: %+v", policies)
+	}
+}
+
+func TestStoreKindSecrets(t *testing.T) {
+	store := newTestStore(t)
+
+	store.SetSecret("API_KEY", []byte{1})
+	if err := store.SetKindSecret("podman", "podman/abc", []byte{2}); err != nil {
+		t.Fatalf("Failed to set kind secret: %v", err)
+	}
+
+	keys, _ := store.ListSecrets()
+	if len(keys) != 1 || keys[0] != "API_KEY" {
+		t.Errorf("ListSecrets should exclude other kinds, got %v", keys)
+	}
+	keys, _ = store.ListKindSecrets("podman")
+	if len(keys) != 1 || keys[0] != "podman/abc" {
+		t.Errorf("ListKindSecrets returned %v", keys)
+	}
+
+	value, err := store.GetSecret("podman/abc")
+	if err != nil || len(value) != 1 || value[0] != 2 {
+		t.Errorf("GetSecret on a kind secret = %v, %v", value, err)
+	}
+}
+
+func TestStoreSecretOwner(t *testing.T) {
+	store := newTestStore(t)
+
+	store.SetSecretBlob("API_KEY", "d1", []byte{1})
+	if owner, err := store.SecretOwner("API_KEY"); err != nil || owner != "" {
+		t.Errorf("Expected a new secret to be unowned, got %q, %v", owner, err)
+	}
+	if err := store.SetSecretOwner("API_KEY", "uid:1000"); err != nil {
+		t.Fatalf("Failed to set owner: %v", err)
+	}
+
+	// Overwriting the value keeps the owner
+	store.SetSecretBlob("API_KEY", "d2", []byte{2})
+	store.SetSecret("API_KEY", []byte{3})
+	if owner, _ := store.SecretOwner("API_KEY"); owner != "uid:1000" {
+		t.Errorf("Expected owner to survive overwrites, got %q", owner)
+	}
+
+	if _, err := store.SecretOwner("MISSING"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing secret, got %v", err)
+	}
+	if err := store.SetSecretOwner("MISSING", "uid:1000"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound setting a missing owner, got %v", err)
+	}
+
+	// A recreated secret starts unowned
+	store.DeleteSecret("API_KEY")
+	store.SetSecret("API_KEY", []byte{4})
+	if owner, _ := store.SecretOwner("API_KEY"); owner != "" {
+		t.Errorf("Expected a recreated secret to be unowned, got %q", owner)
+	}
+}
+
+func TestStoreSecretMeta(t *testing.T) {
+	store := newTestStore(t)
+
+	store.SetSecretBlob("API_KEY", "d1", []byte{1})
+	if err := store.SetSecretMeta("API_KEY", Meta{Tags: []string{"prod", "api", "prod"}, Description: "Payments API"}); err != nil {
+		t.Fatalf("Failed to set metadata: %v", err)
+	}
+	store.SetSecret("API_KEY", []byte{2})
+	infos, _ := store.ListSecretInfo()
+	if len(infos) != 1 || strings.Join(infos[0].Tags, ",") != "api,prod" || infos[0].Description != "Payments API" || !infos[0].HasTags("prod", "api") {
+		t.Errorf("Expected metadata to survive overwrites, got %+v", infos)
+	}
+
+	if err := store.SetSecretMeta("API_KEY", Meta{Tags: []string{"a b"}}); err == nil {
+		t.Error("Expected an invalid tag to be rejected")
+	}
+	if err := store.SetSecretMeta("MISSING", Meta{Description: "x"}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound setting metadata of a missing secret, got %v", err)
+	}
+
+	// A recreated secret starts without metadata
+	store.DeleteSecret("API_KEY")
+	store.SetSecret("API_KEY", []byte{3})
+	if m, err := store.SecretMeta("API_KEY"); err != nil || len(m.Tags) != 0 || m.Description != "" {
+		t.Errorf("Expected a recreated secret to have no metadata, got %+v, %v", m, err)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	for _, key := range []string{"OLD", "RENEWED", "LIVE"} {
+		store.SetSecretBlob(key, "d-"+key, []byte{1})
+	}
+	store.SetExpiry("OLD", now.Add(-time.Minute))
+	store.SetExpiry("RENEWED", now.Add(-time.Minute))
+	store.SetExpiry("LIVE", now.Add(time.Hour))
+	if err := store.SetExpiry("MISSING", now); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound setting the expiry of a missing secret, got %v", err)
+	}
+	// Writing a secret again makes it permanent
+	store.SetSecretBlob("RENEWED", "d-new", []byte{2})
+
+	if keys, _ := store.ListSecrets(); strings.Join(keys, ",") != "LIVE,RENEWED" {
+		t.Errorf("Expected expired secrets to be left out of ListSecrets, got %v", keys)
+	}
+	if expires, err := store.SecretExpiry("LIVE"); err != nil || expires.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("SecretExpiry = %v, %v", expires, err)
+	}
+	infos, _ := store.ListSecretInfo()
+	for _, info := range infos {
+		if info.Expired(now) != (info.Key == "OLD") {
+			t.Errorf("%s expired = %v", info.Key, info.Expired(now))
+		}
+	}
+
+	pruned, err := store.PruneExpired(now)
+	if err != nil || strings.Join(pruned, ",") != "OLD" {
+		t.Fatalf("PruneExpired = %v, %v", pruned, err)
+	}
+	if _, err := store.GetSecret("OLD"); err != ErrNotFound {
+		t.Errorf("Expected a pruned secret to be gone, got %v", err)
+	}
+	if keys, _ := store.ListExpiredSecrets(now.Add(2 * time.Hour)); strings.Join(keys, ",") != "LIVE" {
+		t.Errorf("ListExpiredSecrets later = %v", keys)
+	}
+}
+
+func TestStoreRenameSecret(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	store.SetSecretBlob("OLD", "d1", []byte{1})
+	store.SetSecretOwner("OLD", "uid:1000")
+	store.SetSecretMeta("OLD", Meta{Tags: []string{"prod"}, Description: "Old name"})
+	store.SetExpiry("OLD", now.Add(time.Hour))
+	store.CheckOut("OLD", "uid:1000", now.Add(time.Hour), false)
+	store.SetSecretBlob("TAKEN", "d2", []byte{2})
+	rev, _ := store.Revision()
+
+	if err := store.RenameSecret("OLD", "TAKEN", false); err != ErrExists {
+		t.Errorf("Expected ErrExists renaming onto an existing key, got %v", err)
+	}
+	if err := store.RenameSecret("MISSING", "X", false); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound renaming a missing secret, got %v", err)
+	}
+	if err := store.RenameSecret("OLD", "NEW", false); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+
+	if _, err := store.GetSecret("OLD"); err != ErrNotFound {
+		t.Errorf("Expected the old key to be gone, got %v", err)
+	}
+	if value, err := store.GetSecret("NEW"); err != nil || !bytes.Equal(value, []byte{1}) {
+		t.Errorf("GetSecret(NEW) = %v, %v", value, err)
+	}
+	owner, _ := store.SecretOwner("NEW")
+	m, _ := store.SecretMeta("NEW")
+	expires, _ := store.SecretExpiry("NEW")
+	checkouts, _ := store.Checkouts()
+	if owner != "uid:1000" || m.Description != "Old name" || expires.Unix() != now.Add(time.Hour).Unix() || len(checkouts) != 1 || checkouts[0].Key != "NEW" {
+		t.Errorf("Renamed secret has owner %q, metadata %+v, expiry %v and checkouts %+v", owner, m, expires, checkouts)
+	}
+
+	// Sync sees the old key deleted and the new one written
+	var changes []string
+	store.Changes(rev, func(c Change) error {
+		changes = append(changes, fmt.Sprintf("%s:%v", c.Key, c.Deleted))
+		return nil
+	})
+	if strings.Join(changes, ",") != "OLD:true,NEW:false" {
+		t.Errorf("Changes after rename = %v", changes)
+	}
+
+	if err := store.RenameSecret("NEW", "TAKEN", true); err != nil {
+		t.Fatalf("Failed to rename with force: %v", err)
+	}
+	if value, _ := store.GetSecret("TAKEN"); !bytes.Equal(value, []byte{1}) {
+		t.Errorf("Expected force to replace TAKEN, got %v", value)
+	}
+	if keys, _ := store.ListSecrets(); strings.Join(keys, ",") != "TAKEN" {
+		t.Errorf("Secrets after renaming with force = %v", keys)
+	}
+}
+
+func TestStoreRevision(t *testing.T) {
+	store := newTestStore(t)
+
+	rev0, err := store.Revision()
+	if err != nil {
+		t.Fatalf("Failed to read revision: %v", err)
+	}
+
+	store.SetSecret("A", []byte{1})
+	rev1, _ := store.Revision()
+	store.SetSecretBlob("A", "digest", []byte{2})
+	rev2, _ := store.Revision()
+	store.DeleteSecret("A")
+	rev3, _ := store.Revision()
+
+	if !(rev0 < rev1 && rev1 < rev2 && rev2 < rev3) {
+		t.Errorf("Revision did not increase on every write: %d %d %d %d", rev0, rev1, rev2, rev3)
+	}
+
+	store.SetConfig("unrelated", []byte("x"))
+	if rev, _ := store.Revision(); rev != rev3 {
+		t.Errorf("Config writes should not change the revision")
+	}
+}
+
+func TestStoreTx(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecretBlob("OLD", "d1", []byte{1})
+
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	tx.SetSecretBlob("NEW", "d2", []byte{2})
+	if err := tx.DeleteSecret("OLD"); err != nil {
+		t.Fatalf("Failed to delete in transaction: %v", err)
+	}
+	if keys, _ := tx.ListSecrets(); len(keys) != 1 || keys[0] != "NEW" {
+		t.Errorf("Transaction should see its own writes, got %v", keys)
+	}
+	tx.Rollback()
+
+	if keys, _ := store.ListSecrets(); len(keys) != 1 || keys[0] != "OLD" {
+		t.Errorf("Rollback left %v, expected [OLD]", keys)
+	}
+
+	tx, _ = store.Begin()
+	tx.SetSecretBlob("NEW", "d2", []byte{2})
+	tx.SetKindSecret("note", "note/x", []byte{3})
+	if err := tx.DeleteSecret("MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	tx.Rollback()
+	if value, err := store.GetSecret("NEW"); err != nil || value[0] != 2 {
+		t.Errorf("Committed secret not readable: %v, %v", value, err)
+	}
+	if keys, _ := store.ListKindSecrets("note"); len(keys) != 1 {
+		t.Errorf("Committed kind secret not listed: %v", keys)
+	}
+}
+
+func TestStoreReencrypt(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecretBlob("A", "d1", []byte("a"))
+	store.SetSecretBlob("B", "d1", []byte("a"))
+	store.SetSecret("C", []byte("c"))
+	store.SetKindSecret("note", "N", []byte("n"))
+	store.SetSecretOwner("C", "uid:1000")
+	before, _ := store.Revision()
+
+	tx, _ := store.Begin()
+	calls := 0
+	n, err := tx.Reencrypt(func(ciphertext []byte, blob bool) ([]byte, string, error) {
+		calls++
+		if blob {
+			return append([]byte("new-"), ciphertext...), "d2", nil
+		}
+		return append([]byte("new-"), ciphertext...), "", nil
+	})
+	if err != nil || n != 4 {
+		t.Fatalf("Reencrypt = %d, %v", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	// The shared blob is re-encrypted once and stays shared
+	if calls != 3 {
+		t.Errorf("Expected 3 values re-encrypted, got %d", calls)
+	}
+	for key, want := range map[string]string{"A": "new-a", "B": "new-a", "C": "new-c"} {
+		if value, _ := store.GetSecret(key); string(value) != want {
+			t.Errorf("%s = %q, expected %q", key, value, want)
+		}
+	}
+	if infos, _ := store.ListSecretInfo(); len(infos) != 3 || infos[0].Shared != 1 || infos[1].Shared != 1 {
+		t.Errorf("Expected A and B to still share a blob, got %+v", infos)
+	}
+	var blobs, refs int
+	store.db.QueryRow("SELECT COUNT(*), SUM(refcount) FROM blobs WHERE digest = 'd2'").Scan(&blobs, &refs)
+	if blobs != 1 || refs != 2 {
+		t.Errorf("Expected one blob with 2 references, got %d with %d", blobs, refs)
+	}
+	if owner, _ := store.SecretOwner("C"); owner != "uid:1000" {
+		t.Errorf("Reencrypt lost the owner of C: %q", owner)
+	}
+	if after, _ := store.Revision(); after <= before {
+		t.Errorf("Expected the revision to move past %d, got %d", before, after)
+	}
+}
+
+func TestStoreVaults(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecret("DB_URL", []byte("default"))
+
+	if err := store.CreateVault("prod"); err != nil {
+		t.Fatalf("Failed to create vault: %v", err)
+	}
+	for _, name := range []string{"prod", "default", "a/b", ""} {
+		if err := store.CreateVault(name); err == nil {
+			t.Errorf("CreateVault accepted %q", name)
+		}
+	}
+
+	// The same key is independent in each vault
+	prod := store.InVault("prod")
+	if err := prod.SetSecretBlob("DB_URL", "d1", []byte("prod")); err != nil {
+		t.Fatalf("Failed to set in vault: %v", err)
+	}
+	prod.SetKindSecret("note", "note/x", []byte("n"))
+	if value, _ := store.GetSecret("DB_URL"); string(value) != "default" {
+		t.Errorf("Default vault DB_URL = %q", value)
+	}
+	if value, _ := prod.GetSecret("DB_URL"); string(value) != "prod" {
+		t.Errorf("prod DB_URL = %q", value)
+	}
+	if keys, _ := store.ListAllSecrets(); len(keys) != 1 {
+		t.Errorf("Default vault lists %v", keys)
+	}
+	if prod.Qualify("DB_URL") != "prod/DB_URL" || store.Qualify("DB_URL") != "DB_URL" {
+		t.Errorf("Unexpected qualified names %q, %q", prod.Qualify("DB_URL"), store.Qualify("DB_URL"))
+	}
+
+	vaults, err := store.ListVaults()
+	if err != nil || len(vaults) != 1 || vaults[0].Name != "prod" || vaults[0].Secrets != 1 {
+		t.Errorf("ListVaults = %+v, %v", vaults, err)
+	}
+	if ok, _ := store.HasVault("staging"); ok {
+		t.Error("HasVault found a vault never created")
+	}
+
+	// Changes carry the vault and apply back to it
+	var changes []Change
+	store.Changes(0, func(c Change) error { changes = append(changes, c); return nil })
+	if len(changes) != 3 || changes[1].Vault != "prod" {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+
+	n, err := store.DeleteVault("prod")
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteVault = %d, %v", n, err)
+	}
+	if _, err := prod.GetSecret("DB_URL"); err != ErrNotFound {
+		t.Errorf("Secret survived its vault: %v", err)
+	}
+	if value, _ := store.GetSecret("DB_URL"); string(value) != "default" {
+		t.Errorf("Deleting a vault touched the default vault: %q", value)
+	}
+	if _, err := store.DeleteVault("prod"); err != ErrNotFound {
+		t.Errorf("Deleting a missing vault = %v, want ErrNotFound", err)
+	}
+
+	tx, _ := store.Begin()
+	for _, c := range changes[1:2] {
+		if err := tx.ApplyChange(c); err != nil {
+			t.Fatalf("ApplyChange failed: %v", err)
+		}
+	}
+	tx.Commit()
+	if value, _ := prod.GetSecret("DB_URL"); string(value) != "prod" {
+		t.Errorf("ApplyChange did not restore into the vault: %q", value)
+	}
+}
+
+func TestStoreSnapshots(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecretBlob("API_KEY", "d1", []byte("v1"))
+	store.SetSecret("DB_URL", []byte("db"))
+	store.SetKindSecret("note", "N", []byte("n"))
+	now := time.Now()
+
+	sn, err := store.CreateSnapshot("deploy-1", "uid:1000", nil, now)
+	if err != nil || sn.Secrets != 2 || sn.CreatedBy != "uid:1000" {
+		t.Fatalf("CreateSnapshot = %+v, %v", sn, err)
+	}
+	if _, err := store.CreateSnapshot("deploy-1", "uid:1000", nil, now); err == nil {
+		t.Error("CreateSnapshot accepted an existing name")
+	}
+	if _, err := store.CreateSnapshot("partial", "uid:1000", []string{"MISSING"}, now); err == nil {
+		t.Error("CreateSnapshot accepted a missing key")
+	}
+	if _, err := store.CreateSnapshot("a/b", "uid:1000", nil, now); err == nil {
+		t.Error("CreateSnapshot accepted an invalid name")
+	}
+	if sn, err := store.CreateSnapshot("partial", "uid:1000", []string{"DB_URL"}, now.Add(time.Second)); err != nil || sn.Secrets != 1 {
+		t.Errorf("CreateSnapshot of one key = %+v, %v", sn, err)
+	}
+
+	// The snapshot keeps its values through changes and key rotations
+	store.SetSecretBlob("API_KEY", "d2", []byte("v2"))
+	store.DeleteSecret("DB_URL")
+	tx, _ := store.Begin()
+	if _, err := tx.Reencrypt(func(ciphertext []byte, blob bool) ([]byte, string, error) {
+		return append([]byte("new-"), ciphertext...), "", nil
+	}); err != nil {
+		t.Fatalf("Reencrypt failed: %v", err)
+	}
+	tx.Commit()
+	_, secrets, err := store.GetSnapshot("deploy-1")
+	if err != nil || len(secrets) != 2 {
+		t.Fatalf("GetSnapshot = %v, %v", secrets, err)
+	}
+	if secrets[0].Key != "API_KEY" || string(secrets[0].Value) != "new-v1" || string(secrets[1].Value) != "new-db" {
+		t.Errorf("Snapshot values = %+v", secrets)
+	}
+	if _, _, err := store.GetSnapshot("missing"); err != ErrNotFound {
+		t.Errorf("GetSnapshot(missing) = %v, want ErrNotFound", err)
+	}
+
+	// Snapshots belong to their vault
+	store.CreateVault("prod")
+	prod := store.InVault("prod")
+	prod.SetSecret("API_KEY", []byte("prod"))
+	if _, err := prod.CreateSnapshot("deploy-1", "uid:1000", nil, now); err != nil {
+		t.Fatalf("CreateSnapshot in vault failed: %v", err)
+	}
+	if list, err := store.ListSnapshots(); err != nil || len(list) != 2 || list[0].Name != "deploy-1" {
+		t.Errorf("ListSnapshots = %+v, %v", list, err)
+	}
+	store.DeleteVault("prod")
+	if list, _ := prod.ListSnapshots(); len(list) != 0 {
+		t.Errorf("Snapshots survived their vault: %+v", list)
+	}
+
+	if err := store.DeleteSnapshot("deploy-1"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if err := store.DeleteSnapshot("deploy-1"); err != ErrNotFound {
+		t.Errorf("Deleting a missing snapshot = %v, want ErrNotFound", err)
+	}
+	var left int
+	store.db.QueryRow("SELECT COUNT(*) FROM snapshot_secrets WHERE snapshot = 'deploy-1'").Scan(&left)
+	if left != 0 {
+		t.Errorf("%d values left after deleting the snapshot", left)
+	}
+}
+
+func TestStoreCollectGarbage(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecretBlob("A", "d1", []byte("a"))
+	store.SetSecretBlob("B", "d1", []byte("a"))
+	for range 3 {
+		store.Audit("uid:1000", "secret-set", "A")
+	}
+	now := time.Now().UTC()
+	store.db.Exec("INSERT INTO blobs (digest, value, refcount) VALUES ('orphan', x'00', 1)")
+	store.db.Exec("INSERT INTO token_reads (name, day, reads) VALUES ('ci', '2020-01-01', 5), ('ci', ?, 1)", now.Format(time.DateOnly))
+	store.db.Exec("INSERT INTO search_index (vault, key, digest, entry) VALUES ('', 'A', 'stale', x'00'), ('', 'B', 'd1', x'00')")
+
+	// Only events up to the second may go, however old
+	result, err := store.CollectGarbage(GCOptions{LogsBefore: now.Add(time.Hour), MaxAuditID: 2, Now: now})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if result.AuditEvents != 2 || result.Orphans != 3 {
+		t.Errorf("CollectGarbage = %+v, expected 2 audit events and 3 orphans", result)
+	}
+	if events, _ := store.AuditEvents(""); len(events) != 1 || events[0].ID != 3 {
+		t.Errorf("Audit log after pruning: %+v", events)
+	}
+	var blobs, reads, entries int
+	store.db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	store.db.QueryRow("SELECT COUNT(*) FROM token_reads").Scan(&reads)
+	store.db.QueryRow("SELECT COUNT(*) FROM search_index").Scan(&entries)
+	if blobs != 1 || reads != 1 || entries != 1 {
+		t.Errorf("Left %d blobs, %d read counts and %d index entries, expected 1 of each", blobs, reads, entries)
+	}
+	if value, _ := store.GetSecret("B"); string(value) != "a" {
+		t.Errorf("CollectGarbage lost a shared blob: %q", value)
+	}
+
+	// Without LogsBefore the logs are kept
+	if result, _ := store.CollectGarbage(GCOptions{MaxAuditID: 10, Now: now}); result.AuditEvents != 0 {
+		t.Errorf("CollectGarbage pruned %d events without a retention", result.AuditEvents)
+	}
+	if size, err := store.Size(); err != nil || size <= 0 {
+		t.Errorf("Size = %d, %v", size, err)
+	}
+}
+
+// escrowFunc adapts a function to Escrow
+type escrowFunc func(a Archived) error
+
+func (f escrowFunc) Archive(a Archived) error { return f(a) }
+
+func TestStoreTempSecrets(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	setTemp := func(s *Store, key string, expires time.Time) {
+		t.Helper()
+		tx, _ := s.Begin()
+		defer tx.Rollback()
+		tx.SetSecretBlob(key, "d-"+key, []byte(key))
+		if err := tx.SetTemporary(key, expires); err != nil {
+			t.Fatalf("SetTemporary failed: %v", err)
+		}
+		tx.Commit()
+	}
+	store.CreateVault("demo")
+	setTemp(store, "LATER", now.Add(2*time.Hour))
+	setTemp(store, "SOON", now.Add(time.Minute))
+	setTemp(store, "PAST", now.Add(-time.Minute))
+	setTemp(store.InVault("demo"), "PAST", now.Add(-time.Minute))
+	setTemp(store, "KEPT", now.Add(-time.Minute))
+	store.SetSecret("PERMANENT", []byte("p"))
+
+	// Writing a temporary secret again makes it permanent
+	store.SetSecretBlob("KEPT", "d-kept", []byte("kept"))
+
+	temp, err := store.TempSecrets()
+	if err != nil || len(temp) != 3 || temp[0].Key != "PAST" || temp[2].Key != "LATER" {
+		t.Fatalf("TempSecrets = %v, %v", temp, err)
+	}
+	tx, _ := store.Begin()
+	if _, err := tx.TempExpiry("PERMANENT"); err != ErrNotFound {
+		t.Errorf("TempExpiry(PERMANENT) = %v", err)
+	}
+	if expires, err := tx.TempExpiry("LATER"); err != nil || expires.Unix() != now.Add(2*time.Hour).Unix() {
+		t.Errorf("TempExpiry(LATER) = %v, %v", expires, err)
+	}
+	tx.Rollback()
+
+	if n, err := store.ExpireTempSecrets(now); err != nil || n != 2 {
+		t.Fatalf("ExpireTempSecrets = %d, %v", n, err)
+	}
+	keys, _ := store.ListSecrets()
+	if strings.Join(keys, ",") != "KEPT,LATER,PERMANENT,SOON" {
+		t.Errorf("After expiry: %v", keys)
+	}
+	if n, err := store.DropTempSecrets(); err != nil || n != 2 {
+		t.Fatalf("DropTempSecrets = %d, %v", n, err)
+	}
+	if temp, _ := store.TempSecrets(); len(temp) != 0 {
+		t.Errorf("Temporary secrets left: %v", temp)
+	}
+}
+
+func TestStoreCheckouts(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecret("SHARED_ADMIN", []byte("x"))
+	now := time.Now()
+
+	if _, err := store.CheckOut("MISSING", "uid:1", now.Add(time.Hour), false); err != ErrNotFound {
+		t.Errorf("CheckOut(MISSING) = %v", err)
+	}
+	if _, err := store.CheckOut("SHARED_ADMIN", "uid:1", now.Add(time.Hour), false); err != nil {
+		t.Fatalf("CheckOut failed: %v", err)
+	}
+	// The holder may extend; anyone else is blocked unless forcing
+	if _, err := store.CheckOut("SHARED_ADMIN", "uid:1", now.Add(2*time.Hour), false); err != nil {
+		t.Errorf("Extending failed: %v", err)
+	}
+	if prev, err := store.CheckOut("SHARED_ADMIN", "uid:2", now.Add(time.Hour), false); err != ErrCheckedOut || prev.Holder != "uid:1" {
+		t.Errorf("Concurrent CheckOut = %+v, %v", prev, err)
+	}
+	if _, err := store.CheckIn("SHARED_ADMIN", "uid:2", false); err != ErrCheckedOut {
+		t.Errorf("CheckIn by another holder = %v", err)
+	}
+	if prev, err := store.CheckOut("SHARED_ADMIN", "uid:2", now.Add(-time.Minute), true); err != nil || prev.Holder != "uid:1" {
+		t.Fatalf("Forced CheckOut = %+v, %v", prev, err)
+	}
+
+	// Expired checkouts are reported once, and no longer block
+	if expired, err := store.ExpiredCheckouts(now); err != nil || len(expired) != 1 || expired[0].Holder != "uid:2" {
+		t.Fatalf("ExpiredCheckouts = %v, %v", expired, err)
+	}
+	if expired, _ := store.ExpiredCheckouts(now); len(expired) != 0 {
+		t.Errorf("Expiry reported twice: %v", expired)
+	}
+	if _, err := store.CheckOut("SHARED_ADMIN", "uid:1", now.Add(time.Hour), false); err != nil {
+		t.Errorf("Expired checkout still blocks: %v", err)
+	}
+	if checkouts, _ := store.Checkouts(); len(checkouts) != 1 || checkouts[0].Holder != "uid:1" {
+		t.Errorf("Checkouts = %v", checkouts)
+	}
+	if c, err := store.CheckIn("SHARED_ADMIN", "uid:1", false); err != nil || c.Holder != "uid:1" {
+		t.Errorf("CheckIn = %+v, %v", c, err)
+	}
+	if _, err := store.CheckIn("SHARED_ADMIN", "uid:1", false); err != ErrNotFound {
+		t.Errorf("Second CheckIn = %v", err)
+	}
+
+	// Deleting a secret ends its checkout
+	store.CheckOut("SHARED_ADMIN", "uid:1", now.Add(time.Hour), false)
+	store.DeleteSecret("SHARED_ADMIN")
+	if checkouts, _ := store.Checkouts(); len(checkouts) != 0 {
+		t.Errorf("Checkout outlived its secret: %v", checkouts)
+	}
+}
+
+func TestStoreEscrow(t *testing.T) {
+	store := newTestStore(t)
+	var archived []Archived
+	store.SetEscrow(escrowFunc(func(a Archived) error {
+		archived = append(archived, a)
+		return nil
+	}))
+
+	store.SetSecretBlob("A", "d1", []byte{1})
+	store.SetSecretOwner("A", "uid:1000")
+	store.SetSecret("A", []byte{2})
+	store.SetKindSecret("note", "note/x", []byte{3})
+	tx, _ := store.Begin()
+	tx.DeleteSecret("A")
+	tx.SetKindSecret("note", "note/x", []byte{4})
+	tx.Commit()
+
+	// Creating a secret has nothing to archive
+	if len(archived) != 3 {
+		t.Fatalf("Expected 3 archived values, got %+v", archived)
+	}
+	if a := archived[0]; a.Op != "overwrite" || a.Key != "A" || a.Owner != "uid:1000" || a.Value[0] != 1 || a.Created.IsZero() {
+		t.Errorf("Unexpected archive of a blob secret: %+v", a)
+	}
+	if a := archived[1]; a.Op != "delete" || a.Value[0] != 2 {
+		t.Errorf("Unexpected archive of a delete: %+v", a)
+	}
+	if a := archived[2]; a.Kind != "note" || a.Value[0] != 3 {
+		t.Errorf("Unexpected archive of a kind secret: %+v", a)
+	}
+
+	// A failing escrow aborts the write
+	store.SetEscrow(escrowFunc(func(Archived) error { return errors.New("disk full") }))
+	if err := store.DeleteSecret("note/x"); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Expected the escrow error, got %v", err)
+	}
+	if value, err := store.GetSecret("note/x"); err != nil || value[0] != 4 {
+		t.Errorf("Secret changed despite the escrow failing: %v, %v", value, err)
+	}
+
+	store.SetEscrow(nil)
+	if err := store.DeleteSecret("note/x"); err != nil {
+		t.Errorf("Delete with escrow off failed: %v", err)
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := store.CreateToken(Token{Name: "ci"}, "hash-ci", ""); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if err := store.CreateToken(Token{Name: "ci"}, "hash-other", ""); err == nil {
+		t.Errorf("Expected an error creating a duplicate token name")
+	}
+
+	tok, err := store.LookupToken("hash-ci")
+	if err != nil || tok.Name != "ci" || !tok.ExpiresAt.IsZero() || tok.Subjects != nil {
+		t.Errorf("LookupToken = %+v, %v", tok, err)
+	}
+	if _, err := store.LookupToken("nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown hash, got %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	store.CreateToken(Token{Name: "alice", ExpiresAt: expires, Subjects: []string{"claim:groups=dev", "claim:email=a@x"}}, "hash-alice", "")
+	tok, err = store.LookupToken("hash-alice")
+	if err != nil || tok.ExpiresAt.Unix() != expires.Unix() || len(tok.Subjects) != 2 || tok.Subjects[1] != "claim:email=a@x" {
+		t.Errorf("LookupToken = %+v, %v", tok, err)
+	}
+
+	store.CreateToken(Token{Name: "old", ExpiresAt: time.Now().Add(-time.Minute)}, "hash-old", "")
+	if _, err := store.LookupToken("hash-old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an expired token, got %v", err)
+	}
+	if n, err := store.DeleteExpiredTokens(time.Now()); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredTokens = %d, %v", n, err)
+	}
+
+	tokens, _ := store.ListTokens()
+	if len(tokens) != 2 || tokens[0].Name != "alice" || tokens[1].Name != "ci" {
+		t.Errorf("Unexpected tokens: %+v", tokens)
+	}
+
+	if err := store.RevokeToken("ci"); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	if _, err := store.LookupToken("hash-ci"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a revoked token, got %v", err)
+	}
+	if err := store.RevokeToken("ci"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound revoking a token twice, got %v", err)
+	}
+}
+
+func TestStoreRefreshToken(t *testing.T) {
+	store := newTestStore(t)
+
+	now := time.Now()
+	tok := Token{Name: "deploy", TTL: time.Hour, ExpiresAt: now.Add(-time.Minute), Scopes: []string{"read:APP_*"}}
+	if err := store.CreateToken(tok, "access-1", "refresh-1"); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	refreshed, err := store.RefreshToken("refresh-1", "access-2", "refresh-2", now)
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if refreshed.ExpiresAt.Unix() != now.Add(time.Hour).Unix() || len(refreshed.Scopes) != 1 {
+		t.Errorf("Unexpected refreshed token: %+v", refreshed)
+	}
+	if _, err := store.LookupToken("access-2"); err != nil {
+		t.Errorf("Refreshed token not accepted: %v", err)
+	}
+	if _, err := store.LookupToken("access-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the old access token to be replaced, got %v", err)
+	}
+	if _, err := store.RefreshToken("refresh-1", "a", "r", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected refresh tokens to be single use, got %v", err)
+	}
+
+	store.RevokeToken("deploy")
+	if _, err := store.RefreshToken("refresh-2", "a", "r", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a revoked token not to refresh, got %v", err)
+	}
+}
+
+func TestStorePairing(t *testing.T) {
+	store := newTestStore(t)
+
+	now := time.Now()
+	phone := Pairing{Name: "phone", Scopes: []string{"read:MOBILE_*"}, ExpiresAt: now.Add(time.Minute)}
+	store.CreatePairing(phone, "code-1")
+	// Pairing again replaces the pending code
+	if err := store.CreatePairing(phone, "code-2"); err != nil {
+		t.Fatalf("Failed to create pairing: %v", err)
+	}
+	if pending, _ := store.PairingPending("phone"); !pending {
+		t.Error("Expected the pairing to be pending")
+	}
+	if _, err := store.RedeemPairing("code-1", "access-1", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a replaced code to be refused, got %v", err)
+	}
+	if _, err := store.RedeemPairing("code-2", "access-2", now.Add(time.Minute)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an expired code to be refused, got %v", err)
+	}
+
+	p, err := store.RedeemPairing("code-2", "access-2", now)
+	if err != nil {
+		t.Fatalf("RedeemPairing failed: %v", err)
+	}
+	if p.Name != "phone" || len(p.Scopes) != 1 {
+		t.Errorf("Unexpected pairing: %+v", p)
+	}
+	tok, err := store.LookupToken("access-2")
+	if err != nil || tok.Name != "phone" || !tok.ExpiresAt.IsZero() || len(tok.Scopes) != 1 || tok.Scopes[0] != "read:MOBILE_*" {
+		t.Errorf("Paired token = %+v, %v", tok, err)
+	}
+	if _, err := store.RedeemPairing("code-2", "access-3", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected pairing codes to be single use, got %v", err)
+	}
+	if pending, _ := store.PairingPending("phone"); pending {
+		t.Error("Expected the pairing to be redeemed")
+	}
+}
+
+func TestStoreTokenQuota(t *testing.T) {
+	store := newTestStore(t)
+	tok := Token{Name: "ci", MaxReads: 3, MaxKeys: 2}
+	if err := store.CreateToken(tok, "hash", ""); err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if got, _ := store.LookupToken("hash"); got.MaxReads != 3 || got.MaxKeys != 2 {
+		t.Fatalf("Quotas not stored: %+v", got)
+	}
+	day := time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)
+
+	if usage, err := store.SpendTokenQuota(tok, []string{"A", "A"}, day); err != nil || usage != (TokenUsage{Reads: 2, Keys: 1}) {
+		t.Errorf("Spend = %+v, %v", usage, err)
+	}
+	// A read past a quota counts nothing
+	var quota *QuotaError
+	if _, err := store.SpendTokenQuota(tok, []string{"A", "B"}, day); !errors.As(err, &quota) || quota.Limit != "reads" || !quota.Reset.Equal(day.Add(time.Hour)) {
+		t.Errorf("Spend past reads = %v", err)
+	}
+	if _, err := store.SpendTokenQuota(tok, []string{"B"}, day); err != nil {
+		t.Errorf("Spend within quota = %v", err)
+	}
+	// Reads reset the next day, distinct keys never do
+	next := day.Add(2 * time.Hour)
+	if usage, _ := store.TokenUsage("ci", next); usage != (TokenUsage{Reads: 0, Keys: 2}) {
+		t.Errorf("Usage the next day = %+v", usage)
+	}
+	if _, err := store.SpendTokenQuota(tok, []string{"C"}, next); !errors.As(err, &quota) || quota.Limit != "keys" {
+		t.Errorf("Spend past keys = %v", err)
+	}
+	if usage, _ := store.TokenUsage("ci", next); usage != (TokenUsage{Reads: 0, Keys: 2}) {
+		t.Errorf("Rejected read was counted: %+v", usage)
+	}
+
+	if err := store.SetTokenQuota("ci", 0, 0); err != nil {
+		t.Fatalf("SetTokenQuota failed: %v", err)
+	}
+	if err := store.SetTokenQuota("missing", 1, 1); err != ErrNotFound {
+		t.Errorf("SetTokenQuota(missing) = %v", err)
+	}
+	tok, _ = store.LookupToken("hash")
+	if _, err := store.SpendTokenQuota(tok, []string{"C", "D", "E", "F"}, next); err != nil {
+		t.Errorf("Spend without quotas = %v", err)
+	}
+}
+
+func TestLoadAccessed(t *testing.T) {
+	store := newTestStore(t)
+	store.SetSecret("API_KEY", []byte{1})
+	store.SetSecret("UNREAD", []byte{2})
+	store.CreateVault("team")
+	team := store.InVault("team")
+	team.SetSecret("API_KEY", []byte{3})
+
+	store.RecordAccess("cli", "uid:1000", []string{"API_KEY"})
+	store.RecordAccess("server", "token:ci", []string{"API_KEY"})
+
+	infos, _ := store.ListSecretInfo()
+	if err := store.LoadAccessed(infos); err != nil {
+		t.Fatalf("LoadAccessed failed: %v", err)
+	}
+	if infos[0].Key != "API_KEY" || infos[0].Accessed.IsZero() {
+		t.Errorf("Expected API_KEY to have an access time, got %+v", infos[0])
+	}
+	if !infos[1].Accessed.IsZero() {
+		t.Errorf("Expected UNREAD to have none, got %v", infos[1].Accessed)
+	}
+
+	// Reads are per vault
+	infos, _ = team.ListSecretInfo()
+	team.LoadAccessed(infos)
+	if !infos[0].Accessed.IsZero() {
+		t.Errorf("A read in the default vault counted in team: %v", infos[0].Accessed)
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TempSecret is a temporary secret: it is deleted once it expires and is
+// left out of backups unless they ask for it
+type TempSecret struct {
+	Key     string
+	Expires time.Time
+}
+
+// TempSecrets returns the temporary secrets in s's vault, soonest to
+// expire first
+func (s *Store) TempSecrets() ([]TempSecret, error) {
+	rows, err := s.db.Query(
+		"SELECT key, expires_at FROM temp_secrets WHERE vault = ? ORDER BY expires_at ASC, key ASC",
+		s.vault,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temporary secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var secrets []TempSecret
+	for rows.Next() {
+		var t TempSecret
+		var expires int64
+		if err := rows.Scan(&t.Key, &expires); err != nil {
+			return nil, fmt.Errorf("failed to scan temporary secret: %w", err)
+		}
+		t.Expires = time.Unix(expires, 0)
+		secrets = append(secrets, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating temporary secrets: %w", err)
+	}
+	return secrets, nil
+}
+
+// TempExpiry returns when the secret key expires, or ErrNotFound if it is
+// not temporary
+func (t *Tx) TempExpiry(key string) (time.Time, error) {
+	var expires int64
+	err := t.tx.QueryRow("SELECT expires_at FROM temp_secrets WHERE vault = ? AND key = ?", t.vault, key).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrNotFound
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read temporary secret: %w", err)
+	}
+	return time.Unix(expires, 0), nil
+}
+
+// SetTemporary makes the secret key, just written in the transaction,
+// temporary until expires. Writing it again makes it permanent.
+func (t *Tx) SetTemporary(key string, expires time.Time) error {
+	return setTemporary(t.tx, t.vault, key, expires)
+}
+
+// setTemporary is SetTemporary within tx
+func setTemporary(tx *sql.Tx, vault, key string, expires time.Time) error {
+	_, err := tx.Exec(
+		`INSERT OR REPLACE INTO temp_secrets (vault, key, expires_at)
+		 SELECT vault, key, ? FROM secrets WHERE vault = ? AND key = ?`,
+		expires.Unix(), vault, key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to make '%s' temporary: %w", key, err)
+	}
+	return nil
+}
+
+// ExpireTempSecrets deletes the temporary secrets of every vault that have
+// expired at now, returning how many it deleted. Nothing is archived to
+// escrow: temporary values are meant to disappear.
+func (s *Store) ExpireTempSecrets(now time.Time) (int, error) {
+	return s.deleteTempSecrets("WHERE expires_at <= ?", now.Unix())
+}
+
+// DropTempSecrets deletes every temporary secret of every vault, returning
+// how many it deleted
+func (s *Store) DropTempSecrets() (int, error) {
+	return s.deleteTempSecrets("")
+}
+
+// deleteTempSecrets deletes the temporary secrets selected by where
+func (s *Store) deleteTempSecrets(where string, args ...any) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete temporary secrets: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT vault, key FROM temp_secrets "+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list temporary secrets: %w", err)
+	}
+	type secret struct{ vault, key string }
+	var expired []secret
+	for rows.Next() {
+		var e secret
+		if err := rows.Scan(&e.vault, &e.key); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan temporary secret: %w", err)
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating temporary secrets: %w", err)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	for _, e := range expired {
+		if err := deleteSecret(tx, nil, e.vault, e.key); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete temporary secrets: %w", err)
+	}
+	return len(expired), nil
+}
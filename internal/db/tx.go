@@ -0,0 +1,224 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Tx reads and writes secrets in a single transaction. Nothing it writes
+// is visible to other connections until Commit.
+type Tx struct {
+	tx     *sql.Tx
+	escrow Escrow
+	index  Indexer
+	vault  string
+}
+
+// Begin starts a transaction in s's vault
+func (s *Store) Begin() (*Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return &Tx{tx: tx, escrow: s.escrow, index: s.index, vault: s.vault}, nil
+}
+
+// InVault returns t scoped to the vault called name, "" being the default
+// vault. Both write in the same transaction.
+func (t *Tx) InVault(name string) *Tx {
+	scoped := *t
+	scoped.vault = name
+	return &scoped
+}
+
+// AddVault adds an empty vault called name unless it exists
+func (t *Tx) AddVault(name string) error {
+	if err := ValidateVault(name); err != nil {
+		return err
+	}
+	if _, err := t.tx.Exec("INSERT OR IGNORE INTO vaults (name) VALUES (?)", name); err != nil {
+		return fmt.Errorf("failed to create vault: %w", err)
+	}
+	return nil
+}
+
+// Commit applies the transaction's writes
+func (t *Tx) Commit() error {
+	if err := t.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Rollback discards the transaction's writes. It is a no-op after Commit.
+func (t *Tx) Rollback() error {
+	if err := t.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return fmt.Errorf("failed to roll back transaction: %w", err)
+	}
+	return nil
+}
+
+// SetSecretBlob is Store.SetSecretBlob within the transaction
+func (t *Tx) SetSecretBlob(key string, digest string, encryptedValue []byte) error {
+	if err := setSecretBlob(t.tx, t.escrow, t.vault, key, digest, encryptedValue); err != nil {
+		return err
+	}
+	return indexSecret(t.tx, t.index, t.vault, key, digest, encryptedValue)
+}
+
+// SetKindSecret is Store.SetKindSecret within the transaction
+func (t *Tx) SetKindSecret(kind, key string, encryptedValue []byte) error {
+	return setKindSecret(t.tx, t.escrow, t.vault, kind, key, encryptedValue)
+}
+
+// GetSecret is Store.GetSecret within the transaction
+func (t *Tx) GetSecret(key string) ([]byte, error) {
+	return getSecret(t.tx, t.vault, key)
+}
+
+// DeleteSecret is Store.DeleteSecret within the transaction
+func (t *Tx) DeleteSecret(key string) error {
+	return deleteSecret(t.tx, t.escrow, t.vault, key)
+}
+
+// ListSecrets is Store.ListSecrets within the transaction
+func (t *Tx) ListSecrets() ([]string, error) {
+	return listKindSecrets(t.tx, t.vault, "")
+}
+
+// SecretOwner is Store.SecretOwner within the transaction
+func (t *Tx) SecretOwner(key string) (string, error) {
+	return secretOwner(t.tx, t.vault, key)
+}
+
+// SetSecretOwner is Store.SetSecretOwner within the transaction
+func (t *Tx) SetSecretOwner(key, owner string) error {
+	return setSecretOwner(t.tx, t.vault, key, owner)
+}
+
+// DeleteConfig is Store.DeleteConfig within the transaction
+func (t *Tx) DeleteConfig(key string) error {
+	return deleteConfig(t.tx, key)
+}
+
+// SetConfig is Store.SetConfig within the transaction
+func (t *Tx) SetConfig(key string, value []byte) error {
+	return setConfig(t.tx, key, value)
+}
+
+// Reencrypt replaces the ciphertext of every secret, of every kind and in
+// every vault, and of every snapshotted value, with what fn returns for it.
+// For blob-backed values blob is set and fn also returns the value's new
+// digest; blobs shared before stay shared. Owners and timestamps are kept,
+// versions are bumped and nothing is escrowed, as no value changes. It
+// returns the number of secrets re-encrypted.
+func (t *Tx) Reencrypt(fn func(ciphertext []byte, blob bool) ([]byte, string, error)) (int, error) {
+	type row struct {
+		vault  string
+		key    string
+		value  []byte
+		digest sql.NullString
+	}
+	rows, err := t.tx.Query(
+		`SELECT s.vault, s.key, COALESCE(b.value, s.value), s.digest
+		 FROM secrets s LEFT JOIN blobs b ON b.digest = s.digest`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	var secrets []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.vault, &r.key, &r.value, &r.digest); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read secret: %w", err)
+		}
+		secrets = append(secrets, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	type blob struct {
+		digest string
+		value  []byte
+		refs   int
+	}
+	blobs := map[string]*blob{}
+	for _, r := range secrets {
+		if !r.digest.Valid {
+			value, _, err := fn(r.value, false)
+			if err != nil {
+				return 0, fmt.Errorf("failed to re-encrypt '%s': %w", r.key, err)
+			}
+			if _, err := t.tx.Exec("UPDATE secrets SET value = ? WHERE vault = ? AND key = ?", value, r.vault, r.key); err != nil {
+				return 0, fmt.Errorf("failed to update '%s': %w", r.key, err)
+			}
+			continue
+		}
+		b, ok := blobs[r.digest.String]
+		if !ok {
+			value, digest, err := fn(r.value, true)
+			if err != nil {
+				return 0, fmt.Errorf("failed to re-encrypt '%s': %w", r.key, err)
+			}
+			b = &blob{digest: digest, value: value}
+			blobs[r.digest.String] = b
+		}
+		b.refs++
+		if _, err := t.tx.Exec("UPDATE secrets SET digest = ? WHERE vault = ? AND key = ?", b.digest, r.vault, r.key); err != nil {
+			return 0, fmt.Errorf("failed to update '%s': %w", r.key, err)
+		}
+	}
+
+	if _, err := t.tx.Exec("DELETE FROM blobs"); err != nil {
+		return 0, fmt.Errorf("failed to replace blobs: %w", err)
+	}
+	for _, b := range blobs {
+		if _, err := t.tx.Exec("INSERT INTO blobs (digest, value, refcount) VALUES (?, ?, ?)", b.digest, b.value, b.refs); err != nil {
+			return 0, fmt.Errorf("failed to store blob: %w", err)
+		}
+	}
+	if err := t.reencryptSnapshots(fn); err != nil {
+		return 0, err
+	}
+	return len(secrets), nil
+}
+
+// reencryptSnapshots replaces the ciphertext of every snapshotted value
+// with what fn returns for it
+func (t *Tx) reencryptSnapshots(fn func(ciphertext []byte, blob bool) ([]byte, string, error)) error {
+	type row struct {
+		id    int64
+		key   string
+		value []byte
+	}
+	rows, err := t.tx.Query("SELECT rowid, key, value FROM snapshot_secrets")
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var values []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.key, &r.value); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		values = append(values, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, r := range values {
+		value, _, err := fn(r.value, false)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt snapshot of '%s': %w", r.key, err)
+		}
+		if _, err := t.tx.Exec("UPDATE snapshot_secrets SET value = ? WHERE rowid = ?", value, r.id); err != nil {
+			return fmt.Errorf("failed to update snapshot of '%s': %w", r.key, err)
+		}
+	}
+	return nil
+}
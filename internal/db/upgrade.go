@@ -0,0 +1,150 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Status describes the on-disk format of a store
+type Status struct {
+	// Version is the number of migrations applied, Latest the number this
+	// build knows
+	Version int
+	Latest  int
+	// Inline counts secrets whose values are stored in the secrets table,
+	// as the first release wrote them, instead of as shared blobs
+	Inline int
+}
+
+// Current reports whether the store needs no upgrade
+func (st Status) Current() bool {
+	return st.Version >= st.Latest && st.Inline == 0
+}
+
+// Inspect reads the format of the store at path without migrating or
+// otherwise changing it
+func Inspect(path string) (Status, error) {
+	st := Status{Latest: len(migrations)}
+	if _, err := os.Stat(path); err != nil {
+		return st, fmt.Errorf("no store at %s: %w", path, err)
+	}
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return st, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&st.Version); err != nil {
+		return st, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	// Columns added by migrations may not exist yet
+	var hasDigest, hasKind bool
+	err = conn.QueryRow(
+		`SELECT COALESCE(SUM(name = 'digest'), 0), COALESCE(SUM(name = 'kind'), 0)
+		 FROM pragma_table_info('secrets')`,
+	).Scan(&hasDigest, &hasKind)
+	if err != nil {
+		return st, fmt.Errorf("failed to read schema: %w", err)
+	}
+	query := "SELECT COUNT(*) FROM secrets WHERE 1"
+	if hasDigest {
+		query += " AND digest IS NULL"
+	}
+	if hasKind {
+		query += " AND kind = ''"
+	}
+	if err := conn.QueryRow(query).Scan(&st.Inline); err != nil {
+		return st, fmt.Errorf("failed to count secrets: %w", err)
+	}
+	return st, nil
+}
+
+// Backup writes a consistent copy of the store at path to dest, which must
+// not exist, without migrating it
+func Backup(path, dest string) error {
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("backup %s already exists", dest)
+	}
+	if _, err := conn.Exec("VACUUM INTO ?", dest); err != nil {
+		return fmt.Errorf("failed to back up store: %w", err)
+	}
+	return os.Chmod(dest, 0600)
+}
+
+// InlineSecrets returns the keys of secrets, excluding secrets of other
+// kinds, whose values are stored inline rather than as shared blobs
+func (s *Store) InlineSecrets() ([]string, error) {
+	rows, err := s.db.Query("SELECT key FROM secrets WHERE vault = ? AND digest IS NULL AND kind = '' ORDER BY key ASC", s.vault)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan secret key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+
+	return keys, nil
+}
+
+// MoveToBlob moves the inline value of key into the shared blob for digest,
+// the digest of its plaintext. The value and its timestamps are unchanged,
+// so nothing is archived to escrow.
+func (s *Store) MoveToBlob(key, digest string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to move secret: %w", err)
+	}
+	defer tx.Rollback()
+
+	var value []byte
+	err = tx.QueryRow("SELECT value FROM secrets WHERE vault = ? AND key = ? AND digest IS NULL AND kind = ''", s.vault, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to move secret: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO blobs (digest, value, refcount) VALUES (?, ?, 1)
+		 ON CONFLICT(digest) DO UPDATE SET refcount = refcount + 1`,
+		digest, value,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE secrets SET value = x'', digest = ? WHERE vault = ? AND key = ?", digest, s.vault, key); err != nil {
+		return fmt.Errorf("failed to move secret: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to move secret: %w", err)
+	}
+	return nil
+}
+
+// Reindex rebuilds every index in the store
+func (s *Store) Reindex() error {
+	if _, err := s.db.Exec("REINDEX"); err != nil {
+		return fmt.Errorf("failed to rebuild indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/fixtures"
+)
+
+func TestInspectAndUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lockbox.db")
+	if err := fixtures.Load("../fixtures/testdata/store-v0.sql", path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	st, err := Inspect(path)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if st.Version != 0 || st.Latest != len(migrations) || st.Inline != 6 || st.Current() {
+		t.Errorf("Unexpected status of a first release store: %+v", st)
+	}
+	// Inspect leaves the store alone
+	if again, _ := Inspect(path); again != st {
+		t.Errorf("Inspect changed the store: %+v", again)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := Backup(path, backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := Backup(path, backup); err == nil {
+		t.Errorf("Expected Backup to refuse an existing file")
+	}
+	if st, _ := Inspect(backup); st.Version != 0 || st.Inline != 6 {
+		t.Errorf("Backup is not an unmigrated copy: %+v", st)
+	}
+
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	_, updated, _ := store.SecretTimes("API_KEY")
+	before, _ := store.GetSecret("API_KEY")
+
+	inline, _ := store.InlineSecrets()
+	if len(inline) != 6 {
+		t.Fatalf("Expected 6 inline secrets after migrating, got %v", inline)
+	}
+	for _, k := range inline {
+		if err := store.MoveToBlob(k, "digest-"+k); err != nil {
+			t.Fatalf("MoveToBlob(%s) failed: %v", k, err)
+		}
+	}
+	if err := store.MoveToBlob("API_KEY", "again"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound moving a blob secret, got %v", err)
+	}
+	if err := store.Reindex(); err != nil {
+		t.Errorf("Reindex failed: %v", err)
+	}
+
+	after, _ := store.GetSecret("API_KEY")
+	if string(after) != string(before) {
+		t.Errorf("MoveToBlob changed the value")
+	}
+	if _, u, _ := store.SecretTimes("API_KEY"); !u.Equal(updated) {
+		t.Errorf("MoveToBlob changed the update time from %v to %v", updated, u)
+	}
+	if st, _ := Inspect(path); !st.Current() {
+		t.Errorf("Expected the store to be current, got %+v", st)
+	}
+}
+
+func TestOpenExisting(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.db")
+	if _, err := OpenExisting(missing); err == nil {
+		t.Error("OpenExisting opened a missing store")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("OpenExisting created %s", missing)
+	}
+
+	old := filepath.Join(dir, "old.db")
+	if err := fixtures.Load("../fixtures/testdata/store-v0.sql", old); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := OpenExisting(old); err != ErrNotCurrent {
+		t.Errorf("OpenExisting of a first release store = %v, want ErrNotCurrent", err)
+	}
+	if st, _ := Inspect(old); st.Version != 0 {
+		t.Errorf("OpenExisting migrated the store to version %d", st.Version)
+	}
+
+	current := filepath.Join(dir, "current.db")
+	store, err := OpenStore(current)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	store.SetSecret("API_KEY", []byte("x"))
+	store.Close()
+	store, err = OpenExisting(current)
+	if err != nil {
+		t.Fatalf("OpenExisting of a current store failed: %v", err)
+	}
+	defer store.Close()
+	if value, err := store.GetSecret("API_KEY"); err != nil || string(value) != "x" {
+		t.Errorf("GetSecret = %q, %v", value, err)
+	}
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultVault is how the default vault, stored as "", is named to users
+const DefaultVault = "default"
+
+// Vault is a named, isolated set of secrets in a store
+type Vault struct {
+	Name    string
+	Created time.Time
+	// Secrets counts the vault's secrets, excluding secrets of other kinds
+	Secrets int
+}
+
+// ValidateVault checks that name can be used for a new vault
+func ValidateVault(name string) error {
+	if name == "" || len(name) > 64 || strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		return fmt.Errorf("invalid vault '%s': use up to 64 letters, digits, dashes and underscores", name)
+	}
+	if name == DefaultVault {
+		return fmt.Errorf("'%s' is the vault every store has", name)
+	}
+	return nil
+}
+
+// InVault returns s scoped to the vault called name, "" being the default
+// vault. It shares s's connection, so only one of them is closed.
+func (s *Store) InVault(name string) *Store {
+	scoped := *s
+	scoped.vault = name
+	return &scoped
+}
+
+// Vault returns the name of s's vault, "" for the default vault
+func (s *Store) Vault() string {
+	return s.vault
+}
+
+// Qualify names key across vaults: VAULT/KEY, or just key in the default
+// vault. Policies and the access log use qualified names.
+func (s *Store) Qualify(key string) string {
+	if s.vault == "" {
+		return key
+	}
+	return s.vault + "/" + key
+}
+
+// CreateVault adds an empty vault called name
+func (s *Store) CreateVault(name string) error {
+	if err := ValidateVault(name); err != nil {
+		return err
+	}
+	result, err := s.db.Exec("INSERT OR IGNORE INTO vaults (name) VALUES (?)", name)
+	if err != nil {
+		return fmt.Errorf("failed to create vault: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("vault '%s' already exists", name)
+	}
+	return nil
+}
+
+// HasVault reports whether a vault called name exists. The default vault
+// always does.
+func (s *Store) HasVault(name string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM vaults WHERE name = ?", name).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to look up vault: %w", err)
+	}
+	return n > 0, nil
+}
+
+// ListVaults returns the named vaults, sorted by name
+func (s *Store) ListVaults() ([]Vault, error) {
+	rows, err := s.db.Query(
+		`SELECT v.name, v.created_at, COUNT(s.key) FROM vaults v
+		 LEFT JOIN secrets s ON s.vault = v.name AND s.kind = ''
+		 GROUP BY v.name ORDER BY v.name ASC`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vaults: %w", err)
+	}
+	defer rows.Close()
+
+	var vaults []Vault
+	for rows.Next() {
+		var v Vault
+		if err := rows.Scan(&v.Name, &v.Created, &v.Secrets); err != nil {
+			return nil, fmt.Errorf("failed to scan vault: %w", err)
+		}
+		vaults = append(vaults, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating vaults: %w", err)
+	}
+	return vaults, nil
+}
+
+// DeleteVault removes the vault called name and every secret in it, each
+// archived to escrow first if escrow is on. It returns the number of
+// secrets deleted.
+func (s *Store) DeleteVault(name string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete vault: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM vaults WHERE name = ?", name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete vault: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return 0, ErrNotFound
+	}
+
+	keys, err := listVaultSecrets(tx, name)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := deleteSecret(tx, s.escrow, name, key); err != nil {
+			return 0, err
+		}
+	}
+	if err := deleteSnapshots(tx, name, ""); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete vault: %w", err)
+	}
+	return len(keys), nil
+}
+
+// listVaultSecrets returns the keys of every secret in vault, of every kind
+func listVaultSecrets(tx *sql.Tx, vault string) ([]string, error) {
+	rows, err := tx.Query("SELECT key FROM secrets WHERE vault = ? ORDER BY key ASC", vault)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan secret key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating secrets: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,255 @@
+// Package device enrolls the machines sharing a store. Each device has an
+// X25519 key pair of its own, the private half never leaving it. Once an
+// admin approves a device the store key is sealed to its public key, so
+// the device opens its copy of the store without the key backend of the
+// machine that created it. Revoking a device drops its sealed copy; the
+// caller then rotates the store key so nothing written afterwards can be
+// read with what the device already holds.
+package device
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// configPrefix starts the config entry of every device
+const configPrefix = "device/"
+
+// sealInfo binds sealed store keys to this format
+const sealInfo = "lockbox device v1"
+
+// Statuses
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Revoked  = "revoked"
+)
+
+// ErrNotEnrolled means this machine has no device key, or one the store
+// does not know
+var ErrNotEnrolled = errors.New("this machine is not an enrolled device")
+
+// Device is an enrolled machine
+type Device struct {
+	Name       string    `json:"name"`
+	PublicKey  []byte    `json:"public_key"`
+	Status     string    `json:"status"`
+	EnrolledBy string    `json:"enrolled_by"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	ApprovedAt time.Time `json:"approved_at,omitzero"`
+	RevokedAt  time.Time `json:"revoked_at,omitzero"`
+	LastSeen   time.Time `json:"last_seen,omitzero"`
+	// Ephemeral and SealedKey are the store key sealed to PublicKey, set
+	// while the device is approved
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	SealedKey []byte `json:"sealed_key,omitempty"`
+}
+
+// Fingerprint identifies the device's public key
+func (d Device) Fingerprint() string {
+	return bundle.Fingerprint(d.PublicKey)
+}
+
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidateName checks that name can be used for a device
+func ValidateName(name string) error {
+	if !deviceName.MatchString(name) {
+		return fmt.Errorf("invalid device name '%s': use up to 64 letters, digits, '.', '-' and '_'", name)
+	}
+	return nil
+}
+
+// KeyPath returns where this machine keeps its device key for the store
+// at storePath: $LOCKBOX_DEVICE_KEY, or else next to the store
+func KeyPath(storePath string) string {
+	if path := os.Getenv("LOCKBOX_DEVICE_KEY"); path != "" {
+		return path
+	}
+	return storePath + ".device"
+}
+
+// Get returns the device called name
+func Get(store *db.Store, name string) (Device, error) {
+	var d Device
+	data, err := store.GetConfig(configPrefix + name)
+	if errors.Is(err, db.ErrNotFound) {
+		return d, fmt.Errorf("no device '%s'", name)
+	} else if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return d, fmt.Errorf("corrupt device '%s': %w", name, err)
+	}
+	return d, nil
+}
+
+// List returns every device, sorted by name
+func List(store *db.Store) ([]Device, error) {
+	config, err := store.ListConfig()
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	for name, data := range config {
+		if !strings.HasPrefix(name, configPrefix) {
+			continue
+		}
+		var d Device
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("corrupt device '%s': %w", strings.TrimPrefix(name, configPrefix), err)
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// put writes d
+func put(store *db.Store, d Device) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return store.SetConfig(configPrefix+d.Name, data)
+}
+
+// Enroll registers a device called name with public key pub, pending
+// approval. A revoked device's name can be enrolled again with a new key.
+func Enroll(store *db.Store, name string, pub *ecdh.PublicKey, actor string, now time.Time) (Device, error) {
+	if err := ValidateName(name); err != nil {
+		return Device{}, err
+	}
+	if d, err := Get(store, name); err == nil && d.Status != Revoked {
+		return Device{}, fmt.Errorf("device '%s' is already enrolled", name)
+	}
+	if d, err := Find(store, pub); err == nil {
+		return Device{}, fmt.Errorf("this key is already enrolled as device '%s'", d.Name)
+	}
+	d := Device{Name: name, PublicKey: pub.Bytes(), Status: Pending, EnrolledBy: actor, EnrolledAt: now.UTC()}
+	return d, put(store, d)
+}
+
+// Approve seals key, the store key, to the pending device called name
+func Approve(store *db.Store, name string, key []byte, actor string, now time.Time) (Device, error) {
+	d, err := Get(store, name)
+	if err != nil {
+		return d, err
+	}
+	if d.Status != Pending {
+		return d, fmt.Errorf("device '%s' is %s, not pending", name, d.Status)
+	}
+	if err := d.seal(key); err != nil {
+		return d, err
+	}
+	d.Status, d.ApprovedBy, d.ApprovedAt = Approved, actor, now.UTC()
+	return d, put(store, d)
+}
+
+// seal seals key to d
+func (d *Device) seal(key []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(d.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid key for device '%s': %w", d.Name, err)
+	}
+	d.Ephemeral, d.SealedKey, err = crypto.Seal(key, pub, sealInfo)
+	return err
+}
+
+// Revoke marks the device called name revoked and drops its copy of the
+// store key. Revoking a revoked device is not an error, so a key rotation
+// that failed after revoking can be retried.
+func Revoke(store *db.Store, name string, now time.Time) (Device, error) {
+	d, err := Get(store, name)
+	if err != nil || d.Status == Revoked {
+		return d, err
+	}
+	d.Status, d.RevokedAt = Revoked, now.UTC()
+	d.Ephemeral, d.SealedKey = nil, nil
+	return d, put(store, d)
+}
+
+// Reseal returns the config entry of every approved device with newKey
+// sealed to it, for the caller to write along with the rest of a key
+// rotation
+func Reseal(store *db.Store, newKey []byte) (map[string][]byte, error) {
+	devices, err := List(store)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string][]byte{}
+	for _, d := range devices {
+		if d.Status != Approved {
+			continue
+		}
+		if err := d.seal(newKey); err != nil {
+			return nil, err
+		}
+		if entries[configPrefix+d.Name], err = json.Marshal(d); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Unlock returns the store key sealed to this machine's device key at
+// keyPath, recording the device as seen at now. It returns ErrNotEnrolled
+// if there is no key or the store does not know it.
+func Unlock(store *db.Store, keyPath string, now time.Time) ([]byte, Device, error) {
+	data, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Device{}, ErrNotEnrolled
+	} else if err != nil {
+		return nil, Device{}, fmt.Errorf("failed to read device key: %w", err)
+	}
+	priv, err := bundle.ParsePrivateKey(data)
+	if err != nil {
+		return nil, Device{}, fmt.Errorf("failed to read device key %s: %w", keyPath, err)
+	}
+	d, err := Find(store, priv.PublicKey())
+	if err != nil {
+		return nil, d, err
+	}
+
+	switch d.Status {
+	case Pending:
+		return nil, d, fmt.Errorf("device '%s' is waiting for approval: ask an admin to run 'lockbox device approve %s'", d.Name, d.Name)
+	case Revoked:
+		return nil, d, fmt.Errorf("device '%s' has been revoked", d.Name)
+	}
+	key, err := crypto.Unseal(d.Ephemeral, d.SealedKey, priv, sealInfo)
+	if err != nil {
+		return nil, d, fmt.Errorf("failed to unseal the store key for device '%s': %w", d.Name, err)
+	}
+	// A read-only store keeps working without the last-seen time
+	d.LastSeen = now.UTC()
+	put(store, d)
+	return key, d, nil
+}
+
+// Find returns the device enrolled with pub, ErrNotEnrolled if none
+func Find(store *db.Store, pub *ecdh.PublicKey) (Device, error) {
+	devices, err := List(store)
+	if err != nil {
+		return Device{}, err
+	}
+	for _, d := range devices {
+		if bytes.Equal(d.PublicKey, pub.Bytes()) {
+			return d, nil
+		}
+	}
+	return Device{}, ErrNotEnrolled
+}
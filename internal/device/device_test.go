@@ -0,0 +1,106 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	store, err := db.OpenStore(filepath.Join(dir, "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	storeKey, _ := crypto.GenerateKey()
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	priv, _ := bundle.GenerateKey()
+	pem, _ := bundle.MarshalPrivateKey(priv)
+	keyPath := filepath.Join(dir, "laptop.device")
+	os.WriteFile(keyPath, pem, 0600)
+
+	if _, _, err := Unlock(store, keyPath, now); !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("Unlock before enrolling = %v, want ErrNotEnrolled", err)
+	}
+	if _, err := Enroll(store, "bad name", priv.PublicKey(), "uid:1000", now); err == nil {
+		t.Error("Enroll accepted an invalid name")
+	}
+	d, err := Enroll(store, "laptop", priv.PublicKey(), "uid:1000", now)
+	if err != nil || d.Status != Pending || !strings.HasPrefix(d.Fingerprint(), "SHA256:") {
+		t.Fatalf("Enroll = %+v, %v", d, err)
+	}
+	if _, err := Enroll(store, "laptop", priv.PublicKey(), "uid:1000", now); err == nil {
+		t.Error("Enroll accepted a name already enrolled")
+	}
+	if _, _, err := Unlock(store, keyPath, now); err == nil || !strings.Contains(err.Error(), "waiting for approval") {
+		t.Errorf("Unlock of a pending device = %v", err)
+	}
+
+	if _, err := Approve(store, "phone", storeKey, "uid:0", now); err == nil {
+		t.Error("Approve accepted an unknown device")
+	}
+	if d, err = Approve(store, "laptop", storeKey, "uid:0", now); err != nil || d.Status != Approved || d.ApprovedBy != "uid:0" {
+		t.Fatalf("Approve = %+v, %v", d, err)
+	}
+	if config, _ := store.ListConfig(); bytes.Contains(config["device/laptop"], storeKey) {
+		t.Error("Approve stored the store key in the clear")
+	}
+	later := now.Add(time.Hour)
+	key, d, err := Unlock(store, keyPath, later)
+	if err != nil || !bytes.Equal(key, storeKey) {
+		t.Fatalf("Unlock = %x, %v", key, err)
+	}
+	if d, _ = Get(store, "laptop"); !d.LastSeen.Equal(later) {
+		t.Errorf("Expected last seen %v, got %v", later, d.LastSeen)
+	}
+
+	// Rotation reseals the new key to approved devices only
+	other, _ := bundle.GenerateKey()
+	Enroll(store, "phone", other.PublicKey(), "uid:1000", now)
+	newKey, _ := crypto.GenerateKey()
+	entries, err := Reseal(store, newKey)
+	if err != nil || len(entries) != 1 || entries["device/laptop"] == nil {
+		t.Fatalf("Reseal = %v, %v", entries, err)
+	}
+	for name, data := range entries {
+		store.SetConfig(name, data)
+	}
+	if key, _, err := Unlock(store, keyPath, later); err != nil || !bytes.Equal(key, newKey) {
+		t.Errorf("Unlock after Reseal = %x, %v", key, err)
+	}
+
+	if d, err = Revoke(store, "laptop", later); err != nil || d.Status != Revoked || d.SealedKey != nil {
+		t.Fatalf("Revoke = %+v, %v", d, err)
+	}
+	if _, err := Revoke(store, "laptop", later); err != nil {
+		t.Errorf("Revoking again = %v", err)
+	}
+	if _, _, err := Unlock(store, keyPath, later); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Unlock of a revoked device = %v", err)
+	}
+	if entries, _ := Reseal(store, newKey); len(entries) != 0 {
+		t.Errorf("Reseal included a revoked device: %v", entries)
+	}
+
+	// The name is free again once revoked
+	if _, err := Enroll(store, "laptop", other.PublicKey(), "uid:1000", later); err == nil {
+		t.Error("Enroll accepted a key already enrolled as another device")
+	}
+	fresh, _ := bundle.GenerateKey()
+	if _, err := Enroll(store, "laptop", fresh.PublicKey(), "uid:1000", later); err != nil {
+		t.Errorf("Re-enrolling a revoked device failed: %v", err)
+	}
+	if devices, _ := List(store); len(devices) != 2 || devices[0].Name != "laptop" || devices[1].Name != "phone" {
+		t.Errorf("List = %+v", devices)
+	}
+}
@@ -0,0 +1,293 @@
+// Package digest builds a periodic summary of a store for its admins, of
+// secrets and tokens that need attention and of audited activity, and
+// emails it over SMTP. Digests name keys but never contain values.
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/report"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+// ConfigKey is the config entry holding the SMTP settings
+const ConfigKey = "digest"
+
+// DefaultEvery is how often digests are sent unless configured otherwise
+const DefaultEvery = 7 * 24 * time.Hour
+
+// ErrNotConfigured is returned when no digest has been configured
+var ErrNotConfigured = errors.New("digests are not configured; run 'lockbox digest config' first")
+
+// Config is where and how often digests are sent. The SMTP credentials are
+// secrets in the store, named by UsernameKey and PasswordKey.
+type Config struct {
+	// Server is the SMTP server as host:port
+	Server      string        `json:"server"`
+	From        string        `json:"from"`
+	To          []string      `json:"to"`
+	UsernameKey string        `json:"username_key,omitempty"`
+	PasswordKey string        `json:"password_key,omitempty"`
+	Every       time.Duration `json:"every"`
+	LastSent    time.Time     `json:"last_sent,omitzero"`
+}
+
+// LoadConfig returns the stored config
+func LoadConfig(store *db.Store) (Config, error) {
+	var c Config
+	data, err := store.GetConfig(ConfigKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return c, ErrNotConfigured
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("corrupt digest config: %w", err)
+	}
+	return c, nil
+}
+
+// SaveConfig stores c
+func SaveConfig(store *db.Store, c Config) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return store.SetConfig(ConfigKey, data)
+}
+
+// Digest summarises a store over a period ending at Generated
+type Digest struct {
+	Since     time.Time
+	Generated time.Time
+	// ExpiringTokens are API tokens expiring within the next period
+	ExpiringTokens []db.Token
+	// DueRotations are rotation rules due within the next period
+	DueRotations []rotation.Rule
+	// StaleSecrets are secrets unchanged for report.StaleDays that no
+	// rotation rule covers
+	StaleSecrets []db.SecretInfo
+	// FailedAuth counts rejected credentials in the period
+	FailedAuth int
+	// Notable are audited events in the period that need a look, such as
+	// failed rotations
+	Notable []db.AuditEvent
+	// Activity counts audited events in the period by action
+	Activity map[string]int
+}
+
+// notable are the audit actions listed individually in a digest
+var notable = map[string]bool{"rotate-failed": true, "promote-requested": true}
+
+// Build summarises store for the period of length every ending at now
+func Build(store *db.Store, now time.Time, every time.Duration) (Digest, error) {
+	d := Digest{Since: now.Add(-every), Generated: now, Activity: map[string]int{}}
+
+	tokens, err := store.ListTokens()
+	if err != nil {
+		return d, err
+	}
+	for _, t := range tokens {
+		if t.RevokedAt.IsZero() && !t.Refreshable && !t.ExpiresAt.IsZero() && t.ExpiresAt.After(now) && t.ExpiresAt.Before(now.Add(every)) {
+			d.ExpiringTokens = append(d.ExpiringTokens, t)
+		}
+	}
+
+	rules, err := rotation.List(store)
+	if err != nil {
+		return d, err
+	}
+	rotated := map[string]bool{}
+	for _, r := range rules {
+		rotated[r.Key], rotated[r.SecretKey] = true, true
+		if r.Next().Before(now.Add(every)) {
+			d.DueRotations = append(d.DueRotations, r)
+		}
+	}
+
+	infos, err := store.ListSecretInfo()
+	if err != nil {
+		return d, err
+	}
+	for _, info := range infos {
+		if !rotated[info.Key] && report.AgeDays(info.Updated, now) >= report.StaleDays {
+			d.StaleSecrets = append(d.StaleSecrets, info)
+		}
+	}
+
+	events, err := store.AuditEvents("")
+	if err != nil {
+		return d, err
+	}
+	for _, e := range events {
+		if e.At.Before(d.Since) || e.At.After(now) {
+			continue
+		}
+		d.Activity[e.Action]++
+		switch {
+		case e.Action == "auth-failed":
+			d.FailedAuth++
+		case notable[e.Action]:
+			d.Notable = append(d.Notable, e)
+		}
+	}
+	return d, nil
+}
+
+// Empty reports whether nothing in d needs attention
+func (d Digest) Empty() bool {
+	return len(d.ExpiringTokens) == 0 && len(d.DueRotations) == 0 && len(d.StaleSecrets) == 0 && d.FailedAuth == 0 && len(d.Notable) == 0
+}
+
+// Text renders d as a plain text message body
+func (d Digest) Text() string {
+	var b strings.Builder
+	day := func(t time.Time) string { return t.UTC().Format(time.DateOnly) }
+	fmt.Fprintf(&b, "Lockbox digest for %s to %s\n", day(d.Since), day(d.Generated))
+	if d.Empty() {
+		b.WriteString("\nNothing needs attention.\n")
+	}
+
+	if len(d.ExpiringTokens) > 0 {
+		b.WriteString("\nTokens expiring soon:\n")
+		for _, t := range d.ExpiringTokens {
+			fmt.Fprintf(&b, "  %s  expires %s\n", t.Name, day(t.ExpiresAt))
+		}
+	}
+	if len(d.DueRotations) > 0 {
+		b.WriteString("\nRotations due:\n")
+		for _, r := range d.DueRotations {
+			fmt.Fprintf(&b, "  %s  due %s\n", r.Key, day(r.Next()))
+		}
+	}
+	if len(d.StaleSecrets) > 0 {
+		fmt.Fprintf(&b, "\nSecrets unchanged for %d days or more, with no rotation rule:\n", report.StaleDays)
+		for _, info := range d.StaleSecrets {
+			fmt.Fprintf(&b, "  %s  %d days\n", info.Key, report.AgeDays(info.Updated, d.Generated))
+		}
+	}
+	if d.FailedAuth > 0 {
+		fmt.Fprintf(&b, "\nFailed authentication attempts: %d\n", d.FailedAuth)
+	}
+	if len(d.Notable) > 0 {
+		b.WriteString("\nNeeds a look:\n")
+		for _, e := range d.Notable {
+			fmt.Fprintf(&b, "  %s  %s  %s\n", e.At.UTC().Format(time.DateTime), e.Action, e.Detail)
+		}
+	}
+	if len(d.Activity) > 0 {
+		b.WriteString("\nAudited activity:\n")
+		actions := make([]string, 0, len(d.Activity))
+		for action := range d.Activity {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		for _, action := range actions {
+			fmt.Fprintf(&b, "  %-18s %d\n", action, d.Activity[action])
+		}
+	}
+	return b.String()
+}
+
+// sendMail is smtp.SendMail, replaced in tests
+var sendMail = smtp.SendMail
+
+// Send emails d as configured by c, with SMTP credentials decrypted from
+// store
+func Send(store *db.Store, encKey []byte, c Config, d Digest) error {
+	var auth smtp.Auth
+	if c.UsernameKey != "" {
+		username, err := secret(store, encKey, c.UsernameKey)
+		if err != nil {
+			return err
+		}
+		password, err := secret(store, encKey, c.PasswordKey)
+		if err != nil {
+			return err
+		}
+		host, _, err := net.SplitHostPort(c.Server)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server '%s': %w", c.Server, err)
+		}
+		// PlainAuth refuses to send credentials unless the connection is
+		// TLS or to localhost
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Lockbox digest %s\r\n", d.Generated.UTC().Format(time.DateOnly))
+	fmt.Fprintf(&msg, "Date: %s\r\n", d.Generated.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(d.Text(), "\n", "\r\n"))
+
+	if err := sendMail(c.Server, auth, c.From, c.To, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send digest: %w", err)
+	}
+	return nil
+}
+
+// SendDue sends a digest if one is configured and due at now, and
+// records when it was sent. It reports whether a digest was sent.
+func SendDue(store *db.Store, encKey []byte, now time.Time) (bool, error) {
+	c, err := LoadConfig(store)
+	if errors.Is(err, ErrNotConfigured) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !c.LastSent.IsZero() && now.Before(c.LastSent.Add(c.Every)) {
+		return false, nil
+	}
+	d, err := Build(store, now, c.Every)
+	if err != nil {
+		return false, err
+	}
+	if err := Send(store, encKey, c, d); err != nil {
+		return false, err
+	}
+	c.LastSent = now
+	return true, SaveConfig(store, c)
+}
+
+func secret(store *db.Store, encKey []byte, key string) (string, error) {
+	ciphertext, err := store.GetSecret(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get SMTP credential '%s': %w", key, err)
+	}
+	value, err := crypto.Decrypt(ciphertext, encKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt SMTP credential '%s': %w", key, err)
+	}
+	return string(value), nil
+}
+
+// Schedule calls SendDue every interval until ctx is done, reporting each
+// attempt that sent a digest or failed
+func Schedule(ctx context.Context, store *db.Store, encKey []byte, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sent, err := SendDue(store, encKey, time.Now().UTC()); sent || err != nil {
+			report(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
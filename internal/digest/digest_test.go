@@ -0,0 +1,102 @@
+package digest
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+func newTestStore(t *testing.T) (*db.Store, []byte) {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	return store, key
+}
+
+func set(t *testing.T, store *db.Store, key []byte, name, value string, updated time.Time) {
+	t.Helper()
+	encrypted, _ := crypto.Encrypt([]byte(value), key)
+	tx, _ := store.Begin()
+	if err := tx.ApplyChange(db.Change{Key: name, Value: encrypted, Created: updated, Updated: updated}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+}
+
+func TestBuild(t *testing.T) {
+	store, key := newTestStore(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	set(t, store, key, "OLD_KEY", "x", now.AddDate(0, 0, -200))
+	set(t, store, key, "ROTATED", "x", now.AddDate(0, 0, -200))
+	set(t, store, key, "FRESH", "x", now)
+	rotation.Save(store, rotation.Rule{Key: "ROTATED", Every: 30 * 24 * time.Hour, Generator: "random", Created: now.AddDate(0, 0, -27)})
+	store.CreateToken(db.Token{Name: "ci", CreatedAt: now, ExpiresAt: now.Add(48 * time.Hour)}, "h1", "")
+	store.CreateToken(db.Token{Name: "deploy", CreatedAt: now, ExpiresAt: now.AddDate(1, 0, 0)}, "h2", "")
+	store.Audit("anonymous", "auth-failed", "invalid token on /env")
+	store.Audit("anonymous", "auth-failed", "invalid token on /env")
+	store.Audit("uid:1000", "rotate-failed", "DB_PASSWORD: hook failed")
+
+	d, err := Build(store, now.Add(time.Minute), DefaultEvery)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	text := d.Text()
+	for _, want := range []string{"ci  expires", "ROTATED  due", "OLD_KEY  200 days", "Failed authentication attempts: 2", "rotate-failed  DB_PASSWORD: hook failed"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("digest lacks %q:\n%s", want, text)
+		}
+	}
+	for _, unwanted := range []string{"deploy", "FRESH", "ROTATED  2"} {
+		if strings.Contains(text, unwanted) {
+			t.Errorf("digest mentions %q:\n%s", unwanted, text)
+		}
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	store, key := newTestStore(t)
+	now := time.Now().UTC()
+	set(t, store, key, "SMTP_USER", "lockbox", now)
+	set(t, store, key, "SMTP_PASSWORD", "s3cret", now)
+
+	var sent []string
+	var auth smtp.Auth
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		auth = a
+		sent = append(sent, string(msg))
+		return nil
+	}
+	t.Cleanup(func() { sendMail = smtp.SendMail })
+
+	if ok, err := SendDue(store, key, now); ok || err != nil {
+		t.Errorf("SendDue without config = %v, %v", ok, err)
+	}
+	SaveConfig(store, Config{Server: "localhost:25", From: "lockbox@example.com", To: []string{"ops@example.com"}, UsernameKey: "SMTP_USER", PasswordKey: "SMTP_PASSWORD", Every: DefaultEvery})
+	if ok, err := SendDue(store, key, now); !ok || err != nil {
+		t.Fatalf("SendDue = %v, %v", ok, err)
+	}
+	if ok, _ := SendDue(store, key, now.Add(time.Hour)); ok {
+		t.Error("sent a second digest within the period")
+	}
+	if ok, _ := SendDue(store, key, now.Add(DefaultEvery)); !ok {
+		t.Error("no digest sent after the period")
+	}
+	if len(sent) != 2 || !strings.Contains(sent[0], "To: ops@example.com\r\n") || !strings.Contains(sent[0], "Nothing needs attention") {
+		t.Errorf("sent %q", sent)
+	}
+	if strings.Contains(sent[0], "s3cret") {
+		t.Error("digest contains a secret value")
+	}
+	if _, resp, err := auth.Start(&smtp.ServerInfo{Name: "localhost", Auth: []string{"PLAIN"}}); err != nil || string(resp) != "\x00lockbox\x00s3cret" {
+		t.Errorf("auth = %q, %v", resp, err)
+	}
+}
@@ -0,0 +1,224 @@
+// Package dotenv reads and writes .env files.
+//
+// Parse accepts what dotenv loaders and shells agree on: KEY=value lines,
+// optionally prefixed with export; # comments on their own line or after
+// an unquoted value; single-quoted values taken literally; and
+// double-quoted values with backslash escapes. Quoted values may span
+// lines. Variables are not expanded.
+//
+// Line writes values escaped exactly as 'lockbox env' does, so a file
+// written with it is read back unchanged by Parse and by a shell.
+package dotenv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/export"
+)
+
+// Entry is one variable of a .env file
+type Entry struct {
+	Key   string
+	Value string
+	// Line is where the variable is set
+	Line int
+}
+
+// Parse returns the variables set in data in the order they first appear.
+// A variable set twice keeps its last value.
+func Parse(data []byte) ([]Entry, error) {
+	p := &parser{src: strings.ReplaceAll(string(data), "\r\n", "\n"), line: 1}
+	var entries []Entry
+	index := map[string]int{}
+	for {
+		p.skipBlank()
+		if p.done() {
+			return entries, nil
+		}
+		e, err := p.entry()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", e.Line, err)
+		}
+		if i, ok := index[e.Key]; ok {
+			entries[i].Value, entries[i].Line = e.Value, e.Line
+			continue
+		}
+		index[e.Key] = len(entries)
+		entries = append(entries, e)
+	}
+}
+
+// Line formats a variable as a KEY="value" line
+func Line(key, value string) string {
+	return strings.TrimPrefix(export.Line(key, value), "export ")
+}
+
+// parser reads src from pos, counting lines
+type parser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.src) }
+
+func (p *parser) peek() byte { return p.src[p.pos] }
+
+// next consumes and returns the next byte
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipBlank skips blank lines, whitespace and comment lines
+func (p *parser) skipBlank() {
+	for !p.done() {
+		switch p.peek() {
+		case ' ', '\t', '\n':
+			p.next()
+		case '#':
+			p.skipLine()
+		default:
+			return
+		}
+	}
+}
+
+// skipSpaces skips spaces and tabs
+func (p *parser) skipSpaces() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipLine skips to the start of the next line
+func (p *parser) skipLine() {
+	for !p.done() && p.next() != '\n' {
+	}
+}
+
+// entry reads one KEY=value line
+func (p *parser) entry() (Entry, error) {
+	e := Entry{Line: p.line}
+	key := p.word()
+	if key == "export" {
+		p.skipSpaces()
+		if !p.done() && p.peek() != '=' {
+			key = p.word()
+		}
+	}
+	if !validKey(key) {
+		return e, fmt.Errorf("invalid variable name %q", key)
+	}
+	e.Key = key
+
+	p.skipSpaces()
+	if p.done() || p.peek() != '=' {
+		return e, fmt.Errorf("expected = after %s", key)
+	}
+	p.next()
+	p.skipSpaces()
+
+	var err error
+	switch {
+	case p.done() || p.peek() == '\n':
+	case p.peek() == '\'':
+		e.Value, err = p.quoted('\'')
+	case p.peek() == '"':
+		e.Value, err = p.quoted('"')
+	default:
+		e.Value = p.unquoted()
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+
+	// Only a comment may follow a quoted value
+	p.skipSpaces()
+	if !p.done() && p.peek() != '\n' && p.peek() != '#' {
+		return e, fmt.Errorf("unexpected text after the value of %s", key)
+	}
+	p.skipLine()
+	return e, nil
+}
+
+// word reads up to whitespace or =
+func (p *parser) word() string {
+	start := p.pos
+	for !p.done() {
+		switch p.peek() {
+		case ' ', '\t', '\n', '=':
+			return p.src[start:p.pos]
+		}
+		p.next()
+	}
+	return p.src[start:p.pos]
+}
+
+// unquoted reads a value to the end of the line or a comment, which must
+// follow whitespace
+func (p *parser) unquoted() string {
+	start := p.pos
+	end := p.pos
+	for !p.done() && p.peek() != '\n' {
+		if p.peek() == '#' && p.pos > start && (p.src[p.pos-1] == ' ' || p.src[p.pos-1] == '\t') {
+			p.skipLine()
+			break
+		}
+		p.next()
+		end = p.pos
+	}
+	return strings.TrimRight(p.src[start:end], " \t")
+}
+
+// quoted reads a value in quote. Double-quoted values take the escapes
+// \n, \r, \t and a backslash before \, ", $ or `; any other backslash is
+// kept.
+func (p *parser) quoted(quote byte) (string, error) {
+	p.next()
+	var b strings.Builder
+	for !p.done() {
+		c := p.next()
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"' && !p.done():
+			switch e := p.peek(); e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '$', '`':
+				b.WriteByte(e)
+			default:
+				b.WriteByte('\\')
+				continue
+			}
+			p.next()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated %c quote", quote)
+}
+
+// validKey reports whether key is a valid environment variable name
+func validKey(key string) bool {
+	if key == "" || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+	for _, c := range []byte(key) {
+		if c != '_' && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
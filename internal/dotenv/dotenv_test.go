@@ -0,0 +1,76 @@
+package dotenv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `# Database
+DB_HOST=localhost
+export DB_USER = app # the app user
+DB_PASSWORD='p@ss#word $HOME'
+GREETING="Hello\n\"World\" \$HOME \\ \d"
+CERT="-----BEGIN-----
+abc
+-----END-----"
+EMPTY=
+URL=http://x/#anchor
+DB_HOST=db.internal
+`
+	entries, err := Parse([]byte(strings.ReplaceAll(data, "\n", "\r\n")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := []Entry{
+		{"DB_HOST", "db.internal", 11},
+		{"DB_USER", "app", 3},
+		{"DB_PASSWORD", "p@ss#word $HOME", 4},
+		{"GREETING", "Hello\n\"World\" $HOME \\ \\d", 5},
+		{"CERT", "-----BEGIN-----\nabc\n-----END-----", 6},
+		{"EMPTY", "", 9},
+		{"URL", "http://x/#anchor", 10},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Parsed %d entries, expected %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("Entry %d = %+v, expected %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for data, msg := range map[string]string{
+		"A=1\nB=\"open\n":    "line 2: unterminated \" quote",
+		"1BAD=x":             "invalid variable name",
+		"A=1\nJUST_A_NAME\n": "line 2: expected =",
+		"A='x' trailing":     "unexpected text",
+		"my-key=x":           "invalid variable name",
+	} {
+		if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Parse(%q) = %v, expected %q", data, err, msg)
+		}
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	values := []string{"plain", `a"b`, `$HOME and \n`, "line1\nline2", "`cmd`", ""}
+	var b strings.Builder
+	for i, v := range values {
+		b.WriteString(Line(string(rune('A'+i)), v))
+	}
+	entries, err := Parse([]byte(b.String()))
+	if err != nil {
+		t.Fatalf("Parse failed: %v\n%s", err, b.String())
+	}
+	for i, v := range values {
+		if entries[i].Value != v {
+			t.Errorf("Value %d = %q, expected %q", i, entries[i].Value, v)
+		}
+	}
+	if line := Line("KEY", "v"); line != "KEY=\"v\"\n" {
+		t.Errorf("Line = %q", line)
+	}
+}
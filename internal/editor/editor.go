@@ -0,0 +1,79 @@
+// Package editor lets the user edit text in their own editor
+package editor
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Command returns the user's editor command: $VISUAL, then $EDITOR, then vi
+func Command() string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if e := strings.TrimSpace(os.Getenv(env)); e != "" {
+			return e
+		}
+	}
+	return "vi"
+}
+
+// Edit writes initial to a private temporary file named with suffix, opens
+// it in the user's editor and returns the saved text. The file is kept in
+// memory-backed /dev/shm where available and is shredded afterwards, along
+// with any swap or backup files the editor left next to it.
+func Edit(initial []byte, suffix string) ([]byte, error) {
+	base := ""
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		base = "/dev/shm"
+	}
+	dir, err := os.MkdirTemp(base, "lockbox-edit-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer shred(dir)
+
+	path := filepath.Join(dir, "edit"+suffix)
+	if err := os.WriteFile(path, initial, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	// The editor may carry arguments, e.g. "code --wait"
+	args := append(strings.Fields(Command()), path)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor '%s' failed: %w", args[0], err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read edited file: %w", err)
+	}
+	return data, nil
+}
+
+// shred overwrites the regular files in dir with zeros before removing it,
+// so their contents do not linger on disk-backed storage
+func shred(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		f.Write(make([]byte, info.Size()))
+		f.Sync()
+		return nil
+	})
+	os.RemoveAll(dir)
+}
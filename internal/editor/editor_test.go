@@ -0,0 +1,46 @@
+package editor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEdit(t *testing.T) {
+	// A fake editor that appends a line to the file it is given
+	script := filepath.Join(t.TempDir(), "fake-editor")
+	os.WriteFile(script, []byte("#!/bin/sh\necho edited >> \"$1\"\n"), 0700)
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", script)
+
+	got, err := Edit([]byte("draft\n"), ".md")
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	if string(got) != "draft\nedited\n" {
+		t.Errorf("Edit returned %q", got)
+	}
+
+	t.Setenv("EDITOR", "false")
+	if _, err := Edit(nil, ".md"); err == nil {
+		t.Errorf("Expected an error when the editor fails")
+	}
+}
+
+func TestEditShreds(t *testing.T) {
+	// A fake editor that leaves a backup next to the file and records
+	// where it was
+	dir := t.TempDir()
+	record := filepath.Join(dir, "path")
+	script := filepath.Join(dir, "fake-editor")
+	os.WriteFile(script, []byte("#!/bin/sh\ncp \"$1\" \"$1~\"\necho \"$1\" > "+record+"\n"), 0700)
+	t.Setenv("VISUAL", script)
+
+	if _, err := Edit([]byte("secret"), ""); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	path, _ := os.ReadFile(record)
+	if _, err := os.Stat(filepath.Dir(string(path[:len(path)-1]))); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary directory to be removed, got %v", err)
+	}
+}
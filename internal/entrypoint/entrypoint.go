@@ -0,0 +1,79 @@
+package entrypoint
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fetch calls fetch until it succeeds, making at most attempts calls and
+// doubling delay after each failure. The last error is returned.
+func Fetch(fetch func() (map[string]string, error), attempts int, delay time.Duration) (map[string]string, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		var secrets map[string]string
+		if secrets, err = fetch(); err == nil {
+			return secrets, nil
+		}
+		if i < attempts-1 {
+			fmt.Fprintf(os.Stderr, "Warning: fetch attempt %d/%d failed: %v\n", i+1, attempts, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+// MergeEnv overlays secrets on base, dropping variables named in strip.
+// Each name appears once, since execve leaves duplicate resolution to the
+// program. Secrets are appended in sorted order.
+func MergeEnv(base []string, secrets map[string]string, strip ...string) []string {
+	drop := make(map[string]bool, len(secrets)+len(strip))
+	for key := range secrets {
+		drop[key] = true
+	}
+	for _, key := range strip {
+		drop[key] = true
+	}
+
+	env := make([]string, 0, len(base)+len(secrets))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if !drop[name] {
+			env = append(env, kv)
+		}
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+secrets[key])
+	}
+	return env
+}
+
+// Run starts argv with env. As PID 1 in a container it stays resident as a
+// minimal init, forwarding signals to the child and reaping zombies, and
+// returns the child's exit code. Otherwise it replaces the current process
+// via execve and only returns on failure.
+func Run(argv []string, env []string) (int, error) {
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return 127, fmt.Errorf("command not found: %s", argv[0])
+	}
+
+	if os.Getpid() == 1 {
+		return supervise(path, argv, env)
+	}
+	return 126, execve(path, argv, env)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package entrypoint
+
+import "errors"
+
+// errUnsupported is returned on platforms without execve and wait4
+var errUnsupported = errors.New("entrypoint mode is only supported on unix")
+
+func execve(path string, argv []string, env []string) error {
+	return errUnsupported
+}
+
+func supervise(path string, argv []string, env []string) (int, error) {
+	return 1, errUnsupported
+}
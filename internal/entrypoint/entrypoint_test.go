@@ -0,0 +1,63 @@
+//go:build unix
+
+package entrypoint
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFetchRetries(t *testing.T) {
+	calls := 0
+	fetch := func() (map[string]string, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return map[string]string{"A": "1"}, nil
+	}
+
+	secrets, err := Fetch(fetch, 5, time.Millisecond)
+	if err != nil || secrets["A"] != "1" || calls != 3 {
+		t.Errorf("Fetch = %v, %v after %d calls", secrets, err, calls)
+	}
+
+	calls = 0
+	if _, err := Fetch(func() (map[string]string, error) {
+		calls++
+		return nil, errors.New("down")
+	}, 2, time.Millisecond); err == nil || calls != 2 {
+		t.Errorf("Expected failure after 2 calls, got %v after %d", err, calls)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	base := []string{"PATH=/bin", "API_KEY=old", "LOCKBOX_TOKEN=t0k3n", "HOME=/root"}
+	got := MergeEnv(base, map[string]string{"API_KEY": "new", "DB_URL": "pg://"}, "LOCKBOX_TOKEN")
+	want := []string{"PATH=/bin", "HOME=/root", "API_KEY=new", "DB_URL=pg://"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeEnv = %v, expected %v", got, want)
+	}
+}
+
+func TestSuperviseExitCode(t *testing.T) {
+	code, err := supervise("/bin/sh", []string{"sh", "-c", "exit 3"}, nil)
+	if err != nil || code != 3 {
+		t.Errorf("supervise = %d, %v, expected 3", code, err)
+	}
+}
+
+func TestSuperviseForwardsSignals(t *testing.T) {
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	code, err := supervise("/bin/sh", []string{"sh", "-c", "trap 'exit 7' TERM; while :; do sleep 0.05; done"}, nil)
+	if err != nil || code != 7 {
+		t.Errorf("supervise = %d, %v, expected the child's TERM handler to exit 7", code, err)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build unix
+
+package entrypoint
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// execve replaces the current process with path
+func execve(path string, argv []string, env []string) error {
+	if err := syscall.Exec(path, argv, env); err != nil {
+		return fmt.Errorf("failed to exec %s: %w", path, err)
+	}
+	return nil
+}
+
+// supervise runs path as a child, forwarding every catchable signal to it
+// and reaping any process reparented to us, until the child exits
+func supervise(path string, argv []string, env []string) (int, error) {
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+	defer signal.Stop(sigs)
+
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   argv,
+		Env:    env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		return 126, fmt.Errorf("failed to start %s: %w", path, err)
+	}
+	child := cmd.Process.Pid
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD:
+			if code, exited := reap(child); exited {
+				return code, nil
+			}
+		case syscall.SIGURG:
+			// Used internally by the Go runtime for preemption
+		default:
+			syscall.Kill(child, sig.(syscall.Signal))
+		}
+	}
+	return 1, nil
+}
+
+// reap collects every exited process without blocking, reporting the exit
+// code once child is among them
+func reap(child int) (code int, exited bool) {
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			return 0, false
+		}
+		if pid != child {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal()), true
+		}
+		return status.ExitStatus(), true
+	}
+}
@@ -0,0 +1,244 @@
+// Package escrow keeps an append-only archive of secrets as they were
+// before being deleted or overwritten, so a mistaken or malicious write
+// cannot destroy a value for good.
+//
+// Each archive entry is one JSON line. The secret's ciphertext, still
+// encrypted with the store key, is sealed again to a separate X25519
+// escrow key whose private half is kept away from the store, so neither
+// the store key nor the escrow key alone can read an archived value.
+package escrow
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// Store config entries enabling escrow
+const (
+	archiveConfig   = "escrow_archive"
+	recipientConfig = "escrow_recipient"
+)
+
+// sealInfo binds archived ciphertexts to this format
+const sealInfo = "lockbox escrow v1"
+
+// Entry is one line of the archive. Only the vault, key, operation and time
+// are readable without the escrow key.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Vault     string    `json:"vault,omitempty"`
+	Key       string    `json:"key"`
+	Ephemeral []byte    `json:"ephemeral"`
+	Sealed    []byte    `json:"sealed"`
+}
+
+// sealed is the encrypted part of an entry
+type sealed struct {
+	Kind    string    `json:"kind"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Value   []byte    `json:"value"`
+}
+
+// Archive appends entries to an archive file. It implements db.Escrow.
+type Archive struct {
+	Path      string
+	Recipient *ecdh.PublicKey
+	now       func() time.Time
+}
+
+// New returns an archive at path sealed to recipient
+func New(path string, recipient *ecdh.PublicKey) *Archive {
+	return &Archive{Path: path, Recipient: recipient, now: time.Now}
+}
+
+// Archive appends s to the archive and syncs it to disk
+func (a *Archive) Archive(s db.Archived) error {
+	payload, err := json.Marshal(sealed{Kind: s.Kind, Owner: s.Owner, Created: s.Created.UTC(), Updated: s.Updated.UTC(), Value: s.Value})
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %w", err)
+	}
+	ephemeral, ciphertext, err := crypto.Seal(payload, a.Recipient, sealInfo)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(Entry{Time: a.now().UTC(), Op: s.Op, Vault: s.Vault, Key: s.Key, Ephemeral: ephemeral, Sealed: ciphertext})
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %w", err)
+	}
+
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open escrow archive: %w", err)
+	}
+	defer f.Close()
+	// One write per line keeps concurrent appends from interleaving
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write escrow archive: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync escrow archive: %w", err)
+	}
+	return nil
+}
+
+// Open decrypts an entry with the escrow private key. The returned value is
+// still encrypted with the store key.
+func (e Entry) Open(key *ecdh.PrivateKey) (db.Archived, error) {
+	payload, err := crypto.Unseal(e.Ephemeral, e.Sealed, key, sealInfo)
+	if err != nil {
+		return db.Archived{}, fmt.Errorf("failed to open entry for '%s': %w", e.Key, err)
+	}
+	var s sealed
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return db.Archived{}, fmt.Errorf("failed to decode entry for '%s': %w", e.Key, err)
+	}
+	return db.Archived{Op: e.Op, Vault: e.Vault, Key: e.Key, Kind: s.Kind, Owner: s.Owner, Created: s.Created, Updated: s.Updated, Value: s.Value}, nil
+}
+
+// ReadFile returns the entries of the archive at path, oldest first
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open escrow archive: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("escrow archive line %d is corrupt: %w", n, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read escrow archive: %w", err)
+	}
+	return entries, nil
+}
+
+// Prune rewrites the archive at path keeping only the newest keep entries
+// of each secret, and returns how many entries and bytes it removed. The
+// file is replaced atomically; entries appended while it is rewritten are
+// carried over.
+func Prune(path string, keep int) (int, int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to read escrow archive: %w", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	// Count back from the newest entry of each secret
+	seen := map[[2]string]int{}
+	kept := make([]bool, len(lines))
+	removed := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		var e Entry
+		if err := json.Unmarshal(lines[i], &e); err != nil {
+			return 0, 0, fmt.Errorf("escrow archive line %d is corrupt: %w", i+1, err)
+		}
+		id := [2]string{e.Vault, e.Key}
+		seen[id]++
+		if kept[i] = seen[id] <= keep; !kept[i] {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, 0, nil
+	}
+
+	var out bytes.Buffer
+	for i, line := range lines {
+		if kept[i] {
+			out.Write(line)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".lockbox-tmp-*")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return 0, 0, fmt.Errorf("failed to write escrow archive: %w", err)
+	}
+	// Carry over entries appended since the archive was read
+	if current, err := os.ReadFile(path); err == nil && len(current) > len(data) {
+		if _, err := tmp.Write(current[len(data):]); err != nil {
+			tmp.Close()
+			return 0, 0, fmt.Errorf("failed to write escrow archive: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, 0, fmt.Errorf("failed to sync escrow archive: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to write escrow archive: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, 0, fmt.Errorf("failed to replace escrow archive: %w", err)
+	}
+	return removed, int64(len(data) - out.Len()), nil
+}
+
+// Enable records in store that destructive writes must be archived to path,
+// sealed to recipient
+func Enable(store *db.Store, path string, recipient *ecdh.PublicKey) error {
+	if err := store.SetConfig(recipientConfig, []byte(hex.EncodeToString(recipient.Bytes()))); err != nil {
+		return err
+	}
+	return store.SetConfig(archiveConfig, []byte(path))
+}
+
+// Disable turns escrow off for store. The archive file is left in place.
+func Disable(store *db.Store) error {
+	if err := store.DeleteConfig(archiveConfig); err != nil {
+		return err
+	}
+	return store.DeleteConfig(recipientConfig)
+}
+
+// Load returns the archive configured for store, or nil if escrow is off
+func Load(store *db.Store) (*Archive, error) {
+	path, err := store.GetConfig(archiveConfig)
+	if err == db.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	recipientHex, err := store.GetConfig(recipientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("escrow is enabled but its key is missing: %w", err)
+	}
+	raw, err := hex.DecodeString(string(recipientHex))
+	if err != nil {
+		return nil, errors.New("stored escrow key is corrupt")
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errors.New("stored escrow key is corrupt")
+	}
+	return New(string(path), recipient), nil
+}
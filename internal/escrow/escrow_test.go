@@ -0,0 +1,114 @@
+package escrow
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestArchive(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "lockbox.escrow")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := New(path, key.PublicKey())
+	a.now = func() time.Time { return now }
+
+	for _, s := range []db.Archived{
+		{Op: "overwrite", Key: "API_KEY", Owner: "uid:1000", Value: []byte{1}},
+		{Op: "delete", Key: "note/x", Kind: "note", Value: []byte{2}},
+	} {
+		if err := a.Archive(s); err != nil {
+			t.Fatalf("Archive failed: %v", err)
+		}
+	}
+
+	entries, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "API_KEY" || entries[1].Op != "delete" || !entries[0].Time.Equal(now) {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+
+	s, err := entries[1].Open(key)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if s.Key != "note/x" || s.Kind != "note" || s.Op != "delete" || len(s.Value) != 1 || s.Value[0] != 2 {
+		t.Errorf("Unexpected opened entry %+v", s)
+	}
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := entries[0].Open(other); err == nil {
+		t.Errorf("Expected Open with another key to fail")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "lockbox.escrow")
+	a := New(path, key.PublicKey())
+
+	for i, s := range []db.Archived{
+		{Op: "overwrite", Key: "API_KEY", Value: []byte{1}},
+		{Op: "overwrite", Key: "API_KEY", Value: []byte{2}},
+		{Op: "overwrite", Vault: "prod", Key: "API_KEY", Value: []byte{3}},
+		{Op: "delete", Key: "API_KEY", Value: []byte{4}},
+		{Op: "delete", Key: "DB_URL", Value: []byte{5}},
+	} {
+		s.Updated = time.Unix(int64(i), 0)
+		a.Archive(s)
+	}
+
+	removed, reclaimed, err := Prune(path, 2)
+	if err != nil || removed != 1 || reclaimed <= 0 {
+		t.Fatalf("Prune = %d, %d, %v", removed, reclaimed, err)
+	}
+	entries, err := ReadFile(path)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("ReadFile = %d entries, %v", len(entries), err)
+	}
+	// The oldest API_KEY entry of the default vault went
+	if s, _ := entries[0].Open(key); s.Value[0] != 2 {
+		t.Errorf("Prune kept %+v first", s)
+	}
+
+	if removed, _, err := Prune(path, 2); err != nil || removed != 0 {
+		t.Errorf("Second Prune = %d, %v", removed, err)
+	}
+	if removed, _, err := Prune(filepath.Join(t.TempDir(), "missing"), 1); err != nil || removed != 0 {
+		t.Errorf("Prune of a missing archive = %d, %v", removed, err)
+	}
+}
+
+func TestEnable(t *testing.T) {
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if a, err := Load(store); err != nil || a != nil {
+		t.Errorf("Expected escrow to be off by default, got %v, %v", a, err)
+	}
+
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if err := Enable(store, "/backup/lockbox.escrow", key.PublicKey()); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	a, err := Load(store)
+	if err != nil || a == nil || a.Path != "/backup/lockbox.escrow" || !a.Recipient.Equal(key.PublicKey()) {
+		t.Errorf("Load = %+v, %v", a, err)
+	}
+
+	if err := Disable(store); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+	if a, _ := Load(store); a != nil {
+		t.Errorf("Expected escrow to be off after Disable")
+	}
+}
@@ -0,0 +1,97 @@
+// Package export writes secrets as shell export statements. Writer streams
+// them through a fixed-size buffer, so exporting a store of any size uses
+// the same memory as exporting one secret.
+package export
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// BufferSize is how much output Writer holds before writing it out
+const BufferSize = 32 << 10
+
+// Line formats a secret as an export statement, escaping the value for
+// double quotes
+func Line(key, value string) string {
+	var b strings.Builder
+	b.Grow(len(key) + len(value) + 12)
+	b.WriteString("export ")
+	b.WriteString(key)
+	b.WriteString("=\"")
+	for i := 0; i < len(value); i++ {
+		writeEscaped(&b, value[i])
+	}
+	b.WriteString("\"\n")
+	return b.String()
+}
+
+// byteWriter is a *bufio.Writer or *strings.Builder
+type byteWriter interface {
+	WriteByte(c byte) error
+}
+
+// writeEscaped writes c, escaped for double quotes in a shell
+func writeEscaped(w byteWriter, c byte) {
+	switch c {
+	case '\\', '"', '$', '`':
+		w.WriteByte('\\')
+	}
+	w.WriteByte(c)
+}
+
+// Writer streams export statements. Whenever its buffer fills, the output
+// is written out and, when the destination can flush (such as an HTTP
+// response), flushed, so a reader receives secrets as they are produced.
+type Writer struct {
+	buf *bufio.Writer
+	dst *flushWriter
+}
+
+// flushWriter flushes after every write when the destination supports it
+type flushWriter struct {
+	w       io.Writer
+	flusher interface{ Flush() }
+	started bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.started = true
+	n, err := f.w.Write(p)
+	if err == nil && f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// NewWriter returns a Writer streaming to w
+func NewWriter(w io.Writer) *Writer {
+	dst := &flushWriter{w: w}
+	dst.flusher, _ = w.(interface{ Flush() })
+	return &Writer{buf: bufio.NewWriterSize(dst, BufferSize), dst: dst}
+}
+
+// Write writes one export statement. The value is not retained, so callers
+// may wipe it afterwards.
+func (e *Writer) Write(key string, value []byte) error {
+	e.buf.WriteString("export ")
+	e.buf.WriteString(key)
+	e.buf.WriteString("=\"")
+	for _, c := range value {
+		writeEscaped(e.buf, c)
+	}
+	_, err := e.buf.WriteString("\"\n")
+	return err
+}
+
+// Started reports whether any output has reached the destination. Until
+// then an error can still be reported in its place.
+func (e *Writer) Started() bool {
+	return e.dst.started
+}
+
+// Flush writes out any buffered output
+func (e *Writer) Flush() error {
+	return e.buf.Flush()
+}
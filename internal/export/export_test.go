@@ -0,0 +1,72 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLine(t *testing.T) {
+	got := Line("KEY", "a\\b\"c$d`e")
+	want := "export KEY=\"a\\\\b\\\"c\\$d\\`e\"\n"
+	if got != want {
+		t.Errorf("Line = %q, want %q", got, want)
+	}
+}
+
+// flushBuffer records how often it was flushed
+type flushBuffer struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushBuffer) Flush() { f.flushes++ }
+
+func TestWriterMatchesLine(t *testing.T) {
+	values := []string{"", "plain", "multi\nline", "q\"uote $HOME `cmd` back\\slash", "pässwörd ✓"}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var want strings.Builder
+	for i, v := range values {
+		key := string(rune('A' + i))
+		if err := w.Write(key, []byte(v)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		want.WriteString(Line(key, v))
+	}
+	if w.Started() {
+		t.Error("Started before the buffer filled")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if !w.Started() {
+		t.Error("not Started after Flush")
+	}
+	if buf.String() != want.String() {
+		t.Errorf("Writer wrote %q, want %q", buf.String(), want.String())
+	}
+}
+
+func TestWriterStreams(t *testing.T) {
+	dst := &flushBuffer{}
+	w := NewWriter(dst)
+	value := []byte(strings.Repeat("x", 1000))
+
+	// Write several buffers' worth; output must reach dst as it goes
+	for i := 0; i < 4*BufferSize/len(value); i++ {
+		if err := w.Write("KEY", value); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if dst.Len() > 0 && dst.flushes == 0 {
+			t.Fatal("output written without a flush")
+		}
+	}
+	if dst.Len() < 3*BufferSize {
+		t.Errorf("only %d bytes reached the destination before Flush", dst.Len())
+	}
+	if dst.flushes == 0 {
+		t.Error("destination was never flushed")
+	}
+}
@@ -0,0 +1,409 @@
+package fixtures
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/escrow"
+)
+
+var record = flag.Bool("record", false, "write fixture files that do not exist yet")
+
+// firstReleaseSchema is the schema of the first release, before
+// migrations were introduced
+const firstReleaseSchema = `
+CREATE TABLE config (
+	key TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+CREATE TABLE secrets (
+	key TEXT PRIMARY KEY,
+	value BLOB NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// Schema versions that changed how secrets are stored
+const (
+	kindVersion  = 3
+	ownerVersion = 8
+)
+
+// sentinelPlaintext is the value sealed in a store's key sentinel
+const sentinelPlaintext = "lockbox key check v1"
+
+// envelopes is the file format of envelope-v1.json
+type envelopes struct {
+	Key      string     `json:"key"`
+	Sentinel string     `json:"sentinel"`
+	Values   []envelope `json:"values"`
+}
+
+// envelope is one recorded value
+type envelope struct {
+	Plaintext  string `json:"plaintext"`
+	Ciphertext string `json:"ciphertext"`
+	Digest     string `json:"digest"`
+}
+
+// currentVersion is the schema version of a newly created store
+func currentVersion(t *testing.T) int {
+	path := filepath.Join(t.TempDir(), "version.db")
+	store, err := db.OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Close()
+	return schemaVersion(t, path)
+}
+
+func schemaVersion(t *testing.T, path string) int {
+	conn, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer conn.Close()
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	return version
+}
+
+// recordFirstRelease dumps a store as the first release wrote it: values
+// inline, no kinds or owners
+func recordFirstRelease(t *testing.T) []byte {
+	path := filepath.Join(t.TempDir(), "v0.db")
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=rwc")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(firstReleaseSchema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	conn.Exec("INSERT INTO config (key, value) VALUES ('encryption_key', ?)", []byte(hex.EncodeToString(Key())))
+	for _, s := range Secrets {
+		if s.Kind != "" {
+			continue
+		}
+		value, err := Encrypt([]byte(s.Value), Key(), s.Key)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		conn.Exec("INSERT INTO secrets (key, value, created_at, updated_at) VALUES (?, ?, ?, ?)",
+			s.Key, value, Time.Format(time.DateTime), Time.Format(time.DateTime))
+	}
+	return dump(t, path)
+}
+
+// recordStore dumps a store written by the current code
+func recordStore(t *testing.T) []byte {
+	path := filepath.Join(t.TempDir(), "current.db")
+	store, err := db.OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	key := Key()
+	store.SetConfig("encryption_key", []byte(hex.EncodeToString(key)))
+	sentinel, _ := Encrypt([]byte(sentinelPlaintext), key, "sentinel")
+	store.SetConfig("key_sentinel", sentinel)
+
+	for _, s := range Secrets {
+		value, err := Encrypt([]byte(s.Value), key, s.Key)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		if s.Kind != "" {
+			err = store.SetKindSecret(s.Kind, s.Key, value)
+		} else {
+			digest, _ := crypto.Digest([]byte(s.Value), key)
+			err = store.SetSecretBlob(s.Key, digest, value)
+		}
+		if err == nil && s.Owner != "" {
+			err = store.SetSecretOwner(s.Key, s.Owner)
+		}
+		if err != nil {
+			t.Fatalf("Failed to store %s: %v", s.Key, err)
+		}
+	}
+	store.Close()
+
+	conn, _ := sql.Open("sqlite", "file:"+path)
+	defer conn.Close()
+	if _, err := conn.Exec("UPDATE secrets SET created_at = ?, updated_at = ?", Time.Format(time.DateTime), Time.Format(time.DateTime)); err != nil {
+		t.Fatalf("Failed to fix timestamps: %v", err)
+	}
+	return dump(t, path)
+}
+
+func dump(t *testing.T, path string) []byte {
+	var buf bytes.Buffer
+	if err := Dump(path, &buf); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// recordEnvelopes returns envelope-v1.json: recorded ciphertexts, digests
+// and a sentinel under Key
+func recordEnvelopes(t *testing.T) []byte {
+	key := Key()
+	e := envelopes{Key: hex.EncodeToString(key)}
+	sentinel, _ := Encrypt([]byte(sentinelPlaintext), key, "sentinel")
+	e.Sentinel = hex.EncodeToString(sentinel)
+	for _, s := range Secrets {
+		ciphertext, err := Encrypt([]byte(s.Value), key, s.Key)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		digest, _ := crypto.Digest([]byte(s.Value), key)
+		e.Values = append(e.Values, envelope{s.Value, hex.EncodeToString(ciphertext), digest})
+	}
+	data, _ := json.MarshalIndent(e, "", "  ")
+	return append(data, '\n')
+}
+
+// plainSecrets returns the fixture secrets without a kind as a map
+func plainSecrets() map[string]string {
+	m := map[string]string{}
+	for _, s := range Secrets {
+		if s.Kind == "" {
+			m[s.Key] = s.Value
+		}
+	}
+	return m
+}
+
+// TestRecord writes missing fixture files when run with -record. Existing
+// files are never overwritten.
+func TestRecord(t *testing.T) {
+	if !*record {
+		t.Skip("run with -record to write missing fixtures")
+	}
+
+	files := map[string]func() []byte{
+		"store-v0.sql": func() []byte { return recordFirstRelease(t) },
+		fmt.Sprintf("store-v%d.sql", currentVersion(t)): func() []byte { return recordStore(t) },
+		"envelope-v1.json": func() []byte { return recordEnvelopes(t) },
+		fmt.Sprintf("bundle-v%d.json", bundle.Version): func() []byte {
+			data, err := bundle.Create(plainSecrets(), X25519Key("auditor").PublicKey(), Ed25519Key("store"), Time, Time.Add(7*24*time.Hour))
+			if err != nil {
+				t.Fatalf("bundle.Create failed: %v", err)
+			}
+			return data
+		},
+	}
+	for name, generate := range files {
+		path := filepath.Join("testdata", name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.WriteFile(path, generate(), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		t.Logf("Recorded %s", path)
+	}
+
+	path := filepath.Join("testdata", "escrow-v1.escrow")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		s, _ := Lookup("DB_URL")
+		value, _ := Encrypt([]byte(s.Value), Key(), "escrow/"+s.Key)
+		a := escrow.New(path, X25519Key("escrow").PublicKey())
+		if err := a.Archive(db.Archived{Op: "delete", Key: s.Key, Owner: s.Owner, Created: Time, Updated: Time, Value: value}); err != nil {
+			t.Fatalf("Failed to record %s: %v", path, err)
+		}
+		t.Logf("Recorded %s", path)
+	}
+}
+
+// TestStoresDecrypt opens a copy of every recorded store with the current
+// code, migrating it, and checks every secret still decrypts
+func TestStoresDecrypt(t *testing.T) {
+	dumps, _ := filepath.Glob(filepath.Join("testdata", "store-v*.sql"))
+	if len(dumps) < 2 {
+		t.Fatalf("Expected store fixtures in testdata, found %v", dumps)
+	}
+
+	versionPattern := regexp.MustCompile(`store-v(\d+)\.sql$`)
+	for _, dumpPath := range dumps {
+		t.Run(filepath.Base(dumpPath), func(t *testing.T) {
+			version, _ := strconv.Atoi(versionPattern.FindStringSubmatch(dumpPath)[1])
+			path := filepath.Join(t.TempDir(), "lockbox.db")
+			if err := Load(dumpPath, path); err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if got := schemaVersion(t, path); got != version {
+				t.Fatalf("%s is at schema version %d", dumpPath, got)
+			}
+
+			store, err := db.OpenStore(path)
+			if err != nil {
+				t.Fatalf("Failed to open and migrate store: %v", err)
+			}
+			defer store.Close()
+
+			keyHex, err := store.GetConfig("encryption_key")
+			if err != nil {
+				t.Fatalf("Failed to read key: %v", err)
+			}
+			key, err := hex.DecodeString(string(keyHex))
+			if err != nil || !bytes.Equal(key, Key()) {
+				t.Fatalf("Unexpected encryption key %q", keyHex)
+			}
+			if sentinel, err := store.GetConfig("key_sentinel"); err == nil {
+				if err := crypto.CheckSentinel(sentinel, key); err != nil {
+					t.Errorf("Sentinel check failed: %v", err)
+				}
+			}
+
+			keys, err := store.ListAllSecrets()
+			if err != nil {
+				t.Fatalf("Failed to list secrets: %v", err)
+			}
+			var want []string
+			for _, s := range Secrets {
+				if s.Kind == "" || version >= kindVersion {
+					want = append(want, s.Key)
+				}
+			}
+			slices.Sort(want)
+			if !slices.Equal(keys, want) {
+				t.Errorf("Store holds %v, expected %v", keys, want)
+			}
+
+			for _, k := range keys {
+				s, _ := Lookup(k)
+				value, err := store.GetSecret(k)
+				if err != nil {
+					t.Errorf("GetSecret(%s) failed: %v", k, err)
+					continue
+				}
+				plaintext, err := crypto.Decrypt(value, key)
+				if err != nil || string(plaintext) != s.Value {
+					t.Errorf("%s decrypted to %q, %v; expected %q", k, plaintext, err, s.Value)
+				}
+				if version >= ownerVersion {
+					if owner, _ := store.SecretOwner(k); owner != s.Owner {
+						t.Errorf("%s is owned by %q, expected %q", k, owner, s.Owner)
+					}
+				}
+			}
+
+			if version >= kindVersion {
+				if notes, _ := store.ListKindSecrets("note"); len(notes) != 1 || notes[0] != "note/runbook" {
+					t.Errorf("Unexpected notes %v", notes)
+				}
+			}
+		})
+	}
+}
+
+// TestCurrentStoreRecorded checks the current schema version has a
+// fixture, and that recording it again reproduces the file exactly
+func TestCurrentStoreRecorded(t *testing.T) {
+	path := filepath.Join("testdata", fmt.Sprintf("store-v%d.sql", currentVersion(t)))
+	recorded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("No fixture for the current schema; run 'go test ./internal/fixtures -run TestRecord -record': %v", err)
+	}
+	if !bytes.Equal(recordStore(t), recorded) {
+		t.Errorf("Recording the current store no longer reproduces %s; existing fixtures must not change", path)
+	}
+	if recorded, _ := os.ReadFile(filepath.Join("testdata", "store-v0.sql")); !bytes.Equal(recordFirstRelease(t), recorded) {
+		t.Errorf("Recording the first release store no longer reproduces store-v0.sql")
+	}
+}
+
+// TestEnvelopes checks recorded ciphertexts decrypt and recorded digests
+// and the sentinel still match
+func TestEnvelopes(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "envelope-v1.json"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	var e envelopes
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+	key, _ := hex.DecodeString(e.Key)
+
+	for _, v := range e.Values {
+		ciphertext, _ := hex.DecodeString(v.Ciphertext)
+		plaintext, err := crypto.Decrypt(ciphertext, key)
+		if err != nil || string(plaintext) != v.Plaintext {
+			t.Errorf("Decrypt = %q, %v; expected %q", plaintext, err, v.Plaintext)
+		}
+		if digest, _ := crypto.Digest([]byte(v.Plaintext), key); digest != v.Digest {
+			t.Errorf("Digest of %q changed from %s to %s; identical values would stop sharing blobs", v.Plaintext, v.Digest, digest)
+		}
+	}
+
+	sentinel, _ := hex.DecodeString(e.Sentinel)
+	if err := crypto.CheckSentinel(sentinel, key); err != nil {
+		t.Errorf("Recorded sentinel no longer checks: %v", err)
+	}
+}
+
+// TestBundles checks every recorded bundle still verifies and opens
+func TestBundles(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "bundle-v*.json"))
+	if len(files) == 0 {
+		t.Fatalf("No bundle fixtures in testdata")
+	}
+	for _, path := range files {
+		data, _ := os.ReadFile(path)
+		b, secrets, err := bundle.Open(data, X25519Key("auditor"), Time.Add(time.Hour))
+		if err != nil {
+			t.Errorf("%s: Open failed: %v", path, err)
+			continue
+		}
+		if bundle.Fingerprint(b.Signer) != bundle.Fingerprint(Ed25519Key("store").Public().(ed25519.PublicKey)) {
+			t.Errorf("%s: unexpected signer", path)
+		}
+		want := plainSecrets()
+		if len(secrets) != len(want) {
+			t.Errorf("%s: opened %d secrets, expected %d", path, len(secrets), len(want))
+		}
+		for k, v := range want {
+			if secrets[k] != v {
+				t.Errorf("%s: %s = %q, expected %q", path, k, secrets[k], v)
+			}
+		}
+	}
+}
+
+// TestEscrowArchive checks the recorded escrow archive still opens and
+// its value decrypts with the store key
+func TestEscrowArchive(t *testing.T) {
+	entries, err := escrow.ReadFile(filepath.Join("testdata", "escrow-v1.escrow"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadFile = %d entries, %v", len(entries), err)
+	}
+	a, err := entries[0].Open(X25519Key("escrow"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s, _ := Lookup("DB_URL")
+	plaintext, err := crypto.Decrypt(a.Value, Key())
+	if err != nil || string(plaintext) != s.Value || a.Key != s.Key || a.Op != "delete" || a.Owner != s.Owner || !a.Updated.Equal(Time) {
+		t.Errorf("Unexpected archived secret %+v (%q, %v)", a, plaintext, err)
+	}
+}
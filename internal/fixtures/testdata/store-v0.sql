@@ -0,0 +1,18 @@
+PRAGMA user_version = 0;
+CREATE TABLE config (
+	key TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+INSERT INTO "config" (key, value) VALUES ('encryption_key', X'36663034396264623437653539323032316466333962316663613831666565653035326331326362363665313232336438616136666432333466323262333735');
+CREATE TABLE secrets (
+	key TEXT PRIMARY KEY,
+	value BLOB NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('API_KEY', X'9eee16d43898380b2278dcec4b2ad7e47d9e7a0cf5dac4ac57f655b1319617e33bbaa43e0e00b73ee22b0c2ebf8f52fee4968d55', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('API_KEY_COPY', X'bbd851ded71df3e6d4120ff719ac5cdbba6d150cbd52312db96bfa9dbb8e7dd47b293f7da428b560ce351809085eaf3c002486ea', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('DB_URL', X'bd97d808ba99623364ef4100c6576718c2d27eb96aad7e314a2677b29040fa0762975d9babc6a652a34bf202cbefc7f0ef71595c270317cf9b999936c26a86fe1829d86adf8532', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('EMPTY', X'6bfccbb65506ebc5a8be5e2c1716fc84a7ef45fc6ce8176d5998f8e8', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('MULTILINE', X'f1b96a7696a5e3407c23a0401f823af3c7ee0da4588b3a6d1b7f77bdcd7f157cebdac00cf164cdae1e4ca3b5cae513280e7f3fc9b49607dab3d891b92d8a5784296d26117bccbe6a429ecf', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
+INSERT INTO "secrets" (key, value, created_at, updated_at) VALUES ('UNICODE', X'422ed6c01a292f954e8dd2c8d5106b5ac25e102bdaa377c13ecb9333f37b45488c677bd538e9b94e9eb39e2394279bab2166d40489b2a15f5d83329b6ec4b06b2b55d1c8', '2026-01-01 00:00:00', '2026-01-01 00:00:00');
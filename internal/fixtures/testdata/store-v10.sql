@@ -0,0 +1,84 @@
+PRAGMA user_version = 10;
+CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT ''
+	);
+CREATE TABLE blobs (
+		digest TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 0
+	);
+INSERT INTO "blobs" (digest, value, refcount) VALUES ('912c4084703c29701c2ce9fd0c36b001e4b8ac341e777bf59047ac5b4d8d2692', X'9eee16d43898380b2278dcec4b2ad7e47d9e7a0cf5dac4ac57f655b1319617e33bbaa43e0e00b73ee22b0c2ebf8f52fee4968d55', 2);
+INSERT INTO "blobs" (digest, value, refcount) VALUES ('0fd4981baf5c63dcf06a50651252bb9acba4f97e5bbfc6e6e603a56663711906', X'bd97d808ba99623364ef4100c6576718c2d27eb96aad7e314a2677b29040fa0762975d9babc6a652a34bf202cbefc7f0ef71595c270317cf9b999936c26a86fe1829d86adf8532', 1);
+INSERT INTO "blobs" (digest, value, refcount) VALUES ('30b0a9e05e714277a2f0e0a522cc89348d311f1160c7d3b6ba82d77d77b8558c', X'6bfccbb65506ebc5a8be5e2c1716fc84a7ef45fc6ce8176d5998f8e8', 1);
+INSERT INTO "blobs" (digest, value, refcount) VALUES ('b16602c12bdfee314754c042d54c7cd2e70fa07b7e608a977c5b03a0d1d13909', X'f1b96a7696a5e3407c23a0401f823af3c7ee0da4588b3a6d1b7f77bdcd7f157cebdac00cf164cdae1e4ca3b5cae513280e7f3fc9b49607dab3d891b92d8a5784296d26117bccbe6a429ecf', 1);
+INSERT INTO "blobs" (digest, value, refcount) VALUES ('a4ed9e4ce89e6c382e2f94bf31d439c82b6f102ff0ee1f79c93f85574f0ba078', X'422ed6c01a292f954e8dd2c8d5106b5ac25e102bdaa377c13ecb9333f37b45488c677bd538e9b94e9eb39e2394279bab2166d40489b2a15f5d83329b6ec4b06b2b55d1c8', 1);
+CREATE TABLE config (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	);
+INSERT INTO "config" (key, value) VALUES ('encryption_key', X'36663034396264623437653539323032316466333962316663613831666565653035326331326362363665313232336438616136666432333466323262333735');
+INSERT INTO "config" (key, value) VALUES ('key_sentinel', X'5aeb284d9107a04c38b082d583ba24683bb039edbc4dd0f13dc778ef8cfb0b51563fafa1ffdd06696ff7138f39608b3b');
+CREATE TABLE policies (
+		subject TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		PRIMARY KEY (subject, pattern)
+	);
+CREATE TABLE revision (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		value INTEGER NOT NULL
+	);
+INSERT INTO "revision" (id, value) VALUES (1, 46);
+CREATE TABLE secrets (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	, digest TEXT, kind TEXT NOT NULL DEFAULT '', owner TEXT NOT NULL DEFAULT '', version INTEGER NOT NULL DEFAULT 0);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('API_KEY', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', '912c4084703c29701c2ce9fd0c36b001e4b8ac341e777bf59047ac5b4d8d2692', '', '', 26);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('API_KEY_COPY', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', '912c4084703c29701c2ce9fd0c36b001e4b8ac341e777bf59047ac5b4d8d2692', '', '', 29);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('DB_URL', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', '0fd4981baf5c63dcf06a50651252bb9acba4f97e5bbfc6e6e603a56663711906', '', 'uid:1000', 32);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('EMPTY', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', '30b0a9e05e714277a2f0e0a522cc89348d311f1160c7d3b6ba82d77d77b8558c', '', '', 35);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('MULTILINE', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', 'b16602c12bdfee314754c042d54c7cd2e70fa07b7e608a977c5b03a0d1d13909', '', '', 38);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('UNICODE', X'', '2026-01-01 00:00:00', '2026-01-01 00:00:00', 'a4ed9e4ce89e6c382e2f94bf31d439c82b6f102ff0ee1f79c93f85574f0ba078', '', '', 41);
+INSERT INTO "secrets" (key, value, created_at, updated_at, digest, kind, owner, version) VALUES ('note/runbook', X'bf0ce88c8c4e537773a5f05867abbaa314c217fcc0be6fc00f274023ca6d75be96b674904afc62a01a3a4992268aa397a33047d246a8f7f91f3e', '2026-01-01 00:00:00', '2026-01-01 00:00:00', NULL, 'note', '', 44);
+CREATE TABLE tokens (
+		name TEXT PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	, expires_at INTEGER NOT NULL DEFAULT 0, subjects TEXT NOT NULL DEFAULT '', scopes TEXT NOT NULL DEFAULT '', ttl INTEGER NOT NULL DEFAULT 0, refresh_hash TEXT, refresh_expires_at INTEGER NOT NULL DEFAULT 0, revoked_at INTEGER NOT NULL DEFAULT 0);
+CREATE TABLE tombstones (
+		key TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	);
+CREATE UNIQUE INDEX tokens_refresh_hash ON tokens (refresh_hash);
+CREATE TRIGGER secrets_delete_revision AFTER DELETE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+CREATE TRIGGER secrets_delete_version AFTER DELETE ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		INSERT OR REPLACE INTO tombstones (key, version)
+		SELECT OLD.key, value FROM revision WHERE id = 1;
+	END;
+CREATE TRIGGER secrets_insert_revision AFTER INSERT ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+CREATE TRIGGER secrets_insert_version AFTER INSERT ON secrets
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE key = NEW.key;
+		DELETE FROM tombstones WHERE key = NEW.key;
+	END;
+CREATE TRIGGER secrets_update_revision AFTER UPDATE ON secrets
+	BEGIN UPDATE revision SET value = value + 1 WHERE id = 1; END;
+CREATE TRIGGER secrets_update_version AFTER UPDATE ON secrets
+	WHEN NEW.version = OLD.version
+	BEGIN
+		UPDATE revision SET value = value + 1 WHERE id = 1;
+		UPDATE secrets SET version = (SELECT value FROM revision WHERE id = 1) WHERE key = NEW.key;
+		DELETE FROM tombstones WHERE key = NEW.key;
+		INSERT OR REPLACE INTO tombstones (key, version)
+		SELECT OLD.key, value FROM revision WHERE id = 1 AND OLD.key != NEW.key;
+	END;
@@ -0,0 +1,130 @@
+// Package gc prunes what a store accumulates: audit and access log
+// entries past their retention, escrowed versions of a secret beyond its
+// newest few, and rows nothing refers to any more. The database is then
+// vacuumed, so the space is returned to the filesystem.
+//
+// The database is pruned in one transaction. Audit events not yet shipped
+// to WORM targets are kept whatever their age, so pruning never opens a
+// gap in the shipped history.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/escrow"
+	"github.com/MQ37/lockbox/internal/worm"
+)
+
+// Options is the retention policy
+type Options struct {
+	// KeepVersions is how many escrowed versions of each secret are kept;
+	// 0 keeps them all
+	KeepVersions int
+	// AuditRetention is how long audit and access log entries are kept; 0
+	// keeps them forever
+	AuditRetention time.Duration
+}
+
+// Result is what Run pruned
+type Result struct {
+	db.GCResult
+	// Versions is the number of escrowed versions pruned
+	Versions int
+	// Reclaimed is how many bytes the store and escrow archive shrank by
+	Reclaimed int64
+}
+
+// Empty reports whether nothing was pruned
+func (r Result) Empty() bool {
+	return r.AuditEvents == 0 && r.Accesses == 0 && r.Orphans == 0 && r.Versions == 0 && r.Reclaimed == 0
+}
+
+// ParseRetention parses a retention period: a number of days such as
+// 180d, or a Go duration such as 72h
+func ParseRetention(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention '%s': expected a positive duration such as 180d or 72h", s)
+	}
+	return d, nil
+}
+
+// Run prunes store by opts at now
+func Run(store *db.Store, opts Options, now time.Time) (Result, error) {
+	var r Result
+	if opts.KeepVersions < 0 {
+		return r, fmt.Errorf("invalid number of versions to keep: %d", opts.KeepVersions)
+	}
+	before, err := store.Size()
+	if err != nil {
+		return r, err
+	}
+
+	gcOpts := db.GCOptions{MaxAuditID: math.MaxInt64, Now: now}
+	if opts.AuditRetention > 0 {
+		gcOpts.LogsBefore = now.Add(-opts.AuditRetention)
+	}
+	if id, ok, err := worm.ShippedAudit(store); err != nil {
+		return r, err
+	} else if ok {
+		gcOpts.MaxAuditID = id
+	}
+	if r.GCResult, err = store.CollectGarbage(gcOpts); err != nil {
+		return r, err
+	}
+	if err := store.Vacuum(); err != nil {
+		return r, err
+	}
+	after, err := store.Size()
+	if err != nil {
+		return r, err
+	}
+	r.Reclaimed = max(before-after, 0)
+
+	if opts.KeepVersions > 0 {
+		archive, err := escrow.Load(store)
+		if err != nil {
+			return r, err
+		}
+		if archive != nil {
+			n, size, err := escrow.Prune(archive.Path, opts.KeepVersions)
+			if err != nil {
+				return r, err
+			}
+			r.Versions = n
+			r.Reclaimed += size
+		}
+	}
+	return r, nil
+}
+
+// Schedule runs Run every interval until ctx is done, passing report what
+// each run pruned or why it failed; runs pruning nothing are not reported
+func Schedule(ctx context.Context, store *db.Store, interval time.Duration, opts Options, report func(Result, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if r, err := Run(store, opts, time.Now()); !r.Empty() || err != nil {
+			report(r, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
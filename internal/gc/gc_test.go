@@ -0,0 +1,69 @@
+package gc
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/escrow"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	store, err := db.OpenStore(filepath.Join(dir, "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	store.SetSecret("API_KEY", []byte("v"))
+	for range 3 {
+		store.Audit("uid:1000", "secret-set", "API_KEY")
+	}
+	store.RecordAccess("cli", "uid:1000", []string{"API_KEY"})
+
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	archivePath := filepath.Join(dir, "lockbox.escrow")
+	escrow.Enable(store, archivePath, key.PublicKey())
+	archive := escrow.New(archivePath, key.PublicKey())
+	for range 5 {
+		archive.Archive(db.Archived{Op: "overwrite", Key: "API_KEY", Value: make([]byte, 64)})
+	}
+
+	// Nothing is old enough yet, and all versions are kept
+	r, err := Run(store, Options{AuditRetention: 24 * time.Hour}, time.Now())
+	if err != nil || r.AuditEvents != 0 || r.Versions != 0 {
+		t.Fatalf("Run = %+v, %v", r, err)
+	}
+
+	r, err = Run(store, Options{KeepVersions: 2, AuditRetention: 180 * 24 * time.Hour}, time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if r.AuditEvents != 3 || r.Accesses != 1 || r.Versions != 3 || r.Reclaimed <= 0 {
+		t.Errorf("Run = %+v", r)
+	}
+	if entries, _ := escrow.ReadFile(archivePath); len(entries) != 2 {
+		t.Errorf("Escrow holds %d versions, expected 2", len(entries))
+	}
+	if value, err := store.GetSecret("API_KEY"); err != nil || string(value) != "v" {
+		t.Errorf("Run touched a live secret: %q, %v", value, err)
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	if d, err := ParseRetention("180d"); err != nil || d != 180*24*time.Hour {
+		t.Errorf("ParseRetention(180d) = %v, %v", d, err)
+	}
+	if d, err := ParseRetention("72h"); err != nil || d != 72*time.Hour {
+		t.Errorf("ParseRetention(72h) = %v, %v", d, err)
+	}
+	for _, s := range []string{"", "0d", "-1h", "soon"} {
+		if _, err := ParseRetention(s); err == nil {
+			t.Errorf("ParseRetention accepted %q", s)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+// Package gitsync keeps a vault's secrets in step across machines through
+// a git repository. Each secret is one file under secrets/, named by a
+// keyed digest of its vault and key and holding its key, value and update
+// time encrypted with the store key, so only ciphertext is committed and
+// the key never leaves the machine. Machines syncing the same repository
+// must share the store key, whose fingerprint is recorded in key.json
+// along with those of the keys it was rotated from. After a rotation the
+// previous keys are kept sealed under the new one, and the next sync
+// re-encrypts the repository.
+//
+// A sync merges three ways: the state last synced, kept as a ref in the
+// clone, the store and the repository. A side that changed since wins, a
+// deletion included; when both did the copy updated later wins.
+package gitsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/replicate"
+)
+
+const (
+	// secretsDir holds the secret files in the repository
+	secretsDir = "secrets"
+	// keyFile records which store key the repository is encrypted with
+	keyFile = "key.json"
+	// previousKeysConfig holds the store keys rotated away from, sealed
+	// with the current key
+	previousKeysConfig = "sync_previous_keys"
+	// baseRef is the commit last synced, in the clone only
+	baseRef = "refs/lockbox/base"
+	// nameContext separates file name digests from value digests
+	nameContext = "lockbox/sync-name/v1\x00"
+)
+
+// ErrWrongKey is returned when a file of the repository cannot be
+// decrypted with the store key
+var ErrWrongKey = errors.New("the repository holds secrets encrypted with another key; sync only stores sharing one key, such as enrolled devices")
+
+// ErrKeyRotated is returned when the repository was re-encrypted with a
+// key that replaced the store key on another machine
+var ErrKeyRotated = errors.New("the repository was re-encrypted after the store key was rotated on another machine; enroll this machine again to get the new key")
+
+// What a sync does to a key
+const (
+	// Pull writes the repository's value to the store
+	Pull = "pull"
+	// Push writes the store's value to the repository
+	Push = "push"
+	// DeleteLocal deletes the key from the store
+	DeleteLocal = "delete-local"
+	// DeleteRemote deletes the key from the repository
+	DeleteRemote = "delete-remote"
+)
+
+// Item is a key that differs between the store and the repository
+type Item struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	// Conflict is set when both sides changed the key since the last sync
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// Merge compares the store's secrets and the repository's with those
+// last synced and returns what to do to each key that differs, sorted by
+// key. With no base, as on the first sync, nothing is deleted.
+func Merge(base, local, remote map[string]replicate.Secret) []Item {
+	keys := map[string]bool{}
+	for _, m := range []map[string]replicate.Secret{base, local, remote} {
+		for key := range m {
+			keys[key] = true
+		}
+	}
+
+	var items []Item
+	for key := range keys {
+		b, bok := base[key]
+		l, lok := local[key]
+		r, rok := remote[key]
+		item := Item{Key: key}
+		switch {
+		case same(l, lok, r, rok):
+			continue
+		case same(r, rok, b, bok):
+			item.Action = Push
+			if !lok {
+				item.Action = DeleteRemote
+			}
+		case same(l, lok, b, bok):
+			item.Action = Pull
+			if !rok {
+				item.Action = DeleteLocal
+			}
+		default:
+			// Both changed: an edit beats a deletion, else the later one wins
+			item.Conflict = true
+			item.Action = Pull
+			if !rok || (lok && l.Updated.After(r.Updated)) {
+				item.Action = Push
+			}
+		}
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b Item) int { return strings.Compare(a.Key, b.Key) })
+	return items
+}
+
+// same reports whether two optional secrets hold the same value
+func same(a replicate.Secret, aok bool, b replicate.Secret, bok bool) bool {
+	return aok == bok && (!aok || bytes.Equal(a.Value, b.Value))
+}
+
+// file is the plaintext of a secret file
+type file struct {
+	Vault   string    `json:"vault"`
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+// keyRecord is the content of keyFile
+type keyRecord struct {
+	Fingerprint string   `json:"fingerprint"`
+	Previous    []string `json:"previous,omitempty"`
+}
+
+// Repo is a clone of the sync repository for one vault
+type Repo struct {
+	dir      string
+	branch   string
+	vault    string
+	key      []byte
+	previous [][]byte
+}
+
+// Dir returns where the clone syncing vault of the store at storePath
+// with url lives: next to the store, one clone per vault and url, so each
+// keeps its own base
+func Dir(storePath, vault, url string) string {
+	sum := sha256.Sum256([]byte(vault + "\n" + url))
+	return filepath.Join(storePath+".sync", hex.EncodeToString(sum[:8]))
+}
+
+// Open clones url into dir, or reuses the clone already there, and
+// fetches branch. Files are encrypted with key; those still encrypted
+// with one of previous are read and re-encrypted on the next write.
+func Open(dir, url, branch, vault string, key []byte, previous [][]byte) (*Repo, error) {
+	r := &Repo{dir: dir, branch: branch, vault: vault, key: key, previous: previous}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+			return nil, err
+		}
+		if _, err := r.git("", "clone", "--quiet", "--no-checkout", url, dir); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := r.git("", "fetch", "--quiet", "origin"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Base returns the secrets as last synced, none before the first sync
+func (r *Repo) Base() (map[string]replicate.Secret, error) {
+	return r.read(baseRef)
+}
+
+// Synced reports whether this clone has synced before; until it has, the
+// repository is met for the first time
+func (r *Repo) Synced() (bool, error) {
+	commit, err := r.resolve(baseRef)
+	return commit != "", err
+}
+
+// Remote returns the secrets on the fetched branch, none if it has no
+// commits yet
+func (r *Repo) Remote() (map[string]replicate.Secret, error) {
+	return r.read(r.remoteRef())
+}
+
+// Write commits the store's secrets for the Push and DeleteRemote items
+// on top of the fetched branch and pushes the commit, then records it as
+// the new base. With nothing to write the fetched branch becomes the base.
+func (r *Repo) Write(items []Item, local map[string]replicate.Secret, message string) error {
+	remote, err := r.resolve(r.remoteRef())
+	if err != nil {
+		return err
+	}
+	record, err := r.record(remote)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := crypto.Fingerprint(r.key)
+	if err != nil {
+		return err
+	}
+	// A repository last written with a previous key, or before keys were
+	// recorded, is rewritten whole
+	rekey := remote != "" && record.Fingerprint != fingerprint
+
+	var writes []Item
+	for _, item := range items {
+		if item.Action == Push || item.Action == DeleteRemote {
+			writes = append(writes, item)
+		}
+	}
+	if len(writes) == 0 && !rekey {
+		if remote == "" {
+			return nil
+		}
+		_, err := r.git("", "update-ref", baseRef, remote)
+		return err
+	}
+
+	if remote != "" {
+		_, err = r.git("", "checkout", "--quiet", "--force", "-B", r.branch, remote)
+	} else {
+		// An empty repository: start the branch with no parent, dropping
+		// any commit left unpushed by a failed sync
+		_, err = r.git("", "symbolic-ref", "HEAD", "refs/heads/"+r.branch)
+		if err == nil {
+			_, err = r.git("", "update-ref", "-d", "HEAD")
+		}
+		if err == nil {
+			_, err = r.git("", "read-tree", "--empty")
+		}
+	}
+	if err == nil {
+		_, err = r.git("", "clean", "--quiet", "--force", "-d", "-x")
+	}
+	if err != nil {
+		return err
+	}
+	if rekey {
+		files, err := r.decryptTree(remote)
+		if err == nil {
+			err = os.RemoveAll(filepath.Join(r.dir, secretsDir))
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Join(r.dir, secretsDir), 0700)
+		}
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			err := r.writeFile(f)
+			clear(f.Value)
+			if err != nil {
+				return err
+			}
+		}
+		message += "\n\nRe-encrypted with the current store key"
+	}
+	if err := os.MkdirAll(filepath.Join(r.dir, secretsDir), 0700); err != nil {
+		return err
+	}
+	for _, item := range writes {
+		if item.Action == DeleteRemote {
+			path, err := r.path(r.vault, item.Key)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(filepath.Join(r.dir, path)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		sec := local[item.Key]
+		if err := r.writeFile(file{Vault: r.vault, Key: item.Key, Value: sec.Value, Updated: sec.Updated.UTC()}); err != nil {
+			return err
+		}
+	}
+
+	// Record the key, and the keys it replaced for machines still holding
+	// one of them
+	if record.Fingerprint != fingerprint {
+		for _, fp := range append([]string{record.Fingerprint}, r.previousFingerprints()...) {
+			if fp != "" && fp != fingerprint && !slices.Contains(record.Previous, fp) {
+				record.Previous = append(record.Previous, fp)
+			}
+		}
+		record.Fingerprint = fingerprint
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, keyFile), append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	if _, err := r.git("", "add", "--all", secretsDir, keyFile); err != nil {
+		return err
+	}
+	if _, err := r.git("", "config", "user.email"); err != nil {
+		// No identity configured: commit as lockbox in this clone only
+		r.git("", "config", "user.name", "lockbox")
+		r.git("", "config", "user.email", "lockbox@localhost")
+	}
+	if _, err := r.git("", "commit", "--quiet", "--message", message); err != nil {
+		return err
+	}
+	if _, err := r.git("", "push", "--quiet", "origin", "HEAD:refs/heads/"+r.branch); err != nil {
+		return fmt.Errorf("%w; the store is up to date, run sync again to retry", err)
+	}
+	_, err = r.git("", "update-ref", baseRef, "HEAD")
+	return err
+}
+
+func (r *Repo) remoteRef() string {
+	return "refs/remotes/origin/" + r.branch
+}
+
+// writeFile encrypts f into its file in the clone
+func (r *Repo) writeFile(f file) error {
+	path, err := r.path(f.Vault, f.Key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	encrypted, err := crypto.Encrypt(data, r.key)
+	clear(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.dir, path), encrypted, 0600)
+}
+
+// path returns the file of key in vault, relative to the clone
+func (r *Repo) path(vault, key string) (string, error) {
+	name, err := crypto.Digest([]byte(nameContext+vault+"/"+key), r.key)
+	if err != nil {
+		return "", err
+	}
+	return secretsDir + "/" + name, nil
+}
+
+// resolve returns the commit ref points to, "" if it does not exist
+func (r *Repo) resolve(ref string) (string, error) {
+	out, err := r.git("", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// read decrypts the secret files of the vault in the tree of ref
+func (r *Repo) read(ref string) (map[string]replicate.Secret, error) {
+	secrets := map[string]replicate.Secret{}
+	commit, err := r.resolve(ref)
+	if err != nil || commit == "" {
+		return secrets, err
+	}
+	files, err := r.decryptTree(commit)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Vault == r.vault {
+			secrets[f.Key] = replicate.Secret{Value: f.Value, Updated: f.Updated}
+		}
+	}
+	return secrets, nil
+}
+
+// decryptTree decrypts every secret file in the tree of commit, of any
+// vault, with the store key or a previous one
+func (r *Repo) decryptTree(commit string) ([]file, error) {
+	out, err := r.git("", "ls-tree", "-r", "-z", commit, secretsDir+"/")
+	if err != nil {
+		return nil, err
+	}
+	// Each entry is "<mode> blob <oid>\t<path>"
+	var objects []string
+	for _, entry := range strings.Split(out, "\x00") {
+		if fields := strings.Fields(entry); len(fields) >= 3 && fields[1] == "blob" {
+			objects = append(objects, fields[2])
+		}
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	blobs, err := r.git(strings.Join(objects, "\n")+"\n", "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(strings.NewReader(blobs))
+	files := make([]file, 0, len(objects))
+	for range objects {
+		// Each blob is "<oid> blob <size>\n<content>\n"
+		header, err := in.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", commit, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("failed to read %s: %s", commit, strings.TrimSpace(header))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", commit, err)
+		}
+		encrypted := make([]byte, size+1)
+		if _, err := io.ReadFull(in, encrypted); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", commit, err)
+		}
+		data, err := crypto.Decrypt(encrypted[:size], r.key)
+		for _, key := range r.previous {
+			if err == nil {
+				break
+			}
+			data, err = crypto.Decrypt(encrypted[:size], key)
+		}
+		if err != nil {
+			return nil, r.keyError(commit)
+		}
+		var f file
+		err = json.Unmarshal(data, &f)
+		clear(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret file %s: %w", fields[0], err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// record returns the key record in the tree of commit, empty if there is
+// none
+func (r *Repo) record(commit string) (keyRecord, error) {
+	var record keyRecord
+	if commit == "" {
+		return record, nil
+	}
+	if out, err := r.git("", "ls-tree", commit, keyFile); err != nil || out == "" {
+		return record, err
+	}
+	data, err := r.git("", "cat-file", "blob", commit+":"+keyFile)
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return record, fmt.Errorf("invalid %s: %w", keyFile, err)
+	}
+	return record, nil
+}
+
+// keyError explains why a file of commit could not be decrypted: the
+// store key was rotated away from on another machine, or the repository
+// belongs to another store
+func (r *Repo) keyError(commit string) error {
+	record, err := r.record(commit)
+	if err != nil {
+		return err
+	}
+	if fingerprint, err := crypto.Fingerprint(r.key); err == nil && slices.Contains(record.Previous, fingerprint) {
+		return ErrKeyRotated
+	}
+	return ErrWrongKey
+}
+
+// previousFingerprints returns the fingerprints of the previous keys
+func (r *Repo) previousFingerprints() []string {
+	var fps []string
+	for _, key := range r.previous {
+		if fp, err := crypto.Fingerprint(key); err == nil {
+			fps = append(fps, fp)
+		}
+	}
+	return fps
+}
+
+// Rekey returns the config entry keeping oldKey, and any keys it replaced,
+// sealed with newKey when the store key is rotated, so a sync repository
+// still encrypted with one of them can be re-encrypted on the next sync.
+// Stores that never synced need none.
+func Rekey(store *db.Store, oldKey, newKey []byte) (map[string][]byte, error) {
+	if _, err := os.Stat(store.Path() + ".sync"); os.IsNotExist(err) {
+		return nil, nil
+	}
+	keys, err := PreviousKeys(store, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, slices.Clone(oldKey))
+	data, err := json.Marshal(keys)
+	for _, key := range keys {
+		clear(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := crypto.Encrypt(data, newKey)
+	clear(data)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{previousKeysConfig: sealed}, nil
+}
+
+// PreviousKeys returns the store keys rotated away from since the store
+// first synced, oldest first
+func PreviousKeys(store *db.Store, key []byte) ([][]byte, error) {
+	sealed, err := store.GetConfig(previousKeysConfig)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := crypto.Decrypt(sealed, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the previous store keys: %w", err)
+	}
+	defer clear(data)
+	var keys [][]byte
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("stored previous store keys are corrupt: %w", err)
+	}
+	return keys, nil
+}
+
+// git runs git in the clone with stdin, returning its output
+func (r *Repo) git(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	if args[0] != "clone" {
+		cmd.Dir = r.dir
+	}
+	// Never ask for credentials on the terminal mid-sync
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s failed: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
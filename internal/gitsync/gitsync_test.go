@@ -0,0 +1,205 @@
+package gitsync
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/replicate"
+)
+
+func TestMerge(t *testing.T) {
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	sec := func(v string, at time.Time) replicate.Secret { return replicate.Secret{Value: []byte(v), Updated: at} }
+	base := map[string]replicate.Secret{
+		"KEPT": sec("a", t1), "LOCAL_EDIT": sec("a", t1), "REMOTE_EDIT": sec("a", t1),
+		"LOCAL_DELETE": sec("a", t1), "REMOTE_DELETE": sec("a", t1),
+		"BOTH_EDIT": sec("a", t1), "EDIT_VS_DELETE": sec("a", t1),
+	}
+	local := map[string]replicate.Secret{
+		"KEPT": sec("a", t1), "LOCAL_EDIT": sec("b", t2), "REMOTE_EDIT": sec("a", t1),
+		"REMOTE_DELETE": sec("a", t1), "BOTH_EDIT": sec("b", t1), "EDIT_VS_DELETE": sec("b", t1),
+		"LOCAL_NEW": sec("n", t1),
+	}
+	remote := map[string]replicate.Secret{
+		"KEPT": sec("a", t1), "LOCAL_EDIT": sec("a", t1), "REMOTE_EDIT": sec("c", t2),
+		"LOCAL_DELETE": sec("a", t1), "BOTH_EDIT": sec("c", t2),
+		"REMOTE_NEW": sec("n", t1),
+	}
+
+	want := map[string]Item{
+		"BOTH_EDIT":      {Action: Pull, Conflict: true},
+		"EDIT_VS_DELETE": {Action: Push, Conflict: true},
+		"LOCAL_DELETE":   {Action: DeleteRemote},
+		"LOCAL_EDIT":     {Action: Push},
+		"LOCAL_NEW":      {Action: Push},
+		"REMOTE_DELETE":  {Action: DeleteLocal},
+		"REMOTE_EDIT":    {Action: Pull},
+		"REMOTE_NEW":     {Action: Pull},
+	}
+	items := Merge(base, local, remote)
+	if len(items) != len(want) {
+		t.Fatalf("Merge returned %d items, want %d: %+v", len(items), len(want), items)
+	}
+	for _, item := range items {
+		if w := want[item.Key]; item.Action != w.Action || item.Conflict != w.Conflict {
+			t.Errorf("%s: %+v, want %+v", item.Key, item, w)
+		}
+	}
+
+	// Without a base nothing is deleted
+	for _, item := range Merge(nil, local, remote) {
+		if item.Action == DeleteLocal || item.Action == DeleteRemote {
+			t.Errorf("first sync deletes %s", item.Key)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	dir := t.TempDir()
+	url := filepath.Join(dir, "remote.git")
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", url).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v %s", err, out)
+	}
+	key, _ := crypto.GenerateKey()
+	at := time.Now().UTC().Truncate(time.Second)
+
+	laptop, err := Open(filepath.Join(dir, "laptop"), url, "main", "default", key, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	local := map[string]replicate.Secret{"API_KEY": {Value: []byte("sk-1"), Updated: at}}
+	items := Merge(nil, local, nil)
+	if err := laptop.Write(items, local, "sync"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Another machine sharing the key sees the secret
+	server, err := Open(filepath.Join(dir, "server"), url, "main", "default", key, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	remote, err := server.Remote()
+	if err != nil || !bytes.Equal(remote["API_KEY"].Value, []byte("sk-1")) || !remote["API_KEY"].Updated.Equal(at) {
+		t.Fatalf("Remote = %v, %v", remote, err)
+	}
+	if base, _ := server.Base(); len(base) != 0 {
+		t.Errorf("Base before the first sync = %v", base)
+	}
+	if synced, err := server.Synced(); synced || err != nil {
+		t.Errorf("Synced before the first sync = %v, %v", synced, err)
+	}
+
+	// Only ciphertext is committed
+	out, _ := exec.Command("git", "-C", url, "log", "-p", "--all").CombinedOutput()
+	if bytes.Contains(out, []byte("API_KEY")) || bytes.Contains(out, []byte("sk-1")) {
+		t.Errorf("repository holds plaintext:\n%s", out)
+	}
+
+	// A deletion is pushed once both have synced
+	if err := server.Write(Merge(nil, remote, remote), remote, "sync"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if synced, _ := server.Synced(); !synced {
+		t.Error("Synced after the first sync = false")
+	}
+	base, _ := server.Base()
+	items = Merge(base, map[string]replicate.Secret{}, remote)
+	if len(items) != 1 || items[0].Action != DeleteRemote {
+		t.Fatalf("Merge after delete = %+v", items)
+	}
+	if err := server.Write(items, nil, "sync"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	laptop, _ = Open(filepath.Join(dir, "laptop"), url, "main", "default", key, nil)
+	if remote, _ := laptop.Remote(); len(remote) != 0 {
+		t.Errorf("Remote after delete = %v", remote)
+	}
+
+	other, _ := crypto.GenerateKey()
+	server.Write([]Item{{Key: "X", Action: Push}}, map[string]replicate.Secret{"X": {Value: []byte("x")}}, "sync")
+	stranger, err := Open(filepath.Join(dir, "stranger"), url, "main", "default", other, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := stranger.Remote(); err != ErrWrongKey {
+		t.Errorf("Remote with another key = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestRotatedKey(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	dir := t.TempDir()
+	url := filepath.Join(dir, "remote.git")
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", url).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v %s", err, out)
+	}
+	oldKey, _ := crypto.GenerateKey()
+	at := time.Now().UTC().Truncate(time.Second)
+
+	laptop, _ := Open(filepath.Join(dir, "laptop"), url, "main", "default", oldKey, nil)
+	local := map[string]replicate.Secret{"API_KEY": {Value: []byte("sk-1"), Updated: at}}
+	if err := laptop.Write(Merge(nil, local, nil), local, "sync"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	other, _ := Open(filepath.Join(dir, "other"), url, "main", "prod", oldKey, nil)
+	prod := map[string]replicate.Secret{"DB_URL": {Value: []byte("postgres://"), Updated: at}}
+	if err := other.Write(Merge(nil, prod, nil), prod, "sync"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The laptop rotates its key: the repository and its base are read
+	// with the previous key, and rewritten with the new one
+	newKey, _ := crypto.GenerateKey()
+	laptop, _ = Open(filepath.Join(dir, "laptop"), url, "main", "default", newKey, [][]byte{oldKey})
+	base, err := laptop.Base()
+	if err != nil || len(base) != 1 {
+		t.Fatalf("Base after rotation = %v, %v", base, err)
+	}
+	remote, err := laptop.Remote()
+	if err != nil || !bytes.Equal(remote["API_KEY"].Value, []byte("sk-1")) {
+		t.Fatalf("Remote after rotation = %v, %v", remote, err)
+	}
+	items := Merge(base, remote, remote)
+	if len(items) != 0 {
+		t.Fatalf("Merge after rotation = %+v", items)
+	}
+	if err := laptop.Write(items, remote, "sync"); err != nil {
+		t.Fatalf("Write after rotation: %v", err)
+	}
+
+	// The new key alone reads every vault now
+	fresh, _ := Open(filepath.Join(dir, "fresh"), url, "main", "prod", newKey, nil)
+	if remote, err := fresh.Remote(); err != nil || !bytes.Equal(remote["DB_URL"].Value, []byte("postgres://")) {
+		t.Errorf("Remote with the new key = %v, %v", remote, err)
+	}
+	out, _ := exec.Command("git", "-C", url, "show", "main:"+keyFile).CombinedOutput()
+	newFP, _ := crypto.Fingerprint(newKey)
+	oldFP, _ := crypto.Fingerprint(oldKey)
+	if !bytes.Contains(out, []byte(newFP)) || !bytes.Contains(out, []byte(oldFP)) {
+		t.Errorf("%s does not record both keys:\n%s", keyFile, out)
+	}
+
+	// A machine still holding the old key is told it was rotated, one
+	// with an unrelated key that the repository is not its own
+	other, _ = Open(filepath.Join(dir, "other"), url, "main", "prod", oldKey, nil)
+	if _, err := other.Remote(); err != ErrKeyRotated {
+		t.Errorf("Remote with the rotated key = %v, want ErrKeyRotated", err)
+	}
+	stranger, _ := crypto.GenerateKey()
+	foreign, _ := Open(filepath.Join(dir, "stranger"), url, "main", "prod", stranger, nil)
+	if _, err := foreign.Remote(); err != ErrWrongKey {
+		t.Errorf("Remote with another key = %v, want ErrWrongKey", err)
+	}
+}
@@ -0,0 +1,196 @@
+package harden
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Config describes the deployment a confinement profile is generated for
+type Config struct {
+	// Binary is the absolute path of the lockbox executable
+	Binary string
+	// StorePath is the absolute path of the SQLite database
+	StorePath string
+	// Socket is the unix socket served on, if any
+	Socket string
+	// Port is the TCP port served on, if any
+	Port string
+	// AllowRun lets 'lockbox run' exec commands, which then run unconfined
+	AllowRun bool
+}
+
+// File is a generated policy file
+type File struct {
+	Name    string
+	Content string
+}
+
+// validate rejects paths that would break out of the profile syntax
+func (c Config) validate() error {
+	paths := [][2]string{{"binary", c.Binary}, {"store path", c.StorePath}}
+	if c.Socket != "" {
+		paths = append(paths, [2]string{"socket", c.Socket})
+	}
+	for _, np := range paths {
+		name, p := np[0], np[1]
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("%s must be an absolute path, got '%s'", name, p)
+		}
+		if strings.ContainsAny(p, " \t\n\"{}[]*?,#") {
+			return fmt.Errorf("%s '%s' contains characters not allowed in a profile", name, p)
+		}
+	}
+	if c.Port != "" {
+		if n, err := strconv.Atoi(c.Port); err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != c.Port {
+			return fmt.Errorf("port must be a number from 1 to 65535, got '%s'", c.Port)
+		}
+	}
+	return nil
+}
+
+// AppArmor returns an AppArmor profile confining lockbox to its store
+// directory, socket and loopback networking
+func AppArmor(c Config) ([]File, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := apparmorTemplate.Execute(&buf, map[string]any{
+		"Binary":   c.Binary,
+		"StoreDir": filepath.Dir(c.StorePath),
+		"Socket":   c.Socket,
+		"Port":     c.Port,
+		"AllowRun": c.AllowRun,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to render AppArmor profile: %w", err)
+	}
+
+	// Profiles in /etc/apparmor.d are named after the binary path
+	name := strings.ReplaceAll(strings.TrimPrefix(c.Binary, "/"), "/", ".")
+	return []File{{Name: name, Content: buf.String()}}, nil
+}
+
+// SELinux returns a reference-policy module (type enforcement and file
+// contexts) for running lockbox serve in its own domain
+func SELinux(c Config) ([]File, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	data := map[string]any{
+		"Binary":    regexp.QuoteMeta(c.Binary),
+		"StoreDir":  regexp.QuoteMeta(filepath.Dir(c.StorePath)),
+		"Socket":    regexp.QuoteMeta(c.Socket),
+		"HasSocket": c.Socket != "",
+		"Port":      c.Port,
+	}
+
+	var te, fc bytes.Buffer
+	if err := selinuxTETemplate.Execute(&te, data); err != nil {
+		return nil, fmt.Errorf("failed to render SELinux module: %w", err)
+	}
+	if err := selinuxFCTemplate.Execute(&fc, data); err != nil {
+		return nil, fmt.Errorf("failed to render SELinux file contexts: %w", err)
+	}
+
+	return []File{
+		{Name: "lockbox.te", Content: te.String()},
+		{Name: "lockbox.fc", Content: fc.String()},
+	}, nil
+}
+
+var apparmorTemplate = template.Must(template.New("apparmor").Parse(`# AppArmor profile for lockbox, generated by 'lockbox harden --generate-apparmor'
+# Install: cp to /etc/apparmor.d/ and run 'apparmor_parser -r <file>'
+
+abi <abi/3.0>,
+
+include <tunables/global>
+
+profile lockbox {{.Binary}} {
+  include <abstractions/base>
+  include <abstractions/nameservice>
+
+  {{.Binary}} mr,
+
+  # Encrypted store; SQLite also needs its journal next to the database
+  owner {{.StoreDir}}/ rw,
+  owner {{.StoreDir}}/** rwk,
+{{- if .Socket}}
+
+  # Unix socket for serve --socket and --remote unix://
+  {{.Socket}} rw,
+  network unix stream,
+{{- end}}
+{{- if .Port}}
+
+  # serve binds 127.0.0.1:{{.Port}}; --remote clients connect out
+  network inet stream,
+  network inet6 stream,
+{{- end}}
+
+{{- if .AllowRun}}
+
+  # 'lockbox run' hands secrets to an arbitrary command, which runs
+  # unconfined (harden --allow-run)
+  /** Ux,
+{{- end}}
+}
+`))
+
+var selinuxTETemplate = template.Must(template.New("te").Parse(`# SELinux module for lockbox, generated by 'lockbox harden --generate-selinux'
+# Build and load:
+#   make -f /usr/share/selinux/devel/Makefile lockbox.pp
+#   semodule -i lockbox.pp
+#   restorecon -Rv <store dir> <binary>
+{{- if .Port}}
+#   semanage port -a -t lockbox_port_t -p tcp {{.Port}}
+{{- end}}
+
+policy_module(lockbox, 1.0.0)
+
+type lockbox_t;
+type lockbox_exec_t;
+init_daemon_domain(lockbox_t, lockbox_exec_t)
+
+type lockbox_db_t;
+files_type(lockbox_db_t)
+
+allow lockbox_t self:process { signal_perms };
+allow lockbox_t self:fifo_file rw_fifo_file_perms;
+
+# Encrypted store and SQLite journal
+manage_dirs_pattern(lockbox_t, lockbox_db_t, lockbox_db_t)
+manage_files_pattern(lockbox_t, lockbox_db_t, lockbox_db_t)
+{{- if .HasSocket}}
+
+# Unix socket for serve --socket, with SO_PEERCRED lookups
+type lockbox_var_run_t;
+files_pid_file(lockbox_var_run_t)
+manage_sock_files_pattern(lockbox_t, lockbox_var_run_t, lockbox_var_run_t)
+files_pid_filetrans(lockbox_t, lockbox_var_run_t, sock_file)
+allow lockbox_t self:unix_stream_socket { create_stream_socket_perms connectto };
+auth_use_nsswitch(lockbox_t)
+{{- end}}
+{{- if .Port}}
+
+# serve on 127.0.0.1:{{.Port}}
+type lockbox_port_t;
+corenet_port(lockbox_port_t)
+allow lockbox_t self:tcp_socket create_stream_socket_perms;
+allow lockbox_t lockbox_port_t:tcp_socket name_bind;
+corenet_tcp_bind_generic_node(lockbox_t)
+{{- end}}
+`))
+
+var selinuxFCTemplate = template.Must(template.New("fc").Parse(`{{.Binary}}	--	gen_context(system_u:object_r:lockbox_exec_t,s0)
+{{.StoreDir}}(/.*)?	gen_context(system_u:object_r:lockbox_db_t,s0)
+{{- if .HasSocket}}
+{{.Socket}}	-s	gen_context(system_u:object_r:lockbox_var_run_t,s0)
+{{- end}}
+`))
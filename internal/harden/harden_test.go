@@ -0,0 +1,95 @@
+package harden
+
+import (
+	"strings"
+	"testing"
+)
+
+var testConfig = Config{
+	Binary:    "/usr/local/bin/lockbox",
+	StorePath: "/var/lib/lockbox/1000/lockbox.db",
+	Socket:    "/run/lockbox.sock",
+	Port:      "8100",
+}
+
+func TestAppArmor(t *testing.T) {
+	files, err := AppArmor(testConfig)
+	if err != nil {
+		t.Fatalf("AppArmor failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "usr.local.bin.lockbox" {
+		t.Fatalf("Unexpected files: %+v", files)
+	}
+
+	profile := files[0].Content
+	for _, want := range []string{
+		"profile lockbox /usr/local/bin/lockbox {",
+		"owner /var/lib/lockbox/1000/** rwk,",
+		"/run/lockbox.sock rw,",
+		"network inet stream,",
+	} {
+		if !strings.Contains(profile, want) {
+			t.Errorf("Profile missing %q:\n%s", want, profile)
+		}
+	}
+
+	// Commands may only be exec'd unconfined when asked for
+	if strings.Contains(profile, "Ux") {
+		t.Errorf("Profile lets commands run unconfined by default:\n%s", profile)
+	}
+	allowRun := testConfig
+	allowRun.AllowRun = true
+	files, _ = AppArmor(allowRun)
+	if !strings.Contains(files[0].Content, "/** Ux,") {
+		t.Errorf("Profile with AllowRun is missing the exec rule:\n%s", files[0].Content)
+	}
+
+	// Without a port no TCP networking is granted
+	noPort := testConfig
+	noPort.Port = ""
+	files, _ = AppArmor(noPort)
+	if strings.Contains(files[0].Content, "network inet") {
+		t.Errorf("Profile grants TCP networking without a port")
+	}
+}
+
+func TestSELinux(t *testing.T) {
+	files, err := SELinux(testConfig)
+	if err != nil {
+		t.Fatalf("SELinux failed: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != "lockbox.te" || files[1].Name != "lockbox.fc" {
+		t.Fatalf("Unexpected files: %+v", files)
+	}
+	if !strings.Contains(files[0].Content, "semanage port -a -t lockbox_port_t -p tcp 8100") {
+		t.Errorf("Module missing port labelling:\n%s", files[0].Content)
+	}
+	for _, want := range []string{
+		`/usr/local/bin/lockbox	--	gen_context(system_u:object_r:lockbox_exec_t,s0)`,
+		`/var/lib/lockbox/1000(/.*)?	gen_context`,
+		`/run/lockbox\.sock	-s	gen_context`,
+	} {
+		if !strings.Contains(files[1].Content, want) {
+			t.Errorf("File contexts missing %q:\n%s", want, files[1].Content)
+		}
+	}
+}
+
+func TestRejectsUnsafePaths(t *testing.T) {
+	for _, c := range []Config{
+		{Binary: "lockbox", StorePath: "/var/lib/lockbox.db"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/a b/lockbox.db"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/x.db", Socket: "/run/{x}.sock"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/x.db", Port: "8100,\n  /** Ux"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/x.db", Port: "0"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/x.db", Port: "65536"},
+		{Binary: "/usr/bin/lockbox", StorePath: "/tmp/x.db", Port: "+80"},
+	} {
+		if _, err := AppArmor(c); err == nil {
+			t.Errorf("AppArmor accepted %+v", c)
+		}
+		if _, err := SELinux(c); err == nil {
+			t.Errorf("SELinux accepted %+v", c)
+		}
+	}
+}
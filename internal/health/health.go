@@ -0,0 +1,133 @@
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// LastBackupConfigKey is the config entry holding the RFC 3339 time of the
+// most recent successful backup
+const LastBackupConfigKey = "last_backup_at"
+
+// Check statuses
+const (
+	StatusOK      = "ok"
+	StatusFail    = "fail"
+	StatusSkipped = "skipped"
+)
+
+// Check is the result of a single readiness check
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Report is the combined result of all readiness checks
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Ready reports whether the report has no failed checks
+func (r Report) Ready() bool {
+	return r.Status == StatusOK
+}
+
+// Options tunes the readiness checks
+type Options struct {
+	// MaxBackupAge fails the backup check when the last backup is older.
+	// Zero only reports the age without failing.
+	MaxBackupAge time.Duration
+}
+
+// Readiness runs all readiness checks against an open store and its key
+func Readiness(store *db.Store, key []byte, opts Options) Report {
+	checks := []Check{
+		checkDatabase(store),
+		checkKey(key),
+		checkDiskWritable(store),
+		checkLastBackup(store, opts.MaxBackupAge),
+	}
+
+	report := Report{Status: StatusOK, Checks: checks}
+	for _, c := range checks {
+		if c.Status == StatusFail {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// checkDatabase verifies the store can be queried
+func checkDatabase(store *db.Store) Check {
+	if err := store.Ping(); err != nil {
+		return Check{Name: "database", Status: StatusFail, Message: err.Error()}
+	}
+	return Check{Name: "database", Status: StatusOK}
+}
+
+// checkKey verifies the encryption key is available and usable
+func checkKey(key []byte) Check {
+	if err := crypto.SelfTest(); err != nil {
+		return Check{Name: "key", Status: StatusFail, Message: err.Error()}
+	}
+	probe := []byte("lockbox-readiness-probe")
+	encrypted, err := crypto.Encrypt(probe, key)
+	if err != nil {
+		return Check{Name: "key", Status: StatusFail, Message: err.Error()}
+	}
+	decrypted, err := crypto.Decrypt(encrypted, key)
+	if err != nil {
+		return Check{Name: "key", Status: StatusFail, Message: err.Error()}
+	}
+	if !bytes.Equal(probe, decrypted) {
+		return Check{Name: "key", Status: StatusFail, Message: "encryption round trip mismatch"}
+	}
+	return Check{Name: "key", Status: StatusOK}
+}
+
+// checkDiskWritable verifies a file can be created next to the database
+func checkDiskWritable(store *db.Store) Check {
+	f, err := os.CreateTemp(filepath.Dir(store.Path()), ".lockbox-probe-*")
+	if err != nil {
+		return Check{Name: "disk", Status: StatusFail, Message: err.Error()}
+	}
+	name := f.Name()
+	_, writeErr := f.Write([]byte("ok"))
+	f.Close()
+	os.Remove(name)
+	if writeErr != nil {
+		return Check{Name: "disk", Status: StatusFail, Message: writeErr.Error()}
+	}
+	return Check{Name: "disk", Status: StatusOK}
+}
+
+// checkLastBackup reports the age of the last backup, failing when it is
+// older than maxAge
+func checkLastBackup(store *db.Store, maxAge time.Duration) Check {
+	value, err := store.GetConfig(LastBackupConfigKey)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return Check{Name: "backup", Status: StatusSkipped, Message: "no backup recorded"}
+		}
+		return Check{Name: "backup", Status: StatusFail, Message: err.Error()}
+	}
+
+	last, err := time.Parse(time.RFC3339, string(value))
+	if err != nil {
+		return Check{Name: "backup", Status: StatusFail, Message: fmt.Sprintf("invalid backup timestamp: %v", err)}
+	}
+
+	age := time.Since(last).Truncate(time.Second)
+	if maxAge > 0 && age > maxAge {
+		return Check{Name: "backup", Status: StatusFail, Message: fmt.Sprintf("last backup %s ago exceeds %s", age, maxAge)}
+	}
+	return Check{Name: "backup", Status: StatusOK, Message: fmt.Sprintf("last backup %s ago", age)}
+}
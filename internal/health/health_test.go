@@ -0,0 +1,87 @@
+package health
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// newTestStore opens a store backed by a fresh temporary database
+func newTestStore(t *testing.T) *db.Store {
+	t.Helper()
+
+	tmpDir := fmt.Sprintf("/tmp/lockbox-health-test-%d", time.Now().UnixNano())
+	os.MkdirAll(tmpDir, 0700)
+	os.Setenv("LOCKBOX_DB_PATH", tmpDir+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+		os.Unsetenv("LOCKBOX_DB_PATH")
+		os.RemoveAll(tmpDir)
+	})
+
+	return store
+}
+
+func findCheck(r Report, name string) Check {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return Check{}
+}
+
+func TestReadiness(t *testing.T) {
+	store := newTestStore(t)
+	key, _ := crypto.GenerateKey()
+
+	report := Readiness(store, key, Options{})
+	if !report.Ready() {
+		t.Fatalf("Expected ready report, got %+v", report)
+	}
+	if c := findCheck(report, "backup"); c.Status != StatusSkipped {
+		t.Errorf("Expected backup check to be skipped, got %+v", c)
+	}
+}
+
+func TestReadinessBadKey(t *testing.T) {
+	store := newTestStore(t)
+
+	report := Readiness(store, []byte("short"), Options{})
+	if report.Ready() {
+		t.Fatal("Expected report to fail with an invalid key")
+	}
+	if c := findCheck(report, "key"); c.Status != StatusFail {
+		t.Errorf("Expected key check to fail, got %+v", c)
+	}
+}
+
+func TestReadinessStaleBackup(t *testing.T) {
+	store := newTestStore(t)
+	key, _ := crypto.GenerateKey()
+
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	store.SetConfig(LastBackupConfigKey, []byte(old))
+
+	if report := Readiness(store, key, Options{}); !report.Ready() {
+		t.Errorf("Expected old backup to pass without a max age, got %+v", report)
+	}
+
+	report := Readiness(store, key, Options{MaxBackupAge: 24 * time.Hour})
+	if report.Ready() {
+		t.Fatal("Expected report to fail with a stale backup")
+	}
+	if c := findCheck(report, "backup"); c.Status != StatusFail {
+		t.Errorf("Expected backup check to fail, got %+v", c)
+	}
+}
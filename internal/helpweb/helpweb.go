@@ -0,0 +1,157 @@
+// Package helpweb serves a searchable HTML reference of the commands, the
+// HTTP API and the README's recipes, for machines without internet access
+// to the online docs. Everything is embedded in the binary.
+package helpweb
+
+import (
+	"bytes"
+	_ "embed"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/server"
+)
+
+//go:embed index.html
+var page string
+
+// Flag is a command line flag
+type Flag struct {
+	Name      string
+	Shorthand string
+	Type      string
+	Default   string
+	Usage     string
+}
+
+// Command is one command of the tree
+type Command struct {
+	// Path is the full command, e.g. "lockbox backup restore"
+	Path  string
+	Usage string
+	Short string
+	Long  string
+	Flags []Flag
+}
+
+// Recipe is a section of the README with its examples
+type Recipe struct {
+	ID    string
+	Title string
+	Body  template.HTML
+}
+
+// Reference is everything the page shows
+type Reference struct {
+	Commands    []Command
+	GlobalFlags []Flag
+	Endpoints   []server.Endpoint
+	Recipes     []Recipe
+}
+
+// Handler renders ref once and serves it at /
+func Handler(ref Reference) (http.Handler, error) {
+	tmpl, err := template.New("index").Funcs(template.FuncMap{"anchor": anchor}).Parse(page)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ref); err != nil {
+		return nil, err
+	}
+	body := buf.Bytes()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+		w.Write(body)
+	}), nil
+}
+
+// Recipes splits markdown into a recipe per "##" or "###" section,
+// leaving out sections without text
+func Recipes(markdown string) []Recipe {
+	var recipes []Recipe
+	var title string
+	var body []string
+	flush := func() {
+		text := strings.TrimSpace(strings.Join(body, "\n"))
+		if title != "" && text != "" {
+			recipes = append(recipes, Recipe{ID: "recipe-" + anchor(title), Title: strings.ReplaceAll(title, "`", ""), Body: render(text)})
+		}
+		body = nil
+	}
+
+	fenced := false
+	for _, line := range strings.Split(markdown, "\n") {
+		if strings.HasPrefix(line, "```") {
+			fenced = !fenced
+		}
+		if !fenced && (strings.HasPrefix(line, "## ") || strings.HasPrefix(line, "### ")) {
+			flush()
+			title = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	return recipes
+}
+
+// inlineCode matches `code` spans in escaped text
+var inlineCode = regexp.MustCompile("`([^`]+)`")
+
+// render turns markdown into HTML: fenced blocks become pre elements and
+// other text paragraphs keeping their line breaks. Other markup is left
+// as written, which reads well enough.
+func render(text string) template.HTML {
+	var b strings.Builder
+	var para []string
+	endPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + inlineCode.ReplaceAllString(html.EscapeString(strings.Join(para, "\n")), "<code>$1</code>") + "</p>\n")
+			para = nil
+		}
+	}
+
+	var code []string
+	fenced := false
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case strings.HasPrefix(line, "```"):
+			if fenced {
+				b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+				code = nil
+			} else {
+				endPara()
+			}
+			fenced = !fenced
+		case fenced:
+			code = append(code, line)
+		case strings.TrimSpace(line) == "":
+			endPara()
+		default:
+			para = append(para, line)
+		}
+	}
+	if fenced {
+		b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+	}
+	endPara()
+	return template.HTML(b.String())
+}
+
+// nonAnchor matches runs of characters left out of anchors
+var nonAnchor = regexp.MustCompile(`[^a-z0-9]+`)
+
+// anchor returns an element ID for a title, such as "lockbox-backup-restore"
+func anchor(title string) string {
+	return strings.Trim(nonAnchor.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
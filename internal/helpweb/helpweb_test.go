@@ -0,0 +1,53 @@
+package helpweb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/server"
+)
+
+const readme = "# Lockbox\n\nIntro\n\n## Commands\n\n### `lockbox get KEY`\n\nPrints a value, `-o json` for <scripts>.\n\n```bash\nlockbox get API_KEY\n## not a heading\n```\n\n### Empty\n"
+
+func TestRecipes(t *testing.T) {
+	recipes := Recipes(readme)
+	if len(recipes) != 1 {
+		t.Fatalf("Recipes = %+v, want only the get section", recipes)
+	}
+	r := recipes[0]
+	if r.ID != "recipe-lockbox-get-key" || r.Title != "lockbox get KEY" {
+		t.Errorf("Recipe = %q %q", r.ID, r.Title)
+	}
+	want := "<p>Prints a value, <code>-o json</code> for &lt;scripts&gt;.</p>\n<pre><code>lockbox get API_KEY\n## not a heading</code></pre>\n"
+	if string(r.Body) != want {
+		t.Errorf("Body = %q, want %q", r.Body, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h, err := Handler(Reference{
+		Commands:  []Command{{Path: "lockbox get", Usage: "lockbox get KEY... [flags]", Short: "Get secrets", Flags: []Flag{{Name: "output", Shorthand: "o", Type: "string", Default: "text", Usage: "Output format"}}}},
+		Endpoints: server.Endpoints,
+		Recipes:   Recipes(readme),
+	})
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rec.Body.String()
+	for _, want := range []string{`id="lockbox-get"`, "-o, --output string", "(default text)", "/secrets/KEY", `id="recipe-lockbox-get-key"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Page is missing %q", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /other = %d, want 404", rec.Code)
+	}
+}
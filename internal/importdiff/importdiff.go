@@ -0,0 +1,89 @@
+// Package importdiff compares secrets about to be imported with the store,
+// so an import can be reviewed before anything is written and repeating
+// one is seen to change nothing. Values are compared by their keyed
+// digest; they are never printed.
+package importdiff
+
+import (
+	"fmt"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/provider"
+)
+
+// What importing does to a key
+const (
+	New       = "new"
+	Changed   = "changed"
+	Identical = "identical"
+)
+
+// Item is an incoming secret and what importing it would do
+type Item struct {
+	Key    string `json:"key"`
+	Source string `json:"source"`
+	Change string `json:"change"`
+}
+
+// Compare returns what importing secrets into store would do to each,
+// in order. Values are digested with encKey and compared with the
+// digests kept by the store; secrets stored without one are decrypted
+// instead.
+func Compare(store *db.Store, encKey []byte, secrets []provider.Secret) ([]Item, error) {
+	digests, err := store.Digests()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, len(secrets))
+	for i, sec := range secrets {
+		items[i] = Item{Key: sec.Key, Source: sec.Source, Change: New}
+		current, ok := digests[sec.Key]
+		if !ok {
+			continue
+		}
+		if current == "" {
+			if current, err = digestStored(store, encKey, sec.Key); err != nil {
+				return nil, err
+			}
+		}
+		digest, err := crypto.Digest(sec.Value, encKey)
+		if err != nil {
+			return nil, err
+		}
+		items[i].Change = Changed
+		if digest == current {
+			items[i].Change = Identical
+		}
+	}
+	return items, nil
+}
+
+// digestStored decrypts the secret key to digest it
+func digestStored(store *db.Store, encKey []byte, key string) (string, error) {
+	encrypted, err := store.GetSecret(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret '%s': %w", key, err)
+	}
+	value, err := crypto.Decrypt(encrypted, encKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret '%s': %w", key, err)
+	}
+	defer clear(value)
+	return crypto.Digest(value, encKey)
+}
+
+// Count returns how many items are new, changed and identical
+func Count(items []Item) (added, changed, identical int) {
+	for _, item := range items {
+		switch item.Change {
+		case New:
+			added++
+		case Changed:
+			changed++
+		case Identical:
+			identical++
+		}
+	}
+	return added, changed, identical
+}
@@ -0,0 +1,57 @@
+package importdiff
+
+import (
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/provider"
+)
+
+// newTestStore opens a store backed by a fresh temporary database
+func newTestStore(t *testing.T) *db.Store {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestCompare(t *testing.T) {
+	store := newTestStore(t)
+	key, _ := crypto.GenerateKey()
+
+	for k, v := range map[string]string{"SAME": "a", "DIFFERENT": "b"} {
+		value := v
+		if _, err := batch.Execute(store, key, batch.Actor{Admin: true}, batch.Command{Op: "set", Key: k, Value: &value}); err != nil {
+			t.Fatalf("set %s failed: %v", k, err)
+		}
+	}
+	// Stored inline without a digest, as by older versions
+	encrypted, _ := crypto.Encrypt([]byte("c"), key)
+	if err := store.SetSecret("LEGACY", encrypted); err != nil {
+		t.Fatalf("SetSecret failed: %v", err)
+	}
+
+	items, err := Compare(store, key, []provider.Secret{
+		{Key: "SAME", Source: ".env:1", Value: []byte("a")},
+		{Key: "DIFFERENT", Source: ".env:2", Value: []byte("x")},
+		{Key: "LEGACY", Source: ".env:3", Value: []byte("c")},
+		{Key: "ADDED", Source: ".env:4", Value: []byte("d")},
+	})
+	if err != nil {
+		t.Fatalf("Compare failed: %v", err)
+	}
+	want := []string{Identical, Changed, Identical, New}
+	for i, item := range items {
+		if item.Change != want[i] {
+			t.Errorf("%s: got %s, want %s", item.Key, item.Change, want[i])
+		}
+	}
+	if added, changed, identical := Count(items); added != 1 || changed != 1 || identical != 2 {
+		t.Errorf("Count = %d, %d, %d", added, changed, identical)
+	}
+}
@@ -0,0 +1,163 @@
+// Package k8s reads Secrets from a Kubernetes cluster so they can be
+// imported. It runs kubectl, so it uses the same kubeconfig, context and
+// credentials as the rest of the user's cluster tooling.
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Options selects the Secrets to read
+type Options struct {
+	Namespace string
+	// Selector is a label selector such as app=web
+	Selector string
+	// Context is the kubeconfig context, "" for the current one
+	Context string
+	// Kubectl is the kubectl binary (default "kubectl")
+	Kubectl string
+}
+
+// Secret is a Kubernetes Secret with its data decoded
+type Secret struct {
+	Name      string
+	Namespace string
+	Type      string
+	Data      map[string][]byte
+}
+
+// managedTypes are Secret types the cluster or tooling maintains itself,
+// which are not worth importing
+var managedTypes = map[string]bool{
+	"kubernetes.io/service-account-token": true,
+	"helm.sh/release.v1":                  true,
+}
+
+// Get reads the Secrets matching opts, skipping managed types
+func Get(opts Options) ([]Secret, error) {
+	kubectl := opts.Kubectl
+	if kubectl == "" {
+		kubectl = "kubectl"
+	}
+	args := []string{"get", "secrets", "--output", "json"}
+	if opts.Namespace != "" {
+		args = append(args, "--namespace", opts.Namespace)
+	}
+	if opts.Selector != "" {
+		args = append(args, "--selector", opts.Selector)
+	}
+	if opts.Context != "" {
+		args = append(args, "--context", opts.Context)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(kubectl, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("kubectl failed: %s", msg)
+		}
+		return nil, fmt.Errorf("failed to run kubectl: %w", err)
+	}
+	return Parse(stdout.Bytes())
+}
+
+// Parse decodes the output of 'kubectl get secrets -o json', skipping
+// managed types. Secrets are sorted by namespace and name.
+func Parse(data []byte) ([]Secret, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Type string            `json:"type"`
+			Data map[string][]byte `json:"data"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unexpected kubectl output: %w", err)
+	}
+
+	var secrets []Secret
+	for _, item := range list.Items {
+		if managedTypes[item.Type] {
+			continue
+		}
+		secrets = append(secrets, Secret{
+			Name:      item.Metadata.Name,
+			Namespace: item.Metadata.Namespace,
+			Type:      item.Type,
+			Data:      item.Data,
+		})
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if secrets[i].Namespace != secrets[j].Namespace {
+			return secrets[i].Namespace < secrets[j].Namespace
+		}
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// Entry is one field of a Secret and the key it is imported as
+type Entry struct {
+	Key    string
+	Secret Secret
+	Field  string
+	Value  []byte
+}
+
+// Source describes where the entry came from, as namespace/name.field
+func (e Entry) Source() string {
+	return e.Secret.Namespace + "/" + e.Secret.Name + "." + e.Field
+}
+
+// Entries names a key for every field of secrets. A field keeps its name,
+// as envFrom would expose it, or with prefixName is prefixed by its
+// Secret's name, so web-db's password becomes WEB_DB_password. Characters
+// that are not valid in an environment variable become underscores. Two
+// fields mapping to the same key are an error.
+func Entries(secrets []Secret, prefixName bool) ([]Entry, error) {
+	var entries []Entry
+	from := map[string]string{}
+	for _, s := range secrets {
+		fields := make([]string, 0, len(s.Data))
+		for field := range s.Data {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			key := envName(field)
+			if prefixName {
+				key = strings.ToUpper(envName(s.Name)) + "_" + key
+			}
+			e := Entry{Key: key, Secret: s, Field: field, Value: s.Data[field]}
+			if prev, ok := from[key]; ok {
+				return nil, fmt.Errorf("%s and %s would both be imported as %s; use --prefix-name or narrow the selector", prev, e.Source(), key)
+			}
+			from[key] = e.Source()
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// envName replaces characters not allowed in environment variable names
+// with underscores
+func envName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
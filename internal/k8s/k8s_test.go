@@ -0,0 +1,95 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secretList = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"metadata": {"name": "web-db", "namespace": "prod"}, "type": "Opaque",
+     "data": {"password": "aHVudGVyMg==", "DB_USER": "YXBw"}},
+    {"metadata": {"name": "web-tls", "namespace": "prod"}, "type": "kubernetes.io/tls",
+     "data": {"tls.crt": "Y2VydA==", "tls.key": "a2V5"}},
+    {"metadata": {"name": "default-token-x", "namespace": "prod"}, "type": "kubernetes.io/service-account-token",
+     "data": {"token": "dG9r"}}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	secrets, err := Parse([]byte(secretList))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(secrets) != 2 {
+		t.Fatalf("got %d secrets, want 2 without the service account token", len(secrets))
+	}
+	if got := string(secrets[0].Data["password"]); got != "hunter2" {
+		t.Errorf("password = %q, want the decoded value", got)
+	}
+
+	entries, err := Entries(secrets, false)
+	if err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if got := strings.Join(keys, " "); got != "DB_USER password tls_crt tls_key" {
+		t.Errorf("keys = %s", got)
+	}
+	if entries[0].Source() != "prod/web-db.DB_USER" {
+		t.Errorf("source = %s", entries[0].Source())
+	}
+
+	entries, _ = Entries(secrets, true)
+	if entries[1].Key != "WEB_DB_password" || entries[2].Key != "WEB_TLS_tls_crt" {
+		t.Errorf("prefixed keys = %s, %s", entries[1].Key, entries[2].Key)
+	}
+}
+
+func TestEntriesCollide(t *testing.T) {
+	secrets := []Secret{
+		{Name: "a", Namespace: "ns", Data: map[string][]byte{"tls.key": nil}},
+		{Name: "b", Namespace: "ns", Data: map[string][]byte{"tls_key": nil}},
+	}
+	if _, err := Entries(secrets, false); err == nil || !strings.Contains(err.Error(), "ns/a.tls.key and ns/b.tls_key") {
+		t.Errorf("Entries = %v, want a collision", err)
+	}
+	if _, err := Entries(secrets, true); err != nil {
+		t.Errorf("prefixed Entries failed: %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir := t.TempDir()
+	// A stand-in kubectl that records its arguments
+	kubectl := filepath.Join(dir, "kubectl")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat <<'EOF'\n" + secretList + "\nEOF\n"
+	if err := os.WriteFile(kubectl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := Get(Options{Namespace: "prod", Selector: "app=web", Context: "staging", Kubectl: kubectl})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if len(secrets) != 2 {
+		t.Errorf("got %d secrets, want 2", len(secrets))
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	if got := strings.TrimSpace(string(args)); got != "get secrets --output json --namespace prod --selector app=web --context staging" {
+		t.Errorf("kubectl args = %s", got)
+	}
+
+	failing := filepath.Join(dir, "failing")
+	os.WriteFile(failing, []byte("#!/bin/sh\necho 'error: You must be logged in' >&2\nexit 1\n"), 0755)
+	if _, err := Get(Options{Kubectl: failing}); err == nil || !strings.Contains(err.Error(), "You must be logged in") {
+		t.Errorf("Get = %v, want kubectl's error", err)
+	}
+}
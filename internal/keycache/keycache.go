@@ -0,0 +1,28 @@
+// Package keycache keeps unlocked store keys for a while, so a passphrase
+// is asked once per session rather than on every command. On Linux keys
+// are held in the kernel's per-user keyring and expire there; they never
+// touch the disk.
+package keycache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+)
+
+var (
+	// ErrNotCached means no unexpired key is cached for the store
+	ErrNotCached = errors.New("no unlocked key cached")
+	// ErrUnsupported means the platform has no key cache
+	ErrUnsupported = errors.New("unlocking is not supported on this platform")
+)
+
+// name returns the cache entry name of the store at path
+func name(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(path))
+	return "lockbox:" + hex.EncodeToString(sum[:8])
+}
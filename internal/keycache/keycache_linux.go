@@ -0,0 +1,61 @@
+package keycache
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyPerm grants the possessor and the owning user every permission on a
+// cached key, and nobody else any
+const keyPerm = 0x3f3f0000
+
+// Put caches key for the store at path until ttl passes
+func Put(path string, key []byte, ttl time.Duration) error {
+	id, err := unix.AddKey("user", name(path), key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	// Readable by the user's later commands, which need not share a
+	// session keyring with this one
+	if err := unix.KeyctlSetperm(id, keyPerm); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(ttl.Seconds()), 0, 0); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+		return err
+	}
+	return nil
+}
+
+// Get returns the key cached for the store at path
+func Get(path string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", name(path), 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+			return nil, ErrNotCached
+		}
+		return nil, err
+	}
+	key := make([]byte, 64)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0)
+	if err != nil {
+		return nil, ErrNotCached
+	}
+	if n > len(key) {
+		return nil, ErrNotCached
+	}
+	return key[:n], nil
+}
+
+// Drop forgets the key cached for the store at path
+func Drop(path string) error {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", name(path), 0)
+	if err != nil {
+		return nil
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+	return err
+}
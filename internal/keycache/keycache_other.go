@@ -0,0 +1,20 @@
+//go:build !linux
+
+package keycache
+
+import "time"
+
+// Put is only supported on Linux
+func Put(path string, key []byte, ttl time.Duration) error {
+	return ErrUnsupported
+}
+
+// Get is only supported on Linux; elsewhere nothing is ever cached
+func Get(path string) ([]byte, error) {
+	return nil, ErrNotCached
+}
+
+// Drop is only supported on Linux; elsewhere nothing is ever cached
+func Drop(path string) error {
+	return nil
+}
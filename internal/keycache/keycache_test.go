@@ -0,0 +1,36 @@
+package keycache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lockbox.db")
+	key := bytes.Repeat([]byte{7}, 32)
+
+	if _, err := Get(path); err != ErrNotCached {
+		t.Fatalf("Get before Put = %v, want ErrNotCached", err)
+	}
+	if err := Put(path, key, time.Minute); err == ErrUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Skipf("kernel keyring unavailable: %v", err)
+	}
+	defer Drop(path)
+
+	if got, err := Get(path); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("Get = %x, %v, want %x", got, err, key)
+	}
+	if _, err := Get(filepath.Join(t.TempDir(), "other.db")); err != ErrNotCached {
+		t.Errorf("Get of another store = %v, want ErrNotCached", err)
+	}
+	if err := Drop(path); err != nil {
+		t.Fatalf("Drop failed: %v", err)
+	}
+	if _, err := Get(path); err != ErrNotCached {
+		t.Errorf("Get after Drop = %v, want ErrNotCached", err)
+	}
+}
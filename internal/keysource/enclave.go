@@ -0,0 +1,61 @@
+package keysource
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SecureEnclave keeps P-256 key pairs in the Mac's Secure Enclave, by
+// label. The private keys never leave the enclave; data is encrypted to
+// a public key and only the enclave can decrypt it.
+type SecureEnclave interface {
+	// Available reports why no key can be made in the enclave, if so
+	Available() error
+	// Create makes a key pair labeled label. With confirm, every use of
+	// the private key asks for Touch ID or the login password.
+	Create(label string, confirm bool) error
+	Encrypt(label string, plaintext []byte) ([]byte, error)
+	// Decrypt decrypts with the private key labeled label, showing
+	// prompt if the key asks for confirmation. A confirmation given to
+	// unlock the Mac within reuse counts.
+	Decrypt(label string, ciphertext []byte, reuse time.Duration, prompt string) ([]byte, error)
+	Delete(label string) error
+}
+
+// ErrNoEnclave means the machine has no Secure Enclave lockbox can use
+var ErrNoEnclave = errors.New("no Secure Enclave on this machine")
+
+// enclave is the platform's Secure Enclave, replaced in tests
+var enclave SecureEnclave = platformEnclave()
+
+// EnclaveAvailable reports why keys cannot be kept in the Secure Enclave,
+// or nil if they can
+func EnclaveAvailable() error {
+	return enclave.Available()
+}
+
+// MaxConfirmReuse is the longest a Touch ID confirmation may be reused,
+// the limit macOS sets
+const MaxConfirmReuse = 5 * time.Minute
+
+// EnclaveConfirm is how often a key kept in the Secure Enclave asks for
+// Touch ID, as accepted by ParseConfirm. Empty never asks.
+var EnclaveConfirm string
+
+// ParseConfirm parses how often to ask for Touch ID: never, always, or a
+// duration of up to MaxConfirmReuse for which the confirmation given to
+// unlock the Mac counts
+func ParseConfirm(s string) (confirm bool, reuse time.Duration, err error) {
+	switch s {
+	case "", "never":
+		return false, 0, nil
+	case "always":
+		return true, 0, nil
+	}
+	reuse, err = time.ParseDuration(s)
+	if err != nil || reuse <= 0 || reuse > MaxConfirmReuse {
+		return false, 0, fmt.Errorf("invalid confirmation '%s': expected never, always or a duration of up to %s", s, MaxConfirmReuse)
+	}
+	return true, reuse, nil
+}
@@ -0,0 +1,262 @@
+//go:build darwin && cgo
+
+package keysource
+
+/*
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework Foundation -framework Security -framework LocalAuthentication
+
+#import <Foundation/Foundation.h>
+#import <LocalAuthentication/LocalAuthentication.h>
+#import <Security/Security.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define LB_ALGORITHM kSecKeyAlgorithmECIESEncryptionCofactorVariableIVX963SHA256AESGCM
+
+static char *lb_status(OSStatus status) {
+	CFStringRef msg = SecCopyErrorMessageString(status, NULL);
+	if (msg == NULL) {
+		return strdup("unknown Security framework error");
+	}
+	char *s = strdup([(NSString *)msg UTF8String]);
+	CFRelease(msg);
+	return s;
+}
+
+static char *lb_error(CFErrorRef err) {
+	if (err == NULL) {
+		return strdup("unknown Security framework error");
+	}
+	char *s = strdup([[(NSError *)err localizedDescription] UTF8String]);
+	CFRelease(err);
+	return s;
+}
+
+static NSData *lb_tag(const char *label) {
+	return [NSData dataWithBytes:label length:strlen(label)];
+}
+
+static void lb_copy_out(CFDataRef data, void **out, int *outlen) {
+	*outlen = (int)CFDataGetLength(data);
+	*out = malloc(*outlen > 0 ? *outlen : 1);
+	memcpy(*out, CFDataGetBytePtr(data), *outlen);
+	CFRelease(data);
+}
+
+// lb_private_key returns the private key labeled label, which uses ctx to
+// confirm if given
+static SecKeyRef lb_private_key(const char *label, LAContext *ctx, char **err) {
+	NSMutableDictionary *query = [NSMutableDictionary dictionaryWithDictionary:@{
+		(id)kSecClass: (id)kSecClassKey,
+		(id)kSecAttrKeyClass: (id)kSecAttrKeyClassPrivate,
+		(id)kSecAttrApplicationTag: lb_tag(label),
+		(id)kSecReturnRef: @YES,
+	}];
+	if (ctx != nil) {
+		query[(id)kSecUseAuthenticationContext] = ctx;
+	}
+	SecKeyRef key = NULL;
+	OSStatus status = SecItemCopyMatching((CFDictionaryRef)query, (CFTypeRef *)&key);
+	if (status != errSecSuccess) {
+		*err = lb_status(status);
+		return NULL;
+	}
+	return key;
+}
+
+static int lb_create(const char *label, int confirm, char **err);
+static int lb_delete(const char *label, char **err);
+
+// lb_available makes and deletes a key, which also fails for binaries
+// that are not signed to keep keys in the keychain
+static int lb_available(char **err) {
+	if (lb_create("lockbox-probe", 0, err) != 0) {
+		return -1;
+	}
+	return lb_delete("lockbox-probe", err);
+}
+
+static int lb_create(const char *label, int confirm, char **err) {
+	@autoreleasepool {
+		SecAccessControlCreateFlags flags = kSecAccessControlPrivateKeyUsage;
+		if (confirm) {
+			flags |= kSecAccessControlUserPresence;
+		}
+		CFErrorRef e = NULL;
+		SecAccessControlRef access = SecAccessControlCreateWithFlags(
+			kCFAllocatorDefault, kSecAttrAccessibleWhenUnlockedThisDeviceOnly, flags, &e);
+		if (access == NULL) {
+			*err = lb_error(e);
+			return -1;
+		}
+		NSDictionary *attrs = @{
+			(id)kSecAttrKeyType: (id)kSecAttrKeyTypeECSECPrimeRandom,
+			(id)kSecAttrKeySizeInBits: @256,
+			(id)kSecAttrTokenID: (id)kSecAttrTokenIDSecureEnclave,
+			(id)kSecPrivateKeyAttrs: @{
+				(id)kSecAttrIsPermanent: @YES,
+				(id)kSecAttrApplicationTag: lb_tag(label),
+				(id)kSecAttrAccessControl: (id)access,
+			},
+		};
+		SecKeyRef key = SecKeyCreateRandomKey((CFDictionaryRef)attrs, &e);
+		CFRelease(access);
+		if (key == NULL) {
+			*err = lb_error(e);
+			return -1;
+		}
+		CFRelease(key);
+		return 0;
+	}
+}
+
+static int lb_encrypt(const char *label, const void *in, int inlen, void **out, int *outlen, char **err) {
+	@autoreleasepool {
+		SecKeyRef key = lb_private_key(label, nil, err);
+		if (key == NULL) {
+			return -1;
+		}
+		SecKeyRef public = SecKeyCopyPublicKey(key);
+		CFRelease(key);
+		if (public == NULL) {
+			*err = strdup("no public key");
+			return -1;
+		}
+		CFErrorRef e = NULL;
+		CFDataRef data = SecKeyCreateEncryptedData(public, LB_ALGORITHM, (CFDataRef)[NSData dataWithBytes:in length:inlen], &e);
+		CFRelease(public);
+		if (data == NULL) {
+			*err = lb_error(e);
+			return -1;
+		}
+		lb_copy_out(data, out, outlen);
+		return 0;
+	}
+}
+
+static int lb_decrypt(const char *label, const void *in, int inlen, double reuse, const char *prompt, void **out, int *outlen, char **err) {
+	@autoreleasepool {
+		LAContext *ctx = [[[LAContext alloc] init] autorelease];
+		ctx.touchIDAuthenticationAllowableReuseDuration = reuse;
+		ctx.localizedReason = [NSString stringWithUTF8String:prompt];
+		SecKeyRef key = lb_private_key(label, ctx, err);
+		if (key == NULL) {
+			return -1;
+		}
+		CFErrorRef e = NULL;
+		CFDataRef data = SecKeyCreateDecryptedData(key, LB_ALGORITHM, (CFDataRef)[NSData dataWithBytes:in length:inlen], &e);
+		CFRelease(key);
+		if (data == NULL) {
+			*err = lb_error(e);
+			return -1;
+		}
+		lb_copy_out(data, out, outlen);
+		return 0;
+	}
+}
+
+static int lb_delete(const char *label, char **err) {
+	@autoreleasepool {
+		NSDictionary *query = @{
+			(id)kSecClass: (id)kSecClassKey,
+			(id)kSecAttrApplicationTag: lb_tag(label),
+		};
+		OSStatus status = SecItemDelete((CFDictionaryRef)query);
+		if (status != errSecSuccess && status != errSecItemNotFound) {
+			*err = lb_status(status);
+			return -1;
+		}
+		return 0;
+	}
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// darwinEnclave uses the Secure Enclave through Security.framework. Keys
+// are ECIES P-256, and macOS only lets signed binaries keep them.
+type darwinEnclave struct{}
+
+func platformEnclave() SecureEnclave { return darwinEnclave{} }
+
+// enclaveError turns an error returned by the C helpers into a Go error,
+// freeing it
+func enclaveError(err *C.char) error {
+	defer C.free(unsafe.Pointer(err))
+	return errors.New(C.GoString(err))
+}
+
+// enclaveOutput copies out, freeing it
+func enclaveOutput(out unsafe.Pointer, n C.int) []byte {
+	defer C.free(out)
+	return C.GoBytes(out, n)
+}
+
+func (darwinEnclave) Available() error {
+	var err *C.char
+	if C.lb_available(&err) != 0 {
+		return fmt.Errorf("%w: %w", ErrNoEnclave, enclaveError(err))
+	}
+	return nil
+}
+
+func (darwinEnclave) Create(label string, confirm bool) error {
+	cLabel := C.CString(label)
+	defer C.free(unsafe.Pointer(cLabel))
+	var cConfirm C.int
+	if confirm {
+		cConfirm = 1
+	}
+	var err *C.char
+	if C.lb_create(cLabel, cConfirm, &err) != 0 {
+		return enclaveError(err)
+	}
+	return nil
+}
+
+func (darwinEnclave) Encrypt(label string, plaintext []byte) ([]byte, error) {
+	cLabel := C.CString(label)
+	defer C.free(unsafe.Pointer(cLabel))
+	in := C.CBytes(plaintext)
+	defer C.free(in)
+	var out unsafe.Pointer
+	var n C.int
+	var err *C.char
+	if C.lb_encrypt(cLabel, in, C.int(len(plaintext)), &out, &n, &err) != 0 {
+		return nil, enclaveError(err)
+	}
+	return enclaveOutput(out, n), nil
+}
+
+func (darwinEnclave) Decrypt(label string, ciphertext []byte, reuse time.Duration, prompt string) ([]byte, error) {
+	cLabel := C.CString(label)
+	defer C.free(unsafe.Pointer(cLabel))
+	cPrompt := C.CString(prompt)
+	defer C.free(unsafe.Pointer(cPrompt))
+	in := C.CBytes(ciphertext)
+	defer C.free(in)
+	var out unsafe.Pointer
+	var n C.int
+	var err *C.char
+	if C.lb_decrypt(cLabel, in, C.int(len(ciphertext)), C.double(reuse.Seconds()), cPrompt, &out, &n, &err) != 0 {
+		return nil, enclaveError(err)
+	}
+	return enclaveOutput(out, n), nil
+}
+
+func (darwinEnclave) Delete(label string) error {
+	cLabel := C.CString(label)
+	defer C.free(unsafe.Pointer(cLabel))
+	var err *C.char
+	if C.lb_delete(cLabel, &err) != 0 {
+		return enclaveError(err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !darwin || !cgo
+
+package keysource
+
+import "time"
+
+// noEnclave is the Secure Enclave of machines without one, and of builds
+// without cgo, which Security.framework needs
+type noEnclave struct{}
+
+func platformEnclave() SecureEnclave { return noEnclave{} }
+
+func (noEnclave) Available() error                       { return ErrNoEnclave }
+func (noEnclave) Create(string, bool) error              { return ErrNoEnclave }
+func (noEnclave) Encrypt(string, []byte) ([]byte, error) { return nil, ErrNoEnclave }
+func (noEnclave) Decrypt(string, []byte, time.Duration, string) ([]byte, error) {
+	return nil, ErrNoEnclave
+}
+func (noEnclave) Delete(string) error { return ErrNoEnclave }
@@ -0,0 +1,48 @@
+package keysource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainService is the service name entries are filed under
+const keychainService = "lockbox"
+
+// Keyring stores small secrets in the operating system's credential
+// store, by account name
+type Keyring interface {
+	Get(account string) ([]byte, error)
+	Set(account string, secret []byte) error
+	Delete(account string) error
+}
+
+// SecretTool is the libsecret CLI used on Linux to reach the Secret
+// Service, such as GNOME Keyring or KWallet
+var SecretTool = "secret-tool"
+
+// ErrUnsupported means the platform has no supported keychain
+var ErrUnsupported = errors.New("no supported keychain on this platform")
+
+// keyring is the platform's keychain, replaced in tests
+var keyring Keyring = platformKeychain()
+
+// run runs a keychain helper command with stdin, returning its output or
+// its error message
+func run(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", name, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
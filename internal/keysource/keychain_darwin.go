@@ -0,0 +1,30 @@
+package keysource
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// macKeychain keeps entries in the login keychain through security(1)
+type macKeychain struct{}
+
+func platformKeychain() Keyring { return macKeychain{} }
+
+func (macKeychain) Get(account string) ([]byte, error) {
+	out, err := run(nil, "security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	return bytes.TrimSpace(out), err
+}
+
+func (macKeychain) Set(account string, secret []byte) error {
+	// The command is fed to 'security -i' on stdin so the secret never
+	// appears in the process list; account and secret are hex and need
+	// no quoting
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -l 'lockbox encryption key' -w %s\n", keychainService, account, secret)
+	_, err := run([]byte(command), "security", "-i")
+	return err
+}
+
+func (macKeychain) Delete(account string) error {
+	_, err := run(nil, "security", "delete-generic-password", "-s", keychainService, "-a", account)
+	return err
+}
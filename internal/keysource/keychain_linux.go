@@ -0,0 +1,20 @@
+package keysource
+
+// secretService keeps entries in the Secret Service through secret-tool
+type secretService struct{}
+
+func platformKeychain() Keyring { return secretService{} }
+
+func (secretService) Get(account string) ([]byte, error) {
+	return run(nil, SecretTool, "lookup", "service", keychainService, "account", account)
+}
+
+func (secretService) Set(account string, secret []byte) error {
+	_, err := run(secret, SecretTool, "store", "--label=lockbox encryption key", "service", keychainService, "account", account)
+	return err
+}
+
+func (secretService) Delete(account string) error {
+	_, err := run(nil, SecretTool, "clear", "service", keychainService, "account", account)
+	return err
+}
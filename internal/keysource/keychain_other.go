@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package keysource
+
+// unsupported is the keychain of platforms without one
+type unsupported struct{}
+
+func platformKeychain() Keyring { return unsupported{} }
+
+func (unsupported) Get(string) ([]byte, error) { return nil, ErrUnsupported }
+func (unsupported) Set(string, []byte) error   { return ErrUnsupported }
+func (unsupported) Delete(string) error        { return ErrUnsupported }
@@ -0,0 +1,351 @@
+// Package keysource decides where a store's encryption key is kept: in the
+// store itself, wrapped with a passphrase in the store, in the operating
+// system's keychain, sealed to the machine's TPM, or encrypted to a key in
+// the Mac's Secure Enclave, so the key need not sit next to the data it
+// protects.
+package keysource
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/agent"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/keycache"
+	"github.com/MQ37/lockbox/internal/tpm"
+)
+
+// Backends
+const (
+	// Store keeps the key in the clear in the store's config
+	Store = "store"
+	// Passphrase keeps the key in the store wrapped with a passphrase
+	Passphrase = "passphrase"
+	// Keychain keeps the key in the OS keychain; the store holds only the
+	// name of the keychain entry
+	Keychain = "keychain"
+	// TPM keeps the key in the store sealed to this machine's TPM 2.0
+	TPM = "tpm"
+	// Enclave keeps the key in the store encrypted to a key pair in this
+	// Mac's Secure Enclave
+	Enclave = "enclave"
+)
+
+// Backends are the supported backends
+var Backends = []string{Store, Passphrase, Keychain, TPM, Enclave}
+
+// TPMPCRs are the PCRs, as returned by tpm.ParsePCRs, that a key sealed
+// to the TPM is bound to. Empty binds to none.
+var TPMPCRs string
+
+// Config entries locating the key, one per backend
+const (
+	keyConfig      = "encryption_key"
+	wrappedConfig  = "wrapped_key"
+	accountConfig  = "keychain_account"
+	sealedConfig   = "tpm_sealed_key"
+	enclaveConfig  = "enclave_wrapped_key"
+	keychainPrefix = "lockbox-"
+	// pcrsConfig records the PCRs a sealed key is bound to
+	pcrsConfig = "tpm_pcrs"
+	// labelConfig names the Secure Enclave key pair, and confirmConfig
+	// records how often it asks for Touch ID
+	labelConfig   = "enclave_label"
+	confirmConfig = "enclave_confirm"
+)
+
+// configs are every config entry a backend may set
+var configs = []string{keyConfig, wrappedConfig, accountConfig, sealedConfig, enclaveConfig, pcrsConfig, labelConfig, confirmConfig}
+
+// ErrNotInitialized means the store has no key in any backend
+var ErrNotInitialized = errors.New("encryption key not found. Please run 'lockbox init' first")
+
+// PassphraseFunc asks for the passphrase of a passphrase backed store
+type PassphraseFunc func() (string, error)
+
+// Backend returns the backend holding store's key
+func Backend(store *db.Store) (string, error) {
+	for _, b := range []struct{ name, config string }{
+		{Store, keyConfig}, {Passphrase, wrappedConfig}, {Keychain, accountConfig}, {TPM, sealedConfig}, {Enclave, enclaveConfig},
+	} {
+		if _, err := store.GetConfig(b.config); err == nil {
+			return b.name, nil
+		} else if err != db.ErrNotFound {
+			return "", fmt.Errorf("failed to get encryption key: %w", err)
+		}
+	}
+	return "", ErrNotInitialized
+}
+
+// Load returns store's encryption key. A passphrase backed key comes from
+// the unlocked key cache, or else is unwrapped with passphrase().
+func Load(store *db.Store, passphrase PassphraseFunc) ([]byte, error) {
+	backend, err := Backend(store)
+	if err != nil {
+		return nil, err
+	}
+	switch backend {
+	case Store:
+		keyHex, err := store.GetConfig(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		return decodeKey(keyHex)
+	case Passphrase:
+		wrapped, err := store.GetConfig(wrappedConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		if key, err := keycache.Get(store.Path()); err == nil {
+			return key, nil
+		}
+		if key, err := agent.Get(store.Path()); err == nil {
+			return key, nil
+		}
+		p, err := passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("store is locked: %w; run 'lockbox unlock' or set LOCKBOX_PASSPHRASE", err)
+		}
+		key, err := crypto.UnwrapKey(wrapped, p)
+		if err != nil {
+			return nil, err
+		}
+		// A running agent keeps the key, so later commands need not ask
+		agent.Add(store.Path(), key)
+		return key, nil
+	case TPM:
+		sealed, err := store.GetConfig(sealedConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		keyHex, err := tpm.UnsealData(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the encryption key: %w; the store can only be opened on the machine it was sealed on, in the same boot configuration", err)
+		}
+		return decodeKey(keyHex)
+	case Enclave:
+		wrapped, err := store.GetConfig(enclaveConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		label, err := store.GetConfig(labelConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		_, reuse, err := ParseConfirm(EnclaveSettings(store))
+		if err != nil {
+			return nil, err
+		}
+		keyHex, err := enclave.Decrypt(string(label), wrapped, reuse, "unlock the lockbox store")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the encryption key from the Secure Enclave: %w; the store can only be opened on the Mac it was created on", err)
+		}
+		return decodeKey(keyHex)
+	default:
+		account, err := store.GetConfig(accountConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get encryption key: %w", err)
+		}
+		keyHex, err := keyring.Get(string(account))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the encryption key from the keychain: %w", err)
+		}
+		return decodeKey(keyHex)
+	}
+}
+
+func decodeKey(keyHex []byte) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// Save keeps key in backend, removing it from wherever it was before.
+// passphrase is only called for the passphrase backend.
+func Save(store *db.Store, key []byte, backend string, passphrase PassphraseFunc) error {
+	p, err := Prepare(store, key, backend, passphrase)
+	if err != nil {
+		return err
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		p.Done(false)
+		return err
+	}
+	defer tx.Rollback()
+	if err := p.Apply(tx); err != nil {
+		p.Done(false)
+		return err
+	}
+	err = tx.Commit()
+	p.Done(err == nil)
+	return err
+}
+
+// Pending is a key kept in a backend that the store does not point to yet
+type Pending struct {
+	store  *db.Store
+	config string
+	value  []byte
+	// extra are further config entries describing the key
+	extra      map[string]string
+	account    string
+	oldAccount string
+	label      string
+	oldLabel   string
+}
+
+// Prepare readies key to be kept in backend, so the switch can be made in
+// a transaction that also writes data encrypted with it: Apply points the
+// store at the key and Done finishes once the transaction is over.
+// passphrase is only called for the passphrase backend.
+func Prepare(store *db.Store, key []byte, backend string, passphrase PassphraseFunc) (*Pending, error) {
+	if !slices.Contains(Backends, backend) {
+		return nil, fmt.Errorf("unknown key backend '%s' (supported: %s)", backend, strings.Join(Backends, ", "))
+	}
+	p := &Pending{store: store}
+	if account, err := store.GetConfig(accountConfig); err == nil {
+		p.oldAccount = string(account)
+	}
+	if label, err := store.GetConfig(labelConfig); err == nil {
+		p.oldLabel = string(label)
+	}
+
+	switch backend {
+	case Store:
+		p.config, p.value = keyConfig, []byte(hex.EncodeToString(key))
+	case Passphrase:
+		passphrase, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := crypto.WrapKey(key, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		p.config, p.value = wrappedConfig, wrapped
+	case Keychain:
+		// A fresh entry per move, so the old one is never overwritten
+		// before the store stops pointing at it
+		id := make([]byte, 8)
+		rand.Read(id)
+		p.account = keychainPrefix + hex.EncodeToString(id)
+		if err := keyring.Set(p.account, []byte(hex.EncodeToString(key))); err != nil {
+			return nil, fmt.Errorf("failed to store the encryption key in the keychain: %w", err)
+		}
+		p.config, p.value = accountConfig, []byte(p.account)
+	case TPM:
+		sealed, err := tpm.Seal([]byte(hex.EncodeToString(key)), TPMPCRs)
+		if err != nil {
+			return nil, err
+		}
+		p.config, p.value = sealedConfig, sealed
+		p.extra = map[string]string{pcrsConfig: TPMPCRs}
+	case Enclave:
+		confirm, _, err := ParseConfirm(EnclaveConfirm)
+		if err != nil {
+			return nil, err
+		}
+		// A fresh key pair per move, as for the keychain
+		id := make([]byte, 8)
+		rand.Read(id)
+		label := keychainPrefix + hex.EncodeToString(id)
+		if err := enclave.Create(label, confirm); err != nil {
+			return nil, fmt.Errorf("failed to create a key in the Secure Enclave: %w", err)
+		}
+		p.label = label
+		wrapped, err := enclave.Encrypt(label, []byte(hex.EncodeToString(key)))
+		if err != nil {
+			p.Done(false)
+			return nil, fmt.Errorf("failed to encrypt the encryption key in the Secure Enclave: %w", err)
+		}
+		p.config, p.value = enclaveConfig, wrapped
+		p.extra = map[string]string{labelConfig: label}
+		if confirm {
+			p.extra[confirmConfig] = EnclaveConfirm
+		}
+	}
+	return p, nil
+}
+
+// Apply points the store at the pending key within tx
+func (p *Pending) Apply(tx *db.Tx) error {
+	for _, c := range configs {
+		if err := tx.DeleteConfig(c); err != nil {
+			return err
+		}
+	}
+	for c, v := range p.extra {
+		if v == "" {
+			continue
+		}
+		if err := tx.SetConfig(c, []byte(v)); err != nil {
+			return err
+		}
+	}
+	return tx.SetConfig(p.config, p.value)
+}
+
+// Done cleans up after the transaction: once committed the old keychain
+// entry or enclave key and the unlocked key are dropped, otherwise the new
+// keychain entry or enclave key is
+func (p *Pending) Done(committed bool) {
+	if !committed {
+		if p.account != "" {
+			keyring.Delete(p.account)
+		}
+		if p.label != "" {
+			enclave.Delete(p.label)
+		}
+		return
+	}
+	keycache.Drop(p.store.Path())
+	agent.Drop(p.store.Path())
+	if p.oldAccount != "" {
+		keyring.Delete(p.oldAccount)
+	}
+	if p.oldLabel != "" {
+		enclave.Delete(p.oldLabel)
+	}
+}
+
+// SealedPCRs returns the PCRs store's key is bound to if it is sealed to
+// the TPM
+func SealedPCRs(store *db.Store) string {
+	pcrs, _ := store.GetConfig(pcrsConfig)
+	return string(pcrs)
+}
+
+// EnclaveSettings returns how often store's key asks for Touch ID if it is
+// kept in the Secure Enclave, as accepted by ParseConfirm
+func EnclaveSettings(store *db.Store) string {
+	confirm, _ := store.GetConfig(confirmConfig)
+	return string(confirm)
+}
+
+// CheckPassphrase reports whether passphrase unwraps store's key
+func CheckPassphrase(store *db.Store, passphrase string) error {
+	key, err := Unwrap(store, passphrase)
+	if err != nil {
+		return err
+	}
+	clear(key)
+	return nil
+}
+
+// Unwrap returns the key of a passphrase protected store, unwrapped with
+// passphrase, without consulting the key cache or the agent
+func Unwrap(store *db.Store, passphrase string) ([]byte, error) {
+	wrapped, err := store.GetConfig(wrappedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	return crypto.UnwrapKey(wrapped, passphrase)
+}
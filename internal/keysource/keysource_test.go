@@ -0,0 +1,267 @@
+package keysource
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/tpm"
+)
+
+// memKeyring is a Keyring in memory
+type memKeyring map[string][]byte
+
+func (m memKeyring) Get(account string) ([]byte, error) {
+	if v, ok := m[account]; ok {
+		return v, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (m memKeyring) Set(account string, secret []byte) error {
+	m[account] = append([]byte(nil), secret...)
+	return nil
+}
+
+func (m memKeyring) Delete(account string) error {
+	delete(m, account)
+	return nil
+}
+
+func TestBackends(t *testing.T) {
+	defer func(m uint32) { crypto.PassphraseMemory = m }(crypto.PassphraseMemory)
+	crypto.PassphraseMemory = 1024
+	mem := memKeyring{}
+	defer func(k Keyring) { keyring = k }(keyring)
+	keyring = mem
+
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := Load(store, nil); err != ErrNotInitialized {
+		t.Fatalf("Load of an empty store = %v, want ErrNotInitialized", err)
+	}
+
+	key, _ := crypto.GenerateKey()
+	passphrase := func() (string, error) { return "correct horse", nil }
+	for _, backend := range []string{Store, Keychain, Passphrase, Keychain, Store} {
+		if err := Save(store, key, backend, passphrase); err != nil {
+			t.Fatalf("Save to %s failed: %v", backend, err)
+		}
+		if got, _ := Backend(store); got != backend {
+			t.Errorf("Backend after saving to %s = %s", backend, got)
+		}
+		got, err := Load(store, passphrase)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("Load from %s = %x, %v", backend, got, err)
+		}
+		config, _ := store.ListConfig()
+		if n := len(config); n != 1 {
+			t.Errorf("%s backend left %d key entries in the store", backend, n)
+		}
+		for _, v := range config {
+			if backend != Store && strings.Contains(string(v), hex.EncodeToString(key)) {
+				t.Errorf("%s backend left the key in the store", backend)
+			}
+		}
+		if wantEntries := map[bool]int{true: 1, false: 0}[backend == Keychain]; len(mem) != wantEntries {
+			t.Errorf("%s backend left %d keychain entries, want %d", backend, len(mem), wantEntries)
+		}
+	}
+
+	if err := Save(store, key, "vault", passphrase); err == nil {
+		t.Error("Save to an unknown backend succeeded")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	defer func(m uint32) { crypto.PassphraseMemory = m }(crypto.PassphraseMemory)
+	crypto.PassphraseMemory = 1024
+	mem := memKeyring{}
+	defer func(k Keyring) { keyring = k }(keyring)
+	keyring = mem
+
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+	passphrase := func() (string, error) { return "correct horse", nil }
+	Save(store, key, Passphrase, passphrase)
+
+	// A rolled back switch leaves the old key in place and no keychain entry
+	newKey, _ := crypto.GenerateKey()
+	p, err := Prepare(store, newKey, Keychain, nil)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	tx, _ := store.Begin()
+	p.Apply(tx)
+	tx.Rollback()
+	p.Done(false)
+	if got, err := Load(store, passphrase); err != nil || !bytes.Equal(got, key) || len(mem) != 0 {
+		t.Errorf("Load after a rolled back switch = %x, %v with %d keychain entries", got, err, len(mem))
+	}
+
+	if err := CheckPassphrase(store, "correct horse"); err != nil {
+		t.Errorf("CheckPassphrase with the right passphrase = %v", err)
+	}
+	if err := CheckPassphrase(store, "battery staple"); err != crypto.ErrWrongPassphrase {
+		t.Errorf("CheckPassphrase with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestTPM(t *testing.T) {
+	// The fake "seals" by prefixing the PCR flag
+	fake := filepath.Join(t.TempDir(), "systemd-creds")
+	os.WriteFile(fake, []byte("#!/bin/sh\ncase \"$1\" in\nencrypt) echo \"$3\"; cat;;\ndecrypt) read -r pcrs; cat;;\nesac\n"), 0755)
+	defer func(s string) { tpm.SystemdCreds = s }(tpm.SystemdCreds)
+	tpm.SystemdCreds = fake
+	defer func(s string) { TPMPCRs = s }(TPMPCRs)
+
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+
+	TPMPCRs = "7"
+	if err := Save(store, key, TPM, nil); err != nil {
+		t.Fatalf("Save to tpm failed: %v", err)
+	}
+	if got, err := Load(store, nil); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("Load from tpm = %x, %v", got, err)
+	}
+	sealed, _ := store.GetConfig(sealedConfig)
+	if !strings.HasPrefix(string(sealed), "--tpm2-pcrs=7\n") || SealedPCRs(store) != "7" {
+		t.Errorf("Sealed key %q bound to PCRs %q, want 7", sealed, SealedPCRs(store))
+	}
+
+	// Moving away drops the PCRs with the sealed key
+	if err := Save(store, key, Store, nil); err != nil {
+		t.Fatalf("Save to store failed: %v", err)
+	}
+	if config, _ := store.ListConfig(); len(config) != 1 || SealedPCRs(store) != "" {
+		t.Errorf("Moving out of tpm left %d key entries and PCRs %q", len(config), SealedPCRs(store))
+	}
+}
+
+// memEnclave is a SecureEnclave in memory that "encrypts" by prefixing
+// the label
+type memEnclave struct {
+	keys    map[string]bool
+	prompts int
+}
+
+func (m *memEnclave) Available() error { return nil }
+
+func (m *memEnclave) Create(label string, confirm bool) error {
+	m.keys[label] = confirm
+	return nil
+}
+
+func (m *memEnclave) Encrypt(label string, plaintext []byte) ([]byte, error) {
+	if _, ok := m.keys[label]; !ok {
+		return nil, errors.New("no such key")
+	}
+	return append([]byte(label+":"), plaintext...), nil
+}
+
+func (m *memEnclave) Decrypt(label string, ciphertext []byte, reuse time.Duration, prompt string) ([]byte, error) {
+	confirm, ok := m.keys[label]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	if confirm {
+		m.prompts++
+	}
+	plaintext, ok := bytes.CutPrefix(ciphertext, []byte(label+":"))
+	if !ok {
+		return nil, errors.New("wrong key")
+	}
+	return plaintext, nil
+}
+
+func (m *memEnclave) Delete(label string) error {
+	delete(m.keys, label)
+	return nil
+}
+
+func TestEnclave(t *testing.T) {
+	mem := &memEnclave{keys: map[string]bool{}}
+	defer func(e SecureEnclave) { enclave = e }(enclave)
+	enclave = mem
+	defer func(s string) { EnclaveConfirm = s }(EnclaveConfirm)
+
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+
+	EnclaveConfirm = "2m"
+	if err := Save(store, key, Enclave, nil); err != nil {
+		t.Fatalf("Save to enclave failed: %v", err)
+	}
+	if got, err := Load(store, nil); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("Load from enclave = %x, %v", got, err)
+	}
+	if len(mem.keys) != 1 || mem.prompts != 1 || EnclaveSettings(store) != "2m" {
+		t.Errorf("Enclave holds %d keys and prompted %d times with confirmation %q, want 1, 1 and 2m", len(mem.keys), mem.prompts, EnclaveSettings(store))
+	}
+
+	// Changing the confirmation makes a new key pair and drops the old one
+	EnclaveConfirm = "never"
+	if err := Save(store, key, Enclave, nil); err != nil {
+		t.Fatalf("Save to enclave failed: %v", err)
+	}
+	if got, err := Load(store, nil); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("Load from enclave = %x, %v", got, err)
+	}
+	if len(mem.keys) != 1 || mem.prompts != 1 || EnclaveSettings(store) != "" {
+		t.Errorf("Enclave holds %d keys and prompted %d times with confirmation %q, want 1, 1 and none", len(mem.keys), mem.prompts, EnclaveSettings(store))
+	}
+
+	if err := Save(store, key, Store, nil); err != nil {
+		t.Fatalf("Save to store failed: %v", err)
+	}
+	if config, _ := store.ListConfig(); len(config) != 1 || len(mem.keys) != 0 {
+		t.Errorf("Moving out of enclave left %d key entries and %d enclave keys", len(config), len(mem.keys))
+	}
+}
+
+func TestParseConfirm(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		confirm bool
+		reuse   time.Duration
+		ok      bool
+	}{
+		{"", false, 0, true},
+		{"never", false, 0, true},
+		{"always", true, 0, true},
+		{"30s", true, 30 * time.Second, true},
+		{"5m", true, 5 * time.Minute, true},
+		{"6m", false, 0, false},
+		{"0s", false, 0, false},
+		{"sometimes", false, 0, false},
+	} {
+		confirm, reuse, err := ParseConfirm(tc.in)
+		if (err == nil) != tc.ok || confirm != tc.confirm || reuse != tc.reuse {
+			t.Errorf("ParseConfirm(%q) = %v, %v, %v", tc.in, confirm, reuse, err)
+		}
+	}
+}
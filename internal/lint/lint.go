@@ -0,0 +1,243 @@
+// Package lint finds the secrets that template and manifest files refer
+// to, checks them against a store, and normalizes the files' layout.
+//
+// Templates are consul-template or Vault agent templates rendered against
+// lockbox's Consul and Vault facades: {{ key "NAME" }}, {{ keyOrDefault
+// "NAME" "fallback" }}, {{ keyExists "NAME" }} and {{ with secret
+// "secret/data/NAME" }}. Any file containing "{{" is read as a template.
+//
+// Manifests list the keys a deployment needs, one per line, optionally as
+// KEY=value or export KEY=value lines like an .env.example. Lines starting
+// with # are comments.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Ref is a reference to a secret at a position in a file
+type Ref struct {
+	Key  string
+	Line int
+	Col  int
+	// Optional refs tolerate a missing secret (keyOrDefault, keyExists)
+	Optional bool
+}
+
+// Problem is a reference that fails a check
+type Problem struct {
+	Ref
+	Message string
+}
+
+// String formats p as LINE:COL: MESSAGE
+func (p Problem) String() string {
+	return fmt.Sprintf("%d:%d: %s", p.Line, p.Col, p.Message)
+}
+
+// Options are what references are checked against
+type Options struct {
+	// Keys are the secrets in the store
+	Keys []string
+	// Validate rejects malformed key names; nil accepts all
+	Validate func(key string) error
+	// Allowed reports whether the deploying identity may read key; nil
+	// allows all
+	Allowed func(key string) bool
+}
+
+var (
+	// consulRef matches consul-template key lookups
+	consulRef = regexp.MustCompile(`\b(key|keyOrDefault|keyExists)\s+"([^"]*)"`)
+	// vaultRef matches Vault agent secret lookups on the secret/ mount
+	vaultRef = regexp.MustCompile(`\bsecret\s+"secret/(?:data/|metadata/)?([^"?]*)`)
+	// action matches a template action with its trim markers
+	action = regexp.MustCompile(`(?s)\{\{(-\s)?(.*?)(\s-)?\}\}`)
+)
+
+// IsTemplate reports whether data is read as a template
+func IsTemplate(data []byte) bool {
+	return bytes.Contains(data, []byte("{{"))
+}
+
+// Scan returns the secret references in a template or manifest
+func Scan(data []byte) []Ref {
+	if IsTemplate(data) {
+		return scanTemplate(data)
+	}
+	return scanManifest(data)
+}
+
+// scanTemplate finds key and secret lookups in template actions
+func scanTemplate(data []byte) []Ref {
+	var refs []Ref
+	for _, a := range action.FindAllIndex(data, -1) {
+		body := data[a[0]:a[1]]
+		for _, m := range consulRef.FindAllSubmatchIndex(body, -1) {
+			fn := string(body[m[2]:m[3]])
+			refs = append(refs, newRef(data, a[0]+m[4], string(body[m[4]:m[5]]), fn != "key"))
+		}
+		for _, m := range vaultRef.FindAllSubmatchIndex(body, -1) {
+			refs = append(refs, newRef(data, a[0]+m[2], string(body[m[2]:m[3]]), false))
+		}
+	}
+	slices.SortStableFunc(refs, func(a, b Ref) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Col - b.Col
+	})
+	return refs
+}
+
+// scanManifest reads one key per non-comment line
+func scanManifest(data []byte) []Ref {
+	var refs []Ref
+	for i, line := range strings.Split(string(data), "\n") {
+		key, col := manifestKey(line)
+		if key != "" {
+			refs = append(refs, Ref{Key: key, Line: i + 1, Col: col})
+		}
+	}
+	return refs
+}
+
+// manifestKey returns the key on a manifest line and its 1-based column
+func manifestKey(line string) (string, int) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return "", 0
+	}
+	col := strings.Index(line, trimmed) + 1
+	if rest, ok := strings.CutPrefix(trimmed, "export "); ok {
+		col += len(trimmed) - len(strings.TrimLeft(rest, " \t"))
+		trimmed = strings.TrimLeft(rest, " \t")
+	}
+	key, _, _ := strings.Cut(trimmed, "=")
+	return strings.TrimSpace(key), col
+}
+
+// newRef returns a reference to key starting at offset in data
+func newRef(data []byte, offset int, key string, optional bool) Ref {
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return Ref{Key: key, Line: line, Col: col, Optional: optional}
+}
+
+// Check returns the references that are malformed, point at missing
+// secrets, or are not readable by the deploying identity
+func Check(refs []Ref, opts Options) []Problem {
+	var problems []Problem
+	for _, ref := range refs {
+		if opts.Validate != nil {
+			if err := opts.Validate(ref.Key); err != nil {
+				problems = append(problems, Problem{ref, err.Error()})
+				continue
+			}
+		}
+		if !slices.Contains(opts.Keys, ref.Key) {
+			if !ref.Optional {
+				problems = append(problems, Problem{ref, fmt.Sprintf("secret '%s' not found", ref.Key)})
+			}
+			continue
+		}
+		if opts.Allowed != nil && !opts.Allowed(ref.Key) {
+			problems = append(problems, Problem{ref, fmt.Sprintf("access to secret '%s' denied", ref.Key)})
+		}
+	}
+	return problems
+}
+
+// Format returns data in canonical form: trailing whitespace removed, runs
+// of blank lines collapsed and a single final newline. Template actions
+// get one space inside their delimiters; manifests have their keys sorted
+// and deduplicated within each block of consecutive key lines.
+func Format(data []byte) []byte {
+	text := string(data)
+	if IsTemplate(data) {
+		text = action.ReplaceAllStringFunc(text, formatAction)
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	if !IsTemplate(data) {
+		lines = sortBlocks(lines)
+	}
+
+	var out []string
+	for _, line := range lines {
+		if line == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, line)
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// formatAction puts one space inside the delimiters of a template action.
+// Comments are left alone since Go templates require them to touch the
+// delimiters.
+func formatAction(a string) string {
+	m := action.FindStringSubmatch(a)
+	body := strings.TrimSpace(m[2])
+	if strings.HasPrefix(body, "/*") && m[1] == "" && m[3] == "" {
+		return a
+	}
+	left, right := "{{ ", " }}"
+	if m[1] != "" {
+		left = "{{- "
+	}
+	if m[3] != "" {
+		right = " -}}"
+	}
+	return left + body + right
+}
+
+// sortBlocks sorts each run of manifest key lines by key, dropping later
+// duplicates
+func sortBlocks(lines []string) []string {
+	var out []string
+	for i := 0; i < len(lines); {
+		if key, _ := manifestKey(lines[i]); key == "" {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(lines) {
+			if key, _ := manifestKey(lines[j]); key == "" {
+				break
+			}
+			j++
+		}
+		block := slices.Clone(lines[i:j])
+		slices.SortStableFunc(block, func(a, b string) int {
+			ka, _ := manifestKey(a)
+			kb, _ := manifestKey(b)
+			return strings.Compare(ka, kb)
+		})
+		block = slices.CompactFunc(block, func(a, b string) bool {
+			ka, _ := manifestKey(a)
+			kb, _ := manifestKey(b)
+			return ka == kb
+		})
+		for _, line := range block {
+			out = append(out, strings.TrimLeft(line, " \t"))
+		}
+		i = j
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScanTemplate(t *testing.T) {
+	tmpl := `db_password = "{{ key "DB_PASSWORD" }}"
+region = "{{keyOrDefault "REGION" "eu"}}"
+{{- with secret "secret/data/API_KEY" }}
+api_key = "{{ .Data.data.value }}"
+{{- end }}
+`
+	refs := Scan([]byte(tmpl))
+	want := []Ref{
+		{Key: "DB_PASSWORD", Line: 1, Col: 24},
+		{Key: "REGION", Line: 2, Col: 27, Optional: true},
+		{Key: "API_KEY", Line: 3, Col: 30},
+	}
+	if fmt.Sprint(refs) != fmt.Sprint(want) {
+		t.Errorf("Scan = %v, expected %v", refs, want)
+	}
+}
+
+func TestScanManifest(t *testing.T) {
+	manifest := "# required by the app\nDB_PASSWORD\nexport API_KEY=changeme\n\n  REGION=\n"
+	var keys []string
+	for _, ref := range Scan([]byte(manifest)) {
+		keys = append(keys, fmt.Sprintf("%s@%d:%d", ref.Key, ref.Line, ref.Col))
+	}
+	if got := strings.Join(keys, " "); got != "DB_PASSWORD@2:1 API_KEY@3:8 REGION@5:3" {
+		t.Errorf("Unexpected refs %s", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	refs := []Ref{
+		{Key: "PRESENT", Line: 1, Col: 1},
+		{Key: "MISSING", Line: 2, Col: 1},
+		{Key: "FALLBACK", Line: 3, Col: 1, Optional: true},
+		{Key: "HIDDEN", Line: 4, Col: 1},
+		{Key: "BAD/KEY", Line: 5, Col: 1},
+	}
+	problems := Check(refs, Options{
+		Keys: []string{"PRESENT", "HIDDEN"},
+		Validate: func(key string) error {
+			if strings.Contains(key, "/") {
+				return fmt.Errorf("invalid key '%s'", key)
+			}
+			return nil
+		},
+		Allowed: func(key string) bool { return key != "HIDDEN" },
+	})
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		"2:1: secret 'MISSING' not found",
+		"4:1: access to secret 'HIDDEN' denied",
+		"5:1: invalid key 'BAD/KEY'",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Check = %q, expected %q", got, want)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+	}{
+		{"template", "a = {{key \"A\"}}  \n\n\n{{-  with secret \"secret/data/B\"   -}}\n{{/* note */}}{{-3}}", "a = {{ key \"A\" }}\n\n{{- with secret \"secret/data/B\" -}}\n{{/* note */}}{{ -3 }}\n"},
+		{"manifest", "# app\nZED\n  ALPHA=x \nZED\n\n\nBETA\n\n", "# app\nALPHA=x\nZED\n\nBETA\n"},
+		{"empty", "\n\n", ""},
+	}
+	for _, tt := range tests {
+		if got := string(Format([]byte(tt.in))); got != tt.out {
+			t.Errorf("%s: Format = %q, expected %q", tt.name, got, tt.out)
+		}
+		if got := string(Format(Format([]byte(tt.in)))); got != tt.out {
+			t.Errorf("%s: Format is not idempotent: %q", tt.name, got)
+		}
+	}
+}
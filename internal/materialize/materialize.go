@@ -0,0 +1,184 @@
+package materialize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Output formats
+const (
+	FormatFiles  = "files"
+	FormatDotenv = "dotenv"
+)
+
+// DotenvFile is the file written in dotenv format
+const DotenvFile = "secrets.env"
+
+// manifestFile records what the last run wrote, so re-runs can skip
+// unchanged output and prune files for deleted secrets
+const manifestFile = ".lockbox-manifest"
+
+// manifest is the content of manifestFile
+type manifest struct {
+	Checksum string   `json:"checksum"`
+	Files    []string `json:"files"`
+}
+
+// Options configures Write
+type Options struct {
+	// Format is FormatFiles (one file per secret) or FormatDotenv
+	Format string
+	// Mode is the permission of written files
+	Mode os.FileMode
+}
+
+// Write materializes secrets into dir. Files are written atomically with
+// opts.Mode. If the secrets, format and mode match the previous run and its
+// files are intact, nothing is written and changed is false.
+func Write(dir string, secrets map[string]string, opts Options) (changed bool, err error) {
+	rendered, err := render(secrets, opts.Format)
+	if err != nil {
+		return false, err
+	}
+	sum := checksum(rendered, opts)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	previous, _ := readManifest(dir)
+	if previous.Checksum == sum && intact(dir, previous.Files) {
+		return false, nil
+	}
+
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := WriteFile(filepath.Join(dir, name), []byte(rendered[name]), opts.Mode); err != nil {
+			return false, err
+		}
+	}
+
+	// Remove files written by a previous run for secrets that are gone
+	for _, name := range previous.Files {
+		if _, keep := rendered[name]; !keep {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	data, _ := json.Marshal(manifest{Checksum: sum, Files: names})
+	if err := WriteFile(filepath.Join(dir, manifestFile), data, 0600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// render maps output file names to their contents
+func render(secrets map[string]string, format string) (map[string]string, error) {
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		if key == "" || key == "." || key == ".." || key == manifestFile || strings.ContainsAny(key, "/\\\x00") {
+			return nil, fmt.Errorf("secret key '%s' cannot be used as a file name", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	switch format {
+	case FormatFiles:
+		return secrets, nil
+	case FormatDotenv:
+		var b strings.Builder
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s=\"%s\"\n", key, escapeDotenv(secrets[key]))
+		}
+		return map[string]string{DotenvFile: b.String()}, nil
+	default:
+		return nil, fmt.Errorf("unknown format '%s' (expected %s or %s)", format, FormatFiles, FormatDotenv)
+	}
+}
+
+// escapeDotenv escapes a value for a double-quoted dotenv assignment
+func escapeDotenv(value string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		"\"", "\\\"",
+		"$", "\\$",
+		"`", "\\`",
+		"\n", "\\n",
+	).Replace(value)
+}
+
+// checksum identifies the rendered output and the options it was written with
+func checksum(rendered map[string]string, opts Options) string {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%o\x00", opts.Format, opts.Mode)
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(rendered[name]), rendered[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readManifest loads the manifest of a previous run, if any
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// intact reports whether all previously written files still exist
+func intact(dir string, files []string) bool {
+	for _, name := range files {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteFile writes data with mode to a temporary file in the same
+// directory and renames it over path, so readers never see a partial file
+// nor one with wider permissions
+func WriteFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".lockbox-tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
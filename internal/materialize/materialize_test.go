@@ -0,0 +1,76 @@
+package materialize
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Format: FormatFiles, Mode: 0400}
+
+	changed, err := Write(dir, map[string]string{"API_KEY": "secret123", "OLD": "x"}, opts)
+	if err != nil || !changed {
+		t.Fatalf("First Write = %v, %v", changed, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "API_KEY"))
+	if string(data) != "secret123" {
+		t.Errorf("Unexpected content %q", data)
+	}
+	info, _ := os.Stat(filepath.Join(dir, "API_KEY"))
+	if info.Mode().Perm() != 0400 {
+		t.Errorf("Expected mode 0400, got %v", info.Mode().Perm())
+	}
+
+	// Unchanged secrets skip writing
+	changed, err = Write(dir, map[string]string{"API_KEY": "secret123", "OLD": "x"}, opts)
+	if err != nil || changed {
+		t.Errorf("Repeat Write = %v, %v, expected a skip", changed, err)
+	}
+
+	// A deleted output file forces a rewrite
+	os.Remove(filepath.Join(dir, "OLD"))
+	if changed, _ := Write(dir, map[string]string{"API_KEY": "secret123", "OLD": "x"}, opts); !changed {
+		t.Errorf("Expected rewrite after a file went missing")
+	}
+
+	// Removed secrets are pruned, changed ones replaced despite 0400
+	changed, err = Write(dir, map[string]string{"API_KEY": "rotated"}, opts)
+	if err != nil || !changed {
+		t.Fatalf("Write after change = %v, %v", changed, err)
+	}
+	data, _ = os.ReadFile(filepath.Join(dir, "API_KEY"))
+	if string(data) != "rotated" {
+		t.Errorf("Expected rotated value, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "OLD")); !os.IsNotExist(err) {
+		t.Errorf("Expected OLD to be pruned")
+	}
+}
+
+func TestWriteDotenv(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := Write(dir, map[string]string{"B": "two\nlines", "A": `say "hi" $HOME`}, Options{Format: FormatDotenv, Mode: 0440})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, DotenvFile))
+	want := "A=\"say \\\"hi\\\" \\$HOME\"\nB=\"two\\nlines\"\n"
+	if string(data) != want {
+		t.Errorf("Dotenv content = %q, expected %q", data, want)
+	}
+}
+
+func TestWriteRejects(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Write(dir, map[string]string{"a/b": "x"}, Options{Format: FormatFiles, Mode: 0400}); err == nil {
+		t.Errorf("Accepted a key with a path separator")
+	}
+	if _, err := Write(dir, map[string]string{"A": "x"}, Options{Format: "yaml", Mode: 0400}); err == nil {
+		t.Errorf("Accepted an unknown format")
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushTimeout bounds how long a push may delay the CLI from exiting
+const pushTimeout = 5 * time.Second
+
+// Run describes a single CLI invocation reported to a pushgateway
+type Run struct {
+	Command  string
+	Instance string
+	Duration time.Duration
+	ExitCode int
+	Finished time.Time
+}
+
+// Format renders the run in the Prometheus text exposition format
+func (r Run) Format() []byte {
+	success := 0
+	if r.ExitCode == 0 {
+		success = 1
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE lockbox_command_duration_seconds gauge\n")
+	fmt.Fprintf(&buf, "lockbox_command_duration_seconds %g\n", r.Duration.Seconds())
+	fmt.Fprintf(&buf, "# TYPE lockbox_command_success gauge\n")
+	fmt.Fprintf(&buf, "lockbox_command_success %d\n", success)
+	fmt.Fprintf(&buf, "# TYPE lockbox_command_exit_code gauge\n")
+	fmt.Fprintf(&buf, "lockbox_command_exit_code %d\n", r.ExitCode)
+	fmt.Fprintf(&buf, "# TYPE lockbox_command_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&buf, "lockbox_command_last_run_timestamp_seconds %d\n", r.Finished.Unix())
+	return buf.Bytes()
+}
+
+// Push sends the run to the pushgateway at gateway. Metrics are grouped by
+// job "lockbox", instance and command, so each command on each machine keeps
+// its own most recent result.
+func Push(gateway string, r Run) error {
+	if !strings.Contains(gateway, "://") {
+		gateway = "http://" + gateway
+	}
+
+	target := fmt.Sprintf("%s/metrics/job/lockbox/instance/%s/command/%s",
+		strings.TrimRight(gateway, "/"),
+		url.PathEscape(r.Instance),
+		url.PathEscape(r.Command),
+	)
+
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(r.Format()))
+	if err != nil {
+		return fmt.Errorf("failed to create push request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: pushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pushgateway returned status %d: %s", resp.StatusCode, body)
+	}
+
+	return nil
+}
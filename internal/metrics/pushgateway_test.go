@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	var gotMethod, gotPath, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	run := Run{
+		Command:  "env",
+		Instance: "host-1",
+		Duration: 1500 * time.Millisecond,
+		ExitCode: 1,
+		Finished: time.Unix(1700000000, 0),
+	}
+
+	if err := Push(server.URL, run); err != nil {
+		t.Fatalf("Push() failed: %v", err)
+	}
+
+	if gotMethod != http.MethodPut {
+		t.Errorf("Expected PUT, got %s", gotMethod)
+	}
+	if gotPath != "/metrics/job/lockbox/instance/host-1/command/env" {
+		t.Errorf("Unexpected push path: %s", gotPath)
+	}
+
+	for _, want := range []string{
+		"lockbox_command_duration_seconds 1.5\n",
+		"lockbox_command_success 0\n",
+		"lockbox_command_exit_code 1\n",
+		"lockbox_command_last_run_timestamp_seconds 1700000000\n",
+	} {
+		if !strings.Contains(gotBody, want) {
+			t.Errorf("Expected body to contain %q, got:\n%s", want, gotBody)
+		}
+	}
+}
+
+func TestPushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	if err := Push(server.URL, Run{Command: "get", Instance: "h"}); err == nil {
+		t.Error("Push() should fail on a non-2xx response")
+	}
+}
@@ -0,0 +1,111 @@
+package multiuser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultSystemDir holds one store directory per UID plus shared group
+// stores. It is owned by root:lockbox with mode 2771 so only the setgid
+// helper can create entries, while users can reach their own directory.
+const DefaultSystemDir = "/var/lib/lockbox"
+
+// sharedDirName is the subdirectory of the system dir holding group stores
+const sharedDirName = "shared"
+
+// SystemDir returns the system directory, honouring LOCKBOX_SYSTEM_DIR.
+// The privileged helper must not call this; it uses DefaultSystemDir.
+func SystemDir() string {
+	if dir := os.Getenv("LOCKBOX_SYSTEM_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultSystemDir
+}
+
+// UserDir returns the per-user store directory for uid
+func UserDir(systemDir string, uid int) string {
+	return filepath.Join(systemDir, strconv.Itoa(uid))
+}
+
+// UserStorePath returns the per-user database path for uid, and whether the
+// directory has been provisioned and belongs to uid
+func UserStorePath(systemDir string, uid int) (string, bool) {
+	dir := UserDir(systemDir, uid)
+	if err := checkOwned(dir, uid); err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, "lockbox.db"), true
+}
+
+// SharedStorePath returns the database path of the shared store for group
+func SharedStorePath(systemDir, group string) (string, error) {
+	if group == "" || group == "." || group == ".." || strings.ContainsAny(group, "/\\\x00") {
+		return "", fmt.Errorf("invalid group name '%s'", group)
+	}
+	return filepath.Join(systemDir, sharedDirName, group+".db"), nil
+}
+
+// Provision creates the per-user directory for uid with mode 0700. It is
+// idempotent, and refuses to reuse a path that is not a directory owned by
+// uid (e.g. a symlink planted by another user).
+func Provision(systemDir string, uid int) (string, error) {
+	dir := UserDir(systemDir, uid)
+
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := checkOwned(dir, uid); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to set permissions on %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// checkOwned verifies that dir is a real directory owned by uid
+func checkOwned(dir string, uid int) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if owner, ok := fileOwner(info); ok && owner != uid {
+		return fmt.Errorf("%s is owned by uid %d, not %d", dir, owner, uid)
+	}
+	return nil
+}
+
+// PathOwner returns the UID owning path, and false when it cannot be
+// determined
+func PathOwner(path string) (int, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return fileOwner(info)
+}
+
+// IsMember reports whether the calling process's real user belongs to the
+// group with gid, going by its real and supplementary groups. Root is a
+// member of every group.
+func IsMember(gid int) (bool, error) {
+	if os.Getuid() == 0 || os.Getgid() == gid {
+		return true, nil
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return false, fmt.Errorf("failed to read groups: %w", err)
+	}
+	for _, g := range groups {
+		if g == gid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
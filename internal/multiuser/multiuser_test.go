@@ -0,0 +1,69 @@
+package multiuser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvision(t *testing.T) {
+	systemDir := t.TempDir()
+	uid := os.Getuid()
+
+	if _, ok := UserStorePath(systemDir, uid); ok {
+		t.Fatalf("UserStorePath reported an unprovisioned directory")
+	}
+
+	dir, err := Provision(systemDir, uid)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	info, _ := os.Stat(dir)
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Expected mode 0700, got %v", info.Mode().Perm())
+	}
+
+	// Re-provisioning is idempotent
+	if _, err := Provision(systemDir, uid); err != nil {
+		t.Errorf("Second Provision failed: %v", err)
+	}
+
+	path, ok := UserStorePath(systemDir, uid)
+	if !ok || path != filepath.Join(systemDir, filepath.Base(dir), "lockbox.db") {
+		t.Errorf("Unexpected user store path %q (ok=%v)", path, ok)
+	}
+}
+
+func TestProvisionRefusesSymlink(t *testing.T) {
+	systemDir := t.TempDir()
+	uid := os.Getuid()
+
+	target := t.TempDir()
+	os.Symlink(target, UserDir(systemDir, uid))
+
+	if _, err := Provision(systemDir, uid); err == nil {
+		t.Errorf("Provision accepted a planted symlink")
+	}
+	if _, ok := UserStorePath(systemDir, uid); ok {
+		t.Errorf("UserStorePath followed a planted symlink")
+	}
+}
+
+func TestSharedStorePath(t *testing.T) {
+	path, err := SharedStorePath("/var/lib/lockbox", "deploy")
+	if err != nil || path != "/var/lib/lockbox/shared/deploy.db" {
+		t.Errorf("SharedStorePath = %q, %v", path, err)
+	}
+	for _, group := range []string{"", ".", "..", "../etc", "a/b"} {
+		if _, err := SharedStorePath("/var/lib/lockbox", group); err == nil {
+			t.Errorf("SharedStorePath accepted %q", group)
+		}
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	member, err := IsMember(os.Getgid())
+	if err != nil || !member {
+		t.Errorf("Expected membership of own primary group, got %v, %v", member, err)
+	}
+}
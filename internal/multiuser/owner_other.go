@@ -0,0 +1,10 @@
+//go:build !unix
+
+package multiuser
+
+import "os"
+
+// fileOwner is unsupported on platforms without POSIX ownership
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
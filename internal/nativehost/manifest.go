@@ -0,0 +1,79 @@
+package nativehost
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Name is the name extensions connect to the host by
+const Name = "io.github.mq37.lockbox"
+
+// Browsers are the browsers a host can be installed for
+var Browsers = []string{"chrome", "chromium", "firefox"}
+
+// Manifest returns the host manifest letting the extension with id start
+// the host at path in browser
+func Manifest(browser, id, path string) ([]byte, error) {
+	m := map[string]any{
+		"name":        Name,
+		"description": "lockbox credentials",
+		"path":        path,
+		"type":        "stdio",
+	}
+	switch browser {
+	case "chrome", "chromium":
+		m["allowed_origins"] = []string{"chrome-extension://" + id + "/"}
+	case "firefox":
+		m["allowed_extensions"] = []string{id}
+	default:
+		return nil, fmt.Errorf("unknown browser '%s'", browser)
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// ManifestDir returns the directory browser looks for the current user's
+// host manifests in
+func ManifestDir(browser string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dirs := map[string]map[string]string{
+		"linux": {
+			"chrome":   ".config/google-chrome/NativeMessagingHosts",
+			"chromium": ".config/chromium/NativeMessagingHosts",
+			"firefox":  ".mozilla/native-messaging-hosts",
+		},
+		"darwin": {
+			"chrome":   "Library/Application Support/Google/Chrome/NativeMessagingHosts",
+			"chromium": "Library/Application Support/Chromium/NativeMessagingHosts",
+			"firefox":  "Library/Application Support/Mozilla/NativeMessagingHosts",
+		},
+	}[runtime.GOOS]
+	if dirs == nil {
+		// Windows finds manifests through the registry
+		return "", fmt.Errorf("installing the native host is not supported on %s; register the manifest by hand", runtime.GOOS)
+	}
+	dir, ok := dirs[browser]
+	if !ok {
+		return "", fmt.Errorf("unknown browser '%s'", browser)
+	}
+	return filepath.Join(home, dir), nil
+}
+
+// Wrapper returns the script a manifest points browsers at, which runs
+// 'lockbox native-host' from exe against the store at dbPath. Browsers
+// start the manifest's path with arguments of their own and no way to add
+// any, and without the user's shell environment.
+func Wrapper(exe, dbPath string) []byte {
+	return []byte("#!/bin/sh\nLOCKBOX_DB_PATH=" + shellQuote(dbPath) + " exec " + shellQuote(exe) + " native-host \"$@\"\n")
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
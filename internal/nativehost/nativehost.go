@@ -0,0 +1,169 @@
+// Package nativehost speaks the native messaging protocol of Chrome and
+// Firefox, so a browser extension can ask lockbox for the credentials of
+// the site it is on. Each message is JSON preceded by its length as a
+// 32-bit integer in native byte order, over the host's stdin and stdout.
+//
+// Secrets are scoped to sites with domain tags: a secret tagged
+// domain:example.com is offered on example.com and its subdomains, and
+// never on any other site.
+package nativehost
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// DomainTag prefixes the tags naming the sites a secret is offered on
+const DomainTag = "domain:"
+
+// MaxMessage bounds the messages read and written. Browsers accept up to
+// 1 MiB from a host; requests are far smaller.
+const MaxMessage = 1 << 20
+
+// Request is a message from the extension
+type Request struct {
+	// ID is echoed in the response, to match them up
+	ID string `json:"id,omitempty"`
+	// Type is list, for the secrets offered on URL, or get, for the value
+	// of Key
+	Type string `json:"type"`
+	// URL is the page the extension is filling in
+	URL string `json:"url"`
+	Key string `json:"key,omitempty"`
+}
+
+// Secret describes a secret offered on a site, without its value
+type Secret struct {
+	Key         string `json:"key"`
+	Description string `json:"description,omitempty"`
+}
+
+// Response answers a Request
+type Response struct {
+	ID      string   `json:"id,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Secrets []Secret `json:"secrets,omitempty"`
+	Value   string   `json:"value,omitempty"`
+}
+
+// Handler looks secrets up for the sites requests come from
+type Handler interface {
+	// List returns the secrets offered on host
+	List(host string) ([]Secret, error)
+	// Get returns the value of key if it is offered on host, after the
+	// user has confirmed
+	Get(host, key string) (string, error)
+}
+
+// ReadMessage reads one message into v, returning io.EOF once the browser
+// has closed the stream
+func ReadMessage(r io.Reader, v any) error {
+	var n uint32
+	if err := binary.Read(r, binary.NativeEndian, &n); err != nil {
+		return err
+	}
+	if n > MaxMessage {
+		return fmt.Errorf("message of %d bytes is too long", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteMessage writes v as one message
+func WriteMessage(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxMessage {
+		return fmt.Errorf("message of %d bytes is too long", len(data))
+	}
+	if err := binary.Write(w, binary.NativeEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Serve answers requests from r on w with h until r is closed
+func Serve(r io.Reader, w io.Writer, h Handler) error {
+	for {
+		var req Request
+		err := ReadMessage(r, &req)
+		if err == io.EOF {
+			return nil
+		}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			// The frame was read whole, so the stream is still in step
+			if err := WriteMessage(w, Response{Error: "invalid request: " + err.Error()}); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := WriteMessage(w, handle(req, h)); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers req with h
+func handle(req Request, h Handler) Response {
+	resp := Response{ID: req.ID}
+	host, err := Host(req.URL)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	switch req.Type {
+	case "list":
+		resp.Secrets, err = h.List(host)
+	case "get":
+		resp.Value, err = h.Get(host, req.Key)
+	default:
+		err = fmt.Errorf("unknown request type '%s'", req.Type)
+	}
+	if err != nil {
+		resp = Response{ID: req.ID, Error: err.Error()}
+	}
+	return resp
+}
+
+// Host returns the host of the page at rawURL, which must be https
+func Host(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid url '%s'", rawURL)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("credentials are only offered to https pages, not '%s'", rawURL)
+	}
+	return strings.ToLower(u.Hostname()), nil
+}
+
+// Offered reports whether a secret with tags is offered on host: whether
+// one of its domain tags names host or a parent domain of it
+func Offered(tags []string, host string) bool {
+	for _, tag := range tags {
+		domain, ok := strings.CutPrefix(tag, DomainTag)
+		if !ok || domain == "" {
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
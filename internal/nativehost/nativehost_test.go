@@ -0,0 +1,128 @@
+package nativehost
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// fakeHandler offers API_KEY on example.com
+type fakeHandler struct{}
+
+func (fakeHandler) List(host string) ([]Secret, error) {
+	if Offered([]string{"domain:example.com"}, host) {
+		return []Secret{{Key: "API_KEY", Description: "Example login"}}, nil
+	}
+	return nil, nil
+}
+
+func (fakeHandler) Get(host, key string) (string, error) {
+	if key != "API_KEY" || !Offered([]string{"domain:example.com"}, host) {
+		return "", errors.New("not offered")
+	}
+	return "sk-123", nil
+}
+
+func TestServe(t *testing.T) {
+	var in bytes.Buffer
+	for _, req := range []Request{
+		{ID: "1", Type: "list", URL: "https://login.example.com/signin"},
+		{ID: "2", Type: "get", URL: "https://example.com/", Key: "API_KEY"},
+		{ID: "3", Type: "get", URL: "https://example.org/", Key: "API_KEY"},
+		{ID: "4", Type: "get", URL: "http://example.com/", Key: "API_KEY"},
+		{ID: "5", Type: "delete", URL: "https://example.com/"},
+	} {
+		WriteMessage(&in, req)
+	}
+	in.Write([]byte{2, 0, 0, 0})
+	in.WriteString("{]")
+
+	var out bytes.Buffer
+	if err := Serve(&in, &out, fakeHandler{}); err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	var got []Response
+	for {
+		var resp Response
+		if err := ReadMessage(&out, &resp); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		got = append(got, resp)
+	}
+	if len(got) != 6 {
+		t.Fatalf("Got %d responses, want 6", len(got))
+	}
+	if len(got[0].Secrets) != 1 || got[0].Secrets[0].Key != "API_KEY" {
+		t.Errorf("list on a subdomain = %+v", got[0])
+	}
+	if got[1].Value != "sk-123" || got[1].ID != "2" {
+		t.Errorf("get = %+v", got[1])
+	}
+	for _, resp := range got[2:] {
+		if resp.Error == "" || resp.Value != "" {
+			t.Errorf("Response %s = %+v, want an error", resp.ID, resp)
+		}
+	}
+}
+
+func TestOffered(t *testing.T) {
+	tags := []string{"prod", "domain:Example.com"}
+	for host, want := range map[string]bool{
+		"example.com":         true,
+		"login.example.com":   true,
+		"badexample.com":      false,
+		"example.com.evil.io": false,
+		"example.org":         false,
+	} {
+		if got := Offered(tags, host); got != want {
+			t.Errorf("Offered(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	if err := ReadMessage(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f}), &Request{}); err == nil {
+		t.Error("ReadMessage of an oversized message succeeded")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	data, err := Manifest("chrome", "abcdef", "/usr/local/bin/lockbox-native-host")
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	var m map[string]any
+	json.Unmarshal(data, &m)
+	if m["name"] != Name || m["type"] != "stdio" || fmt.Sprint(m["allowed_origins"]) != "[chrome-extension://abcdef/]" {
+		t.Errorf("Chrome manifest = %s", data)
+	}
+	if data, _ := Manifest("firefox", "lockbox@example.com", "/x"); !bytes.Contains(data, []byte(`"allowed_extensions"`)) {
+		t.Errorf("Firefox manifest = %s", data)
+	}
+	if _, err := Manifest("lynx", "x", "/x"); err == nil {
+		t.Error("Manifest for an unknown browser succeeded")
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "lockbox")
+	os.WriteFile(exe, []byte("#!/bin/sh\necho \"$LOCKBOX_DB_PATH\" \"$@\"\n"), 0755)
+	script := filepath.Join(dir, "host.sh")
+	os.WriteFile(script, Wrapper(exe, "/tmp/it's here.db"), 0755)
+	out, err := exec.Command(script, "chrome-extension://abc/").Output()
+	if err != nil {
+		t.Fatalf("Wrapper failed: %v", err)
+	}
+	if string(out) != "/tmp/it's here.db native-host chrome-extension://abc/\n" {
+		t.Errorf("Wrapper ran %q", out)
+	}
+}
@@ -0,0 +1,74 @@
+package nativehost
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// StoreHandler serves the secrets of a store
+type StoreHandler struct {
+	Store *db.Store
+	Key   []byte
+	// Actor is who reads are recorded as
+	Actor string
+	// Confirm asks the user to allow reason, such as "fill API_KEY on
+	// example.com", before a value is handed out
+	Confirm func(reason string) error
+}
+
+// errNotOffered hides whether a secret that is not offered exists
+var errNotOffered = errors.New("no such secret for this site")
+
+// List returns the unexpired secrets offered on host
+func (h StoreHandler) List(host string) ([]Secret, error) {
+	infos, err := h.Store.ListSecretInfo()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	secrets := []Secret{}
+	for _, info := range infos {
+		if !info.Expired(now) && Offered(info.Tags, host) {
+			secrets = append(secrets, Secret{Key: info.Key, Description: info.Description})
+		}
+	}
+	return secrets, nil
+}
+
+// Get returns the value of key once the user confirms, if it is offered
+// on host and has not expired
+func (h StoreHandler) Get(host, key string) (string, error) {
+	meta, err := h.Store.SecretMeta(key)
+	if err == db.ErrNotFound || err == nil && !Offered(meta.Tags, host) {
+		return "", errNotOffered
+	} else if err != nil {
+		return "", err
+	}
+	if expires, err := h.Store.SecretExpiry(key); err != nil {
+		return "", err
+	} else if !expires.IsZero() && !time.Now().Before(expires) {
+		return "", errNotOffered
+	}
+
+	if err := h.Confirm(fmt.Sprintf("fill %s on %s", key, host)); err != nil {
+		h.Store.Audit(h.Actor, "read-denied", key+" on "+host)
+		return "", err
+	}
+	encrypted, err := h.Store.GetSecret(key)
+	if err != nil {
+		return "", err
+	}
+	value, err := crypto.Decrypt(encrypted, h.Key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt '%s': %w", key, err)
+	}
+	h.Store.Audit(h.Actor, "read-confirmed", key+" on "+host)
+	if err := h.Store.RecordAccess("native-host", h.Actor, []string{key}); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
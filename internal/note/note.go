@@ -0,0 +1,47 @@
+// Package note stores free-form notes, such as runbooks and recovery
+// instructions, as encrypted secrets of their own kind so they are never
+// exported by env or run.
+package note
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind tags secrets that hold notes
+const Kind = "note"
+
+// keyPrefix namespaces notes. The separator is rejected by the HTTP
+// server, so notes cannot be read remotely.
+const keyPrefix = "note/"
+
+// Key returns the store key for the note called name
+func Key(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("invalid note name '%s'", name)
+	}
+	return keyPrefix + name, nil
+}
+
+// Name returns the name of the note stored under key
+func Name(key string) string {
+	return strings.TrimPrefix(key, keyPrefix)
+}
+
+// Match is a line of a note containing a search term
+type Match struct {
+	Line int
+	Text string
+}
+
+// Search returns the lines of body containing query, ignoring case
+func Search(body, query string) []Match {
+	query = strings.ToLower(query)
+	var matches []Match
+	for i, line := range strings.Split(body, "\n") {
+		if strings.Contains(strings.ToLower(line), query) {
+			matches = append(matches, Match{Line: i + 1, Text: line})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,29 @@
+package note
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	key, err := Key("github recovery")
+	if err != nil || key != "note/github recovery" || Name(key) != "github recovery" {
+		t.Errorf("Key = %q, %v", key, err)
+	}
+	for _, name := range []string{"", "a/b", `a\b`} {
+		if _, err := Key(name); err == nil {
+			t.Errorf("Key(%q) succeeded", name)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	body := "# Runbook\nRestart the DB\nthen check db-replica\n"
+	want := []Match{{2, "Restart the DB"}, {3, "then check db-replica"}}
+	if got := Search(body, "db"); !slices.Equal(got, want) {
+		t.Errorf("Search = %v, expected %v", got, want)
+	}
+	if got := Search(body, "missing"); got != nil {
+		t.Errorf("Expected no matches, got %v", got)
+	}
+}
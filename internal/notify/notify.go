@@ -0,0 +1,273 @@
+// Package notify posts short messages about store events to chat
+// webhooks. Messages are rendered from fixed templates over event fields
+// that never hold secret values.
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// targetPrefix starts the config entries holding targets, followed by the
+// target's name
+const targetPrefix = "notify/"
+
+// Kinds are the supported target kinds
+var Kinds = []string{"slack", "discord", "matrix"}
+
+// Event types, and the message each renders to
+var templates = map[string]*template.Template{
+	"rotation":            parse("Rotated {{.Key}}"),
+	"rotation-failed":     parse("Rotation of {{.Key}} failed, the old value is still in use. Run 'lockbox audit --action rotate-failed' for details."),
+	"backup-failed":       parse("Backup to {{.Target}} failed: {{.Detail}}"),
+	"promotion":           parse("Promoted {{.Detail}} from {{.From}} to {{.Target}}"),
+	"promotion-requested": parse("Promotion of {{.Detail}} from {{.From}} to {{.Target}} awaits approval"),
+	"anomaly":             parse("Unusual access: {{.Detail}}. Run 'lockbox audit anomalies' for details."),
+	"checkout":            parse("{{.Key}} checked out by {{.From}} {{.Detail}}"),
+	"checkin":             parse("{{.Key}} checked in by {{.From}}"),
+	"checkout-expired":    parse("Checkout of {{.Key}} by {{.From}} has expired. Check it in with 'lockbox checkin {{.Key}}' or extend it with 'lockbox checkout {{.Key}}'."),
+}
+
+func parse(text string) *template.Template {
+	return template.Must(template.New("").Option("missingkey=error").Parse("lockbox{{with .Store}} ({{.}}){{end}}: " + text))
+}
+
+// Events returns the supported event types, sorted
+func Events() []string {
+	events := make([]string, 0, len(templates))
+	for e := range templates {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// Event is something targets are told about. Fields name keys, places and
+// outcomes; they must never hold values.
+type Event struct {
+	Type string
+	// Store identifies the store, such as a profile or host name
+	Store  string
+	Key    string
+	From   string
+	Target string
+	Detail string
+}
+
+// Message renders e
+func (e Event) Message() (string, error) {
+	t, ok := templates[e.Type]
+	if !ok {
+		return "", fmt.Errorf("unknown event '%s'", e.Type)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, e); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Target is a webhook notified of events
+type Target struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// URL is the webhook, which usually embeds a credential; it is stored
+	// encrypted
+	URL string `json:"-"`
+	// Events are the event types sent to the target; empty sends all
+	Events []string `json:"events,omitempty"`
+}
+
+// stored is a Target as kept in the config table
+type stored struct {
+	Target
+	URL []byte `json:"url"`
+}
+
+// Validate checks t's kind, URL and events
+func (t Target) Validate() error {
+	if !slices.Contains(Kinds, t.Kind) {
+		return fmt.Errorf("unknown target kind '%s' (supported: %s)", t.Kind, strings.Join(Kinds, ", "))
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("invalid webhook URL")
+	}
+	for _, e := range t.Events {
+		if _, ok := templates[e]; !ok {
+			return fmt.Errorf("unknown event '%s' (supported: %s)", e, strings.Join(Events(), ", "))
+		}
+	}
+	return nil
+}
+
+// Host returns the host of the target's URL, to show it without the
+// credential it embeds
+func (t Target) Host() string {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// Wants reports whether t is sent events of type event
+func (t Target) Wants(event string) bool {
+	return len(t.Events) == 0 || slices.Contains(t.Events, event)
+}
+
+// Add stores t, replacing any target of the same name
+func Add(store *db.Store, encKey []byte, t Target) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	data, err := encode(t, encKey)
+	if err != nil {
+		return err
+	}
+	return store.SetConfig(targetPrefix+t.Name, data)
+}
+
+// encode returns t as stored, with its URL encrypted
+func encode(t Target, encKey []byte) ([]byte, error) {
+	encrypted, err := crypto.Encrypt([]byte(t.URL), encKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stored{Target: t, URL: encrypted})
+}
+
+// Remove deletes the target called name
+func Remove(store *db.Store, name string) error {
+	if _, err := store.GetConfig(targetPrefix + name); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("no notification target '%s'", name)
+		}
+		return err
+	}
+	return store.DeleteConfig(targetPrefix + name)
+}
+
+// List returns every target, sorted by name
+func List(store *db.Store, encKey []byte) ([]Target, error) {
+	config, err := store.ListConfig()
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	for name, data := range config {
+		if !strings.HasPrefix(name, targetPrefix) {
+			continue
+		}
+		var s stored
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("corrupt notification target '%s': %w", strings.TrimPrefix(name, targetPrefix), err)
+		}
+		u, err := crypto.Decrypt(s.URL, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt notification target '%s': %w", s.Name, err)
+		}
+		s.Target.URL = string(u)
+		targets = append(targets, s.Target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets, nil
+}
+
+// Rekey returns every target's config entry re-encrypted from oldKey to
+// newKey, for the caller to write along with the rest of a key rotation
+func Rekey(store *db.Store, oldKey, newKey []byte) (map[string][]byte, error) {
+	targets, err := List(store, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string][]byte{}
+	for _, t := range targets {
+		if entries[targetPrefix+t.Name], err = encode(t, newKey); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// client posts to webhooks
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Post sends message to t
+func Post(t Target, message string) error {
+	method, target := http.MethodPost, t.URL
+	var body any
+	switch t.Kind {
+	case "slack":
+		body = map[string]string{"text": message}
+	case "discord":
+		body = map[string]string{"content": message}
+	case "matrix":
+		// The client-server API sends with PUT under a transaction ID
+		// unique to the message; the room and access token are in the URL
+		txn := make([]byte, 8)
+		rand.Read(txn)
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return err
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + hex.EncodeToString(txn)
+		method, target = http.MethodPut, u.String()
+		body = map[string]string{"msgtype": "m.text", "body": message}
+	default:
+		return fmt.Errorf("unknown target kind '%s'", t.Kind)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error names the URL, which embeds a credential
+		return fmt.Errorf("failed to notify '%s' at %s", t.Name, t.Host())
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notifying '%s' failed: %s returned %s", t.Name, t.Host(), resp.Status)
+	}
+	return nil
+}
+
+// Send posts e to every target that wants it. Every target is tried; the
+// errors of those that failed are returned together.
+func Send(store *db.Store, encKey []byte, e Event) error {
+	message, err := e.Message()
+	if err != nil {
+		return err
+	}
+	targets, err := List(store, encKey)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range targets {
+		if t.Wants(e.Type) {
+			errs = append(errs, Post(t, message))
+		}
+	}
+	return errors.Join(errs...)
+}
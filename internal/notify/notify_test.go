@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// request is a webhook call received by a test server
+type request struct {
+	Method, Path string
+	Body         map[string]string
+}
+
+func newWebhook(t *testing.T) (*httptest.Server, func() []request) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		req := request{Method: r.Method, Path: r.URL.Path}
+		json.Unmarshal(data, &req.Body)
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/broken") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]request(nil), got...)
+	}
+}
+
+func TestSend(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+	ts, received := newWebhook(t)
+
+	targets := []Target{
+		{Name: "slack", Kind: "slack", URL: ts.URL + "/services/T0/B0/secret-token"},
+		{Name: "discord", Kind: "discord", URL: ts.URL + "/api/webhooks/1/abc", Events: []string{"backup-failed"}},
+		{Name: "matrix", Kind: "matrix", URL: ts.URL + "/_matrix/client/v3/rooms/!r:x/send/m.room.message?access_token=t"},
+	}
+	for _, target := range targets {
+		if err := Add(store, key, target); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	config, _ := store.ListConfig()
+	for _, data := range config {
+		if strings.Contains(string(data), "secret-token") {
+			t.Error("webhook URL stored in plain text")
+		}
+	}
+
+	if err := Send(store, key, Event{Type: "rotation", Store: "prod", Key: "DB_PASSWORD"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	got := received()
+	if len(got) != 2 {
+		t.Fatalf("received %+v, want slack and matrix only", got)
+	}
+	for _, r := range got {
+		switch {
+		case r.Path == "/services/T0/B0/secret-token":
+			if r.Body["text"] != "lockbox (prod): Rotated DB_PASSWORD" {
+				t.Errorf("slack got %+v", r.Body)
+			}
+		case strings.HasPrefix(r.Path, "/_matrix/client/v3/rooms/!r:x/send/m.room.message/"):
+			if r.Method != http.MethodPut || r.Body["msgtype"] != "m.text" || r.Body["body"] != "lockbox (prod): Rotated DB_PASSWORD" {
+				t.Errorf("matrix got %+v", r)
+			}
+		default:
+			t.Errorf("unexpected request %+v", r)
+		}
+	}
+
+	Add(store, key, Target{Name: "broken", Kind: "slack", URL: ts.URL + "/broken/secret-token"})
+	err = Send(store, key, Event{Type: "backup-failed", Target: "/backups", Detail: "disk full"})
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("Send = %v, want an error without the URL", err)
+	}
+	if n := len(received()); n != 6 {
+		t.Errorf("received %d requests, want every target tried", n)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, target := range []Target{
+		{Kind: "teams", URL: "https://example.com"},
+		{Kind: "slack", URL: "hooks.slack.com/x"},
+		{Kind: "slack", URL: "https://hooks.slack.com/x", Events: []string{"canary"}},
+	} {
+		if target.Validate() == nil {
+			t.Errorf("Validate accepted %+v", target)
+		}
+	}
+	if _, err := (Event{Type: "nope"}).Message(); err == nil {
+		t.Error("Message rendered an unknown event")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	oldKey, _ := crypto.GenerateKey()
+	newKey, _ := crypto.GenerateKey()
+	Add(store, oldKey, Target{Name: "slack", Kind: "slack", URL: "https://hooks.slack.com/services/T0/B0/x"})
+
+	entries, err := Rekey(store, oldKey, newKey)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Rekey = %v, %v", entries, err)
+	}
+	for name, data := range entries {
+		store.SetConfig(name, data)
+	}
+	targets, err := List(store, newKey)
+	if err != nil || len(targets) != 1 || targets[0].URL != "https://hooks.slack.com/services/T0/B0/x" {
+		t.Errorf("List with the new key = %+v, %v", targets, err)
+	}
+}
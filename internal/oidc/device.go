@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// deviceGrantType is the OAuth 2.0 device authorization grant (RFC 8628)
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceCode is the device authorization response shown to the user
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// tokenResponse is a token endpoint response, successful or not
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// DeviceLogin runs the device authorization flow for clientID: it calls
+// prompt with the code the user must confirm in a browser, then polls until
+// the user approves and returns the ID token.
+func (p *Provider) DeviceLogin(ctx context.Context, clientID string, prompt func(DeviceCode)) (string, error) {
+	if p.DeviceAuthorizationEndpoint == "" {
+		return "", fmt.Errorf("identity provider does not support the device flow")
+	}
+
+	var resp struct {
+		DeviceCode
+		Error string `json:"error"`
+	}
+	form := url.Values{"client_id": {clientID}, "scope": {"openid profile email"}}
+	status, err := postForm(ctx, p.DeviceAuthorizationEndpoint, form, &resp)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d: %s", status, resp.Error)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to start device login: %w", err)
+	}
+	code := resp.DeviceCode
+	prompt(code)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if code.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(code.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+
+	poll := url.Values{"grant_type": {deviceGrantType}, "device_code": {code.DeviceCode}, "client_id": {clientID}}
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("device login timed out")
+		case <-time.After(interval):
+		}
+
+		var resp tokenResponse
+		if _, err := postForm(ctx, p.TokenEndpoint, poll, &resp); err != nil {
+			return "", fmt.Errorf("failed to poll for token: %w", err)
+		}
+		switch resp.Error {
+		case "":
+			if resp.IDToken == "" {
+				return "", fmt.Errorf("identity provider returned no ID token")
+			}
+			return resp.IDToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			if resp.ErrorDescription != "" {
+				return "", fmt.Errorf("device login failed: %s: %s", resp.Error, resp.ErrorDescription)
+			}
+			return "", fmt.Errorf("device login failed: %s", resp.Error)
+		}
+	}
+}
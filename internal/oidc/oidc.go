@@ -0,0 +1,85 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpClient is used for all requests to the identity provider
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Config identifies the identity provider and the client registered with it
+type Config struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+}
+
+// Provider holds the endpoints of an identity provider, read from its
+// discovery document
+type Provider struct {
+	Issuer                      string `json:"issuer"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+// Discover fetches the OpenID Connect discovery document of issuer
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	wellKnown := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+
+	var p Provider
+	if err := getJSON(ctx, wellKnown, &p); err != nil {
+		return nil, fmt.Errorf("failed to discover identity provider: %w", err)
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("identity provider reports issuer '%s', expected '%s'", p.Issuer, issuer)
+	}
+	return &p, nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned status %d: %s", url, resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// postForm posts form to endpoint and decodes the JSON response into v.
+// Error responses are decoded too, since OAuth reports errors as JSON.
+func postForm(ctx context.Context, endpoint string, form url.Values, v any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s returned status %d with an invalid body: %w", endpoint, resp.StatusCode, err)
+	}
+	return resp.StatusCode, nil
+}
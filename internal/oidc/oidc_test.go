@@ -0,0 +1,166 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProvider is a minimal identity provider signing RS256 ID tokens
+type fakeProvider struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+	polls   int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p := &fakeProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Provider{
+			Issuer:                      p.URL,
+			DeviceAuthorizationEndpoint: p.URL + "/device",
+			TokenEndpoint:               p.URL + "/token",
+			JWKSURI:                     p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(DeviceCode{DeviceCode: "dc", UserCode: "ABCD-EFGH", VerificationURI: p.URL + "/activate", Interval: 1})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != deviceGrantType || r.Form.Get("device_code") != "dc" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+			return
+		}
+		p.polls++
+		if p.polls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tokenResponse{Error: "authorization_pending"})
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{IDToken: p.idToken})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// sign returns an RS256 ID token carrying claims
+func (p *fakeProvider) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims returns valid claims for client lockbox
+func (p *fakeProvider) claims() map[string]any {
+	return map[string]any{
+		"iss":    p.URL,
+		"aud":    "lockbox",
+		"sub":    "alice",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"dev"},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p := newFakeProvider(t)
+	v := NewVerifier(Config{Issuer: p.URL, ClientID: "lockbox"})
+	ctx := context.Background()
+
+	claims, err := v.Verify(ctx, p.sign(t, "k1", p.claims()))
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if claims.Subject() != "alice" {
+		t.Errorf("Expected subject alice, got %q", claims.Subject())
+	}
+
+	bad := map[string]func(map[string]any){
+		"wrong audience": func(c map[string]any) { c["aud"] = []string{"other"} },
+		"wrong issuer":   func(c map[string]any) { c["iss"] = "https://evil.example" },
+		"expired":        func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no subject":     func(c map[string]any) { delete(c, "sub") },
+	}
+	for name, mutate := range bad {
+		c := p.claims()
+		mutate(c)
+		if _, err := v.Verify(ctx, p.sign(t, "k1", c)); err == nil {
+			t.Errorf("Verify accepted a token with %s", name)
+		}
+	}
+
+	tampered := p.sign(t, "k1", p.claims())
+	parts := strings.Split(tampered, ".")
+	other, _ := json.Marshal(map[string]any{"iss": p.URL, "aud": "lockbox", "sub": "root", "exp": time.Now().Add(time.Hour).Unix()})
+	parts[1] = base64.RawURLEncoding.EncodeToString(other)
+	if _, err := v.Verify(ctx, strings.Join(parts, ".")); err == nil {
+		t.Errorf("Verify accepted a token with a tampered payload")
+	}
+
+	if _, err := v.Verify(ctx, p.sign(t, "unknown", p.claims())); err == nil {
+		t.Errorf("Verify accepted a token signed with an unknown key")
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	p := newFakeProvider(t)
+	p.idToken = "id-token"
+
+	provider, err := Discover(context.Background(), p.URL)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+
+	var prompted DeviceCode
+	idToken, err := provider.DeviceLogin(context.Background(), "lockbox", func(c DeviceCode) { prompted = c })
+	if err != nil {
+		t.Fatalf("DeviceLogin failed: %v", err)
+	}
+	if idToken != "id-token" {
+		t.Errorf("Expected id-token, got %q", idToken)
+	}
+	if prompted.UserCode != "ABCD-EFGH" {
+		t.Errorf("Prompt got user code %q", prompted.UserCode)
+	}
+	if p.polls != 2 {
+		t.Errorf("Expected 2 polls, got %d", p.polls)
+	}
+}
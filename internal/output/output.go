@@ -0,0 +1,56 @@
+// Package output writes the structured output of --output for scripts and
+// tools such as jq: JSON, or the same document as YAML.
+//
+// YAML is produced from the JSON encoding, so both formats hold the same
+// fields in the same order.
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/yaml"
+)
+
+// Text is the default format: each command's own output for people
+const Text = "text"
+
+// Formats are the supported output formats
+var Formats = []string{Text, "json", "yaml"}
+
+// Validate checks that format is a supported output format
+func Validate(format string) error {
+	for _, f := range Formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format '%s' (supported: %s)", format, strings.Join(Formats, ", "))
+}
+
+// Write writes v to w as JSON or YAML
+func Write(w io.Writer, format string, v any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	switch format {
+	case "json":
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	default:
+		return Validate(format)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
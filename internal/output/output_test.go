@@ -0,0 +1,89 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+)
+
+type secret struct {
+	Key     string   `json:"key"`
+	Owner   string   `json:"owner"`
+	Version int      `json:"version"`
+	Tags    []string `json:"tags"`
+}
+
+func TestWriteYAML(t *testing.T) {
+	v := map[string]any{
+		"secrets": []secret{
+			{Key: "API_KEY", Owner: "uid:1000", Version: 3, Tags: []string{"prod"}},
+			{Key: "DB_URL", Version: 1, Tags: []string{}},
+		},
+		"values": map[string]string{
+			"A": "yes",
+			"B": "line1\nline2",
+			"C": "2026-10-16",
+			"D": "plain/path.txt",
+			"E": ".5",
+			"F": "a & b",
+		},
+		"empty": map[string]string{},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, "yaml", v); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want := `empty: {}
+secrets:
+  - key: API_KEY
+    owner: "uid:1000"
+    version: 3
+    tags:
+      - prod
+  - key: DB_URL
+    owner: ""
+    version: 1
+    tags: []
+values:
+  A: "yes"
+  B: "line1\nline2"
+  C: "2026-10-16"
+  D: plain/path.txt
+  E: ".5"
+  F: "a & b"
+`
+	if buf.String() != want {
+		t.Errorf("Unexpected YAML:\n%s\nexpected\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, "json", map[string]string{"A": "<&>"}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if want := "{\n  \"A\": \"<&>\"\n}\n"; buf.String() != want {
+		t.Errorf("Unexpected JSON %q, expected %q", buf.String(), want)
+	}
+
+	if err := Write(&buf, "xml", nil); err == nil {
+		t.Error("Write accepted an unknown format")
+	}
+	if err := Validate("text"); err != nil {
+		t.Errorf("Validate(text) = %v", err)
+	}
+}
+
+func TestMarkPlain(t *testing.T) {
+	t.Setenv("LOCKBOX_PLAIN", "")
+	if got := OK.String(); got != "✓" {
+		t.Errorf("OK = %q, want ✓", got)
+	}
+
+	t.Setenv("LOCKBOX_PLAIN", "1")
+	for mark, want := range map[Mark]string{OK: "OK", Fail: "FAIL", Warn: "WARN"} {
+		if got := mark.String(); got != want {
+			t.Errorf("%s = %q in plain mode, want %q", string(mark), got, want)
+		}
+	}
+}
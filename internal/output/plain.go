@@ -0,0 +1,31 @@
+package output
+
+import "os"
+
+// Mark starts a status line for people, such as "✓ Secret 'A' set"
+type Mark string
+
+// Marks of status lines
+const (
+	OK   Mark = "✓"
+	Fail Mark = "✗"
+	Warn Mark = "⚠"
+)
+
+// words spell each mark in plain mode
+var words = map[Mark]string{OK: "OK", Fail: "FAIL", Warn: "WARN"}
+
+// Plain reports whether plain mode is on with --plain ($LOCKBOX_PLAIN=1).
+// In plain mode marks are written as ASCII words and nothing is colored,
+// for screen readers and dumb terminals.
+func Plain() bool {
+	return os.Getenv("LOCKBOX_PLAIN") == "1"
+}
+
+// String returns the mark, or its word in plain mode
+func (m Mark) String() string {
+	if Plain() {
+		return words[m]
+	}
+	return string(m)
+}
@@ -0,0 +1,90 @@
+// Package pairing builds the URI a mobile device scans, as a QR code, to
+// pair with 'lockbox serve': the server on the local network, a one-time
+// pairing code it redeems at /v1/auth/pair, and the fingerprint of the
+// server's certificate when that is self-signed.
+package pairing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// URI returns the pairing URI for server and code, pinning the
+// certificate with fingerprint unless it is empty
+func URI(server, code, fingerprint string) string {
+	q := url.Values{"server": {server}, "code": {code}}
+	if fingerprint != "" {
+		q.Set("fp", fingerprint)
+	}
+	return "lockbox://pair?" + q.Encode()
+}
+
+// LocalURL returns the URL of port at this machine's first private IPv4
+// address, which devices on the same network can reach
+func LocalURL(port string, https bool) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list network addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || !ipnet.IP.IsPrivate() {
+			continue
+		}
+		scheme := "http"
+		if https {
+			scheme = "https"
+		}
+		return scheme + "://" + net.JoinHostPort(ipnet.IP.String(), port), nil
+	}
+	return "", errors.New("no address on a local network found; pass the server's URL with --url")
+}
+
+// Reachable reports whether a server answers connections at serverURL,
+// so a device is not handed an address nothing listens on
+func Reachable(serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid server URL '%s'", serverURL)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("nothing answers at %s; start 'lockbox serve --bind ADDR' to accept connections from the local network, or pass its URL with --url", serverURL)
+	}
+	return conn.Close()
+}
+
+// Fingerprint returns the hex SHA-256 fingerprint of the first certificate
+// in the PEM file at path
+func Fingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read certificate: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", fmt.Errorf("no certificate found in %s", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			return hex.EncodeToString(sum[:]), nil
+		}
+	}
+}
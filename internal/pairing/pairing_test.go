@@ -0,0 +1,67 @@
+package pairing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/server"
+)
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("http://192.168.1.5:8100", "lbx_abc", ""))
+	if err != nil {
+		t.Fatalf("Failed to parse URI: %v", err)
+	}
+	q := u.Query()
+	if u.Scheme != "lockbox" || u.Host != "pair" || q.Get("server") != "http://192.168.1.5:8100" || q.Get("code") != "lbx_abc" || q.Has("fp") {
+		t.Errorf("Unexpected URI %s", u)
+	}
+	if u, _ := url.Parse(URI("https://h:8100", "c", "ab12")); u.Query().Get("fp") != "ab12" {
+		t.Errorf("Expected the fingerprint in %s", u)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, _, err := server.AutoTLS(dir, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	data, _ := os.ReadFile(certFile)
+	block, _ := pem.Decode(data)
+	sum := sha256.Sum256(block.Bytes)
+
+	if fp, err := Fingerprint(certFile); err != nil || fp != hex.EncodeToString(sum[:]) {
+		t.Errorf("Fingerprint = %s, %v", fp, err)
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := Fingerprint(empty); err == nil {
+		t.Error("Expected an error for a file without a certificate")
+	}
+}
+
+func TestReachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	if err := Reachable("http://" + addr); err != nil {
+		t.Errorf("Reachable of a listening server: %v", err)
+	}
+	ln.Close()
+	if err := Reachable("http://" + addr); err == nil {
+		t.Error("Reachable accepted a closed port")
+	}
+	if err := Reachable("192.168.1.5:8100"); err == nil {
+		t.Error("Reachable accepted a URL without a scheme")
+	}
+}
@@ -0,0 +1,118 @@
+// Package podman implements Podman's shell secret driver on a lockbox
+// store: secrets created with 'podman secret create' are stored encrypted
+// under their secret ID, apart from the user's own secrets.
+package podman
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// Kind tags secrets stored on behalf of Podman so they stay out of env
+// and run
+const Kind = "podman"
+
+// keyPrefix namespaces Podman secret IDs. The separator is rejected by the
+// HTTP server, so these secrets cannot be read remotely.
+const keyPrefix = "podman/"
+
+// Key returns the store key for a Podman secret ID
+func Key(id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("SECRET_ID is not set")
+	}
+	if strings.ContainsAny(id, "/\\\x00") {
+		return "", fmt.Errorf("invalid secret ID '%s'", id)
+	}
+	return keyPrefix + id, nil
+}
+
+// ID returns the Podman secret ID stored under key
+func ID(key string) string {
+	return strings.TrimPrefix(key, keyPrefix)
+}
+
+// Store encrypts value with key and stores it under the secret ID
+func Store(store *db.Store, key []byte, id string, value []byte) error {
+	name, err := Key(id)
+	if err != nil {
+		return err
+	}
+	encrypted, err := crypto.Encrypt(value, key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt value: %w", err)
+	}
+	if err := store.SetKindSecret(Kind, name, encrypted); err != nil {
+		return fmt.Errorf("failed to store secret: %w", err)
+	}
+	return nil
+}
+
+// Lookup returns the decrypted value stored under the secret ID
+func Lookup(store *db.Store, key []byte, id string) ([]byte, error) {
+	name, err := Key(id)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := store.GetSecret(name)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("secret '%s' not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	value, err := crypto.Decrypt(encrypted, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return value, nil
+}
+
+// Delete removes the secret stored under the secret ID
+func Delete(store *db.Store, id string) error {
+	name, err := Key(id)
+	if err != nil {
+		return err
+	}
+	err = store.DeleteSecret(name)
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("secret '%s' not found", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+	return nil
+}
+
+// List returns the IDs of the stored Podman secrets
+func List(store *db.Store) ([]string, error) {
+	keys, err := store.ListKindSecrets(Kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = ID(key)
+	}
+	return ids, nil
+}
+
+// Config returns the containers.conf section that makes lockbox the
+// default secret driver via Podman's shell driver
+func Config(binary string) string {
+	return fmt.Sprintf(`# Add to ~/.config/containers/containers.conf (rootless) or
+# /etc/containers/containers.conf
+[secrets]
+driver = "shell"
+
+[secrets.opts]
+list = "%[1]s podman-driver list"
+lookup = "%[1]s podman-driver lookup"
+store = "%[1]s podman-driver store"
+delete = "%[1]s podman-driver delete"
+`, binary)
+}
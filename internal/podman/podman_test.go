@@ -0,0 +1,110 @@
+package podman
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    string
+		wantErr string
+	}{
+		{"a1b2c3", "podman/a1b2c3", ""},
+		{"db_password", "podman/db_password", ""},
+		{"", "", "SECRET_ID is not set"},
+		{"../etc", "", "invalid secret ID"},
+		{`a\b`, "", "invalid secret ID"},
+		{"a\x00b", "", "invalid secret ID"},
+	}
+	for _, tt := range tests {
+		got, err := Key(tt.id)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Key(%q) error = %v, want %q", tt.id, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Key(%q) = %q, %v, want %q", tt.id, got, err, tt.want)
+		}
+		if id := ID(got); id != tt.id {
+			t.Errorf("ID(%q) = %q, want %q", got, id, tt.id)
+		}
+	}
+}
+
+func TestDriver(t *testing.T) {
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+	store.SetSecret("API_KEY", []byte("mine"))
+
+	steps := []struct {
+		op      string
+		id      string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"store", "a1b2c3", "pod\nsecret", "", ""},
+		{"lookup", "a1b2c3", "", "pod\nsecret", ""},
+		// Binary values and overwrites
+		{"store", "bin", "\x00\xff", "", ""},
+		{"store", "bin", "\x01", "", ""},
+		{"lookup", "bin", "", "\x01", ""},
+		{"lookup", "missing", "", "", "secret 'missing' not found"},
+		{"lookup", "../API_KEY", "", "", "invalid secret ID"},
+		{"store", "", "x", "", "SECRET_ID is not set"},
+		{"delete", "a1b2c3", "", "", ""},
+		{"lookup", "a1b2c3", "", "", "secret 'a1b2c3' not found"},
+		{"delete", "a1b2c3", "", "", "secret 'a1b2c3' not found"},
+		// The user's own secrets are out of reach
+		{"lookup", "API_KEY", "", "", "secret 'API_KEY' not found"},
+		{"delete", "API_KEY", "", "", "secret 'API_KEY' not found"},
+	}
+	for i, s := range steps {
+		var got []byte
+		var err error
+		switch s.op {
+		case "store":
+			err = Store(store, key, s.id, []byte(s.value))
+		case "lookup":
+			got, err = Lookup(store, key, s.id)
+		case "delete":
+			err = Delete(store, s.id)
+		}
+		if s.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), s.wantErr) {
+				t.Errorf("step %d: %s %q error = %v, want %q", i, s.op, s.id, err, s.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: %s %q failed: %v", i, s.op, s.id, err)
+		}
+		if s.op == "lookup" && !bytes.Equal(got, []byte(s.want)) {
+			t.Errorf("step %d: lookup %q = %q, want %q", i, s.id, got, s.want)
+		}
+	}
+
+	if ids, err := List(store); err != nil || !slices.Equal(ids, []string{"bin"}) {
+		t.Errorf("List = %v, %v", ids, err)
+	}
+	if value, err := store.GetSecret("API_KEY"); err != nil || string(value) != "mine" {
+		t.Errorf("The user's secret changed: %q, %v", value, err)
+	}
+	if keys, _ := store.ListSecrets(); !slices.Equal(keys, []string{"API_KEY"}) {
+		t.Errorf("Podman secrets leaked into ListSecrets: %v", keys)
+	}
+}
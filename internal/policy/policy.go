@@ -0,0 +1,241 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// copyOutConfig marks a store whose secrets may not be copied into other
+// stores
+const copyOutConfig = "copy_out"
+
+// ErrCopyOut is returned when secrets would leave a store that forbids it
+var ErrCopyOut = errors.New("the source store forbids copying its secrets to other stores; allow it with 'lockbox policy copy-out allow'")
+
+// CopyOutForbidden reports whether store forbids copying its secrets into
+// other stores, by copy, promote or restoring its archives
+func CopyOutForbidden(store *db.Store) (bool, error) {
+	value, err := store.GetConfig(copyOutConfig)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(value) == "deny", nil
+}
+
+// SetCopyOut allows or forbids copying store's secrets into other stores
+func SetCopyOut(store *db.Store, allowed bool) error {
+	if allowed {
+		return store.DeleteConfig(copyOutConfig)
+	}
+	return store.SetConfig(copyOutConfig, []byte("deny"))
+}
+
+// Identity is the OS-level identity of a local client
+type Identity struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+}
+
+// NewIdentity returns the identity for uid with primary group gid, adding
+// the user's supplementary groups when they can be looked up
+func NewIdentity(uid, gid uint32) Identity {
+	id := Identity{UID: uid, GID: gid, Groups: []uint32{gid}}
+
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return id
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return id
+	}
+	for _, g := range groupIDs {
+		n, err := strconv.ParseUint(g, 10, 32)
+		if err == nil && uint32(n) != gid {
+			id.Groups = append(id.Groups, uint32(n))
+		}
+	}
+	return id
+}
+
+// UserSubject returns the policy subject for a UID
+func UserSubject(uid uint32) string {
+	return fmt.Sprintf("uid:%d", uid)
+}
+
+// GroupSubject returns the policy subject for a GID
+func GroupSubject(gid uint32) string {
+	return fmt.Sprintf("gid:%d", gid)
+}
+
+// TokenSubject returns the policy subject for a named API token
+func TokenSubject(name string) string {
+	return "token:" + name
+}
+
+// TokenSubjects returns the policy subjects a token acts as: its own name
+// and any subjects it was issued with
+func TokenSubjects(t db.Token) []string {
+	return append([]string{TokenSubject(t.Name)}, t.Subjects...)
+}
+
+// ClaimSubject returns the policy subject for an identity provider claim,
+// e.g. "claim:groups=devs"
+func ClaimSubject(name, value string) string {
+	return "claim:" + name + "=" + value
+}
+
+// ClaimSubjects returns a subject for every string, boolean and string
+// list claim in an ID token
+func ClaimSubjects(claims map[string]any) []string {
+	var subjects []string
+	for name, v := range claims {
+		switch v := v.(type) {
+		case string:
+			subjects = append(subjects, ClaimSubject(name, v))
+		case bool:
+			subjects = append(subjects, ClaimSubject(name, strconv.FormatBool(v)))
+		case []any:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					subjects = append(subjects, ClaimSubject(name, s))
+				}
+			}
+		}
+	}
+	slices.Sort(subjects)
+	return subjects
+}
+
+// Subjects returns the policy subjects the identity acts as: its user and
+// all of its groups
+func (id Identity) Subjects() []string {
+	subjects := []string{UserSubject(id.UID)}
+	for _, g := range id.Groups {
+		subjects = append(subjects, GroupSubject(g))
+	}
+	return subjects
+}
+
+// ParseSubject resolves a user or group given as a name or number, a token
+// name, or a NAME=VALUE claim into a policy subject. Exactly one must be set.
+func ParseSubject(username, group, token, claim string) (string, error) {
+	set := 0
+	for _, v := range []string{username, group, token, claim} {
+		if v != "" {
+			set++
+		}
+	}
+
+	switch {
+	case set > 1:
+		return "", fmt.Errorf("specify only one of a user, a group, a token or a claim")
+	case token != "":
+		return TokenSubject(token), nil
+	case claim != "":
+		name, value, ok := strings.Cut(claim, "=")
+		if !ok || name == "" {
+			return "", fmt.Errorf("invalid claim '%s': expected NAME=VALUE", claim)
+		}
+		return ClaimSubject(name, value), nil
+	case username != "":
+		if n, err := strconv.ParseUint(username, 10, 32); err == nil {
+			return UserSubject(uint32(n)), nil
+		}
+		u, err := user.Lookup(username)
+		if err != nil {
+			return "", fmt.Errorf("unknown user '%s'", username)
+		}
+		n, _ := strconv.ParseUint(u.Uid, 10, 32)
+		return UserSubject(uint32(n)), nil
+	case group != "":
+		if n, err := strconv.ParseUint(group, 10, 32); err == nil {
+			return GroupSubject(uint32(n)), nil
+		}
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return "", fmt.Errorf("unknown group '%s'", group)
+		}
+		n, _ := strconv.ParseUint(g.Gid, 10, 32)
+		return GroupSubject(uint32(n)), nil
+	default:
+		return "", fmt.Errorf("a user, a group, a token or a claim is required")
+	}
+}
+
+// ValidateSubject checks that subject is a uid, gid, token or claim
+// subject
+func ValidateSubject(subject string) error {
+	kind, id, ok := strings.Cut(subject, ":")
+	if !ok || id == "" || !slices.Contains([]string{"uid", "gid", "token", "claim"}, kind) {
+		return fmt.Errorf("invalid subject '%s': expected uid:N, gid:N, token:NAME or claim:NAME=VALUE", subject)
+	}
+	return nil
+}
+
+// ValidatePattern checks that pattern is a well-formed glob
+func ValidatePattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("pattern must not be empty")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+	}
+	return nil
+}
+
+// CanModify reports whether an identity acting as subjects may change or
+// delete a secret owned by owner. Unowned secrets may be changed by anyone
+// and admins may change any secret.
+func CanModify(owner string, subjects []string, admin bool) bool {
+	return owner == "" || admin || slices.Contains(subjects, owner)
+}
+
+// ScopeRead is the scope prefix granting read access to a key pattern
+const ScopeRead = "read:"
+
+// ValidateScope checks that scope is "read:PATTERN" with a valid pattern
+func ValidateScope(scope string) error {
+	pattern, ok := strings.CutPrefix(scope, ScopeRead)
+	if !ok {
+		return fmt.Errorf("invalid scope '%s': expected read:PATTERN", scope)
+	}
+	return ValidatePattern(pattern)
+}
+
+// Describe formats a subject for display, resolving IDs to names when
+// possible
+func Describe(subject string) string {
+	kind, id, ok := strings.Cut(subject, ":")
+	if !ok {
+		return subject
+	}
+	switch kind {
+	case "uid":
+		if u, err := user.LookupId(id); err == nil {
+			return fmt.Sprintf("user %s (%s)", u.Username, id)
+		}
+		return "uid " + id
+	case "gid":
+		if g, err := user.LookupGroupId(id); err == nil {
+			return fmt.Sprintf("group %s (%s)", g.Name, id)
+		}
+		return "gid " + id
+	case "token":
+		return "token " + id
+	case "claim":
+		return "claim " + id
+	}
+	return subject
+}
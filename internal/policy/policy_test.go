@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSubject(t *testing.T) {
+	if s, err := ParseSubject("1000", "", "", ""); err != nil || s != "uid:1000" {
+		t.Errorf("ParseSubject(uid) = %q, %v", s, err)
+	}
+	if s, err := ParseSubject("", "50", "", ""); err != nil || s != "gid:50" {
+		t.Errorf("ParseSubject(gid) = %q, %v", s, err)
+	}
+	if s, err := ParseSubject("root", "", "", ""); err != nil || s != "uid:0" {
+		t.Errorf("ParseSubject(root) = %q, %v", s, err)
+	}
+	if s, err := ParseSubject("", "", "ci", ""); err != nil || s != "token:ci" {
+		t.Errorf("ParseSubject(token) = %q, %v", s, err)
+	}
+	if s, err := ParseSubject("", "", "", "groups=dev"); err != nil || s != "claim:groups=dev" {
+		t.Errorf("ParseSubject(claim) = %q, %v", s, err)
+	}
+	for _, args := range [][4]string{{"", "", "", ""}, {"1", "1", "", ""}, {"1", "", "ci", ""}, {"", "", "", "groups"}, {"no-such-user-xyz", "", "", ""}} {
+		if _, err := ParseSubject(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("ParseSubject(%q) succeeded", args)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	if err := ValidatePattern("APP_*"); err != nil {
+		t.Errorf("ValidatePattern rejected a valid pattern: %v", err)
+	}
+	for _, p := range []string{"", "APP_["} {
+		if err := ValidatePattern(p); err == nil {
+			t.Errorf("ValidatePattern(%q) accepted an invalid pattern", p)
+		}
+	}
+}
+
+func TestCanModify(t *testing.T) {
+	subjects := []string{"uid:1000", "gid:100"}
+	tests := []struct {
+		owner string
+		admin bool
+		want  bool
+	}{
+		{"", false, true},
+		{"uid:1000", false, true},
+		{"gid:100", false, true},
+		{"uid:1001", false, false},
+		{"uid:1001", true, true},
+	}
+	for _, tt := range tests {
+		if got := CanModify(tt.owner, subjects, tt.admin); got != tt.want {
+			t.Errorf("CanModify(%q, admin=%v) = %v, expected %v", tt.owner, tt.admin, got, tt.want)
+		}
+	}
+}
+
+func TestClaimSubjects(t *testing.T) {
+	subjects := ClaimSubjects(map[string]any{
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"groups":         []any{"dev", "ops", 7},
+		"exp":            float64(1700000000),
+	})
+	want := []string{"claim:email=alice@example.com", "claim:email_verified=true", "claim:groups=dev", "claim:groups=ops"}
+	if !reflect.DeepEqual(subjects, want) {
+		t.Errorf("ClaimSubjects = %v, expected %v", subjects, want)
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	if err := ValidateScope("read:APP_*"); err != nil {
+		t.Errorf("ValidateScope rejected read:APP_*: %v", err)
+	}
+	for _, scope := range []string{"write:APP_*", "APP_*", "read:", "read:[a"} {
+		if ValidateScope(scope) == nil {
+			t.Errorf("ValidateScope accepted %q", scope)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package porcelain writes the stable output of --porcelain for scripts.
+//
+// Each line is one record: a record type followed by tab-separated fields.
+// Within a version, fields are only ever appended to a record type and new
+// record types may appear, so parsers should ignore extra fields and
+// unknown types. Fields containing a tab, newline, backslash or other
+// control character, or starting with a double quote, are written as Go
+// quoted strings. Times are RFC 3339 in UTC; an empty field means none.
+package porcelain
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// V1 is the current, and only, porcelain format
+const V1 = "v1"
+
+// Validate checks that version is a supported porcelain format
+func Validate(version string) error {
+	if version != V1 {
+		return fmt.Errorf("unsupported porcelain format '%s' (supported: %s)", version, V1)
+	}
+	return nil
+}
+
+// Write writes one record of type kind
+func Write(w io.Writer, kind string, fields ...string) {
+	var b strings.Builder
+	b.WriteString(kind)
+	for _, f := range fields {
+		b.WriteByte('\t')
+		b.WriteString(Quote(f))
+	}
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+// Quote returns f as a field, quoting it when it would break the line
+// format
+func Quote(f string) string {
+	if strings.HasPrefix(f, `"`) || strings.ContainsFunc(f, func(r rune) bool { return r < 0x20 || r == 0x7f || r == '\\' }) {
+		return strconv.Quote(f)
+	}
+	return f
+}
+
+// Time formats t as a field; the zero time is empty
+func Time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
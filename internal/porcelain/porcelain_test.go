@@ -0,0 +1,30 @@
+package porcelain
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	Write(&buf, "secret", "API_KEY")
+	Write(&buf, "token", "ci", Time(time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))), Time(time.Time{}), "active")
+	Write(&buf, "problem", "a\tb.tmpl", `"quoted`, `back\slash`, "plain text")
+
+	want := "secret\tAPI_KEY\n" +
+		"token\tci\t2026-01-02T02:04:05Z\t\tactive\n" +
+		"problem\t\"a\\tb.tmpl\"\t\"\\\"quoted\"\t\"back\\\\slash\"\tplain text\n"
+	if buf.String() != want {
+		t.Errorf("Write produced %q, expected %q", buf.String(), want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(V1); err != nil {
+		t.Errorf("Validate(v1) failed: %v", err)
+	}
+	if err := Validate("v2"); err == nil {
+		t.Errorf("Validate accepted v2")
+	}
+}
@@ -0,0 +1,32 @@
+// Package presence asks the operating system to confirm that a person is
+// at the machine before a sensitive secret is read: Touch ID on macOS,
+// Windows Hello on Windows and a polkit authentication prompt on Linux.
+// Unlike a passphrase typed into lockbox, the confirmation is shown and
+// checked by the OS, so a script running as the user cannot answer it.
+package presence
+
+import "errors"
+
+// Tag marks the secrets that are only read after a confirmation
+const Tag = "confirm-read"
+
+var (
+	// ErrUnavailable means the platform has no way to confirm presence
+	ErrUnavailable = errors.New("no confirmation prompt is available on this machine")
+	// ErrDenied means the confirmation was refused or dismissed
+	ErrDenied = errors.New("confirmation was denied")
+)
+
+// Pkcheck is the polkit CLI used on Linux, replaced in tests
+var Pkcheck = "pkcheck"
+
+// PolkitAction is the polkit action the user must be authorized for on
+// Linux. Its default policy asks for an administrator's password, which on
+// a single-user machine is the user's own.
+var PolkitAction = "org.freedesktop.policykit.exec"
+
+// Confirm asks the user to confirm reason, such as "read API_KEY", and
+// returns nil once they have
+func Confirm(reason string) error {
+	return confirm(reason)
+}
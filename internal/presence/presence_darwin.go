@@ -0,0 +1,60 @@
+//go:build darwin && cgo
+
+package presence
+
+/*
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework Foundation -framework LocalAuthentication
+
+#import <Foundation/Foundation.h>
+#import <LocalAuthentication/LocalAuthentication.h>
+#include <stdlib.h>
+#include <string.h>
+
+// lb_confirm asks for Touch ID, or the login password, returning 0 when
+// given, 1 when refused and -1 when it cannot be asked for
+static int lb_confirm(const char *reason, char **err) {
+	@autoreleasepool {
+		LAContext *ctx = [[[LAContext alloc] init] autorelease];
+		NSError *e = nil;
+		if (![ctx canEvaluatePolicy:LAPolicyDeviceOwnerAuthentication error:&e]) {
+			*err = strdup([[e localizedDescription] UTF8String]);
+			return -1;
+		}
+		__block int result = 1;
+		dispatch_semaphore_t done = dispatch_semaphore_create(0);
+		[ctx evaluatePolicy:LAPolicyDeviceOwnerAuthentication
+		    localizedReason:[NSString stringWithUTF8String:reason]
+		              reply:^(BOOL success, NSError *error) {
+			                  result = success ? 0 : 1;
+			                  dispatch_semaphore_signal(done);
+		              }];
+		dispatch_semaphore_wait(done, DISPATCH_TIME_FOREVER);
+		dispatch_release(done);
+		return result;
+	}
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// confirm asks for Touch ID through LocalAuthentication, falling back to
+// the login password where there is no sensor
+func confirm(reason string) error {
+	cReason := C.CString(reason)
+	defer C.free(unsafe.Pointer(cReason))
+	var err *C.char
+	switch C.lb_confirm(cReason, &err) {
+	case 0:
+		return nil
+	case 1:
+		return ErrDenied
+	default:
+		defer C.free(unsafe.Pointer(err))
+		return fmt.Errorf("%w: %s", ErrUnavailable, C.GoString(err))
+	}
+}
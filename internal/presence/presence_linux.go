@@ -0,0 +1,35 @@
+package presence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// confirm asks polkit whether this process may perform PolkitAction,
+// letting its authentication agent prompt. polkit shows its own message
+// for the action, so reason is not shown.
+func confirm(reason string) error {
+	cmd := exec.Command(Pkcheck, "--action-id", PolkitAction, "--process", strconv.Itoa(os.Getpid()), "--allow-user-interaction")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, exec.ErrNotFound):
+		return fmt.Errorf("%w: install polkit", ErrUnavailable)
+	case errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 3):
+		// 1 is not authorized, 3 is dismissed
+		return ErrDenied
+	default:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", ErrUnavailable, msg)
+		}
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+}
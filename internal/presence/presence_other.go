@@ -0,0 +1,9 @@
+//go:build !linux && !windows && (!darwin || !cgo)
+
+package presence
+
+// confirm is unsupported here, including macOS builds without cgo, which
+// LocalAuthentication needs
+func confirm(reason string) error {
+	return ErrUnavailable
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package presence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfirm(t *testing.T) {
+	// The fake exits with the code in $PKCHECK_EXIT
+	fake := filepath.Join(t.TempDir(), "pkcheck")
+	os.WriteFile(fake, []byte("#!/bin/sh\nexit ${PKCHECK_EXIT:-0}\n"), 0755)
+	defer func(s string) { Pkcheck = s }(Pkcheck)
+	Pkcheck = fake
+
+	for _, tc := range []struct {
+		exit string
+		want error
+	}{
+		{"0", nil},
+		{"1", ErrDenied},
+		{"3", ErrDenied},
+		{"4", ErrUnavailable},
+	} {
+		t.Setenv("PKCHECK_EXIT", tc.exit)
+		if err := Confirm("read API_KEY"); !errors.Is(err, tc.want) {
+			t.Errorf("Confirm with pkcheck exiting %s = %v, want %v", tc.exit, err, tc.want)
+		}
+	}
+
+	Pkcheck = filepath.Join(t.TempDir(), "missing")
+	if err := Confirm("read API_KEY"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Confirm without pkcheck = %v, want ErrUnavailable", err)
+	}
+}
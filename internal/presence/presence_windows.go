@@ -0,0 +1,41 @@
+package presence
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// verifyScript asks Windows Hello for verification through the WinRT
+// UserConsentVerifier and prints the result, such as Verified or Canceled
+const verifyScript = `Add-Type -AssemblyName System.Runtime.WindowsRuntime
+$null = [Windows.Security.Credentials.UI.UserConsentVerifier, Windows.Security.Credentials.UI, ContentType = WindowsRuntime]
+$asTask = [System.WindowsRuntimeSystemExtensions].GetMethods() | Where-Object {
+	$_.Name -eq 'AsTask' -and $_.GetParameters().Count -eq 1 -and $_.GetParameters()[0].ParameterType.Name -eq 'IAsyncOperation` + "`" + `1'
+} | Select-Object -First 1
+$op = [Windows.Security.Credentials.UI.UserConsentVerifier]::RequestVerificationAsync($env:LOCKBOX_CONFIRM_REASON)
+$task = $asTask.MakeGenericMethod([Windows.Security.Credentials.UI.UserConsentVerificationResult]).Invoke($null, @($op))
+$null = $task.Wait(-1)
+$task.Result`
+
+// confirm asks Windows Hello to verify the user, through PowerShell since
+// the API is only reachable through WinRT
+func confirm(reason string) error {
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", verifyScript)
+	cmd.Env = append(os.Environ(), "LOCKBOX_CONFIRM_REASON=lockbox: "+reason)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	switch result := strings.TrimSpace(string(out)); result {
+	case "Verified":
+		return nil
+	case "Canceled", "RetriesExhausted":
+		return ErrDenied
+	default:
+		// DeviceNotPresent, NotConfiguredForUser, DisabledByPolicy or
+		// DeviceBusy
+		return fmt.Errorf("%w: Windows Hello reports %s", ErrUnavailable, result)
+	}
+}
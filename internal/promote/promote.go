@@ -0,0 +1,237 @@
+// Package promote copies selected secrets from one profile's store to
+// another's, such as from staging to prod, re-encrypting them with the
+// target's key. A promotion may be held until a second admin approves it.
+package promote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/selector"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+// What a promotion does to a key in the target
+const (
+	Add    = "add"
+	Update = "update"
+	Same   = "same"
+)
+
+// pendingPrefix starts the target config entries of promotions awaiting
+// approval, followed by the hash of their approval code
+const pendingPrefix = "promotion/"
+
+// ErrSelfApproval is returned when the requester tries to approve their
+// own promotion
+var ErrSelfApproval = errors.New("a promotion must be approved by a different admin than the one who requested it")
+
+// Item is a secret selected for promotion
+type Item struct {
+	Key string `json:"key"`
+	// Digest identifies the source value, keyed by the source store key
+	Digest string `json:"digest"`
+	Change string `json:"change"`
+}
+
+// Plan selects the source secrets matching patterns, or all of them, and
+// compares each with the target. It fails with policy.ErrCopyOut if the
+// source forbids copying its secrets out.
+func Plan(src *db.Store, srcKey []byte, dst *db.Store, dstKey []byte, patterns []string) ([]Item, error) {
+	if err := checkCopyOut(src); err != nil {
+		return nil, err
+	}
+	keys, err := src.ListSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	if len(patterns) > 0 {
+		if keys, err = selector.Resolve(keys, patterns); err != nil {
+			return nil, err
+		}
+	}
+	items := make([]Item, 0, len(keys))
+	for _, key := range keys {
+		value, err := decrypt(src, srcKey, key)
+		if err != nil {
+			return nil, err
+		}
+		item := Item{Key: key, Change: Add}
+		if item.Digest, err = crypto.Digest(value, srcKey); err != nil {
+			return nil, err
+		}
+		current, err := decrypt(dst, dstKey, key)
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+		case err != nil:
+			return nil, err
+		case string(current) == string(value):
+			item.Change = Same
+		default:
+			item.Change = Update
+		}
+		clear(value)
+		clear(current)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Apply writes the added and updated items to the target as actor,
+// failing if a source value changed since the items were planned. The
+// number of secrets written is returned.
+func Apply(src *db.Store, srcKey []byte, dst *db.Tx, dstKey []byte, actor batch.Actor, items []Item) (int, error) {
+	// Checked again for promotions approved after the source forbade it
+	if err := checkCopyOut(src); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		if item.Change == Same {
+			continue
+		}
+		value, err := decrypt(src, srcKey, item.Key)
+		if err != nil {
+			return 0, err
+		}
+		digest, err := crypto.Digest(value, srcKey)
+		if err != nil {
+			return 0, err
+		}
+		if digest != item.Digest {
+			return 0, fmt.Errorf("'%s' changed in the source since the promotion was planned", item.Key)
+		}
+		s := string(value)
+		clear(value)
+		if _, err := batch.Execute(dst, dstKey, actor, batch.Command{Op: "set", Key: item.Key, Value: &s}); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// checkCopyOut fails with policy.ErrCopyOut if src forbids copying its
+// secrets out
+func checkCopyOut(src *db.Store) error {
+	forbidden, err := policy.CopyOutForbidden(src)
+	if err != nil {
+		return err
+	}
+	if forbidden {
+		return policy.ErrCopyOut
+	}
+	return nil
+}
+
+// Request is a promotion awaiting a second admin's approval. It holds
+// digests rather than values, so approval promotes exactly what was
+// requested or nothing.
+type Request struct {
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Items       []Item    `json:"items"`
+	RequestedBy string    `json:"requested_by"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// Propose stores req in the target and returns the approval code to hand
+// to the approving admin
+func Propose(dst *db.Store, req Request) (string, error) {
+	code, err := token.Generate()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	if err := dst.SetConfig(pendingPrefix+token.Hash(code), data); err != nil {
+		return "", fmt.Errorf("failed to store promotion request: %w", err)
+	}
+	return code, nil
+}
+
+// Pending returns the promotion awaiting approval under code
+func Pending(dst *db.Store, code string) (Request, error) {
+	var req Request
+	data, err := dst.GetConfig(pendingPrefix + token.Hash(code))
+	if errors.Is(err, db.ErrNotFound) {
+		return req, fmt.Errorf("no pending promotion for this approval code")
+	}
+	if err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, fmt.Errorf("corrupt promotion request: %w", err)
+	}
+	return req, nil
+}
+
+// Approve checks that approver may approve req, which was stored under
+// code, and removes it from the target within tx
+func Approve(tx *db.Tx, code string, req Request, approver batch.Actor) error {
+	if !approver.Admin {
+		return fmt.Errorf("only an admin of the target store can approve a promotion")
+	}
+	if approver.Owner == req.RequestedBy {
+		return ErrSelfApproval
+	}
+	return tx.DeleteConfig(pendingPrefix + token.Hash(code))
+}
+
+// List returns the promotions awaiting approval in the target, oldest
+// first
+func List(dst *db.Store) ([]Request, error) {
+	config, err := dst.ListConfig()
+	if err != nil {
+		return nil, err
+	}
+	var reqs []Request
+	for name, data := range config {
+		if !strings.HasPrefix(name, pendingPrefix) {
+			continue
+		}
+		var req Request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, fmt.Errorf("corrupt promotion request: %w", err)
+		}
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].RequestedAt.Before(reqs[j].RequestedAt) })
+	return reqs, nil
+}
+
+// Summary describes items for the audit log
+func Summary(items []Item) string {
+	var keys []string
+	for _, item := range items {
+		if item.Change != Same {
+			keys = append(keys, item.Key+" ("+item.Change+")")
+		}
+	}
+	return strings.Join(keys, ", ")
+}
+
+func decrypt(s *db.Store, key []byte, name string) ([]byte, error) {
+	ciphertext, err := s.GetSecret(name)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get secret '%s': %w", name, err)
+	}
+	value, err := crypto.Decrypt(ciphertext, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret '%s': %w", name, err)
+	}
+	return value, nil
+}
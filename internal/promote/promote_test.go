@@ -0,0 +1,155 @@
+package promote
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+)
+
+// newTestStore returns a store holding secrets and its key
+func newTestStore(t *testing.T, secrets map[string]string) (*db.Store, []byte) {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	for k, v := range secrets {
+		encrypted, _ := crypto.Encrypt([]byte(v), key)
+		store.SetSecret(k, encrypted)
+	}
+	return store, key
+}
+
+func get(t *testing.T, store *db.Store, key []byte, name string) string {
+	t.Helper()
+	encrypted, err := store.GetSecret(name)
+	if err != nil {
+		return ""
+	}
+	value, _ := crypto.Decrypt(encrypted, key)
+	return string(value)
+}
+
+var admin = batch.Actor{Owner: "uid:1000", Subjects: []string{"uid:1000"}, Admin: true}
+
+func TestPromote(t *testing.T) {
+	src, srcKey := newTestStore(t, map[string]string{"APP_A": "a2", "APP_B": "b", "APP_C": "c", "DB_URL": "staging"})
+	dst, dstKey := newTestStore(t, map[string]string{"APP_A": "a1", "APP_B": "b", "DB_URL": "prod"})
+
+	items, err := Plan(src, srcKey, dst, dstKey, []string{"APP_*"})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	want := map[string]string{"APP_A": Update, "APP_B": Same, "APP_C": Add}
+	if len(items) != len(want) {
+		t.Fatalf("planned %+v", items)
+	}
+	for _, item := range items {
+		if want[item.Key] != item.Change {
+			t.Errorf("%s planned as %s, want %s", item.Key, item.Change, want[item.Key])
+		}
+	}
+
+	tx, _ := dst.Begin()
+	n, err := Apply(src, srcKey, tx, dstKey, admin, items)
+	if err != nil || n != 2 {
+		t.Fatalf("Apply = %d, %v", n, err)
+	}
+	tx.Commit()
+	for k, v := range map[string]string{"APP_A": "a2", "APP_C": "c", "DB_URL": "prod"} {
+		if got := get(t, dst, dstKey, k); got != v {
+			t.Errorf("%s = %q in target, want %q", k, got, v)
+		}
+	}
+}
+
+func TestApproval(t *testing.T) {
+	src, srcKey := newTestStore(t, map[string]string{"APP_A": "new"})
+	dst, dstKey := newTestStore(t, map[string]string{"APP_A": "old"})
+	items, _ := Plan(src, srcKey, dst, dstKey, nil)
+	code, err := Propose(dst, Request{From: "staging", To: "prod", Items: items, RequestedBy: "uid:1000", RequestedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	if reqs, _ := List(dst); len(reqs) != 1 || reqs[0].From != "staging" {
+		t.Errorf("List = %+v", reqs)
+	}
+	if _, err := Pending(dst, "lbx_wrong"); err == nil {
+		t.Error("Pending accepted a wrong code")
+	}
+	req, err := Pending(dst, code)
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+
+	tx, _ := dst.Begin()
+	if err := Approve(tx, code, req, admin); !errors.Is(err, ErrSelfApproval) {
+		t.Errorf("self-approval = %v, want ErrSelfApproval", err)
+	}
+	if err := Approve(tx, code, req, batch.Actor{Owner: "uid:1001"}); err == nil {
+		t.Error("a non-admin approved")
+	}
+	tx.Rollback()
+
+	// A source value changed after the request cannot be promoted
+	encrypted, _ := crypto.Encrypt([]byte("newer"), srcKey)
+	src.SetSecret("APP_A", encrypted)
+	second := batch.Actor{Owner: "uid:0", Admin: true}
+	tx, _ = dst.Begin()
+	if err := Approve(tx, code, req, second); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if _, err := Apply(src, srcKey, tx, dstKey, second, req.Items); err == nil {
+		t.Error("Apply promoted a value changed since the request")
+	}
+	tx.Rollback()
+
+	encrypted, _ = crypto.Encrypt([]byte("new"), srcKey)
+	src.SetSecret("APP_A", encrypted)
+	tx, _ = dst.Begin()
+	Approve(tx, code, req, second)
+	if _, err := Apply(src, srcKey, tx, dstKey, second, req.Items); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	tx.Commit()
+	if got := get(t, dst, dstKey, "APP_A"); got != "new" {
+		t.Errorf("APP_A = %q, want new", got)
+	}
+	if _, err := Pending(dst, code); err == nil {
+		t.Error("approved promotion still pending")
+	}
+}
+
+func TestCopyOutForbidden(t *testing.T) {
+	src, srcKey := newTestStore(t, map[string]string{"APP_A": "a"})
+	dst, dstKey := newTestStore(t, nil)
+
+	items, err := Plan(src, srcKey, dst, dstKey, nil)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if err := policy.SetCopyOut(src, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Plan(src, srcKey, dst, dstKey, nil); !errors.Is(err, policy.ErrCopyOut) {
+		t.Errorf("Plan out of a store forbidding it = %v", err)
+	}
+	// A plan made before copies were forbidden is not applied
+	tx, _ := dst.Begin()
+	defer tx.Rollback()
+	if _, err := Apply(src, srcKey, tx, dstKey, admin, items); !errors.Is(err, policy.ErrCopyOut) {
+		t.Errorf("Apply out of a store forbidding it = %v", err)
+	}
+
+	policy.SetCopyOut(src, true)
+	if _, err := Plan(src, srcKey, dst, dstKey, nil); err != nil {
+		t.Errorf("Plan after allowing copies failed: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Package prompt asks the user for input on the controlling terminal,
+// even when stdin and stdout are redirected
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoTerminal means there is no terminal to prompt on
+var ErrNoTerminal = errors.New("no terminal to prompt on")
+
+// errNoEcho means the platform cannot turn off terminal echo
+var errNoEcho = errors.New("hidden prompts are not supported on this platform")
+
+// Passphrase prints label on the terminal and reads a line without
+// echoing it
+func Passphrase(label string) (string, error) {
+	line, err := hidden(label, "passphrase")
+	if err == errNoEcho {
+		return "", fmt.Errorf("passphrase prompts are not supported on this platform; set LOCKBOX_PASSPHRASE")
+	}
+	return line, err
+}
+
+// Secret prints label on the terminal and reads a secret value without
+// echoing it
+func Secret(label string) (string, error) {
+	line, err := hidden(label, "value")
+	if err == errNoEcho {
+		return "", fmt.Errorf("%w; pass the value on stdin", err)
+	}
+	return line, err
+}
+
+// hidden reads a line from the terminal without echoing it; what names
+// the line in errors
+func hidden(label, what string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", ErrNoTerminal
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, label)
+	restore, err := noEcho(tty)
+	if err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	restore()
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", what, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Line prints label on the terminal and reads a line, echoing it
+func Line(label string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", ErrNoTerminal
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, label)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read answer: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package prompt
+
+import "os"
+
+// noEcho is only supported on Linux; elsewhere passphrases come from
+// LOCKBOX_PASSPHRASE and values from stdin
+func noEcho(f *os.File) (func(), error) {
+	return nil, errNoEcho
+}
@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Azure is an Azure Key Vault, driven through the az CLI
+type Azure struct {
+	Vault string
+	// Binary is the az CLI (default "az")
+	Binary string
+}
+
+func (a Azure) az(stdin []byte, args ...string) ([]byte, error) {
+	binary := a.Binary
+	if binary == "" {
+		binary = "az"
+	}
+	return run(stdin, binary, append(args, "--vault-name", a.Vault)...)
+}
+
+// List returns the names of the vault's enabled secrets
+func (a Azure) List() ([]string, error) {
+	out, err := a.az(nil, "keyvault", "secret", "list", "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+	var items []struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Attributes struct {
+			Enabled *bool `json:"enabled"`
+		} `json:"attributes"`
+	}
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, fmt.Errorf("unexpected az output: %w", err)
+	}
+	var names []string
+	for _, item := range items {
+		if item.Attributes.Enabled != nil && !*item.Attributes.Enabled {
+			continue
+		}
+		name := item.Name
+		if name == "" {
+			name = path.Base(item.ID)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the current value of a secret
+func (a Azure) Get(name string) ([]byte, error) {
+	out, err := a.az(nil, "keyvault", "secret", "show", "--name", name, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(out, &secret); err != nil {
+		return nil, fmt.Errorf("unexpected az output: %w", err)
+	}
+	return []byte(secret.Value), nil
+}
+
+// Put sets a secret's value, passing it on stdin so it never appears in
+// the process list
+func (a Azure) Put(name string, value []byte) error {
+	_, err := a.az(value, "keyvault", "secret", "set", "--name", name, "--file", "/dev/stdin", "--encoding", "utf-8", "--output", "none")
+	return err
+}
+
+// Key Vault names allow only letters, digits and dashes, so underscores in
+// keys are stored as dashes
+
+func (Azure) Key(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func (Azure) Name(key string) (string, error) {
+	name := strings.ReplaceAll(key, "_", "-")
+	if len(name) > 127 || strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		return "", fmt.Errorf("'%s' cannot be named in Key Vault, which allows only letters, digits and dashes", key)
+	}
+	return name, nil
+}
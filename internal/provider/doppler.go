@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Doppler is one config of a Doppler project, read through the doppler CLI
+type Doppler struct {
+	Project string
+	Config  string
+	// Binary is the doppler CLI (default "doppler")
+	Binary string
+}
+
+// Secrets returns the config's secrets in name order. The DOPPLER_*
+// secrets Doppler adds to every config are left out.
+func (d Doppler) Secrets() ([]Secret, error) {
+	binary := d.Binary
+	if binary == "" {
+		binary = "doppler"
+	}
+	args := []string{"secrets", "download", "--no-file", "--format", "json"}
+	if d.Project != "" {
+		args = append(args, "--project", d.Project)
+	}
+	if d.Config != "" {
+		args = append(args, "--config", d.Config)
+	}
+	out, err := run(nil, binary, args...)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal(out, &values); err != nil {
+		return nil, fmt.Errorf("unexpected doppler output: %w", err)
+	}
+	source := d.Project + "/" + d.Config
+	if d.Project == "" || d.Config == "" {
+		source = values["DOPPLER_PROJECT"] + "/" + values["DOPPLER_CONFIG"]
+	}
+	var secrets []Secret
+	for name, value := range values {
+		if strings.HasPrefix(name, "DOPPLER_") {
+			continue
+		}
+		secrets = append(secrets, Secret{Key: name, Source: source + "/" + name, Value: []byte(value)})
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Key < secrets[j].Key })
+	return secrets, nil
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GCP is Google Cloud Secret Manager in one project, driven through the
+// gcloud CLI
+type GCP struct {
+	Project string
+	// Binary is the gcloud CLI (default "gcloud")
+	Binary string
+
+	once     sync.Once
+	existing map[string]bool
+	err      error
+}
+
+func (g *GCP) gcloud(stdin []byte, args ...string) ([]byte, error) {
+	binary := g.Binary
+	if binary == "" {
+		binary = "gcloud"
+	}
+	return run(stdin, binary, append(args, "--project", g.Project)...)
+}
+
+// List returns the names of the project's secrets
+func (g *GCP) List() ([]string, error) {
+	out, err := g.gcloud(nil, "secrets", "list", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var items []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, fmt.Errorf("unexpected gcloud output: %w", err)
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		// Names are projects/PROJECT/secrets/NAME
+		names = append(names, path.Base(item.Name))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the latest version of a secret
+func (g *GCP) Get(name string) ([]byte, error) {
+	return g.gcloud(nil, "secrets", "versions", "access", "latest", "--secret", name)
+}
+
+// Put adds a version holding value, creating the secret first if needed.
+// The value is passed on stdin so it never appears in the process list.
+func (g *GCP) Put(name string, value []byte) error {
+	g.once.Do(func() {
+		var names []string
+		names, g.err = g.List()
+		g.existing = map[string]bool{}
+		for _, n := range names {
+			g.existing[n] = true
+		}
+	})
+	if g.err != nil {
+		return g.err
+	}
+	if g.existing[name] {
+		_, err := g.gcloud(value, "secrets", "versions", "add", name, "--data-file", "-")
+		return err
+	}
+	_, err := g.gcloud(value, "secrets", "create", name, "--replication-policy", "automatic", "--data-file", "-")
+	if err == nil {
+		g.existing[name] = true
+	}
+	return err
+}
+
+// Secret IDs allow letters, digits, dashes and underscores, so keys map
+// to themselves
+
+func (*GCP) Key(name string) string {
+	return name
+}
+
+func (*GCP) Name(key string) (string, error) {
+	if len(key) > 255 || strings.IndexFunc(key, func(r rune) bool {
+		return !(r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) >= 0 {
+		return "", fmt.Errorf("'%s' cannot be named in Secret Manager, which allows only letters, digits, dashes and underscores", key)
+	}
+	return key, nil
+}
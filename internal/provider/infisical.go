@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Infisical is one environment of an Infisical project, read through the
+// infisical CLI
+type Infisical struct {
+	// ProjectID defaults to the project linked by .infisical.json
+	ProjectID string
+	Env       string
+	// Path is the folder to read (default "/")
+	Path string
+	// Binary is the infisical CLI (default "infisical")
+	Binary string
+}
+
+// Secrets returns the folder's secrets in name order
+func (i Infisical) Secrets() ([]Secret, error) {
+	binary := i.Binary
+	if binary == "" {
+		binary = "infisical"
+	}
+	args := []string{"export", "--format", "json", "--env", i.Env}
+	if i.ProjectID != "" {
+		args = append(args, "--projectId", i.ProjectID)
+	}
+	folder := i.Path
+	if folder == "" {
+		folder = "/"
+	}
+	args = append(args, "--path", folder)
+	out, err := run(nil, binary, args...)
+	if err != nil {
+		return nil, err
+	}
+	var items []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, fmt.Errorf("unexpected infisical output: %w", err)
+	}
+	source := i.Env + folder
+	if folder != "/" {
+		source += "/"
+	}
+	var secrets []Secret
+	for _, item := range items {
+		secrets = append(secrets, Secret{Key: item.Key, Source: source + item.Key, Value: []byte(item.Value)})
+	}
+	sort.Slice(secrets, func(a, b int) bool { return secrets[a].Key < secrets[b].Key })
+	return secrets, nil
+}
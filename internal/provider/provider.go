@@ -0,0 +1,88 @@
+// Package provider connects lockbox to hosted secret managers so secrets
+// can be mirrored or migrated in either direction. Each provider drives
+// the vendor's own CLI, so it uses whatever login, profile and
+// credentials the user has already set up for it; Vault, whose API is
+// simple enough, is spoken to over HTTP with the CLI's environment.
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/bulk"
+)
+
+// Provider is a hosted secret manager
+type Provider interface {
+	// List returns the names of the provider's secrets
+	List() ([]string, error)
+	// Get returns the current value of the secret called name
+	Get(name string) ([]byte, error)
+	// Put makes value the current value of the secret called name,
+	// creating the secret if needed
+	Put(name string, value []byte) error
+	// Key maps a provider secret name to a lockbox key
+	Key(name string) string
+	// Name maps a lockbox key to a provider secret name, failing for keys
+	// the provider cannot name
+	Name(key string) (string, error)
+}
+
+// Committer is a provider that buffers Put calls until Commit, such as
+// one writing every key as a field of a single secret
+type Committer interface {
+	Commit() error
+}
+
+// Secret is a provider secret to import, under the lockbox key it maps to
+type Secret struct {
+	Key string
+	// Source describes where the value came from
+	Source string
+	Value  []byte
+}
+
+// workers bounds concurrent CLI calls, which are slow but network bound
+const workers = 8
+
+// Import reads every secret of p. Values are fetched several at a time
+// and returned in name order.
+func Import(p Provider, label string) ([]Secret, error) {
+	names, err := p.List()
+	if err != nil {
+		return nil, err
+	}
+	var secrets []Secret
+	err = bulk.Map(names, workers, p.Get, func(name string, value []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, Secret{Key: p.Key(name), Source: label + "/" + name, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// run runs a provider CLI, feeding it stdin, and returns its output. The
+// CLI's own message is used as the error when it fails.
+func run(stdin []byte, binary string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %s", binary, msg)
+		}
+		return nil, fmt.Errorf("failed to run %s: %w", binary, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,283 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCLI writes a stand-in CLI that appends its arguments, and any stdin
+// it is given for writes, to a log and answers with script
+func fakeCLI(t *testing.T, script string) (binary, log string) {
+	t.Helper()
+	dir := t.TempDir()
+	binary = filepath.Join(dir, "cli")
+	log = filepath.Join(dir, "log")
+	body := "#!/bin/sh\necho \"$@\" >> " + log + "\n" + script
+	if err := os.WriteFile(binary, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binary, log
+}
+
+func readLog(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+const azureScript = `case "$3" in
+list) cat <<'JSON'
+[{"id": "https://v.vault.azure.net/secrets/db-url", "name": "db-url", "attributes": {"enabled": true}},
+ {"id": "https://v.vault.azure.net/secrets/api-key", "attributes": {"enabled": true}},
+ {"id": "https://v.vault.azure.net/secrets/old", "name": "old", "attributes": {"enabled": false}}]
+JSON
+;;
+show) echo "{\"value\": \"value of $5\"}" ;;
+set) echo "stdin: $(cat)" >> "$(dirname "$0")/log" ;;
+esac
+`
+
+func TestAzure(t *testing.T) {
+	binary, log := fakeCLI(t, azureScript)
+	az := Azure{Vault: "v", Binary: binary}
+
+	secrets, err := Import(az, "v")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(secrets) != 2 {
+		t.Fatalf("imported %d secrets, want 2 (disabled skipped)", len(secrets))
+	}
+	want := []Secret{
+		{Key: "api_key", Source: "v/api-key", Value: []byte("value of api-key")},
+		{Key: "db_url", Source: "v/db-url", Value: []byte("value of db-url")},
+	}
+	for i, s := range secrets {
+		if s.Key != want[i].Key || s.Source != want[i].Source || string(s.Value) != string(want[i].Value) {
+			t.Errorf("secret %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+
+	name, err := az.Name("DB_URL")
+	if err != nil || name != "DB-URL" {
+		t.Errorf("Name(DB_URL) = %q, %v", name, err)
+	}
+	if _, err := az.Name("db.url"); err == nil {
+		t.Error("Name accepted a key Key Vault cannot hold")
+	}
+
+	os.Remove(log)
+	if err := az.Put("DB-URL", []byte("postgres://")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	got := readLog(t, log)
+	if got[0] != "keyvault secret set --name DB-URL --file /dev/stdin --encoding utf-8 --output none --vault-name v" || got[1] != "stdin: postgres://" {
+		t.Errorf("Put ran %q", got)
+	}
+}
+
+func TestGCP(t *testing.T) {
+	binary, log := fakeCLI(t, `case "$2" in
+list) echo '[{"name": "projects/p/secrets/EXISTING"}]' ;;
+versions) [ "$3" = access ] && printf 'value of %s' "$6" || echo "stdin: $(cat)" >> "$(dirname "$0")/log" ;;
+create) echo "stdin: $(cat)" >> "$(dirname "$0")/log" ;;
+esac
+`)
+	gcp := &GCP{Project: "p", Binary: binary}
+
+	secrets, err := Import(gcp, "p")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(secrets) != 1 || secrets[0].Key != "EXISTING" || string(secrets[0].Value) != "value of EXISTING" {
+		t.Errorf("imported %+v", secrets)
+	}
+	if _, err := gcp.Name("a/b"); err == nil {
+		t.Error("Name accepted a key Secret Manager cannot hold")
+	}
+
+	os.Remove(log)
+	if err := gcp.Put("EXISTING", []byte("one")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := gcp.Put("NEW", []byte("two")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	want := []string{
+		"secrets list --format json --project p",
+		"secrets versions add EXISTING --data-file - --project p",
+		"stdin: one",
+		"secrets create NEW --replication-policy automatic --data-file - --project p",
+		"stdin: two",
+	}
+	if got := readLog(t, log); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Put ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunError(t *testing.T) {
+	binary, _ := fakeCLI(t, "echo 'ERROR: Please run az login' >&2\nexit 1\n")
+	if _, err := (Azure{Vault: "v", Binary: binary}).List(); err == nil || !strings.Contains(err.Error(), "Please run az login") {
+		t.Errorf("List = %v, want the CLI's error", err)
+	}
+}
+
+func TestDoppler(t *testing.T) {
+	binary, log := fakeCLI(t, `cat <<'JSON'
+{"DOPPLER_CONFIG": "dev", "DOPPLER_ENVIRONMENT": "dev", "DOPPLER_PROJECT": "x", "STRIPE_KEY": "sk_test", "DB_URL": "postgres://"}
+JSON
+`)
+	secrets, err := Doppler{Project: "x", Config: "dev", Binary: binary}.Secrets()
+	if err != nil {
+		t.Fatalf("Secrets failed: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0].Key != "DB_URL" || secrets[1].Source != "x/dev/STRIPE_KEY" || string(secrets[1].Value) != "sk_test" {
+		t.Errorf("secrets = %+v", secrets)
+	}
+	if got := readLog(t, log); got[0] != "secrets download --no-file --format json --project x --config dev" {
+		t.Errorf("doppler args = %s", got[0])
+	}
+
+	// Without flags the CLI's directory setup picks the config
+	secrets, _ = Doppler{Binary: binary}.Secrets()
+	if len(secrets) != 2 || secrets[0].Source != "x/dev/DB_URL" {
+		t.Errorf("secrets = %+v", secrets)
+	}
+}
+
+func TestInfisical(t *testing.T) {
+	binary, log := fakeCLI(t, `cat <<'JSON'
+[{"key": "SMTP_PASS", "value": "p4ss", "type": "shared"}, {"key": "API_URL", "value": "https://api", "type": "shared"}]
+JSON
+`)
+	secrets, err := Infisical{ProjectID: "abc", Env: "prod", Path: "/backend", Binary: binary}.Secrets()
+	if err != nil {
+		t.Fatalf("Secrets failed: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0].Key != "API_URL" || secrets[1].Source != "prod/backend/SMTP_PASS" || string(secrets[1].Value) != "p4ss" {
+		t.Errorf("secrets = %+v", secrets)
+	}
+	if got := readLog(t, log); got[0] != "export --format json --env prod --projectId abc --path /backend" {
+		t.Errorf("infisical args = %s", got[0])
+	}
+}
+
+// fakeVault serves one KV mount at secret/ holding data, checking the
+// token and, on version 2, the cas of writes
+func fakeVault(t *testing.T, version string, data map[string]any) (*httptest.Server, *int) {
+	t.Helper()
+	writes, current := 0, 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		secret := "/v1/secret/myapp"
+		if version == "2" {
+			secret = "/v1/secret/data/myapp"
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/"):
+			fmt.Fprintf(w, `{"data":{"path":"secret/","type":"kv","options":{"version":%q}}}`, version)
+		case r.URL.Path != secret:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		case r.Method == http.MethodGet && version == "2":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data, "metadata": map[string]int{"version": current}}})
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]any{"data": data})
+		case r.Method == http.MethodPost:
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			if version == "2" {
+				if cas := body["options"].(map[string]any)["cas"]; cas != float64(current) {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+					return
+				}
+				body = body["data"].(map[string]any)
+				current++
+			}
+			data = body
+			writes++
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &writes
+}
+
+func TestVault(t *testing.T) {
+	for _, version := range []string{"1", "2"} {
+		t.Run("kv"+version, func(t *testing.T) {
+			srv, writes := fakeVault(t, version, map[string]any{"DB_URL": "postgres://db", "PORT": 5432})
+			secrets, err := Import(&Vault{Addr: srv.URL, Token: "root", Path: "secret/myapp"}, "secret/myapp")
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			want := []Secret{
+				{Key: "DB_URL", Source: "secret/myapp/DB_URL", Value: []byte("postgres://db")},
+				{Key: "PORT", Source: "secret/myapp/PORT", Value: []byte("5432")},
+			}
+			if len(secrets) != len(want) {
+				t.Fatalf("imported %+v, want %+v", secrets, want)
+			}
+			for i, s := range secrets {
+				if s.Key != want[i].Key || s.Source != want[i].Source || string(s.Value) != string(want[i].Value) {
+					t.Errorf("secret %d = %+v, want %+v", i, s, want[i])
+				}
+			}
+
+			v := &Vault{Addr: srv.URL, Token: "root", Path: "/secret/myapp/"}
+			v.Put("API_KEY", []byte("k"))
+			v.Put("DB_URL", []byte("postgres://new"))
+			if err := v.Commit(); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if *writes != 1 {
+				t.Errorf("Commit wrote %d times, want once", *writes)
+			}
+			reread := &Vault{Addr: srv.URL, Token: "root", Path: "secret/myapp"}
+			names, _ := reread.List()
+			if strings.Join(names, ",") != "API_KEY,DB_URL,PORT" {
+				t.Errorf("fields after export = %v, want the old ones kept", names)
+			}
+			if value, _ := reread.Get("DB_URL"); string(value) != "postgres://new" {
+				t.Errorf("DB_URL = %q after export", value)
+			}
+		})
+	}
+
+	srv, _ := fakeVault(t, "2", map[string]any{"A": "1"})
+	stale := &Vault{Addr: srv.URL, Token: "root", Path: "secret/myapp"}
+	stale.List()
+	other := &Vault{Addr: srv.URL, Token: "root", Path: "secret/myapp"}
+	other.Put("B", []byte("2"))
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	stale.Put("C", []byte("3"))
+	if err := stale.Commit(); err == nil || !strings.Contains(err.Error(), "check-and-set") {
+		t.Errorf("Commit over a newer version = %v, want a check-and-set error", err)
+	}
+
+	if _, err := (&Vault{Addr: srv.URL, Token: "wrong", Path: "secret/myapp"}).List(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("List with a bad token = %v, want Vault's error", err)
+	}
+	if _, err := (&Vault{Addr: srv.URL, Token: "root", Path: "secret"}).List(); err == nil {
+		t.Error("List accepted a mount as the secret path")
+	}
+	if names, err := (&Vault{Addr: srv.URL, Token: "root", Path: "secret/other"}).List(); err != nil || len(names) != 0 {
+		t.Errorf("List of a missing secret = %v, %v; want none", names, err)
+	}
+}
@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Vault is one secret of a HashiCorp Vault KV mount, such as secret/myapp,
+// whose fields are lockbox keys. Unlike the other providers it speaks the
+// Vault HTTP API, so no vault CLI is needed. KV versions 1 and 2 are
+// supported.
+type Vault struct {
+	// Addr is the server, such as https://vault.example.com:8200
+	Addr  string
+	Token string
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+	// Path is the mount followed by the secret's path in it
+	Path string
+	// Client makes the requests (default http.DefaultClient)
+	Client *http.Client
+
+	once sync.Once
+	err  error
+	// mount is the mount's path with a trailing slash, such as secret/
+	mount   string
+	kv2     bool
+	fields  map[string]any
+	version int
+
+	mu      sync.Mutex
+	pending map[string]string
+}
+
+// vaultReply is the envelope of Vault API responses
+type vaultReply struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+// do sends a request to the Vault API and decodes the data of the reply
+// into data, returning the status. 404 is not an error.
+func (v *Vault) do(method, path string, body, data any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.Addr, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	}
+	var reply vaultReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil && err != io.EOF {
+		return resp.StatusCode, fmt.Errorf("unexpected Vault response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode >= 300 {
+		if len(reply.Errors) > 0 {
+			return resp.StatusCode, fmt.Errorf("vault: %s", strings.Join(reply.Errors, "; "))
+		}
+		return resp.StatusCode, fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+	if data != nil && len(reply.Data) > 0 {
+		if err := json.Unmarshal(reply.Data, data); err != nil {
+			return resp.StatusCode, fmt.Errorf("unexpected Vault response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// load finds the mount of Path and its KV version, as the vault CLI does,
+// then reads the secret's fields once
+func (v *Vault) load() error {
+	v.once.Do(func() {
+		path := strings.Trim(v.Path, "/")
+		var mount struct {
+			Path    string `json:"path"`
+			Options struct {
+				Version string `json:"version"`
+			} `json:"options"`
+		}
+		status, err := v.do(http.MethodGet, "sys/internal/ui/mounts/"+path, nil, &mount)
+		if err != nil {
+			v.err = err
+			return
+		}
+		if status == http.StatusNotFound || mount.Path == "" {
+			// Servers too old to answer: take the first segment as a KV v2
+			// mount, the default since Vault 1.1
+			mount.Path = strings.SplitN(path, "/", 2)[0] + "/"
+			mount.Options.Version = "2"
+		}
+		v.mount, v.kv2 = mount.Path, mount.Options.Version == "2"
+		if strings.TrimPrefix(path+"/", v.mount) == "" {
+			v.err = fmt.Errorf("%s is a mount; give the path of a secret in it, such as %smyapp", v.Path, v.mount)
+			return
+		}
+
+		if v.kv2 {
+			var secret struct {
+				Data     map[string]any `json:"data"`
+				Metadata struct {
+					Version int `json:"version"`
+				} `json:"metadata"`
+			}
+			_, v.err = v.do(http.MethodGet, v.apiPath(), nil, &secret)
+			v.fields, v.version = secret.Data, secret.Metadata.Version
+		} else {
+			_, v.err = v.do(http.MethodGet, v.apiPath(), nil, &v.fields)
+		}
+	})
+	return v.err
+}
+
+// apiPath is the API path of the secret's data
+func (v *Vault) apiPath() string {
+	rest := strings.TrimPrefix(strings.Trim(v.Path, "/"), v.mount)
+	if v.kv2 {
+		return v.mount + "data/" + rest
+	}
+	return v.mount + rest
+}
+
+// List returns the names of the secret's fields, none if the secret does
+// not exist
+func (v *Vault) List() ([]string, error) {
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(v.fields))
+	for name := range v.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the value of a field. Fields that are not strings are
+// returned as JSON.
+func (v *Vault) Get(name string) ([]byte, error) {
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	value, ok := v.fields[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no field '%s'", v.Path, name)
+	}
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(value)
+}
+
+// Put sets a field when Commit is called, so an export writes one new
+// version of the secret rather than one per key
+func (v *Vault) Put(name string, value []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pending == nil {
+		v.pending = map[string]string{}
+	}
+	v.pending[name] = string(value)
+	return nil
+}
+
+// Commit writes the fields set with Put over the secret's other fields.
+// On KV v2 the write fails rather than overwrite a version written since
+// the secret was read.
+func (v *Vault) Commit() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.pending) == 0 {
+		return nil
+	}
+	if err := v.load(); err != nil {
+		return err
+	}
+	fields := map[string]any{}
+	for name, value := range v.fields {
+		fields[name] = value
+	}
+	for name, value := range v.pending {
+		fields[name] = value
+	}
+
+	var body any = fields
+	if v.kv2 {
+		body = map[string]any{"data": fields, "options": map[string]int{"cas": v.version}}
+	}
+	if _, err := v.do(http.MethodPost, v.apiPath(), body, nil); err != nil {
+		return err
+	}
+	v.fields, v.pending = fields, nil
+	return nil
+}
+
+// Key returns the field name as is
+func (v *Vault) Key(name string) string {
+	return name
+}
+
+// Name returns the key as is: any key is a valid field name
+func (v *Vault) Name(key string) (string, error) {
+	return key, nil
+}
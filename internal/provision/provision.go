@@ -0,0 +1,183 @@
+// Package provision fetches what a new server needs to set up its store
+// without anyone at a terminal: the seed archive holding its secrets, and
+// the passphrase that opens it from the cloud instance's metadata.
+//
+// Provisioning runs early in boot from cloud-init or Ansible, when the
+// network may not be up yet, so fetches are retried with backoff.
+package provision
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxSeedSize bounds the size of a seed archive
+const MaxSeedSize = 64 << 20
+
+// Attempts is how often a fetch is tried, RetryDelay the wait before the
+// second try, doubling after each failure
+var (
+	Attempts   = 5
+	RetryDelay = 2 * time.Second
+)
+
+// Metadata service endpoints, replaced in tests
+var (
+	AWSMetadataURL = "http://169.254.169.254"
+	GCPMetadataURL = "http://metadata.google.internal"
+)
+
+// MetadataName is the instance tag on AWS, or custom metadata attribute on
+// GCP, holding the seed's passphrase
+const MetadataName = "lockbox-bootstrap"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// metadataClient fails fast off the cloud, where the endpoints do not
+// answer
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// Redact returns rawURL without its query and credentials, which may hold
+// a presigned token, for logs
+func Redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "seed"
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
+
+// Fetch returns the seed at rawURL: an https URL, or a file:// URL for a
+// seed baked into the image
+func Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed URL: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read seed: %w", err)
+		}
+		defer f.Close()
+		return readSeed(f)
+	case "https":
+	default:
+		return nil, fmt.Errorf("seed URL must be https:// or file://, not %s", Redact(rawURL))
+	}
+
+	delay := RetryDelay
+	for attempt := 1; ; attempt++ {
+		data, retry, err := get(ctx, rawURL)
+		if err == nil || !retry || attempt == Attempts {
+			return data, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// get fetches rawURL once, reporting whether a failure may be temporary
+func get(ctx context.Context, rawURL string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to fetch %s: %w", Redact(rawURL), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("failed to fetch %s: %s", Redact(rawURL), resp.Status)
+	}
+	data, err := readSeed(resp.Body)
+	return data, false, err
+}
+
+// readSeed reads a seed of at most MaxSeedSize bytes
+func readSeed(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSeedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seed: %w", err)
+	}
+	if len(data) > MaxSeedSize {
+		return nil, fmt.Errorf("seed is larger than %d MiB", MaxSeedSize>>20)
+	}
+	return data, nil
+}
+
+// InstanceMetadata returns the value of the instance tag or metadata
+// attribute called name, asking the AWS metadata service (IMDSv2) and then
+// GCP's. Both only answer the instance itself.
+func InstanceMetadata(ctx context.Context, name string) (string, error) {
+	value, awsErr := awsMetadata(ctx, name)
+	if awsErr == nil {
+		return value, nil
+	}
+	value, gcpErr := gcpMetadata(ctx, name)
+	if gcpErr == nil {
+		return value, nil
+	}
+	return "", fmt.Errorf("no instance metadata '%s': AWS: %v; GCP: %v", name, awsErr, gcpErr)
+}
+
+// awsMetadata reads the instance tag called name with an IMDSv2 session
+// token. Tags must be allowed in the instance metadata.
+func awsMetadata(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, AWSMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadata(req)
+	if err != nil {
+		return "", err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, AWSMetadataURL+"/latest/meta-data/tags/instance/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return metadata(req)
+}
+
+// gcpMetadata reads the custom metadata attribute called name
+func gcpMetadata(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, GCPMetadataURL+"/computeMetadata/v1/instance/attributes/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return metadata(req)
+}
+
+// metadata sends a request to a metadata service and returns the body
+func metadata(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,86 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetch(t *testing.T) {
+	failures := 2
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("seed"))
+		}
+	}))
+	defer srv.Close()
+	httpClient, RetryDelay = srv.Client(), time.Millisecond
+	defer func() { httpClient, RetryDelay = &http.Client{Timeout: 30 * time.Second}, 2*time.Second }()
+
+	// Temporary failures are retried
+	data, err := Fetch(context.Background(), srv.URL+"/seed.lbx?X-Amz-Signature=abc")
+	if err != nil || string(data) != "seed" {
+		t.Fatalf("Fetch = %q, %v", data, err)
+	}
+	_, err = Fetch(context.Background(), srv.URL+"/missing?token=abc")
+	if err == nil || !strings.Contains(err.Error(), "404") || strings.Contains(err.Error(), "token") {
+		t.Errorf("Fetch of a missing seed = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.lbx")
+	os.WriteFile(path, []byte("baked"), 0600)
+	if data, err := Fetch(context.Background(), "file://"+path); err != nil || string(data) != "baked" {
+		t.Errorf("Fetch(file) = %q, %v", data, err)
+	}
+	if _, err := Fetch(context.Background(), "http://example.com/seed.lbx"); err == nil {
+		t.Error("Fetch accepted a plain http URL")
+	}
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("session"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "session":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/tags/instance/"+MetadataName:
+			w.Write([]byte("from-aws\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer aws.Close()
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/attributes/"+MetadataName {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("from-gcp"))
+	}))
+	defer gcp.Close()
+	defer func(a, g string) { AWSMetadataURL, GCPMetadataURL = a, g }(AWSMetadataURL, GCPMetadataURL)
+
+	AWSMetadataURL, GCPMetadataURL = aws.URL, gcp.URL
+	if v, err := InstanceMetadata(context.Background(), MetadataName); err != nil || v != "from-aws" {
+		t.Errorf("InstanceMetadata on AWS = %q, %v", v, err)
+	}
+	AWSMetadataURL = gcp.URL
+	if v, err := InstanceMetadata(context.Background(), MetadataName); err != nil || v != "from-gcp" {
+		t.Errorf("InstanceMetadata on GCP = %q, %v", v, err)
+	}
+	if _, err := InstanceMetadata(context.Background(), "other"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("InstanceMetadata of a missing tag = %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as version 1-M, from the worked example in the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, expected %v", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	for mask, want := range []int{
+		0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+		0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+	} {
+		if got := formatBits(mask); got != want {
+			t.Errorf("formatBits(%d) = %015b, expected %015b", mask, got, want)
+		}
+	}
+	if got := versionBits(7); got != 0b000111110010010100 {
+		t.Errorf("versionBits(7) = %018b", got)
+	}
+	if got := versionBits(8); got != 0b001000010110111100 {
+		t.Errorf("versionBits(8) = %018b", got)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// The codeword counts of the standard's capacity table
+	total := []int{0, 26, 44, 70, 100, 134, 172, 196, 242, 292, 346, 404, 466, 532, 581, 655, 733, 815, 901, 991, 1085}
+	for v := 1; v <= MaxVersion; v++ {
+		c := newCode(v)
+		c.drawFunctionPatterns()
+		free := 0
+		for y := range c.Size {
+			for x := range c.Size {
+				if !c.function[y][x] {
+					free++
+				}
+			}
+		}
+		if free != rawModules(v) || free/8 != total[v] {
+			t.Errorf("Version %d has %d data modules, expected %d codewords", v, free, total[v])
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	c, err := Encode([]byte("lockbox"))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if c.Version != 1 || c.Size != 21 {
+		t.Errorf("Expected a version 1 code, got version %d", c.Version)
+	}
+	// Finder pattern corners and the dark module
+	for _, p := range [][2]int{{0, 0}, {20, 0}, {0, 20}, {8, 13}} {
+		if !c.Dark(p[0], p[1]) {
+			t.Errorf("Module %v should be dark", p)
+		}
+	}
+
+	// Two rows per line plus the quiet zone
+	lines := strings.Split(strings.TrimSuffix(c.Text(), "\n"), "\n")
+	if len(lines) != 15 || len([]rune(lines[0])) != 29 {
+		t.Errorf("Unexpected text rendering: %d lines of %d", len(lines), len([]rune(lines[0])))
+	}
+
+	c, err = Encode(bytes.Repeat([]byte{'x'}, 400))
+	if err != nil || c.Version != 15 {
+		t.Fatalf("Expected 400 bytes to need version 15: %v", err)
+	}
+	if _, err := Encode(make([]byte, 667)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
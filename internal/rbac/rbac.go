@@ -0,0 +1,182 @@
+// Package rbac evaluates role-based access to secrets. Policies bind a
+// subject (a user, group, token or claim) to a role on a key pattern and
+// a role is a set of permissions.
+package rbac
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+)
+
+// Permission is an action a role allows
+type Permission string
+
+const (
+	// Read allows reading secret values
+	Read Permission = "read"
+	// List allows seeing secret names
+	List Permission = "list"
+	// Write allows setting and deleting secrets through the server
+	Write Permission = "write"
+	// Audit allows reading the audit and access logs
+	Audit Permission = "audit"
+	// Admin allows managing the store: policies, tokens, keys and
+	// secrets owned by others
+	Admin Permission = "admin"
+)
+
+// Permissions lists every permission
+var Permissions = []Permission{Read, List, Write, Audit, Admin}
+
+// Built-in role names
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleReader   = "reader"
+	RoleAuditor  = "auditor"
+)
+
+// Builtin are the roles every store has
+var Builtin = []db.Role{
+	{Name: RoleAdmin, Permissions: []string{string(Read), string(List), string(Write), string(Audit), string(Admin)}},
+	{Name: RoleOperator, Permissions: []string{string(Read), string(List), string(Write)}},
+	{Name: RoleReader, Permissions: []string{string(Read), string(List)}},
+	{Name: RoleAuditor, Permissions: []string{string(List), string(Audit)}},
+}
+
+// IsBuiltin reports whether name is a built-in role
+func IsBuiltin(name string) bool {
+	return slices.ContainsFunc(Builtin, func(r db.Role) bool { return r.Name == name })
+}
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// ValidateName checks that name can be used for a new role
+func ValidateName(name string) error {
+	if !roleName.MatchString(name) {
+		return fmt.Errorf("invalid role name '%s': use lowercase letters, digits, '-' and '_'", name)
+	}
+	if IsBuiltin(name) {
+		return fmt.Errorf("'%s' is a built-in role", name)
+	}
+	return nil
+}
+
+// ParsePermissions parses a comma-separated permission list
+func ParsePermissions(s string) ([]string, error) {
+	var perms []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !slices.Contains(Permissions, Permission(p)) {
+			return nil, fmt.Errorf("unknown permission '%s': expected read, list, write, audit or admin", p)
+		}
+		if !slices.Contains(perms, p) {
+			perms = append(perms, p)
+		}
+	}
+	if len(perms) == 0 {
+		return nil, fmt.Errorf("a role needs at least one permission")
+	}
+	return perms, nil
+}
+
+// Evaluator answers access questions for a set of roles and policies
+type Evaluator struct {
+	roles    map[string][]Permission
+	policies []db.Policy
+}
+
+// New returns an evaluator for the built-in roles, the user-defined roles
+// and policies. Policies naming an unknown role grant nothing.
+func New(roles []db.Role, policies []db.Policy) *Evaluator {
+	e := &Evaluator{roles: map[string][]Permission{}, policies: slices.Clone(policies)}
+	for _, r := range append(slices.Clone(roles), Builtin...) {
+		perms := make([]Permission, len(r.Permissions))
+		for i, p := range r.Permissions {
+			perms[i] = Permission(p)
+		}
+		e.roles[r.Name] = perms
+	}
+	return e
+}
+
+// Load returns an evaluator for the roles and policies in store
+func Load(store *db.Store) (*Evaluator, error) {
+	roles, err := store.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := store.ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+	return New(roles, policies), nil
+}
+
+// HasRole reports whether name is a built-in or user-defined role
+func (e *Evaluator) HasRole(name string) bool {
+	_, ok := e.roles[name]
+	return ok
+}
+
+// ForToken returns an evaluator that also grants t the reader role on
+// each of its read scopes
+func (e *Evaluator) ForToken(t db.Token) *Evaluator {
+	scoped := &Evaluator{roles: e.roles, policies: slices.Clone(e.policies)}
+	for _, scope := range t.Scopes {
+		if pattern, ok := strings.CutPrefix(scope, policy.ScopeRead); ok {
+			scoped.policies = append(scoped.policies, db.Policy{Subject: policy.TokenSubject(t.Name), Pattern: pattern, Role: RoleReader})
+		}
+	}
+	return scoped
+}
+
+// Allows reports whether any policy for one of subjects grants perm on
+// key. Patterns use path.Match glob syntax, e.g. "APP_*".
+func (e *Evaluator) Allows(subjects []string, perm Permission, key string) bool {
+	for _, p := range e.policies {
+		if !slices.Contains(subjects, p.Subject) || !slices.Contains(e.roles[p.Role], perm) {
+			continue
+		}
+		if ok, _ := path.Match(p.Pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the keys subjects are granted perm on
+func (e *Evaluator) Filter(subjects []string, perm Permission, keys []string) []string {
+	allowed := []string{}
+	for _, key := range keys {
+		if e.Allows(subjects, perm, key) {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+// Granted reports whether subjects hold perm store-wide, through a policy
+// on the pattern "*". Audit and admin are only meaningful store-wide.
+func (e *Evaluator) Granted(subjects []string, perm Permission) bool {
+	for _, p := range e.policies {
+		if p.Pattern == "*" && slices.Contains(subjects, p.Subject) && slices.Contains(e.roles[p.Role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bound reports whether any policy names one of subjects
+func (e *Evaluator) Bound(subjects []string) bool {
+	return slices.ContainsFunc(e.policies, func(p db.Policy) bool { return slices.Contains(subjects, p.Subject) })
+}
@@ -0,0 +1,127 @@
+package rbac
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+)
+
+func TestAllows(t *testing.T) {
+	e := New(nil, []db.Policy{
+		{Subject: "uid:1000", Pattern: "APP_*", Role: RoleReader},
+		{Subject: "gid:50", Pattern: "DEPLOY_KEY", Role: RoleOperator},
+		{Subject: "uid:1002", Pattern: "*", Role: RoleAuditor},
+	})
+
+	alice := policy.Identity{UID: 1000, GID: 1000, Groups: []uint32{1000}}
+	deployer := policy.Identity{UID: 1001, GID: 1001, Groups: []uint32{1001, 50}}
+	auditor := policy.Identity{UID: 1002, GID: 1002, Groups: []uint32{1002}}
+
+	cases := []struct {
+		id   policy.Identity
+		perm Permission
+		key  string
+		want bool
+	}{
+		{alice, Read, "APP_TOKEN", true},
+		{alice, List, "APP_TOKEN", true},
+		{alice, Write, "APP_TOKEN", false},
+		{alice, Read, "DEPLOY_KEY", false},
+		{deployer, Write, "DEPLOY_KEY", true},
+		{deployer, Read, "APP_TOKEN", false},
+		{auditor, List, "APP_TOKEN", true},
+		{auditor, Read, "APP_TOKEN", false},
+	}
+	for _, c := range cases {
+		if got := e.Allows(c.id.Subjects(), c.perm, c.key); got != c.want {
+			t.Errorf("Allows(uid %d, %s, %q) = %v, expected %v", c.id.UID, c.perm, c.key, got, c.want)
+		}
+	}
+
+	got := e.Filter(alice.Subjects(), Read, []string{"APP_A", "DB_URL", "APP_B"})
+	if !reflect.DeepEqual(got, []string{"APP_A", "APP_B"}) {
+		t.Errorf("Filter returned %v", got)
+	}
+	if got := New(nil, nil).Filter(alice.Subjects(), Read, []string{"APP_A"}); len(got) != 0 {
+		t.Errorf("Empty evaluator allowed %v", got)
+	}
+}
+
+func TestGranted(t *testing.T) {
+	e := New(nil, []db.Policy{
+		{Subject: "uid:1", Pattern: "*", Role: RoleAdmin},
+		{Subject: "uid:2", Pattern: "APP_*", Role: RoleAdmin},
+		{Subject: "uid:3", Pattern: "*", Role: RoleAuditor},
+	})
+
+	if !e.Granted([]string{"uid:1"}, Admin) {
+		t.Error("Admin on * was not granted admin")
+	}
+	// Store-wide permissions need a policy on every key
+	if e.Granted([]string{"uid:2"}, Admin) {
+		t.Error("Admin on APP_* was granted admin")
+	}
+	if !e.Granted([]string{"uid:3"}, Audit) || e.Granted([]string{"uid:3"}, Admin) {
+		t.Error("Auditor should hold audit and not admin")
+	}
+	if !e.Bound([]string{"uid:2"}) || e.Bound([]string{"uid:4"}) {
+		t.Error("Bound reported the wrong subjects")
+	}
+}
+
+func TestCustomRoles(t *testing.T) {
+	e := New(
+		[]db.Role{{Name: "deployer", Permissions: []string{"read", "write"}}},
+		[]db.Policy{
+			{Subject: "token:ci", Pattern: "CI_*", Role: "deployer"},
+			{Subject: "token:ci", Pattern: "*", Role: "missing"},
+		},
+	)
+
+	if !e.HasRole("deployer") || !e.HasRole(RoleReader) || e.HasRole("missing") {
+		t.Error("HasRole reported the wrong roles")
+	}
+	if !e.Allows([]string{"token:ci"}, Write, "CI_KEY") || e.Allows([]string{"token:ci"}, List, "CI_KEY") {
+		t.Error("Custom role permissions were not applied")
+	}
+	// A policy for an unknown role grants nothing
+	if e.Allows([]string{"token:ci"}, Read, "PROD_KEY") {
+		t.Error("Unknown role granted access")
+	}
+}
+
+func TestForToken(t *testing.T) {
+	e := New(nil, []db.Policy{{Subject: "claim:groups=dev", Pattern: "DEV_*", Role: RoleReader}})
+	tok := db.Token{Name: "ci", Subjects: []string{"claim:groups=dev"}, Scopes: []string{"read:CI_*"}}
+
+	got := e.ForToken(tok).Filter(policy.TokenSubjects(tok), Read, []string{"CI_KEY", "DEV_KEY", "PROD_KEY"})
+	if !reflect.DeepEqual(got, []string{"CI_KEY", "DEV_KEY"}) {
+		t.Errorf("Expected CI_KEY and DEV_KEY, got %v", got)
+	}
+	if e.Allows(policy.TokenSubjects(tok), Read, "CI_KEY") {
+		t.Errorf("ForToken modified the evaluator")
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	got, err := ParsePermissions("read, write,read")
+	if err != nil || !reflect.DeepEqual(got, []string{"read", "write"}) {
+		t.Errorf("ParsePermissions = %v, %v", got, err)
+	}
+	for _, s := range []string{"", "read,delete", " , "} {
+		if _, err := ParsePermissions(s); err == nil {
+			t.Errorf("ParsePermissions accepted %q", s)
+		}
+	}
+
+	if err := ValidateName("deployer"); err != nil {
+		t.Errorf("ValidateName rejected deployer: %v", err)
+	}
+	for _, name := range []string{"admin", "Deployer", "", "a b", "-x"} {
+		if ValidateName(name) == nil {
+			t.Errorf("ValidateName accepted %q", name)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package recovery tracks single-use recovery codes, such as the backup
+// codes of a two-factor login, handing them out one at a time. Each set of
+// codes is one encrypted secret of its own kind, kept out of env and run.
+package recovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kind tags secrets that hold recovery codes
+const Kind = "recovery"
+
+// keyPrefix namespaces recovery code sets. The separator is rejected by
+// the HTTP server, so codes cannot be read remotely.
+const keyPrefix = "recovery/"
+
+// DefaultLow is how many unused codes are left when a set should be
+// renewed
+const DefaultLow = 3
+
+// ErrExhausted is returned by Use when every code has been used
+var ErrExhausted = errors.New("all recovery codes have been used")
+
+// Key returns the store key for the code set called name
+func Key(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("invalid recovery code set name '%s'", name)
+	}
+	return keyPrefix + name, nil
+}
+
+// Name returns the name of the code set stored under key
+func Name(key string) string {
+	return strings.TrimPrefix(key, keyPrefix)
+}
+
+// Code is one recovery code
+type Code struct {
+	Code string `json:"code"`
+	// Used is when the code was handed out; zero if it is unused
+	Used time.Time `json:"used,omitzero"`
+}
+
+// Set is the codes for one account, in the order they are handed out
+type Set struct {
+	Added time.Time `json:"added"`
+	Codes []Code    `json:"codes"`
+}
+
+// Parse reads codes from text, one per line or separated by spaces.
+// Blank lines and lines starting with # are ignored, as are duplicates.
+func Parse(text string, added time.Time) (Set, error) {
+	set := Set{Added: added}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, code := range strings.Fields(line) {
+			if !seen[code] {
+				seen[code] = true
+				set.Codes = append(set.Codes, Code{Code: code})
+			}
+		}
+	}
+	if len(set.Codes) == 0 {
+		return set, errors.New("no recovery codes found")
+	}
+	return set, nil
+}
+
+// Remaining returns how many codes are unused
+func (s Set) Remaining() int {
+	n := 0
+	for _, c := range s.Codes {
+		if c.Used.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// Use marks the next unused code as used at now and returns it
+func (s *Set) Use(now time.Time) (string, error) {
+	for i := range s.Codes {
+		if s.Codes[i].Used.IsZero() {
+			s.Codes[i].Used = now.UTC()
+			return s.Codes[i].Code, nil
+		}
+	}
+	return "", ErrExhausted
+}
+
+// Marshal encodes the set for storage
+func (s Set) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Unmarshal decodes a stored set
+func Unmarshal(data []byte) (Set, error) {
+	var s Set
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("invalid recovery code set: %w", err)
+	}
+	return s, nil
+}
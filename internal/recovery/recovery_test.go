@@ -0,0 +1,45 @@
+package recovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	set, err := Parse("# GitHub recovery codes\naaaa-1111 bbbb-2222\n\ncccc-3333\naaaa-1111\n", now)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(set.Codes) != 3 || set.Codes[0].Code != "aaaa-1111" || set.Codes[2].Code != "cccc-3333" {
+		t.Errorf("Unexpected codes %+v", set.Codes)
+	}
+	if _, err := Parse("# nothing\n\n", now); err == nil {
+		t.Errorf("Expected an error for a file without codes")
+	}
+}
+
+func TestUse(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	set, _ := Parse("one\ntwo\n", now)
+
+	for _, want := range []string{"one", "two"} {
+		code, err := set.Use(now)
+		if err != nil || code != want {
+			t.Errorf("Use = %q, %v; expected %q", code, err, want)
+		}
+	}
+	if set.Remaining() != 0 {
+		t.Errorf("Expected no codes to remain, got %d", set.Remaining())
+	}
+	if _, err := set.Use(now); err != ErrExhausted {
+		t.Errorf("Expected ErrExhausted, got %v", err)
+	}
+
+	// Used codes survive a round trip
+	data, _ := set.Marshal()
+	decoded, err := Unmarshal(data)
+	if err != nil || decoded.Remaining() != 0 || !decoded.Codes[0].Used.Equal(now) {
+		t.Errorf("Round trip lost state: %+v, %v", decoded, err)
+	}
+}
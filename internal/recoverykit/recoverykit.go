@@ -0,0 +1,180 @@
+// Package recoverykit writes break-glass recovery kits: printable
+// documents holding a store's encryption key, where the store lives and
+// its schema version, encrypted with a passphrase of their own. A kit
+// gets a store back when its key is lost with the machine, for example
+// when the key was kept in that machine's keychain.
+package recoverykit
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/qr"
+)
+
+// Prefix starts every kit code
+const Prefix = "lockbox-kit:1:"
+
+// format is the version byte of the encoded kit
+const format = 1
+
+// saltSize is the length of the passphrase salt
+const saltSize = 16
+
+// lineWidth is where the printed code wraps
+const lineWidth = 64
+
+// Contents is what a kit restores
+type Contents struct {
+	Key     []byte    `json:"key"`
+	Store   string    `json:"store"`
+	Schema  int       `json:"schema"`
+	Backend string    `json:"backend"`
+	Created time.Time `json:"created"`
+}
+
+// Seal encrypts c with a key derived from passphrase and returns the kit
+// code: Prefix followed by the base64url salt, work factor and ciphertext
+func Seal(c Contents, passphrase string) (string, error) {
+	plaintext, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	defer clear(plaintext)
+
+	header := make([]byte, 1+saltSize+4)
+	header[0] = format
+	if _, err := rand.Read(header[1 : 1+saltSize]); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	binary.BigEndian.PutUint32(header[1+saltSize:], uint32(crypto.PassphraseIterations))
+
+	kek, err := deriveKey(passphrase, header)
+	if err != nil {
+		return "", err
+	}
+	defer clear(kek)
+	ciphertext, err := crypto.Encrypt(plaintext, kek)
+	if err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawURLEncoding.EncodeToString(append(header, ciphertext...)), nil
+}
+
+// Open decrypts a kit code, returning crypto.ErrWrongPassphrase if
+// passphrase does not open it
+func Open(code, passphrase string) (Contents, error) {
+	var c Contents
+	encoded, ok := strings.CutPrefix(code, Prefix)
+	if !ok {
+		return c, fmt.Errorf("not a lockbox recovery kit")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < 1+saltSize+4 {
+		return c, fmt.Errorf("damaged recovery kit: check the code was copied completely")
+	}
+	if raw[0] != format {
+		return c, fmt.Errorf("unsupported recovery kit format %d", raw[0])
+	}
+
+	header := raw[:1+saltSize+4]
+	kek, err := deriveKey(passphrase, header)
+	if err != nil {
+		return c, err
+	}
+	defer clear(kek)
+	plaintext, err := crypto.Decrypt(raw[len(header):], kek)
+	if err != nil {
+		return c, crypto.ErrWrongPassphrase
+	}
+	defer clear(plaintext)
+	if err := json.Unmarshal(plaintext, &c); err != nil {
+		return c, fmt.Errorf("failed to parse recovery kit: %w", err)
+	}
+	return c, nil
+}
+
+// deriveKey derives the kit key from passphrase with the salt and work
+// factor in header
+func deriveKey(passphrase string, header []byte) ([]byte, error) {
+	salt := header[1 : 1+saltSize]
+	iterations := int(binary.BigEndian.Uint32(header[1+saltSize:]))
+	kek, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, crypto.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive passphrase key: %w", err)
+	}
+	return kek, nil
+}
+
+// Write prints the kit document: the details of the store in the clear,
+// the code as a QR code and as text, and how to restore from it
+func Write(w io.Writer, c Contents, code string) error {
+	symbol, err := qr.Encode([]byte(code))
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "LOCKBOX RECOVERY KIT\n\n")
+	fmt.Fprintf(&b, "Created:         %s\n", c.Created.Local().Format(time.DateTime))
+	fmt.Fprintf(&b, "Store:           %s\n", c.Store)
+	fmt.Fprintf(&b, "Schema version:  %d\n", c.Schema)
+	fmt.Fprintf(&b, "Key kept in:     %s\n\n", c.Backend)
+	fmt.Fprintf(&b, "This kit holds the store's encryption key, encrypted with the kit\n")
+	fmt.Fprintf(&b, "passphrase. Keep it offline, apart from the passphrase and from backups.\n\n")
+	b.WriteString(symbol.Text())
+	fmt.Fprintf(&b, "\nKit code:\n")
+	for rest := code; rest != ""; {
+		n := min(lineWidth, len(rest))
+		fmt.Fprintf(&b, "%s\n", rest[:n])
+		rest = rest[n:]
+	}
+	fmt.Fprintf(&b, "\nTo restore on a new machine:\n")
+	fmt.Fprintf(&b, "  1. Install lockbox and put the store back at its path, for example\n")
+	fmt.Fprintf(&b, "     with 'lockbox backup restore DIR --to PATH'.\n")
+	fmt.Fprintf(&b, "  2. Scan the QR code or type the kit code into a file, then run\n")
+	fmt.Fprintf(&b, "     'lockbox recovery-kit restore FILE' and enter the kit passphrase.\n")
+	fmt.Fprintf(&b, "     Add --store PATH if the store is no longer at the path above.\n")
+	fmt.Fprintf(&b, "  3. Run 'lockbox verify', then make a new kit: this one stays valid\n")
+	fmt.Fprintf(&b, "     for as long as the store keeps its key.\n")
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// Parse finds the kit code in a kit document, or in a file holding only
+// the code as scanned from the QR code. Codes wrapped over several lines
+// are joined.
+func Parse(text string) (string, error) {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, Prefix) {
+			continue
+		}
+		code := line
+		for _, next := range lines[i+1:] {
+			next = strings.TrimSpace(next)
+			if next == "" || strings.ContainsFunc(next, func(r rune) bool { return !isBase64URL(r) }) {
+				break
+			}
+			code += next
+		}
+		return code, nil
+	}
+	return "", fmt.Errorf("no recovery kit code found")
+}
+
+func isBase64URL(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_'
+}
@@ -0,0 +1,69 @@
+package recoverykit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+)
+
+func TestSealOpen(t *testing.T) {
+	defer func(n int) { crypto.PassphraseIterations = n }(crypto.PassphraseIterations)
+	crypto.PassphraseIterations = 1000
+
+	key, _ := crypto.GenerateKey()
+	c := Contents{Key: key, Store: "/home/alice/.lockbox/lockbox.db", Schema: 12, Backend: "keychain", Created: time.Now().UTC().Truncate(time.Second)}
+	code, err := Seal(c, "correct horse")
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if !strings.HasPrefix(code, Prefix) || strings.Contains(code, "alice") {
+		t.Errorf("Unexpected code %q", code)
+	}
+
+	got, err := Open(code, "correct horse")
+	if err != nil || !bytes.Equal(got.Key, key) || got.Store != c.Store || got.Schema != 12 || !got.Created.Equal(c.Created) {
+		t.Errorf("Open = %+v, %v", got, err)
+	}
+	if _, err := Open(code, "battery staple"); err != crypto.ErrWrongPassphrase {
+		t.Errorf("Open with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := Open(code[:len(code)-10], "correct horse"); err == nil {
+		t.Error("Open accepted a truncated code")
+	}
+}
+
+func TestWriteParse(t *testing.T) {
+	defer func(n int) { crypto.PassphraseIterations = n }(crypto.PassphraseIterations)
+	crypto.PassphraseIterations = 1000
+
+	key, _ := crypto.GenerateKey()
+	c := Contents{Key: key, Store: "/srv/lockbox.db", Schema: 12, Backend: "store", Created: time.Now()}
+	code, _ := Seal(c, "pw")
+
+	var doc bytes.Buffer
+	if err := Write(&doc, c, code); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	text := doc.String()
+	for _, want := range []string{"/srv/lockbox.db", "Schema version:  12", "█", "recovery-kit restore"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Document is missing %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, code) {
+		t.Error("Expected the code to be wrapped over several lines")
+	}
+
+	// The wrapped code in the document and a bare scanned code both parse
+	for _, in := range []string{text, code + "\n"} {
+		if got, err := Parse(in); err != nil || got != code {
+			t.Errorf("Parse = %q, %v, expected the kit code", got, err)
+		}
+	}
+	if _, err := Parse("nothing here"); err == nil {
+		t.Error("Parse accepted text without a code")
+	}
+}
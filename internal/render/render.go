@@ -0,0 +1,145 @@
+// Package render fills config file templates with secret values, so files
+// such as nginx.conf or application.yml can be generated without exporting
+// every secret to the environment.
+//
+// Templates use Go's text/template syntax, with secrets referenced by
+// quoted key:
+//
+//	password: {{ secret "DB_PASSWORD" }}
+//
+// Keys must be literal strings, so every secret a template reads is known
+// before it runs and nothing else is decrypted.
+package render
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/template"
+	"text/template/parse"
+)
+
+// Template is a parsed config template
+type Template struct {
+	t    *template.Template
+	keys []string
+}
+
+// Parse parses the template text, called name in errors
+func Parse(name, text string) (*Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(funcs(nil)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		w := walker{tree: tt.Tree}
+		if err := w.walk(tt.Tree.Root); err != nil {
+			return nil, err
+		}
+		keys = append(keys, w.keys...)
+	}
+	slices.Sort(keys)
+	return &Template{t: t, keys: slices.Compact(keys)}, nil
+}
+
+// Keys returns the keys of the secrets t reads, sorted
+func (t *Template) Keys() []string {
+	return t.keys
+}
+
+// Execute renders t to w, with values holding the value of every key in
+// Keys
+func (t *Template) Execute(w io.Writer, values map[string]string) error {
+	c, err := t.t.Clone()
+	if err != nil {
+		return err
+	}
+	return c.Funcs(funcs(values)).Execute(w, nil)
+}
+
+// funcs returns the template functions, looking secrets up in values
+func funcs(values map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(key string) (string, error) {
+			value, ok := values[key]
+			if !ok {
+				return "", fmt.Errorf("secret '%s' not found", key)
+			}
+			return value, nil
+		},
+	}
+}
+
+// walker collects the keys of the secret calls in a template tree
+type walker struct {
+	tree *parse.Tree
+	keys []string
+}
+
+// walk collects the keys under node, returning an error for a secret call
+// whose key is not a quoted string
+func (w *walker) walk(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := w.walk(child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return w.walk(n.Pipe)
+	case *parse.IfNode:
+		return w.branch(&n.BranchNode)
+	case *parse.RangeNode:
+		return w.branch(&n.BranchNode)
+	case *parse.WithNode:
+		return w.branch(&n.BranchNode)
+	case *parse.TemplateNode:
+		return w.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := w.walk(cmd); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		if id, ok := n.Args[0].(*parse.IdentifierNode); ok && id.Ident == "secret" {
+			var key *parse.StringNode
+			if len(n.Args) == 2 {
+				key, _ = n.Args[1].(*parse.StringNode)
+			}
+			if key == nil {
+				location, _ := w.tree.ErrorContext(n)
+				return fmt.Errorf("%s: secret takes one quoted key, such as {{ secret \"API_KEY\" }}", location)
+			}
+			w.keys = append(w.keys, key.Text)
+		}
+		for _, arg := range n.Args {
+			if err := w.walk(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// branch walks the pipeline and both lists of an if, range or with
+func (w *walker) branch(n *parse.BranchNode) error {
+	if err := w.walk(n.Pipe); err != nil {
+		return err
+	}
+	if err := w.walk(n.List); err != nil {
+		return err
+	}
+	return w.walk(n.ElseList)
+}
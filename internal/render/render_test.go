@@ -0,0 +1,66 @@
+package render
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	text := `server {
+    listen 443 ssl;
+    ssl_certificate_key {{ secret "TLS_KEY_PATH" }};
+{{- if secret "DEBUG" }}
+    error_log /dev/stderr {{ secret "LOG_LEVEL" | printf "%s" }};
+{{- end }}
+    proxy_set_header Authorization "Bearer {{ secret "API_TOKEN" }}";
+}
+`
+	tmpl, err := Parse("nginx.conf.tmpl", text)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if want := []string{"API_TOKEN", "DEBUG", "LOG_LEVEL", "TLS_KEY_PATH"}; !slices.Equal(tmpl.Keys(), want) {
+		t.Errorf("Keys = %v, want %v", tmpl.Keys(), want)
+	}
+
+	var b strings.Builder
+	values := map[string]string{"TLS_KEY_PATH": "/etc/ssl/key.pem", "DEBUG": "1", "LOG_LEVEL": "debug", "API_TOKEN": "tok-123"}
+	if err := tmpl.Execute(&b, values); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	want := `server {
+    listen 443 ssl;
+    ssl_certificate_key /etc/ssl/key.pem;
+    error_log /dev/stderr debug;
+    proxy_set_header Authorization "Bearer tok-123";
+}
+`
+	if b.String() != want {
+		t.Errorf("Rendered:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestRenderMissing(t *testing.T) {
+	tmpl, err := Parse("app.yml", `password: {{ secret "DB_PASSWORD" }}`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, nil); err == nil || !strings.Contains(err.Error(), "DB_PASSWORD") {
+		t.Errorf("Expected a missing secret error, got %v", err)
+	}
+}
+
+func TestRenderDynamicKey(t *testing.T) {
+	for _, text := range []string{
+		`{{ secret }}`,
+		`{{ "API_KEY" | secret }}`,
+		`{{ range $k := .Keys }}{{ secret $k }}{{ end }}`,
+		`{{ define "x" }}{{ secret (printf "%s" "A") }}{{ end }}`,
+	} {
+		if _, err := Parse("t", text); err == nil || !strings.Contains(err.Error(), "quoted key") {
+			t.Errorf("Parse(%q) = %v, want a quoted key error", text, err)
+		}
+	}
+}
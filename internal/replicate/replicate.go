@@ -0,0 +1,125 @@
+// Package replicate plans copying secrets between two lockbox instances,
+// such as a laptop and a server with push and pull, or another store file
+// with merge. A secret is only overwritten when the copy being sent was
+// updated later than the one it replaces; otherwise the target changed
+// since and the key conflicts. A merge strategy may choose differently.
+// Nothing is ever deleted.
+package replicate
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// What replicating does to a key in the target
+const (
+	Add      = "add"
+	Update   = "update"
+	Same     = "same"
+	Conflict = "conflict"
+)
+
+// Secret is a value and when it was last updated
+type Secret struct {
+	Value   []byte
+	Updated time.Time
+}
+
+// Item is a key of the source and what replicating it would do
+type Item struct {
+	Key    string `json:"key"`
+	Change string `json:"change"`
+	// Source and Target are when each copy was last updated; Target is
+	// zero for an added key
+	Source time.Time `json:"source_updated"`
+	Target time.Time `json:"target_updated,omitzero"`
+}
+
+// Plan compares every source secret with the target, sorted by key. A key
+// the target lacks is added; a differing value updates the target when the
+// source copy is newer and conflicts when it is not.
+func Plan(source, target map[string]Secret) []Item {
+	items := make([]Item, 0, len(source))
+	for key, src := range source {
+		item := Item{Key: key, Change: Add, Source: src.Updated}
+		if dst, ok := target[key]; ok {
+			item.Target = dst.Updated
+			switch {
+			case bytes.Equal(src.Value, dst.Value):
+				item.Change = Same
+			case src.Updated.After(dst.Updated):
+				item.Change = Update
+			default:
+				item.Change = Conflict
+			}
+		}
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b Item) int { return strings.Compare(a.Key, b.Key) })
+	return items
+}
+
+// Keys returns the keys to write: those added or updated, and conflicting
+// ones when force is set
+func Keys(items []Item, force bool) []string {
+	var keys []string
+	for _, item := range items {
+		if item.Change == Add || item.Change == Update || (item.Change == Conflict && force) {
+			keys = append(keys, item.Key)
+		}
+	}
+	return keys
+}
+
+// Strategies for a key both sides hold with different values
+const (
+	// Newer takes the source's value when it was updated later
+	Newer = "newer"
+	// Prompt asks which value to keep
+	Prompt = "prompt"
+	// PreferLocal keeps the target's value
+	PreferLocal = "prefer-local"
+)
+
+// Strategies are the supported strategies
+var Strategies = []string{Newer, Prompt, PreferLocal}
+
+// Choose returns the keys to write under strategy: those added, and of
+// the keys both sides hold with different values those the strategy
+// takes from the source. Prompt calls ask for each such key.
+func Choose(items []Item, strategy string, ask func(Item) (bool, error)) ([]string, error) {
+	if !slices.Contains(Strategies, strategy) {
+		return nil, fmt.Errorf("unknown strategy '%s' (supported: %s)", strategy, strings.Join(Strategies, ", "))
+	}
+	var keys []string
+	for _, item := range items {
+		take := item.Change == Add
+		if item.Change == Update || item.Change == Conflict {
+			switch strategy {
+			case Newer:
+				take = item.Change == Update
+			case Prompt:
+				var err error
+				if take, err = ask(item); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if take {
+			keys = append(keys, item.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Count returns how many items are of each change
+func Count(items []Item) map[string]int {
+	counts := map[string]int{}
+	for _, item := range items {
+		counts[item.Change]++
+	}
+	return counts
+}
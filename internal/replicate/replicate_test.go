@@ -0,0 +1,85 @@
+package replicate
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	source := map[string]Secret{
+		"NEW":     {[]byte("n"), t1},
+		"NEWER":   {[]byte("b"), t2},
+		"OLDER":   {[]byte("b"), t1},
+		"SAME":    {[]byte("s"), t1},
+		"TIED":    {[]byte("b"), t1},
+		"CHANGED": {[]byte("s"), t2},
+	}
+	target := map[string]Secret{
+		"NEWER":   {[]byte("a"), t1},
+		"OLDER":   {[]byte("a"), t2},
+		"SAME":    {[]byte("s"), t2},
+		"TIED":    {[]byte("a"), t1},
+		"CHANGED": {[]byte("s"), t1},
+		"EXTRA":   {[]byte("x"), t1},
+	}
+
+	want := map[string]string{
+		"CHANGED": Same, "NEW": Add, "NEWER": Update,
+		"OLDER": Conflict, "SAME": Same, "TIED": Conflict,
+	}
+	items := Plan(source, target)
+	if len(items) != len(want) {
+		t.Fatalf("Plan returned %d items, want %d: %+v", len(items), len(want), items)
+	}
+	for i, item := range items {
+		if i > 0 && items[i-1].Key > item.Key {
+			t.Errorf("items not sorted: %s before %s", items[i-1].Key, item.Key)
+		}
+		if item.Change != want[item.Key] {
+			t.Errorf("%s: change = %s, want %s", item.Key, item.Change, want[item.Key])
+		}
+	}
+
+	if got := Keys(items, false); !slices.Equal(got, []string{"NEW", "NEWER"}) {
+		t.Errorf("Keys = %v", got)
+	}
+	if got := Keys(items, true); !slices.Equal(got, []string{"NEW", "NEWER", "OLDER", "TIED"}) {
+		t.Errorf("Keys with force = %v", got)
+	}
+	if counts := Count(items); counts[Same] != 2 || counts[Conflict] != 2 {
+		t.Errorf("Count = %v", counts)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	items := []Item{
+		{Key: "ADDED", Change: Add},
+		{Key: "NEWER", Change: Update},
+		{Key: "OLDER", Change: Conflict},
+		{Key: "SAME", Change: Same},
+	}
+	asked := []string{}
+	ask := func(item Item) (bool, error) {
+		asked = append(asked, item.Key)
+		return item.Key == "OLDER", nil
+	}
+	for strategy, want := range map[string][]string{
+		Newer:       {"ADDED", "NEWER"},
+		PreferLocal: {"ADDED"},
+		Prompt:      {"ADDED", "OLDER"},
+	} {
+		got, err := Choose(items, strategy, ask)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("Choose(%s) = %v, %v; want %v", strategy, got, err, want)
+		}
+	}
+	if !slices.Equal(asked, []string{"NEWER", "OLDER"}) {
+		t.Errorf("prompt asked about %v", asked)
+	}
+	if _, err := Choose(items, "oldest", ask); err == nil {
+		t.Error("Choose accepted an unknown strategy")
+	}
+}
@@ -0,0 +1,173 @@
+// Package report renders an inventory of a store for security reviews.
+// Reports describe secrets by name and metadata only; they never contain
+// values.
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+)
+
+// Formats are the supported report formats
+var Formats = []string{"md", "csv", "html"}
+
+// Report is an inventory of secrets at a point in time
+type Report struct {
+	Generated time.Time
+	Secrets   []db.SecretInfo
+}
+
+// Write renders r to w in format
+func Write(w io.Writer, format string, r Report) error {
+	switch format {
+	case "md":
+		return writeMarkdown(w, r)
+	case "csv":
+		return writeCSV(w, r)
+	case "html":
+		return page.Execute(w, r)
+	}
+	return fmt.Errorf("unknown report format '%s' (supported: %s)", format, strings.Join(Formats, ", "))
+}
+
+// AgeDays is how many whole days have passed between updated and now
+func AgeDays(updated, now time.Time) int {
+	if now.Before(updated) {
+		return 0
+	}
+	return int(now.Sub(updated) / (24 * time.Hour))
+}
+
+// Secrets unchanged for FreshDays are due for review, and for StaleDays
+// are overdue for rotation
+const (
+	FreshDays = 30
+	StaleDays = 90
+)
+
+// Freshness classifies a secret by days since its last update: "fresh",
+// "aging" or "stale"
+func Freshness(days int) string {
+	switch {
+	case days < FreshDays:
+		return "fresh"
+	case days < StaleDays:
+		return "aging"
+	}
+	return "stale"
+}
+
+// date formats t as a UTC calendar date
+func date(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// optionalDate is date, or "" for a zero time such as no expiry
+func optionalDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return date(t)
+}
+
+// rfc3339 formats t for CSV, "" for a zero time
+func rfc3339(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// tags joins a secret's tags for display
+func tags(s db.SecretInfo) string {
+	return strings.Join(s.Tags, ",")
+}
+
+func writeCSV(w io.Writer, r Report) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "created", "updated", "age_days", "shared_with", "owner", "tags", "expires", "last_accessed"})
+	for _, s := range r.Secrets {
+		cw.Write([]string{
+			s.Key,
+			rfc3339(s.Created),
+			rfc3339(s.Updated),
+			strconv.Itoa(AgeDays(s.Updated, r.Generated)),
+			strconv.Itoa(s.Shared),
+			s.Owner,
+			tags(s),
+			rfc3339(s.Expires),
+			rfc3339(s.Accessed),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeMarkdown(w io.Writer, r Report) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Lockbox inventory\n\nGenerated %s. %d secrets.\n\n", r.Generated.UTC().Format(time.RFC3339), len(r.Secrets))
+	b.WriteString("| Key | Owner | Created | Updated | Age (days) | Shared with | Tags | Expires | Last access |\n")
+	b.WriteString("|-----|-------|---------|---------|------------|-------------|------|---------|-------------|\n")
+	for _, s := range r.Secrets {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d | %d | %s | %s | %s |\n",
+			escapeCell(s.Key), escapeCell(owner(s.Owner)), date(s.Created), date(s.Updated), AgeDays(s.Updated, r.Generated), s.Shared,
+			escapeCell(tags(s)), optionalDate(s.Expires), optionalDate(s.Accessed))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// owner describes an owner subject for display
+func owner(subject string) string {
+	if subject == "" {
+		return ""
+	}
+	return policy.Describe(subject)
+}
+
+// escapeCell keeps a key from breaking a Markdown table
+func escapeCell(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "`", "\\`", "*", `\*`, "_", `\_`).Replace(s)
+}
+
+// page is the HTML report, a standalone document
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date":     date,
+	"optional": optionalDate,
+	"owner":    owner,
+	"tags":     tags,
+	"age":      AgeDays,
+	"rfc3339":  rfc3339,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Lockbox inventory</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Lockbox inventory</h1>
+<p>Generated {{rfc3339 .Generated}}. {{len .Secrets}} secrets.</p>
+<table>
+<tr><th>Key</th><th>Owner</th><th>Created</th><th>Updated</th><th>Age (days)</th><th>Shared with</th><th>Tags</th><th>Expires</th><th>Last access</th></tr>
+{{- $now := .Generated}}
+{{- range .Secrets}}
+<tr><td>{{.Key}}</td><td>{{owner .Owner}}</td><td>{{date .Created}}</td><td>{{date .Updated}}</td><td class="num">{{age .Updated $now}}</td><td class="num">{{.Shared}}</td><td>{{tags .}}</td><td>{{optional .Expires}}</td><td>{{optional .Accessed}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
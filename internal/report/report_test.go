@@ -0,0 +1,63 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestWrite(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	r := Report{
+		Generated: now,
+		Secrets: []db.SecretInfo{
+			{Key: "API_KEY", Created: now.AddDate(0, 0, -90), Updated: now.AddDate(0, 0, -30), Shared: 1, Owner: "token:ci",
+				Expires: now.AddDate(0, 0, 7), Accessed: now.AddDate(0, 0, -2), Meta: db.Meta{Tags: []string{"api", "prod"}}},
+			{Key: "<b>|x", Created: now, Updated: now},
+		},
+	}
+
+	tests := map[string][]string{
+		"csv": {
+			"key,created,updated,age_days,shared_with,owner,tags,expires,last_accessed\n",
+			"API_KEY,2025-12-31T12:00:00Z,2026-03-01T12:00:00Z,30,1,token:ci,\"api,prod\",2026-04-07T12:00:00Z,2026-03-29T12:00:00Z\n",
+			"<b>|x,2026-03-31T12:00:00Z,2026-03-31T12:00:00Z,0,0,,,,\n",
+		},
+		"md": {
+			"Generated 2026-03-31T12:00:00Z. 2 secrets.",
+			"| API\\_KEY | token ci | 2025-12-31 | 2026-03-01 | 30 | 1 | api,prod | 2026-04-07 | 2026-03-29 |\n",
+			"| <b>\\|x |",
+		},
+		"html": {
+			"<td>API_KEY</td><td>token ci</td><td>2025-12-31</td><td>2026-03-01</td><td class=\"num\">30</td>",
+			"<td>api,prod</td><td>2026-04-07</td><td>2026-03-29</td></tr>",
+			"<td>&lt;b&gt;|x</td>",
+		},
+	}
+	for format, wants := range tests {
+		var buf bytes.Buffer
+		if err := Write(&buf, format, r); err != nil {
+			t.Fatalf("Write(%s) failed: %v", format, err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s report is missing %q:\n%s", format, want, buf.String())
+			}
+		}
+	}
+
+	if err := Write(&bytes.Buffer{}, "pdf", r); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	for days, want := range map[int]string{0: "fresh", 29: "fresh", 30: "aging", 89: "aging", 90: "stale", 400: "stale"} {
+		if got := Freshness(days); got != want {
+			t.Errorf("Freshness(%d) = %q, expected %q", days, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package rotation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// AWSIAM is the rotator for AWS access keys. IAM issues the new key pair,
+// so a rule using it has no generator or hook.
+const AWSIAM = "aws-iam"
+
+// AWSCLI is the aws CLI used by the aws-iam rotator
+var AWSCLI = "aws"
+
+// New IAM keys take a few seconds to be accepted everywhere, so
+// verification is retried
+var (
+	VerifyAttempts = 10
+	VerifyDelay    = 3 * time.Second
+)
+
+// awsKey is an access key pair
+type awsKey struct {
+	ID     string `json:"AccessKeyId"`
+	Secret string `json:"SecretAccessKey"`
+}
+
+// SecretKeyFor returns the conventional key of the secret access key
+// paired with the access key ID stored under key, e.g. AWS_SECRET_ACCESS_KEY
+// for AWS_ACCESS_KEY_ID
+func SecretKeyFor(key string) (string, bool) {
+	prefix, ok := strings.CutSuffix(key, "ACCESS_KEY_ID")
+	return prefix + "SECRET_ACCESS_KEY", ok
+}
+
+// rotateAWS creates a new access key with the current one, stores it,
+// verifies it works and deletes the current key. If the new key cannot be
+// verified the store is reverted and the new key deleted instead.
+func rotateAWS(store *db.Store, encKey []byte, actor batch.Actor, r Rule, now time.Time) error {
+	old := awsKey{}
+	for name, dst := range map[string]*string{r.Key: &old.ID, r.SecretKey: &old.Secret} {
+		ciphertext, err := store.GetSecret(name)
+		if err != nil {
+			return fmt.Errorf("failed to get '%s': %w", name, err)
+		}
+		value, err := crypto.Decrypt(ciphertext, encKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", name, err)
+		}
+		*dst = string(value)
+		clear(value)
+	}
+
+	args := []string{"iam", "create-access-key", "--output", "json"}
+	if r.User != "" {
+		args = append(args, "--user-name", r.User)
+	}
+	out, err := aws(old, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create a new access key: %w", err)
+	}
+	var created struct {
+		AccessKey awsKey `json:"AccessKey"`
+	}
+	if err := json.Unmarshal(out, &created); err != nil || created.AccessKey.ID == "" {
+		return fmt.Errorf("unexpected aws output creating an access key")
+	}
+	next := created.AccessKey
+
+	if err := storeAWSKey(store, encKey, actor, r, next, &now); err != nil {
+		deleteAWSKey(old, r.User, next.ID)
+		return err
+	}
+	if err := verifyAWSKey(next); err != nil {
+		if revertErr := storeAWSKey(store, encKey, actor, r, old, nil); revertErr != nil {
+			return fmt.Errorf("new access key %s does not work (%v) and the old one could not be restored: %w", next.ID, err, revertErr)
+		}
+		deleteAWSKey(old, r.User, next.ID)
+		return fmt.Errorf("new access key does not work, kept %s: %w", old.ID, err)
+	}
+	if err := deleteAWSKey(next, r.User, old.ID); err != nil {
+		return fmt.Errorf("stored new access key %s but the old key %s is still active: %w", next.ID, old.ID, err)
+	}
+	return nil
+}
+
+// storeAWSKey stores k under the rule's keys. With now set, the rotation
+// is recorded in the rule and the audit log too.
+func storeAWSKey(store *db.Store, encKey []byte, actor batch.Actor, r Rule, k awsKey, now *time.Time) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name, value := range map[string]string{r.Key: k.ID, r.SecretKey: k.Secret} {
+		if _, err := batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: name, Value: &value}); err != nil {
+			return fmt.Errorf("failed to store '%s': %w", name, err)
+		}
+	}
+	if now != nil {
+		r.LastRotated = *now
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := tx.SetConfig(rulePrefix+r.Key, data); err != nil {
+			return err
+		}
+		if err := tx.Audit(actor.Owner, "rotate", r.Key+", "+r.SecretKey); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func verifyAWSKey(k awsKey) error {
+	var err error
+	for attempt := range VerifyAttempts {
+		if attempt > 0 {
+			time.Sleep(VerifyDelay)
+		}
+		if _, err = aws(k, "sts", "get-caller-identity", "--output", "json"); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func deleteAWSKey(as awsKey, user, id string) error {
+	args := []string{"iam", "delete-access-key", "--access-key-id", id}
+	if user != "" {
+		args = append(args, "--user-name", user)
+	}
+	_, err := aws(as, args...)
+	return err
+}
+
+// aws runs the aws CLI authenticated as k, ignoring any profile or
+// session token in the environment
+func aws(k awsKey, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(AWSCLI, args...)
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); name != "AWS_PROFILE" && name != "AWS_SESSION_TOKEN" && name != "AWS_ACCESS_KEY_ID" && name != "AWS_SECRET_ACCESS_KEY" {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, "AWS_ACCESS_KEY_ID="+k.ID, "AWS_SECRET_ACCESS_KEY="+k.Secret)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("aws %s: %s", strings.Join(args[:2], " "), msg)
+		}
+		return nil, fmt.Errorf("failed to run aws: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,152 @@
+package rotation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Generator returns a new value given the argument after the colon of a
+// generator spec, "" if there is none
+type Generator func(arg string) ([]byte, error)
+
+// Generators are the built-in generators by name. A spec naming any other
+// generator runs the plugin lockbox-generator-NAME from PATH instead.
+var Generators = map[string]Generator{
+	"random": randomChars,
+	"hex": func(arg string) ([]byte, error) {
+		b, err := randomBytes(arg)
+		return []byte(hex.EncodeToString(b)), err
+	},
+	"base64": func(arg string) ([]byte, error) {
+		b, err := randomBytes(arg)
+		return []byte(base64.RawURLEncoding.EncodeToString(b)), err
+	},
+}
+
+// PluginPrefix starts the executable name of generator plugins
+const PluginPrefix = "lockbox-generator-"
+
+// defaultLength is the length of generated values when a spec gives none
+const defaultLength = 32
+
+// alphabet is what random draws from, safe in URLs, shells and env files
+const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// Generate returns a new value from a generator spec such as random:32
+func Generate(spec string) ([]byte, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	if gen, ok := Generators[name]; ok {
+		return gen(arg)
+	}
+	return plugin(name, arg)
+}
+
+// CheckSpec reports whether spec names a usable generator, without
+// generating anything
+func CheckSpec(spec string) error {
+	name, arg, _ := strings.Cut(spec, ":")
+	if _, ok := Generators[name]; ok {
+		_, err := length(arg)
+		return err
+	}
+	if _, err := exec.LookPath(PluginPrefix + name); err != nil {
+		return fmt.Errorf("unknown generator '%s': not built in and no %s%s on PATH", name, PluginPrefix, name)
+	}
+	return nil
+}
+
+func length(arg string) (int, error) {
+	if arg == "" {
+		return defaultLength, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > 4096 {
+		return 0, fmt.Errorf("invalid generator length '%s'", arg)
+	}
+	return n, nil
+}
+
+func randomBytes(arg string) ([]byte, error) {
+	n, err := length(arg)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate value: %w", err)
+	}
+	return b, nil
+}
+
+// randomChars draws from alphabet
+func randomChars(arg string) ([]byte, error) {
+	n, err := length(arg)
+	if err != nil {
+		return nil, err
+	}
+	return Random(n, alphabet)
+}
+
+// Charsets are the alphabets values can be drawn from by name
+var Charsets = map[string]string{
+	"alnum":  alphabet,
+	"hex":    "0123456789abcdef",
+	"base64": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_",
+}
+
+// Symbols is punctuation to add to alnum that needs no escaping in double
+// quotes in shells, env files or YAML
+const Symbols = "#%+,-./:=?@^_~"
+
+// Random returns n characters drawn uniformly from chars, rejecting bytes
+// that would bias the draw
+func Random(n int, chars string) ([]byte, error) {
+	limit := 256 - 256%len(chars)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate value: %w", err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(out) < n {
+				out = append(out, chars[int(b)%len(chars)])
+			}
+		}
+	}
+	return out, nil
+}
+
+// plugin runs lockbox-generator-NAME with arg, if any, and returns its
+// output without the trailing newline
+func plugin(name, arg string) ([]byte, error) {
+	binary, err := exec.LookPath(PluginPrefix + name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown generator '%s': not built in and no %s%s on PATH", name, PluginPrefix, name)
+	}
+	var args []string
+	if arg != "" {
+		args = append(args, arg)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("generator '%s' failed: %s", name, msg)
+		}
+		return nil, fmt.Errorf("generator '%s' failed: %w", name, err)
+	}
+	value := bytes.TrimSuffix(stdout.Bytes(), []byte("\n"))
+	if len(value) == 0 {
+		return nil, fmt.Errorf("generator '%s' produced no value", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,239 @@
+// Package rotation replaces secrets with generated values on a schedule.
+// A rule names the generator of new values and a hook that propagates them
+// to whatever uses the secret, and a new value is only stored once its
+// hook has succeeded.
+package rotation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// rulePrefix starts the config entries holding rules, followed by the key
+const rulePrefix = "rotation/"
+
+// HookTimeout bounds how long a hook may run before the rotation fails
+var HookTimeout = 5 * time.Minute
+
+// Rule rotates one secret
+type Rule struct {
+	Key   string        `json:"key"`
+	Every time.Duration `json:"every"`
+	// Generator is a spec such as random:32, see Generate
+	Generator string `json:"generator"`
+	// Hook is the absolute path of a program run with the new value
+	// before it is stored; empty stores it directly
+	Hook string `json:"hook,omitempty"`
+	// Rotator is AWSIAM for AWS access keys, with Key holding the access
+	// key ID; empty uses Generator and Hook
+	Rotator string `json:"rotator,omitempty"`
+	// SecretKey holds the secret access key paired with Key for AWSIAM
+	SecretKey string `json:"secret_key,omitempty"`
+	// User is the IAM user owning the key for AWSIAM; empty is the user
+	// the current key belongs to
+	User        string    `json:"user,omitempty"`
+	Created     time.Time `json:"created"`
+	LastRotated time.Time `json:"last_rotated,omitzero"`
+}
+
+// ParseEvery parses a rotation interval: a number of days such as 30d, or
+// a Go duration such as 12h
+func ParseEvery(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Minute {
+		return 0, fmt.Errorf("invalid interval '%s': expected a duration of at least a minute, such as 30d or 12h", s)
+	}
+	return d, nil
+}
+
+// Next returns when the rule is next due
+func (r Rule) Next() time.Time {
+	if r.LastRotated.IsZero() {
+		return r.Created.Add(r.Every)
+	}
+	return r.LastRotated.Add(r.Every)
+}
+
+// Save stores r, replacing any rule for the same key
+func Save(store *db.Store, r Rule) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return store.SetConfig(rulePrefix+r.Key, data)
+}
+
+// Remove deletes the rule for key
+func Remove(store *db.Store, key string) error {
+	if _, err := store.GetConfig(rulePrefix + key); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("no rotation rule for '%s'", key)
+		}
+		return err
+	}
+	return store.DeleteConfig(rulePrefix + key)
+}
+
+// List returns every rule, sorted by key
+func List(store *db.Store) ([]Rule, error) {
+	config, err := store.ListConfig()
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for name, data := range config {
+		if !strings.HasPrefix(name, rulePrefix) {
+			continue
+		}
+		var r Rule
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("corrupt rotation rule '%s': %w", strings.TrimPrefix(name, rulePrefix), err)
+		}
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Key < rules[j].Key })
+	return rules, nil
+}
+
+// Rotate generates a new value for r.Key and runs the hook with it. Only
+// if the hook succeeds is the value stored, the rule's last rotation set
+// to now and a rotate event audited, all in one transaction. Failures are
+// audited as rotate-failed.
+func Rotate(store *db.Store, encKey []byte, actor batch.Actor, r Rule, now time.Time) error {
+	if err := rotate(store, encKey, actor, r, now); err != nil {
+		store.Audit(actor.Owner, "rotate-failed", r.Key+": "+err.Error())
+		return fmt.Errorf("rotating '%s' failed: %w", r.Key, err)
+	}
+	return nil
+}
+
+func rotate(store *db.Store, encKey []byte, actor batch.Actor, r Rule, now time.Time) error {
+	if r.Rotator == AWSIAM {
+		return rotateAWS(store, encKey, actor, r, now)
+	}
+	ciphertext, err := store.GetSecret(r.Key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("the secret no longer exists")
+		}
+		return err
+	}
+	old, err := crypto.Decrypt(ciphertext, encKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the current value: %w", err)
+	}
+	defer clear(old)
+	value, err := Generate(r.Generator)
+	if err != nil {
+		return err
+	}
+	defer clear(value)
+
+	if r.Hook != "" {
+		if err := runHook(r, old, value); err != nil {
+			return err
+		}
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	s := string(value)
+	if _, err := batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: r.Key, Value: &s}); err != nil {
+		return fmt.Errorf("hook succeeded but the new value was not stored: %w", err)
+	}
+	r.LastRotated = now
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := tx.SetConfig(rulePrefix+r.Key, data); err != nil {
+		return err
+	}
+	if err := tx.Audit(actor.Owner, "rotate", r.Key); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("hook succeeded but the new value was not stored: %w", err)
+	}
+	return nil
+}
+
+// runHook runs r's hook with the key and both values in its environment
+// as LOCKBOX_ROTATE_KEY, LOCKBOX_OLD_VALUE and LOCKBOX_NEW_VALUE. Its
+// output is only shown when it fails.
+func runHook(r Rule, old, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, r.Hook)
+	cmd.Env = append(os.Environ(),
+		"LOCKBOX_ROTATE_KEY="+r.Key,
+		"LOCKBOX_OLD_VALUE="+string(old),
+		"LOCKBOX_NEW_VALUE="+string(value),
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("hook failed, secret left unchanged: %w: %s", err, msg)
+		}
+		return fmt.Errorf("hook failed, secret left unchanged: %w", err)
+	}
+	return nil
+}
+
+// RotateDue rotates every rule due at now, calling report with each
+// rotated rule and its error
+func RotateDue(store *db.Store, encKey []byte, actor batch.Actor, now time.Time, report func(Rule, error)) error {
+	rules, err := List(store)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if now.Before(r.Next()) {
+			continue
+		}
+		report(r, Rotate(store, encKey, actor, r, now))
+	}
+	return nil
+}
+
+// Schedule runs RotateDue every interval until ctx is done
+func Schedule(ctx context.Context, store *db.Store, encKey []byte, actor batch.Actor, interval time.Duration, report func(Rule, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := RotateDue(store, encKey, actor, time.Now().UTC(), report); err != nil {
+			report(Rule{}, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package rotation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+var admin = batch.Actor{Owner: "uid:1000", Admin: true}
+
+func newTestStore(t *testing.T) (*db.Store, []byte) {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("old"), key)
+	store.SetSecret("DB_PASSWORD", encrypted)
+	return store, key
+}
+
+func value(t *testing.T, store *db.Store, key []byte) string {
+	t.Helper()
+	encrypted, _ := store.GetSecret("DB_PASSWORD")
+	v, _ := crypto.Decrypt(encrypted, key)
+	return string(v)
+}
+
+func writeScript(t *testing.T, path, body string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGenerate(t *testing.T) {
+	v, err := Generate("random:40")
+	if err != nil || len(v) != 40 || strings.Trim(string(v), alphabet) != "" {
+		t.Errorf("random:40 = %q, %v", v, err)
+	}
+	if v, _ := Generate("random"); len(v) != defaultLength {
+		t.Errorf("random = %d chars, want %d", len(v), defaultLength)
+	}
+	if v, _ := Generate("hex:16"); len(v) != 32 {
+		t.Errorf("hex:16 = %q", v)
+	}
+	if _, err := Generate("random:x"); err == nil {
+		t.Error("Generate accepted an invalid length")
+	}
+	// Alphabets dividing 256 evenly reject no bytes
+	for name, chars := range Charsets {
+		if v, err := Random(64, chars); err != nil || len(v) != 64 || strings.Trim(string(v), chars) != "" {
+			t.Errorf("Random(64, %s) = %q, %v", name, v, err)
+		}
+	}
+
+	dir := t.TempDir()
+	writeScript(t, filepath.Join(dir, PluginPrefix+"words"), `echo "correct-horse-$1"`)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if v, err := Generate("words:4"); err != nil || string(v) != "correct-horse-4" {
+		t.Errorf("plugin = %q, %v", v, err)
+	}
+	if err := CheckSpec("missing:1"); err == nil {
+		t.Error("CheckSpec accepted a generator that does not exist")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	store, key := newTestStore(t)
+	dir := t.TempDir()
+	seen := filepath.Join(dir, "seen")
+	hook := writeScript(t, filepath.Join(dir, "hook"), `echo "$LOCKBOX_ROTATE_KEY $LOCKBOX_OLD_VALUE $LOCKBOX_NEW_VALUE" > `+seen+"\n")
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	r := Rule{Key: "DB_PASSWORD", Every: 24 * time.Hour, Generator: "hex:8", Hook: hook, Created: now}
+	Save(store, r)
+
+	if err := Rotate(store, key, admin, r, now); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	got := value(t, store, key)
+	if data, _ := os.ReadFile(seen); strings.TrimSpace(string(data)) != "DB_PASSWORD old "+got || len(got) != 16 {
+		t.Errorf("hook saw %q, stored %q", data, got)
+	}
+	rules, _ := List(store)
+	if len(rules) != 1 || !rules[0].LastRotated.Equal(now) {
+		t.Errorf("rules = %+v", rules)
+	}
+
+	failing := writeScript(t, filepath.Join(dir, "failing"), "echo 'connection refused' >&2\nexit 1\n")
+	r.Hook = failing
+	if err := Rotate(store, key, admin, r, now); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Rotate = %v, want the hook's error", err)
+	}
+	if value(t, store, key) != got {
+		t.Error("value stored although the hook failed")
+	}
+	events, _ := store.AuditEvents("")
+	if len(events) != 2 || events[0].Action != "rotate" || events[1].Action != "rotate-failed" {
+		t.Errorf("audit = %+v", events)
+	}
+}
+
+func TestRotateDue(t *testing.T) {
+	store, key := newTestStore(t)
+	encrypted, _ := crypto.Encrypt([]byte("k"), key)
+	store.SetSecret("API_KEY", encrypted)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	Save(store, Rule{Key: "DB_PASSWORD", Every: time.Hour, Generator: "random", Created: now.Add(-2 * time.Hour)})
+	Save(store, Rule{Key: "API_KEY", Every: 30 * 24 * time.Hour, Generator: "random", Created: now.Add(-2 * time.Hour)})
+
+	var rotated []string
+	err := RotateDue(store, key, admin, now, func(r Rule, err error) {
+		if err != nil {
+			t.Errorf("rotating %s: %v", r.Key, err)
+		}
+		rotated = append(rotated, r.Key)
+	})
+	if err != nil || len(rotated) != 1 || rotated[0] != "DB_PASSWORD" {
+		t.Errorf("RotateDue rotated %v, %v", rotated, err)
+	}
+	if value(t, store, key) == "old" {
+		t.Error("due secret not rotated")
+	}
+}
+
+func TestParseEvery(t *testing.T) {
+	if d, err := ParseEvery("30d"); err != nil || d != 30*24*time.Hour {
+		t.Errorf("30d = %v, %v", d, err)
+	}
+	for _, s := range []string{"", "0d", "10s", "x"} {
+		if _, err := ParseEvery(s); err == nil {
+			t.Errorf("ParseEvery(%q) succeeded", s)
+		}
+	}
+}
+
+// fakeAWS installs a stand-in aws CLI keeping active access keys as files
+// in a directory, holding their secrets. New keys fail verification when
+// reject is set.
+func fakeAWS(t *testing.T, reject bool) (keys string) {
+	t.Helper()
+	dir := t.TempDir()
+	keys = filepath.Join(dir, "keys")
+	os.Mkdir(keys, 0700)
+	os.WriteFile(filepath.Join(keys, "AKIAOLD"), []byte("old-secret"), 0600)
+	verify := `[ "$(cat "$AWS_ACCESS_KEY_ID" 2>/dev/null)" = "$AWS_SECRET_ACCESS_KEY" ] || { echo 'InvalidClientTokenId' >&2; exit 254; }`
+	if reject {
+		verify += "\n[ \"$AWS_ACCESS_KEY_ID\" = AKIAOLD ] || { echo 'InvalidClientTokenId' >&2; exit 254; }"
+	}
+	writeScript(t, filepath.Join(dir, "aws"), `cd `+keys+`
+[ "$(cat "$AWS_ACCESS_KEY_ID" 2>/dev/null)" = "$AWS_SECRET_ACCESS_KEY" ] || { echo 'InvalidClientTokenId' >&2; exit 254; }
+case "$2" in
+create-access-key) echo new-secret > AKIANEW; echo '{"AccessKey": {"AccessKeyId": "AKIANEW", "SecretAccessKey": "new-secret"}}' ;;
+get-caller-identity) `+verify+` ;;
+delete-access-key) rm "$4" ;;
+esac
+`)
+	AWSCLI = filepath.Join(dir, "aws")
+	VerifyDelay = 0
+	t.Cleanup(func() { AWSCLI = "aws" })
+	return keys
+}
+
+func TestRotateAWS(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		store, key := newTestStore(t)
+		for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "AKIAOLD", "AWS_SECRET_ACCESS_KEY": "old-secret"} {
+			encrypted, _ := crypto.Encrypt([]byte(v), key)
+			store.SetSecret(k, encrypted)
+		}
+		keys := fakeAWS(t, reject)
+		secretKey, _ := SecretKeyFor("AWS_ACCESS_KEY_ID")
+		r := Rule{Key: "AWS_ACCESS_KEY_ID", Every: 90 * 24 * time.Hour, Rotator: AWSIAM, SecretKey: secretKey}
+
+		err := Rotate(store, key, admin, r, time.Now())
+		get := func(name string) string {
+			encrypted, _ := store.GetSecret(name)
+			v, _ := crypto.Decrypt(encrypted, key)
+			return string(v)
+		}
+		active, _ := os.ReadDir(keys)
+		if reject {
+			if err == nil || get("AWS_ACCESS_KEY_ID") != "AKIAOLD" || get(secretKey) != "old-secret" {
+				t.Errorf("unverified key: Rotate = %v, stored %s", err, get("AWS_ACCESS_KEY_ID"))
+			}
+			if len(active) != 1 || active[0].Name() != "AKIAOLD" {
+				t.Errorf("unverified key: active keys %v, want only AKIAOLD", active)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+		if get("AWS_ACCESS_KEY_ID") != "AKIANEW" || get(secretKey) != "new-secret" {
+			t.Errorf("stored %s/%s", get("AWS_ACCESS_KEY_ID"), get(secretKey))
+		}
+		if len(active) != 1 || active[0].Name() != "AKIANEW" {
+			t.Errorf("active keys %v, want only AKIANEW", active)
+		}
+	}
+}
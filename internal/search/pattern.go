@@ -0,0 +1,121 @@
+package search
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/selector"
+)
+
+// Pattern is what a search looks for: text, a glob or a regular expression
+type Pattern struct {
+	re *regexp.Regexp
+	// literals all appear, ignoring case, in anything re matches, so the
+	// index can rule values out
+	literals []string
+}
+
+// Compile parses pattern. Plain text matches wherever it appears and globs
+// such as 'DB_*' match whole keys or values, both ignoring case. With
+// regex, pattern is a regular expression used as given, matching anywhere
+// unless anchored.
+func Compile(pattern string, regex bool) (*Pattern, error) {
+	switch {
+	case regex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s': %w", pattern, err)
+		}
+		p := &Pattern{re: re}
+		// A case-insensitive prefix is still a required substring, as
+		// the index ignores case anyway
+		if prefix, _ := re.LiteralPrefix(); prefix != "" {
+			p.literals = []string{prefix}
+		}
+		return p, nil
+	case selector.IsPattern(pattern):
+		expr, literals, err := globExpr(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &Pattern{re: regexp.MustCompile(expr), literals: literals}, nil
+	default:
+		return &Pattern{re: regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern)), literals: []string{pattern}}, nil
+	}
+}
+
+// Match reports whether b matches p
+func (p *Pattern) Match(b []byte) bool {
+	return p.re.Match(b)
+}
+
+// MatchString reports whether s matches p
+func (p *Pattern) MatchString(s string) bool {
+	return p.re.MatchString(s)
+}
+
+// globExpr translates the glob pattern into an anchored, case-insensitive
+// regular expression, returning the literal runs between its wildcards.
+// Unlike selector patterns, * also matches /.
+func globExpr(pattern string) (string, []string, error) {
+	var expr, literal strings.Builder
+	var literals []string
+	flush := func() {
+		if literal.Len() > 0 {
+			literals = append(literals, literal.String())
+			literal.Reset()
+		}
+	}
+	expr.WriteString("(?is)^")
+	escaped := false
+	next := 0 // the index after the last character class
+	for i, r := range pattern {
+		if i < next {
+			continue
+		}
+		if escaped {
+			escaped = false
+			literal.WriteRune(r)
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			continue
+		}
+		switch r {
+		case '*':
+			flush()
+			expr.WriteString(".*")
+		case '?':
+			flush()
+			expr.WriteString(".")
+		case '[':
+			flush()
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", nil, fmt.Errorf("invalid pattern '%s': unterminated [", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			if _, err := syntax.Parse("["+class+"]", syntax.Perl); class == "" || err != nil {
+				return "", nil, fmt.Errorf("invalid pattern '%s': bad character class", pattern)
+			}
+			expr.WriteString("[" + class + "]")
+			next = i + end + 2
+		case '\\':
+			if i+1 < len(pattern) {
+				escaped = true
+				continue
+			}
+			literal.WriteRune(r)
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		default:
+			literal.WriteRune(r)
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	flush()
+	expr.WriteString("$")
+	return expr.String(), literals, nil
+}
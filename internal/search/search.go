@@ -0,0 +1,282 @@
+// Package search finds secrets whose values contain a term, and keeps an
+// optional index that lets it decrypt only the secrets that may match.
+//
+// Each indexed value gets a fixed-size Bloom filter of its lowercased
+// byte trigrams, each hashed with HMAC-SHA256 under a subkey of the store
+// key. A value is only decrypted when every trigram of the term may be in
+// its filter. Filters cannot be read or tested without the store key, but
+// a reader of the database still learns from them how many distinct
+// trigrams a value has, roughly its length, and which values share
+// trigrams, such as two secrets with a common prefix.
+package search
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// configKey records in the store that the index is maintained
+const configKey = "search_index"
+
+// indexContext separates the index subkey from every other use of the
+// store key
+const indexContext = "lockbox/search-index/v1"
+
+// Filter parameters: 4096 bits and 4 positions per trigram keep false
+// positives rare for values up to a few hundred bytes. Longer values fill
+// their filter and are decrypted for most terms.
+const (
+	gramSize   = 3
+	filterBits = 4096
+	positions  = 4
+)
+
+// Index builds and tests search index entries
+type Index struct {
+	storeKey []byte
+	subkey   []byte
+}
+
+// New returns the index for values encrypted with storeKey
+func New(storeKey []byte) *Index {
+	mac := hmac.New(sha256.New, storeKey)
+	mac.Write([]byte(indexContext))
+	return &Index{storeKey: storeKey, subkey: mac.Sum(nil)}
+}
+
+// Enable records in store that the index is maintained and builds it for
+// every vault, returning how many values were indexed
+func Enable(store *db.Store, storeKey []byte) (int, error) {
+	if err := store.SetConfig(configKey, []byte("on")); err != nil {
+		return 0, err
+	}
+	return Rebuild(store, storeKey)
+}
+
+// Disable stops maintaining the index and deletes it
+func Disable(store *db.Store) error {
+	if err := store.DeleteConfig(configKey); err != nil {
+		return err
+	}
+	return store.ClearSearchIndex()
+}
+
+// Load returns the index for store, or nil if it is off
+func Load(store *db.Store, storeKey []byte) (*Index, error) {
+	if _, err := store.GetConfig(configKey); err == db.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return New(storeKey), nil
+}
+
+// Rebuild indexes every value in every vault of store whose entry is
+// missing or out of date, returning how many it indexed
+func Rebuild(store *db.Store, storeKey []byte) (int, error) {
+	vaults, err := vaults(store)
+	if err != nil {
+		return 0, err
+	}
+
+	x, n := New(storeKey), 0
+	for _, scoped := range vaults {
+		err := scoped.EachSearchEntry(func(e db.SearchEntry) error {
+			if e.Entry != nil || e.Digest == "" {
+				return nil
+			}
+			value, err := decrypt(scoped, storeKey, e.Key)
+			if err == db.ErrNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			err = x.refresh(scoped, e.Key, value)
+			clear(value)
+			if err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Coverage returns how many values in every vault of store have an
+// up-to-date index entry, and how many values there are
+func Coverage(store *db.Store) (indexed, total int, err error) {
+	vaults, err := vaults(store)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, scoped := range vaults {
+		err := scoped.EachSearchEntry(func(e db.SearchEntry) error {
+			if e.Entry != nil {
+				indexed++
+			}
+			total++
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return indexed, total, nil
+}
+
+// vaults returns store scoped to each of its vaults, the default first
+func vaults(store *db.Store) ([]*db.Store, error) {
+	named, err := store.ListVaults()
+	if err != nil {
+		return nil, err
+	}
+	scoped := []*db.Store{store.InVault("")}
+	for _, v := range named {
+		scoped = append(scoped, store.InVault(v.Name))
+	}
+	return scoped, nil
+}
+
+// refresh stores the index entry of value, just read from key. It is
+// stamped with the value's own digest, so an entry for a value that has
+// since been overwritten is never taken for the current one.
+func (x *Index) refresh(store *db.Store, key string, value []byte) error {
+	digest, err := crypto.Digest(value, x.storeKey)
+	if err != nil {
+		return err
+	}
+	return store.SetSearchEntry(key, digest, x.filter(value))
+}
+
+// Entry returns the index entry of a value encrypted with the store key
+func (x *Index) Entry(encryptedValue []byte) ([]byte, error) {
+	value, err := crypto.Decrypt(encryptedValue, x.storeKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(value)
+	return x.filter(value), nil
+}
+
+// filter returns the Bloom filter of value's trigrams
+func (x *Index) filter(value []byte) []byte {
+	f := make([]byte, filterBits/8)
+	lower := bytes.ToLower(value)
+	for i := 0; i+gramSize <= len(lower); i++ {
+		for _, p := range x.positions(lower[i : i+gramSize]) {
+			f[p/8] |= 1 << (p % 8)
+		}
+	}
+	clear(lower)
+	return f
+}
+
+// mayContain reports whether the value with index entry f may contain
+// every literal of p, ignoring case. Literals shorter than a trigram rule
+// nothing out.
+func (x *Index) mayContain(f []byte, p *Pattern) bool {
+	if len(f) != filterBits/8 {
+		return true
+	}
+	for _, literal := range p.literals {
+		lower := []byte(strings.ToLower(literal))
+		for i := 0; i+gramSize <= len(lower); i++ {
+			for _, pos := range x.positions(lower[i : i+gramSize]) {
+				if f[pos/8]&(1<<(pos%8)) == 0 {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// positions returns the filter bits of gram
+func (x *Index) positions(gram []byte) [positions]uint16 {
+	mac := hmac.New(sha256.New, x.subkey)
+	mac.Write(gram)
+	sum := mac.Sum(nil)
+	var ps [positions]uint16
+	for i := range ps {
+		ps[i] = binary.BigEndian.Uint16(sum[2*i:]) % filterBits
+	}
+	return ps
+}
+
+// Stats describes the work of a search
+type Stats struct {
+	// Secrets is how many secrets were searched
+	Secrets int
+	// Decrypted is how many of them had to be decrypted
+	Decrypted int
+}
+
+// Where a search found a match
+const (
+	InKey   = "key"
+	InValue = "value"
+)
+
+// Search calls fn with each secret in store's vault whose key matches p,
+// with In set to InKey, in key order. With values, secrets whose value
+// matches are passed too, with InValue. Secrets are read a page at a time
+// and each value is decrypted, checked and wiped in turn, so memory stays
+// flat however large the store is. With x, values whose index entry rules
+// p out are not decrypted, and missing or out-of-date entries are rebuilt
+// from the values decrypted along the way; a nil x decrypts every value.
+// An error from fn stops the search.
+func Search(store *db.Store, storeKey []byte, x *Index, p *Pattern, values bool, fn func(key, in string) error) (Stats, error) {
+	var stats Stats
+	err := store.EachSearchEntry(func(e db.SearchEntry) error {
+		stats.Secrets++
+		if p.MatchString(e.Key) {
+			return fn(e.Key, InKey)
+		}
+		if !values || x != nil && e.Entry != nil && !x.mayContain(e.Entry, p) {
+			return nil
+		}
+		value, err := decrypt(store, storeKey, e.Key)
+		if err == db.ErrNotFound {
+			// Deleted since the entry was read
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer clear(value)
+		stats.Decrypted++
+
+		if x != nil && e.Entry == nil && e.Digest != "" {
+			// A read-only store still searches, just without the entry
+			x.refresh(store, e.Key, value)
+		}
+		if p.Match(value) {
+			return fn(e.Key, InValue)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// decrypt returns the plaintext of key
+func decrypt(store *db.Store, storeKey []byte, key string) ([]byte, error) {
+	encrypted, err := store.GetSecret(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := crypto.Decrypt(encrypted, storeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt '%s': %w", key, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,109 @@
+// Package selector expands the key arguments of commands, where each
+// argument is a key name or a glob pattern such as 'DB_*'.
+package selector
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// IsPattern reports whether arg contains glob metacharacters
+func IsPattern(arg string) bool {
+	return strings.ContainsAny(arg, "*?[")
+}
+
+// Match returns the keys arg selects, in sorted order. A key equal to arg
+// always matches, so keys containing metacharacters can still be named.
+func Match(keys []string, arg string) ([]string, error) {
+	if _, err := path.Match(arg, ""); err != nil {
+		// A malformed pattern may still be a key's name
+		if slices.Contains(keys, arg) {
+			return []string{arg}, nil
+		}
+		return nil, fmt.Errorf("invalid pattern '%s': %w", arg, err)
+	}
+
+	var matched []string
+	for _, key := range keys {
+		if ok, _ := path.Match(arg, key); ok || key == arg {
+			matched = append(matched, key)
+		}
+	}
+	slices.Sort(matched)
+	return matched, nil
+}
+
+// Resolve expands args against keys. Matches are returned in argument
+// order, the matches of each pattern sorted, without duplicates. Naming a
+// missing key, or a pattern that matches nothing, is an error.
+func Resolve(keys []string, args []string) ([]string, error) {
+	var resolved []string
+	for _, arg := range args {
+		matched, err := Match(keys, arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) == 0 {
+			if IsPattern(arg) {
+				return nil, fmt.Errorf("no secrets match '%s'", arg)
+			}
+			return nil, fmt.Errorf("secret '%s' not found", arg)
+		}
+		for _, key := range matched {
+			if !slices.Contains(resolved, key) {
+				resolved = append(resolved, key)
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// Filter narrows the keys a command sees, such as the secrets 'lockbox run'
+// passes to its child
+type Filter struct {
+	// Only keeps just the keys these keys and patterns select, each of
+	// which must select something, as for Resolve
+	Only []string
+	// Prefixes keeps just the keys starting with one of them
+	Prefixes []string
+	// Exclude drops the keys these keys and patterns select
+	Exclude []string
+}
+
+// IsZero reports whether f keeps every key
+func (f Filter) IsZero() bool {
+	return len(f.Only) == 0 && len(f.Prefixes) == 0 && len(f.Exclude) == 0
+}
+
+// Apply returns the keys f keeps, in the order of keys or, with Only, of
+// its arguments
+func (f Filter) Apply(keys []string) ([]string, error) {
+	if len(f.Only) > 0 {
+		var err error
+		if keys, err = Resolve(keys, f.Only); err != nil {
+			return nil, err
+		}
+	}
+	var excluded []string
+	for _, arg := range f.Exclude {
+		matched, err := Match(keys, arg)
+		if err != nil {
+			return nil, err
+		}
+		excluded = append(excluded, matched...)
+	}
+
+	kept := []string{}
+	for _, key := range keys {
+		if len(f.Prefixes) > 0 && !slices.ContainsFunc(f.Prefixes, func(p string) bool { return strings.HasPrefix(key, p) }) {
+			continue
+		}
+		if slices.Contains(excluded, key) {
+			continue
+		}
+		kept = append(kept, key)
+	}
+	return kept, nil
+}
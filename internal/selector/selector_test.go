@@ -0,0 +1,70 @@
+package selector
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	keys := []string{"TMP_B", "DB_USER", "TMP_A", "API_KEY", "DB_PASSWORD", "ODD*", "BAD["}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"API_KEY"}, []string{"API_KEY"}},
+		{[]string{"DB_*"}, []string{"DB_PASSWORD", "DB_USER"}},
+		{[]string{"TMP_?", "API_KEY"}, []string{"TMP_A", "TMP_B", "API_KEY"}},
+		{[]string{"DB_USER", "DB_*"}, []string{"DB_USER", "DB_PASSWORD"}},
+		{[]string{"ODD*"}, []string{"ODD*"}},
+		{[]string{"BAD["}, []string{"BAD["}},
+	}
+	for _, tt := range tests {
+		got, err := Resolve(keys, tt.args)
+		if err != nil {
+			t.Errorf("Resolve(%v) failed: %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Resolve(%v) = %v, expected %v", tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"MISSING"}, {"NONE_*"}, {"[bad"}} {
+		if _, err := Resolve(keys, args); err == nil {
+			t.Errorf("Resolve(%v) succeeded, expected an error", args)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	keys := []string{"API_KEY", "DB_PASSWORD", "DB_USER", "TMP_A", "TMP_B"}
+
+	tests := []struct {
+		filter Filter
+		want   []string
+	}{
+		{Filter{}, keys},
+		{Filter{Only: []string{"TMP_A", "API_KEY"}}, []string{"TMP_A", "API_KEY"}},
+		{Filter{Prefixes: []string{"DB_"}}, []string{"DB_PASSWORD", "DB_USER"}},
+		{Filter{Prefixes: []string{"DB_", "TMP_"}, Exclude: []string{"DB_PASSWORD"}}, []string{"DB_USER", "TMP_A", "TMP_B"}},
+		{Filter{Exclude: []string{"TMP_*", "MISSING"}}, []string{"API_KEY", "DB_PASSWORD", "DB_USER"}},
+		{Filter{Only: []string{"DB_*"}, Prefixes: []string{"TMP_"}}, []string{}},
+	}
+	for _, tt := range tests {
+		got, err := tt.filter.Apply(keys)
+		if err != nil {
+			t.Errorf("Apply(%+v) failed: %v", tt.filter, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Apply(%+v) = %v, expected %v", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, f := range []Filter{{Only: []string{"MISSING"}}, {Exclude: []string{"[bad"}}} {
+		if _, err := f.Apply(keys); err == nil {
+			t.Errorf("Apply(%+v) succeeded, expected an error", f)
+		}
+	}
+}
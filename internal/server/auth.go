@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/oidc"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/rbac"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+const (
+	// DefaultTokenTTL is the lifetime of tokens issued on OIDC login
+	DefaultTokenTTL = time.Hour
+	// DefaultRefreshTTL is how long the refresh token of an OIDC login
+	// can renew it
+	DefaultRefreshTTL = 24 * time.Hour
+)
+
+// OIDCVerifier checks ID tokens exchanged at /v1/auth/oidc/login
+type OIDCVerifier interface {
+	// Config returns the provider and client ID that logins use
+	Config() oidc.Config
+	// Verify validates a raw ID token and returns its claims
+	Verify(ctx context.Context, rawIDToken string) (oidc.Claims, error)
+}
+
+// tokenContextKey is the context key for the authenticated token
+type tokenContextKey struct{}
+
+// tokenFromContext returns the token a request authenticated with
+func tokenFromContext(ctx context.Context) (db.Token, bool) {
+	t, ok := ctx.Value(tokenContextKey{}).(db.Token)
+	return t, ok
+}
+
+// authenticate resolves a bearer token sent with the request, rejecting
+// the request with 401 when the token is unknown, expired or revoked.
+// Requests without a token pass through unchanged from unix socket peers;
+// over TCP they may only read, and only from and to localhost.
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := token.FromRequest(r)
+		if raw == "" {
+			if _, isPeer := PeerCredFromContext(r.Context()); !isPeer {
+				if !loopbackHost(r.Host) || !loopbackHost(r.RemoteAddr) {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprintf(w, "Error: requests without a token must come from and be sent to localhost")
+					return
+				}
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					s.auditAuthFailure(r, "write without a token")
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprintf(w, "Error: writes over TCP require a token; create one with 'lockbox token create'")
+					return
+				}
+			}
+			next(w, r)
+			return
+		}
+
+		t, err := s.store.LookupToken(token.Hash(raw))
+		if err != nil {
+			if err == db.ErrNotFound {
+				s.auditAuthFailure(r, "invalid, expired or revoked token")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "Error: invalid, expired or revoked token")
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error: %v", err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t)))
+	}
+}
+
+// handleOIDCConfig tells 'lockbox login' which identity provider to use
+func (s *Server) handleOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	if s.opts.OIDC == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error: OIDC login is not enabled on this server")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.opts.OIDC.Config())
+}
+
+// loginRequest is the body of POST /v1/auth/oidc/login
+type loginRequest struct {
+	IDToken string `json:"id_token"`
+}
+
+// LoginResponse is a short-lived token issued on login or refresh
+type LoginResponse struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// handleOIDCLogin exchanges a verified ID token for a short-lived lockbox
+// token acting as the token's claims. Logins whose claims no policy
+// mentions are refused.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.opts.OIDC == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error: OIDC login is not enabled on this server")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IDToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: expected a JSON body with id_token")
+		return
+	}
+
+	claims, err := s.opts.OIDC.Verify(r.Context(), req.IDToken)
+	if err != nil {
+		s.auditAuthFailure(r, "rejected OIDC ID token")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	subjects := policy.ClaimSubjects(claims)
+	e, err := rbac.Load(s.store)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	if !e.Bound(subjects) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Error: no policy grants access to '%s'", claims.Subject())
+		return
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	s.store.DeleteExpiredTokens(time.Now())
+	now := time.Now().Truncate(time.Second)
+	t := db.Token{
+		Name:             "oidc-" + claims.Subject() + "-" + hex.EncodeToString(suffix),
+		ExpiresAt:        now.Add(s.opts.TokenTTL),
+		Subjects:         subjects,
+		TTL:              s.opts.TokenTTL,
+		RefreshExpiresAt: now.Add(s.opts.RefreshTTL),
+	}
+	raw, refresh, err := token.Issue(s.store, t, true)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: raw, ExpiresAt: t.ExpiresAt, RefreshToken: refresh})
+}
+
+// refreshRequest is the body of POST /v1/auth/token/refresh
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// handleRefresh redeems a refresh token for a new token and a new refresh
+// token. The old pair stops working.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: expected a JSON body with refresh_token")
+		return
+	}
+
+	raw, err := token.Generate()
+	var refresh string
+	if err == nil {
+		refresh, err = token.Generate()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	t, err := s.store.RefreshToken(token.Hash(req.RefreshToken), token.Hash(raw), token.Hash(refresh), time.Now().Truncate(time.Second))
+	if err != nil {
+		if err == db.ErrNotFound {
+			s.auditAuthFailure(r, "invalid, expired or revoked refresh token")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "Error: invalid, expired or revoked refresh token")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: raw, ExpiresAt: t.ExpiresAt, RefreshToken: refresh})
+}
+
+// pairRequest is the body of POST /v1/auth/pair
+type pairRequest struct {
+	Code string `json:"code"`
+}
+
+// PairResponse is the token a device receives for its pairing code
+type PairResponse struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+	// Fingerprint identifies the server's store, as shown by 'lockbox
+	// pair', for the device to display so the two can be compared
+	Fingerprint string `json:"fingerprint"`
+}
+
+// handlePair redeems a one-time pairing code shown by 'lockbox pair' for
+// an API token carrying the scopes the pairing was made with
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req pairRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: expected a JSON body with code")
+		return
+	}
+
+	raw, err := token.Generate()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	fingerprint, err := crypto.Fingerprint(s.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	p, err := s.store.RedeemPairing(token.Hash(req.Code), token.Hash(raw), time.Now())
+	if err != nil {
+		if err == db.ErrNotFound {
+			s.auditAuthFailure(r, "invalid or expired pairing code")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "Error: invalid or expired pairing code")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	s.store.Audit(identity(r), "device-paired", p.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PairResponse{Name: p.Name, Token: raw, Scopes: p.Scopes, Fingerprint: fingerprint})
+}
+
+// auditAuthFailure records a rejected credential in the audit log. The
+// credential itself is never recorded.
+func (s *Server) auditAuthFailure(r *http.Request, reason string) {
+	detail := reason + " on " + r.URL.Path
+	if r.RemoteAddr != "" && r.RemoteAddr != "@" {
+		detail += " from " + r.RemoteAddr
+	}
+	s.store.Audit("anonymous", "auth-failed", detail)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/oidc"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+// stubVerifier accepts ID tokens of the form "valid:<groups>"
+type stubVerifier struct{}
+
+func (stubVerifier) Config() oidc.Config {
+	return oidc.Config{Issuer: "https://idp.example", ClientID: "lockbox"}
+}
+
+func (stubVerifier) Verify(ctx context.Context, raw string) (oidc.Claims, error) {
+	groups, ok := strings.CutPrefix(raw, "valid:")
+	if !ok {
+		return nil, fmt.Errorf("invalid ID token")
+	}
+	return oidc.Claims{"sub": "alice", "groups": []any{groups}}, nil
+}
+
+// login posts an ID token and returns the status and issued token
+func login(t *testing.T, url, idToken string) (int, LoginResponse) {
+	t.Helper()
+	resp, err := http.Post(url+"/v1/auth/oidc/login", "application/json", strings.NewReader(`{"id_token":"`+idToken+`"}`))
+	if err != nil {
+		t.Fatalf("Login request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var lr LoginResponse
+	json.NewDecoder(resp.Body).Decode(&lr)
+	return resp.StatusCode, lr
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	for _, k := range []string{"DEV_KEY", "PROD_KEY"} {
+		encrypted, _ := crypto.Encrypt([]byte(k), key)
+		store.SetSecret(k, encrypted)
+	}
+	store.AddPolicy("claim:groups=dev", "DEV_*", "reader")
+
+	ts := httptest.NewServer(New(store, key, Options{OIDC: stubVerifier{}, TokenTTL: time.Minute}))
+	defer ts.Close()
+
+	resp, _ := http.Get(ts.URL + "/v1/auth/oidc/config")
+	var config oidc.Config
+	json.NewDecoder(resp.Body).Decode(&config)
+	resp.Body.Close()
+	if config.ClientID != "lockbox" {
+		t.Errorf("Unexpected OIDC config: %+v", config)
+	}
+
+	if status, _ := login(t, ts.URL, "forged"); status != http.StatusUnauthorized {
+		t.Errorf("Login with an invalid ID token returned %d, expected 401", status)
+	}
+	if status, _ := login(t, ts.URL, "valid:ops"); status != http.StatusForbidden {
+		t.Errorf("Login with unmapped claims returned %d, expected 403", status)
+	}
+
+	status, lr := login(t, ts.URL, "valid:dev")
+	if status != http.StatusOK || lr.Token == "" || lr.RefreshToken == "" {
+		t.Fatalf("Login returned %d, %+v", status, lr)
+	}
+	if until := time.Until(lr.ExpiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("Token expires in %v, expected within the TTL", until)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/secrets", nil)
+	req.Header.Set("Authorization", "Bearer "+lr.Token)
+	resp, _ = http.DefaultClient.Do(req)
+	var keys []string
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	if len(keys) != 1 || keys[0] != "DEV_KEY" {
+		t.Errorf("Expected the token to see only DEV_KEY, got %v", keys)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/secrets/API_KEY", nil)
+	req.Header.Set("Authorization", "Bearer lbx_bogus")
+	resp, _ = http.DefaultClient.Do(req)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unknown bearer token returned %d, expected 401", resp.StatusCode)
+	}
+}
+
+func TestOIDCLoginDisabled(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/v1/auth/oidc/config")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("OIDC config without --oidc-issuer returned %d, expected 404", resp.StatusCode)
+	}
+}
+
+// getSecrets lists keys with a bearer token, returning the status
+func getSecrets(t *testing.T, url, tok string) (int, []string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/secrets", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /secrets failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var keys []string
+	json.NewDecoder(resp.Body).Decode(&keys)
+	return resp.StatusCode, keys
+}
+
+func TestTokenRefreshAndRevoke(t *testing.T) {
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	for _, k := range []string{"APP_A", "OTHER"} {
+		encrypted, _ := crypto.Encrypt([]byte(k), key)
+		store.SetSecret(k, encrypted)
+	}
+
+	ts := httptest.NewServer(New(store, key, Options{}))
+	defer ts.Close()
+
+	// An expired token whose scopes grant APP_*
+	expired := db.Token{Name: "deploy", TTL: time.Hour, ExpiresAt: time.Now().Add(-time.Second), Scopes: []string{"read:APP_*"}}
+	raw, refresh, err := token.Issue(store, expired, true)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if status, _ := getSecrets(t, ts.URL, raw); status != http.StatusUnauthorized {
+		t.Errorf("Expired token returned %d, expected 401", status)
+	}
+
+	resp, _ := http.Post(ts.URL+"/v1/auth/token/refresh", "application/json", strings.NewReader(`{"refresh_token":"`+refresh+`"}`))
+	var lr LoginResponse
+	json.NewDecoder(resp.Body).Decode(&lr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || lr.RefreshToken == "" || lr.RefreshToken == refresh {
+		t.Fatalf("Refresh returned %d, %+v", resp.StatusCode, lr)
+	}
+
+	status, keys := getSecrets(t, ts.URL, lr.Token)
+	if status != http.StatusOK || len(keys) != 1 || keys[0] != "APP_A" {
+		t.Errorf("Refreshed token returned %d, %v; expected only APP_A", status, keys)
+	}
+
+	resp, _ = http.Post(ts.URL+"/v1/auth/token/refresh", "application/json", strings.NewReader(`{"refresh_token":"`+refresh+`"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Reused refresh token returned %d, expected 401", resp.StatusCode)
+	}
+
+	store.RevokeToken("deploy")
+	if status, _ := getSecrets(t, ts.URL, lr.Token); status != http.StatusUnauthorized {
+		t.Errorf("Revoked token returned %d, expected 401", status)
+	}
+
+	// Every rejected credential is audited, without the credential
+	events, _ := store.AuditEvents("auth-failed")
+	if len(events) != 3 || !strings.HasPrefix(events[1].Detail, "invalid, expired or revoked refresh token on /v1/auth/token/refresh from 127.0.0.1:") {
+		t.Errorf("audited %+v", events)
+	}
+	for _, e := range events {
+		if strings.Contains(e.Detail, refresh) || strings.Contains(e.Detail, lr.Token) {
+			t.Errorf("audit event %q holds a credential", e.Detail)
+		}
+	}
+}
+
+func TestPair(t *testing.T) {
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	for _, k := range []string{"MOBILE_PIN", "OTHER"} {
+		encrypted, _ := crypto.Encrypt([]byte(k), key)
+		store.SetSecret(k, encrypted)
+	}
+
+	ts := httptest.NewServer(New(store, key, Options{}))
+	defer ts.Close()
+
+	code, _ := token.Generate()
+	store.CreatePairing(db.Pairing{Name: "phone", Scopes: []string{"read:MOBILE_*"}, ExpiresAt: time.Now().Add(time.Minute)}, token.Hash(code))
+
+	pair := func() (int, PairResponse) {
+		resp, err := http.Post(ts.URL+"/v1/auth/pair", "application/json", strings.NewReader(`{"code":"`+code+`"}`))
+		if err != nil {
+			t.Fatalf("Pair request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var pr PairResponse
+		json.NewDecoder(resp.Body).Decode(&pr)
+		return resp.StatusCode, pr
+	}
+
+	status, pr := pair()
+	if status != http.StatusOK || pr.Name != "phone" || pr.Token == "" {
+		t.Fatalf("Pair returned %d, %+v", status, pr)
+	}
+	if want, _ := crypto.Fingerprint(key); pr.Fingerprint != want {
+		t.Errorf("Pair returned fingerprint %q, want the store's %q", pr.Fingerprint, want)
+	}
+	status, keys := getSecrets(t, ts.URL, pr.Token)
+	if status != http.StatusOK || len(keys) != 1 || keys[0] != "MOBILE_PIN" {
+		t.Errorf("Paired token returned %d, %v; expected only MOBILE_PIN", status, keys)
+	}
+
+	if status, _ := pair(); status != http.StatusUnauthorized {
+		t.Errorf("Reused pairing code returned %d, expected 401", status)
+	}
+	if events, _ := store.AuditEvents("device-paired"); len(events) != 1 || events[0].Detail != "phone" {
+		t.Errorf("Expected one device-paired audit event, got %+v", events)
+	}
+}
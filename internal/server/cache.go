@@ -0,0 +1,178 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+const (
+	// DefaultCacheSize is how many decrypted values serve keeps
+	DefaultCacheSize = 256
+	// DefaultCacheTTL is how long a decrypted value is served from memory
+	DefaultCacheTTL = 30 * time.Second
+)
+
+// Cache is an LRU of decrypted secret values. Entries expire after a TTL,
+// and the whole cache is dropped when the store revision changes, so
+// writes from any lockbox process are seen within watchInterval.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+	rev     uint64
+	checked time.Time
+}
+
+// cacheEntry is a cached plaintext
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewCache returns a cache holding up to size values for ttl each
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get returns a copy of the cached value of key
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return append([]byte(nil), e.value...), true
+}
+
+// Put caches a copy of value for key, evicting the least recently used
+// value when full
+func (c *Cache) Put(key string, value []byte) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	e := &cacheEntry{key: key, value: append([]byte(nil), value...), expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate drops the cached value of key
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge drops every cached value
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+// Len returns the number of cached values
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// sync purges the cache when the store revision has changed since the
+// last check. The revision is read at most once per watchInterval.
+func (c *Cache) sync(store *db.Store) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < watchInterval {
+		return nil
+	}
+	rev, err := store.Revision()
+	if err != nil {
+		return err
+	}
+	if rev != c.rev {
+		c.purge()
+		c.rev = rev
+	}
+	c.checked = time.Now()
+	return nil
+}
+
+// purge drops every entry; c.mu must be held
+func (c *Cache) purge() {
+	for c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops el and wipes its value; c.mu must be held
+func (c *Cache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	for i := range e.value {
+		e.value[i] = 0
+	}
+}
+
+// value returns the plaintext of key, decrypting it only when it is not
+// cached. db.ErrNotFound is returned for unknown and expired keys.
+func (s *Server) value(key string) ([]byte, error) {
+	// Expiring does not change the revision, so check before the cache
+	expires, err := s.store.SecretExpiry(key)
+	if err != nil {
+		return nil, err
+	}
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		return nil, db.ErrNotFound
+	}
+
+	c := s.opts.Cache
+	if c != nil {
+		if err := c.sync(s.store); err != nil {
+			return nil, err
+		}
+		if value, ok := c.Get(s.store.Qualify(key)); ok {
+			return value, nil
+		}
+	}
+
+	encrypted, err := s.store.GetSecret(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := crypto.Decrypt(encrypted, s.key)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.Put(s.store.Qualify(key), value)
+	}
+	return value, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(2, time.Hour)
+	c.Put("A", []byte("a"))
+	c.Put("B", []byte("b"))
+
+	// Reading A makes B the least recently used
+	if v, ok := c.Get("A"); !ok || string(v) != "a" {
+		t.Errorf("Get A = %q, %v", v, ok)
+	}
+	c.Put("C", []byte("c"))
+	if _, ok := c.Get("B"); ok {
+		t.Errorf("B was not evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+
+	// Callers get copies
+	v, _ := c.Get("A")
+	v[0] = 'x'
+	if v, _ := c.Get("A"); string(v) != "a" {
+		t.Errorf("Cached value was modified through Get: %q", v)
+	}
+
+	c.Invalidate("A")
+	if _, ok := c.Get("A"); ok {
+		t.Errorf("A was not invalidated")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("Purge left %d entries", c.Len())
+	}
+
+	expiring := NewCache(2, 10*time.Millisecond)
+	expiring.Put("A", []byte("a"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := expiring.Get("A"); ok {
+		t.Errorf("A outlived its TTL")
+	}
+
+	disabled := NewCache(0, time.Hour)
+	disabled.Put("A", []byte("a"))
+	if _, ok := disabled.Get("A"); ok {
+		t.Errorf("Zero-size cache stored a value")
+	}
+}
+
+func TestCacheSeesWrites(t *testing.T) {
+	watchInterval = 10 * time.Millisecond
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	key, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("old"), key)
+	store.SetSecret("API_KEY", encrypted)
+
+	ts := httptest.NewServer(New(store, key, Options{Cache: NewCache(16, time.Hour)}))
+	t.Cleanup(ts.Close)
+
+	get := func() string {
+		resp, err := http.Get(ts.URL + "/secrets/API_KEY")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if v := get(); v != "old" {
+		t.Fatalf("Expected old, got %q", v)
+	}
+
+	encrypted, _ = crypto.Encrypt([]byte("new"), key)
+	store.SetSecret("API_KEY", encrypted)
+	time.Sleep(20 * time.Millisecond)
+	if v := get(); v != "new" {
+		t.Errorf("Cache served a stale value after a write: %q", v)
+	}
+}
+
+func TestCacheSkipsExpired(t *testing.T) {
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	key, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("value"), key)
+	store.SetSecret("API_KEY", encrypted)
+	expires := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	store.SetExpiry("API_KEY", expires)
+
+	ts := httptest.NewServer(New(store, key, Options{Cache: NewCache(16, time.Hour)}))
+	t.Cleanup(ts.Close)
+	get := func() int {
+		resp, err := http.Get(ts.URL + "/secrets/API_KEY")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("GET before expiry returned %d", code)
+	}
+	// Expiring changes nothing in the store, so only the check sees it
+	time.Sleep(time.Until(expires))
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("GET of a cached expired secret returned %d, want 404", code)
+	}
+}
+
+// BenchmarkGetSecret compares decrypting on every request with the cache
+func BenchmarkGetSecret(b *testing.B) {
+	b.Setenv("LOCKBOX_DB_PATH", b.TempDir()+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		b.Fatalf("Failed to create store: %v", err)
+	}
+	b.Cleanup(func() { store.Close() })
+
+	key, _ := crypto.GenerateKey()
+	for i := range 100 {
+		encrypted, _ := crypto.Encrypt([]byte(fmt.Sprintf("value-%d", i)), key)
+		store.SetSecret(fmt.Sprintf("KEY_%d", i), encrypted)
+	}
+
+	for _, bc := range []struct {
+		name  string
+		cache *Cache
+	}{
+		{"uncached", nil},
+		{"cached", NewCache(DefaultCacheSize, time.Hour)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			handler := New(store, key, Options{Cache: bc.cache})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/secrets/KEY_%d", i%100), nil)
+				req.Host = "localhost"
+				req.RemoteAddr = "127.0.0.1:40000"
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("GET returned %d", rec.Code)
+				}
+			}
+		})
+	}
+}
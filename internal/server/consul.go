@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/rbac"
+)
+
+const (
+	// consulDefaultWait is the blocking query wait when none is given
+	consulDefaultWait = 5 * time.Minute
+	// consulMaxWait caps the blocking query wait, as Consul does
+	consulMaxWait = 10 * time.Minute
+)
+
+// consulKVPair is a key as returned by Consul's KV API. Lockbox has no
+// per-key index, so every key reports the store revision.
+type consulKVPair struct {
+	LockIndex   uint64
+	Key         string
+	Flags       uint64
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// handleConsulKV serves a read-only subset of Consul's /v1/kv/ API so
+// consul-template and envconsul can read from lockbox. Supported query
+// parameters are raw, keys, recurse, separator, and blocking queries via
+// index and wait.
+func (s *Server) handleConsulKV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Error: the Consul KV facade is read-only")
+		return
+	}
+
+	query := r.URL.Query()
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	_, recurse := query["recurse"]
+	_, keysOnly := query["keys"]
+	_, raw := query["raw"]
+
+	if !recurse && !keysOnly {
+		if err := ValidateKey(key); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: %v", err)
+			return
+		}
+	}
+
+	index, wait, err := parseBlocking(query.Get("index"), query.Get("wait"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	// Blocking queries may outlive the server's write timeout
+	if wait > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + DefaultWriteTimeout))
+	}
+
+	rev, err := waitForRevision(r.Context(), s.store, index, wait)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(rev, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+
+	keys, err := s.store.ListSecrets()
+	if err == nil {
+		perm := rbac.Read
+		if keysOnly {
+			perm = rbac.List
+		}
+		keys, err = s.allowedKeys(r, perm, keys)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	var matched []string
+	for _, k := range keys {
+		if (recurse || keysOnly) && strings.HasPrefix(k, key) || k == key {
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if keysOnly {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collapseKeys(matched, key, query.Get("separator")))
+		return
+	}
+
+	if err := s.spendQuota(w, r, matched); err != nil {
+		w.WriteHeader(quotaStatus(err))
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	pairs := make([]consulKVPair, 0, len(matched))
+	for _, k := range matched {
+		value, err := s.decrypt(k)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error: %v", err)
+			return
+		}
+		pairs = append(pairs, consulKVPair{Key: k, Value: value, CreateIndex: rev, ModifyIndex: rev})
+	}
+	s.recordAccess(r, matched)
+
+	if raw && !recurse {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(pairs[0].Value)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pairs)
+}
+
+// decrypt returns the plaintext of key
+func (s *Server) decrypt(key string) ([]byte, error) {
+	value, err := s.value(key)
+	if err == db.ErrNotFound {
+		return nil, fmt.Errorf("secret '%s' not found", key)
+	}
+	return value, err
+}
+
+// parseBlocking parses the index and wait parameters of a blocking query.
+// wait accepts Consul's duration syntax ("10s", "5m") and is capped at
+// consulMaxWait. Without an index the query does not block.
+func parseBlocking(indexParam, waitParam string) (uint64, time.Duration, error) {
+	if indexParam == "" {
+		return 0, 0, nil
+	}
+	index, err := strconv.ParseUint(indexParam, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid index '%s'", indexParam)
+	}
+
+	wait := consulDefaultWait
+	if waitParam != "" {
+		if wait, err = time.ParseDuration(waitParam); err != nil {
+			return 0, 0, fmt.Errorf("invalid wait '%s'", waitParam)
+		}
+	}
+	if wait > consulMaxWait {
+		wait = consulMaxWait
+	}
+	return index, wait, nil
+}
+
+// collapseKeys implements ?keys&separator=: keys below prefix are cut after
+// the first separator past the prefix and deduplicated
+func collapseKeys(keys []string, prefix, separator string) []string {
+	if separator == "" {
+		return keys
+	}
+
+	seen := map[string]bool{}
+	var out []string
+	for _, k := range keys {
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, separator); i >= 0 {
+			k = prefix + rest[:i+len(separator)]
+		}
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+// newConsulTestServer returns a server and its store holding APP_A and APP_B
+func newConsulTestServer(t *testing.T) (string, *db.Store, []byte) {
+	t.Helper()
+	t.Setenv("LOCKBOX_DB_PATH", t.TempDir()+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	key, _ := crypto.GenerateKey()
+	for k, v := range map[string]string{"APP_A": "alpha", "APP_B": "beta"} {
+		encrypted, _ := crypto.Encrypt([]byte(v), key)
+		store.SetSecret(k, encrypted)
+	}
+
+	srv := NewHTTPServer("", New(store, key, Options{}), Options{})
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	return ts.URL, store, key
+}
+
+func TestConsulKV(t *testing.T) {
+	url, store, _ := newConsulTestServer(t)
+
+	resp, err := http.Get(url + "/v1/kv/APP_A")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	var pairs []consulKVPair
+	json.NewDecoder(resp.Body).Decode(&pairs)
+	resp.Body.Close()
+	if len(pairs) != 1 || pairs[0].Key != "APP_A" || string(pairs[0].Value) != "alpha" {
+		t.Errorf("Unexpected pairs: %+v", pairs)
+	}
+	if resp.Header.Get("X-Consul-Index") == "" {
+		t.Errorf("Missing X-Consul-Index header")
+	}
+
+	resp, _ = http.Get(url + "/v1/kv/APP_B?raw")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "beta" {
+		t.Errorf("Raw value = %q", body)
+	}
+
+	resp, _ = http.Get(url + "/v1/kv/APP_?recurse")
+	pairs = nil
+	json.NewDecoder(resp.Body).Decode(&pairs)
+	resp.Body.Close()
+	if len(pairs) != 2 {
+		t.Errorf("Recurse returned %d pairs", len(pairs))
+	}
+
+	resp, _ = http.Get(url + "/v1/kv/?keys&separator=_")
+	var keys []string
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	if len(keys) != 1 || keys[0] != "APP_" {
+		t.Errorf("Keys with separator = %v", keys)
+	}
+
+	resp, _ = http.Get(url + "/v1/kv/MISSING")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing key returned %d", resp.StatusCode)
+	}
+
+	// The facade is read-only even for tokens with write access
+	tok, _ := token.Generate()
+	store.CreateToken(db.Token{Name: "ci"}, token.Hash(tok), "")
+	store.AddPolicy("token:ci", "*", "operator")
+	req, _ := http.NewRequest(http.MethodPut, url+"/v1/kv/APP_A", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT returned %d, expected 405", resp.StatusCode)
+	}
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+	watchInterval = 10 * time.Millisecond
+	url, store, key := newConsulTestServer(t)
+
+	resp, _ := http.Get(url + "/v1/kv/APP_A")
+	resp.Body.Close()
+	index := resp.Header.Get("X-Consul-Index")
+
+	// Without changes the query blocks for the full wait
+	start := time.Now()
+	resp, _ = http.Get(url + "/v1/kv/APP_A?index=" + index + "&wait=200ms")
+	resp.Body.Close()
+	if time.Since(start) < 200*time.Millisecond {
+		t.Errorf("Blocking query returned early")
+	}
+
+	// A write releases the query with a new index
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		encrypted, _ := crypto.Encrypt([]byte("changed"), key)
+		store.SetSecret("APP_A", encrypted)
+	}()
+	start = time.Now()
+	resp, _ = http.Get(url + "/v1/kv/APP_A?index=" + index + "&wait=5s")
+	var pairs []consulKVPair
+	json.NewDecoder(resp.Body).Decode(&pairs)
+	resp.Body.Close()
+
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Blocking query was not released by a write")
+	}
+	old, _ := strconv.ParseUint(index, 10, 64)
+	if next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); next <= old {
+		t.Errorf("Index did not advance: %d -> %d", old, next)
+	}
+	if len(pairs) != 1 || string(pairs[0].Value) != "changed" {
+		t.Errorf("Unexpected pairs after write: %+v", pairs)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+// Endpoint documents one route of the HTTP API
+type Endpoint struct {
+	Method string
+	Path   string
+	// Auth is set when the route requires a bearer token
+	Auth    bool
+	Summary string
+}
+
+// Endpoints are the routes New serves, for 'lockbox help --web'
+var Endpoints = []Endpoint{
+	{"GET", "/healthz", false, "Liveness probe; /health is kept as an alias"},
+	{"GET", "/readyz", false, "Readiness checks; 503 when not ready"},
+	{"GET", "/secrets", true, "List the keys as a JSON array; with ?meta=true, objects with each key's updated and expires times"},
+	{"POST", "/secrets", true, "Set every key of a JSON object in one transaction"},
+	{"GET", "/secrets/KEY", true, "Read a secret's value"},
+	{"PUT", "/secrets/KEY", true, "Set a secret to the request body; 201 when new, 204 when overwritten"},
+	{"DELETE", "/secrets/KEY", true, "Delete a secret; 204"},
+	{"GET", "/env", true, "All secrets as export KEY=\"value\" lines"},
+	{"GET", "/vaults/NAME/secrets", true, "/secrets in the vault called NAME; /vaults/NAME/secrets/KEY and /vaults/NAME/env likewise"},
+	{"GET", "/v1/kv/KEY", true, "Consul KV facade for consul-template and envconsul (raw, keys, recurse, index, wait)"},
+	{"GET", "/v1/auth/oidc/config", false, "Identity provider for 'lockbox login'"},
+	{"POST", "/v1/auth/oidc/login", false, "Exchange an OIDC ID token for a short-lived lockbox token"},
+	{"POST", "/v1/auth/token/refresh", false, "Redeem a refresh token for a new token pair"},
+	{"POST", "/v1/auth/pair", false, "Redeem a pairing code from 'lockbox pair' for a token"},
+	{"GET", "/v1/secret/data/KEY", true, "Vault KV v2 facade; LIST /v1/secret/metadata/ lists keys"},
+	{"GET", "/v1/auth/token/lookup-self", true, "Vault token lookup for client libraries"},
+	{"GET", "/v1/sys/internal/ui/mounts/PATH", true, "Vault mount lookup for the vault CLI"},
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestEndpoints checks that each documented route is served with its method
+func TestEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+
+	placeholders := strings.NewReplacer("KEY", "API_KEY", "NAME", "default", "PATH", "secret")
+	for _, e := range Endpoints {
+		req, _ := http.NewRequest(e.Method, ts.URL+placeholders.Replace(e.Path), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", e.Method, e.Path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusMethodNotAllowed || string(body) == "404 page not found\n" {
+			t.Errorf("%s %s is not served: %d %s", e.Method, e.Path, resp.StatusCode, body)
+		}
+	}
+}
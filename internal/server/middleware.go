@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultMaxBodyBytes is the default request body limit (1 MiB)
+	DefaultMaxBodyBytes = 1 << 20
+	// DefaultMaxURLLength is the default request URI length limit
+	DefaultMaxURLLength = 2048
+	// MaxKeyLength is the longest secret key accepted over HTTP
+	MaxKeyLength = 256
+)
+
+// allowedContentTypes are the media types accepted on request bodies
+var allowedContentTypes = map[string]bool{
+	"application/json":         true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+// harden wraps a handler with URL length limits, strict content-type
+// checking, request body size limits and the rejection of requests sent
+// by web pages of other origins
+func harden(next http.Handler, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		// Browsers name the page's origin on cross-origin requests, which
+		// no lockbox client sends; any page could otherwise drive the API
+		// of a server on localhost
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Error: cross-origin requests are not allowed")
+			return
+		}
+
+		if len(r.RequestURI) > opts.MaxURLLength {
+			w.WriteHeader(http.StatusRequestURITooLong)
+			fmt.Fprintf(w, "Error: request URI exceeds %d bytes", opts.MaxURLLength)
+			return
+		}
+
+		if r.ContentLength > opts.MaxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Error: request body exceeds %d bytes", opts.MaxBodyBytes)
+			return
+		}
+
+		// Requests carrying a body must declare an accepted content type
+		if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !allowedContentTypes[mediaType] {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				fmt.Fprintf(w, "Error: unsupported content type %q", r.Header.Get("Content-Type"))
+				return
+			}
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, opts.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether an Origin header names the host a request
+// was sent to
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
+
+// loopbackHost reports whether the Host or remote address of a request
+// names the local machine. Pages of a domain rebound to 127.0.0.1 send
+// their own name as Host.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ValidateKey rejects key names that could escape their namespace or
+// confuse clients: path separators, traversal segments, control characters
+// and overly long names
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+	if len(key) > MaxKeyLength {
+		return fmt.Errorf("key exceeds %d bytes", MaxKeyLength)
+	}
+	if key == "." || key == ".." {
+		return fmt.Errorf("invalid key '%s': path traversal is not allowed", key)
+	}
+	if strings.ContainsAny(key, "/\\") {
+		return fmt.Errorf("invalid key '%s': path separators are not allowed", key)
+	}
+	for _, c := range key {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("invalid key: control characters are not allowed")
+		}
+	}
+	return nil
+}
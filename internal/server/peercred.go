@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// PeerCred identifies the local process on the other end of a unix socket
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ErrNoPeerCred means the platform cannot tell who is on the other end of
+// a unix socket
+var ErrNoPeerCred = errors.New("peer credentials are not supported on this platform")
+
+// peerCredKey is the context key holding a connection's PeerCred
+type peerCredKey struct{}
+
+// PeerCredFromContext returns the credentials of the connecting process.
+// ok is false for TCP connections and on platforms without SO_PEERCRED.
+func PeerCredFromContext(ctx context.Context) (cred PeerCred, ok bool) {
+	cred, ok = ctx.Value(peerCredKey{}).(PeerCred)
+	return cred, ok
+}
+
+// connContext attaches the peer credentials of unix socket connections to
+// every request served on them
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	uc, isUnix := c.(*net.UnixConn)
+	if !isUnix {
+		return ctx
+	}
+	cred, err := peerCred(uc)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// ListenUnix listens on a unix socket at path with the given permissions,
+// replacing a stale socket left by a previous run
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	// The socket is created with mode rather than changed to it after
+	// listening, so no other user can connect in between
+	var ln net.Listener
+	err := withUmask(int(0777&^mode.Perm()), func() (err error) {
+		ln, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// ConnPeerCred returns the credentials of the process on the other end of
+// a unix socket connection, or ErrNoPeerCred where they cannot be read
+func ConnPeerCred(c *net.UnixConn) (PeerCred, error) {
+	return peerCred(c)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// peerCred is unsupported outside Linux
+func peerCred(c *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, ErrNoPeerCred
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// spendQuota counts reading keys against the quotas of the request's
+// token. When the reads would exceed a quota it records the breach in the
+// audit log and returns the error to reject the request with; Retry-After
+// is set when the quota resets.
+func (s *Server) spendQuota(w http.ResponseWriter, r *http.Request, keys []string) error {
+	t, ok := tokenFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	_, err := s.store.SpendTokenQuota(t, keys, now)
+	var quota *db.QuotaError
+	if !errors.As(err, &quota) {
+		return err
+	}
+
+	if err := s.store.Audit(identity(r), "quota-exceeded", fmt.Sprintf("%s: %s", quota.Limit, r.URL.Path)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if !quota.Reset.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(quota.Reset.Sub(now).Seconds())+1))
+	}
+	return quota
+}
+
+// quotaStatus returns the status to reject a request with when spending
+// its quota failed with err
+func quotaStatus(err error) int {
+	var quota *db.QuotaError
+	if errors.As(err, &quota) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
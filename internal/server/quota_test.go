@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+func TestTokenQuota(t *testing.T) {
+	url, store, _ := newConsulTestServer(t)
+
+	tok, _ := token.Generate()
+	store.CreateToken(db.Token{Name: "ci", Scopes: []string{"read:APP_*"}, MaxReads: 3, MaxKeys: 1}, token.Hash(tok), "")
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/secrets/APP_A"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("First read returned %d", resp.StatusCode)
+	}
+	// A second distinct key is past the key quota
+	if resp := get("/secrets/APP_B"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Read past the key quota returned %d, expected 429", resp.StatusCode)
+	}
+	if resp := get("/env"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Env past the key quota returned %d, expected 429", resp.StatusCode)
+	}
+	// Listing keys reads no values
+	if resp := get("/secrets"); resp.StatusCode != http.StatusOK {
+		t.Errorf("List returned %d", resp.StatusCode)
+	}
+
+	get("/v1/kv/APP_A")
+	if resp := get("/secrets/APP_A"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Third read returned %d", resp.StatusCode)
+	}
+	resp := get("/secrets/APP_A")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Read past the daily quota returned %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	events, _ := store.AuditEvents("quota-exceeded")
+	if len(events) != 3 || events[0].Actor != "token:ci" {
+		t.Errorf("Expected 3 quota-exceeded events by token:ci, got %+v", events)
+	}
+	if usage, _ := store.TokenUsage("ci", time.Now()); usage.Reads != 3 || usage.Keys != 1 {
+		t.Errorf("Usage = %+v", usage)
+	}
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/bulk"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/export"
+	"github.com/MQ37/lockbox/internal/health"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/rbac"
+	"github.com/MQ37/lockbox/internal/signing"
+)
+
+// Options configures the HTTP server
+type Options struct {
+	// MaxBackupAge fails readiness when the last backup is older
+	MaxBackupAge time.Duration
+	// MaxBodyBytes limits request body size (DefaultMaxBodyBytes if zero)
+	MaxBodyBytes int64
+	// MaxURLLength limits the request URI length (DefaultMaxURLLength if zero)
+	MaxURLLength int
+	// ReadTimeout bounds reading a whole request (DefaultReadTimeout if zero)
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing a response (DefaultWriteTimeout if zero)
+	WriteTimeout time.Duration
+	// IdleTimeout is how long keep-alive connections stay open between
+	// requests (DefaultIdleTimeout if zero)
+	IdleTimeout time.Duration
+	// OIDC enables /v1/auth/oidc/login when set
+	OIDC OIDCVerifier
+	// TokenTTL is the lifetime of tokens issued on login (DefaultTokenTTL
+	// if zero)
+	TokenTTL time.Duration
+	// RefreshTTL is how long refresh tokens issued on login stay usable
+	// (DefaultRefreshTTL if zero)
+	RefreshTTL time.Duration
+	// Cache keeps recently decrypted values in memory; nil decrypts on
+	// every request
+	Cache *Cache
+	// Signer signs every response when set
+	Signer *signing.Signer
+}
+
+// Server serves secrets from a store over HTTP
+type Server struct {
+	store *db.Store
+	key   []byte
+	opts  Options
+}
+
+// New returns an http.Handler exposing the store's secrets. All handlers
+// are wrapped in the input hardening middleware.
+func New(store *db.Store, key []byte, opts Options) http.Handler {
+	if opts.MaxBodyBytes == 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if opts.MaxURLLength == 0 {
+		opts.MaxURLLength = DefaultMaxURLLength
+	}
+	if opts.TokenTTL == 0 {
+		opts.TokenTTL = DefaultTokenTTL
+	}
+	if opts.RefreshTTL == 0 {
+		opts.RefreshTTL = DefaultRefreshTTL
+	}
+
+	s := &Server{store: store, key: key, opts: opts}
+
+	mux := http.NewServeMux()
+
+	// Health endpoints - /healthz is the liveness probe, /health is kept for compatibility
+	mux.HandleFunc("/health", s.handleLiveness)
+	mux.HandleFunc("/healthz", s.handleLiveness)
+	mux.HandleFunc("/readyz", s.handleReadiness)
+
+	mux.HandleFunc("/secrets", s.authenticate(s.handleSecrets))
+	mux.HandleFunc("/secrets/", s.authenticate(s.handleSecret))
+	mux.HandleFunc("/env", s.authenticate(s.handleEnv))
+
+	// The same endpoints for a named vault
+	mux.HandleFunc("/vaults/", s.authenticate(s.handleVault))
+
+	// Read-only Consul KV facade for consul-template and envconsul
+	mux.HandleFunc("/v1/kv/", s.authenticate(s.handleConsulKV))
+
+	// OIDC login issuing short-lived tokens, and their refresh
+	mux.HandleFunc("/v1/auth/oidc/config", s.handleOIDCConfig)
+	mux.HandleFunc("/v1/auth/oidc/login", s.handleOIDCLogin)
+	mux.HandleFunc("/v1/auth/token/refresh", s.handleRefresh)
+
+	// Pairing of devices shown a code by 'lockbox pair'
+	mux.HandleFunc("/v1/auth/pair", s.handlePair)
+
+	// Read-only Vault KV v2 facade for Vault client libraries
+	mux.HandleFunc("/v1/secret/", s.handleVaultKV)
+	mux.HandleFunc("/v1/auth/token/lookup-self", s.handleVaultLookupSelf)
+	mux.HandleFunc("/v1/sys/internal/ui/mounts/", s.handleVaultMounts)
+
+	if opts.Signer != nil {
+		return sign(harden(mux, opts), opts.Signer)
+	}
+	return harden(mux, opts)
+}
+
+// handleLiveness reports that the process is up
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReadiness runs the readiness checks, returning 503 when not ready
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	report := health.Readiness(s.store, s.key, health.Options{MaxBackupAge: s.opts.MaxBackupAge})
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// allowedKeys narrows keys to those the requesting peer holds perm on.
+// Requests with a token only see keys granted to the token. Otherwise
+// requests over TCP, and unix socket peers running as the server's own
+// user or root, are unrestricted; other local users only see keys granted
+// by a policy. Policies match keys in a named vault as VAULT/KEY.
+func (s *Server) allowedKeys(r *http.Request, perm rbac.Permission, keys []string) ([]string, error) {
+	if unrestricted(r) {
+		return keys, nil
+	}
+	e, subjects, err := s.evaluator(r)
+	if err != nil {
+		return nil, err
+	}
+
+	qualified := make([]string, len(keys))
+	for i, key := range keys {
+		qualified[i] = s.store.Qualify(key)
+	}
+	allowed := e.Filter(subjects, perm, qualified)
+	for i, key := range allowed {
+		allowed[i] = strings.TrimPrefix(key, s.store.Qualify(""))
+	}
+	return allowed, nil
+}
+
+// unrestricted reports whether the requesting peer bypasses policies: it
+// has no token and is either a unix socket peer running as the server's
+// own user or root, or on TCP, where authenticate only lets such requests
+// read through localhost
+func unrestricted(r *http.Request) bool {
+	if _, hasToken := tokenFromContext(r.Context()); hasToken {
+		return false
+	}
+	cred, ok := PeerCredFromContext(r.Context())
+	return !ok || cred.UID == 0 || int(cred.UID) == os.Getuid()
+}
+
+// evaluator returns the policies that apply to the requesting peer and the
+// subjects it acts as: its token's, or its unix socket user's
+func (s *Server) evaluator(r *http.Request) (*rbac.Evaluator, []string, error) {
+	e, err := rbac.Load(s.store)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t, ok := tokenFromContext(r.Context()); ok {
+		return e.ForToken(t), policy.TokenSubjects(t), nil
+	}
+	cred, _ := PeerCredFromContext(r.Context())
+	return e, policy.NewIdentity(cred.UID, cred.GID).Subjects(), nil
+}
+
+// identity names the requesting peer in the access log: its token, its
+// unix socket user, or its remote address
+func identity(r *http.Request) string {
+	if t, ok := tokenFromContext(r.Context()); ok {
+		return policy.TokenSubject(t.Name)
+	}
+	if cred, ok := PeerCredFromContext(r.Context()); ok {
+		return policy.UserSubject(cred.UID)
+	}
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "local"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "remote:" + host
+}
+
+// recordAccess logs that the requesting peer read keys. Failing to log
+// does not fail the request.
+func (s *Server) recordAccess(r *http.Request, keys []string) {
+	if err := s.store.RecordAccess("server", identity(r), keys); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
+
+// handleVault serves /vaults/NAME/secrets, /vaults/NAME/secrets/:key and
+// /vaults/NAME/env like their unscoped forms, from the vault called NAME
+func (s *Server) handleVault(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/vaults/"), "/")
+	vault := name
+	if vault == db.DefaultVault {
+		vault = ""
+	}
+	exists, err := s.store.HasVault(vault)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	if name == "" || !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error: vault '%s' not found", name)
+		return
+	}
+
+	scoped := &Server{store: s.store.InVault(vault), key: s.key, opts: s.opts}
+	var h http.HandlerFunc
+	switch {
+	case rest == "secrets":
+		h = scoped.handleSecrets
+	case strings.HasPrefix(rest, "secrets/"):
+		h = scoped.handleSecret
+	case rest == "env":
+		h = scoped.handleEnv
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix("/vaults/"+name, h).ServeHTTP(w, r)
+}
+
+// handleSecrets serves /secrets: GET lists the keys and POST sets several
+// secrets at once
+func (s *Server) handleSecrets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleListSecrets(w, r)
+	case http.MethodPost:
+		s.handleSetSecrets(w, r)
+	default:
+		methodNotAllowed(w, "GET, HEAD, POST")
+	}
+}
+
+// handleSecret serves /secrets/:key: GET reads the secret, PUT sets it and
+// DELETE deletes it
+func (s *Server) handleSecret(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleGetSecret(w, r)
+	case http.MethodPut:
+		s.handlePutSecret(w, r)
+	case http.MethodDelete:
+		s.handleDeleteSecret(w, r)
+	default:
+		methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+	}
+}
+
+// methodNotAllowed rejects a request with 405, listing the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	fmt.Fprintf(w, "Error: method not allowed")
+}
+
+// SecretMeta is a secret as listed by GET /secrets?meta=true
+type SecretMeta struct {
+	Key     string    `json:"key"`
+	Updated time.Time `json:"updated"`
+	// Expires is when a temporary secret expires; omitted if never
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// handleListSecrets returns a JSON array of all secret keys, or of their
+// metadata with ?meta=true
+func (s *Server) handleListSecrets(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("meta") == "true" {
+		s.handleListSecretMeta(w, r)
+		return
+	}
+	keys, err := s.store.ListSecrets()
+	if err == nil {
+		keys, err = s.allowedKeys(r, rbac.List, keys)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleListSecretMeta returns a JSON array of SecretMeta for every
+// unexpired secret the caller may list
+func (s *Server) handleListSecretMeta(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.store.ListSecretInfo()
+	var keys []string
+	now := time.Now()
+	byKey := map[string]db.SecretInfo{}
+	for _, info := range infos {
+		if !info.Expired(now) {
+			keys = append(keys, info.Key)
+			byKey[info.Key] = info
+		}
+	}
+	if err == nil {
+		keys, err = s.allowedKeys(r, rbac.List, keys)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	metas := make([]SecretMeta, len(keys))
+	for i, key := range keys {
+		metas[i] = SecretMeta{Key: key, Updated: byKey[key].Updated.UTC(), Expires: byKey[key].Expires.UTC()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metas)
+}
+
+// handleEnv returns all secrets in export KEY="value" format
+func (s *Server) handleEnv(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.ListSecrets()
+	if err == nil {
+		keys, err = s.allowedKeys(r, rbac.Read, keys)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+
+	if err := s.spendQuota(w, r, keys); err != nil {
+		writeError(w, quotaStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	// Values are decrypted in parallel and sent in key order through a
+	// bounded buffer
+	out := export.NewWriter(w)
+	err = bulk.Map(keys, bulk.Workers, s.value, func(key string, decrypted []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		out.Write(key, decrypted)
+		clear(decrypted)
+		return nil
+	})
+	if err != nil {
+		if out.Started() {
+			// Abort rather than end a partial export cleanly
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	out.Flush()
+	s.recordAccess(r, keys)
+}
+
+// handleGetSecret returns a single decrypted secret - handles /secrets/:key
+func (s *Server) handleGetSecret(w http.ResponseWriter, r *http.Request) {
+	key, ok := secretKey(w, r)
+	if !ok {
+		return
+	}
+
+	allowed, err := s.allowedKeys(r, rbac.Read, []string{key})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	if len(allowed) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Error: access to secret '%s' denied", key)
+		return
+	}
+
+	decrypted, err := s.value(key)
+	if err != nil {
+		if err == db.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Error: secret '%s' not found", key)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v", err)
+		return
+	}
+	if err := s.spendQuota(w, r, allowed); err != nil {
+		writeError(w, quotaStatus(err), err)
+		return
+	}
+
+	s.recordAccess(r, allowed)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(decrypted)
+}
+
+// secretKey returns the key named by a /secrets/:key path, rejecting the
+// request with 400 when it is missing or invalid
+func secretKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := strings.TrimPrefix(r.URL.Path, "/secrets/")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: no key specified")
+		return "", false
+	}
+	if err := ValidateKey(key); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v", err)
+		return "", false
+	}
+	return key, true
+}
@@ -0,0 +1,534 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// newTestServer starts a server over a fresh store holding one secret
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	tmpDir := fmt.Sprintf("/tmp/lockbox-server-test-%d", time.Now().UnixNano())
+	os.MkdirAll(tmpDir, 0700)
+	os.Setenv("LOCKBOX_DB_PATH", tmpDir+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	key, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("secret123"), key)
+	store.SetSecret("API_KEY", encrypted)
+
+	ts := httptest.NewServer(New(store, key, Options{}))
+
+	t.Cleanup(func() {
+		ts.Close()
+		store.Close()
+		os.Unsetenv("LOCKBOX_DB_PATH")
+		os.RemoveAll(tmpDir)
+	})
+
+	return ts
+}
+
+// handlerPaths covers every registered handler
+var handlerPaths = []string{"/health", "/healthz", "/readyz", "/secrets", "/secrets/API_KEY", "/env", "/v1/kv/API_KEY"}
+
+func TestHandlers(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, path := range handlerPaths {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s returned %d, expected 200", path, resp.StatusCode)
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("GET %s missing nosniff header", path)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, path := range []string{"/secrets", "/secrets/API_KEY", "/env"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	accesses, err := store.Accesses(time.Time{})
+	if err != nil {
+		t.Fatalf("Accesses failed: %v", err)
+	}
+	// Listing keys reads no values
+	if len(accesses) != 2 {
+		t.Fatalf("logged %d reads, want 2: %+v", len(accesses), accesses)
+	}
+	for _, a := range accesses {
+		if a.Key != "API_KEY" || a.Source != "server" || a.Identity != "remote:127.0.0.1" {
+			t.Errorf("logged %+v", a)
+		}
+	}
+}
+
+func TestOversizedURL(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, path := range handlerPaths {
+		resp, err := http.Get(ts.URL + path + "?pad=" + strings.Repeat("a", DefaultMaxURLLength))
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestURITooLong {
+			t.Errorf("Oversized URL on %s returned %d, expected 414", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	ts := newTestServer(t)
+
+	body := strings.Repeat("x", DefaultMaxBodyBytes+1)
+	for _, path := range handlerPaths {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Oversized body on %s returned %d, expected 413", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBadContentType(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, contentType := range []string{"", "text/html", "application/x-www-form-urlencoded", "multipart/form-data; boundary=x", "garbage;;"} {
+		for _, path := range handlerPaths {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader("{}"))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("POST %s failed: %v", path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnsupportedMediaType {
+				t.Errorf("Content type %q on %s returned %d, expected 415", contentType, path, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestMaliciousKeys(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, key := range []string{
+		"..",
+		"%2e%2e",
+		"..%2fetc%2fpasswd",
+		"a%2fb",
+		"a%5cb",
+		"key%00null",
+		"key%0anewline",
+		strings.Repeat("K", MaxKeyLength+1),
+	} {
+		resp, err := http.Get(ts.URL + "/secrets/" + key)
+		if err != nil {
+			t.Fatalf("GET /secrets/%s failed: %v", key, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Malicious key %q was accepted: %s", key, body)
+		}
+		if resp.StatusCode >= 500 {
+			t.Errorf("Malicious key %q caused server error %d", key, resp.StatusCode)
+		}
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"SIMPLE_KEY", "key.with.dots", "key-with-dashes", "a..b"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("ValidateKey(%q) rejected a valid key: %v", key, err)
+		}
+	}
+	for _, key := range []string{"", ".", "..", "a/b", "a\\b", "a\x00b", "a\tb"} {
+		if err := ValidateKey(key); err == nil {
+			t.Errorf("ValidateKey(%q) accepted an invalid key", key)
+		}
+	}
+}
+
+func TestNewHTTPServerH2C(t *testing.T) {
+	srv := NewHTTPServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), Options{})
+	if srv.ReadTimeout != DefaultReadTimeout || srv.WriteTimeout != DefaultWriteTimeout || srv.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("Expected default timeouts, got read=%v write=%v idle=%v", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.Start()
+	defer ts.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	for _, c := range []*http.Client{http.DefaultClient, client} {
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if c == client && string(body) != "HTTP/2.0" {
+			t.Errorf("Expected h2c request, got %s", body)
+		}
+		if c == http.DefaultClient && string(body) != "HTTP/1.1" {
+			t.Errorf("Expected HTTP/1.1 request, got %s", body)
+		}
+	}
+}
+
+func TestAutoTLS(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	now := time.Now()
+	certFile, keyFile, created, err := AutoTLS(dir, now)
+	if err != nil || !created {
+		t.Fatalf("AutoTLS = %v, %v", created, err)
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Errorf("Key file mode %v", info.Mode().Perm())
+	}
+	first, _ := os.ReadFile(certFile)
+
+	// Clients trusting the certificate reach the server over HTTP/2
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	srv := NewHTTPServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), Options{})
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, NextProtos: []string{"h2", "http/1.1"}}
+	ts.StartTLS()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(first)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET over TLS failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ts.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 over TLS, got %s", body)
+	}
+
+	// The certificate is reused until it nears expiry
+	if _, _, created, _ := AutoTLS(dir, now.Add(300*24*time.Hour)); created {
+		t.Error("AutoTLS replaced a certificate far from expiry")
+	}
+	if _, _, created, _ := AutoTLS(dir, now.Add(340*24*time.Hour)); !created {
+		t.Error("AutoTLS kept a certificate about to expire")
+	}
+	second, _ := os.ReadFile(certFile)
+	if bytes.Equal(first, second) {
+		t.Error("Expected a new certificate")
+	}
+}
+
+func TestUnixSocketPeerCred(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/lockbox.sock"
+
+	// A stale socket from a previous run is replaced
+	stale, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("ListenUnix failed: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("ListenUnix over stale socket failed: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+	if wide, err := ListenUnix(dir+"/shared.sock", 0666); err != nil {
+		t.Errorf("ListenUnix with mode 0666 failed: %v", err)
+	} else {
+		info, _ := os.Stat(dir + "/shared.sock")
+		if info.Mode().Perm() != 0666 {
+			t.Errorf("Expected socket mode 0666, got %v", info.Mode().Perm())
+		}
+		wide.Close()
+	}
+
+	srv := NewHTTPServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := PeerCredFromContext(r.Context())
+		fmt.Fprintf(w, "%v %d", ok, cred.UID)
+	}), Options{})
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://lockbox/")
+	if err != nil {
+		t.Fatalf("GET over unix socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if runtime.GOOS == "linux" && string(body) != fmt.Sprintf("true %d", os.Getuid()) {
+		t.Errorf("Expected peer credentials for uid %d, got %q", os.Getuid(), body)
+	}
+}
+
+func TestListenUnixRefusesNonSocket(t *testing.T) {
+	path := t.TempDir() + "/not-a-socket"
+	os.WriteFile(path, []byte("data"), 0600)
+
+	if _, err := ListenUnix(path, 0600); err == nil {
+		t.Errorf("ListenUnix replaced a regular file")
+	}
+}
+
+func TestPeerPolicies(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("LOCKBOX_DB_PATH", tmpDir+"/lockbox.db")
+
+	store, err := db.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	for _, k := range []string{"APP_TOKEN", "DB_PASSWORD"} {
+		encrypted, _ := crypto.Encrypt([]byte(k+"-value"), key)
+		store.SetSecret(k, encrypted)
+	}
+	store.AddPolicy("uid:54321", "APP_*", "reader")
+	store.AddPolicy("uid:54323", "*", "auditor")
+
+	handler := New(store, key, Options{})
+
+	// get issues a request as if it arrived on the unix socket from uid
+	get := func(uid uint32, path string) (int, string) {
+		ctx := context.WithValue(context.Background(), peerCredKey{}, PeerCred{UID: uid, GID: uid})
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := get(54321, "/secrets"); code != http.StatusOK || strings.Contains(body, "DB_PASSWORD") || !strings.Contains(body, "APP_TOKEN") {
+		t.Errorf("Restricted peer list: %d %s", code, body)
+	}
+	if code, body := get(54321, "/secrets?meta=true"); code != http.StatusOK || strings.Contains(body, "DB_PASSWORD") || !strings.Contains(body, `{"key":"APP_TOKEN","updated":"`) {
+		t.Errorf("Restricted peer metadata list: %d %s", code, body)
+	}
+	if code, _ := get(54321, "/secrets/APP_TOKEN"); code != http.StatusOK {
+		t.Errorf("Restricted peer denied a granted key: %d", code)
+	}
+	if code, _ := get(54321, "/secrets/DB_PASSWORD"); code != http.StatusForbidden {
+		t.Errorf("Restricted peer read an ungranted key: %d", code)
+	}
+	if _, body := get(54321, "/env"); strings.Contains(body, "DB_PASSWORD") {
+		t.Errorf("Restricted peer env leaked an ungranted key: %s", body)
+	}
+	if code, body := get(54322, "/secrets"); code != http.StatusOK || body != "[]\n" {
+		t.Errorf("Peer without policies should see no keys: %d %s", code, body)
+	}
+	// Auditors see every key name but no values
+	if code, body := get(54323, "/secrets"); code != http.StatusOK || !strings.Contains(body, "DB_PASSWORD") {
+		t.Errorf("Auditor list: %d %s", code, body)
+	}
+	if code, _ := get(54323, "/secrets/DB_PASSWORD"); code != http.StatusForbidden {
+		t.Errorf("Auditor read a value: %d", code)
+	}
+	if _, body := get(54323, "/env"); strings.Contains(body, "DB_PASSWORD") {
+		t.Errorf("Auditor env leaked a value: %s", body)
+	}
+	if code, _ := get(uint32(os.Getuid()), "/secrets/DB_PASSWORD"); code != http.StatusOK {
+		t.Errorf("Server's own user was restricted: %d", code)
+	}
+}
+
+func TestVaultEndpoints(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	store.CreateVault("prod")
+	for _, s := range []*db.Store{store, store.InVault("prod")} {
+		for _, k := range []string{"APP_TOKEN", "DB_PASSWORD"} {
+			encrypted, _ := crypto.Encrypt([]byte(s.Qualify(k)+"-value"), key)
+			s.SetSecret(k, encrypted)
+		}
+	}
+	store.AddPolicy("uid:54321", "prod/APP_*", "reader")
+
+	handler := New(store, key, Options{Cache: NewCache(16, time.Minute)})
+	get := func(uid uint32, path string) (int, string) {
+		ctx := context.WithValue(context.Background(), peerCredKey{}, PeerCred{UID: uid, GID: uid})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx))
+		return rec.Code, rec.Body.String()
+	}
+	self := uint32(os.Getuid())
+
+	// The cache keeps vaults apart
+	if _, body := get(self, "/secrets/APP_TOKEN"); body != "APP_TOKEN-value" {
+		t.Errorf("Default vault value: %q", body)
+	}
+	if _, body := get(self, "/vaults/prod/secrets/APP_TOKEN"); body != "prod/APP_TOKEN-value" {
+		t.Errorf("prod value: %q", body)
+	}
+	if _, body := get(self, "/vaults/default/secrets/APP_TOKEN"); body != "APP_TOKEN-value" {
+		t.Errorf("Default vault by name: %q", body)
+	}
+	if code, body := get(self, "/vaults/prod/env"); code != http.StatusOK || !strings.Contains(body, "prod/DB_PASSWORD-value") {
+		t.Errorf("prod env: %d %s", code, body)
+	}
+	for _, path := range []string{"/vaults/staging/secrets", "/vaults/prod/other", "/vaults/"} {
+		if code, _ := get(self, path); code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, expected 404", path, code)
+		}
+	}
+
+	// Policies name keys in a vault as VAULT/KEY
+	if code, body := get(54321, "/vaults/prod/secrets"); code != http.StatusOK || body != "[\"APP_TOKEN\"]\n" {
+		t.Errorf("Restricted peer prod list: %d %s", code, body)
+	}
+	if code, _ := get(54321, "/vaults/prod/secrets/APP_TOKEN"); code != http.StatusOK {
+		t.Errorf("Restricted peer denied a granted key: %d", code)
+	}
+	if code, _ := get(54321, "/secrets/APP_TOKEN"); code != http.StatusForbidden {
+		t.Errorf("A grant in prod leaked to the default vault: %d", code)
+	}
+}
+
+// peakWriter discards a response, sampling the live heap as it arrives
+type peakWriter struct {
+	header http.Header
+	writes int
+	bytes  int
+	peak   uint64
+}
+
+func (p *peakWriter) Header() http.Header { return p.header }
+func (p *peakWriter) WriteHeader(int)     {}
+func (p *peakWriter) Flush()              {}
+
+func (p *peakWriter) Write(b []byte) (int, error) {
+	if p.writes%16 == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		p.peak = max(p.peak, m.HeapAlloc)
+	}
+	p.writes++
+	p.bytes += len(b)
+	return len(b), nil
+}
+
+// BenchmarkEnv streams /env from stores of 5k and 50k secrets. The
+// peak-heap-MB metric stays flat as the store grows: only the key list,
+// not the output or the decrypted values, scales with the store.
+func BenchmarkEnv(b *testing.B) {
+	key, _ := crypto.GenerateKey()
+	value := strings.Repeat("v", 200)
+
+	for _, n := range []int{5000, 50000} {
+		b.Run(fmt.Sprintf("secrets=%d", n), func(b *testing.B) {
+			store, err := db.OpenStore(b.TempDir() + "/lockbox.db")
+			if err != nil {
+				b.Fatalf("Failed to create store: %v", err)
+			}
+			defer store.Close()
+
+			tx, _ := store.Begin()
+			for i := range n {
+				encrypted, _ := crypto.Encrypt([]byte(value), key)
+				tx.SetSecretBlob(fmt.Sprintf("KEY_%06d", i), fmt.Sprintf("digest-%d", i), encrypted)
+			}
+			if err := tx.Commit(); err != nil {
+				b.Fatalf("Failed to commit: %v", err)
+			}
+
+			handler := New(store, key, Options{})
+			runtime.GC()
+			var base runtime.MemStats
+			runtime.ReadMemStats(&base)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				w := &peakWriter{header: http.Header{}}
+				req := httptest.NewRequest(http.MethodGet, "/env", nil)
+				req.Host = "localhost"
+				req.RemoteAddr = "127.0.0.1:40000"
+				handler.ServeHTTP(w, req)
+				if w.bytes < n*len(value) {
+					b.Fatalf("/env wrote %d bytes for %d secrets", w.bytes, n)
+				}
+				peak = max(peak, w.peak)
+			}
+			b.ReportMetric(float64(peak-min(peak, base.HeapAlloc))/(1<<20), "peak-heap-MB")
+		})
+	}
+}
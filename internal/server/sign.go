@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/signing"
+)
+
+// signedResponse buffers a response so its body can be signed before it
+// is sent. A handler that flushes, like /env, streams instead: what is
+// buffered goes out and the rest passes through, signed in a trailer.
+type signedResponse struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	signer *signing.Signer
+	status int
+	body   bytes.Buffer
+	stream *signing.Stream
+}
+
+func (w *signedResponse) Header() http.Header { return w.w.Header() }
+
+func (w *signedResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.stream != nil {
+		w.stream.Write(p)
+		return w.w.Write(p)
+	}
+	return w.body.Write(p)
+}
+
+func (w *signedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Flush switches to streaming. HEAD responses have no body to stream and
+// stay buffered, as clients read no trailer from them.
+func (w *signedResponse) Flush() {
+	if w.r.Method == http.MethodHead {
+		return
+	}
+	if w.stream == nil {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.stream = w.signer.Stream(w.r.Method, w.r.RequestURI, w.status, time.Now())
+		w.Header().Add("Trailer", signing.Header)
+		w.w.WriteHeader(w.status)
+		w.stream.Write(w.body.Bytes())
+		w.w.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sign signs every response of next with signer
+func sign(next http.Handler, signer *signing.Signer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &signedResponse{w: w, r: r, signer: signer}
+		next.ServeHTTP(rec, r)
+		if rec.stream != nil {
+			rec.stream.Sign(w.Header())
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// Clients read no body from HEAD responses
+		body := rec.body.Bytes()
+		if r.Method == http.MethodHead {
+			body = nil
+		}
+		signer.Sign(w.Header(), r.Method, r.RequestURI, rec.status, body, time.Now())
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	})
+}
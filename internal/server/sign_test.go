@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/signing"
+)
+
+func TestSignedResponses(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+	key, _ := crypto.GenerateKey()
+	encrypted, _ := crypto.Encrypt([]byte("secret123"), key)
+	store.SetSecret("API_KEY", encrypted)
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	handler := New(store, key, Options{Signer: &signing.Signer{Name: "test", Key: priv}})
+	verifier := &signing.Verifier{Name: "test", Key: pub}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/secrets/API_KEY", http.StatusOK},
+		{"HEAD", "/secrets/API_KEY", http.StatusOK},
+		{"GET", "/secrets/MISSING", http.StatusNotFound},
+		{"GET", "/env", http.StatusOK},
+		{"GET", "/healthz", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Host = "localhost"
+		req.RemoteAddr = "127.0.0.1:40000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s returned %d, expected %d", tc.method, tc.path, rec.Code, tc.status)
+		}
+		// /env streams, so it is signed in a trailer
+		res := rec.Result()
+		h := res.Header
+		if streamed := h.Get(signing.Header) == ""; streamed != (tc.method == "GET" && tc.path == "/env") {
+			t.Errorf("%s %s streamed = %v", tc.method, tc.path, streamed)
+		} else if streamed {
+			h = res.Trailer
+		}
+		if err := verifier.Verify(h, tc.method, tc.path, rec.Code, rec.Body.Bytes(), time.Now()); err != nil {
+			t.Errorf("%s %s: %v", tc.method, tc.path, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultReadTimeout bounds reading a whole request
+	DefaultReadTimeout = 10 * time.Second
+	// DefaultWriteTimeout bounds writing a response
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultIdleTimeout keeps idle connections open for reuse by sidecars
+	DefaultIdleTimeout = 120 * time.Second
+	// readHeaderTimeout guards against slow header attacks
+	readHeaderTimeout = 5 * time.Second
+	// maxHeaderBytes caps request headers well below net/http's 1 MiB default
+	maxHeaderBytes = 64 << 10
+)
+
+// NewHTTPServer returns an http.Server for handler listening on addr, tuned
+// for many short requests from a long-lived client: timeouts on every phase,
+// long idle keep-alive, and HTTP/2 over both TLS and cleartext (h2c) so a
+// sidecar can multiplex requests over a single connection
+func NewHTTPServer(addr string, handler http.Handler, opts Options) *http.Server {
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = DefaultReadTimeout
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		Protocols:         &protocols,
+		ConnContext:       connContext,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
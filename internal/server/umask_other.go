@@ -0,0 +1,8 @@
+//go:build !unix
+
+package server
+
+// withUmask runs f; there is no umask outside unix
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// withUmask runs f with the process umask set to mask
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
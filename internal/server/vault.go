@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/rbac"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+// vaultMount is the KV v2 mount lockbox pretends to be
+const vaultMount = "secret"
+
+// vaultValueField is the field a lockbox secret is exposed as, since Vault
+// secrets are maps and lockbox secrets are single values
+const vaultValueField = "value"
+
+// vaultResponse is the envelope of every successful Vault API response
+type vaultResponse struct {
+	RequestID     string `json:"request_id"`
+	LeaseID       string `json:"lease_id"`
+	Renewable     bool   `json:"renewable"`
+	LeaseDuration int    `json:"lease_duration"`
+	Data          any    `json:"data"`
+	WrapInfo      any    `json:"wrap_info"`
+	Warnings      any    `json:"warnings"`
+	Auth          any    `json:"auth"`
+}
+
+// vaultVersion is the metadata of a KV v2 secret version. Lockbox keeps no
+// history, so every secret is at version 1.
+type vaultVersion struct {
+	CreatedTime    time.Time `json:"created_time"`
+	CustomMetadata any       `json:"custom_metadata"`
+	DeletionTime   string    `json:"deletion_time"`
+	Destroyed      bool      `json:"destroyed"`
+	Version        int       `json:"version"`
+}
+
+// writeVault writes a Vault JSON response
+func writeVault(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeVaultError writes a Vault error response
+func writeVaultError(w http.ResponseWriter, status int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	writeVault(w, status, map[string][]string{"errors": errs})
+}
+
+// vaultToken resolves the request's token. It writes a 403 and returns
+// false when the token is missing, unknown or expired.
+func (s *Server) vaultToken(w http.ResponseWriter, r *http.Request) (db.Token, bool) {
+	raw := token.FromRequest(r)
+	if raw == "" {
+		writeVaultError(w, http.StatusForbidden, "permission denied")
+		return db.Token{}, false
+	}
+	t, err := s.store.LookupToken(token.Hash(raw))
+	if err != nil {
+		if err == db.ErrNotFound {
+			writeVaultError(w, http.StatusForbidden, "permission denied")
+		} else {
+			writeVaultError(w, http.StatusInternalServerError, err.Error())
+		}
+		return db.Token{}, false
+	}
+	return t, true
+}
+
+// handleVaultKV serves a read-only subset of Vault's KV v2 API mounted at
+// secret/: reading /v1/secret/data/KEY and listing /v1/secret/metadata/.
+// Requests authenticate with a lockbox token and see the keys granted to
+// that token by policy.
+func (s *Server) handleVaultKV(w http.ResponseWriter, r *http.Request) {
+	list := r.Method == "LIST" || r.Method == http.MethodGet && r.URL.Query().Get("list") == "true"
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !list {
+		w.Header().Set("Allow", "GET, HEAD, LIST")
+		writeVaultError(w, http.StatusMethodNotAllowed, "the Vault KV facade is read-only")
+		return
+	}
+
+	t, ok := s.vaultToken(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/"+vaultMount+"/")
+	switch {
+	case list && strings.HasPrefix(rest, "metadata/"):
+		s.vaultList(w, t, strings.TrimPrefix(rest, "metadata/"))
+	case strings.HasPrefix(rest, "data/"):
+		s.vaultRead(w, r, t, strings.TrimPrefix(rest, "data/"))
+	case strings.HasPrefix(rest, "metadata/"):
+		s.vaultMetadata(w, t, strings.TrimPrefix(rest, "metadata/"))
+	default:
+		writeVaultError(w, http.StatusNotFound)
+	}
+}
+
+// vaultAllowed reports whether t may read key
+func (s *Server) vaultAllowed(w http.ResponseWriter, t db.Token, key string) bool {
+	if err := ValidateKey(key); err != nil {
+		writeVaultError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	e, err := rbac.Load(s.store)
+	if err != nil {
+		writeVaultError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if !e.ForToken(t).Allows(policy.TokenSubjects(t), rbac.Read, key) {
+		writeVaultError(w, http.StatusForbidden, "permission denied")
+		return false
+	}
+	return true
+}
+
+// vaultRead handles GET /v1/secret/data/KEY
+func (s *Server) vaultRead(w http.ResponseWriter, r *http.Request, t db.Token, key string) {
+	if !s.vaultAllowed(w, t, key) {
+		return
+	}
+	if v := r.URL.Query().Get("version"); v != "" && v != "0" && v != "1" {
+		writeVaultError(w, http.StatusNotFound)
+		return
+	}
+
+	_, updated, err := s.secretTimes(key)
+	var value []byte
+	if err == nil {
+		value, err = s.value(key)
+	}
+	if err == db.ErrNotFound {
+		writeVaultError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeVaultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.spendQuota(w, r, []string{key}); err != nil {
+		writeVaultError(w, quotaStatus(err), err.Error())
+		return
+	}
+
+	s.recordAccess(r, []string{key})
+	writeVault(w, http.StatusOK, vaultResponse{Data: map[string]any{
+		"data":     map[string]string{vaultValueField: string(value)},
+		"metadata": vaultVersion{CreatedTime: updated, Version: 1},
+	}})
+}
+
+// vaultMetadata handles GET /v1/secret/metadata/KEY
+func (s *Server) vaultMetadata(w http.ResponseWriter, t db.Token, key string) {
+	if !s.vaultAllowed(w, t, key) {
+		return
+	}
+
+	created, updated, err := s.secretTimes(key)
+	if err != nil {
+		if err == db.ErrNotFound {
+			writeVaultError(w, http.StatusNotFound)
+			return
+		}
+		writeVaultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeVault(w, http.StatusOK, vaultResponse{Data: map[string]any{
+		"cas_required":         false,
+		"created_time":         created,
+		"current_version":      1,
+		"custom_metadata":      nil,
+		"delete_version_after": "0s",
+		"max_versions":         0,
+		"oldest_version":       1,
+		"updated_time":         updated,
+		"versions": map[string]vaultVersion{
+			"1": {CreatedTime: updated, Version: 1},
+		},
+	}})
+}
+
+// secretTimes returns when key was created and last updated, or
+// db.ErrNotFound if it does not exist or has expired
+func (s *Server) secretTimes(key string) (time.Time, time.Time, error) {
+	expires, err := s.store.SecretExpiry(key)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		return time.Time{}, time.Time{}, db.ErrNotFound
+	}
+	return s.store.SecretTimes(key)
+}
+
+// vaultList handles LIST /v1/secret/metadata/PREFIX, returning the keys
+// below prefix the token may list. Lockbox keys cannot contain "/", so
+// only the root of the mount has entries.
+func (s *Server) vaultList(w http.ResponseWriter, t db.Token, prefix string) {
+	keys, err := s.store.ListSecrets()
+	var e *rbac.Evaluator
+	if err == nil {
+		e, err = rbac.Load(s.store)
+	}
+	if err != nil {
+		writeVaultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var matched []string
+	for _, k := range e.ForToken(t).Filter(policy.TokenSubjects(t), rbac.List, keys) {
+		if strings.HasPrefix(k, prefix) {
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) == 0 {
+		writeVaultError(w, http.StatusNotFound)
+		return
+	}
+
+	writeVault(w, http.StatusOK, vaultResponse{Data: map[string][]string{"keys": matched}})
+}
+
+// handleVaultLookupSelf answers /v1/auth/token/lookup-self, which client
+// libraries use to check that their token is valid
+func (s *Server) handleVaultLookupSelf(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.vaultToken(w, r)
+	if !ok {
+		return
+	}
+
+	var expireTime any
+	var ttl int64
+	if !t.ExpiresAt.IsZero() {
+		expireTime = t.ExpiresAt
+		ttl = int64(time.Until(t.ExpiresAt).Seconds())
+	}
+	writeVault(w, http.StatusOK, vaultResponse{Data: map[string]any{
+		"display_name": "token-" + t.Name,
+		"expire_time":  expireTime,
+		"policies":     []string{"default"},
+		"renewable":    false,
+		"ttl":          ttl,
+	}})
+}
+
+// handleVaultMounts answers /v1/sys/internal/ui/mounts/PATH, which the
+// vault CLI queries to learn the KV version of a mount before reading it
+func (s *Server) handleVaultMounts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.vaultToken(w, r); !ok {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/")
+	if path != vaultMount && !strings.HasPrefix(path, vaultMount+"/") {
+		writeVaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	writeVault(w, http.StatusOK, vaultResponse{Data: map[string]any{
+		"path":    vaultMount + "/",
+		"type":    "kv",
+		"options": map[string]string{"version": "2"},
+	}})
+}
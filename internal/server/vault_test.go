@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+// vaultGet performs a request with a Vault token and decodes the response
+func vaultGet(t *testing.T, method, url, tok string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if tok != "" {
+		req.Header.Set("X-Vault-Token", tok)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestVaultKV(t *testing.T) {
+	url, store, _ := newConsulTestServer(t)
+
+	tok, _ := token.Generate()
+	store.CreateToken(db.Token{Name: "ci"}, token.Hash(tok), "")
+	store.AddPolicy("token:ci", "APP_A", "reader")
+
+	if status, _ := vaultGet(t, "GET", url+"/v1/secret/data/APP_A", ""); status != http.StatusForbidden {
+		t.Errorf("Read without a token returned %d, expected 403", status)
+	}
+	if status, _ := vaultGet(t, "GET", url+"/v1/secret/data/APP_A", "lbx_bogus"); status != http.StatusForbidden {
+		t.Errorf("Read with an unknown token returned %d, expected 403", status)
+	}
+
+	status, body := vaultGet(t, "GET", url+"/v1/secret/data/APP_A", tok)
+	if status != http.StatusOK {
+		t.Fatalf("Read returned %d: %v", status, body)
+	}
+	data := body["data"].(map[string]any)
+	if v := data["data"].(map[string]any)["value"]; v != "alpha" {
+		t.Errorf("Expected value alpha, got %v", v)
+	}
+	if v := data["metadata"].(map[string]any)["version"]; v != float64(1) {
+		t.Errorf("Expected version 1, got %v", v)
+	}
+
+	if status, _ := vaultGet(t, "GET", url+"/v1/secret/data/APP_B", tok); status != http.StatusForbidden {
+		t.Errorf("Read of an ungranted key returned %d, expected 403", status)
+	}
+
+	store.AddPolicy("token:ci", "MISSING", "reader")
+	if status, _ := vaultGet(t, "GET", url+"/v1/secret/data/MISSING", tok); status != http.StatusNotFound {
+		t.Errorf("Read of a missing key returned %d, expected 404", status)
+	}
+
+	// Expired secrets read as missing
+	store.AddPolicy("token:ci", "APP_B", "reader")
+	store.SetExpiry("APP_B", time.Now().Add(-time.Second))
+	if status, body := vaultGet(t, "GET", url+"/v1/secret/data/APP_B", tok); status != http.StatusNotFound {
+		t.Errorf("Read of an expired key returned %d, expected 404: %v", status, body)
+	}
+	if status, _ := vaultGet(t, "GET", url+"/v1/secret/metadata/APP_B", tok); status != http.StatusNotFound {
+		t.Errorf("Metadata of an expired key returned %d, expected 404", status)
+	}
+	store.RemovePolicy("token:ci", "APP_B", "reader")
+
+	status, body = vaultGet(t, "LIST", url+"/v1/secret/metadata/", tok)
+	if status != http.StatusOK {
+		t.Fatalf("List returned %d: %v", status, body)
+	}
+	keys := body["data"].(map[string]any)["keys"].([]any)
+	if len(keys) != 1 || keys[0] != "APP_A" {
+		t.Errorf("Expected only APP_A to be listed, got %v", keys)
+	}
+
+	if status, _ := vaultGet(t, "POST", url+"/v1/secret/data/APP_A", tok); status != http.StatusMethodNotAllowed {
+		t.Errorf("Write returned %d, expected 405", status)
+	}
+
+	status, body = vaultGet(t, "GET", url+"/v1/sys/internal/ui/mounts/secret/APP_A", tok)
+	if status != http.StatusOK || body["data"].(map[string]any)["options"].(map[string]any)["version"] != "2" {
+		t.Errorf("Unexpected mount info: %d %v", status, body)
+	}
+}
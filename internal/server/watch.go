@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// watchInterval is how often a blocking query polls the store revision.
+// Polling also picks up writes made by other lockbox processes.
+var watchInterval = 250 * time.Millisecond
+
+// waitForRevision blocks until the store revision differs from index, wait
+// elapses or ctx is done, and returns the current revision
+func waitForRevision(ctx context.Context, store *db.Store, index uint64, wait time.Duration) (uint64, error) {
+	rev, err := store.Revision()
+	if err != nil || rev != index || wait <= 0 {
+		return rev, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return rev, nil
+		case <-timer.C:
+			return rev, nil
+		case <-ticker.C:
+			if rev, err = store.Revision(); err != nil || rev != index {
+				return rev, err
+			}
+		}
+	}
+}
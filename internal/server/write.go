@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/rbac"
+)
+
+// writeResult is the response to POST /secrets
+type writeResult struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+}
+
+// handlePutSecret sets /secrets/:key to the request body, returning 201
+// when the secret is new and 204 when it was overwritten
+func (s *Server) handlePutSecret(w http.ResponseWriter, r *http.Request) {
+	key, ok := secretKey(w, r)
+	if !ok {
+		return
+	}
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+
+	result, status, err := s.setSecrets(r, map[string]string{key: string(value)})
+	clear(value)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if len(result.Created) > 0 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetSecrets sets every secret in a JSON object of keys to values in
+// one transaction: either all are written or none are
+func (s *Server) handleSetSecrets(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected a JSON object with content type application/json"))
+		return
+	}
+	var secrets map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&secrets); err != nil {
+		writeError(w, bodyStatus(err), fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if len(secrets) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no secrets given"))
+		return
+	}
+	for key := range secrets {
+		if err := ValidateKey(key); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	result, status, err := s.setSecrets(r, secrets)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleDeleteSecret deletes /secrets/:key, returning 204
+func (s *Server) handleDeleteSecret(w http.ResponseWriter, r *http.Request) {
+	key, ok := secretKey(w, r)
+	if !ok {
+		return
+	}
+	if status, err := s.authorizeWrite(r, []string{key}); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	actor, err := s.writer(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tx, err := s.store.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.SecretOwner(key); err == db.ErrNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("secret '%s' not found", key))
+		return
+	}
+	if _, err := batch.Execute(tx, nil, actor, batch.Command{Op: "delete", Key: key}); err != nil {
+		writeError(w, writeStatus(err), err)
+		return
+	}
+	if err := tx.Audit(identity(r), "secret-deleted", s.store.Qualify(key)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.invalidate(key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setSecrets writes secrets in one transaction as the requesting peer. It
+// fails with the status to respond with unless the peer may write every
+// key.
+func (s *Server) setSecrets(r *http.Request, secrets map[string]string) (writeResult, int, error) {
+	result := writeResult{Created: []string{}, Updated: []string{}}
+	keys := slices.Sorted(maps.Keys(secrets))
+	if status, err := s.authorizeWrite(r, keys); err != nil {
+		return result, status, err
+	}
+	actor, err := s.writer(r)
+	if err != nil {
+		return result, http.StatusInternalServerError, err
+	}
+
+	tx, err := s.store.Begin()
+	if err != nil {
+		return result, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		_, err := tx.SecretOwner(key)
+		if err != nil && err != db.ErrNotFound {
+			return result, http.StatusInternalServerError, err
+		}
+		created := err == db.ErrNotFound
+
+		value := secrets[key]
+		if _, err := batch.Execute(tx, s.key, actor, batch.Command{Op: "set", Key: key, Value: &value}); err != nil {
+			return result, writeStatus(err), err
+		}
+		if err := tx.Audit(identity(r), "secret-set", s.store.Qualify(key)); err != nil {
+			return result, http.StatusInternalServerError, err
+		}
+		if created {
+			result.Created = append(result.Created, key)
+		} else {
+			result.Updated = append(result.Updated, key)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, http.StatusInternalServerError, err
+	}
+	for _, key := range keys {
+		s.invalidate(key)
+	}
+	return result, http.StatusOK, nil
+}
+
+// authorizeWrite fails with 403 unless the requesting peer holds the write
+// permission on every key
+func (s *Server) authorizeWrite(r *http.Request, keys []string) (int, error) {
+	allowed, err := s.allowedKeys(r, rbac.Write, keys)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, key := range keys {
+		if !slices.Contains(allowed, key) {
+			return http.StatusForbidden, fmt.Errorf("write access to secret '%s' denied", key)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// writer returns the actor the requesting peer writes as. Secrets it
+// creates are owned by its token or unix socket user. Unrestricted peers
+// and holders of the admin permission may modify secrets owned by anyone.
+func (s *Server) writer(r *http.Request) (batch.Actor, error) {
+	var actor batch.Actor
+	cred, isPeer := PeerCredFromContext(r.Context())
+	if t, ok := tokenFromContext(r.Context()); ok {
+		actor.Owner = policy.TokenSubject(t.Name)
+	} else if isPeer {
+		actor.Owner = policy.UserSubject(cred.UID)
+	}
+
+	if unrestricted(r) {
+		if isPeer {
+			actor.Subjects = policy.NewIdentity(cred.UID, cred.GID).Subjects()
+		}
+		actor.Admin = true
+		return actor, nil
+	}
+	e, subjects, err := s.evaluator(r)
+	if err != nil {
+		return actor, err
+	}
+	actor.Subjects, actor.Admin = subjects, e.Granted(subjects, rbac.Admin)
+	return actor, nil
+}
+
+// invalidate drops the cached value of key after it was written
+func (s *Server) invalidate(key string) {
+	if s.opts.Cache != nil {
+		s.opts.Cache.Invalidate(s.store.Qualify(key))
+	}
+}
+
+// writeStatus returns the status to respond with when a write fails with
+// err
+func writeStatus(err error) int {
+	var owned *batch.OwnerError
+	if errors.As(err, &owned) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// bodyStatus returns the status to respond with when reading the request
+// body fails with err
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// writeError responds with status and err
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "Error: %v", err)
+}
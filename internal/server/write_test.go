@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/token"
+)
+
+func TestWriteEndpoints(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+	store.CreateVault("prod")
+
+	key, _ := crypto.GenerateKey()
+	handler := New(store, key, Options{Cache: NewCache(16, time.Minute)})
+
+	// do issues a request as the server's own user on the unix socket
+	do := func(method, path, contentType, body string) (int, string) {
+		t.Helper()
+		ctx := context.WithValue(context.Background(), peerCredKey{}, PeerCred{UID: uint32(os.Getuid())})
+		req := httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := do("PUT", "/secrets/API_KEY", "text/plain", "v1"); code != http.StatusCreated {
+		t.Errorf("PUT of a new key returned %d, expected 201", code)
+	}
+	if _, body := do("GET", "/secrets/API_KEY", "", ""); body != "v1" {
+		t.Errorf("GET after PUT = %q", body)
+	}
+	// The cached value is dropped on overwrite
+	if code, _ := do("PUT", "/secrets/API_KEY", "text/plain", "v2"); code != http.StatusNoContent {
+		t.Errorf("PUT of an existing key returned %d, expected 204", code)
+	}
+	if _, body := do("GET", "/secrets/API_KEY", "", ""); body != "v2" {
+		t.Errorf("GET after overwrite = %q", body)
+	}
+
+	code, body := do("POST", "/secrets", "application/json", `{"DB_USER":"app","API_KEY":"v3"}`)
+	if code != http.StatusOK || body != `{"created":["DB_USER"],"updated":["API_KEY"]}`+"\n" {
+		t.Errorf("POST returned %d %s", code, body)
+	}
+	// Bulk writes are all or nothing
+	if code, _ := do("POST", "/secrets", "application/json", `{"OK_KEY":"x","../BAD":"y"}`); code != http.StatusBadRequest {
+		t.Errorf("POST with an invalid key returned %d, expected 400", code)
+	}
+	if _, err := store.GetSecret("OK_KEY"); err != db.ErrNotFound {
+		t.Error("Rejected bulk write was partly applied")
+	}
+	if code, _ := do("POST", "/secrets", "application/json", `{}`); code != http.StatusBadRequest {
+		t.Errorf("Empty POST returned %d, expected 400", code)
+	}
+	if code, _ := do("POST", "/secrets", "text/plain", `{"DB_USER":"x"}`); code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST of text/plain returned %d, expected 415", code)
+	}
+
+	if code, _ := do("DELETE", "/secrets/API_KEY", "", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE returned %d, expected 204", code)
+	}
+	if code, _ := do("GET", "/secrets/API_KEY", "", ""); code != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d, expected 404", code)
+	}
+	if code, _ := do("DELETE", "/secrets/API_KEY", "", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing key returned %d, expected 404", code)
+	}
+	if code, _ := do("PATCH", "/secrets/DB_USER", "text/plain", "x"); code != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH returned %d, expected 405", code)
+	}
+
+	// Named vaults take writes too
+	if code, _ := do("PUT", "/vaults/prod/secrets/DB_URL", "text/plain", "postgres://prod"); code != http.StatusCreated {
+		t.Errorf("PUT in a vault returned %d, expected 201", code)
+	}
+	if _, err := store.InVault("prod").GetSecret("DB_URL"); err != nil {
+		t.Errorf("PUT in a vault did not write to it: %v", err)
+	}
+
+	events, _ := store.AuditEvents("secret-set")
+	if len(events) != 5 {
+		t.Errorf("Expected 5 secret-set audit events, got %d", len(events))
+	}
+}
+
+func TestWritePolicies(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	key, _ := crypto.GenerateKey()
+	store.AddPolicy("uid:54321", "APP_*", "operator")
+	store.AddPolicy("uid:54321", "DB_*", "reader")
+	store.AddPolicy("uid:54322", "APP_*", "operator")
+	handler := New(store, key, Options{})
+
+	// do issues a request as if it arrived on the unix socket from uid
+	do := func(uid uint32, method, path, body string) int {
+		ctx := context.WithValue(context.Background(), peerCredKey{}, PeerCred{UID: uid, GID: uid})
+		req := httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Content-Type", "text/plain")
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(54321, "PUT", "/secrets/APP_TOKEN", "x"); code != http.StatusCreated {
+		t.Errorf("Operator PUT returned %d, expected 201", code)
+	}
+	if owner, _ := store.SecretOwner("APP_TOKEN"); owner != "uid:54321" {
+		t.Errorf("Secret written by a peer is owned by %q", owner)
+	}
+	if code := do(54321, "PUT", "/secrets/DB_PASSWORD", "x"); code != http.StatusForbidden {
+		t.Errorf("Reader PUT returned %d, expected 403", code)
+	}
+	if code := do(54321, "POST", "/secrets", `{"APP_A":"1","DB_B":"2"}`); code != http.StatusForbidden {
+		t.Errorf("Bulk write with an ungranted key returned %d, expected 403", code)
+	}
+	if _, err := store.GetSecret("APP_A"); err != db.ErrNotFound {
+		t.Error("Denied bulk write was partly applied")
+	}
+
+	// Write permission does not override ownership
+	if code := do(54322, "PUT", "/secrets/APP_TOKEN", "y"); code != http.StatusForbidden {
+		t.Errorf("Overwriting another user's secret returned %d, expected 403", code)
+	}
+	if code := do(54322, "DELETE", "/secrets/APP_TOKEN", ""); code != http.StatusForbidden {
+		t.Errorf("Deleting another user's secret returned %d, expected 403", code)
+	}
+	if code := do(uint32(os.Getuid()), "DELETE", "/secrets/APP_TOKEN", ""); code != http.StatusNoContent {
+		t.Errorf("Server's own user could not delete: %d", code)
+	}
+}
+
+func TestTCPWrites(t *testing.T) {
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+	store.SetSecret("API_KEY", []byte("x"))
+
+	tok, _ := token.Generate()
+	store.CreateToken(db.Token{Name: "ci"}, token.Hash(tok), "")
+	store.AddPolicy("token:ci", "*", "operator")
+
+	key, _ := crypto.GenerateKey()
+	handler := New(store, key, Options{})
+
+	// do issues a request over TCP as a page or client would
+	do := func(method, remote, host, path string, header map[string]string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader("v")).WithContext(context.Background())
+		req.RemoteAddr = remote
+		req.Host = host
+		req.Header.Set("Content-Type", "text/plain")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		name, method, remote, host string
+		header                     map[string]string
+		status                     int
+	}{
+		{"tokenless read", "GET", "127.0.0.1:40000", "127.0.0.1:9876", nil, http.StatusNotFound},
+		{"tokenless write", "PUT", "127.0.0.1:40000", "127.0.0.1:9876", nil, http.StatusUnauthorized},
+		{"tokenless write to localhost", "PUT", "[::1]:40000", "localhost", nil, http.StatusUnauthorized},
+		{"tokenless read of a rebound name", "GET", "127.0.0.1:40000", "attacker.example:9876", nil, http.StatusForbidden},
+		{"tokenless read from another machine", "GET", "192.168.1.20:40000", "localhost:9876", nil, http.StatusForbidden},
+		{"cross-origin write", "PUT", "127.0.0.1:40000", "127.0.0.1:9876", map[string]string{"Origin": "http://attacker.example", "Authorization": "Bearer " + tok}, http.StatusForbidden},
+		{"same-origin write", "PUT", "127.0.0.1:40000", "127.0.0.1:9876", map[string]string{"Origin": "http://127.0.0.1:9876", "Authorization": "Bearer " + tok}, http.StatusCreated},
+		{"token write", "PUT", "[::1]:40000", "[::1]:9876", map[string]string{"Authorization": "Bearer " + tok}, http.StatusNoContent},
+		{"token write from another machine", "PUT", "192.168.1.20:40000", "192.168.1.10:9876", map[string]string{"Authorization": "Bearer " + tok}, http.StatusNoContent},
+	} {
+		if code := do(tc.method, tc.remote, tc.host, "/secrets/NEW_KEY", tc.header); code != tc.status {
+			t.Errorf("%s returned %d, expected %d", tc.name, code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package setup captures how a workstation's stores are configured, so the
+// same setup can be applied on another machine: the profiles and their
+// vaults, roles, policies, rotation rules and notification targets, and
+// the remotes logged in to.
+//
+// A setup never holds secret values. Notification targets, whose webhook
+// URLs embed credentials, name the secret holding the URL instead, and
+// applying the setup reads the URL from that secret.
+package setup
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/notify"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/rbac"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+// Format identifies the setup file format
+const Format = "lockbox-setup/1"
+
+// DefaultProfile names the default store
+const DefaultProfile = "default"
+
+// Setup is a workstation's configuration
+type Setup struct {
+	Format string `json:"format"`
+	// Remotes are the servers to log in to with 'lockbox login'
+	Remotes  []string  `json:"remotes,omitempty"`
+	Profiles []Profile `json:"profiles"`
+}
+
+// Profile is the configuration of one store
+type Profile struct {
+	// Name is the profile, DefaultProfile for the default store
+	Name     string     `json:"name"`
+	Vaults   []string   `json:"vaults,omitempty"`
+	Roles    []Role     `json:"roles,omitempty"`
+	Policies []Policy   `json:"policies,omitempty"`
+	Rotation []Rotation `json:"rotation,omitempty"`
+	Notify   []Notify   `json:"notify,omitempty"`
+}
+
+// Role is a custom role
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// Policy grants a subject a role on keys matching a pattern
+type Policy struct {
+	Subject string `json:"subject"`
+	Pattern string `json:"pattern"`
+	Role    string `json:"role"`
+}
+
+// Rotation is a rotation rule, its interval written as in
+// 'lockbox rotation add --every'
+type Rotation struct {
+	Key       string `json:"key"`
+	Every     string `json:"every"`
+	Generator string `json:"generator,omitempty"`
+	Hook      string `json:"hook,omitempty"`
+	Rotator   string `json:"rotator,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	User      string `json:"user,omitempty"`
+}
+
+// Notify is a notification target
+type Notify struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// URLSecret is the key of the secret holding the webhook URL
+	URLSecret string   `json:"url_secret"`
+	Events    []string `json:"events,omitempty"`
+}
+
+// URLSecret returns the conventional key of the secret holding the URL of
+// the notification target called name, such as NOTIFY_OPS_SLACK_URL
+func URLSecret(name string) string {
+	return "NOTIFY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_URL"
+}
+
+// formatEvery writes d in days when it is whole days
+func formatEvery(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// Export returns the configuration of store as the profile called name.
+// The warnings name notification targets whose URL secret the store does
+// not hold, so the setup could not be applied from it as it is.
+func Export(store *db.Store, encKey []byte, name string) (Profile, []string, error) {
+	p := Profile{Name: name}
+	var warnings []string
+
+	vaults, err := store.ListVaults()
+	if err != nil {
+		return p, nil, err
+	}
+	for _, v := range vaults {
+		p.Vaults = append(p.Vaults, v.Name)
+	}
+
+	roles, err := store.ListRoles()
+	if err != nil {
+		return p, nil, err
+	}
+	for _, r := range roles {
+		p.Roles = append(p.Roles, Role{Name: r.Name, Permissions: r.Permissions})
+	}
+
+	policies, err := store.ListPolicies()
+	if err != nil {
+		return p, nil, err
+	}
+	for _, pol := range policies {
+		p.Policies = append(p.Policies, Policy{Subject: pol.Subject, Pattern: pol.Pattern, Role: pol.Role})
+	}
+
+	rules, err := rotation.List(store)
+	if err != nil {
+		return p, nil, err
+	}
+	for _, r := range rules {
+		p.Rotation = append(p.Rotation, Rotation{
+			Key: r.Key, Every: formatEvery(r.Every), Generator: r.Generator, Hook: r.Hook,
+			Rotator: r.Rotator, SecretKey: r.SecretKey, User: r.User,
+		})
+	}
+
+	targets, err := notify.List(store, encKey)
+	if err != nil {
+		return p, nil, err
+	}
+	for _, t := range targets {
+		n := Notify{Name: t.Name, Kind: t.Kind, URLSecret: URLSecret(t.Name), Events: t.Events}
+		if url, err := secretValue(store, encKey, n.URLSecret); err != nil || url != t.URL {
+			warnings = append(warnings, fmt.Sprintf("profile %s: notification target '%s' reads its URL from secret '%s', which does not hold it; set it with '%s'", name, t.Name, n.URLSecret, setCommand(name, n.URLSecret)))
+		}
+		p.Notify = append(p.Notify, n)
+	}
+	return p, warnings, nil
+}
+
+// setCommand returns the command setting key in the store of profile
+func setCommand(profile, key string) string {
+	if profile == DefaultProfile {
+		return "lockbox set " + key
+	}
+	return "lockbox --profile " + profile + " set " + key
+}
+
+// secretValue returns the decrypted value of the secret key
+func secretValue(store *db.Store, encKey []byte, key string) (string, error) {
+	encrypted, err := store.GetSecret(key)
+	if err != nil {
+		return "", err
+	}
+	value, err := crypto.Decrypt(encrypted, encKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret '%s': %w", key, err)
+	}
+	return string(value), nil
+}
+
+// Result is what Apply changed
+type Result struct {
+	Vaults, Roles, Policies, Rotation, Notify int
+	// Warnings are things that will not work on this machine as they are,
+	// such as missing hooks
+	Warnings []string
+}
+
+// Apply configures store as p says, adding to its configuration: vaults,
+// roles, policies, rules and targets it names are created or replaced,
+// and others are kept. Everything is checked before anything is written.
+func Apply(store *db.Store, encKey []byte, p Profile, now time.Time) (Result, error) {
+	var r Result
+	fail := func(format string, args ...any) (Result, error) {
+		return Result{}, fmt.Errorf("profile %s: %s", p.Name, fmt.Sprintf(format, args...))
+	}
+
+	existing, err := store.ListVaults()
+	if err != nil {
+		return r, err
+	}
+	var vaults []string
+	for _, v := range p.Vaults {
+		if err := db.ValidateVault(v); err != nil {
+			return fail("%v", err)
+		}
+		if !slices.ContainsFunc(existing, func(e db.Vault) bool { return e.Name == v }) {
+			vaults = append(vaults, v)
+		}
+	}
+
+	roles := map[string]bool{}
+	for _, role := range p.Roles {
+		if err := rbac.ValidateName(role.Name); err != nil {
+			return fail("%v", err)
+		}
+		if _, err := rbac.ParsePermissions(strings.Join(role.Permissions, ",")); err != nil {
+			return fail("role %s: %v", role.Name, err)
+		}
+		roles[role.Name] = true
+	}
+	custom, err := store.ListRoles()
+	if err != nil {
+		return r, err
+	}
+	for _, role := range custom {
+		roles[role.Name] = true
+	}
+	for _, pol := range p.Policies {
+		if err := policy.ValidateSubject(pol.Subject); err != nil {
+			return fail("%v", err)
+		}
+		if err := policy.ValidatePattern(pol.Pattern); err != nil {
+			return fail("%v", err)
+		}
+		if !rbac.IsBuiltin(pol.Role) && !roles[pol.Role] {
+			return fail("policy for %s names unknown role '%s'", pol.Subject, pol.Role)
+		}
+	}
+
+	current, err := rotation.List(store)
+	if err != nil {
+		return r, err
+	}
+	var rules []rotation.Rule
+	for _, rot := range p.Rotation {
+		every, err := rotation.ParseEvery(rot.Every)
+		if err != nil {
+			return fail("rotation of %s: %v", rot.Key, err)
+		}
+		if rot.Rotator == "" {
+			if err := rotation.CheckSpec(rot.Generator); err != nil {
+				return fail("rotation of %s: %v", rot.Key, err)
+			}
+		} else if rot.Rotator != rotation.AWSIAM {
+			return fail("rotation of %s: unknown rotator '%s'", rot.Key, rot.Rotator)
+		}
+		rule := rotation.Rule{
+			Key: rot.Key, Every: every, Generator: rot.Generator, Hook: rot.Hook,
+			Rotator: rot.Rotator, SecretKey: rot.SecretKey, User: rot.User, Created: now.UTC(),
+		}
+		// Replacing a rule keeps its schedule
+		if i := slices.IndexFunc(current, func(c rotation.Rule) bool { return c.Key == rot.Key }); i >= 0 {
+			rule.Created, rule.LastRotated = current[i].Created, current[i].LastRotated
+		}
+		if rule.Hook != "" {
+			if info, err := os.Stat(rule.Hook); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				r.Warnings = append(r.Warnings, fmt.Sprintf("profile %s: hook '%s' of %s is not an executable file here", p.Name, rule.Hook, rule.Key))
+			}
+		}
+		for _, key := range []string{rule.Key, rule.SecretKey} {
+			if _, err := store.GetSecret(key); key != "" && err != nil {
+				r.Warnings = append(r.Warnings, fmt.Sprintf("profile %s: rotated secret '%s' is not set yet", p.Name, key))
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	var targets []notify.Target
+	for _, n := range p.Notify {
+		if n.URLSecret == "" {
+			return fail("notification target '%s' names no url_secret", n.Name)
+		}
+		url, err := secretValue(store, encKey, n.URLSecret)
+		if err == db.ErrNotFound {
+			return fail("notification target '%s' reads its URL from secret '%s', which is not set; set it first with '%s'", n.Name, n.URLSecret, setCommand(p.Name, n.URLSecret))
+		} else if err != nil {
+			return r, err
+		}
+		t := notify.Target{Name: n.Name, Kind: n.Kind, URL: url, Events: n.Events}
+		if err := t.Validate(); err != nil {
+			return fail("notification target '%s': %v", n.Name, err)
+		}
+		targets = append(targets, t)
+	}
+
+	for _, v := range vaults {
+		if err := store.CreateVault(v); err != nil {
+			return r, err
+		}
+		r.Vaults++
+	}
+	for _, role := range p.Roles {
+		perms, _ := rbac.ParsePermissions(strings.Join(role.Permissions, ","))
+		if err := store.SetRole(role.Name, perms); err != nil {
+			return r, err
+		}
+		r.Roles++
+	}
+	for _, pol := range p.Policies {
+		if err := store.AddPolicy(pol.Subject, pol.Pattern, pol.Role); err != nil {
+			return r, err
+		}
+		r.Policies++
+	}
+	for _, rule := range rules {
+		if err := rotation.Save(store, rule); err != nil {
+			return r, err
+		}
+		r.Rotation++
+	}
+	for _, t := range targets {
+		if err := notify.Add(store, encKey, t); err != nil {
+			return r, err
+		}
+		r.Notify++
+	}
+	return r, nil
+}
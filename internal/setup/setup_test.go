@@ -0,0 +1,130 @@
+package setup
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/notify"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+func openStore(t *testing.T, name string) (*db.Store, []byte) {
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), name+".db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return store, key
+}
+
+func setSecret(t *testing.T, store *db.Store, key []byte, name, value string) {
+	encrypted, err := crypto.Encrypt([]byte(value), key)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if err := store.SetSecret(name, encrypted); err != nil {
+		t.Fatalf("SetSecret failed: %v", err)
+	}
+}
+
+func TestExportApply(t *testing.T) {
+	const hookURL = "https://hooks.slack.com/services/T0/B0/secret"
+	src, srcKey := openStore(t, "src")
+	src.CreateVault("staging")
+	src.SetRole("deployer", []string{"read", "write"})
+	src.AddPolicy("gid:100", "DEPLOY_*", "deployer")
+	src.AddPolicy("token:ci", "CI_*", "reader")
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rotation.Save(src, rotation.Rule{Key: "DB_PASSWORD", Every: 30 * 24 * time.Hour, Generator: "random:32", Created: created})
+	if err := notify.Add(src, srcKey, notify.Target{Name: "ops", Kind: "slack", URL: hookURL, Events: []string{"rotation"}}); err != nil {
+		t.Fatalf("notify.Add failed: %v", err)
+	}
+
+	// The URL is not yet held by a secret of its own
+	p, warnings, err := Export(src, srcKey, DefaultProfile)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "NOTIFY_OPS_URL") {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+	setSecret(t, src, srcKey, "NOTIFY_OPS_URL", hookURL)
+	if p, warnings, err = Export(src, srcKey, DefaultProfile); err != nil || len(warnings) != 0 {
+		t.Fatalf("Export = %v, %v", warnings, err)
+	}
+	want := Profile{
+		Name:     DefaultProfile,
+		Vaults:   []string{"staging"},
+		Roles:    []Role{{Name: "deployer", Permissions: []string{"read", "write"}}},
+		Policies: []Policy{{Subject: "gid:100", Pattern: "DEPLOY_*", Role: "deployer"}, {Subject: "token:ci", Pattern: "CI_*", Role: "reader"}},
+		Rotation: []Rotation{{Key: "DB_PASSWORD", Every: "30d", Generator: "random:32"}},
+		Notify:   []Notify{{Name: "ops", Kind: "slack", URLSecret: "NOTIFY_OPS_URL", Events: []string{"rotation"}}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("Unexpected profile:\n%+v\nexpected\n%+v", p, want)
+	}
+
+	// Applying needs the URL secret on the new machine
+	dst, dstKey := openStore(t, "dst")
+	if _, err := Apply(dst, dstKey, p, time.Now()); err == nil || !strings.Contains(err.Error(), "NOTIFY_OPS_URL") {
+		t.Fatalf("Apply without the URL secret = %v", err)
+	}
+	if vaults, _ := dst.ListVaults(); len(vaults) != 0 {
+		t.Fatalf("A failed Apply created vaults %v", vaults)
+	}
+	setSecret(t, dst, dstKey, "NOTIFY_OPS_URL", hookURL)
+	r, err := Apply(dst, dstKey, p, time.Now())
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if r.Vaults != 1 || r.Roles != 1 || r.Policies != 2 || r.Rotation != 1 || r.Notify != 1 {
+		t.Errorf("Unexpected result %+v", r)
+	}
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "DB_PASSWORD") {
+		t.Errorf("Unexpected warnings %q", r.Warnings)
+	}
+	got, _, err := Export(dst, dstKey, DefaultProfile)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Applied profile exports as %+v, %v", got, err)
+	}
+
+	// Applying again changes nothing, and keeps the rule's schedule
+	rules, _ := rotation.List(dst)
+	if _, err := Apply(dst, dstKey, p, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Second Apply failed: %v", err)
+	}
+	again, _ := rotation.List(dst)
+	if !again[0].Created.Equal(rules[0].Created) {
+		t.Errorf("Apply moved the rule's schedule from %v to %v", rules[0].Created, again[0].Created)
+	}
+}
+
+func TestApplyRejects(t *testing.T) {
+	store, key := openStore(t, "store")
+	for _, tc := range []struct {
+		profile Profile
+		err     string
+	}{
+		{Profile{Vaults: []string{"bad name"}}, "invalid vault"},
+		{Profile{Roles: []Role{{Name: "admin", Permissions: []string{"read"}}}}, "built-in role"},
+		{Profile{Policies: []Policy{{Subject: "uid:1", Pattern: "*", Role: "ghost"}}}, "unknown role 'ghost'"},
+		{Profile{Policies: []Policy{{Subject: "bob", Pattern: "*", Role: "reader"}}}, "invalid subject"},
+		{Profile{Rotation: []Rotation{{Key: "K", Every: "30s", Generator: "random:32"}}}, "invalid interval"},
+		{Profile{Rotation: []Rotation{{Key: "K", Every: "1d", Generator: "magic"}}}, "rotation of K"},
+		{Profile{Notify: []Notify{{Name: "ops", Kind: "slack"}}}, "no url_secret"},
+	} {
+		tc.profile.Name = "test"
+		if _, err := Apply(store, key, tc.profile, time.Now()); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Apply(%+v) = %v, expected %q", tc.profile, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signer := &Signer{Name: "SHA256:abc", Key: priv}
+	verifier := &Verifier{Name: "SHA256:abc", Key: pub}
+	now := time.Unix(1700000000, 0)
+
+	h := http.Header{}
+	signer.Sign(h, "GET", "/secrets/API_KEY", 200, []byte("value"), now)
+	if err := verifier.Verify(h, "GET", "/secrets/API_KEY", 200, []byte("value"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	for name, err := range map[string]error{
+		"body":   verifier.Verify(h, "GET", "/secrets/API_KEY", 200, []byte("other"), now),
+		"target": verifier.Verify(h, "GET", "/secrets/DB_PASSWORD", 200, []byte("value"), now),
+		"status": verifier.Verify(h, "GET", "/secrets/API_KEY", 404, []byte("value"), now),
+		"method": verifier.Verify(h, "HEAD", "/secrets/API_KEY", 200, []byte("value"), now),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("Verify with another %s = %v, expected an invalid signature", name, err)
+		}
+	}
+
+	if err := verifier.Verify(h, "GET", "/secrets/API_KEY", 200, []byte("value"), now.Add(10*time.Minute)); err == nil {
+		t.Error("Verify accepted a stale signature")
+	}
+	if err := (&Verifier{Name: "SHA256:xyz", Key: pub}).Verify(h, "GET", "/secrets/API_KEY", 200, []byte("value"), now); err == nil {
+		t.Error("Verify accepted a signature by another key name")
+	}
+	if err := verifier.Verify(http.Header{}, "GET", "/", 200, nil, now); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Verify of an unsigned response = %v, expected ErrUnsigned", err)
+	}
+	h.Set(Header, "garbage")
+	if err := verifier.Verify(h, "GET", "/secrets/API_KEY", 200, []byte("value"), now); err == nil {
+		t.Error("Verify accepted a malformed header")
+	}
+}
+
+func TestStream(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signer := &Signer{Name: "SHA256:abc", Key: priv}
+	verifier := &Verifier{Name: "SHA256:abc", Key: pub}
+	now := time.Unix(1700000000, 0)
+
+	st := signer.Stream("GET", "/env", 200, now)
+	st.Write([]byte("export A=\"1\"\n"))
+	st.Write([]byte("export B=\"2\"\n"))
+	trailer := http.Header{}
+	st.Sign(trailer)
+	body := []byte("export A=\"1\"\nexport B=\"2\"\n")
+	if err := verifier.Verify(trailer, "GET", "/env", 200, body, now); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := verifier.Verify(trailer, "GET", "/env", 200, body[:14], now); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("Verify of a truncated body = %v, expected an invalid signature", err)
+	}
+
+	// A streamed signature does not pass for a plain one
+	trailer.Set(Header, strings.Replace(trailer.Get(Header), "hash=sha512, ", "", 1))
+	if err := verifier.Verify(trailer, "GET", "/env", 200, body, now); err == nil {
+		t.Error("Verify accepted a streamed signature without its hash")
+	}
+}
@@ -0,0 +1,237 @@
+// Package stats summarises a store for monitoring scripts, in a stable
+// schema that cron jobs can alert on without parsing human output. Only
+// metadata is read; no value is decrypted.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/escrow"
+	"github.com/MQ37/lockbox/internal/health"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+// SchemaVersion is the version of the Stats schema. Fields may be added
+// within a version; renaming or removing one bumps it.
+const SchemaVersion = 1
+
+// SecretType is the type plain secrets are counted under in ByType; other
+// entries count under their kind, such as note
+const SecretType = "secret"
+
+// Stats describes one store
+type Stats struct {
+	SchemaVersion int       `json:"schema_version"`
+	Generated     time.Time `json:"generated"`
+	// Profile is the profile the store belongs to, or default
+	Profile string `json:"profile"`
+	// SizeBytes is the size of the database file
+	SizeBytes int64 `json:"size_bytes"`
+	// Secrets counts the plain secrets that have not expired, Expired
+	// those kept until pruned, and Temporary those deleted once they expire
+	Secrets   int `json:"secrets"`
+	Expired   int `json:"expired"`
+	Temporary int `json:"temporary"`
+	// ByType counts unexpired entries by type: secret, note and so on
+	ByType map[string]int `json:"by_type"`
+	// ByTag counts unexpired plain secrets by tag; Untagged those without
+	// any
+	ByTag    map[string]int `json:"by_tag"`
+	Untagged int            `json:"untagged"`
+	// ByProfile counts the unexpired secrets of every profile's store
+	ByProfile map[string]int `json:"by_profile"`
+	Versions  Versions       `json:"versions"`
+	// OldestRotation is the rotation rule that has gone longest without
+	// rotating; nil without rules
+	OldestRotation *Rotation `json:"oldest_rotation"`
+	// LastBackup is when the last backup succeeded; nil if never
+	LastBackup *time.Time `json:"last_backup"`
+}
+
+// Versions counts the versions a store keeps
+type Versions struct {
+	// Schema is the number of migrations applied to the store
+	Schema int `json:"schema"`
+	// Revision counts the writes made to the store
+	Revision uint64 `json:"revision"`
+	// Escrowed counts old values in the escrow archive; nil when escrow
+	// is off
+	Escrowed *int `json:"escrowed"`
+}
+
+// Rotation is a rotation rule and when it last rotated, or was created if
+// it never has
+type Rotation struct {
+	Key         string    `json:"key"`
+	LastRotated time.Time `json:"last_rotated"`
+	Next        time.Time `json:"next"`
+}
+
+// Collect gathers the stats of store, the store of profile. profiles
+// holds the secret counts of every profile, see CountProfiles.
+func Collect(store *db.Store, profile string, profiles map[string]int, now time.Time) (Stats, error) {
+	st := Stats{
+		SchemaVersion: SchemaVersion,
+		Generated:     now.UTC().Truncate(time.Second),
+		Profile:       profile,
+		ByType:        map[string]int{},
+		ByTag:         map[string]int{},
+		ByProfile:     profiles,
+	}
+
+	var err error
+	if st.SizeBytes, err = store.Size(); err != nil {
+		return st, err
+	}
+
+	kinds, err := store.CountKinds(now)
+	if err != nil {
+		return st, err
+	}
+	for kind, n := range kinds {
+		if kind == "" {
+			kind = SecretType
+		}
+		st.ByType[kind] = n
+	}
+
+	infos, err := store.ListSecretInfo()
+	if err != nil {
+		return st, err
+	}
+	for _, info := range infos {
+		if info.Expired(now) {
+			st.Expired++
+			continue
+		}
+		st.Secrets++
+		if len(info.Tags) == 0 {
+			st.Untagged++
+		}
+		for _, tag := range info.Tags {
+			st.ByTag[tag]++
+		}
+	}
+
+	temp, err := store.TempSecrets()
+	if err != nil {
+		return st, err
+	}
+	st.Temporary = len(temp)
+
+	status, err := db.Inspect(store.Path())
+	if err != nil {
+		return st, err
+	}
+	st.Versions.Schema = status.Version
+	if st.Versions.Revision, err = store.Revision(); err != nil {
+		return st, err
+	}
+	archive, err := escrow.Load(store)
+	if err != nil {
+		return st, err
+	}
+	if archive != nil {
+		entries, err := escrow.ReadFile(archive.Path)
+		if err != nil {
+			return st, err
+		}
+		n := len(entries)
+		st.Versions.Escrowed = &n
+	}
+
+	rules, err := rotation.List(store)
+	if err != nil {
+		return st, err
+	}
+	for _, r := range rules {
+		last := r.LastRotated
+		if last.IsZero() {
+			last = r.Created
+		}
+		if st.OldestRotation == nil || last.Before(st.OldestRotation.LastRotated) {
+			st.OldestRotation = &Rotation{Key: r.Key, LastRotated: last, Next: r.Next()}
+		}
+	}
+
+	if value, err := store.GetConfig(health.LastBackupConfigKey); err == nil {
+		last, err := time.Parse(time.RFC3339, string(value))
+		if err != nil {
+			return st, fmt.Errorf("invalid backup timestamp: %w", err)
+		}
+		st.LastBackup = &last
+	} else if err != db.ErrNotFound {
+		return st, err
+	}
+	return st, nil
+}
+
+// CountProfiles counts the unexpired secrets in the store of each profile
+// in paths, skipping profiles whose store has not been created
+func CountProfiles(paths map[string]string) (map[string]int, error) {
+	counts := map[string]int{}
+	for name, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		store, err := db.OpenStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open profile '%s': %w", name, err)
+		}
+		keys, err := store.ListSecrets()
+		store.Close()
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		counts[name] = len(keys)
+	}
+	return counts, nil
+}
+
+// WriteText writes st for people
+func WriteText(w io.Writer, st Stats) {
+	fmt.Fprintf(w, "Profile:      %s\n", st.Profile)
+	fmt.Fprintf(w, "Size:         %d bytes\n", st.SizeBytes)
+	fmt.Fprintf(w, "Secrets:      %d (%d expired, %d temporary)\n", st.Secrets, st.Expired, st.Temporary)
+	fmt.Fprintf(w, "Types:        %s\n", counts(st.ByType))
+	fmt.Fprintf(w, "Tags:         %s (%d untagged)\n", counts(st.ByTag), st.Untagged)
+	fmt.Fprintf(w, "Profiles:     %s\n", counts(st.ByProfile))
+	escrowed := "escrow off"
+	if st.Versions.Escrowed != nil {
+		escrowed = fmt.Sprintf("%d escrowed", *st.Versions.Escrowed)
+	}
+	fmt.Fprintf(w, "Versions:     schema %d, revision %d, %s\n", st.Versions.Schema, st.Versions.Revision, escrowed)
+	if r := st.OldestRotation; r != nil {
+		fmt.Fprintf(w, "Rotation:     %s last rotated %s, next %s\n", r.Key, r.LastRotated.Format(time.RFC3339), r.Next.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "Rotation:     no rules\n")
+	}
+	if st.LastBackup != nil {
+		fmt.Fprintf(w, "Last backup:  %s\n", st.LastBackup.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "Last backup:  never\n")
+	}
+}
+
+// counts formats counts as "name=N" pairs sorted by name
+func counts(m map[string]int) string {
+	if len(m) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, m[name])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/health"
+	"github.com/MQ37/lockbox/internal/rotation"
+)
+
+// newTestStore opens a store backed by a fresh temporary database
+func newTestStore(t *testing.T) *db.Store {
+	t.Helper()
+	store, err := db.OpenStore(t.TempDir() + "/lockbox.db")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestCollect(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	for _, key := range []string{"DB_PASS", "API_KEY", "OLD_TOKEN"} {
+		if err := store.SetSecret(key, []byte("encrypted")); err != nil {
+			t.Fatalf("SetSecret failed: %v", err)
+		}
+	}
+	if err := store.SetSecretMeta("DB_PASS", db.Meta{Tags: []string{"prod", "db"}}); err != nil {
+		t.Fatalf("SetSecretMeta failed: %v", err)
+	}
+	if err := store.SetExpiry("OLD_TOKEN", now.Add(-time.Hour)); err != nil {
+		t.Fatalf("SetExpiry failed: %v", err)
+	}
+	if err := store.SetKindSecret("note", "wifi", []byte("encrypted")); err != nil {
+		t.Fatalf("SetKindSecret failed: %v", err)
+	}
+
+	created := now.Add(-48 * time.Hour).Truncate(time.Second)
+	rules := []rotation.Rule{
+		{Key: "DB_PASS", Every: 24 * time.Hour, Generator: "random:32", Created: created},
+		{Key: "API_KEY", Every: 24 * time.Hour, Generator: "random:32", Created: created, LastRotated: now.Add(-time.Hour)},
+	}
+	for _, r := range rules {
+		if err := rotation.Save(store, r); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	backup := now.Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	store.SetConfig(health.LastBackupConfigKey, []byte(backup.Format(time.RFC3339)))
+
+	st, err := Collect(store, "default", map[string]int{"default": 2}, now)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	if st.SchemaVersion != SchemaVersion || st.Profile != "default" {
+		t.Errorf("Unexpected header: %+v", st)
+	}
+	if st.Secrets != 2 || st.Expired != 1 {
+		t.Errorf("Expected 2 secrets and 1 expired, got %d and %d", st.Secrets, st.Expired)
+	}
+	if st.ByType[SecretType] != 2 || st.ByType["note"] != 1 {
+		t.Errorf("Unexpected types: %v", st.ByType)
+	}
+	if st.ByTag["prod"] != 1 || st.ByTag["db"] != 1 || st.Untagged != 1 {
+		t.Errorf("Unexpected tags: %v, %d untagged", st.ByTag, st.Untagged)
+	}
+	if st.SizeBytes <= 0 {
+		t.Errorf("Expected a size, got %d", st.SizeBytes)
+	}
+	if st.Versions.Schema == 0 || st.Versions.Escrowed != nil {
+		t.Errorf("Unexpected versions: %+v", st.Versions)
+	}
+	if r := st.OldestRotation; r == nil || r.Key != "DB_PASS" || !r.LastRotated.Equal(created) {
+		t.Errorf("Expected DB_PASS as the oldest rotation, got %+v", r)
+	}
+	if st.LastBackup == nil || !st.LastBackup.Equal(backup) {
+		t.Errorf("Expected last backup %v, got %v", backup, st.LastBackup)
+	}
+}
+
+func TestCollectEmpty(t *testing.T) {
+	store := newTestStore(t)
+
+	st, err := Collect(store, "default", nil, time.Now())
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	// Monitoring reads these fields even when there is nothing to report
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	for _, name := range []string{"schema_version", "secrets", "expired", "by_type", "by_tag", "versions", "oldest_rotation", "last_backup"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Expected field %s in %s", name, data)
+		}
+	}
+	if fields["oldest_rotation"] != nil || fields["last_backup"] != nil {
+		t.Errorf("Expected null rotation and backup, got %s", data)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var b strings.Builder
+	WriteText(&b, Stats{Profile: "prod", ByProfile: map[string]int{"prod": 2, "default": 5}})
+
+	lines := strings.Split(b.String(), "\n")
+	if !slices.Contains(lines, "Profiles:     default=5 prod=2") {
+		t.Errorf("Expected sorted profile counts, got:\n%s", b.String())
+	}
+	if !slices.Contains(lines, "Last backup:  never") {
+		t.Errorf("Expected no backup, got:\n%s", b.String())
+	}
+}
@@ -0,0 +1,152 @@
+// Package table renders rows as aligned, optionally colored columns for
+// people, or as JSON for scripts, so commands offering --format share one
+// layout.
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/MQ37/lockbox/internal/output"
+)
+
+// Formats are the supported output formats
+var Formats = []string{"table", "json"}
+
+// Color highlights a cell on a terminal
+type Color int
+
+const (
+	None Color = iota
+	Green
+	Yellow
+	Red
+)
+
+// ansi are the escape sequences for each color
+var ansi = map[Color]string{Green: "\x1b[32m", Yellow: "\x1b[33m", Red: "\x1b[31m"}
+
+// Cell is one value in a row
+type Cell struct {
+	Text  string
+	Color Color
+	// Value is written in JSON instead of Text when set, e.g. a number
+	Value any
+}
+
+// Table is a set of rows under named columns
+type Table struct {
+	// Columns name the fields of JSON records
+	Columns []string
+	// Headers title the columns of table output; the upper-cased column
+	// names are used when nil
+	Headers []string
+	Rows    [][]Cell
+}
+
+// Add appends a row
+func (t *Table) Add(cells ...Cell) {
+	t.Rows = append(t.Rows, cells)
+}
+
+// Write renders t to w in format. Table output is colored when color is
+// set; JSON output is an array of objects keyed by column name.
+func (t *Table) Write(w io.Writer, format string, color bool) error {
+	switch format {
+	case "table":
+		return t.writeTable(w, color)
+	case "json":
+		return t.writeJSON(w)
+	}
+	return fmt.Errorf("unknown format '%s' (supported: %s)", format, strings.Join(Formats, ", "))
+}
+
+func (t *Table) writeTable(w io.Writer, color bool) error {
+	header := make([]Cell, len(t.Columns))
+	for i, c := range t.Columns {
+		header[i] = Cell{Text: strings.ToUpper(c)}
+		if i < len(t.Headers) {
+			header[i].Text = t.Headers[i]
+		}
+	}
+
+	widths := make([]int, len(t.Columns))
+	for i, c := range header {
+		widths[i] = utf8.RuneCountInString(c.Text)
+	}
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell.Text))
+		}
+	}
+
+	var b strings.Builder
+	line := func(cells []Cell) {
+		for i, cell := range cells {
+			text := cell.Text
+			if i < len(cells)-1 {
+				text += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(text)+2)
+			}
+			if color && cell.Color != None {
+				// Pad outside the escape codes so columns stay aligned
+				trimmed := strings.TrimRight(text, " ")
+				text = ansi[cell.Color] + trimmed + "\x1b[0m" + text[len(trimmed):]
+			}
+			b.WriteString(text)
+		}
+		b.WriteByte('\n')
+	}
+
+	line(header)
+	for _, row := range t.Rows {
+		line(row)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (t *Table) writeJSON(w io.Writer) error {
+	records := []json.RawMessage{}
+	for _, row := range t.Rows {
+		// Build each object by hand to keep the column order
+		var b strings.Builder
+		b.WriteByte('{')
+		for i, cell := range row {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			var value any = cell.Text
+			if cell.Value != nil {
+				value = cell.Value
+			}
+			name, _ := json.Marshal(t.Columns[i])
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			b.Write(name)
+			b.WriteByte(':')
+			b.Write(data)
+		}
+		b.WriteByte('}')
+		records = append(records, json.RawMessage(b.String()))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// ColorEnabled reports whether output to f should be colored: f is a
+// terminal, NO_COLOR is unset, TERM is not "dumb" and plain mode is off
+func ColorEnabled(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || output.Plain() {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
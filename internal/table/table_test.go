@@ -0,0 +1,56 @@
+package table
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	tbl := Table{Columns: []string{"key", "age_days", "status"}, Headers: []string{"KEY", "AGE"}}
+	tbl.Add(Cell{Text: "API_KEY"}, Cell{Text: "3d", Value: 3}, Cell{Text: "fresh", Color: Green})
+	tbl.Add(Cell{Text: "DB"}, Cell{Text: "120d", Value: 120}, Cell{Text: "stale", Color: Red})
+
+	var buf bytes.Buffer
+	tbl.Write(&buf, "table", false)
+	want := "KEY      AGE   STATUS\n" +
+		"API_KEY  3d    fresh\n" +
+		"DB       120d  stale\n"
+	if buf.String() != want {
+		t.Errorf("Unexpected table:\n%q\nexpected\n%q", buf.String(), want)
+	}
+
+	buf.Reset()
+	tbl.Write(&buf, "table", true)
+	if !bytes.Contains(buf.Bytes(), []byte("\x1b[31mstale\x1b[0m\n")) {
+		t.Errorf("Expected a red status cell:\n%q", buf.String())
+	}
+
+	buf.Reset()
+	tbl.Write(&buf, "json", true)
+	wantJSON := `[
+  {
+    "key": "API_KEY",
+    "age_days": 3,
+    "status": "fresh"
+  },
+  {
+    "key": "DB",
+    "age_days": 120,
+    "status": "stale"
+  }
+]
+`
+	if buf.String() != wantJSON {
+		t.Errorf("Unexpected JSON:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	(&Table{Columns: []string{"key"}}).Write(&buf, "json", false)
+	if buf.String() != "[]\n" {
+		t.Errorf("Expected an empty array, got %q", buf.String())
+	}
+
+	if err := tbl.Write(&buf, "yaml", false); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
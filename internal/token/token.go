@@ -0,0 +1,58 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// prefix marks lockbox tokens so they are recognisable in configs and logs
+const prefix = "lbx_"
+
+// Generate returns a new random token
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// Hash returns the value stored for a token
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// FromRequest extracts a token from the Authorization bearer header or the
+// X-Vault-Token header used by Vault clients
+func FromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Vault-Token")
+}
+
+// Issue generates a token, and a refresh token when refreshable, and
+// stores their hashes in store as t
+func Issue(store *db.Store, t db.Token, refreshable bool) (raw, refresh string, err error) {
+	if raw, err = Generate(); err != nil {
+		return "", "", err
+	}
+	var refreshHash string
+	if refreshable {
+		if refresh, err = Generate(); err != nil {
+			return "", "", err
+		}
+		refreshHash = Hash(refresh)
+	}
+	if err := store.CreateToken(t, Hash(raw), refreshHash); err != nil {
+		return "", "", err
+	}
+	return raw, refresh, nil
+}
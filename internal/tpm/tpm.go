@@ -0,0 +1,90 @@
+// Package tpm seals secrets to the machine's TPM 2.0 through systemd-creds,
+// so a secret placed on a server can only be read on that physical machine.
+//
+// A sealed secret is a systemd credential, made on the machine itself with
+// 'systemd-creds encrypt --with-key=tpm2', optionally bound to PCR state
+// with --tpm2-pcrs so it only unseals in a known boot configuration.
+// systemd-creds talks to the TPM; lockbox only runs it.
+package tpm
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SystemdCreds is the systemd-creds binary, replaced in tests
+var SystemdCreds = "systemd-creds"
+
+// MaxPCR is the highest PCR index of a TPM 2.0
+const MaxPCR = 23
+
+// ParsePCRs checks a list of PCR indexes separated by + or commas, such as
+// "7" or "0+7", and returns it in the form systemd-creds takes. An empty
+// list binds to no PCRs.
+func ParsePCRs(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return "", nil
+	}
+	var pcrs []string
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == '+' || r == ',' }) {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 || n > MaxPCR {
+			return "", fmt.Errorf("invalid PCR '%s': want an index from 0 to %d", strings.TrimSpace(f), MaxPCR)
+		}
+		pcrs = append(pcrs, strconv.Itoa(n))
+	}
+	return strings.Join(pcrs, "+"), nil
+}
+
+// Seal seals secret to this machine's TPM, bound to the current state of
+// pcrs as returned by ParsePCRs, and returns the credential
+func Seal(secret []byte, pcrs string) ([]byte, error) {
+	// systemd-creds binds to PCR 7 unless told otherwise, so always pass
+	// the list, empty or not
+	out, err := run(secret, "encrypt", "--with-key=tpm2", "--tpm2-pcrs="+pcrs, "--name=", "-", "-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal to the TPM: %w", err)
+	}
+	return out, nil
+}
+
+// UnsealData returns the secret sealed in credential
+func UnsealData(credential []byte) ([]byte, error) {
+	out, err := run(credential, "decrypt", "--name=", "-", "-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal from the TPM: %w", err)
+	}
+	return out, nil
+}
+
+// Unseal returns the secret sealed in the credential file at path
+func Unseal(path string) ([]byte, error) {
+	// An empty --name skips checking the credential's name against the
+	// file's, so the file can be renamed
+	out, err := run(nil, "decrypt", "--name=", path, "-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal %s: %w", path, err)
+	}
+	return out, nil
+}
+
+// run runs systemd-creds with stdin, returning its output or its error
+// message
+func run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(SystemdCreds, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", SystemdCreds, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", SystemdCreds, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package tpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnseal(t *testing.T) {
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "systemd-creds")
+	// The fake prints its arguments, or fails for a credential called bad
+	script := `case "$3" in *bad) echo "Failed to unseal: TPM2 policy mismatch" >&2; exit 1;; esac
+echo "$@"`
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := SystemdCreds
+	SystemdCreds = fake
+	defer func() { SystemdCreds = old }()
+
+	out, err := Unseal("/etc/lockbox/seed.cred")
+	if err != nil || string(out) != "decrypt --name= /etc/lockbox/seed.cred -\n" {
+		t.Errorf("Unseal = %q, %v", out, err)
+	}
+	if _, err := Unseal("/etc/lockbox/bad"); err == nil || !strings.Contains(err.Error(), "policy mismatch") {
+		t.Errorf("Unseal of a bad credential = %v", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "systemd-creds")
+	// The fake "seals" by prefixing the PCR flag, and unseals by dropping it
+	script := `case "$1" in
+encrypt) echo "$3"; cat;;
+decrypt) read -r pcrs; cat;;
+esac`
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := SystemdCreds
+	SystemdCreds = fake
+	defer func() { SystemdCreds = old }()
+
+	cred, err := Seal([]byte("key"), "0+7")
+	if err != nil || string(cred) != "--tpm2-pcrs=0+7\nkey" {
+		t.Fatalf("Seal = %q, %v", cred, err)
+	}
+	if out, err := UnsealData(cred); err != nil || string(out) != "key" {
+		t.Errorf("UnsealData = %q, %v", out, err)
+	}
+}
+
+func TestParsePCRs(t *testing.T) {
+	for in, want := range map[string]string{"": "", "7": "7", "0+7": "0+7", "0, 7": "0+7", "07": "7"} {
+		if got, err := ParsePCRs(in); err != nil || got != want {
+			t.Errorf("ParsePCRs(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"24", "-1", "pcr7"} {
+		if got, err := ParsePCRs(in); err == nil {
+			t.Errorf("ParsePCRs(%q) = %q, want an error", in, got)
+		}
+	}
+}
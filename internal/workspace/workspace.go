@@ -0,0 +1,85 @@
+// Package workspace finds project-local stores: a .lockbox directory in a
+// project holding its own store, found by walking up from the working
+// directory the way git finds .git. The store is either ignored by git or
+// committed, which is only safe when the key is kept elsewhere.
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DirName is the workspace directory in a project
+	DirName = ".lockbox"
+	// StoreName is the store file in the workspace directory
+	StoreName = "lockbox.db"
+)
+
+// ErrNotFound means no directory at or above the start has a workspace
+var ErrNotFound = errors.New("no .lockbox workspace in this directory or above; create one with 'lockbox workspace init'")
+
+// gitignore files written by Init: ignoring the whole directory, or all
+// but the store when it is committed
+const (
+	ignoreAll   = "# Created by lockbox: the workspace store stays out of git\n*\n"
+	commitStore = "# Created by lockbox: only the encrypted store is committed\n/*\n!/.gitignore\n!/" + StoreName + "\n"
+)
+
+// Find returns the root of the nearest workspace at or above dir. The
+// user's global ~/.lockbox directory is not a workspace.
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	global := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		global = filepath.Join(home, DirName)
+	}
+	for {
+		if filepath.Join(dir, DirName) != global {
+			if _, err := os.Stat(StorePath(dir)); err == nil {
+				return dir, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotFound
+		}
+		dir = parent
+	}
+}
+
+// StorePath returns the store of the workspace at root
+func StorePath(root string) string {
+	return filepath.Join(root, DirName, StoreName)
+}
+
+// Init creates the workspace directory in root with a .gitignore keeping
+// everything out of git, or everything but the store when commit is set.
+// The store itself is created by the caller.
+func Init(root string, commit bool) error {
+	dir := filepath.Join(root, DirName)
+	if _, err := os.Stat(filepath.Join(dir, StoreName)); err == nil {
+		return fmt.Errorf("%s is already a workspace", root)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+	ignore := ignoreAll
+	if commit {
+		ignore = commitStore
+	}
+	return os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(ignore), 0644)
+}
+
+// Committed reports whether the workspace at root lets git commit its
+// store
+func Committed(root string) bool {
+	data, err := os.ReadFile(filepath.Join(root, DirName, ".gitignore"))
+	return err == nil && strings.Contains(string(data), "!/"+StoreName)
+}
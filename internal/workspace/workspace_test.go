@@ -0,0 +1,46 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	project := filepath.Join(home, "src", "api")
+	nested := filepath.Join(project, "cmd", "server")
+	os.MkdirAll(nested, 0700)
+
+	// The global store is not a workspace
+	os.MkdirAll(filepath.Join(home, DirName), 0700)
+	os.WriteFile(filepath.Join(home, DirName, StoreName), nil, 0600)
+	if _, err := Find(nested); err != ErrNotFound {
+		t.Fatalf("Find without a workspace = %v, want ErrNotFound", err)
+	}
+
+	if err := Init(project, false); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	// Init leaves creating the store to the caller
+	if _, err := Find(nested); err != ErrNotFound {
+		t.Fatalf("Find without a store = %v, want ErrNotFound", err)
+	}
+	os.WriteFile(StorePath(project), nil, 0600)
+	if root, err := Find(nested); err != nil || root != project {
+		t.Errorf("Find = %q, %v; want %q", root, err, project)
+	}
+	if err := Init(project, false); err == nil {
+		t.Error("Init succeeded in an existing workspace")
+	}
+	if Committed(project) {
+		t.Error("Committed without --commit")
+	}
+
+	other := filepath.Join(home, "src", "web")
+	Init(other, true)
+	if !Committed(other) {
+		t.Error("Committed = false after Init with commit")
+	}
+}
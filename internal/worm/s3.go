@@ -0,0 +1,46 @@
+package worm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// AWSCLI is the aws CLI used to write S3 objects
+var AWSCLI = "aws"
+
+// putObject writes lines as one object under Object Lock retention, named
+// after the sequence number of its first record
+func putObject(t Target, lines [][]byte, first uint64) error {
+	body, err := os.CreateTemp("", "lockbox-worm-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(body.Name())
+	for _, line := range lines {
+		body.Write(append(line, '\n'))
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%020d.jsonl", t.Prefix, first)
+	until := time.Now().Add(t.Retain).UTC().Format(time.RFC3339)
+	cmd := exec.Command(AWSCLI, "s3api", "put-object",
+		"--bucket", t.Bucket, "--key", key, "--body", body.Name(),
+		"--content-type", "application/x-ndjson",
+		"--object-lock-mode", t.Mode, "--object-lock-retain-until-date", until,
+		"--output", "json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
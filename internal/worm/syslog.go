@@ -0,0 +1,65 @@
+package worm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// syslogPriority is facility authpriv, severity notice
+const syslogPriority = 10*8 + 5
+
+// dialTimeout bounds connecting to a syslog server
+var dialTimeout = 10 * time.Second
+
+// parseSyslog splits a syslog URL into a network and address
+func parseSyslog(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" || u.Port() == "" {
+		return "", "", fmt.Errorf("invalid syslog address '%s' (want tcp://, udp:// or tls://HOST:PORT)", address)
+	}
+	switch u.Scheme {
+	case "tcp", "udp", "tls":
+		return u.Scheme, u.Host, nil
+	}
+	return "", "", fmt.Errorf("invalid syslog address '%s' (want tcp://, udp:// or tls://HOST:PORT)", address)
+}
+
+// sendSyslog sends each line as one RFC 5424 message. Over TCP and TLS
+// messages are framed by octet counting (RFC 6587).
+func sendSyslog(address string, lines [][]byte) error {
+	network, addr, err := parseSyslog(address)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	for _, line := range lines {
+		msg := fmt.Sprintf("<%d>1 %s %s lockbox - - - %s", syslogPriority, time.Now().UTC().Format(time.RFC3339), hostname, line)
+		if network != "udp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
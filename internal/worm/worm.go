@@ -0,0 +1,366 @@
+// Package worm mirrors the audit log and a digest of every secret change
+// to external append-only storage, such as an S3 bucket with Object Lock
+// or a remote syslog, so history cannot be rewritten from the machine
+// holding the store.
+//
+// Mirrored records form a chain: each names the SHA-256 of the record
+// before it and is signed with the store's Ed25519 signing key. Anyone
+// with the public key can check a copy of the stream for gaps, reordering
+// and forgeries with Verify. Records name keys and value digests, never
+// values.
+package worm
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+// Config entries: targets are stored under targetPrefix followed by their
+// name, and cursorConfig records how far the stream has been shipped
+const (
+	targetPrefix = "worm/"
+	cursorConfig = "worm_cursor"
+)
+
+// Record types
+const (
+	Audit  = "audit"
+	Change = "change"
+)
+
+// Record is one entry of the mirrored stream
+type Record struct {
+	Seq  uint64    `json:"seq"`
+	At   time.Time `json:"at"`
+	Type string    `json:"type"`
+	// Actor, Action and Detail are set for audit events
+	Actor  string `json:"actor,omitempty"`
+	Action string `json:"action,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Key, Revision, Deleted and Digest are set for secret changes.
+	// Digest is a keyed digest of the new value.
+	Key      string `json:"key,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	// Prev is the SHA-256 of the previous record's line, "" for the first
+	Prev      string `json:"prev"`
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// signed returns the bytes the signature covers
+func (r Record) signed() []byte {
+	r.Signature = nil
+	data, _ := json.Marshal(r)
+	return data
+}
+
+// line returns the record as shipped, without a trailing newline
+func (r Record) line() []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+// hash returns the chain hash of a shipped line
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// cursor is how far the stream has been shipped
+type cursor struct {
+	AuditID  int64  `json:"audit_id"`
+	Revision uint64 `json:"revision"`
+	Seq      uint64 `json:"seq"`
+	Prev     string `json:"prev"`
+}
+
+// Target is append-only storage records are shipped to
+type Target struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Address is the syslog URL, such as tcp://logs.example.com:514
+	Address string `json:"address,omitempty"`
+	// Bucket and Prefix locate S3 objects; Mode and Retain set their
+	// Object Lock retention
+	Bucket string        `json:"bucket,omitempty"`
+	Prefix string        `json:"prefix,omitempty"`
+	Mode   string        `json:"mode,omitempty"`
+	Retain time.Duration `json:"retain,omitempty"`
+}
+
+// Kinds are the supported target kinds
+var Kinds = []string{"syslog", "s3"}
+
+// Validate checks t's kind and location
+func (t Target) Validate() error {
+	switch t.Kind {
+	case "syslog":
+		_, _, err := parseSyslog(t.Address)
+		return err
+	case "s3":
+		if t.Bucket == "" {
+			return errors.New("an S3 target needs a bucket")
+		}
+		if t.Mode != "COMPLIANCE" && t.Mode != "GOVERNANCE" {
+			return fmt.Errorf("invalid Object Lock mode '%s' (supported: COMPLIANCE, GOVERNANCE)", t.Mode)
+		}
+		if t.Retain < 24*time.Hour {
+			return errors.New("Object Lock retention must be at least one day")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown target kind '%s' (supported: %s)", t.Kind, strings.Join(Kinds, ", "))
+}
+
+// String describes where t ships to
+func (t Target) String() string {
+	if t.Kind == "s3" {
+		return fmt.Sprintf("s3://%s/%s (%s, %d days)", t.Bucket, t.Prefix, t.Mode, int(t.Retain.Hours()/24))
+	}
+	return t.Address
+}
+
+// send ships lines, each one record, to t
+func (t Target) send(lines [][]byte, first uint64) error {
+	if t.Kind == "s3" {
+		return putObject(t, lines, first)
+	}
+	return sendSyslog(t.Address, lines)
+}
+
+// Add stores t, replacing any target of the same name
+func Add(store *db.Store, t Target) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return store.SetConfig(targetPrefix+t.Name, data)
+}
+
+// Remove deletes the target called name
+func Remove(store *db.Store, name string) error {
+	if _, err := store.GetConfig(targetPrefix + name); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("no WORM target '%s'", name)
+		}
+		return err
+	}
+	return store.DeleteConfig(targetPrefix + name)
+}
+
+// List returns every target, sorted by name
+func List(store *db.Store) ([]Target, error) {
+	config, err := store.ListConfig()
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	for name, data := range config {
+		if !strings.HasPrefix(name, targetPrefix) {
+			continue
+		}
+		var t Target
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("corrupt WORM target '%s': %w", strings.TrimPrefix(name, targetPrefix), err)
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets, nil
+}
+
+// ShippedAudit returns the ID of the last audit event shipped to every
+// target; ok is false when there are no targets, so no event waits to be
+// shipped
+func ShippedAudit(store *db.Store) (id int64, ok bool, err error) {
+	targets, err := List(store)
+	if err != nil || len(targets) == 0 {
+		return 0, false, err
+	}
+	c, err := loadCursor(store)
+	return c.AuditID, true, err
+}
+
+// loadCursor returns how far the stream has been shipped
+func loadCursor(store *db.Store) (cursor, error) {
+	var c cursor
+	if data, err := store.GetConfig(cursorConfig); err == nil {
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("corrupt WORM cursor: %w", err)
+		}
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return c, err
+	}
+	return c, nil
+}
+
+// PublicKey returns the key records are signed with
+func PublicKey(store *db.Store) (ed25519.PublicKey, error) {
+	key, err := bundle.SigningKey(store)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// Ship sends every audit event and secret change not yet shipped to all
+// targets, returning how many records were sent. The stream only advances
+// once every target has the records, so a failed target is sent them
+// again on the next Ship; verifiers skip records they already hold.
+func Ship(store *db.Store, encKey []byte) (int, error) {
+	targets, err := List(store)
+	if err != nil || len(targets) == 0 {
+		return 0, err
+	}
+	signer, err := bundle.SigningKey(store)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := loadCursor(store)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []Record
+	events, err := store.AuditEvents("")
+	if err != nil {
+		return 0, err
+	}
+	next := c
+	for _, e := range events {
+		if e.ID <= c.AuditID {
+			continue
+		}
+		records = append(records, Record{At: e.At.UTC(), Type: Audit, Actor: e.Actor, Action: e.Action, Detail: e.Detail})
+		next.AuditID = e.ID
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	err = store.Changes(c.Revision, func(ch db.Change) error {
+		r := Record{At: now, Type: Change, Key: ch.Key, Revision: ch.Version, Deleted: ch.Deleted}
+		if !ch.Deleted {
+			r.At = ch.Updated.UTC()
+			value, err := crypto.Decrypt(ch.Value, encKey)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt '%s': %w", ch.Key, err)
+			}
+			r.Digest, err = crypto.Digest(value, encKey)
+			clear(value)
+			if err != nil {
+				return err
+			}
+		}
+		records = append(records, r)
+		next.Revision = max(next.Revision, ch.Version)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	lines := make([][]byte, len(records))
+	for i := range records {
+		next.Seq++
+		records[i].Seq = next.Seq
+		records[i].Prev = next.Prev
+		records[i].Signature = ed25519.Sign(signer, records[i].signed())
+		lines[i] = records[i].line()
+		next.Prev = hash(lines[i])
+	}
+
+	var errs []error
+	for _, t := range targets {
+		if err := t.send(lines, c.Seq+1); err != nil {
+			errs = append(errs, fmt.Errorf("shipping to WORM target '%s' failed: %w", t.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.SetConfig(cursorConfig, data); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// Schedule runs Ship every interval until ctx is done, calling report
+// after each Ship that sent records or failed
+func Schedule(ctx context.Context, store *db.Store, encKey []byte, interval time.Duration, report func(int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := Ship(store, encKey); n > 0 || err != nil {
+			report(n, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Verify reads shipped records, one per line, and checks their signatures
+// with signer and that they chain without gaps. Records repeated by a
+// retried Ship are skipped. It returns the number of distinct records.
+func Verify(r io.Reader, signer ed25519.PublicKey) (int, error) {
+	var (
+		seq  uint64
+		prev string
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("line %d: not a WORM record: %w", n, err)
+		}
+		if !ed25519.Verify(signer, rec.signed(), rec.Signature) {
+			return 0, fmt.Errorf("line %d: record %d has an invalid signature", n, rec.Seq)
+		}
+		if rec.Seq <= seq {
+			continue
+		}
+		if rec.Seq != seq+1 {
+			return 0, fmt.Errorf("line %d: records %d to %d are missing", n, seq+1, rec.Seq-1)
+		}
+		if seq > 0 && rec.Prev != prev {
+			return 0, fmt.Errorf("line %d: record %d does not follow record %d", n, rec.Seq, seq)
+		}
+		seq, prev = rec.Seq, hash(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return int(seq), nil
+}
@@ -0,0 +1,201 @@
+package worm
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MQ37/lockbox/internal/crypto"
+	"github.com/MQ37/lockbox/internal/db"
+)
+
+var testKey = make([]byte, 32)
+
+func newStore(t *testing.T) *db.Store {
+	t.Helper()
+	store, err := db.OpenStore(filepath.Join(t.TempDir(), "lockbox.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func set(t *testing.T, store *db.Store, key, value string) {
+	t.Helper()
+	encrypted, _ := crypto.Encrypt([]byte(value), testKey)
+	if err := store.SetSecret(key, encrypted); err != nil {
+		t.Fatalf("Failed to set %s: %v", key, err)
+	}
+}
+
+// syslogServer collects the messages of octet-counted syslog connections
+// and returns the JSON part of each
+func syslogServer(t *testing.T) (string, func() []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				size, err := r.ReadString(' ')
+				if err != nil {
+					break
+				}
+				n, _ := strconv.Atoi(strings.TrimSpace(size))
+				msg := make([]byte, n)
+				if _, err := io.ReadFull(r, msg); err != nil {
+					break
+				}
+				msgs <- string(msg)
+			}
+			conn.Close()
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), func() []string {
+		var got []string
+		for {
+			select {
+			case m := <-msgs:
+				got = append(got, m[strings.Index(m, "{"):])
+			case <-time.After(200 * time.Millisecond):
+				return got
+			}
+		}
+	}
+}
+
+func TestShipSyslog(t *testing.T) {
+	store := newStore(t)
+	address, received := syslogServer(t)
+
+	if n, err := Ship(store, testKey); n != 0 || err != nil {
+		t.Fatalf("Ship without targets = %d, %v", n, err)
+	}
+	if err := Add(store, Target{Name: "logs", Kind: "syslog", Address: address}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	set(t, store, "API_KEY", "hunter2")
+	store.Audit("uid:1000", "promote", "API_KEY from staging")
+	if n, err := Ship(store, testKey); n != 2 || err != nil {
+		t.Fatalf("Ship = %d, %v, want 2 records", n, err)
+	}
+	store.DeleteSecret("API_KEY")
+	if n, err := Ship(store, testKey); n != 1 || err != nil {
+		t.Fatalf("second Ship = %d, %v, want 1 record", n, err)
+	}
+	if n, _ := Ship(store, testKey); n != 0 {
+		t.Errorf("Ship repeated %d records", n)
+	}
+
+	lines := received()
+	stream := strings.Join(lines, "\n")
+	if len(lines) != 3 || strings.Contains(stream, "hunter2") {
+		t.Fatalf("received %q", lines)
+	}
+	if !strings.Contains(lines[0], `"action":"promote"`) || !strings.Contains(lines[1], `"key":"API_KEY"`) || !strings.Contains(lines[2], `"deleted":true`) {
+		t.Errorf("received %q", lines)
+	}
+
+	pub, _ := PublicKey(store)
+	if n, err := Verify(strings.NewReader(stream), pub); n != 3 || err != nil {
+		t.Errorf("Verify = %d, %v", n, err)
+	}
+}
+
+func TestShipS3(t *testing.T) {
+	store := newStore(t)
+	dir := t.TempDir()
+	log := fakeAWS(t, dir)
+	Add(store, Target{Name: "bucket", Kind: "s3", Bucket: "audit", Prefix: "lockbox/", Mode: "COMPLIANCE", Retain: 365 * 24 * time.Hour})
+	for _, action := range []string{"a", "b", "c"} {
+		store.Audit("uid:0", action, "")
+	}
+	if _, err := Ship(store, testKey); err != nil {
+		t.Fatalf("Ship failed: %v", err)
+	}
+	args, _ := os.ReadFile(log)
+	for _, want := range []string{"--bucket audit", "--key lockbox/00000000000000000001.jsonl", "--object-lock-mode COMPLIANCE", "--object-lock-retain-until-date"} {
+		if !strings.Contains(string(args), want) {
+			t.Errorf("aws called with %s, want %s", args, want)
+		}
+	}
+	stream, _ := os.ReadFile(filepath.Join(dir, "body"))
+	pub, _ := PublicKey(store)
+	lines := strings.Split(strings.TrimSpace(string(stream)), "\n")
+
+	tests := map[string]string{
+		"intact":   strings.Join(lines, "\n"),
+		"repeated": strings.Join(append(lines[:2:2], lines[1], lines[2]), "\n"),
+		"missing":  lines[0] + "\n" + lines[2],
+		"edited":   strings.Replace(string(stream), `"action":"b"`, `"action":"x"`, 1),
+		"foreign":  string(stream),
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	for name, input := range tests {
+		key := pub
+		if name == "foreign" {
+			key = other
+		}
+		n, err := Verify(strings.NewReader(input), key)
+		if ok := name == "intact" || name == "repeated"; ok != (err == nil) || ok && n != 3 {
+			t.Errorf("%s: Verify = %d, %v", name, n, err)
+		}
+	}
+}
+
+// fakeAWS installs an aws CLI that logs its arguments and copies the
+// object body into dir
+func fakeAWS(t *testing.T, dir string) string {
+	t.Helper()
+	log := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "aws")
+	os.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" >> `+log+`
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--body" ]; then cp "$2" `+filepath.Join(dir, "body")+`; fi
+	shift
+done
+echo '{"ETag":"x"}'
+`), 0755)
+	old := AWSCLI
+	AWSCLI = script
+	t.Cleanup(func() { AWSCLI = old })
+	return log
+}
+
+func TestValidate(t *testing.T) {
+	bad := []Target{
+		{Kind: "ftp"},
+		{Kind: "syslog", Address: "logs.example.com:514"},
+		{Kind: "syslog", Address: "http://logs.example.com:514"},
+		{Kind: "s3", Mode: "COMPLIANCE", Retain: 48 * time.Hour},
+		{Kind: "s3", Bucket: "b", Mode: "STRICT", Retain: 48 * time.Hour},
+		{Kind: "s3", Bucket: "b", Mode: "GOVERNANCE", Retain: time.Hour},
+	}
+	for _, target := range bad {
+		if err := target.Validate(); err == nil {
+			t.Errorf("Validate(%+v) passed", target)
+		}
+	}
+	if err := (Target{Kind: "syslog", Address: "tls://logs.example.com:6514"}).Validate(); err != nil {
+		t.Errorf("Validate of a TLS syslog target: %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+// Package yaml converts between Go values and the block-style YAML that
+// lockbox writes for people to read and edit.
+//
+// Marshal produces YAML from the JSON encoding, so both hold the same
+// fields in the same order and json struct tags apply. Strings that YAML
+// could read as anything but the same string are written double-quoted.
+//
+// Unmarshal reads the subset of YAML that Marshal writes and people
+// usually add by hand: block mappings and sequences, # comments, plain,
+// single- and double-quoted scalars, and flow sequences of scalars such as
+// [a, b]. Anchors, tags, multi-line scalars and flow mappings with fields
+// are rejected. The document is converted to JSON and decoded with
+// encoding/json.
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Marshal returns v as YAML
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	n, err := decode(json.NewDecoder(&buf))
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	writeYAML(&buf, n, 0)
+	return buf.Bytes(), nil
+}
+
+// node is a decoded JSON value keeping the order of object fields
+type node struct {
+	// scalar is the YAML text of a string, number, bool or null
+	scalar string
+	// isObject and isArray mark containers, whose children are items;
+	// keys names the fields of an object
+	isObject, isArray bool
+	keys              []string
+	items             []node
+}
+
+// decode reads one value from dec
+func decode(dec *json.Decoder) (node, error) {
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return node{}, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		n := node{isObject: t == '{', isArray: t == '['}
+		for dec.More() {
+			if n.isObject {
+				key, err := dec.Token()
+				if err != nil {
+					return n, err
+				}
+				n.keys = append(n.keys, key.(string))
+			}
+			item, err := decode(dec)
+			if err != nil {
+				return n, err
+			}
+			n.items = append(n.items, item)
+		}
+		_, err := dec.Token()
+		return n, err
+	case string:
+		return node{scalar: quote(t)}, nil
+	case json.Number:
+		return node{scalar: t.String()}, nil
+	case bool:
+		return node{scalar: fmt.Sprint(t)}, nil
+	default:
+		return node{scalar: "null"}, nil
+	}
+}
+
+// writeYAML writes n in block style, its fields or items indented by
+// indent spaces
+func writeYAML(b *bytes.Buffer, n node, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch {
+	case (n.isObject || n.isArray) && len(n.items) == 0:
+		b.WriteString(map[bool]string{true: "{}", false: "[]"}[n.isObject] + "\n")
+	case n.isObject:
+		for i, item := range n.items {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			b.WriteString(quote(n.keys[i]) + ":")
+			writeChild(b, item, indent+2)
+		}
+	case n.isArray:
+		for i, item := range n.items {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			if item.isObject && len(item.items) > 0 {
+				// The first field follows the dash
+				b.WriteString("- ")
+				writeYAML(b, item, indent+2)
+				continue
+			}
+			b.WriteString("-")
+			writeChild(b, item, indent+2)
+		}
+	default:
+		b.WriteString(n.scalar + "\n")
+	}
+}
+
+// writeChild writes n after a key or dash: scalars and empty containers on
+// the same line, others on the lines below
+func writeChild(b *bytes.Buffer, n node, indent int) {
+	if !(n.isObject || n.isArray) || len(n.items) == 0 {
+		b.WriteString(" ")
+		writeYAML(b, n, indent)
+		return
+	}
+	b.WriteString("\n" + strings.Repeat(" ", indent))
+	writeYAML(b, n, indent)
+}
+
+// plain matches strings YAML can read unquoted, which cannot be numbers;
+// reserved then excludes those it reads as other types
+var plain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./@+-]*$`)
+
+// reserved are the words YAML 1.1 or 1.2 reads as booleans or nulls
+var reserved = regexp.MustCompile(`(?i)^(y|n|yes|no|on|off|true|false|null)$`)
+
+// quote returns s as a YAML scalar
+func quote(s string) string {
+	if plain.MatchString(s) && !reserved.MatchString(s) {
+		return s
+	}
+	// A JSON string is a valid YAML double-quoted scalar
+	return jsonString(s)
+}
+
+// jsonString returns s as a JSON string
+func jsonString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Unmarshal decodes the YAML document data into v, as encoding/json would
+// decode the same document written as JSON
+func Unmarshal(data []byte, v any) error {
+	p := &parser{}
+	for i, text := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		content, err := stripComment(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		trimmed := strings.TrimLeft(content, " ")
+		if trimmed == "" || (trimmed == "---" && len(p.lines) == 0) {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return fmt.Errorf("line %d: tabs cannot indent YAML", i+1)
+		}
+		if strings.HasPrefix(trimmed, "---") || strings.HasPrefix(trimmed, "...") {
+			return fmt.Errorf("line %d: only one document is supported", i+1)
+		}
+		p.lines = append(p.lines, line{n: i + 1, indent: len(content) - len(trimmed), text: trimmed})
+	}
+
+	var out bytes.Buffer
+	if len(p.lines) == 0 {
+		out.WriteString("null")
+	} else {
+		if err := p.block(&out, p.lines[0].indent); err != nil {
+			return err
+		}
+		if p.pos < len(p.lines) {
+			return fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+		}
+	}
+	if err := json.Unmarshal(out.Bytes(), v); err != nil {
+		return fmt.Errorf("invalid document: %w", err)
+	}
+	return nil
+}
+
+// line is a non-blank line without its comment, text starting after the
+// indentation
+type line struct {
+	n      int
+	indent int
+	text   string
+}
+
+// parser converts lines to JSON, reading from pos
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// isItem reports whether text starts a sequence item
+func isItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block writes the mapping or sequence whose entries start at indent
+func (p *parser) block(out *bytes.Buffer, indent int) error {
+	if isItem(p.lines[p.pos].text) {
+		return p.sequence(out, indent)
+	}
+	return p.mapping(out, indent)
+}
+
+// sequence writes the items starting at indent
+func (p *parser) sequence(out *bytes.Buffer, indent int) error {
+	out.WriteString("[")
+	for i := 0; p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isItem(p.lines[p.pos].text); i++ {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		l := &p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		switch {
+		case rest == "":
+			// The item is the block on the lines below
+			p.pos++
+			if err := p.child(out, indent); err != nil {
+				return err
+			}
+		case isItem(rest) || isField(rest):
+			// The item is a block starting after the dash: parse the rest
+			// of the line as its first line
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			if err := p.block(out, l.indent); err != nil {
+				return err
+			}
+		default:
+			p.pos++
+			if err := scalar(out, rest); err != nil {
+				return fmt.Errorf("line %d: %w", l.n, err)
+			}
+		}
+	}
+	out.WriteString("]")
+	return nil
+}
+
+// mapping writes the fields starting at indent
+func (p *parser) mapping(out *bytes.Buffer, indent int) error {
+	out.WriteString("{")
+	for i := 0; p.pos < len(p.lines) && p.lines[p.pos].indent == indent; i++ {
+		l := p.lines[p.pos]
+		if isItem(l.text) {
+			return fmt.Errorf("line %d: expected a field, not a sequence item", l.n)
+		}
+		key, value, err := field(l.text)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", l.n, err)
+		}
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString(jsonString(key) + ":")
+		p.pos++
+		if value != "" {
+			if err := scalar(out, value); err != nil {
+				return fmt.Errorf("line %d: %w", l.n, err)
+			}
+			continue
+		}
+		// A sequence under a field may start at the field's own indent
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isItem(p.lines[p.pos].text) {
+			if err := p.sequence(out, indent); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.child(out, indent); err != nil {
+			return err
+		}
+	}
+	out.WriteString("}")
+	return nil
+}
+
+// child writes the block indented more than parent on the next line, or
+// null if there is none
+func (p *parser) child(out *bytes.Buffer, parent int) error {
+	if p.pos == len(p.lines) || p.lines[p.pos].indent <= parent {
+		out.WriteString("null")
+		return nil
+	}
+	return p.block(out, p.lines[p.pos].indent)
+}
+
+// isField reports whether text starts a mapping field
+func isField(text string) bool {
+	_, _, err := field(text)
+	return err == nil
+}
+
+// field splits a KEY: VALUE line
+func field(text string) (string, string, error) {
+	var key, rest string
+	if text[0] == '"' || text[0] == '\'' {
+		end := closingQuote(text)
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quoted key")
+		}
+		var b bytes.Buffer
+		if err := scalar(&b, text[:end+1]); err != nil {
+			return "", "", err
+		}
+		json.Unmarshal(b.Bytes(), &key)
+		rest = text[end+1:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected ':' after key")
+		}
+	} else {
+		i := strings.Index(text, ": ")
+		if i < 0 {
+			if !strings.HasSuffix(text, ":") {
+				return "", "", fmt.Errorf("expected KEY: VALUE")
+			}
+			i = len(text) - 1
+		}
+		key, rest = text[:i], text[i:]
+	}
+	return key, strings.TrimSpace(rest[1:]), nil
+}
+
+// closingQuote returns the index of the quote closing the scalar text
+// starts with, or -1
+func closingQuote(text string) int {
+	q := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case text[i] == q && q == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment returns text without a trailing # comment, which starts a
+// line or follows a space outside quotes
+func stripComment(text string) (string, error) {
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case (c == '"' || c == '\'') && (i == 0 || strings.ContainsRune(" -:[,", rune(text[i-1]))):
+			end := closingQuote(text[i:])
+			if end < 0 {
+				return "", fmt.Errorf("unterminated quoted string")
+			}
+			i += end
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " "), nil
+		}
+	}
+	return strings.TrimRight(text, " "), nil
+}
+
+// number matches the scalars YAML and JSON both read as numbers
+var number = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// scalar writes the scalar text as JSON
+func scalar(out *bytes.Buffer, text string) error {
+	switch {
+	case text[0] == '"':
+		if closingQuote(text) != len(text)-1 {
+			return fmt.Errorf("unexpected text after quoted string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(text), &s); err != nil {
+			return fmt.Errorf("invalid quoted string %s", text)
+		}
+		out.WriteString(jsonString(s))
+	case text[0] == '\'':
+		if closingQuote(text) != len(text)-1 {
+			return fmt.Errorf("unexpected text after quoted string")
+		}
+		out.WriteString(jsonString(strings.ReplaceAll(text[1:len(text)-1], "''", "'")))
+	case text == "{}":
+		out.WriteString("{}")
+	case text[0] == '[':
+		if !strings.HasSuffix(text, "]") {
+			return fmt.Errorf("unterminated flow sequence")
+		}
+		out.WriteString("[")
+		if inner := strings.TrimSpace(text[1 : len(text)-1]); inner != "" {
+			for i, item := range strings.Split(inner, ",") {
+				if i > 0 {
+					out.WriteString(",")
+				}
+				item = strings.TrimSpace(item)
+				if item == "" || strings.ContainsAny(item[:1], "[{") {
+					return fmt.Errorf("only scalars are supported in flow sequences")
+				}
+				if err := scalar(out, item); err != nil {
+					return err
+				}
+			}
+		}
+		out.WriteString("]")
+	case strings.ContainsAny(text[:1], "{&*!|>%@`"):
+		return fmt.Errorf("unsupported YAML syntax: %s", text)
+	case text == "~" || text == "null" || text == "Null" || text == "NULL":
+		out.WriteString("null")
+	case text == "true" || text == "True" || text == "TRUE":
+		out.WriteString("true")
+	case text == "false" || text == "False" || text == "FALSE":
+		out.WriteString("false")
+	case number.MatchString(text):
+		out.WriteString(text)
+	default:
+		out.WriteString(jsonString(text))
+	}
+	return nil
+}
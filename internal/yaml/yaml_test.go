@@ -0,0 +1,110 @@
+package yaml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type rule struct {
+	Key    string   `json:"key"`
+	Every  string   `json:"every"`
+	Events []string `json:"events,omitempty"`
+}
+
+type document struct {
+	Format  string            `json:"format"`
+	Remotes []string          `json:"remotes"`
+	Rules   []rule            `json:"rules"`
+	Values  map[string]string `json:"values"`
+	Count   int               `json:"count"`
+	Enabled bool              `json:"enabled"`
+	Empty   map[string]string `json:"empty"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	want := document{
+		Format:  "lockbox-setup/1",
+		Remotes: []string{"lockbox.internal:8100", "localhost:8100"},
+		Rules: []rule{
+			{Key: "DB_PASSWORD", Every: "30d", Events: []string{"rotation", "yes"}},
+			{Key: "API_KEY", Every: "12h"},
+		},
+		Values: map[string]string{
+			"A": "yes", "B": "line1\nline2", "C": "2026-10-16", "D": "a # b",
+			"E": "it's", "F": "", "G": "- item", "H": "key: value",
+		},
+		Count:   3,
+		Enabled: true,
+		Empty:   map[string]string{},
+	}
+	data, err := Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var got document
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip changed the document:\n%+v\nexpected\n%+v\nYAML:\n%s", got, want, data)
+	}
+}
+
+func TestUnmarshalHandWritten(t *testing.T) {
+	data := `---
+# Written by hand
+format: 'lockbox-setup/1'   # single-quoted
+remotes: [lockbox.internal:8100, "localhost:8100"]
+rules:
+- key: DB_PASSWORD
+  every: 30d
+  events:
+  - rotation
+-   key: API_KEY
+    every: "12h"
+values:
+    A: it's plain
+    "B C": ~
+count: 3
+enabled: true
+`
+	var got document
+	if err := Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	want := document{
+		Format:  "lockbox-setup/1",
+		Remotes: []string{"lockbox.internal:8100", "localhost:8100"},
+		Rules: []rule{
+			{Key: "DB_PASSWORD", Every: "30d", Events: []string{"rotation"}},
+			{Key: "API_KEY", Every: "12h"},
+		},
+		Values: map[string]string{"A": "it's plain", "B C": ""},
+		Count:  3, Enabled: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected document:\n%+v\nexpected\n%+v", got, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		err  string
+	}{
+		{"format: \"open", "line 1: unterminated quoted string"},
+		{"a: 1\n\tb: 2", "line 2: tabs cannot indent YAML"},
+		{"a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"a: 1\njust text", "line 2: expected KEY: VALUE"},
+		{"a: &anchor 1", "line 1: unsupported YAML syntax"},
+		{"a: 1\n---\nb: 2", "line 2: only one document is supported"},
+		{"count: many", "invalid document"},
+	} {
+		var d document
+		err := Unmarshal([]byte(tc.data), &d)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Unmarshal(%q) = %v, expected %q", tc.data, err, tc.err)
+		}
+	}
+}
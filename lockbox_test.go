@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode"
+
+	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/fixtures"
+	"github.com/MQ37/lockbox/internal/nativehost"
+	"github.com/MQ37/lockbox/internal/pairing"
 )
 
 // setupTest creates a temporary database directory and sets up the environment for testing
@@ -181,6 +194,40 @@ func TestGetNotFound(t *testing.T) {
 	}
 }
 
+// TestExists tests checking for secrets through the exit code only
+func TestExists(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	if _, _, exitCode := runLockbox("exists", "API_KEY"); exitCode != 2 {
+		t.Errorf("Expected exit code 2 without a store, got %d", exitCode)
+	}
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+	runLockbox("set", "DB_URL", "postgres://")
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"exists", "API_KEY"}, 0},
+		{[]string{"exists", "MISSING"}, 1},
+		{[]string{"exists", "MISSING", "API_KEY"}, 0},
+		{[]string{"exists", "--all", "API_KEY", "DB_URL"}, 0},
+		{[]string{"exists", "--all", "API_KEY", "MISSING"}, 1},
+	}
+	for _, tt := range tests {
+		stdout, stderr, exitCode := runLockbox(tt.args...)
+		if exitCode != tt.code {
+			t.Errorf("%v: expected exit code %d, got %d", tt.args, tt.code, exitCode)
+		}
+		if stdout != "" || stderr != "" {
+			t.Errorf("%v: expected no output, got %q %q", tt.args, stdout, stderr)
+		}
+	}
+}
+
 // TestDelete tests deleting a secret
 func TestDelete(t *testing.T) {
 	_, cleanup := setupTest(t)
@@ -229,6 +276,41 @@ func TestDeleteNotFound(t *testing.T) {
 	}
 }
 
+// TestRename tests moving a secret to a new key
+func TestRename(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_PASS", "hunter2")
+	runLockbox("set", "DB_PASSWORD", "old")
+
+	if _, stderr, exitCode := runLockbox("rename", "DB_PASS", "DB_PASSWORD"); exitCode == 0 || !strings.Contains(stderr, "already exists") {
+		t.Errorf("Expected rename onto an existing key to fail, got exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != "old" {
+		t.Errorf("Expected DB_PASSWORD to be kept, got %q", stdout)
+	}
+
+	stdout, stderr, exitCode := runLockbox("rename", "DB_PASS", "DB_PASSWORD", "--force")
+	if exitCode != 0 {
+		t.Fatalf("Rename failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "renamed to 'DB_PASSWORD'") {
+		t.Errorf("Expected success message, got: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != "hunter2" {
+		t.Errorf("Expected DB_PASSWORD to hold the renamed value, got %q", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "DB_PASS"); exitCode == 0 {
+		t.Error("Expected DB_PASS to be gone after rename")
+	}
+
+	if _, stderr, exitCode := runLockbox("rename", "DB_PASS", "OTHER"); exitCode == 0 || !strings.Contains(stderr, "not found") {
+		t.Errorf("Expected renaming a missing key to fail, got exit code %d: %s", exitCode, stderr)
+	}
+}
+
 // TestList tests listing all secrets
 func TestList(t *testing.T) {
 	_, cleanup := setupTest(t)
@@ -356,6 +438,264 @@ func TestRun(t *testing.T) {
 	}
 }
 
+// TestRunFilters tests scoping the secrets env and run pass on
+func TestRunFilters(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_USER", "app")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+	runLockbox("set", "API_KEY", "sk-123")
+
+	for _, tc := range []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{"--prefix", "DB_"}, "app hunter2\n"},
+		{[]string{"--only", "API_KEY,DB_USER"}, "app sk-123\n"},
+		{[]string{"--prefix", "DB_", "--exclude", "DB_PASSWORD"}, "app\n"},
+		{[]string{"--exclude", "DB_*"}, "sk-123\n"},
+	} {
+		args := append(append([]string{"run"}, tc.flags...), "--", "sh", "-c", "echo ${DB_USER:-} ${DB_PASSWORD:-} ${API_KEY:-}")
+		if stdout, stderr, _ := runLockbox(args...); strings.Join(strings.Fields(stdout), " ")+"\n" != tc.want {
+			t.Errorf("run %v = %q, want %q: %s", tc.flags, stdout, tc.want, stderr)
+		}
+	}
+	if _, stderr, exitCode := runLockbox("run", "--only", "MISSING", "--", "true"); exitCode == 0 || !strings.Contains(stderr, "not found") {
+		t.Errorf("run --only MISSING: exit code %d: %s", exitCode, stderr)
+	}
+
+	if stdout, _, _ := runLockbox("env", "--prefix", "DB_", "--exclude", "DB_USER"); stdout != "export DB_PASSWORD=\"hunter2\"\n" {
+		t.Errorf("env --prefix DB_ --exclude DB_USER = %q", stdout)
+	}
+
+	cmd := exec.Command("./lockbox", "serve", "-p", "9884")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
+	time.Sleep(500 * time.Millisecond)
+
+	if stdout, stderr, _ := runLockbox("env", "--remote", "127.0.0.1:9884", "--prefix", "DB_"); stdout != "export DB_PASSWORD=\"hunter2\"\nexport DB_USER=\"app\"\n" {
+		t.Errorf("env --remote --prefix DB_ = %q: %s", stdout, stderr)
+	}
+	if stdout, stderr, _ := runLockbox("run", "--remote", "127.0.0.1:9884", "--only", "API_KEY", "--", "sh", "-c", "echo ${DB_USER:-} $API_KEY"); strings.TrimSpace(stdout) != "sk-123" {
+		t.Errorf("run --remote --only API_KEY = %q: %s", stdout, stderr)
+	}
+}
+
+// TestPair tests pairing a device through the code in the QR code
+func TestPair(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "MOBILE_PIN", "1234")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+
+	if _, stderr, exitCode := runLockbox("pair", "phone"); exitCode == 0 || !strings.Contains(stderr, "--scope") {
+		t.Errorf("pair without --scope: exit code %d: %s", exitCode, stderr)
+	}
+
+	if _, stderr, exitCode := runLockbox("pair", "phone", "--scope", "read:MOBILE_*", "--url", "http://127.0.0.1:9885"); exitCode == 0 || !strings.Contains(stderr, "nothing answers") {
+		t.Errorf("pair with no server: exit code %d: %s", exitCode, stderr)
+	}
+
+	server := exec.Command("./lockbox", "serve", "-p", "9885")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Process.Kill()
+	time.Sleep(500 * time.Millisecond)
+
+	// A server on localhost is out of reach of the default address
+	if _, _, exitCode := runLockbox("pair", "phone", "--scope", "read:MOBILE_*", "-p", "9885"); exitCode == 0 {
+		t.Error("pair offered the local network address of a server on localhost")
+	}
+
+	pair := exec.Command("./lockbox", "pair", "phone", "--scope", "read:MOBILE_*", "--url", "http://127.0.0.1:9885", "--porcelain")
+	stdout, _ := pair.StdoutPipe()
+	if err := pair.Start(); err != nil {
+		t.Fatalf("Failed to start pair: %v", err)
+	}
+	defer pair.Process.Kill()
+	out := bufio.NewReader(stdout)
+
+	line, _ := out.ReadString('\n')
+	fields := strings.Split(strings.TrimSpace(line), "\t")
+	if len(fields) != 4 || fields[0] != "pairing" {
+		t.Fatalf("pair printed %q", line)
+	}
+	uri, err := url.Parse(fields[1])
+	if err != nil || uri.Query().Get("server") != "http://127.0.0.1:9885" {
+		t.Fatalf("Unexpected pairing URI %s", fields[1])
+	}
+
+	resp, err := http.Post("http://127.0.0.1:9885/v1/auth/pair", "application/json", strings.NewReader(`{"code":"`+uri.Query().Get("code")+`"}`))
+	if err != nil {
+		t.Fatalf("Pair request failed: %v", err)
+	}
+	var paired struct{ Token, Fingerprint string }
+	json.NewDecoder(resp.Body).Decode(&paired)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || paired.Token == "" {
+		t.Fatalf("Pair request returned %d", resp.StatusCode)
+	}
+	if paired.Fingerprint != fields[3] {
+		t.Errorf("device received fingerprint %q, pair showed %q", paired.Fingerprint, fields[3])
+	}
+
+	if line, _ := out.ReadString('\n'); line != "paired\tphone\n" {
+		t.Errorf("pair printed %q once paired", line)
+	}
+	if err := pair.Wait(); err != nil {
+		t.Errorf("pair failed after pairing: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:9885/secrets", nil)
+	req.Header.Set("Authorization", "Bearer "+paired.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "MOBILE_PIN") || strings.Contains(string(body), "DB_PASSWORD") {
+		t.Errorf("Paired token listed %s", body)
+	}
+}
+
+// TestPairDefaultURL tests that the default pairing address reaches a
+// server bound to every interface
+func TestPairDefaultURL(t *testing.T) {
+	serverURL, err := pairing.LocalURL("9890", false)
+	if err != nil {
+		t.Skipf("no local network: %v", err)
+	}
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+
+	server := exec.Command("./lockbox", "serve", "-p", "9890", "--bind", "0.0.0.0")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Process.Kill()
+	time.Sleep(500 * time.Millisecond)
+
+	pair := exec.Command("./lockbox", "pair", "phone", "--scope", "read:*", "-p", "9890", "--porcelain")
+	stdout, _ := pair.StdoutPipe()
+	if err := pair.Start(); err != nil {
+		t.Fatalf("Failed to start pair: %v", err)
+	}
+	defer pair.Process.Kill()
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	fields := strings.Split(strings.TrimSpace(line), "\t")
+	if len(fields) != 4 {
+		t.Fatalf("pair printed %q", line)
+	}
+	uri, _ := url.Parse(fields[1])
+	if uri.Query().Get("server") != serverURL {
+		t.Fatalf("Pairing URI %s does not hold %s", fields[1], serverURL)
+	}
+
+	// The device redeems the code at the address in the QR code
+	resp, err := http.Get(serverURL + "/healthz")
+	if err != nil {
+		t.Fatalf("Default pairing address is unreachable: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz at the default address returned %d", resp.StatusCode)
+	}
+	resp, err = http.Post(serverURL+"/v1/auth/pair", "application/json", strings.NewReader(`{"code":"`+uri.Query().Get("code")+`"}`))
+	if err != nil {
+		t.Fatalf("Pair request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Pair request at the default address returned %d", resp.StatusCode)
+	}
+}
+
+// TestNativeHost tests serving domain-scoped secrets to a browser
+// extension over native messaging
+func TestNativeHost(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("confirmation goes through polkit on Linux only")
+	}
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	bin := filepath.Join(filepath.Dir(dbPath), "bin")
+	os.MkdirAll(bin, 0700)
+	os.WriteFile(filepath.Join(bin, "pkcheck"), []byte("#!/bin/sh\n[ -z \"$PKCHECK_DENY\" ] || exit 3\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	runLockbox("init")
+	runLockbox("set", "GITHUB_PASSWORD", "hunter2", "--tag", "domain:github.com", "--description", "GitHub login")
+	runLockbox("set", "API_KEY", "sk-123")
+
+	// exchange sends requests to native-host and returns its responses
+	exchange := func(requests ...nativehost.Request) []nativehost.Response {
+		var in bytes.Buffer
+		for _, req := range requests {
+			nativehost.WriteMessage(&in, req)
+		}
+		cmd := exec.Command("./lockbox", "native-host", "chrome-extension://abc/")
+		cmd.Stdin = &in
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("native-host failed: %v", err)
+		}
+		var responses []nativehost.Response
+		r := bytes.NewReader(out)
+		for {
+			var resp nativehost.Response
+			if err := nativehost.ReadMessage(r, &resp); err != nil {
+				break
+			}
+			responses = append(responses, resp)
+		}
+		return responses
+	}
+
+	got := exchange(
+		nativehost.Request{Type: "list", URL: "https://github.com/login"},
+		nativehost.Request{Type: "get", URL: "https://gist.github.com/", Key: "GITHUB_PASSWORD"},
+		nativehost.Request{Type: "get", URL: "https://example.com/", Key: "GITHUB_PASSWORD"},
+		nativehost.Request{Type: "get", URL: "https://github.com/", Key: "API_KEY"},
+	)
+	if len(got) != 4 {
+		t.Fatalf("Got %d responses, want 4", len(got))
+	}
+	if len(got[0].Secrets) != 1 || got[0].Secrets[0] != (nativehost.Secret{Key: "GITHUB_PASSWORD", Description: "GitHub login"}) {
+		t.Errorf("list = %+v", got[0])
+	}
+	if got[1].Value != "hunter2" {
+		t.Errorf("get on a subdomain = %+v", got[1])
+	}
+	if got[2].Value != "" || got[3].Value != "" || got[2].Error != got[3].Error {
+		t.Errorf("get of secrets not offered = %+v, %+v", got[2], got[3])
+	}
+
+	t.Setenv("PKCHECK_DENY", "1")
+	if got := exchange(nativehost.Request{Type: "get", URL: "https://github.com/", Key: "GITHUB_PASSWORD"}); len(got) != 1 || got[0].Value != "" || !strings.Contains(got[0].Error, "denied") {
+		t.Errorf("get when denied = %+v", got)
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if _, stderr, exitCode := runLockbox("native-host", "install", "chrome", "abc"); exitCode != 0 {
+		t.Fatalf("native-host install failed: %s", stderr)
+	}
+	manifest, err := os.ReadFile(filepath.Join(home, ".config/google-chrome/NativeMessagingHosts", nativehost.Name+".json"))
+	if err != nil || !strings.Contains(string(manifest), "chrome-extension://abc/") {
+		t.Errorf("manifest = %s, %v", manifest, err)
+	}
+}
+
 // TestServer tests HTTP server endpoints
 func TestServer(t *testing.T) {
 	_, cleanup := setupTest(t)
@@ -432,6 +772,37 @@ func TestServer(t *testing.T) {
 }
 
 // TestRemoteEnv tests `lockbox env --remote` fetches from server
+func TestServerAutoTLS(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+
+	cmd := exec.Command("./lockbox", "serve", "-p", "9881", "--auto-tls")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
+	time.Sleep(500 * time.Millisecond)
+
+	ca := filepath.Join(filepath.Dir(dbPath), "tls", "cert.pem")
+	stdout, stderr, exitCode := runLockbox("env", "--remote", "https://localhost:9881", "--ca", ca)
+	if exitCode != 0 || !strings.Contains(stdout, "secret123") {
+		t.Fatalf("env over TLS = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("env", "--remote", "https://localhost:9881"); exitCode == 0 {
+		t.Error("env trusted a self-signed certificate without --ca")
+	}
+	stdout, stderr, _ = runLockbox("env", "--remote", "https://localhost:9881", "--insecure")
+	if !strings.Contains(stdout, "secret123") || !strings.Contains(stderr, "not verifying") {
+		t.Errorf("env --insecure = %q: %s", stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("env", "--remote", "http://localhost:9881"); exitCode == 0 {
+		t.Error("Plain HTTP reached a TLS server")
+	}
+}
+
 func TestRemoteEnv(t *testing.T) {
 	_, cleanup := setupTest(t)
 	defer cleanup()
@@ -489,114 +860,3946 @@ func TestRemoteRun(t *testing.T) {
 	}
 }
 
-// TestNoInitError tests that operations without init fail properly
-func TestNoInitError(t *testing.T) {
+// TestRemoteWrite tests `lockbox set --remote` and `lockbox delete --remote`
+func TestRemoteWrite(t *testing.T) {
 	_, cleanup := setupTest(t)
 	defer cleanup()
 
-	// Don't run init - should fail
-	_, stderr, exitCode := runLockbox("set", "KEY", "value")
+	runLockbox("init")
+	runLockbox("set", "TMP_A", "a")
+	runLockbox("set", "TMP_B", "b")
 
-	if exitCode == 0 {
-		t.Errorf("Expected non-zero exit code when not initialized, got 0")
+	cmd := exec.Command("./lockbox", "serve", "-p", "9882")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
 	}
+	defer cmd.Process.Kill()
 
-	if !strings.Contains(stderr, "initialization key not found") && !strings.Contains(stderr, "init") {
-		t.Errorf("Expected initialization error message, got: %s", stderr)
+	time.Sleep(500 * time.Millisecond)
+
+	// Writes over TCP need a token with write access
+	if _, _, exitCode := runLockbox("set", "PUSHED", "pushed_value", "--remote", "127.0.0.1:9882"); exitCode == 0 {
+		t.Error("Expected a remote set without a token to fail")
+	}
+	token, _, _ := runLockbox("token", "create", "pusher")
+	runLockbox("role", "assign", "admin", "--token", "pusher")
+	t.Setenv("LOCKBOX_TOKEN", strings.TrimSpace(token))
+
+	if _, stderr, exitCode := runLockbox("set", "PUSHED", "pushed_value", "--remote", "127.0.0.1:9882"); exitCode != 0 {
+		t.Fatalf("Remote set failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "PUSHED"); strings.TrimSpace(stdout) != "pushed_value" {
+		t.Errorf("Remote set was not stored locally, got: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("set", "PUSHED", "x", "--remote", "127.0.0.1:9882", "--owner", "root"); exitCode == 0 {
+		t.Error("Expected --owner with --remote to fail")
+	}
+
+	if _, _, exitCode := runLockbox("delete", "TMP_*", "--remote", "127.0.0.1:9882"); exitCode == 0 {
+		t.Error("Expected a remote pattern delete without --force to fail")
+	}
+	stdout, stderr, exitCode := runLockbox("delete", "TMP_*", "--force", "--remote", "127.0.0.1:9882")
+	if exitCode != 0 {
+		t.Fatalf("Remote delete failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "TMP_A") || !strings.Contains(stdout, "TMP_B") {
+		t.Errorf("Expected both keys deleted, got: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("list"); strings.Contains(stdout, "TMP_") || !strings.Contains(stdout, "PUSHED") {
+		t.Errorf("Unexpected secrets after remote delete: %s", stdout)
 	}
 }
 
-// TestMultipleSecrets tests handling many secrets at once
-func TestMultipleSecrets(t *testing.T) {
+func TestSignedRemote(t *testing.T) {
 	_, cleanup := setupTest(t)
 	defer cleanup()
 
-	// Initialize
 	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
 
-	// Set many secrets
-	for i := 0; i < 10; i++ {
-		key := fmt.Sprintf("SECRET_%d", i)
-		value := fmt.Sprintf("value_%d", i)
-		runLockbox("set", key, value)
+	cmd := exec.Command("./lockbox", "serve", "-p", "9883", "--sign")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
 	}
+	defer cmd.Process.Kill()
 
-	// Verify all can be retrieved
-	for i := 0; i < 10; i++ {
-		key := fmt.Sprintf("SECRET_%d", i)
-		expected := fmt.Sprintf("value_%d", i)
+	time.Sleep(500 * time.Millisecond)
 
-		stdout, _, exitCode := runLockbox("get", key)
-		if exitCode != 0 {
-			t.Errorf("Failed to get %s", key)
-		}
+	_, shown, ok := strings.Cut(out.String(), "--verify-key ")
+	if !ok {
+		t.Fatalf("Server did not show its key: %s", out.String())
+	}
+	key, _, _ := strings.Cut(shown, "\n")
 
-		if stdout != expected {
-			t.Errorf("Expected %s, got %s", expected, stdout)
-		}
+	stdout, stderr, exitCode := runLockbox("env", "--remote", "127.0.0.1:9883", "--verify-key", key)
+	if exitCode != 0 {
+		t.Fatalf("Verified remote env failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "secret123") {
+		t.Errorf("Unexpected env output: %s", stdout)
+	}
+	if stdout, stderr, _ := runLockbox("run", "--remote", "127.0.0.1:9883", "--verify-key", key, "--", "sh", "-c", "echo $API_KEY"); strings.TrimSpace(stdout) != "secret123" {
+		t.Errorf("Verified remote run = %q, %s", stdout, stderr)
 	}
 
-	// Verify list shows all
-	stdout, _, _ := runLockbox("list")
-	for i := 0; i < 10; i++ {
-		key := fmt.Sprintf("SECRET_%d", i)
-		if !strings.Contains(stdout, key) {
-			t.Errorf("Expected %s in list", key)
-		}
+	other := strings.Repeat("ab", 32)
+	if _, stderr, exitCode := runLockbox("env", "--remote", "127.0.0.1:9883", "--verify-key", other); exitCode == 0 || !strings.Contains(stderr, "signed by key") {
+		t.Errorf("Expected env with another key to fail, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("env", "--remote", "127.0.0.1:9883", "--verify-key", "nothex"); exitCode == 0 || !strings.Contains(stderr, "invalid --verify-key") {
+		t.Errorf("Expected an invalid key error, got exit code %d: %s", exitCode, stderr)
 	}
 }
 
-// TestLargeValue tests handling large secret values
-func TestLargeValue(t *testing.T) {
-	_, cleanup := setupTest(t)
+// TestRemoteUnixSocket tests `lockbox run --remote unix://...` against serve --socket
+func TestRemoteUnixSocket(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
 	defer cleanup()
 
-	// Initialize
 	runLockbox("init")
+	runLockbox("set", "SOCKET_VAR", "socket_value")
 
-	// Create a large value (10KB)
-	largeValue := strings.Repeat("A", 10240)
+	socket := filepath.Join(filepath.Dir(dbPath), "lockbox.sock")
+	cmd := exec.Command("./lockbox", "serve", "--socket", socket)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
 
-	// Set and retrieve
-	runLockbox("set", "LARGE_SECRET", largeValue)
+	time.Sleep(500 * time.Millisecond)
 
-	stdout, _, exitCode := runLockbox("get", "LARGE_SECRET")
+	stdout, stderr, exitCode := runLockbox("run", "--remote", "unix://"+socket, "--", "sh", "-c", "echo $SOCKET_VAR")
 	if exitCode != 0 {
-		t.Fatalf("Failed to get large secret")
+		t.Errorf("Remote run over unix socket failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "socket_value") {
+		t.Errorf("Expected 'socket_value' in output, got: %s", stdout)
 	}
 
-	if stdout != largeValue {
-		t.Errorf("Large value not preserved correctly. Length: expected %d, got %d", len(largeValue), len(stdout))
+	stdout, stderr, exitCode = runLockbox("env", "--remote", "unix://"+socket)
+	if exitCode != 0 {
+		t.Errorf("Remote env over unix socket failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "SOCKET_VAR") {
+		t.Errorf("Expected SOCKET_VAR in output, got: %s", stdout)
 	}
 }
 
-// TestSpecialCharactersInKeys tests keys with special characters
-func TestSpecialCharactersInKeys(t *testing.T) {
+// TestPolicy tests granting, listing and revoking unix socket policies
+func TestPolicy(t *testing.T) {
 	_, cleanup := setupTest(t)
 	defer cleanup()
 
-	// Initialize
 	runLockbox("init")
 
-	// Set secrets with various characters
-	keys := []string{
-		"SIMPLE_KEY",
-		"key.with.dots",
-		"key-with-dashes",
-		"KEY_WITH_NUMBERS_123",
+	stdout, stderr, exitCode := runLockbox("policy", "allow", "--user", "0", "APP_*")
+	if exitCode != 0 {
+		t.Fatalf("policy allow failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Granted") {
+		t.Errorf("Expected grant message, got: %s", stdout)
 	}
 
-	for _, key := range keys {
-		value := fmt.Sprintf("value_for_%s", key)
-		runLockbox("set", key, value)
+	stdout, _, _ = runLockbox("policy", "list")
+	if !strings.Contains(stdout, "APP_*") {
+		t.Errorf("Expected APP_* in policy list, got: %s", stdout)
+	}
 
-		stdout, _, exitCode := runLockbox("get", key)
-		if exitCode != 0 {
-			t.Errorf("Failed to get key %s", key)
-		}
+	if _, _, exitCode := runLockbox("policy", "allow", "--user", "0", "--group", "0", "X"); exitCode == 0 {
+		t.Errorf("Expected failure with both --user and --group")
+	}
 
-		if stdout != value {
-			t.Errorf("Expected %s, got %s for key %s", value, stdout, key)
+	stdout, _, _ = runLockbox("policy", "allow", "--claim", "groups=dev", "DEV_*")
+	if !strings.Contains(stdout, "claim groups=dev") {
+		t.Errorf("Expected claim grant message, got: %s", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("policy", "revoke", "--user", "0", "APP_*"); exitCode != 0 {
+		t.Errorf("policy revoke failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("policy", "revoke", "--user", "0", "APP_*"); exitCode == 0 {
+		t.Errorf("Expected failure revoking a missing policy")
+	}
+}
+
+// TestRole tests assigning built-in and custom roles
+func TestRole(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	stdout, _, _ := runLockbox("role", "list", "--porcelain")
+	if !strings.Contains(stdout, "role\tauditor\tlist,audit\tbuilt-in") {
+		t.Errorf("Expected the built-in auditor role, got: %s", stdout)
+	}
+
+	stdout, stderr, exitCode := runLockbox("role", "create", "deployer", "--permissions", "read,write")
+	if exitCode != 0 {
+		t.Fatalf("role create failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "read, write") {
+		t.Errorf("Expected the role's permissions, got: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("role", "create", "admin", "--permissions", "read"); exitCode == 0 {
+		t.Errorf("Expected failure redefining a built-in role")
+	}
+	if _, _, exitCode := runLockbox("role", "create", "x", "--permissions", "delete"); exitCode == 0 {
+		t.Errorf("Expected failure with an unknown permission")
+	}
+
+	if _, stderr, exitCode := runLockbox("role", "assign", "auditor", "--user", "0"); exitCode != 0 {
+		t.Fatalf("role assign failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	runLockbox("role", "assign", "deployer", "--token", "ci", "CI_*")
+	if _, _, exitCode := runLockbox("role", "assign", "missing", "--token", "ci"); exitCode == 0 {
+		t.Errorf("Expected failure assigning an unknown role")
+	}
+
+	stdout, _, _ = runLockbox("policy", "list", "--porcelain")
+	if !strings.Contains(stdout, "policy\tuid:0\t*\tauditor") || !strings.Contains(stdout, "policy\ttoken:ci\tCI_*\tdeployer") {
+		t.Errorf("Expected both assignments in the policy list, got: %s", stdout)
+	}
+
+	stdout, _, _ = runLockbox("audit", "--action", "role-assigned")
+	if !strings.Contains(stdout, "deployer token:ci CI_*") {
+		t.Errorf("Expected the assignment in the audit log, got: %s", stdout)
+	}
+
+	// Deleting a role drops its assignments
+	runLockbox("role", "delete", "deployer")
+	stdout, _, _ = runLockbox("policy", "list")
+	if strings.Contains(stdout, "deployer") {
+		t.Errorf("Expected deployer assignments to be gone, got: %s", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("role", "unassign", "auditor", "--user", "0"); exitCode != 0 {
+		t.Errorf("role unassign failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("role", "unassign", "auditor", "--user", "0"); exitCode == 0 {
+		t.Errorf("Expected failure removing a missing assignment")
+	}
+}
+
+// TestSudoGet tests that `lockbox sudo-get` delegates to the helper
+func TestSudoGet(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A stand-in helper that echoes what it was asked for
+	helper := filepath.Join(filepath.Dir(dbPath), "lockbox-helper")
+	os.WriteFile(helper, []byte("#!/bin/sh\nprintf '%s:%s:%s' \"$1\" \"$2\" \"$3\"\n"), 0700)
+	os.Setenv("LOCKBOX_HELPER", helper)
+	defer os.Unsetenv("LOCKBOX_HELPER")
+
+	stdout, stderr, exitCode := runLockbox("sudo-get", "--group", "deploy", "DEPLOY_KEY")
+	if exitCode != 0 {
+		t.Fatalf("sudo-get failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if stdout != "get:deploy:DEPLOY_KEY" {
+		t.Errorf("Expected helper output, got: %q", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("sudo-get", "DEPLOY_KEY"); exitCode == 0 {
+		t.Errorf("Expected failure without --group")
+	}
+}
+
+// TestEntrypoint tests `lockbox entrypoint` fetching from LOCKBOX_REMOTE and exec'ing the command
+func TestEntrypoint(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "ENTRY_VAR", "entry_value")
+	token, _, _ := runLockbox("token", "create", "entry")
+	runLockbox("policy", "allow", "--token", "entry", "ENTRY_*")
+
+	cmd := exec.Command("./lockbox", "serve", "-p", "9879")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	// The entrypoint retries while the server is starting
+	os.Setenv("LOCKBOX_REMOTE", "127.0.0.1:9879")
+	os.Setenv("LOCKBOX_TOKEN", strings.TrimSpace(token))
+	defer os.Unsetenv("LOCKBOX_REMOTE")
+	defer os.Unsetenv("LOCKBOX_TOKEN")
+
+	stdout, stderr, exitCode := runLockbox("entrypoint", "--retry-delay", "200ms", "--", "sh", "-c", "echo $ENTRY_VAR; echo token=$LOCKBOX_TOKEN; exit 4")
+	if exitCode != 4 {
+		t.Errorf("Expected the command's exit code 4, got %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "entry_value") {
+		t.Errorf("Expected 'entry_value' in output, got: %s", stdout)
+	}
+	if !strings.Contains(stdout, "token=\n") {
+		t.Errorf("Expected LOCKBOX_TOKEN to be stripped, got: %s", stdout)
+	}
+}
+
+// TestMaterialize tests `lockbox materialize` writing remote secrets and skipping unchanged re-runs
+func TestMaterialize(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "MAT_VAR", "mat_value")
+
+	cmd := exec.Command("./lockbox", "serve", "-p", "9880")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	time.Sleep(500 * time.Millisecond)
+
+	dir := filepath.Join(filepath.Dir(dbPath), "shared")
+	stdout, stderr, exitCode := runLockbox("materialize", "--remote", "127.0.0.1:9880", "--dir", dir)
+	if exitCode != 0 {
+		t.Fatalf("materialize failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Wrote 1 secrets") {
+		t.Errorf("Expected write message, got: %s", stdout)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "MAT_VAR"))
+	if string(data) != "mat_value" {
+		t.Errorf("Expected 'mat_value', got: %q", data)
+	}
+
+	stdout, _, _ = runLockbox("materialize", "--remote", "127.0.0.1:9880", "--dir", dir)
+	if !strings.Contains(stdout, "up to date") {
+		t.Errorf("Expected unchanged re-run to skip, got: %s", stdout)
+	}
+}
+
+// TestPodmanDriver tests the Podman shell driver commands
+func TestPodmanDriver(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	// driver runs a driver command the way Podman does
+	driver := func(op, id, stdin string) (string, int) {
+		cmd := exec.Command("./lockbox", "podman-driver", op)
+		cmd.Env = append(os.Environ(), "SECRET_ID="+id)
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(out), exitErr.ExitCode()
+		}
+		return string(out), 0
+	}
+
+	if _, code := driver("store", "a1b2c3", "pod\nsecret"); code != 0 {
+		t.Fatalf("store failed with exit code %d", code)
+	}
+	if out, code := driver("lookup", "a1b2c3", ""); code != 0 || out != "pod\nsecret" {
+		t.Errorf("lookup = %q (exit %d)", out, code)
+	}
+	if out, _ := driver("list", "", ""); out != "a1b2c3\n" {
+		t.Errorf("list = %q", out)
+	}
+
+	// Podman secrets are not exported as environment variables
+	stdout, _, _ := runLockbox("list")
+	if strings.Contains(stdout, "a1b2c3") {
+		t.Errorf("Podman secret leaked into list: %s", stdout)
+	}
+
+	if _, code := driver("delete", "a1b2c3", ""); code != 0 {
+		t.Errorf("delete failed with exit code %d", code)
+	}
+	if _, code := driver("lookup", "a1b2c3", ""); code == 0 {
+		t.Errorf("lookup succeeded after delete")
+	}
+}
+
+// TestNoInitError tests that operations without init fail properly
+func TestNoInitError(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Don't run init - should fail
+	_, stderr, exitCode := runLockbox("set", "KEY", "value")
+
+	if exitCode == 0 {
+		t.Errorf("Expected non-zero exit code when not initialized, got 0")
+	}
+
+	if !strings.Contains(stderr, "initialization key not found") && !strings.Contains(stderr, "init") {
+		t.Errorf("Expected initialization error message, got: %s", stderr)
+	}
+}
+
+// TestMultipleSecrets tests handling many secrets at once
+func TestMultipleSecrets(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Initialize
+	runLockbox("init")
+
+	// Set many secrets
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("SECRET_%d", i)
+		value := fmt.Sprintf("value_%d", i)
+		runLockbox("set", key, value)
+	}
+
+	// Verify all can be retrieved
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("SECRET_%d", i)
+		expected := fmt.Sprintf("value_%d", i)
+
+		stdout, _, exitCode := runLockbox("get", key)
+		if exitCode != 0 {
+			t.Errorf("Failed to get %s", key)
+		}
+
+		if stdout != expected {
+			t.Errorf("Expected %s, got %s", expected, stdout)
+		}
+	}
+
+	// Verify list shows all
+	stdout, _, _ := runLockbox("list")
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("SECRET_%d", i)
+		if !strings.Contains(stdout, key) {
+			t.Errorf("Expected %s in list", key)
+		}
+	}
+}
+
+// TestLargeValue tests handling large secret values
+func TestLargeValue(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Initialize
+	runLockbox("init")
+
+	// Create a large value (10KB)
+	largeValue := strings.Repeat("A", 10240)
+
+	// Set and retrieve
+	runLockbox("set", "LARGE_SECRET", largeValue)
+
+	stdout, _, exitCode := runLockbox("get", "LARGE_SECRET")
+	if exitCode != 0 {
+		t.Fatalf("Failed to get large secret")
+	}
+
+	if stdout != largeValue {
+		t.Errorf("Large value not preserved correctly. Length: expected %d, got %d", len(largeValue), len(stdout))
+	}
+}
+
+// TestSpecialCharactersInKeys tests keys with special characters
+func TestSpecialCharactersInKeys(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Initialize
+	runLockbox("init")
+
+	// Set secrets with various characters
+	keys := []string{
+		"SIMPLE_KEY",
+		"key.with.dots",
+		"key-with-dashes",
+		"KEY_WITH_NUMBERS_123",
+	}
+
+	for _, key := range keys {
+		value := fmt.Sprintf("value_for_%s", key)
+		runLockbox("set", key, value)
+
+		stdout, _, exitCode := runLockbox("get", key)
+		if exitCode != 0 {
+			t.Errorf("Failed to get key %s", key)
+		}
+
+		if stdout != value {
+			t.Errorf("Expected %s, got %s for key %s", value, stdout, key)
+		}
+	}
+}
+
+// TestSharedValues tests that keys holding the same value stay independent
+func TestSharedValues(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "TOKEN_A", "shared_token")
+	runLockbox("set", "TOKEN_B", "shared_token")
+
+	// Deleting one key must not affect the other
+	runLockbox("delete", "TOKEN_A")
+	stdout, stderr, exitCode := runLockbox("get", "TOKEN_B")
+	if exitCode != 0 {
+		t.Fatalf("Get failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if stdout != "shared_token" {
+		t.Errorf("Expected 'shared_token', got: %s", stdout)
+	}
+
+	// Changing one key must not affect the other
+	runLockbox("set", "TOKEN_A", "shared_token")
+	runLockbox("set", "TOKEN_A", "changed")
+	stdout, _, _ = runLockbox("get", "TOKEN_B")
+	if stdout != "shared_token" {
+		t.Errorf("Expected TOKEN_B to keep 'shared_token', got: %s", stdout)
+	}
+}
+
+// TestPushMetrics tests that --push-metrics reports the command result
+func TestPushMetrics(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	pushed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushed <- r.URL.Path + "\n" + string(body)
+	}))
+	defer server.Close()
+
+	runLockbox("init")
+
+	// A failing command is reported with success 0
+	_, _, exitCode := runLockbox("get", "MISSING", "--push-metrics", server.URL)
+	if exitCode == 0 {
+		t.Fatalf("Expected get of missing key to fail")
+	}
+
+	select {
+	case got := <-pushed:
+		if !strings.Contains(got, "/command/get") {
+			t.Errorf("Expected push for command 'get', got: %s", got)
+		}
+		if !strings.Contains(got, "lockbox_command_success 0") {
+			t.Errorf("Expected failure to be reported, got: %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No metrics were pushed")
+	}
+}
+
+// TestStatus tests `lockbox status --check` locally and against /readyz
+func TestStatus(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Uninitialized store fails the check
+	_, _, exitCode := runLockbox("status", "--check")
+	if exitCode == 0 {
+		t.Errorf("Expected status --check to fail before init")
+	}
+
+	runLockbox("init")
+
+	stdout, stderr, exitCode := runLockbox("status", "--check")
+	if exitCode != 0 {
+		t.Fatalf("Status failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "ready") {
+		t.Errorf("Expected ready message, got: %s", stdout)
+	}
+
+	// Start server in background
+	cmd := exec.Command("./lockbox", "serve", "-p", "9879")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:9879/readyz")
+	if err != nil {
+		t.Fatalf("Failed to call /readyz: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Readiness returned status %d, expected 200: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), `"database"`) {
+		t.Errorf("Expected database check in readiness report, got: %s", body)
+	}
+
+	stdout, stderr, exitCode = runLockbox("status", "--check", "--json", "--remote", "127.0.0.1:9879")
+	if exitCode != 0 {
+		t.Fatalf("Remote status failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, `"status":"ok"`) {
+		t.Errorf("Expected ok status in JSON report, got: %s", stdout)
+	}
+}
+
+func TestStats(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_PASSWORD", "hunter2", "--tag", "db", "--tag", "prod")
+	runLockbox("set", "API_KEY", "sk-123", "--tag", "prod")
+	runLockbox("set", "DEBUG", "1")
+	runLockbox("--profile", "staging", "init")
+	runLockbox("--profile", "staging", "set", "APP_URL", "https://staging")
+
+	stdout, stderr, exitCode := runLockbox("stats", "--json")
+	if exitCode != 0 {
+		t.Fatalf("Stats failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	var st struct {
+		SchemaVersion int            `json:"schema_version"`
+		Profile       string         `json:"profile"`
+		SizeBytes     int64          `json:"size_bytes"`
+		Secrets       int            `json:"secrets"`
+		ByType        map[string]int `json:"by_type"`
+		ByTag         map[string]int `json:"by_tag"`
+		Untagged      int            `json:"untagged"`
+		ByProfile     map[string]int `json:"by_profile"`
+		LastBackup    *time.Time     `json:"last_backup"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &st); err != nil {
+		t.Fatalf("Failed to parse stats: %v\n%s", err, stdout)
+	}
+	if st.SchemaVersion != 1 || st.Profile != "default" || st.SizeBytes == 0 {
+		t.Errorf("Unexpected stats header: %s", stdout)
+	}
+	if st.Secrets != 3 || st.ByType["secret"] != 3 || st.ByTag["prod"] != 2 || st.Untagged != 1 {
+		t.Errorf("Unexpected counts: %s", stdout)
+	}
+	if st.ByProfile["default"] != 3 || st.ByProfile["staging"] != 1 {
+		t.Errorf("Expected counts of both profiles, got: %v", st.ByProfile)
+	}
+	if st.LastBackup != nil {
+		t.Errorf("Expected no backup, got %v", st.LastBackup)
+	}
+
+	stdout, _, _ = runLockbox("--profile", "staging", "stats")
+	if !strings.Contains(stdout, "Profile:      staging") || !strings.Contains(stdout, "Last backup:  never") {
+		t.Errorf("Unexpected text stats: %s", stdout)
+	}
+}
+
+// TestToken tests creating, listing and revoking API tokens
+func TestToken(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	stdout, stderr, exitCode := runLockbox("token", "create", "ci")
+	if exitCode != 0 {
+		t.Fatalf("token create failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.HasPrefix(stdout, "lbx_") {
+		t.Errorf("Expected a token on stdout, got: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("token", "create", "ci"); exitCode == 0 {
+		t.Errorf("Expected failure creating a duplicate token")
+	}
+
+	if _, stderr, exitCode := runLockbox("policy", "allow", "--token", "ci", "CI_*"); exitCode != 0 {
+		t.Errorf("policy allow --token failed: %s", stderr)
+	}
+
+	stdout, stderr, exitCode = runLockbox("token", "create", "deploy", "--ttl", "1h", "--refresh", "--scope", "read:APP_*")
+	if exitCode != 0 {
+		t.Fatalf("token create --ttl failed: %s", stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 {
+		t.Errorf("Expected a token and a refresh token, got: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("token", "create", "bad", "--scope", "write:APP_*"); exitCode == 0 {
+		t.Errorf("Expected failure with an invalid scope")
+	}
+	if _, _, exitCode := runLockbox("token", "create", "bad", "--refresh"); exitCode == 0 {
+		t.Errorf("Expected failure with --refresh but no --ttl")
+	}
+
+	if _, stderr, exitCode := runLockbox("token", "revoke", "ci"); exitCode != 0 {
+		t.Errorf("token revoke failed: %s", stderr)
+	}
+	if _, _, exitCode := runLockbox("token", "revoke", "ci"); exitCode == 0 {
+		t.Errorf("Expected failure revoking a token twice")
+	}
+
+	stdout, _, _ = runLockbox("token", "list")
+	if !strings.Contains(stdout, "ci\t") || !strings.Contains(stdout, "revoked") {
+		t.Errorf("Expected ci listed as revoked, got: %s", stdout)
+	}
+	if !strings.Contains(stdout, "(refreshable)\tread:APP_*") {
+		t.Errorf("Expected deploy listed as refreshable with its scope, got: %s", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("token", "create", "bot", "--max-reads", "100", "--max-keys", "5"); exitCode != 0 {
+		t.Fatalf("token create with quotas failed: %s", stderr)
+	}
+	if _, _, exitCode := runLockbox("token", "create", "bad", "--max-reads", "-1"); exitCode == 0 {
+		t.Errorf("Expected failure with a negative quota")
+	}
+	stdout, _, _ = runLockbox("token", "list")
+	if !strings.Contains(stdout, "0/100 reads today, 0/5 keys") {
+		t.Errorf("Expected bot's quota usage listed, got: %s", stdout)
+	}
+	// Flags left out keep their value
+	stdout, stderr, exitCode = runLockbox("token", "quota", "bot", "--max-reads", "0", "--porcelain")
+	if exitCode != 0 || stdout != "token-quota\tbot\t0\t5\n" {
+		t.Errorf("token quota = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("token", "quota", "ci", "--max-keys", "1"); exitCode == 0 {
+		t.Errorf("Expected failure setting the quota of a revoked token")
+	}
+}
+
+// TestLintAndFmt tests checking and formatting templates and manifests
+func TestLintAndFmt(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "APP_DB", "postgres://")
+	runLockbox("set", "OTHER", "x")
+	runLockbox("token", "create", "ci", "--scope", "read:APP_*")
+
+	dir := filepath.Dir(dbPath)
+	tmpl := filepath.Join(dir, "config.ctmpl")
+	os.WriteFile(tmpl, []byte("db = {{key \"APP_DB\"}}\nother = {{ key \"OTHER\" }}  \n"), 0644)
+	manifest := filepath.Join(dir, "app.manifest")
+	os.WriteFile(manifest, []byte("OTHER\nAPP_DB\n"), 0644)
+
+	stdout, stderr, exitCode := runLockbox("lint", tmpl, manifest)
+	if exitCode != 0 {
+		t.Fatalf("lint failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if !strings.Contains(stdout, "4 references in 2 files") {
+		t.Errorf("Expected a summary, got: %s", stdout)
+	}
+
+	stdout, _, exitCode = runLockbox("lint", "--token", "ci", tmpl)
+	if exitCode == 0 || !strings.Contains(stdout, tmpl+":2:17: access to secret 'OTHER' denied") {
+		t.Errorf("Expected OTHER to be denied to the token, got: %s", stdout)
+	}
+
+	os.WriteFile(manifest, []byte("MISSING\n"), 0644)
+	stdout, _, exitCode = runLockbox("lint", manifest)
+	if exitCode == 0 || !strings.Contains(stdout, "secret 'MISSING' not found") {
+		t.Errorf("Expected MISSING to be reported, got: %s", stdout)
+	}
+
+	stdout, _, exitCode = runLockbox("fmt", "--check", tmpl)
+	if exitCode == 0 || strings.TrimSpace(stdout) != tmpl {
+		t.Errorf("Expected fmt --check to list the template, got: %s", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("fmt", tmpl); exitCode != 0 {
+		t.Fatalf("fmt failed: %s", stderr)
+	}
+	data, _ := os.ReadFile(tmpl)
+	if string(data) != "db = {{ key \"APP_DB\" }}\nother = {{ key \"OTHER\" }}\n" {
+		t.Errorf("Unexpected formatted template %q", data)
+	}
+	if _, _, exitCode := runLockbox("fmt", "--check", tmpl); exitCode != 0 {
+		t.Errorf("Expected the formatted template to pass fmt --check")
+	}
+}
+
+// TestPorcelain tests the stable --porcelain output
+func TestPorcelain(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	stdout, _, _ := runLockbox("set", "API_KEY", "x", "--porcelain")
+	if stdout != "secret-set\tAPI_KEY\n" {
+		t.Errorf("Unexpected set output %q", stdout)
+	}
+	runLockbox("set", "DB_URL", "y")
+
+	stdout, _, _ = runLockbox("list", "--porcelain=v1")
+	if want := fmt.Sprintf("secret\tAPI_KEY\tuid:%[1]d\nsecret\tDB_URL\tuid:%[1]d\n", os.Getuid()); stdout != want {
+		t.Errorf("Unexpected list output %q", stdout)
+	}
+
+	runLockbox("policy", "allow", "--user", "0", "APP_*")
+	stdout, _, _ = runLockbox("policy", "list", "--porcelain")
+	if stdout != "policy\tuid:0\tAPP_*\treader\n" {
+		t.Errorf("Unexpected policy list output %q", stdout)
+	}
+
+	runLockbox("token", "create", "ci", "--scope", "read:APP_*")
+	stdout, _, _ = runLockbox("token", "list", "--porcelain")
+	if fields := strings.Split(strings.TrimSuffix(stdout, "\n"), "\t"); len(fields) != 11 || fields[0] != "token" || fields[1] != "ci" || fields[3] != "" || fields[4] != "active" || fields[6] != "read:APP_*" || fields[8] != "0" {
+		t.Errorf("Unexpected token list output %q", stdout)
+	}
+
+	stdout, _, _ = runLockbox("delete", "DB_URL", "--porcelain")
+	if stdout != "secret-deleted\tDB_URL\n" {
+		t.Errorf("Unexpected delete output %q", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("list", "--porcelain=v9"); exitCode == 0 || !strings.Contains(stderr, "unsupported porcelain format") {
+		t.Errorf("Expected an unsupported format error, got: %s", stderr)
+	}
+}
+
+// TestGlobSelectors tests glob patterns as key arguments
+func TestGlobSelectors(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	for _, key := range []string{"DB_USER", "DB_PASSWORD", "TMP_A", "TMP_B", "APP_NAME"} {
+		runLockbox("set", key, strings.ToLower(key))
+	}
+
+	stdout, stderr, exitCode := runLockbox("get", "DB_*", "--json")
+	if exitCode != 0 {
+		t.Fatalf("get --json failed: %s", stderr)
+	}
+	if stdout != `{"DB_PASSWORD":"db_password","DB_USER":"db_user"}`+"\n" {
+		t.Errorf("Unexpected get --json output %q", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("get", "DB_*"); exitCode == 0 || !strings.Contains(stderr, "--json") {
+		t.Errorf("Expected several matches without --json to fail, got: %s", stderr)
+	}
+	if _, stderr, exitCode := runLockbox("get", "NONE_*"); exitCode == 0 || !strings.Contains(stderr, "no secrets match") {
+		t.Errorf("Expected an unmatched pattern to fail, got: %s", stderr)
+	}
+
+	stdout, _, _ = runLockbox("env", "APP_*", "DB_USER")
+	if stdout != "export APP_NAME=\"app_name\"\nexport DB_USER=\"db_user\"\n" {
+		t.Errorf("Unexpected env output %q", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("delete", "TMP_*"); exitCode == 0 {
+		t.Errorf("Expected deleting by pattern without --force to fail")
+	}
+	stdout, stderr, exitCode = runLockbox("delete", "TMP_*", "--force")
+	if exitCode != 0 || strings.Count(stdout, "deleted successfully") != 2 {
+		t.Errorf("delete --force failed: %s %s", stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("exists", "TMP_*"); exitCode != 1 {
+		t.Errorf("Expected TMP_* to be gone")
+	}
+	if _, _, exitCode := runLockbox("exists", "DB_*"); exitCode != 0 {
+		t.Errorf("Expected DB_* to exist")
+	}
+}
+
+// TestBatch tests running JSON commands from stdin in one transaction
+func TestBatch(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	// batch runs lockbox batch with stdin as input
+	batch := func(stdin string) (string, int) {
+		cmd := exec.Command("./lockbox", "batch")
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(out), exitErr.ExitCode()
+		}
+		return string(out), 0
+	}
+
+	out, code := batch(`{"id":"a","op":"set","key":"API_KEY","value":"secret123"}
+{"id":"b","op":"get","key":"API_KEY"}
+`)
+	if code != 0 {
+		t.Fatalf("batch failed with exit code %d: %s", code, out)
+	}
+	want := `{"id":"a","op":"set","key":"API_KEY","ok":true}
+{"id":"b","op":"get","key":"API_KEY","ok":true,"value":"secret123"}
+{"op":"commit","ok":true,"count":2}
+`
+	if out != want {
+		t.Errorf("Unexpected batch output:\n%s\nexpected:\n%s", out, want)
+	}
+
+	out, code = batch(`{"op":"set","key":"OTHER","value":"x"}
+{"op":"frobnicate","key":"API_KEY"}
+`)
+	if code != 1 || !strings.Contains(out, `"op":"rollback"`) {
+		t.Errorf("Expected a rollback, got exit code %d: %s", code, out)
+	}
+	if _, _, exitCode := runLockbox("exists", "OTHER"); exitCode != 1 {
+		t.Errorf("Rolled back set was written")
+	}
+}
+
+// TestConsole tests the console reading commands from a pipe
+func TestConsole(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	cmd := exec.Command("./lockbox", "console")
+	cmd.Stdin = strings.NewReader("set API_KEY secret123\nget API_KEY\nlist\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("console failed: %v", err)
+	}
+	if !strings.Contains(string(out), "secret123\nAPI_KEY\n") {
+		t.Errorf("Unexpected console output: %s", out)
+	}
+
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("Secret set in the console not stored: %q", stdout)
+	}
+	history, _ := os.ReadFile(filepath.Join(filepath.Dir(dbPath), "console_history"))
+	if strings.Contains(string(history), "secret123") {
+		t.Errorf("Console history contains a secret value: %s", history)
+	}
+}
+
+// TestReport tests that the inventory report lists keys but never values
+func TestReport(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "APP_TOKEN", "value-one")
+	runLockbox("set", "APP_COPY", "value-one")
+	runLockbox("set", "DB_PASSWORD", "value-two")
+
+	for _, format := range []string{"md", "csv", "html"} {
+		stdout, stderr, exitCode := runLockbox("report", "--format", format)
+		if exitCode != 0 {
+			t.Fatalf("report --format %s failed with exit code %d. Stderr: %s", format, exitCode, stderr)
+		}
+		if strings.Contains(stdout, "value-") {
+			t.Errorf("%s report contains a secret value:\n%s", format, stdout)
+		}
+		if !strings.Contains(stdout, "DB") {
+			t.Errorf("%s report is missing DB_PASSWORD:\n%s", format, stdout)
+		}
+	}
+
+	stdout, _, _ := runLockbox("report", "--format", "csv", "APP_*")
+	if strings.Count(stdout, "\n") != 3 || !strings.Contains(stdout, ",0,1,") || strings.Contains(stdout, "DB_PASSWORD") {
+		t.Errorf("Unexpected filtered report:\n%s", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("report", "--format", "pdf"); exitCode != 1 {
+		t.Errorf("Expected exit code 1 for an unknown format, got %d", exitCode)
+	}
+}
+
+// TestOwner tests recording owners on set and filtering by them
+func TestOwner(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "MINE", "a")
+	if _, stderr, exitCode := runLockbox("set", "CI_TOKEN", "b", "--owner", "token:ci"); exitCode != 0 {
+		t.Fatalf("set --owner failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	// Overwriting keeps the owner
+	runLockbox("set", "CI_TOKEN", "c")
+
+	stdout, _, _ := runLockbox("list", "--owner", "token:ci")
+	if stdout != "CI_TOKEN\n" {
+		t.Errorf("Unexpected list --owner output %q", stdout)
+	}
+	stdout, _, _ = runLockbox("list", "--owner", strconv.Itoa(os.Getuid()))
+	if stdout != "MINE\n" {
+		t.Errorf("Unexpected list --owner output for the current user %q", stdout)
+	}
+	stdout, _, _ = runLockbox("report", "--format", "csv", "--owner", "token:ci")
+	if !strings.Contains(stdout, "CI_TOKEN") || strings.Contains(stdout, "MINE") || !strings.HasSuffix(stdout, ",token:ci,,,\n") {
+		t.Errorf("Unexpected report --owner output:\n%s", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("set", "X", "y", "--owner", "no-such-user-xyz"); exitCode != 1 {
+		t.Errorf("Expected exit code 1 for an unknown owner, got %d", exitCode)
+	}
+}
+
+// TestBundle tests creating, verifying and opening a share bundle
+func TestBundle(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+
+	runLockbox("init")
+	runLockbox("set", "PROD_DB", "postgres://prod")
+	runLockbox("set", "PROD_KEY", "k")
+	runLockbox("set", "DEV_DB", "postgres://dev")
+
+	if _, stderr, exitCode := runLockbox("bundle", "keygen", filepath.Join(dir, "auditor")); exitCode != 0 {
+		t.Fatalf("bundle keygen failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("bundle", "keygen", filepath.Join(dir, "auditor")); exitCode != 1 {
+		t.Errorf("Expected keygen to refuse overwriting keys, got exit code %d", exitCode)
+	}
+
+	out := filepath.Join(dir, "prod.bundle")
+	stdout, stderr, exitCode := runLockbox("bundle", "create", "--only", "PROD_*", "--expires", "7d", "--for", filepath.Join(dir, "auditor.pub"), "--out", out)
+	if exitCode != 0 {
+		t.Fatalf("bundle create failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "2 secrets") {
+		t.Errorf("Unexpected create output %q", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("bundle", "verify", out); exitCode != 0 {
+		t.Errorf("bundle verify failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("bundle", "verify", out, "--signer", "SHA256:wrong"); exitCode != 1 {
+		t.Errorf("Expected verify to fail for another signer, got exit code %d", exitCode)
+	}
+
+	stdout, stderr, exitCode = runLockbox("bundle", "open", out, "--key", filepath.Join(dir, "auditor.key"))
+	if exitCode != 0 {
+		t.Fatalf("bundle open failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if stdout != "export PROD_DB=\"postgres://prod\"\nexport PROD_KEY=\"k\"\n" {
+		t.Errorf("Unexpected open output %q", stdout)
+	}
+}
+
+// TestNotes tests adding, reading, searching and editing notes
+func TestNotes(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+
+	add := exec.Command("./lockbox", "note", "add", "github")
+	add.Stdin = strings.NewReader("# GitHub\nRecovery codes are in the safe\n")
+	if out, err := add.CombinedOutput(); err != nil {
+		t.Fatalf("note add failed: %v: %s", err, out)
+	}
+	if _, _, exitCode := runLockbox("note", "add", "github"); exitCode != 1 {
+		t.Errorf("Expected adding an existing note to fail, got exit code %d", exitCode)
+	}
+
+	stdout, _, _ := runLockbox("note", "show", "github")
+	if stdout != "# GitHub\nRecovery codes are in the safe\n" {
+		t.Errorf("Unexpected note show output %q", stdout)
+	}
+	stdout, _, _ = runLockbox("note", "list")
+	if stdout != "github\n" {
+		t.Errorf("Unexpected note list output %q", stdout)
+	}
+	stdout, _, _ = runLockbox("note", "search", "SAFE")
+	if stdout != "github:2: Recovery codes are in the safe\n" {
+		t.Errorf("Unexpected note search output %q", stdout)
+	}
+	if _, _, exitCode := runLockbox("note", "search", "nothing"); exitCode != 1 {
+		t.Errorf("Expected a search without matches to exit 1, got %d", exitCode)
+	}
+
+	// Notes are not secrets
+	stdout, _, _ = runLockbox("env")
+	if strings.Contains(stdout, "Recovery") || strings.Contains(stdout, "github") {
+		t.Errorf("env exported a note:\n%s", stdout)
+	}
+	stdout, _, _ = runLockbox("list")
+	if stdout != "API_KEY\n" {
+		t.Errorf("list shows notes: %q", stdout)
+	}
+
+	// A fake editor appends a line
+	editorScript := filepath.Join(filepath.Dir(dbPath), "editor")
+	os.WriteFile(editorScript, []byte("#!/bin/sh\necho 'Second copy with IT' >> \"$1\"\n"), 0700)
+	edit := exec.Command("./lockbox", "note", "edit", "github")
+	edit.Env = append(os.Environ(), "VISUAL=", "EDITOR="+editorScript)
+	if out, err := edit.CombinedOutput(); err != nil {
+		t.Fatalf("note edit failed: %v: %s", err, out)
+	}
+	stdout, _, _ = runLockbox("note", "show", "github")
+	if !strings.HasSuffix(stdout, "Second copy with IT\n") {
+		t.Errorf("Edit was not saved: %q", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("note", "delete", "github"); exitCode != 0 {
+		t.Errorf("note delete failed with exit code %d", exitCode)
+	}
+	if _, _, exitCode := runLockbox("note", "show", "github"); exitCode != 1 {
+		t.Errorf("Expected a deleted note to be gone, got exit code %d", exitCode)
+	}
+}
+
+// TestRecoveryCodes tests handing out recovery codes one at a time
+func TestRecoveryCodes(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	codes := filepath.Join(filepath.Dir(dbPath), "codes.txt")
+	os.WriteFile(codes, []byte("# GitHub\naaaa-1111\nbbbb-2222\ncccc-3333\ndddd-4444\neeee-5555\n"), 0600)
+
+	if _, stderr, exitCode := runLockbox("recovery", "add", "GITHUB", "--codes-file", codes); exitCode != 0 {
+		t.Fatalf("recovery add failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("recovery", "add", "GITHUB", "--codes-file", codes); exitCode != 1 {
+		t.Errorf("Expected adding an existing set without --replace to fail, got %d", exitCode)
+	}
+
+	stdout, stderr, _ := runLockbox("recovery", "use", "GITHUB")
+	if stdout != "aaaa-1111\n" || stderr != "4 recovery codes left\n" {
+		t.Errorf("Unexpected first use: %q %q", stdout, stderr)
+	}
+	stdout, stderr, _ = runLockbox("recovery", "use", "GITHUB")
+	if stdout != "bbbb-2222\n" || !strings.Contains(stderr, "Warning: only 3") {
+		t.Errorf("Unexpected second use: %q %q", stdout, stderr)
+	}
+
+	stdout, _, _ = runLockbox("recovery", "status", "--porcelain")
+	if stdout != "recovery\tGITHUB\t3\t5\ttrue\n" {
+		t.Errorf("Unexpected status output %q", stdout)
+	}
+
+	runLockbox("recovery", "use", "GITHUB")
+	runLockbox("recovery", "use", "GITHUB")
+	runLockbox("recovery", "use", "GITHUB")
+	if _, stderr, exitCode := runLockbox("recovery", "use", "GITHUB"); exitCode != 1 || !strings.Contains(stderr, "all recovery codes have been used") {
+		t.Errorf("Expected an exhausted set to fail, got %d: %s", exitCode, stderr)
+	}
+
+	// Codes are never exported
+	if stdout, _, _ := runLockbox("env"); strings.Contains(stdout, "aaaa") {
+		t.Errorf("env exported recovery codes:\n%s", stdout)
+	}
+}
+
+// TestListLong tests the age view of list
+func TestListLong(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "B_KEY", "1")
+	runLockbox("set", "A_KEY", "2")
+
+	stdout, stderr, exitCode := runLockbox("list", "--long")
+	if exitCode != 0 {
+		t.Fatalf("list --long failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "KEY") || !strings.HasPrefix(lines[1], "A_KEY  0d") || !strings.HasSuffix(lines[2], "fresh") {
+		t.Errorf("Unexpected list --long output:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "\x1b[") {
+		t.Errorf("Expected no colors when not writing to a terminal:\n%q", stdout)
+	}
+
+	// Sorting by age puts the oldest first
+	stdout, _, _ = runLockbox("list", "--sort", "age")
+	if stdout != "B_KEY\nA_KEY\n" && stdout != "A_KEY\nB_KEY\n" {
+		t.Errorf("Unexpected list --sort age output %q", stdout)
+	}
+
+	stdout, _, _ = runLockbox("list", "--format", "json")
+	if !strings.Contains(stdout, `"key": "A_KEY",`) || !strings.Contains(stdout, `"age_days": 0,`) || !strings.Contains(stdout, `"status": "fresh"`) {
+		t.Errorf("Unexpected list --format json output:\n%s", stdout)
+	}
+
+	// Secrets never read come first, then the least recently read
+	runLockbox("get", "A_KEY")
+	stdout, stderr, exitCode = runLockbox("list", "--long", "--sort", "accessed")
+	lines = strings.Split(strings.TrimSpace(stdout), "\n")
+	if exitCode != 0 || len(lines) != 3 || !strings.HasPrefix(lines[1], "B_KEY") || !strings.Contains(lines[1], "never") ||
+		!strings.HasPrefix(lines[2], "A_KEY") || strings.Contains(lines[2], "never") {
+		t.Errorf("Unexpected list --long --sort accessed output (exit %d):\n%s%s", exitCode, stdout, stderr)
+	}
+	stdout, _, _ = runLockbox("report", "--format", "csv")
+	lines = strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], ",tags,expires,last_accessed") || !strings.HasSuffix(lines[1], "Z") || !strings.HasSuffix(lines[2], ",,,") {
+		t.Errorf("Unexpected report:\n%s", stdout)
+	}
+}
+
+// TestEscrow tests archiving deletes and overwrites and restoring from the
+// archive
+func TestEscrow(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+	archive := filepath.Join(dir, "lockbox.escrow")
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "first-value")
+	runLockbox("bundle", "keygen", filepath.Join(dir, "escrow"))
+
+	if _, stderr, exitCode := runLockbox("escrow", "enable", "--archive", archive, "--key", filepath.Join(dir, "escrow.pub")); exitCode != 0 {
+		t.Fatalf("escrow enable failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	runLockbox("set", "API_KEY", "second-value")
+	runLockbox("delete", "API_KEY")
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if strings.Contains(string(data), "first-value") || strings.Contains(string(data), "second-value") {
+		t.Errorf("Archive contains a plaintext value:\n%s", data)
+	}
+
+	stdout, _, _ := runLockbox("--porcelain", "escrow", "list")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "\toverwrite\tAPI_KEY") || !strings.HasSuffix(lines[1], "\tdelete\tAPI_KEY") {
+		t.Errorf("Unexpected escrow list output %q", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("escrow", "restore", "1", "--key", filepath.Join(dir, "escrow.key")); exitCode != 0 {
+		t.Fatalf("escrow restore failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "first-value" {
+		t.Errorf("Expected the restored value first-value, got %q", stdout)
+	}
+	if _, _, exitCode := runLockbox("escrow", "restore", "2", "--key", filepath.Join(dir, "escrow.key")); exitCode != 1 {
+		t.Errorf("Expected restore over an existing secret to need --force, got exit code %d", exitCode)
+	}
+
+	// A write fails rather than going unarchived
+	os.Remove(archive)
+	os.Mkdir(archive, 0700)
+	if _, _, exitCode := runLockbox("delete", "API_KEY"); exitCode != 1 {
+		t.Errorf("Expected delete to fail when the archive cannot be written, got exit code %d", exitCode)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "first-value" {
+		t.Errorf("Expected API_KEY to survive a failed delete, got %q", stdout)
+	}
+}
+
+// TestVerify tests the startup self-test and the verify command
+func TestVerify(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+
+	stdout, stderr, exitCode := runLockbox("verify", "--quick")
+	if exitCode != 0 || strings.Contains(stdout, "values decrypt") {
+		t.Errorf("verify --quick failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, exitCode := runLockbox("verify"); exitCode != 0 || !strings.Contains(stdout, "All 1 stored values decrypt") {
+		t.Errorf("verify failed with exit code %d. Stdout: %s", exitCode, stdout)
+	}
+
+	// Stores from before the sentinel get one on first use
+	store, err := db.OpenStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.DeleteConfig("key_sentinel")
+	if stdout, _, exitCode := runLockbox("get", "API_KEY"); exitCode != 0 || stdout != "secret123" {
+		t.Errorf("Expected get to work on a store without a sentinel, got %q, exit code %d", stdout, exitCode)
+	}
+	if _, err := store.GetConfig("key_sentinel"); err != nil {
+		t.Errorf("Expected the sentinel to be recreated: %v", err)
+	}
+
+	// A replaced key fails every command loudly
+	store.SetConfig("encryption_key", []byte(strings.Repeat("ab", 32)))
+	store.Close()
+	_, stderr, exitCode = runLockbox("get", "API_KEY")
+	if exitCode != 1 || !strings.Contains(stderr, "self-test failed") || !strings.Contains(stderr, "does not match") {
+		t.Errorf("Expected a self-test failure, got exit code %d. Stderr: %s", exitCode, stderr)
+	}
+}
+
+func TestBadValues(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "A_GOOD", "one")
+	runLockbox("set", "Z_GOOD", "two")
+	store, err := db.OpenStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.SetSecret("M_BAD", []byte("not a ciphertext"))
+	store.SetSecret("N_BAD", []byte("nor this"))
+	store.Close()
+
+	// By default the export stops at the first bad value
+	stdout, _, exitCode := runLockbox("env")
+	if exitCode == 0 || !strings.Contains(stdout, "A_GOOD") || strings.Contains(stdout, "Z_GOOD") {
+		t.Errorf("env: exit code %d, output %q", exitCode, stdout)
+	}
+
+	stdout, stderr, exitCode := runLockbox("env", "--strict")
+	if exitCode == 0 || stdout != "" {
+		t.Errorf("env --strict printed %q, exit code %d", stdout, exitCode)
+	}
+	if !strings.Contains(stderr, "M_BAD") || !strings.Contains(stderr, "N_BAD") || !strings.Contains(stderr, "2 of 4 secret(s) cannot be decrypted") {
+		t.Errorf("env --strict did not name every bad value: %s", stderr)
+	}
+
+	stdout, stderr, exitCode = runLockbox("env", "--skip-bad")
+	if exitCode != 0 || !strings.Contains(stdout, "A_GOOD") || !strings.Contains(stdout, "Z_GOOD") || strings.Contains(stdout, "_BAD") {
+		t.Errorf("env --skip-bad: exit code %d, output %q", exitCode, stdout)
+	}
+	if !strings.Contains(stderr, "2 secret(s) skipped: M_BAD, N_BAD") {
+		t.Errorf("env --skip-bad did not report the skipped values: %s", stderr)
+	}
+	if _, stderr, exitCode := runLockbox("env", "--strict", "--skip-bad"); exitCode == 0 || !strings.Contains(stderr, "mutually exclusive") {
+		t.Errorf("--strict with --skip-bad: exit code %d: %s", exitCode, stderr)
+	}
+
+	marker := filepath.Join(filepath.Dir(dbPath), "ran")
+	_, stderr, exitCode = runLockbox("run", "--strict", "--", "touch", marker)
+	if exitCode == 0 || !strings.Contains(stderr, "the command was not run") {
+		t.Errorf("run --strict: exit code %d: %s", exitCode, stderr)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("run --strict started the command")
+	}
+	stdout, _, exitCode = runLockbox("run", "--skip-bad", "--", "sh", "-c", "echo $A_GOOD $Z_GOOD ${M_BAD-unset}")
+	if exitCode != 0 || stdout != "one two unset\n" {
+		t.Errorf("run --skip-bad = %q, exit code %d", stdout, exitCode)
+	}
+}
+
+// TestFixtureStores tests that the binary reads stores recorded from every
+// schema version
+func TestFixtureStores(t *testing.T) {
+	dumps, _ := filepath.Glob("internal/fixtures/testdata/store-v*.sql")
+	if len(dumps) == 0 {
+		t.Fatalf("No store fixtures found")
+	}
+	for _, dump := range dumps {
+		t.Run(filepath.Base(dump), func(t *testing.T) {
+			dbPath, cleanup := setupTest(t)
+			defer cleanup()
+			if err := fixtures.Load(dump, dbPath); err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			if stdout, stderr, exitCode := runLockbox("verify"); exitCode != 0 {
+				t.Fatalf("verify failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+			}
+			for _, s := range fixtures.Secrets {
+				if s.Kind != "" {
+					continue
+				}
+				if stdout, _, exitCode := runLockbox("get", s.Key); exitCode != 0 || stdout != s.Value {
+					t.Errorf("get %s = %q, exit code %d; expected %q", s.Key, stdout, exitCode, s.Value)
+				}
+			}
+		})
+	}
+}
+
+// TestUpgradeStore tests upgrading a store written by the first release
+func TestUpgradeStore(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	if err := fixtures.Load("internal/fixtures/testdata/store-v0.sql", dbPath); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	stdout, _, exitCode := runLockbox("upgrade-store", "--check")
+	if exitCode != 1 || !strings.Contains(stdout, "Schema version 0 -> ") || !strings.Contains(stdout, "6 values stored inline") {
+		t.Errorf("Unexpected check output %q, exit code %d", stdout, exitCode)
+	}
+
+	backup := dbPath + ".bak"
+	stdout, stderr, exitCode := runLockbox("upgrade-store", "--backup", backup)
+	if exitCode != 0 {
+		t.Fatalf("upgrade-store failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Backed up the store to "+backup) {
+		t.Errorf("Unexpected upgrade output %q", stdout)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("Backup not written: %v", err)
+	}
+
+	if stdout, _, exitCode := runLockbox("upgrade-store", "--check"); exitCode != 0 || !strings.Contains(stdout, "up to date") {
+		t.Errorf("Expected an up to date store, got %q, exit code %d", stdout, exitCode)
+	}
+	if stdout, _, _ := runLockbox("get", "UNICODE"); stdout != "pässwörd ✓ 🔑 \"quoted\" $HOME `cmd`" {
+		t.Errorf("Unexpected value after upgrade %q", stdout)
+	}
+	// Values moved to blobs share storage again
+	if stdout, _, _ := runLockbox("report", "--format", "csv", "API_KEY"); !strings.Contains(stdout, ",1,") {
+		t.Errorf("Expected API_KEY to share its value after upgrade:\n%s", stdout)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Join(filepath.Dir(dbPath), "backups")
+
+	runLockbox("init")
+	runLockbox("set", "A", "one")
+	runLockbox("set", "B", "two")
+
+	if _, stderr, exitCode := runLockbox("backup", dir, "--incremental"); exitCode == 0 || !strings.Contains(stderr, "full backup first") {
+		t.Errorf("Expected an incremental backup without a base to fail, got exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("backup", dir)
+	if exitCode != 0 || !strings.Contains(stdout, "Full backup") {
+		t.Fatalf("backup failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+
+	runLockbox("set", "A", "changed")
+	runLockbox("delete", "B")
+	stdout, stderr, exitCode = runLockbox("backup", dir, "--incremental", "--since", "last")
+	if exitCode != 0 || !strings.Contains(stdout, "(2 changes") {
+		t.Fatalf("incremental backup failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+
+	if stdout, _, exitCode := runLockbox("backup", "verify", dir); exitCode != 0 || !strings.Contains(stdout, "0002-incremental.jsonl") {
+		t.Errorf("verify failed with exit code %d: %s", exitCode, stdout)
+	}
+
+	restored := filepath.Join(filepath.Dir(dbPath), "restored.db")
+	if _, stderr, exitCode := runLockbox("backup", "restore", dir, "--to", restored); exitCode != 0 {
+		t.Fatalf("restore failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	os.Setenv("LOCKBOX_DB_PATH", restored)
+	defer os.Setenv("LOCKBOX_DB_PATH", dbPath)
+	if stdout, _, _ := runLockbox("get", "A"); stdout != "changed" {
+		t.Errorf("Restored A = %q, want changed", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "B"); exitCode == 0 {
+		t.Error("Deleted secret B was restored")
+	}
+}
+
+func TestBackupSealed(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	base := filepath.Dir(dbPath)
+	dir := filepath.Join(base, "backups")
+
+	runLockbox("init")
+	runLockbox("set", "A", "one")
+	runLockbox("bundle", "keygen", filepath.Join(base, "admin"))
+
+	stdout, stderr, exitCode := runLockbox("backup", dir, "--compress", "gzip", "--recipient", filepath.Join(base, "admin.pub"))
+	if exitCode != 0 || !strings.Contains(stdout, "encrypted to x25519 SHA256:") {
+		t.Fatalf("sealed backup failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	runLockbox("set", "A", "two")
+	if _, stderr, exitCode := runLockbox("backup", dir, "--incremental"); exitCode != 0 {
+		t.Fatalf("incremental backup failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+
+	if stdout, _, exitCode := runLockbox("backup", "verify", dir); exitCode != 0 || !strings.Contains(stdout, "Checksums only") {
+		t.Errorf("verify without an identity failed with exit code %d: %s", exitCode, stdout)
+	}
+	restored := filepath.Join(base, "restored.db")
+	if _, _, exitCode := runLockbox("backup", "restore", dir, "--to", restored); exitCode == 0 {
+		t.Error("Expected restore without an identity to fail")
+	}
+	if _, stderr, exitCode := runLockbox("backup", "restore", dir, "--to", restored, "--identity", filepath.Join(base, "admin.key")); exitCode != 0 {
+		t.Fatalf("restore failed with exit code %d. Stderr: %s", exitCode, stderr)
+	}
+	os.Setenv("LOCKBOX_DB_PATH", restored)
+	defer os.Setenv("LOCKBOX_DB_PATH", dbPath)
+	if stdout, _, _ := runLockbox("get", "A"); stdout != "two" {
+		t.Errorf("Restored A = %q, want two", stdout)
+	}
+}
+
+func TestImportK8s(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "DB_USER", "local")
+
+	kubectl := filepath.Join(filepath.Dir(dbPath), "kubectl")
+	script := `#!/bin/sh
+cat <<'JSON'
+{"items": [{"metadata": {"name": "web-db", "namespace": "prod"}, "type": "Opaque",
+  "data": {"DB_USER": "YXBw", "DB_PASSWORD": "aHVudGVyMg=="}}]}
+JSON
+`
+	if err := os.WriteFile(kubectl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LOCKBOX_KUBECTL", kubectl)
+	defer os.Unsetenv("LOCKBOX_KUBECTL")
+
+	stdout, stderr, exitCode := runLockbox("import", "k8s", "--namespace", "prod", "--dry-run")
+	if exitCode != 0 || !strings.Contains(stdout, "DB_PASSWORD <- prod/web-db.DB_PASSWORD") {
+		t.Fatalf("dry run failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "DB_PASSWORD"); exitCode == 0 {
+		t.Error("dry run stored a secret")
+	}
+
+	stdout, _, exitCode = runLockbox("import", "k8s", "--namespace", "prod")
+	if exitCode != 0 || !strings.Contains(stdout, "Imported 1 secrets from 1 Kubernetes Secrets (1 skipped)") {
+		t.Errorf("import failed with exit code %d: %s", exitCode, stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != "hunter2" {
+		t.Errorf("DB_PASSWORD = %q, want hunter2", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_USER"); stdout != "local" {
+		t.Errorf("existing DB_USER was overwritten with %q", stdout)
+	}
+
+	runLockbox("import", "k8s", "--overwrite")
+	if stdout, _, _ := runLockbox("get", "DB_USER"); stdout != "app" {
+		t.Errorf("DB_USER = %q after --overwrite, want app", stdout)
+	}
+}
+
+func TestExportImportGCP(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "DB_URL", "postgres://db")
+	runLockbox("set", "API_KEY", "k3y")
+
+	// A stand-in gcloud keeping one file per secret
+	dir := filepath.Dir(dbPath)
+	secrets := filepath.Join(dir, "sm")
+	os.Mkdir(secrets, 0700)
+	gcloud := filepath.Join(dir, "gcloud")
+	script := `#!/bin/sh
+cd ` + secrets + `
+case "$2" in
+list) printf '['; sep=; for f in *; do [ -e "$f" ] && printf '%s{"name": "projects/p/secrets/%s"}' "$sep" "$f" && sep=,; done; echo ']' ;;
+create) cat > "$3" ;;
+versions) [ "$3" = access ] && cat "$6" || cat > "$4" ;;
+esac
+`
+	if err := os.WriteFile(gcloud, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LOCKBOX_GCLOUD", gcloud)
+	defer os.Unsetenv("LOCKBOX_GCLOUD")
+
+	stdout, stderr, exitCode := runLockbox("export", "gcp-sm", "--project", "p", "DB_*")
+	if exitCode != 0 || !strings.Contains(stdout, "Exported 1 secrets to p (0 skipped)") {
+		t.Fatalf("export failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(secrets, "DB_URL")); string(data) != "postgres://db" {
+		t.Errorf("exported DB_URL = %q", data)
+	}
+
+	runLockbox("set", "DB_URL", "postgres://new")
+	stdout, _, _ = runLockbox("export", "gcp-sm", "--project", "p")
+	if !strings.Contains(stdout, "Exported 1 secrets to p (1 skipped)") {
+		t.Errorf("export without --overwrite: %s", stdout)
+	}
+	runLockbox("export", "gcp-sm", "--project", "p", "--overwrite")
+	if data, _ := os.ReadFile(filepath.Join(secrets, "DB_URL")); string(data) != "postgres://new" {
+		t.Errorf("DB_URL = %q after --overwrite", data)
+	}
+
+	runLockbox("delete", "API_KEY")
+	stdout, _, exitCode = runLockbox("import", "gcp-sm", "--project", "p")
+	if exitCode != 0 || !strings.Contains(stdout, "Imported 1 secrets from project p (1 skipped)") {
+		t.Errorf("import failed with exit code %d: %s", exitCode, stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "k3y" {
+		t.Errorf("API_KEY = %q, want k3y", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("import", "gcp-sm"); exitCode == 0 || !strings.Contains(stderr, "--project is required") {
+		t.Errorf("import without --project: exit %d, %s", exitCode, stderr)
+	}
+}
+
+func TestExportImportVault(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "DB_URL", "postgres://db")
+	runLockbox("set", "API_KEY", "k3y")
+
+	// A stand-in Vault with one KV v2 mount
+	var mu sync.Mutex
+	data := map[string]any{"REGION": "eu"}
+	version := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Header.Get("X-Vault-Token") != "s.test":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/"):
+			w.Write([]byte(`{"data":{"path":"secret/","options":{"version":"2"}}}`))
+		case r.URL.Path != "/v1/secret/data/myapp":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data, "metadata": map[string]int{"version": version}}})
+		default:
+			var body struct {
+				Data map[string]any `json:"data"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			data = body.Data
+			version++
+			w.Write([]byte(`{"data":{}}`))
+		}
+	}))
+	defer ts.Close()
+	os.Setenv("VAULT_ADDR", ts.URL)
+	os.Setenv("VAULT_TOKEN", "s.test")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	stdout, stderr, exitCode := runLockbox("export", "vault", "--path", "secret/myapp", "DB_*")
+	if exitCode != 0 || !strings.Contains(stdout, "Exported 1 secrets to secret/myapp (0 skipped)") {
+		t.Fatalf("export failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if data["DB_URL"] != "postgres://db" || data["REGION"] != "eu" {
+		t.Errorf("secret after export = %v, want DB_URL added and REGION kept", data)
+	}
+
+	runLockbox("delete", "API_KEY")
+	stdout, _, exitCode = runLockbox("import", "vault", "--path", "secret/myapp")
+	if exitCode != 0 || !strings.Contains(stdout, "✓ REGION <- secret/myapp/REGION") || !strings.Contains(stdout, "Imported 1 secrets from Vault secret/myapp (1 skipped)") {
+		t.Errorf("import failed with exit code %d: %s", exitCode, stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "REGION"); stdout != "eu" {
+		t.Errorf("REGION = %q, want eu", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("import", "vault", "--path", "secret/other"); exitCode == 0 || !strings.Contains(stderr, "no secret at secret/other") {
+		t.Errorf("import of a missing secret: exit %d, %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("import", "vault"); exitCode == 0 || !strings.Contains(stderr, "--path is required") {
+		t.Errorf("import without --path: exit %d, %s", exitCode, stderr)
+	}
+	os.Setenv("VAULT_TOKEN", "wrong")
+	if _, stderr, exitCode := runLockbox("export", "vault", "--path", "secret/myapp"); exitCode == 0 || !strings.Contains(stderr, "permission denied") {
+		t.Errorf("export with a bad token: exit %d, %s", exitCode, stderr)
+	}
+}
+
+func TestImportDoppler(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+
+	doppler := filepath.Join(filepath.Dir(dbPath), "doppler")
+	script := `#!/bin/sh
+echo '{"DOPPLER_PROJECT": "x", "DOPPLER_CONFIG": "dev", "STRIPE_KEY": "sk_test"}'
+`
+	if err := os.WriteFile(doppler, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LOCKBOX_DOPPLER", doppler)
+	defer os.Unsetenv("LOCKBOX_DOPPLER")
+
+	stdout, stderr, exitCode := runLockbox("import", "doppler", "--project", "x", "--config", "dev")
+	if exitCode != 0 || !strings.Contains(stdout, "✓ STRIPE_KEY <- x/dev/STRIPE_KEY") || !strings.Contains(stdout, "Imported 1 secrets from Doppler") {
+		t.Fatalf("import failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "STRIPE_KEY"); stdout != "sk_test" {
+		t.Errorf("STRIPE_KEY = %q, want sk_test", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "DOPPLER_PROJECT"); exitCode == 0 {
+		t.Error("imported Doppler's own DOPPLER_PROJECT")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	for _, profile := range []string{"staging", "prod"} {
+		if _, stderr, exitCode := runLockbox("--profile", profile, "init"); exitCode != 0 {
+			t.Fatalf("init %s failed: %s", profile, stderr)
+		}
+	}
+	runLockbox("--profile", "staging", "set", "APP_URL", "https://staging")
+	runLockbox("--profile", "staging", "set", "APP_MODE", "fast")
+	runLockbox("--profile", "staging", "set", "DB_URL", "staging-db")
+	runLockbox("--profile", "prod", "set", "APP_MODE", "fast")
+
+	stdout, stderr, exitCode := runLockbox("promote", "--from", "staging", "--to", "prod", "--only", "APP_*", "--dry-run")
+	if exitCode != 0 || !strings.Contains(stdout, "+ APP_URL") || !strings.Contains(stdout, "= APP_MODE") || !strings.Contains(stdout, "Would promote 1 secrets") {
+		t.Fatalf("dry run failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+
+	stdout, stderr, exitCode = runLockbox("promote", "--from", "staging", "--to", "prod", "--only", "APP_*", "--require-approval")
+	if exitCode != 0 || !strings.Contains(stdout, "awaits approval") {
+		t.Fatalf("request failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	code := strings.TrimSpace(stdout[strings.LastIndex(stdout, " ")+1:])
+	if _, _, exitCode := runLockbox("--profile", "prod", "get", "APP_URL"); exitCode == 0 {
+		t.Error("promotion applied before approval")
+	}
+	if stdout, _, _ := runLockbox("promote", "list", "--to", "prod"); !strings.Contains(stdout, "APP_URL (add)") {
+		t.Errorf("promote list: %s", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("promote", "approve", "--to", "prod", code); exitCode == 0 || !strings.Contains(stderr, "different admin") {
+		t.Errorf("self-approval: exit %d, %s", exitCode, stderr)
+	}
+
+	stdout, _, exitCode = runLockbox("promote", "--from", "staging", "--to", "prod", "--only", "APP_*")
+	if exitCode != 0 || !strings.Contains(stdout, "Promoted 1 secrets from staging to prod") {
+		t.Errorf("promote failed with exit code %d: %s", exitCode, stdout)
+	}
+	if stdout, _, _ := runLockbox("--profile", "prod", "get", "APP_URL"); stdout != "https://staging" {
+		t.Errorf("APP_URL = %q in prod", stdout)
+	}
+	if _, _, exitCode := runLockbox("--profile", "prod", "get", "DB_URL"); exitCode == 0 {
+		t.Error("promoted a key not selected by --only")
+	}
+
+	stdout, _, _ = runLockbox("--profile", "prod", "audit", "--porcelain")
+	if !strings.Contains(stdout, "\tpromote-requested\tfrom staging: APP_URL (add)") || !strings.Contains(stdout, "\tpromote\tfrom staging: APP_URL (add)") {
+		t.Errorf("audit log: %s", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("promote", "--from", "staging", "--to", "qa"); exitCode == 0 || !strings.Contains(stderr, "has no store") {
+		t.Errorf("missing profile: exit %d, %s", exitCode, stderr)
+	}
+}
+
+// TestCopyToProfile tests copying secrets between profiles and forbidding
+// copies out of a store
+func TestCopyToProfile(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+	runLockbox("init")
+	for _, profile := range []string{"dev", "prod"} {
+		if _, stderr, exitCode := runLockbox("--profile", profile, "init"); exitCode != 0 {
+			t.Fatalf("init %s failed: %s", profile, stderr)
+		}
+	}
+	runLockbox("--profile", "prod", "set", "APP_URL", "https://prod")
+	runLockbox("--profile", "prod", "set", "APP_MODE", "fast")
+	runLockbox("--profile", "dev", "set", "APP_MODE", "debug")
+
+	stdout, stderr, exitCode := runLockbox("--profile", "prod", "copy", "APP_*", "--to-profile", "dev")
+	if exitCode == 0 || !strings.Contains(stderr, "APP_MODE already in dev") {
+		t.Errorf("copy over a different value: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	stdout, stderr, exitCode = runLockbox("--profile", "prod", "copy", "APP_*", "--to-profile", "dev", "--overwrite")
+	if exitCode != 0 || !strings.Contains(stdout, "Copied 2 secrets to dev") {
+		t.Fatalf("copy failed with exit code %d: %s%s", exitCode, stdout, stderr)
+	}
+	// Re-encrypted under dev's own key
+	if stdout, _, _ := runLockbox("--profile", "dev", "get", "APP_MODE"); stdout != "fast" {
+		t.Errorf("APP_MODE = %q in dev", stdout)
+	}
+	devFP, _, _ := runLockbox("--profile", "dev", "fingerprint")
+	prodFP, _, _ := runLockbox("--profile", "prod", "fingerprint")
+	if devFP == "" || devFP == prodFP {
+		t.Errorf("dev and prod share a key: %s", devFP)
+	}
+	if _, stderr, exitCode := runLockbox("--profile", "dev", "copy", "APP_URL", "--to-profile", "dev"); exitCode == 0 || !strings.Contains(stderr, "current store is the store of profile dev") {
+		t.Errorf("copy into itself: exit %d, %s", exitCode, stderr)
+	}
+
+	archive := filepath.Join(filepath.Dir(dbPath), "prod.lbx")
+	runLockbox("--profile", "prod", "export", archive, "--include-key")
+	if stdout, stderr, exitCode := runLockbox("--profile", "prod", "policy", "copy-out", "deny"); exitCode != 0 {
+		t.Fatalf("copy-out deny failed: %s%s", stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("--profile", "prod", "policy", "copy-out"); stdout != "copy-out: deny\n" {
+		t.Errorf("copy-out = %q", stdout)
+	}
+	locked := filepath.Join(filepath.Dir(dbPath), "prod-locked.lbx")
+	runLockbox("--profile", "prod", "export", locked, "--include-key")
+
+	for name, args := range map[string][]string{
+		"copy":            {"--profile", "prod", "copy", "APP_URL", "--to-profile", "dev", "--overwrite"},
+		"promote":         {"promote", "--from", "prod", "--to", "dev"},
+		"restore":         {"backup", "restore", locked, "--to-profile", "dev"},
+		"restore default": {"backup", "restore", locked},
+	} {
+		if _, stderr, exitCode := runLockbox(args...); exitCode == 0 || !strings.Contains(stderr, "forbids copying") {
+			t.Errorf("%s out of prod: exit %d, %s", name, exitCode, stderr)
+		}
+	}
+	// Restoring into prod itself is still a restore
+	if stdout, stderr, exitCode := runLockbox("backup", "restore", locked, "--to-profile", "prod"); exitCode != 0 {
+		t.Errorf("restore into prod: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	// Archives taken before are not covered
+	if _, stderr, exitCode := runLockbox("backup", "restore", archive, "--only", "APP_URL", "--to-profile", "dev"); exitCode != 0 {
+		t.Errorf("restore of an earlier archive: exit %d, %s", exitCode, stderr)
+	}
+
+	runLockbox("--profile", "prod", "policy", "copy-out", "allow")
+	if stdout, stderr, exitCode := runLockbox("promote", "--from", "prod", "--to", "dev"); exitCode != 0 {
+		t.Errorf("promote after copy-out allow: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+}
+
+// TestSync tests syncing two copies of a store through a git repository
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	repo := filepath.Join(filepath.Dir(dbPath), "secrets.git")
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v %s", err, out)
+	}
+	runLockbox("init")
+	// A second machine with the same key
+	otherPath := filepath.Join(filepath.Dir(dbPath), "other.db")
+	data, _ := os.ReadFile(dbPath)
+	os.WriteFile(otherPath, data, 0600)
+	other := func(args ...string) (string, string, int) {
+		os.Setenv("LOCKBOX_DB_PATH", otherPath)
+		defer os.Setenv("LOCKBOX_DB_PATH", dbPath)
+		return runLockbox(args...)
+	}
+
+	fingerprint, _, _ := runLockbox("fingerprint")
+	fingerprint = strings.TrimSpace(fingerprint)
+	if other, _, _ := other("fingerprint"); strings.TrimSpace(other) != fingerprint {
+		t.Errorf("machines sharing a key show fingerprints %s and %s", fingerprint, other)
+	}
+
+	runLockbox("set", "API_KEY", "sk-live-123")
+	runLockbox("set", "DB_URL", "postgres://db")
+	stdout, stderr, exitCode := runLockbox("sync", repo)
+	if exitCode != 0 || !strings.Contains(stdout, "2 pushed") {
+		t.Fatalf("sync failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if !strings.Contains(stdout, "First sync with "+repo+"; store fingerprint "+fingerprint) {
+		t.Errorf("first sync did not show the fingerprint: %s", stdout)
+	}
+	log, _ := exec.Command("git", "-C", repo, "log", "-p", "--all").CombinedOutput()
+	if strings.Contains(string(log), "sk-live-123") || strings.Contains(string(log), "API_KEY") {
+		t.Errorf("repository holds plaintext:\n%s", log)
+	}
+
+	stdout, _, _ = other("sync", repo, "--dry-run")
+	if !strings.Contains(stdout, "pull          API_KEY") || !strings.Contains(stdout, "Would sync") {
+		t.Errorf("sync --dry-run: %s", stdout)
+	}
+	if stdout, _, _ := other("get", "API_KEY"); stdout != "" {
+		t.Fatal("sync --dry-run wrote to the store")
+	}
+	if stdout, stderr, exitCode := other("sync", repo); exitCode != 0 || !strings.Contains(stdout, "2 pulled") {
+		t.Fatalf("second machine sync failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := other("get", "API_KEY"); strings.TrimSpace(stdout) != "sk-live-123" {
+		t.Errorf("API_KEY after sync = %q", stdout)
+	}
+
+	// The repository is remembered and deletions travel
+	other("delete", "DB_URL")
+	if stdout, stderr, exitCode := other("sync"); exitCode != 0 || !strings.Contains(stdout, "1 deleted there") {
+		t.Fatalf("sync after delete failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("sync"); !strings.Contains(stdout, "delete-local  DB_URL") {
+		t.Errorf("sync of the deletion: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "DB_URL"); exitCode == 0 {
+		t.Error("DB_URL survived a deletion on the other machine")
+	}
+	if stdout, _, _ := runLockbox("sync"); !strings.Contains(stdout, "Already in sync") || strings.Contains(stdout, "First sync") {
+		t.Errorf("repeated sync: %s", stdout)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+
+	stdout, stderr, exitCode := runLockbox("fingerprint")
+	fingerprint := strings.TrimSpace(stdout)
+	if exitCode != 0 || len(fingerprint) != 24 || strings.Count(fingerprint, "-") != 4 {
+		t.Fatalf("fingerprint failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("fingerprint", "--porcelain"); stdout != "fingerprint\t"+fingerprint+"\n" {
+		t.Errorf("fingerprint --porcelain printed %q", stdout)
+	}
+
+	// Another store has another key
+	runLockbox("--profile", "other", "init")
+	if stdout, _, _ := runLockbox("--profile", "other", "fingerprint"); strings.TrimSpace(stdout) == fingerprint {
+		t.Error("two stores with different keys show the same fingerprint")
+	}
+}
+
+// TestMerge tests merging another store file with its own key
+func TestMerge(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("--profile", "api", "init")
+	t.Setenv("LOCKBOX_PASSPHRASE", "api pass")
+	runLockbox("--profile", "api", "passphrase", "set")
+	other := filepath.Join(filepath.Dir(dbPath), "profiles", "api.db")
+
+	// Timestamps have a resolution of a second
+	runLockbox("set", "OLD", "ours")
+	runLockbox("--profile", "api", "set", "MINE", "theirs")
+	time.Sleep(1100 * time.Millisecond)
+	runLockbox("set", "MINE", "ours")
+	runLockbox("--profile", "api", "set", "OLD", "theirs")
+	runLockbox("--profile", "api", "set", "NEW", "n")
+	runLockbox("--profile", "api", "set", "SAME", "s")
+	runLockbox("set", "SAME", "s")
+	os.Unsetenv("LOCKBOX_PASSPHRASE")
+
+	t.Setenv("LOCKBOX_MERGE_PASSPHRASE", "wrong")
+	if _, stderr, exitCode := runLockbox("merge", other); exitCode == 0 || !strings.Contains(stderr, "api.db") {
+		t.Errorf("merge with a wrong passphrase: exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_MERGE_PASSPHRASE", "api pass")
+
+	stdout, stderr, exitCode := runLockbox("merge", other, "--strategy", "prefer-local", "--dry-run")
+	if exitCode != 0 || !strings.Contains(stdout, "+ NEW") || !strings.Contains(stdout, "= OLD") || !strings.Contains(stdout, "Would merge 1 secrets") {
+		t.Fatalf("merge --dry-run failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "NEW"); exitCode == 0 {
+		t.Fatal("merge --dry-run wrote to the store")
+	}
+
+	stdout, stderr, exitCode = runLockbox("merge", other)
+	if exitCode != 0 || !strings.Contains(stdout, "~ OLD") || !strings.Contains(stdout, "= MINE") || !strings.Contains(stdout, "Merged 2 secrets") || !strings.Contains(stdout, "1 kept, 1 unchanged") {
+		t.Fatalf("merge failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	for key, want := range map[string]string{"NEW": "n", "OLD": "theirs", "MINE": "ours"} {
+		if stdout, _, _ := runLockbox("get", key); stdout != want {
+			t.Errorf("%s after merge = %q, want %q", key, stdout, want)
+		}
+	}
+	if _, stderr, exitCode := runLockbox("merge", dbPath); exitCode == 0 || !strings.Contains(stderr, "itself") {
+		t.Errorf("merge into itself: exit code %d: %s", exitCode, stderr)
+	}
+}
+
+// TestWorkspace tests project-local stores found up the directory tree
+func TestWorkspace(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "WHERE", "global")
+
+	bin, _ := filepath.Abs("lockbox")
+	project := filepath.Join(filepath.Dir(dbPath), "project")
+	nested := filepath.Join(project, "cmd", "server")
+	os.MkdirAll(nested, 0700)
+	// in runs lockbox in dir
+	in := func(dir string, args ...string) (string, string, int) {
+		cmd := exec.Command(bin, args...)
+		cmd.Dir = dir
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		cmd.Run()
+		return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+	}
+
+	if _, stderr, exitCode := in(nested, "--workspace", "list"); exitCode == 0 || !strings.Contains(stderr, "workspace init") {
+		t.Errorf("--workspace without a workspace: exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := in(project, "workspace", "init", "--commit", "--key-backend", "store"); exitCode == 0 || !strings.Contains(stderr, "must not hold its own key") {
+		t.Errorf("committed workspace with the store backend: exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, stderr, exitCode := in(project, "workspace", "init"); exitCode != 0 || !strings.Contains(stdout, "Created a workspace") {
+		t.Fatalf("workspace init failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(project, ".lockbox", ".gitignore")); !strings.Contains(string(data), "*") {
+		t.Errorf(".gitignore = %q", data)
+	}
+
+	in(nested, "--workspace", "set", "WHERE", "project")
+	if stdout, _, _ := in(nested, "--workspace", "get", "WHERE"); stdout != "project" {
+		t.Errorf("get in the workspace = %q", stdout)
+	}
+	if stdout, _, _ := in(nested, "get", "WHERE"); stdout != "global" {
+		t.Errorf("get without --workspace = %q", stdout)
+	}
+
+	stdout, _, _ := in(nested, "workspace", "status")
+	if !strings.Contains(stdout, "Workspace: "+project) || !strings.Contains(stdout, "(LOCKBOX_DB_PATH)") || !strings.Contains(stdout, "not in use") {
+		t.Errorf("workspace status: %s", stdout)
+	}
+	if stdout, _, _ := in(nested, "--workspace", "workspace", "status", "--porcelain"); stdout != "workspace\t"+project+"\tfalse\t"+filepath.Join(project, ".lockbox", "lockbox.db")+"\tworkspace\n" {
+		t.Errorf("workspace status --porcelain = %q", stdout)
+	}
+	if _, stderr, exitCode := in(nested, "--workspace", "--profile", "prod", "list"); exitCode == 0 || !strings.Contains(stderr, "cannot be used together") {
+		t.Errorf("--workspace with --profile: exit code %d: %s", exitCode, stderr)
+	}
+}
+
+// TestPushPull tests replicating secrets with a server, detecting
+// conflicts by when each copy was updated
+func TestPushPull(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	for _, args := range [][]string{{"init"}, {"--profile", "server", "init"}} {
+		if _, stderr, exitCode := runLockbox(args...); exitCode != 0 {
+			t.Fatalf("init failed: %s", stderr)
+		}
+	}
+	server := exec.Command("./lockbox", "--profile", "server", "serve", "-p", "9886")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Process.Kill()
+	token, _, _ := runLockbox("--profile", "server", "token", "create", "laptop")
+	runLockbox("--profile", "server", "role", "assign", "admin", "--token", "laptop")
+	t.Setenv("LOCKBOX_TOKEN", strings.TrimSpace(token))
+	serverGet := func(key string) string {
+		stdout, _, _ := runLockbox("--profile", "server", "get", key)
+		return strings.TrimSpace(stdout)
+	}
+
+	// Timestamps have a resolution of a second
+	runLockbox("--profile", "server", "set", "SHARED", "server")
+	time.Sleep(1100 * time.Millisecond)
+	runLockbox("set", "SHARED", "laptop")
+	runLockbox("set", "NEW", "n")
+
+	stdout, stderr, exitCode := runLockbox("push", "--remote", "127.0.0.1:9886", "--dry-run")
+	if exitCode != 0 || !strings.Contains(stdout, "+ NEW") || !strings.Contains(stdout, "~ SHARED") || !strings.Contains(stdout, "Would push 2 secrets") {
+		t.Fatalf("push --dry-run failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if serverGet("SHARED") != "server" {
+		t.Fatal("push --dry-run wrote to the server")
+	}
+	stdout, stderr, exitCode = runLockbox("push", "--remote", "127.0.0.1:9886")
+	if exitCode != 0 || !strings.Contains(stdout, "Pushed 2 secrets") || serverGet("SHARED") != "laptop" || serverGet("NEW") != "n" {
+		t.Fatalf("push failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("push", "--remote", "127.0.0.1:9886"); !strings.Contains(stdout, "Nothing to push") {
+		t.Errorf("repeated push: %s", stdout)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	runLockbox("--profile", "server", "set", "SHARED", "edited")
+	stdout, stderr, exitCode = runLockbox("pull", "--remote", "127.0.0.1:9886", "--porcelain")
+	if exitCode != 0 || !strings.Contains(stdout, "pull\tupdate\tSHARED\t") {
+		t.Fatalf("pull failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "SHARED"); strings.TrimSpace(stdout) != "edited" {
+		t.Errorf("SHARED after pull = %q", stdout)
+	}
+
+	// The server's copy is newer, so pushing the local one conflicts
+	runLockbox("set", "SHARED", "mine")
+	time.Sleep(1100 * time.Millisecond)
+	runLockbox("--profile", "server", "set", "SHARED", "theirs")
+	stdout, stderr, exitCode = runLockbox("push", "--remote", "127.0.0.1:9886")
+	if exitCode == 0 || !strings.Contains(stdout, "! SHARED") || !strings.Contains(stderr, "--force") || serverGet("SHARED") != "theirs" {
+		t.Fatalf("conflicting push: exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("push", "--remote", "127.0.0.1:9886", "--force"); exitCode != 0 || serverGet("SHARED") != "mine" {
+		t.Errorf("push --force: exit code %d: %s", exitCode, stderr)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "DB_PASSWORD", "old")
+
+	dir := filepath.Dir(dbPath)
+	hook := filepath.Join(dir, "update-db.sh")
+	os.WriteFile(hook, []byte("#!/bin/sh\necho \"$LOCKBOX_NEW_VALUE\" > "+filepath.Join(dir, "applied")+"\n"), 0755)
+
+	if _, stderr, exitCode := runLockbox("rotation", "add", "MISSING", "--every", "30d"); exitCode == 0 || !strings.Contains(stderr, "not found") {
+		t.Errorf("rule for a missing secret: exit %d, %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("rotation", "add", "DB_PASSWORD", "--every", "30d", "--generator", "random:24", "--hook", hook)
+	if exitCode != 0 || !strings.Contains(stdout, "DB_PASSWORD rotates every 30d") {
+		t.Fatalf("rotation add failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("rotation", "run"); !strings.Contains(stdout, "No rotations due") {
+		t.Errorf("rotation run before due: %s", stdout)
+	}
+
+	stdout, stderr, exitCode = runLockbox("rotation", "run", "DB_PASSWORD")
+	if exitCode != 0 || !strings.Contains(stdout, "✓ Rotated DB_PASSWORD") {
+		t.Fatalf("rotation run failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	value, _, _ := runLockbox("get", "DB_PASSWORD")
+	applied, _ := os.ReadFile(filepath.Join(dir, "applied"))
+	if len(value) != 24 || strings.TrimSpace(string(applied)) != value {
+		t.Errorf("stored %q, hook applied %q", value, applied)
+	}
+
+	os.WriteFile(hook, []byte("#!/bin/sh\nexit 3\n"), 0755)
+	if _, stderr, exitCode := runLockbox("rotation", "run", "DB_PASSWORD"); exitCode == 0 || !strings.Contains(stderr, "hook failed") {
+		t.Errorf("failing hook: exit %d, %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != value {
+		t.Error("value changed although the hook failed")
+	}
+
+	if stdout, _, _ := runLockbox("rotation", "list", "--porcelain"); !strings.HasPrefix(stdout, "rotation\tDB_PASSWORD\t2592000\trandom:24\t"+hook) {
+		t.Errorf("rotation list: %q", stdout)
+	}
+	runLockbox("rotation", "remove", "DB_PASSWORD")
+	if stdout, _, _ := runLockbox("rotation", "list"); !strings.Contains(stdout, "No rotation rules") {
+		t.Errorf("rule not removed: %s", stdout)
+	}
+
+	runLockbox("set", "AWS_ACCESS_KEY_ID", "AKIAOLD")
+	if _, stderr, exitCode := runLockbox("rotation", "add", "AWS_ACCESS_KEY_ID", "--every", "90d", "--aws-iam"); exitCode == 0 || !strings.Contains(stderr, "'AWS_SECRET_ACCESS_KEY' not found") {
+		t.Errorf("aws-iam rule without its secret key: exit %d, %s", exitCode, stderr)
+	}
+	runLockbox("set", "AWS_SECRET_ACCESS_KEY", "old-secret")
+	if stdout, stderr, exitCode := runLockbox("rotation", "add", "AWS_ACCESS_KEY_ID", "--every", "90d", "--aws-iam"); exitCode != 0 || !strings.Contains(stdout, "with aws-iam") {
+		t.Errorf("aws-iam rule: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "SMTP_USER", "lockbox")
+
+	if _, stderr, exitCode := runLockbox("digest", "send"); exitCode == 0 || !strings.Contains(stderr, "not configured") {
+		t.Errorf("send without config: exit %d, %s", exitCode, stderr)
+	}
+	args := []string{"digest", "config", "--smtp", "smtp.example.com:587", "--from", "lockbox@example.com", "--to", "ops@example.com,sec@example.com", "--username-key", "SMTP_USER", "--password-key", "SMTP_PASSWORD"}
+	if _, stderr, exitCode := runLockbox(args...); exitCode == 0 || !strings.Contains(stderr, "'SMTP_PASSWORD' not found") {
+		t.Errorf("config with a missing credential: exit %d, %s", exitCode, stderr)
+	}
+	runLockbox("set", "SMTP_PASSWORD", "s3cret")
+	stdout, stderr, exitCode := runLockbox(args...)
+	if exitCode != 0 || !strings.Contains(stdout, "Digests go to ops@example.com, sec@example.com every 7d") {
+		t.Fatalf("digest config failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+
+	stdout, _, exitCode = runLockbox("digest", "show")
+	if exitCode != 0 || !strings.Contains(stdout, "Lockbox digest for") || strings.Contains(stdout, "s3cret") {
+		t.Errorf("digest show: exit %d, %s", exitCode, stdout)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+
+	t.Setenv("LOCKBOX_PASSPHRASE", "correct horse")
+	if stdout, stderr, exitCode := runLockbox("passphrase", "set"); exitCode != 0 || !strings.Contains(stdout, "protected by the passphrase") {
+		t.Fatalf("passphrase set failed with exit code %d: %s%s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get with the passphrase = %q", stdout)
+	}
+
+	t.Setenv("LOCKBOX_PASSPHRASE", "battery staple")
+	if _, stderr, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 || !strings.Contains(stderr, "wrong passphrase") {
+		t.Errorf("get with the wrong passphrase: exit %d, %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("init"); !strings.Contains(stdout, "already initialized") {
+		t.Errorf("init of a protected store = %q", stdout)
+	}
+
+	// An unlocked store needs no passphrase until it is locked again
+	t.Setenv("LOCKBOX_PASSPHRASE", "correct horse")
+	if _, stderr, exitCode := runLockbox("unlock", "--for", "1m"); exitCode != 0 {
+		t.Logf("unlock unavailable: %s", stderr)
+	} else {
+		t.Setenv("LOCKBOX_PASSPHRASE", "battery staple")
+		if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+			t.Errorf("get while unlocked = %q, %s", stdout, stderr)
+		}
+		runLockbox("lock")
+		if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+			t.Error("get after lock used the cached key")
+		}
+	}
+
+	t.Setenv("LOCKBOX_PASSPHRASE", "correct horse")
+	if _, stderr, exitCode := runLockbox("passphrase", "remove"); exitCode != 0 {
+		t.Fatalf("passphrase remove failed with exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_PASSPHRASE", "battery staple")
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get after removing the passphrase = %q", stdout)
+	}
+}
+
+func TestKeyBackend(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// secret-tool keeping entries as files named after their account
+	dir := filepath.Dir(dbPath)
+	keyring := filepath.Join(dir, "keyring")
+	os.Mkdir(keyring, 0700)
+	tool := filepath.Join(dir, "secret-tool")
+	os.WriteFile(tool, []byte(`#!/bin/sh
+op=$1; shift
+while [ $# -gt 1 ]; do [ "$1" = account ] && account=$2; shift; done
+case $op in
+store) cat > `+keyring+`/$account ;;
+lookup) cat `+keyring+`/$account ;;
+clear) rm -f `+keyring+`/$account ;;
+esac
+`), 0755)
+	t.Setenv("LOCKBOX_SECRET_TOOL", tool)
+
+	if _, stderr, exitCode := runLockbox("init", "--key-backend", "vault"); exitCode == 0 {
+		t.Errorf("init with an unknown backend succeeded: %s", stderr)
+	}
+	if _, stderr, exitCode := runLockbox("init", "--key-backend", "keychain"); exitCode != 0 {
+		t.Fatalf("init failed with exit code %d: %s", exitCode, stderr)
+	}
+	runLockbox("set", "API_KEY", "secret123")
+	if stdout, _, _ := runLockbox("key-backend"); stdout != "keychain\n" {
+		t.Errorf("key-backend = %q, want keychain", stdout)
+	}
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get with the key in the keychain = %q, %s", stdout, stderr)
+	}
+
+	// Without the keychain entry the store cannot be decrypted
+	entries, _ := os.ReadDir(keyring)
+	if len(entries) != 1 {
+		t.Fatalf("keychain holds %d entries, want 1", len(entries))
+	}
+	entry := filepath.Join(keyring, entries[0].Name())
+	saved, _ := os.ReadFile(entry)
+	os.Remove(entry)
+	if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+		t.Error("get succeeded without the keychain entry")
+	}
+	os.WriteFile(entry, saved, 0600)
+
+	if stdout, stderr, exitCode := runLockbox("key-backend", "store"); exitCode != 0 || !strings.Contains(stdout, "from the keychain backend to the store backend") {
+		t.Fatalf("key-backend store: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	if entries, _ := os.ReadDir(keyring); len(entries) != 0 {
+		t.Errorf("moving the key left %d keychain entries", len(entries))
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get after moving the key back = %q", stdout)
+	}
+}
+
+// TestKeyBackendEnclave tests falling back to the keychain where there
+// is no Secure Enclave
+func TestKeyBackendEnclave(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("the Mac may have a Secure Enclave")
+	}
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	dir := filepath.Dir(dbPath)
+	keyring := filepath.Join(dir, "keyring")
+	os.Mkdir(keyring, 0700)
+	tool := filepath.Join(dir, "secret-tool")
+	os.WriteFile(tool, []byte(`#!/bin/sh
+op=$1; shift
+while [ $# -gt 1 ]; do [ "$1" = account ] && account=$2; shift; done
+case $op in
+store) cat > `+keyring+`/$account ;;
+lookup) cat `+keyring+`/$account ;;
+clear) rm -f `+keyring+`/$account ;;
+esac
+`), 0755)
+	t.Setenv("LOCKBOX_SECRET_TOOL", tool)
+
+	if _, stderr, exitCode := runLockbox("init", "--key-backend", "enclave", "--enclave-confirm", "10m"); exitCode == 0 || !strings.Contains(stderr, "invalid confirmation") {
+		t.Errorf("init with too long a confirmation: exit code %d: %s", exitCode, stderr)
+	}
+	_, stderr, exitCode := runLockbox("init", "--key-backend", "enclave", "--enclave-confirm", "always")
+	if exitCode != 0 || !strings.Contains(stderr, "no Secure Enclave") {
+		t.Fatalf("init: exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("key-backend"); stdout != "keychain\n" {
+		t.Errorf("key-backend = %q, want keychain", stdout)
+	}
+	runLockbox("set", "API_KEY", "secret123")
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get with the key in the keychain = %q, %s", stdout, stderr)
+	}
+	if stdout, _, exitCode := runLockbox("key-backend", "enclave"); exitCode != 0 || !strings.Contains(stdout, "already kept in the keychain") {
+		t.Errorf("key-backend enclave: exit code %d: %s", exitCode, stdout)
+	}
+}
+
+// TestRecoveryKit tests getting a keychain backed store open on a machine
+// without the keychain entry
+func TestRecoveryKit(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	dir := filepath.Dir(dbPath)
+	keyring := filepath.Join(dir, "keyring")
+	os.Mkdir(keyring, 0700)
+	tool := filepath.Join(dir, "secret-tool")
+	os.WriteFile(tool, []byte(`#!/bin/sh
+op=$1; shift
+while [ $# -gt 1 ]; do [ "$1" = account ] && account=$2; shift; done
+case $op in
+store) cat > `+keyring+`/$account ;;
+lookup) cat `+keyring+`/$account ;;
+clear) rm -f `+keyring+`/$account ;;
+esac
+`), 0755)
+	t.Setenv("LOCKBOX_SECRET_TOOL", tool)
+	t.Setenv("LOCKBOX_KIT_PASSPHRASE", "correct horse")
+
+	runLockbox("init", "--key-backend", "keychain")
+	runLockbox("set", "API_KEY", "secret123")
+
+	kit := filepath.Join(dir, "kit.txt")
+	if _, stderr, exitCode := runLockbox("recovery-kit", "create", "--out", kit); exitCode != 0 {
+		t.Fatalf("recovery-kit create failed with exit code %d: %s", exitCode, stderr)
+	}
+	doc, _ := os.ReadFile(kit)
+	if !strings.Contains(string(doc), dbPath) || !strings.Contains(string(doc), "lockbox-kit:1:") {
+		t.Errorf("Unexpected kit:\n%s", doc)
+	}
+
+	// A new machine: the store is restored elsewhere and the keychain is empty
+	moved := filepath.Join(dir, "restored.db")
+	data, _ := os.ReadFile(dbPath)
+	os.WriteFile(moved, data, 0600)
+	os.RemoveAll(keyring)
+	os.Mkdir(keyring, 0700)
+	t.Setenv("LOCKBOX_DB_PATH", moved)
+	if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+		t.Fatal("get succeeded without the keychain entry")
+	}
+
+	t.Setenv("LOCKBOX_KIT_PASSPHRASE", "battery staple")
+	if _, stderr, exitCode := runLockbox("recovery-kit", "restore", kit, "--store", moved); exitCode == 0 || !strings.Contains(stderr, "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase error, got exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_KIT_PASSPHRASE", "correct horse")
+	if _, stderr, exitCode := runLockbox("recovery-kit", "restore", kit, "--store", filepath.Join(dir, "missing.db")); exitCode == 0 || !strings.Contains(stderr, "backup restore") {
+		t.Errorf("Expected a missing store error, got exit code %d: %s", exitCode, stderr)
+	}
+
+	stdout, stderr, exitCode := runLockbox("recovery-kit", "restore", kit, "--store", moved)
+	if exitCode != 0 {
+		t.Fatalf("recovery-kit restore failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "key kept in keychain") {
+		t.Errorf("Unexpected restore output: %s", stdout)
+	}
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get after restoring = %q, %s", stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("audit", "--action", "kit-restored"); !strings.Contains(stdout, "keychain") {
+		t.Errorf("Expected the restore in the audit log, got: %s", stdout)
+	}
+}
+
+func TestDevice(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Two machines sharing the store, each with a keychain of its own
+	dir := filepath.Dir(dbPath)
+	machine := func(name string) {
+		keyring := filepath.Join(dir, name+"-keyring")
+		os.Mkdir(keyring, 0700)
+		tool := filepath.Join(dir, name+"-secret-tool")
+		os.WriteFile(tool, []byte(`#!/bin/sh
+op=$1; shift
+while [ $# -gt 1 ]; do [ "$1" = account ] && account=$2; shift; done
+case $op in
+store) cat > `+keyring+`/$account ;;
+lookup) cat `+keyring+`/$account ;;
+clear) rm -f `+keyring+`/$account ;;
+esac
+`), 0755)
+		t.Setenv("LOCKBOX_SECRET_TOOL", tool)
+		t.Setenv("LOCKBOX_DEVICE_KEY", filepath.Join(dir, name+".device"))
+	}
+
+	machine("desktop")
+	runLockbox("init", "--key-backend", "keychain")
+	runLockbox("set", "API_KEY", "secret123")
+
+	machine("laptop")
+	if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+		t.Fatal("get succeeded on a machine without the key")
+	}
+	stdout, stderr, exitCode := runLockbox("device", "enroll", "laptop", "--porcelain")
+	if exitCode != 0 || !strings.HasPrefix(stdout, "device-enrolled\tlaptop\tSHA256:") {
+		t.Fatalf("device enroll = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	fingerprint := strings.TrimSpace(strings.Split(stdout, "\t")[2])
+	if info, err := os.Stat(filepath.Join(dir, "laptop.device")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a private device key, got %v", err)
+	}
+	if _, stderr, exitCode := runLockbox("device", "enroll", "laptop2"); exitCode == 0 || !strings.Contains(stderr, "already enrolled") {
+		t.Errorf("Expected enrolling twice to fail, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, _ := runLockbox("get", "API_KEY"); !strings.Contains(stderr, "waiting for approval") {
+		t.Errorf("Expected a pending device error, got: %s", stderr)
+	}
+
+	machine("desktop")
+	if _, stderr, exitCode := runLockbox("device", "approve", "laptop", "--fingerprint", "SHA256:nope"); exitCode == 0 || !strings.Contains(stderr, fingerprint) {
+		t.Errorf("Expected a fingerprint mismatch, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("device", "approve", "laptop", "--fingerprint", fingerprint); exitCode != 0 {
+		t.Fatalf("device approve failed with exit code %d: %s", exitCode, stderr)
+	}
+
+	machine("laptop")
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get on the approved device = %q, %s", stdout, stderr)
+	}
+	stdout, _, _ = runLockbox("device", "list", "--porcelain")
+	if fields := strings.Split(strings.TrimSpace(stdout), "\t"); len(fields) != 6 || fields[2] != "approved" || fields[5] == "" {
+		t.Errorf("Expected an approved device seen just now, got %q", stdout)
+	}
+
+	machine("desktop")
+	_, gitErr := exec.LookPath("git")
+	repo := filepath.Join(dir, "secrets.git")
+	if gitErr == nil {
+		exec.Command("git", "init", "--quiet", "--bare", repo).Run()
+		if _, stderr, exitCode := runLockbox("sync", repo); exitCode != 0 {
+			t.Fatalf("sync failed with exit code %d: %s", exitCode, stderr)
+		}
+	}
+	stdout, stderr, exitCode = runLockbox("device", "revoke", "laptop")
+	if exitCode != 0 || !strings.Contains(stdout, "1 secrets re-encrypted") {
+		t.Fatalf("device revoke = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	// The sync repository moves to the new key with the next sync
+	if gitErr == nil {
+		runLockbox("set", "NEW_KEY", "n")
+		if stdout, stderr, exitCode := runLockbox("sync"); exitCode != 0 || !strings.Contains(stdout, "1 pushed") {
+			t.Errorf("sync after rotating = %q, exit code %d: %s", stdout, exitCode, stderr)
+		}
+		fingerprint, _, _ := runLockbox("fingerprint")
+		record, _ := exec.Command("git", "-C", repo, "show", "main:key.json").CombinedOutput()
+		if !strings.Contains(string(record), strings.TrimSpace(fingerprint)) {
+			t.Errorf("key.json does not name the new key %s:\n%s", fingerprint, record)
+		}
+		if stdout, stderr, exitCode := runLockbox("sync"); exitCode != 0 || !strings.Contains(stdout, "Already in sync") {
+			t.Errorf("repeated sync after rotating = %q, exit code %d: %s", stdout, exitCode, stderr)
+		}
+	}
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get after rotating = %q, %s", stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("audit", "--action", "key-rotated"); !strings.Contains(stdout, "1 secrets") {
+		t.Errorf("Expected the rotation in the audit log, got: %s", stdout)
+	}
+	keys, _ := os.ReadDir(filepath.Join(dir, "desktop-keyring"))
+	if len(keys) != 1 {
+		t.Errorf("Expected the old keychain entry to be replaced, got %d entries", len(keys))
+	}
+
+	machine("laptop")
+	if _, stderr, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 || !strings.Contains(stderr, "revoked") {
+		t.Errorf("Expected the revoked device to be cut off, got exit code %d: %s", exitCode, stderr)
+	}
+}
+
+func TestVault(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_URL", "default-db")
+
+	if _, stderr, exitCode := runLockbox("--vault", "prod", "get", "DB_URL"); exitCode == 0 || !strings.Contains(stderr, "lockbox vault create prod") {
+		t.Fatalf("Using a missing vault should fail with a hint, got exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, stderr, exitCode := runLockbox("vault", "create", "prod", "--porcelain"); exitCode != 0 || stdout != "vault-created\tprod\n" {
+		t.Fatalf("vault create = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("vault", "create", "prod"); exitCode == 0 {
+		t.Error("Creating a vault twice succeeded")
+	}
+
+	runLockbox("--vault", "prod", "set", "DB_URL", "prod-db")
+	t.Setenv("LOCKBOX_VAULT", "prod")
+	runLockbox("set", "ONLY_PROD", "x")
+	if stdout, _, _ := runLockbox("get", "DB_URL"); strings.TrimSpace(stdout) != "prod-db" {
+		t.Errorf("LOCKBOX_VAULT get = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("--vault", "default", "get", "DB_URL"); strings.TrimSpace(stdout) != "default-db" {
+		t.Errorf("default vault get = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("--vault", "default", "env"); strings.Contains(stdout, "ONLY_PROD") {
+		t.Errorf("default vault env leaked a prod key: %s", stdout)
+	}
+
+	// Managing vaults ignores the selected vault
+	stdout, stderr, exitCode := runLockbox("vault", "list", "--porcelain")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if exitCode != 0 || len(lines) != 2 || lines[0] != "vault\tdefault\t1\t" || !strings.HasPrefix(lines[1], "vault\tprod\t2\t") {
+		t.Fatalf("vault list = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("vault", "delete", "prod"); exitCode == 0 || !strings.Contains(stderr, "--force") {
+		t.Errorf("Deleting a non-empty vault without --force: exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, stderr, exitCode := runLockbox("vault", "delete", "prod", "--force", "--porcelain"); exitCode != 0 || stdout != "vault-deleted\tprod\t2\n" {
+		t.Fatalf("vault delete = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_VAULT", "")
+	if stdout, _, _ := runLockbox("get", "DB_URL"); strings.TrimSpace(stdout) != "default-db" {
+		t.Errorf("Deleting prod touched the default vault: %q", stdout)
+	}
+}
+
+func TestTempSecrets(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "PERMANENT", "p")
+
+	if _, stderr, exitCode := runLockbox("temp", "set", "PERMANENT", "x"); exitCode == 0 || !strings.Contains(stderr, "permanent") {
+		t.Errorf("temp set replaced a permanent secret: exit code %d: %s", exitCode, stderr)
+	}
+	// Expiry is kept in whole seconds, so a shorter lifetime may end at once
+	if stdout, stderr, exitCode := runLockbox("temp", "set", "DEMO_KEY", "demo", "--for", "3s", "--porcelain"); exitCode != 0 || !strings.HasPrefix(stdout, "temp-set\tDEMO_KEY\t") {
+		t.Fatalf("temp set = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	runLockbox("temp", "set", "KEPT", "kept", "--for", "3s")
+	runLockbox("temp", "set", "LATER", "later", "--for", "2h")
+	if stdout, _, _ := runLockbox("get", "DEMO_KEY"); stdout != "demo" {
+		t.Errorf("get DEMO_KEY = %q", stdout)
+	}
+	// Setting a temporary secret makes it permanent
+	runLockbox("set", "KEPT", "kept")
+
+	stdout, _, _ := runLockbox("temp", "list", "--porcelain")
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "temp\tDEMO_KEY\t") || !strings.HasPrefix(lines[1], "temp\tLATER\t") {
+		t.Fatalf("temp list = %q", stdout)
+	}
+
+	time.Sleep(4 * time.Second)
+	if _, _, exitCode := runLockbox("get", "DEMO_KEY"); exitCode == 0 {
+		t.Error("Expired secret still readable")
+	}
+	if stdout, _, _ := runLockbox("list", "--porcelain"); strings.Contains(stdout, "DEMO_KEY") || !strings.Contains(stdout, "KEPT") || !strings.Contains(stdout, "LATER") {
+		t.Errorf("list after expiry = %q", stdout)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "SHARED_ADMIN", "hunter2")
+
+	messages := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		messages <- body["text"]
+	}))
+	defer ts.Close()
+	runLockbox("notify", "add", "slack", ts.URL+"/hook", "--events", "checkout,checkin")
+
+	if _, stderr, exitCode := runLockbox("checkout", "MISSING"); exitCode == 0 || !strings.Contains(stderr, "not found") {
+		t.Errorf("checkout of a missing secret: exit code %d: %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("checkout", "SHARED_ADMIN", "--for", "30m", "--porcelain")
+	if exitCode != 0 || !strings.HasPrefix(stdout, fmt.Sprintf("checked-out\tSHARED_ADMIN\tuid:%d\t", os.Getuid())) {
+		t.Fatalf("checkout = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, ": SHARED_ADMIN checked out by ") {
+			t.Errorf("message = %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification of the checkout")
+	}
+	if stdout, _, _ := runLockbox("checkout", "list", "--porcelain"); !strings.HasPrefix(stdout, "checkout\tSHARED_ADMIN\t") || !strings.HasSuffix(stdout, "\tactive\n") {
+		t.Errorf("checkout list = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("audit", "--porcelain"); !strings.Contains(stdout, "\tcheckout\tSHARED_ADMIN until ") {
+		t.Errorf("checkout not audited: %q", stdout)
+	}
+
+	if stdout, stderr, exitCode := runLockbox("checkin", "SHARED_ADMIN", "--porcelain"); exitCode != 0 || stdout != "checked-in\tSHARED_ADMIN\n" {
+		t.Fatalf("checkin = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("checkin", "SHARED_ADMIN"); exitCode == 0 || !strings.Contains(stderr, "not checked out") {
+		t.Errorf("second checkin: exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("checkout", "list"); !strings.Contains(stdout, "No secrets checked out") {
+		t.Errorf("checkout list after checkin = %q", stdout)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_URL", "postgres://prod.example.com/app")
+	runLockbox("set", "EXAMPLE_TOKEN", "abc")
+	runLockbox("set", "OTHER", "nothing here")
+
+	stdout, stderr, exitCode := runLockbox("search", "example", "--values", "--porcelain")
+	if exitCode != 0 || stdout != "match\tDB_URL\tvalue\nmatch\tEXAMPLE_TOKEN\tkey\n" {
+		t.Fatalf("search = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("search", "prod.example"); exitCode != 1 {
+		t.Errorf("Key search matched a value: exit code %d", exitCode)
+	}
+	if stdout, _, _ := runLockbox("search", "*_url"); stdout != "DB_URL\n" {
+		t.Errorf("Glob search = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("search", "--regex", "^(DB|OTHER)"); stdout != "DB_URL\nOTHER\n" {
+		t.Errorf("Regex search = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("search", "-E", "--values", `^postgres://[a-z]+\.`); stdout != "DB_URL\n" {
+		t.Errorf("Regex value search = %q", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("search", "--regex", "("); exitCode == 0 || !strings.Contains(stderr, "invalid regular expression") {
+		t.Errorf("Invalid regex: exit code %d: %s", exitCode, stderr)
+	}
+
+	if stdout, stderr, exitCode := runLockbox("search-index", "enable"); exitCode != 0 || !strings.Contains(stdout, "3 values indexed") {
+		t.Fatalf("search-index enable = %q, exit code %d: %s", stdout, exitCode, stderr)
+	}
+	runLockbox("set", "API_URL", "https://PROD.example.com/api")
+	if stdout, _, _ := runLockbox("search-index", "status"); !strings.Contains(stdout, "4 of 4 values indexed") {
+		t.Errorf("Write was not indexed: %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("search", "--values", "prod.EXAMPLE"); stdout != "API_URL\nDB_URL\n" {
+		t.Errorf("Indexed search = %q", stdout)
+	}
+
+	runLockbox("search-index", "disable")
+	if stdout, _, _ := runLockbox("search-index", "status"); !strings.Contains(stdout, "disabled") {
+		t.Errorf("search-index status after disable = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("search", "--values", "prod.example"); stdout != "API_URL\nDB_URL\n" {
+		t.Errorf("Search without the index = %q", stdout)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Nothing to complete before init
+	if stdout, _, _ := runLockbox("__complete", "get", ""); strings.Contains(stdout, "DB_") {
+		t.Errorf("Completed keys without a store: %q", stdout)
+	}
+
+	runLockbox("init")
+	runLockbox("set", "DB_URL", "postgres://localhost")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+	runLockbox("set", "API_KEY", "sk-123")
+
+	stdout, stderr, exitCode := runLockbox("__complete", "get", "DB_URL", "DB")
+	if exitCode != 0 {
+		t.Fatalf("__complete failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout != "DB_PASSWORD\n:4\n" {
+		t.Errorf("get completions = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("__complete", "delete", ""); !strings.HasPrefix(stdout, "API_KEY\nDB_PASSWORD\nDB_URL\n") {
+		t.Errorf("delete completions = %q", stdout)
+	}
+	// edit takes a single key
+	if stdout, _, _ := runLockbox("__complete", "edit", "API_KEY", ""); stdout != ":4\n" {
+		t.Errorf("edit completions after a key = %q", stdout)
+	}
+
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		if stdout, stderr, exitCode := runLockbox("completion", shell); exitCode != 0 || !strings.Contains(stdout, "lockbox") {
+			t.Errorf("completion %s failed with exit code %d: %s", shell, exitCode, stderr)
+		}
+	}
+	if _, _, exitCode := runLockbox("completion", "tcsh"); exitCode == 0 {
+		t.Error("completion accepted an unsupported shell")
+	}
+}
+
+func TestWorm(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+
+	dir := filepath.Dir(dbPath)
+	body := filepath.Join(dir, "shipped.jsonl")
+	aws := filepath.Join(dir, "aws")
+	os.WriteFile(aws, []byte("#!/bin/sh\nwhile [ $# -gt 0 ]; do [ \"$1\" = --body ] && cat \"$2\" >> "+body+"; shift; done\n"), 0755)
+	t.Setenv("LOCKBOX_AWS", aws)
+
+	if _, stderr, exitCode := runLockbox("worm", "add", "s3", "audit-bucket", "--mode", "strict"); exitCode == 0 {
+		t.Errorf("invalid mode accepted: %s", stderr)
+	}
+	if stdout, stderr, exitCode := runLockbox("worm", "add", "s3", "audit-bucket", "--prefix", "lockbox/"); exitCode != 0 || !strings.Contains(stdout, "s3://audit-bucket/lockbox/ (COMPLIANCE, 365 days)") {
+		t.Fatalf("worm add failed with exit code %d: %s%s", exitCode, stdout, stderr)
+	}
+	runLockbox("set", "API_KEY", "secret123")
+	if stdout, stderr, exitCode := runLockbox("worm", "ship"); exitCode != 0 || !strings.Contains(stdout, "Shipped 1 records") {
+		t.Fatalf("worm ship: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	runLockbox("delete", "API_KEY")
+	runLockbox("worm", "ship")
+
+	shipped, _ := os.ReadFile(body)
+	if strings.Count(string(shipped), "\n") != 2 || strings.Contains(string(shipped), "secret123") {
+		t.Errorf("shipped %q", shipped)
+	}
+	if stdout, stderr, exitCode := runLockbox("worm", "verify", body); exitCode != 0 || !strings.Contains(stdout, "2 records verified") {
+		t.Errorf("worm verify: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	os.WriteFile(body, bytes.Replace(shipped, []byte("API_KEY"), []byte("OTHER_KEY"), 1), 0600)
+	if _, _, exitCode := runLockbox("worm", "verify", body); exitCode == 0 {
+		t.Error("worm verify accepted an edited record")
+	}
+}
+
+func TestAuditAnomalies(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+
+	runLockbox("get", "API_KEY")
+	if stdout, _, exitCode := runLockbox("audit", "anomalies"); exitCode != 0 || !strings.Contains(stdout, "No anomalies found") {
+		t.Errorf("no reads: exit %d, %s", exitCode, stdout)
+	}
+
+	var cmds strings.Builder
+	for i := range 20 {
+		fmt.Fprintf(&cmds, `{"op":"set","key":"APP_%d","value":"v"}`+"\n", i)
+	}
+	cmd := exec.Command("./lockbox", "batch")
+	cmd.Stdin = strings.NewReader(cmds.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("batch failed: %v: %s", err, out)
+	}
+	if _, _, exitCode := runLockbox("env"); exitCode != 0 {
+		t.Fatalf("env failed with exit code %d", exitCode)
+	}
+
+	stdout, stderr, exitCode := runLockbox("audit", "anomalies", "--porcelain")
+	if exitCode != 0 {
+		t.Fatalf("audit anomalies failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "anomaly\t") || !strings.Contains(stdout, "\tenumeration\t") || strings.Contains(stdout, "\tv\n") {
+		t.Errorf("audit anomalies = %q, want one enumeration", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("audit", "anomalies", "--since", "soon"); exitCode == 0 {
+		t.Errorf("invalid --since accepted: %s", stderr)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	runLockbox("init")
+	runLockbox("set", "DB_PASSWORD", "old")
+
+	messages := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		messages <- body["text"]
+	}))
+	defer ts.Close()
+
+	if _, stderr, exitCode := runLockbox("notify", "add", "slack", ts.URL+"/hook", "--events", "canary"); exitCode == 0 || !strings.Contains(stderr, "unknown event") {
+		t.Errorf("unknown event: exit %d, %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("notify", "add", "slack", ts.URL+"/hook", "--events", "rotation,backup-failed")
+	if exitCode != 0 || !strings.Contains(stdout, "is notified of rotation, backup-failed") {
+		t.Fatalf("notify add failed with exit code %d. Stdout: %s Stderr: %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("notify", "list", "--porcelain"); !strings.HasPrefix(stdout, "notify\tslack\tslack\t127.0.0.1:") {
+		t.Errorf("notify list: %q", stdout)
+	}
+
+	runLockbox("rotation", "add", "DB_PASSWORD", "--every", "30d")
+	runLockbox("rotation", "run", "DB_PASSWORD")
+	select {
+	case msg := <-messages:
+		if !strings.HasSuffix(msg, ": Rotated DB_PASSWORD") {
+			t.Errorf("message = %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification of the rotation")
+	}
+
+	// A file where the backup directory should be makes the backup fail
+	blocked := filepath.Join(filepath.Dir(dbPath), "blocked")
+	os.WriteFile(blocked, nil, 0600)
+	runLockbox("backup", blocked)
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, "Backup to "+blocked+" failed") {
+			t.Errorf("message = %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification of the failed backup")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+	runLockbox("vault", "create", "prod")
+	runLockbox("set", "--vault", "prod", "API_KEY", "prod-secret")
+	runLockbox("temp", "set", "SCRATCH", "x", "--for", "1h")
+
+	plain := filepath.Join(dir, "plain.lbx")
+	withKey := filepath.Join(dir, "key.lbx")
+	if _, stderr, exitCode := runLockbox("export", plain); exitCode != 0 {
+		t.Fatalf("export failed with exit code %d: %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("export", withKey, "--include-key")
+	if exitCode != 0 {
+		t.Fatalf("export --include-key failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Exported 3 secret(s)") {
+		t.Errorf("Unexpected export output: %s", stdout)
+	}
+	if data, _ := os.ReadFile(withKey); strings.Contains(string(data), "secret123") {
+		t.Error("Archive holds a plaintext value")
+	}
+
+	// A fresh store has another key
+	t.Setenv("LOCKBOX_DB_PATH", filepath.Join(dir, "fresh.db"))
+	runLockbox("init")
+	if _, stderr, exitCode := runLockbox("import", plain); exitCode == 0 || !strings.Contains(stderr, "--include-key") {
+		t.Errorf("Expected import without the key to fail, got exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "battery staple")
+	if _, stderr, exitCode := runLockbox("import", withKey); exitCode == 0 || !strings.Contains(stderr, "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase error, got exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+
+	runLockbox("set", "API_KEY", "local")
+	if _, stderr, exitCode := runLockbox("import", withKey); exitCode == 0 || !strings.Contains(stderr, "API_KEY") {
+		t.Errorf("Expected a conflict on API_KEY, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "DB_PASSWORD"); exitCode == 0 {
+		t.Error("Failed import was partly applied")
+	}
+	if _, _, exitCode := runLockbox("import", withKey, "--skip", "--overwrite"); exitCode == 0 {
+		t.Error("Expected --skip with --overwrite to fail")
+	}
+
+	stdout, stderr, exitCode = runLockbox("import", withKey, "--skip")
+	if exitCode != 0 {
+		t.Fatalf("import --skip failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Imported 2 secret(s)") || !strings.Contains(stdout, "1 skipped") {
+		t.Errorf("Unexpected import output: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "local" {
+		t.Errorf("--skip replaced API_KEY with %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "--vault", "prod", "API_KEY"); stdout != "prod-secret" {
+		t.Errorf("prod/API_KEY = %q", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "SCRATCH"); exitCode == 0 {
+		t.Error("Temporary secret was exported")
+	}
+
+	if _, stderr, exitCode := runLockbox("import", withKey, "--overwrite"); exitCode != 0 {
+		t.Fatalf("import --overwrite failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("--overwrite left API_KEY at %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("audit", "--action", "archive-imported"); !strings.Contains(stdout, "3 overwritten") {
+		t.Errorf("Expected the import in the audit log, got: %s", stdout)
+	}
+
+	// The original store takes the archive without its key
+	t.Setenv("LOCKBOX_DB_PATH", dbPath)
+	runLockbox("delete", "DB_PASSWORD", "--force")
+	if _, stderr, exitCode := runLockbox("import", plain, "--skip"); exitCode != 0 {
+		t.Fatalf("import into the exporting store failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != "hunter2" {
+		t.Errorf("DB_PASSWORD = %q", stdout)
+	}
+}
+
+func TestDotenv(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+
+	runLockbox("init")
+	runLockbox("set", "DB_HOST", "local")
+
+	envFile := filepath.Join(dir, ".env")
+	os.WriteFile(envFile, []byte(`# app config
+export DB_HOST=db.internal
+DB_PASSWORD='p@ss"word'
+CERT="line1
+line2"
+`), 0600)
+
+	if _, stderr, exitCode := runLockbox("import", "--format", "dotenv", envFile); exitCode == 0 || !strings.Contains(stderr, "DB_HOST") {
+		t.Errorf("Expected a conflict on DB_HOST, got exit code %d: %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("import", "--format", "dotenv", envFile, "--skip")
+	if exitCode != 0 {
+		t.Fatalf("import --format dotenv failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Imported 2 secret(s)") || !strings.Contains(stdout, "1 skipped") {
+		t.Errorf("Unexpected import output: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "CERT"); stdout != "line1\nline2" {
+		t.Errorf("CERT = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_HOST"); stdout != "local" {
+		t.Errorf("--skip replaced DB_HOST with %q", stdout)
+	}
+
+	os.WriteFile(envFile, []byte("A=1\nB=\"unterminated\n"), 0600)
+	if _, stderr, exitCode := runLockbox("import", "--format", "dotenv", envFile); exitCode == 0 || !strings.Contains(stderr, "line 2") {
+		t.Errorf("Expected a parse error on line 2, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "A"); exitCode == 0 {
+		t.Error("A file that failed to parse was partly imported")
+	}
+
+	// Export and import back into another store
+	stdout, stderr, exitCode = runLockbox("export", "--format", "dotenv")
+	if exitCode != 0 {
+		t.Fatalf("export --format dotenv failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, `DB_PASSWORD="p@ss\"word"`) {
+		t.Errorf("Unexpected export output:\n%s", stdout)
+	}
+	exported := filepath.Join(dir, "exported.env")
+	if _, stderr, exitCode := runLockbox("export", "--format", "dotenv", exported); exitCode != 0 {
+		t.Fatalf("export to a file failed with exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_DB_PATH", filepath.Join(dir, "other.db"))
+	runLockbox("init")
+	if _, stderr, exitCode := runLockbox("import", "--format", "dotenv", exported); exitCode != 0 {
+		t.Fatalf("import of the export failed with exit code %d: %s", exitCode, stderr)
+	}
+	for key, want := range map[string]string{"DB_HOST": "local", "DB_PASSWORD": `p@ss"word`, "CERT": "line1\nline2"} {
+		if stdout, _, _ := runLockbox("get", key); stdout != want {
+			t.Errorf("%s after the round trip = %q, expected %q", key, stdout, want)
+		}
+	}
+}
+
+func TestImportDiff(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "DB_HOST", "db.internal")
+	runLockbox("set", "DB_PASSWORD", "old")
+
+	envFile := filepath.Join(filepath.Dir(dbPath), ".env")
+	os.WriteFile(envFile, []byte("DB_HOST=db.internal\nDB_PASSWORD=new\nAPI_KEY=sk-123\n"), 0600)
+
+	stdout, stderr, exitCode := runLockbox("import", "--format", "dotenv", envFile, "--diff")
+	if exitCode != 0 {
+		t.Fatalf("import --diff failed with exit code %d: %s", exitCode, stderr)
+	}
+	for _, want := range []string{"= DB_HOST", "~ DB_PASSWORD", "+ API_KEY", "1 new, 1 changed, 1 identical"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("Expected %q in diff, got:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "sk-123") || strings.Contains(stdout, "new\n") {
+		t.Errorf("Diff printed a value:\n%s", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+		t.Error("import --diff imported API_KEY")
+	}
+
+	stdout, _, _ = runLockbox("import", "--format", "dotenv", envFile, "--diff", "--porcelain")
+	if !strings.Contains(stdout, "import-diff\tchanged\tDB_PASSWORD\t"+envFile+":2\n") {
+		t.Errorf("Unexpected porcelain diff:\n%s", stdout)
+	}
+
+	// Once imported, the same file is identical throughout
+	runLockbox("import", "--format", "dotenv", envFile, "--overwrite")
+	stdout, _, _ = runLockbox("import", "--format", "dotenv", envFile, "--diff")
+	if !strings.Contains(stdout, "0 new, 0 changed, 3 identical") {
+		t.Errorf("Expected a repeated import to change nothing, got:\n%s", stdout)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "v1")
+	runLockbox("set", "DB_URL", "postgres://old")
+
+	stdout, stderr, exitCode := runLockbox("snapshot", "create", "deploy-1")
+	if exitCode != 0 {
+		t.Fatalf("snapshot create failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "holds 2 secrets") {
+		t.Errorf("Unexpected snapshot create output: %s", stdout)
+	}
+	if _, _, exitCode := runLockbox("snapshot", "create", "deploy-1"); exitCode == 0 {
+		t.Error("snapshot create accepted an existing name")
+	}
+	if stdout, _, exitCode := runLockbox("--porcelain", "snapshot", "create", "api-only", "API_*"); exitCode != 0 || stdout != "snapshot-created\tapi-only\t1\n" {
+		t.Errorf("snapshot create with a pattern = %q, exit code %d", stdout, exitCode)
+	}
+
+	runLockbox("set", "API_KEY", "v2")
+	runLockbox("delete", "DB_URL")
+
+	stdout, stderr, exitCode = runLockbox("run", "--snapshot", "deploy-1", "--", "sh", "-c", "echo $API_KEY $DB_URL")
+	if exitCode != 0 {
+		t.Fatalf("run --snapshot failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout != "v1 postgres://old\n" {
+		t.Errorf("run --snapshot saw %q, expected the snapshotted values", stdout)
+	}
+	if stdout, _, _ := runLockbox("run", "--", "sh", "-c", "echo $API_KEY"); stdout != "v2\n" {
+		t.Errorf("run without --snapshot saw %q", stdout)
+	}
+	if _, stderr, exitCode := runLockbox("run", "--snapshot", "missing", "--", "true"); exitCode == 0 || !strings.Contains(stderr, "no snapshot 'missing'") {
+		t.Errorf("run with a missing snapshot: exit code %d, %s", exitCode, stderr)
+	}
+
+	stdout, _, _ = runLockbox("--porcelain", "snapshot", "show", "deploy-1")
+	if !strings.Contains(stdout, "snapshot-secret\tAPI_KEY\t") || !strings.Contains(stdout, "\tchanged\n") || !strings.Contains(stdout, "\tDB_URL\t") || !strings.Contains(stdout, "\tdeleted\n") {
+		t.Errorf("Unexpected snapshot show output: %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("snapshot", "list"); !strings.Contains(stdout, "deploy-1") || !strings.Contains(stdout, "api-only") {
+		t.Errorf("snapshot list = %q", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("snapshot", "delete", "deploy-1"); exitCode != 0 {
+		t.Fatalf("snapshot delete failed with exit code %d: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("run", "--snapshot", "deploy-1", "--", "true"); exitCode == 0 {
+		t.Error("run used a deleted snapshot")
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "abc")
+	runLockbox("set", "DB_URL", "postgres://db:5432/app")
+
+	stdout, stderr, exitCode := runLockbox("list", "--output", "json")
+	if exitCode != 0 {
+		t.Fatalf("list --output json failed with exit code %d: %s", exitCode, stderr)
+	}
+	var records []map[string]any
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("list --output json printed invalid JSON %q: %v", stdout, err)
+	}
+	if len(records) != 2 || records[0]["key"] != "API_KEY" || records[0]["created_at"] == "" || records[0]["updated_at"] == "" || records[0]["tags"] == nil {
+		t.Errorf("Unexpected list records %v", records)
+	}
+	if _, err := time.Parse(time.RFC3339, fmt.Sprint(records[1]["updated_at"])); err != nil {
+		t.Errorf("updated_at is not RFC 3339: %v", err)
+	}
+
+	if stdout, _, _ := runLockbox("list", "-o", "yaml"); !strings.HasPrefix(stdout, "- key: API_KEY\n  owner:") {
+		t.Errorf("Unexpected list YAML %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY", "-o", "yaml"); stdout != "API_KEY: abc\n" {
+		t.Errorf("Unexpected get YAML %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "*", "-o", "json"); stdout != "{\n  \"API_KEY\": \"abc\",\n  \"DB_URL\": \"postgres://db:5432/app\"\n}\n" {
+		t.Errorf("Unexpected get JSON %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("env", "-o", "yaml"); stdout != "API_KEY: abc\nDB_URL: \"postgres://db:5432/app\"\n" {
+		t.Errorf("Unexpected env YAML %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY", "-o", "text"); stdout != "abc" {
+		t.Errorf("get -o text = %q", stdout)
+	}
+
+	if _, stderr, exitCode := runLockbox("list", "-o", "xml"); exitCode == 0 || !strings.Contains(stderr, "unknown output format") {
+		t.Errorf("Expected an unknown format to fail, got exit code %d: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("list", "-o", "json", "--porcelain"); exitCode == 0 {
+		t.Error("Expected --output with --porcelain to fail")
+	}
+}
+
+func TestGC(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "v1")
+	runLockbox("bundle", "keygen", filepath.Join(dir, "escrow"))
+	runLockbox("escrow", "enable", "--archive", filepath.Join(dir, "lockbox.escrow"), "--key", filepath.Join(dir, "escrow.pub"))
+	for _, value := range []string{"v2", "v3", "v4"} {
+		runLockbox("set", "API_KEY", value)
+	}
+
+	stdout, stderr, exitCode := runLockbox("gc", "--keep-versions", "1", "--audit-retention", "180d")
+	if exitCode != 0 {
+		t.Fatalf("gc failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "Reclaimed") || !strings.Contains(stdout, "2 versions") {
+		t.Errorf("Unexpected gc output: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("--porcelain", "escrow", "list"); strings.Count(stdout, "\n") != 1 {
+		t.Errorf("Escrow after gc: %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "v4" {
+		t.Errorf("API_KEY after gc = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("--porcelain", "audit"); !strings.Contains(stdout, "\tgc\t") {
+		t.Errorf("gc was not audited: %q", stdout)
+	}
+
+	if _, _, exitCode := runLockbox("gc", "--audit-retention", "soon"); exitCode == 0 {
+		t.Error("gc accepted an invalid retention")
+	}
+	if _, _, exitCode := runLockbox("gc", "--keep-versions", "-1"); exitCode == 0 {
+		t.Error("gc accepted a negative number of versions")
+	}
+}
+
+func TestSetFromStdin(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	// set runs set with stdin
+	set := func(stdin string, args ...string) (string, int) {
+		cmd := exec.Command("./lockbox", append([]string{"set"}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return errBuf.String(), exitErr.ExitCode()
+		}
+		return errBuf.String(), 0
+	}
+
+	if stderr, code := set("sk-123\n", "API_KEY", "-"); code != 0 {
+		t.Fatalf("set KEY - failed with exit code %d: %s", code, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("API_KEY = %q, expected the trailing newline dropped", stdout)
+	}
+
+	if stderr, code := set("-----BEGIN KEY-----\nabc\n-----END KEY-----\n\n", "CERT", "--stdin"); code != 0 {
+		t.Fatalf("set --stdin failed with exit code %d: %s", code, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "CERT"); stdout != "-----BEGIN KEY-----\nabc\n-----END KEY-----\n" {
+		t.Errorf("CERT = %q, expected only one trailing newline dropped", stdout)
+	}
+
+	if _, code := set("", "API_KEY", "value", "--stdin"); code == 0 {
+		t.Error("set accepted --stdin with a value")
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("A rejected set changed API_KEY to %q", stdout)
+	}
+}
+
+func TestConfigExportImport(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+
+	runLockbox("init")
+	runLockbox("--profile", "prod", "init")
+	runLockbox("vault", "create", "staging")
+	runLockbox("role", "create", "deployer", "--permissions", "read,write")
+	runLockbox("role", "assign", "deployer", "--token", "ci", "DEPLOY_*")
+	runLockbox("set", "DB_PASSWORD", "s3cret")
+	runLockbox("rotation", "add", "DB_PASSWORD", "--every", "30d")
+	runLockbox("--profile", "prod", "set", "NOTIFY_OPS_URL", "https://hooks.slack.com/services/T0/B0/x")
+	runLockbox("--profile", "prod", "notify", "add", "slack", "https://hooks.slack.com/services/T0/B0/x", "--name", "ops")
+
+	stdout, stderr, exitCode := runLockbox("config", "export")
+	if exitCode != 0 {
+		t.Fatalf("config export failed with exit code %d: %s", exitCode, stderr)
+	}
+	for _, want := range []string{"format: lockbox-setup/1", "name: prod", "- staging", "role: deployer", "key: DB_PASSWORD", "every: \"30d\"", "url_secret: NOTIFY_OPS_URL"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("Export lacks %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "hooks.slack.com") || strings.Contains(stdout, "s3cret") {
+		t.Errorf("Export holds secret values:\n%s", stdout)
+	}
+	exported := stdout
+	setupFile := filepath.Join(dir, "lockbox-setup.yaml")
+	os.WriteFile(setupFile, []byte(exported), 0600)
+
+	// On a new machine the URL secret has to be set first
+	os.Setenv("LOCKBOX_DB_PATH", filepath.Join(dir, "new", "lockbox.db"))
+	if _, stderr, exitCode := runLockbox("config", "import", setupFile); exitCode == 0 || !strings.Contains(stderr, "lockbox --profile prod set NOTIFY_OPS_URL") {
+		t.Fatalf("Import without the URL secret: exit code %d: %s", exitCode, stderr)
+	}
+	runLockbox("--profile", "prod", "set", "NOTIFY_OPS_URL", "https://hooks.slack.com/services/T0/B0/x")
+	stdout, stderr, exitCode = runLockbox("config", "import", setupFile)
+	if exitCode != 0 {
+		t.Fatalf("config import failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "✓ Applied profile prod") || !strings.Contains(stderr, "'DB_PASSWORD' is not set yet") {
+		t.Errorf("Unexpected import output: %s\n%s", stdout, stderr)
+	}
+
+	// The new machine exports the same setup
+	if again, _, _ := runLockbox("config", "export"); again != exported {
+		t.Errorf("Imported setup exports differently:\n%s", again)
+	}
+	if stdout, _, _ := runLockbox("--porcelain", "audit"); !strings.Contains(stdout, "\tconfig-imported\t") {
+		t.Errorf("Import was not audited: %q", stdout)
+	}
+
+	os.WriteFile(setupFile, []byte("format: lockbox-setup/9\nprofiles: []\n"), 0600)
+	if _, stderr, exitCode := runLockbox("config", "import", setupFile); exitCode == 0 || !strings.Contains(stderr, "unsupported setup format") {
+		t.Errorf("Import of an unknown format: exit code %d: %s", exitCode, stderr)
+	}
+}
+
+// TestFileSecrets tests that --file and --out keep binary values intact
+func TestFileSecrets(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	dir := filepath.Dir(dbPath)
+	keystore := []byte{0x00, 0xfe, 0xff, '\r', '\n', 'k', 0x80, '\n'}
+	in := filepath.Join(dir, "keystore.p12")
+	os.WriteFile(in, keystore, 0600)
+
+	runLockbox("init")
+	if _, stderr, exitCode := runLockbox("set", "KEYSTORE", "--file", in); exitCode != 0 {
+		t.Fatalf("set --file failed with exit code %d: %s", exitCode, stderr)
+	}
+	if _, _, exitCode := runLockbox("set", "KEYSTORE", "value", "--file", in); exitCode == 0 {
+		t.Error("set with both a value and --file succeeded")
+	}
+
+	out := filepath.Join(dir, "out.p12")
+	if _, stderr, exitCode := runLockbox("get", "KEYSTORE", "--out", out); exitCode != 0 {
+		t.Fatalf("get --out failed with exit code %d: %s", exitCode, stderr)
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, keystore) {
+		t.Errorf("get --out wrote %v, want %v", data, keystore)
+	}
+	if info, _ := os.Stat(out); info.Mode().Perm() != 0600 {
+		t.Errorf("get --out wrote mode %o, want 0600", info.Mode().Perm())
+	}
+
+	if _, stderr, exitCode := runLockbox("get", "KEYSTORE", "--out", out, "--mode", "0640"); exitCode != 0 {
+		t.Fatalf("get --out --mode failed with exit code %d: %s", exitCode, stderr)
+	}
+	if info, _ := os.Stat(out); info.Mode().Perm() != 0640 {
+		t.Errorf("get --out --mode 0640 wrote mode %o", info.Mode().Perm())
+	}
+	if _, _, exitCode := runLockbox("get", "KEYSTORE", "--out", out, "--mode", "999"); exitCode == 0 {
+		t.Error("get with an invalid --mode succeeded")
+	}
+	runLockbox("set", "OTHER", "x")
+	if _, stderr, exitCode := runLockbox("get", "*", "--out", out); exitCode == 0 || !strings.Contains(stderr, "--out writes one") {
+		t.Errorf("get of several keys with --out: exit code %d: %s", exitCode, stderr)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	dir := filepath.Dir(dbPath)
+	tmpl := filepath.Join(dir, "app.yml.tmpl")
+	os.WriteFile(tmpl, []byte("db:\n  user: {{ secret \"DB_USER\" }}\n  password: {{ secret \"DB_PASSWORD\" }}\n"), 0600)
+
+	runLockbox("init")
+	runLockbox("set", "DB_USER", "app")
+	if _, stderr, exitCode := runLockbox("template", tmpl); exitCode == 0 || !strings.Contains(stderr, "'DB_PASSWORD' not found") {
+		t.Errorf("Expected a missing secret error, got exit code %d: %s", exitCode, stderr)
+	}
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+
+	want := "db:\n  user: app\n  password: hunter2\n"
+	stdout, stderr, exitCode := runLockbox("template", tmpl)
+	if exitCode != 0 {
+		t.Fatalf("template failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout != want {
+		t.Errorf("Rendered %q, want %q", stdout, want)
+	}
+
+	out := filepath.Join(dir, "app.yml")
+	if _, stderr, exitCode := runLockbox("template", tmpl, "--out", out, "--mode", "0640"); exitCode != 0 {
+		t.Fatalf("template --out failed with exit code %d: %s", exitCode, stderr)
+	}
+	if data, _ := os.ReadFile(out); string(data) != want {
+		t.Errorf("template --out wrote %q, want %q", data, want)
+	}
+	if info, _ := os.Stat(out); info.Mode().Perm() != 0640 {
+		t.Errorf("template --out wrote mode %o, want 0640", info.Mode().Perm())
+	}
+
+	os.WriteFile(tmpl, []byte(`{{ "DB_USER" | secret }}`), 0600)
+	if _, stderr, exitCode := runLockbox("template", tmpl); exitCode == 0 || !strings.Contains(stderr, "quoted key") {
+		t.Errorf("Expected a quoted key error, got exit code %d: %s", exitCode, stderr)
+	}
+}
+
+// TestEdit tests editing a secret in $EDITOR
+func TestEdit(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A fake editor that writes $NEW_VALUE, as editors save it with a
+	// final newline
+	script := filepath.Join(filepath.Dir(dbPath), "fake-editor")
+	os.WriteFile(script, []byte("#!/bin/sh\n[ -z \"$NEW_VALUE\" ] || printf '%s\\n' \"$NEW_VALUE\" > \"$1\"\n"), 0700)
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", script)
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "sk-old", "--ttl", "1h")
+
+	if stdout, stderr, _ := runLockbox("edit", "API_KEY"); !strings.Contains(stdout, "unchanged") {
+		t.Errorf("edit without changes = %q, %s", stdout, stderr)
+	}
+	t.Setenv("NEW_VALUE", "sk-new")
+	if stdout, stderr, exitCode := runLockbox("edit", "API_KEY"); exitCode != 0 || !strings.Contains(stdout, "saved") {
+		t.Fatalf("edit failed with exit code %d: %s", exitCode, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-new" {
+		t.Errorf("get after edit = %q, want the value without the editor's newline", stdout)
+	}
+
+	store, err := db.OpenStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	expires, _ := store.SecretExpiry("API_KEY")
+	store.Close()
+	if expires.IsZero() {
+		t.Error("edit dropped the secret's expiry")
+	}
+
+	if _, _, exitCode := runLockbox("edit", "MISSING"); exitCode == 0 {
+		t.Error("edit of a missing key succeeded")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+
+	stdout, stderr, exitCode := runLockbox("generate", "API_TOKEN")
+	if exitCode != 0 {
+		t.Fatalf("generate failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "API_TOKEN") || strings.Count(stdout, "\n") != 1 {
+		t.Errorf("Unexpected generate output: %q", stdout)
+	}
+	value, _, _ := runLockbox("get", "API_TOKEN")
+	if len(value) != 32 || strings.Trim(value, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		t.Errorf("Generated value %q is not 32 letters and digits", value)
+	}
+	if strings.Contains(stdout, value) {
+		t.Error("generate printed the value without --print")
+	}
+
+	if _, stderr, exitCode := runLockbox("generate", "API_TOKEN"); exitCode == 0 || !strings.Contains(stderr, "--force") {
+		t.Errorf("generate replaced a secret without --force: %s", stderr)
+	}
+	printed, _, exitCode := runLockbox("generate", "API_TOKEN", "--force", "--charset", "hex", "--length", "64", "--print")
+	if exitCode != 0 || len(printed) != 64 || strings.Trim(printed, "0123456789abcdef") != "" {
+		t.Errorf("generate --print = %q, exit code %d", printed, exitCode)
+	}
+	if stdout, _, _ := runLockbox("get", "API_TOKEN"); stdout != printed {
+		t.Errorf("Stored %q, printed %q", stdout, printed)
+	}
+
+	printed, _, _ = runLockbox("generate", "PASSWORD", "--length", "12", "--symbols", "--print")
+	if len(printed) != 12 || !strings.ContainsAny(printed, "#%+,-./:=?@^_~") {
+		t.Errorf("generate --symbols = %q", printed)
+	}
+
+	for _, args := range [][]string{
+		{"generate", "X", "--charset", "emoji"},
+		{"generate", "X", "--charset", "hex", "--symbols"},
+		{"generate", "X", "--length", "0"},
+	} {
+		if _, _, exitCode := runLockbox(args...); exitCode == 0 {
+			t.Errorf("%v succeeded", args)
+		}
+	}
+}
+
+func TestProvision(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "sk-123")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+	seed := filepath.Join(dir, "seed.lbx")
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "fleet-secret")
+	if _, stderr, exitCode := runLockbox("export", seed, "--include-key"); exitCode != 0 {
+		t.Fatalf("export failed: %s", stderr)
+	}
+	os.Unsetenv("LOCKBOX_ARCHIVE_PASSPHRASE")
+
+	// A fake systemd-creds unseals the passphrase
+	bin := filepath.Join(dir, "bin")
+	os.MkdirAll(bin, 0700)
+	os.WriteFile(filepath.Join(bin, "systemd-creds"), []byte("#!/bin/sh\necho fleet-secret\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	os.Setenv("LOCKBOX_DB_PATH", filepath.Join(dir, "server", "lockbox.db"))
+	if _, stderr, exitCode := runLockbox("provision", "--from-url", "file://"+seed); exitCode == 0 || !strings.Contains(stderr, "no seed passphrase") {
+		t.Errorf("provision without a passphrase: exit code %d: %s", exitCode, stderr)
+	}
+	stdout, stderr, exitCode := runLockbox("provision", "--from-url", "file://"+seed, "--key-from-tpm", "/etc/lockbox/seed.cred")
+	if exitCode != 0 {
+		t.Fatalf("provision failed with exit code %d: %s", exitCode, stderr)
+	}
+	if !strings.Contains(stdout, "initialized") || !strings.Contains(stdout, "Provisioned 2 secret(s)") {
+		t.Errorf("Unexpected provision output: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "DB_PASSWORD"); stdout != "hunter2" {
+		t.Errorf("DB_PASSWORD after provision = %q", stdout)
+	}
+
+	// Provisioning again keeps local changes unless told to overwrite
+	runLockbox("set", "API_KEY", "local")
+	passphraseFile := filepath.Join(dir, "passphrase")
+	os.WriteFile(passphraseFile, []byte("fleet-secret\n"), 0600)
+	stdout, _, _ = runLockbox("provision", "--from-url", "file://"+seed, "--passphrase-file", passphraseFile)
+	if !strings.Contains(stdout, "2 skipped") || strings.Contains(stdout, "initialized") {
+		t.Errorf("Unexpected output of a second provision: %s", stdout)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "local" {
+		t.Errorf("Second provision replaced API_KEY with %q", stdout)
+	}
+	runLockbox("provision", "--from-url", "file://"+seed, "--passphrase-file", passphraseFile, "--overwrite")
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("provision --overwrite left API_KEY = %q", stdout)
+	}
+
+	os.WriteFile(passphraseFile, []byte("wrong"), 0600)
+	if _, _, exitCode := runLockbox("provision", "--from-url", "file://"+seed, "--passphrase-file", passphraseFile); exitCode == 0 {
+		t.Error("provision accepted a wrong passphrase")
+	}
+}
+
+func TestKeyBackendTPM(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A fake systemd-creds "seals" by prefixing the PCR flag, and refuses
+	// to unseal a PCR bound key once the boot state has changed
+	bin := filepath.Join(filepath.Dir(dbPath), "bin")
+	os.MkdirAll(bin, 0700)
+	script := `#!/bin/sh
+case "$1" in
+encrypt) echo "$3"; cat;;
+decrypt) read -r pcrs
+	if [ "$pcrs" != "--tpm2-pcrs=" ] && [ -n "$PCRS_CHANGED" ]; then echo "TPM2 policy mismatch" >&2; exit 1; fi
+	cat;;
+esac
+`
+	os.WriteFile(filepath.Join(bin, "systemd-creds"), []byte(script), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if _, stderr, exitCode := runLockbox("init", "--key-backend", "tpm", "--tpm-pcrs", "24"); exitCode == 0 || !strings.Contains(stderr, "invalid PCR") {
+		t.Errorf("init with a bad PCR: exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("init", "--key-backend", "tpm"); exitCode != 0 {
+		t.Fatalf("init failed: %s", stderr)
+	}
+	runLockbox("set", "API_KEY", "sk-123")
+	if stdout, _, _ := runLockbox("key-backend"); strings.TrimSpace(stdout) != "tpm" {
+		t.Errorf("key-backend = %q, want tpm", stdout)
+	}
+
+	stdout, stderr, exitCode := runLockbox("key-backend", "tpm", "--tpm-pcrs", "0,7")
+	if exitCode != 0 || !strings.Contains(stdout, "Resealed") || !strings.Contains(stdout, "0+7") {
+		t.Fatalf("reseal failed with exit code %d: %s%s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("API_KEY after resealing = %q", stdout)
+	}
+	t.Setenv("PCRS_CHANGED", "1")
+	if _, stderr, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 || !strings.Contains(stderr, "policy mismatch") {
+		t.Errorf("get after the boot state changed: exit code %d: %s", exitCode, stderr)
+	}
+	os.Unsetenv("PCRS_CHANGED")
+
+	if _, stderr, exitCode := runLockbox("key-backend", "store"); exitCode != 0 {
+		t.Fatalf("moving the key back failed: %s", stderr)
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("API_KEY after moving the key back = %q", stdout)
+	}
+}
+
+func TestSecretTags(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	if _, stderr, exitCode := runLockbox("set", "DB_PASSWORD", "hunter2", "--tag", "db", "--tag", "prod", "--description", "Primary database"); exitCode != 0 {
+		t.Fatalf("set with tags failed: %s", stderr)
+	}
+	runLockbox("set", "API_KEY", "sk-123", "--tag", "prod")
+	runLockbox("set", "DEV_TOKEN", "t")
+	if _, stderr, exitCode := runLockbox("set", "X", "y", "--tag", "bad tag"); exitCode == 0 || !strings.Contains(stderr, "invalid tag") {
+		t.Errorf("set with an invalid tag: exit code %d: %s", exitCode, stderr)
+	}
+
+	if stdout, _, _ := runLockbox("list", "--tag", "prod"); stdout != "API_KEY\nDB_PASSWORD\n" {
+		t.Errorf("list --tag prod = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("list", "--tag", "prod", "--tag", "db"); stdout != "DB_PASSWORD\n" {
+		t.Errorf("list --tag prod --tag db = %q", stdout)
+	}
+
+	// Overwriting keeps the tags; --tag '' removes them
+	runLockbox("set", "DB_PASSWORD", "hunter3")
+	stdout, _, _ := runLockbox("list", "--tag", "db", "-o", "json")
+	var records []struct {
+		Key         string   `json:"key"`
+		Tags        []string `json:"tags"`
+		Description string   `json:"description"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil || len(records) != 1 || strings.Join(records[0].Tags, ",") != "db,prod" || records[0].Description != "Primary database" {
+		t.Errorf("list -o json = %q, %v", stdout, err)
+	}
+	runLockbox("set", "API_KEY", "sk-456", "--tag", "")
+	if stdout, _, _ := runLockbox("list", "--tag", "prod"); stdout != "DB_PASSWORD\n" {
+		t.Errorf("list --tag prod after untagging = %q", stdout)
+	}
+}
+
+// TestConfirmRead tests that secrets tagged confirm-read are only read
+// once polkit confirms
+func TestConfirmRead(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("confirmation goes through polkit on Linux only")
+	}
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A fake pkcheck confirms unless $PKCHECK_DENY is set
+	bin := filepath.Join(filepath.Dir(dbPath), "bin")
+	os.MkdirAll(bin, 0700)
+	os.WriteFile(filepath.Join(bin, "pkcheck"), []byte("#!/bin/sh\n[ -z \"$PKCHECK_DENY\" ] || exit 3\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	runLockbox("init")
+	runLockbox("set", "ROOT_KEY", "r00t", "--tag", "confirm-read")
+	runLockbox("set", "API_KEY", "sk-123")
+
+	if stdout, stderr, _ := runLockbox("get", "ROOT_KEY"); stdout != "r00t" {
+		t.Errorf("get ROOT_KEY once confirmed = %q, %s", stdout, stderr)
+	}
+	t.Setenv("PKCHECK_DENY", "1")
+	if stdout, stderr, exitCode := runLockbox("get", "ROOT_KEY"); exitCode == 0 || stdout != "" || !strings.Contains(stderr, "denied") {
+		t.Errorf("get ROOT_KEY when denied: exit code %d: %q %s", exitCode, stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "*_KEY", "--json"); exitCode == 0 {
+		t.Error("get of a pattern matching ROOT_KEY succeeded when denied")
+	}
+	if stdout, _, _ := runLockbox("get", "API_KEY"); stdout != "sk-123" {
+		t.Errorf("get of an untagged key = %q", stdout)
+	}
+
+	store, err := db.OpenStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	confirmed, _ := store.AuditEvents("read-confirmed")
+	denied, _ := store.AuditEvents("read-denied")
+	if len(confirmed) != 1 || len(denied) != 2 || confirmed[0].Detail != "ROOT_KEY" {
+		t.Errorf("audit log has %d confirmed and %d denied reads, want 1 and 2", len(confirmed), len(denied))
+	}
+}
+
+// TestAutotype tests typing a secret once another window is focused
+func TestAutotype(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("typing goes through xdotool and wtype on Linux only")
+	}
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A fake xdotool moves the focus to another window on its third poll
+	// and records what it types, as does a fake wtype
+	dir := filepath.Dir(dbPath)
+	bin := filepath.Join(dir, "bin")
+	os.MkdirAll(bin, 0700)
+	os.WriteFile(filepath.Join(bin, "xdotool"), []byte(`#!/bin/sh
+case "$1" in
+getactivewindow)
+	echo x >> "$TYPED.polls"
+	[ "$(wc -l < "$TYPED.polls")" -lt 3 ] && echo 100 || echo 200 ;;
+type)
+	echo "$@" > "$TYPED.args"
+	cat > "$TYPED" ;;
+esac
+`), 0755)
+	os.WriteFile(filepath.Join(bin, "wtype"), []byte("#!/bin/sh\ncat > \"$TYPED\"\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	typed := filepath.Join(dir, "typed")
+	t.Setenv("TYPED", typed)
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	runLockbox("init")
+	runLockbox("set", "VPN_PASSWORD", "p@ss word")
+
+	stdout, stderr, exitCode := runLockbox("autotype", "VPN_PASSWORD")
+	if exitCode != 0 {
+		t.Fatalf("autotype failed with exit code %d: %s", exitCode, stderr)
+	}
+	if strings.Contains(stdout+stderr, "p@ss") {
+		t.Errorf("autotype printed the value: %s %s", stdout, stderr)
+	}
+	if data, _ := os.ReadFile(typed); string(data) != "p@ss word" {
+		t.Errorf("xdotool typed %q", data)
+	}
+	if data, _ := os.ReadFile(typed + ".args"); strings.Contains(string(data), "p@ss") {
+		t.Errorf("the value was passed to xdotool as an argument: %s", data)
+	}
+
+	t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+	runLockbox("set", "VPN_PASSWORD", "other")
+	if _, stderr, exitCode := runLockbox("autotype", "VPN_PASSWORD", "--delay", "10ms"); exitCode != 0 {
+		t.Fatalf("autotype under Wayland failed with exit code %d: %s", exitCode, stderr)
+	}
+	if data, _ := os.ReadFile(typed); string(data) != "other" {
+		t.Errorf("wtype typed %q", data)
+	}
+
+	if _, _, exitCode := runLockbox("autotype", "MISSING"); exitCode == 0 {
+		t.Error("autotype of a missing key succeeded")
+	}
+}
+
+func TestSecretExpiry(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "sk-123")
+	if _, stderr, exitCode := runLockbox("set", "OLD_TOKEN", "t", "--expires", "2020-01-01"); exitCode == 0 || !strings.Contains(stderr, "already passed") {
+		t.Errorf("set with a past expiry: exit code %d: %s", exitCode, stderr)
+	}
+	if _, stderr, exitCode := runLockbox("set", "X", "y", "--ttl", "1h", "--expires", "2099-01-01"); exitCode == 0 || !strings.Contains(stderr, "mutually exclusive") {
+		t.Errorf("set with --ttl and --expires: exit code %d: %s", exitCode, stderr)
+	}
+	runLockbox("set", "LATER", "l", "--expires", "2099-01-01T00:00:00Z")
+	if _, stderr, exitCode := runLockbox("set", "PREVIEW_TOKEN", "p", "--ttl", "1s"); exitCode != 0 {
+		t.Fatalf("set --ttl failed: %s", stderr)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// Expired secrets are gone from env, get and list, but kept
+	if stdout, _, _ := runLockbox("env"); strings.Contains(stdout, "PREVIEW_TOKEN") || !strings.Contains(stdout, "LATER") {
+		t.Errorf("env after expiry = %q", stdout)
+	}
+	if _, _, exitCode := runLockbox("get", "PREVIEW_TOKEN"); exitCode == 0 {
+		t.Error("get of an expired secret succeeded")
+	}
+	if stdout, _, _ := runLockbox("list"); stdout != "API_KEY\nLATER\n" {
+		t.Errorf("list after expiry = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("list", "--expired"); stdout != "PREVIEW_TOKEN\n" {
+		t.Errorf("list --expired = %q", stdout)
+	}
+	if stdout, _, _ := runLockbox("list", "-o", "json"); !strings.Contains(stdout, `"expires_at": "2099-01-01T00:00:00Z"`) {
+		t.Errorf("list -o json lacks the expiry: %q", stdout)
+	}
+
+	if stdout, _, _ := runLockbox("prune", "--dry-run"); !strings.Contains(stdout, "Would delete 'PREVIEW_TOKEN'") {
+		t.Errorf("prune --dry-run = %q", stdout)
+	}
+	if stdout, stderr, exitCode := runLockbox("prune", "--porcelain"); exitCode != 0 || stdout != "secret-deleted\tPREVIEW_TOKEN\n" {
+		t.Errorf("prune: exit code %d: %q %s", exitCode, stdout, stderr)
+	}
+	if stdout, _, _ := runLockbox("list", "--expired"); stdout != "No secrets found\n" {
+		t.Errorf("list --expired after prune = %q", stdout)
+	}
+}
+
+// TestPlain tests that --plain prints words instead of symbols
+func TestPlain(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	runLockbox("init")
+	stdout, stderr, exitCode := runLockbox("--plain", "set", "API_KEY", "sk-123")
+	if exitCode != 0 || stdout != "OK Secret 'API_KEY' set successfully\n" {
+		t.Fatalf("Unexpected plain output (exit %d): %q %s", exitCode, stdout, stderr)
+	}
+
+	stdout, _, _ = runLockbox("set", "API_KEY", "sk-456")
+	if !strings.HasPrefix(stdout, "✓ ") {
+		t.Errorf("Expected a checkmark without --plain: %q", stdout)
+	}
+
+	cmd := exec.Command("./lockbox", "status")
+	cmd.Env = append(os.Environ(), "LOCKBOX_PLAIN=1")
+	out, _ := cmd.Output()
+	for _, r := range string(out) {
+		if r > unicode.MaxASCII {
+			t.Fatalf("Plain status output is not ASCII:\n%s", out)
+		}
+	}
+	if !strings.Contains(string(out), "OK Lockbox is ready") {
+		t.Errorf("Unexpected plain status output:\n%s", out)
+	}
+}
+
+// TestHelpWeb tests that help --web serves the command reference
+func TestHelpWeb(t *testing.T) {
+	cmd := exec.Command("./lockbox", "help", "--web")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start help --web: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read the URL: %v", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 6 || !strings.HasPrefix(fields[5], "http://127.0.0.1:") {
+		t.Fatalf("Unexpected output: %q", line)
+	}
+
+	resp, err := http.Get(fields[5])
+	if err != nil {
+		t.Fatalf("GET %s: %v", fields[5], err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{`id="lockbox-backup-restore"`, "--plain", "/secrets/KEY", `id="recipe-lockbox-init"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Reference is missing %q", want)
+		}
+	}
+}
+
+// TestAgent tests that the agent spares later commands the passphrase
+func TestAgent(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+	t.Setenv("LOCKBOX_AGENT_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+
+	cmd := exec.Command("./lockbox", "agent", "--idle", "1m")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the agent: %v", err)
+	}
+	defer cmd.Process.Kill()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || !strings.Contains(line, "Agent listening on") {
+		t.Fatalf("Unexpected agent output: %q, %v", line, err)
+	}
+	if _, stderr, exitCode := runLockbox("agent"); exitCode == 0 || !strings.Contains(stderr, "already running") {
+		t.Errorf("Second agent: exit %d, %s", exitCode, stderr)
+	}
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+	t.Setenv("LOCKBOX_PASSPHRASE", "correct horse")
+	runLockbox("passphrase", "set")
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Fatalf("get with the passphrase = %q, %s", stdout, stderr)
+	}
+
+	// The agent now holds the key, so no passphrase is needed
+	os.Unsetenv("LOCKBOX_PASSPHRASE")
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get through the agent = %q, %s", stdout, stderr)
+	}
+
+	if stdout, stderr, exitCode := runLockbox("agent", "lock"); exitCode != 0 || !strings.Contains(stdout, "1 store(s)") {
+		t.Errorf("agent lock: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	if _, _, exitCode := runLockbox("get", "API_KEY"); exitCode == 0 {
+		t.Error("get after agent lock succeeded without a passphrase")
+	}
+
+	// unlock runs agent unlock as pam_exec does, with the password on stdin
+	unlock := func(password string) (string, int) {
+		cmd := exec.Command("./lockbox", "agent", "unlock", "--from-pam-stdin")
+		cmd.Stdin = strings.NewReader(password + "\x00")
+		out, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(out), exitErr.ExitCode()
+		}
+		return string(out), 0
+	}
+	if out, code := unlock("wrong horse"); code == 0 {
+		t.Errorf("unlock with a wrong passphrase succeeded: %s", out)
+	}
+	if out, code := unlock("correct horse"); code != 0 || !strings.Contains(out, "Unlocked") {
+		t.Fatalf("unlock: exit %d, %s", code, out)
+	}
+	if stdout, stderr, _ := runLockbox("get", "API_KEY"); stdout != "secret123" {
+		t.Errorf("get after agent unlock = %q, %s", stdout, stderr)
+	}
+}
+
+// TestBackupDiff tests that backup diff lists changed keys without values
+func TestBackupDiff(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+
+	runLockbox("init")
+	runLockbox("set", "API_KEY", "secret123")
+	runLockbox("set", "DB_PASSWORD", "hunter2")
+	runLockbox("set", "OLD_TOKEN", "tok")
+	old := filepath.Join(dir, "old.lbx")
+	runLockbox("export", old)
+
+	runLockbox("set", "DB_PASSWORD", "hunter3")
+	runLockbox("delete", "OLD_TOKEN")
+	runLockbox("set", "NEW_TOKEN", "tok2")
+	newer := filepath.Join(dir, "new.lbx")
+	runLockbox("export", newer, "--include-key")
+
+	stdout, stderr, exitCode := runLockbox("backup", "diff", old, newer)
+	if exitCode != 0 {
+		t.Fatalf("backup diff failed with exit code %d: %s", exitCode, stderr)
+	}
+	for _, want := range []string{"~ DB_PASSWORD", "+ NEW_TOKEN", "- OLD_TOKEN", "1 added, 1 removed, 1 changed, 1 unchanged"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("Output is missing %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "hunter") || strings.Contains(stdout, "API_KEY") {
+		t.Errorf("Output shows a value or an unchanged key:\n%s", stdout)
+	}
+
+	stdout, _, _ = runLockbox("backup", "diff", old, newer, "--porcelain")
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "backup-diff\tchanged\tDB_PASSWORD\t") {
+		t.Errorf("Unexpected porcelain output:\n%s", stdout)
+	}
+
+	// Elsewhere only the archive including its key can be read, with the
+	// right passphrase
+	t.Setenv("LOCKBOX_DB_PATH", filepath.Join(dir, "other.db"))
+	runLockbox("init")
+	if _, stderr, exitCode := runLockbox("backup", "diff", old, newer); exitCode == 0 || !strings.Contains(stderr, "--include-key") {
+		t.Errorf("Expected an error about the missing key, got exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "battery staple")
+	if _, stderr, exitCode := runLockbox("backup", "diff", newer, newer); exitCode == 0 || !strings.Contains(stderr, "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase error, got exit code %d: %s", exitCode, stderr)
+	}
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+	if stdout, stderr, _ := runLockbox("backup", "diff", newer, newer); !strings.Contains(stdout, "0 changed, 3 unchanged") {
+		t.Errorf("Unexpected diff of an archive with itself: %s%s", stdout, stderr)
+	}
+}
+
+// TestPartialRestore tests restoring selected secrets from an archive
+func TestPartialRestore(t *testing.T) {
+	dbPath, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(dbPath)
+	t.Setenv("LOCKBOX_ARCHIVE_PASSPHRASE", "correct horse")
+
+	runLockbox("init")
+	runLockbox("set", "PROD_DB_USER", "app")
+	runLockbox("set", "PROD_DB_PASSWORD", "hunter2")
+	runLockbox("set", "API_KEY", "old-api")
+	snapshot := filepath.Join(dir, "snapshot.lbx")
+	runLockbox("export", snapshot, "--include-key")
+
+	runLockbox("delete", "PROD_DB_USER")
+	runLockbox("set", "PROD_DB_PASSWORD", "hunter3")
+	runLockbox("set", "API_KEY", "new-api")
+
+	stdout, stderr, exitCode := runLockbox("backup", "restore", snapshot, "--only", "PROD_DB_*", "--no-overwrite")
+	if exitCode != 0 || !strings.Contains(stdout, "Restored 1 secret(s)") || !strings.Contains(stdout, "1 skipped") {
+		t.Fatalf("restore --no-overwrite: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	for key, want := range map[string]string{"PROD_DB_USER": "app", "PROD_DB_PASSWORD": "hunter3", "API_KEY": "new-api"} {
+		if got, _, _ := runLockbox("get", key); got != want {
+			t.Errorf("%s = %q after restore --no-overwrite, want %q", key, got, want)
 		}
 	}
+
+	if stdout, stderr, exitCode := runLockbox("backup", "restore", snapshot, "--only", "PROD_DB_PASSWORD"); exitCode != 0 || !strings.Contains(stdout, "1 overwritten") {
+		t.Errorf("restore: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	if got, _, _ := runLockbox("get", "PROD_DB_PASSWORD"); got != "hunter2" {
+		t.Errorf("PROD_DB_PASSWORD = %q after restore, want hunter2", got)
+	}
+	if _, stderr, exitCode := runLockbox("backup", "restore", snapshot, "--only", "MISSING_*"); exitCode == 0 || !strings.Contains(stderr, "no secrets match") {
+		t.Errorf("Expected a pattern matching nothing to fail, got exit %d: %s", exitCode, stderr)
+	}
+
+	// Into another profile, whose key differs, with the included key
+	if _, stderr, exitCode := runLockbox("backup", "restore", snapshot, "--to-profile", "prod"); exitCode == 0 || !strings.Contains(stderr, "has no store") {
+		t.Errorf("Expected a missing profile to fail, got exit %d: %s", exitCode, stderr)
+	}
+	runLockbox("--profile", "prod", "init")
+	if stdout, stderr, exitCode := runLockbox("backup", "restore", snapshot, "--only", "API_KEY", "--to-profile", "prod"); exitCode != 0 || !strings.Contains(stdout, "Restored 1 secret(s)") {
+		t.Fatalf("restore --to-profile: exit %d, %s%s", exitCode, stdout, stderr)
+	}
+	if got, _, _ := runLockbox("--profile", "prod", "get", "API_KEY"); got != "old-api" {
+		t.Errorf("prod API_KEY = %q, want old-api", got)
+	}
+	if out, _, _ := runLockbox("--profile", "prod", "list"); strings.Contains(out, "PROD_DB") {
+		t.Errorf("restore --only restored more than selected:\n%s", out)
+	}
+
+	if _, stderr, exitCode := runLockbox("backup", "restore", dir, "--only", "API_KEY"); exitCode == 0 || !strings.Contains(stderr, "not a backup directory") {
+		t.Errorf("Expected --only with a directory to fail, got exit %d: %s", exitCode, stderr)
+	}
 }
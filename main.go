@@ -1,571 +1,10705 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/tls"
+	_ "embed"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/MQ37/lockbox/internal/agent"
+	"github.com/MQ37/lockbox/internal/anomaly"
+	"github.com/MQ37/lockbox/internal/archive"
+	"github.com/MQ37/lockbox/internal/autotype"
+	"github.com/MQ37/lockbox/internal/backup"
+	"github.com/MQ37/lockbox/internal/batch"
+	"github.com/MQ37/lockbox/internal/bulk"
+	"github.com/MQ37/lockbox/internal/bundle"
+	"github.com/MQ37/lockbox/internal/client"
+	"github.com/MQ37/lockbox/internal/console"
 	"github.com/MQ37/lockbox/internal/crypto"
 	"github.com/MQ37/lockbox/internal/db"
+	"github.com/MQ37/lockbox/internal/device"
+	"github.com/MQ37/lockbox/internal/digest"
+	"github.com/MQ37/lockbox/internal/dotenv"
+	"github.com/MQ37/lockbox/internal/editor"
+	"github.com/MQ37/lockbox/internal/entrypoint"
+	"github.com/MQ37/lockbox/internal/escrow"
+	"github.com/MQ37/lockbox/internal/export"
+	"github.com/MQ37/lockbox/internal/gc"
+	"github.com/MQ37/lockbox/internal/gitsync"
+	"github.com/MQ37/lockbox/internal/harden"
+	"github.com/MQ37/lockbox/internal/health"
+	"github.com/MQ37/lockbox/internal/helpweb"
+	"github.com/MQ37/lockbox/internal/importdiff"
+	"github.com/MQ37/lockbox/internal/k8s"
+	"github.com/MQ37/lockbox/internal/keycache"
+	"github.com/MQ37/lockbox/internal/keysource"
+	"github.com/MQ37/lockbox/internal/lint"
+	"github.com/MQ37/lockbox/internal/materialize"
+	"github.com/MQ37/lockbox/internal/metrics"
+	"github.com/MQ37/lockbox/internal/multiuser"
+	"github.com/MQ37/lockbox/internal/nativehost"
+	"github.com/MQ37/lockbox/internal/note"
+	"github.com/MQ37/lockbox/internal/notify"
+	"github.com/MQ37/lockbox/internal/oidc"
+	"github.com/MQ37/lockbox/internal/output"
+	"github.com/MQ37/lockbox/internal/pairing"
+	"github.com/MQ37/lockbox/internal/podman"
+	"github.com/MQ37/lockbox/internal/policy"
+	"github.com/MQ37/lockbox/internal/porcelain"
+	"github.com/MQ37/lockbox/internal/presence"
+	"github.com/MQ37/lockbox/internal/promote"
+	"github.com/MQ37/lockbox/internal/prompt"
+	"github.com/MQ37/lockbox/internal/provider"
+	"github.com/MQ37/lockbox/internal/provision"
+	"github.com/MQ37/lockbox/internal/qr"
+	"github.com/MQ37/lockbox/internal/rbac"
+	"github.com/MQ37/lockbox/internal/recovery"
+	"github.com/MQ37/lockbox/internal/recoverykit"
+	"github.com/MQ37/lockbox/internal/render"
+	"github.com/MQ37/lockbox/internal/replicate"
+	"github.com/MQ37/lockbox/internal/report"
+	"github.com/MQ37/lockbox/internal/rotation"
+	"github.com/MQ37/lockbox/internal/search"
+	"github.com/MQ37/lockbox/internal/selector"
+	"github.com/MQ37/lockbox/internal/server"
+	"github.com/MQ37/lockbox/internal/setup"
+	"github.com/MQ37/lockbox/internal/signing"
+	"github.com/MQ37/lockbox/internal/stats"
+	"github.com/MQ37/lockbox/internal/table"
+	"github.com/MQ37/lockbox/internal/token"
+	"github.com/MQ37/lockbox/internal/tpm"
+	"github.com/MQ37/lockbox/internal/workspace"
+	"github.com/MQ37/lockbox/internal/worm"
+	"github.com/MQ37/lockbox/internal/yaml"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+// readme is served as recipes by 'lockbox help --web'
+//
+//go:embed README.md
+var readme string
+
+// exitHooks run, in registration order, just before the process exits
+var exitHooks []func(code int)
+
+// exit runs the registered exit hooks and terminates with the given code.
+// Commands must use it instead of os.Exit so hooks are not skipped.
+func exit(code int) {
+	for _, hook := range exitHooks {
+		hook(code)
+	}
+	os.Exit(code)
+}
+
 // getStoreAndKey opens the store and retrieves the encryption key
 func getStoreAndKey() (*db.Store, []byte, error) {
-	store, err := db.NewStore()
+	dbPath, err := db.ResolvePath()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return openStoreAndKey(dbPath)
+}
+
+// openStoreAndKey is getStoreAndKey for the store at dbPath
+func openStoreAndKey(dbPath string) (*db.Store, []byte, error) {
+	store, err := db.OpenStore(dbPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open store: %w", err)
 	}
 
-	keyHex, err := store.GetConfig("encryption_key")
-	if err != nil {
-		if err == db.ErrNotFound {
-			return nil, nil, fmt.Errorf("encryption key not found. Please run 'lockbox init' first")
+	// An approved device opens the store with the key sealed to it, and
+	// falls back to the key backend like any other machine
+	key, _, err := device.Unlock(store, device.KeyPath(dbPath), time.Now())
+	if err != nil {
+		deviceErr := err
+		key, err = keysource.Load(store, func() (string, error) { return readPassphrase("Passphrase: ") })
+		if err != nil && deviceErr != device.ErrNotEnrolled {
+			err = deviceErr
+		}
+	}
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	if err := selfTest(store, key); err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("startup self-test failed: %w", err)
+	}
+
+	// With escrow on, every delete and overwrite is archived first
+	archive, err := escrow.Load(store)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("failed to load escrow settings: %w", err)
+	}
+	if archive != nil {
+		store.SetEscrow(archive)
+	}
+
+	// With the search index on, every write also updates its entry
+	index, err := search.Load(store, key)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("failed to load search index settings: %w", err)
+	}
+	if index != nil {
+		store.SetIndexer(index)
+	}
+
+	// Expired temporary secrets go before anything can read them
+	if _, err := store.ExpireTempSecrets(time.Now()); err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	// --vault scopes every command to a named vault
+	vault := os.Getenv("LOCKBOX_VAULT")
+	if vault == db.DefaultVault {
+		vault = ""
+	}
+	if ok, err := store.HasVault(vault); err != nil {
+		store.Close()
+		return nil, nil, err
+	} else if !ok {
+		store.Close()
+		return nil, nil, fmt.Errorf("no vault '%s': create it with 'lockbox vault create %s'", vault, vault)
+	}
+
+	return store.InVault(vault), key, nil
+}
+
+// readPassphrase returns $LOCKBOX_PASSPHRASE, or else asks for one on the
+// terminal
+func readPassphrase(label string) (string, error) {
+	if passphrase, ok := os.LookupEnv("LOCKBOX_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+	return prompt.Passphrase(label)
+}
+
+// newPassphrase asks for a new passphrase twice, or takes
+// $LOCKBOX_PASSPHRASE
+func newPassphrase() (string, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	if _, ok := os.LookupEnv("LOCKBOX_PASSPHRASE"); !ok {
+		again, err := prompt.Passphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// secretValue returns the value of 'set KEY [VALUE]': VALUE itself, the
+// contents of --file, stdin less one trailing newline when VALUE is - or
+// --stdin is set, or else what is typed at a hidden prompt
+func secretValue(cmd *cobra.Command, args []string) (string, error) {
+	fromStdin, _ := cmd.Flags().GetBool("stdin")
+	file, _ := cmd.Flags().GetString("file")
+	switch {
+	case file != "" && (fromStdin || len(args) > 1):
+		return "", fmt.Errorf("--file cannot be combined with a value or --stdin")
+	case file != "":
+		// Files are kept byte for byte, trailing newline included
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read value: %w", err)
+		}
+		return string(data), nil
+	case fromStdin && len(args) > 1 && args[1] != "-":
+		return "", fmt.Errorf("--stdin cannot be combined with a value")
+	case fromStdin || len(args) > 1 && args[1] == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read value from stdin: %w", err)
+		}
+		value := string(data)
+		if v, ok := strings.CutSuffix(value, "\n"); ok {
+			value = strings.TrimSuffix(v, "\r")
+		}
+		return value, nil
+	case len(args) > 1:
+		return args[1], nil
+	}
+	value, err := prompt.Secret("Value for " + args[0] + ": ")
+	if err == prompt.ErrNoTerminal {
+		return "", fmt.Errorf("no value given and no terminal to ask for it on; pass it on stdin with -")
+	}
+	return value, err
+}
+
+// kitPassphrase returns $LOCKBOX_KIT_PASSPHRASE, or else asks for the
+// recovery kit passphrase on the terminal, twice when confirm is set
+func kitPassphrase(confirm bool) (string, error) {
+	return otherPassphrase("LOCKBOX_KIT_PASSPHRASE", "kit", confirm)
+}
+
+// archivePassphrase is kitPassphrase for the passphrase wrapping the key
+// in an archive, from $LOCKBOX_ARCHIVE_PASSPHRASE
+func archivePassphrase(confirm bool) (string, error) {
+	return otherPassphrase("LOCKBOX_ARCHIVE_PASSPHRASE", "archive", confirm)
+}
+
+// openArchives opens archive files with storeKey, the key of the store
+// they came from, or else with the key they include, unwrapped with the
+// archive passphrase asked once. A nil storeKey is only loaded from the
+// current store for archives without their key.
+func openArchives(storeKey []byte, paths ...string) ([]*archive.Archive, error) {
+	var passphrase string
+	var archives []*archive.Archive
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return archives, fmt.Errorf("failed to read archive: %w", err)
+		}
+		sealed, err := archive.Read(f)
+		f.Close()
+		if err != nil {
+			return archives, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if storeKey == nil && len(sealed.Header.Key) == 0 {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				return archives, err
+			}
+			store.Close()
+			storeKey = encKey
+			defer clear(encKey)
+		}
+		err = archive.ErrWrongKey
+		var a *archive.Archive
+		if storeKey != nil {
+			a, err = sealed.Open(storeKey)
+		}
+		if err == archive.ErrWrongKey {
+			if len(sealed.Header.Key) == 0 {
+				return archives, fmt.Errorf("%s was exported from a store with another key; export it with --include-key to read it here", path)
+			}
+			if passphrase == "" {
+				if passphrase, err = archivePassphrase(false); err != nil {
+					return archives, err
+				}
+			}
+			key, kerr := sealed.UnwrapKey(passphrase)
+			if kerr != nil {
+				return archives, fmt.Errorf("%s: %w", path, kerr)
+			}
+			a, err = sealed.Open(key)
+			clear(key)
+		}
+		if err != nil {
+			return archives, fmt.Errorf("%s: %w", path, err)
+		}
+		archives = append(archives, a)
+	}
+	return archives, nil
+}
+
+// otherPassphrase returns $env, or else asks for the passphrase called
+// label on the terminal, twice when confirm is set
+func otherPassphrase(env, label string, confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv(env); ok {
+		return passphrase, nil
+	}
+	passphrase, err := prompt.Passphrase(strings.ToUpper(label[:1]) + label[1:] + " passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	if confirm {
+		again, err := prompt.Passphrase("Repeat " + label + " passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// moveKey keeps the store's key in backend instead of where it is now,
+// recording the move in the audit log, and returns where it was
+func moveKey(store *db.Store, key []byte, actor, backend string) (string, error) {
+	from, err := keysource.Backend(store)
+	if err != nil {
+		return "", err
+	}
+	if err := keysource.Save(store, key, backend, newPassphrase); err != nil {
+		return "", err
+	}
+	store.Audit(actor, "key-moved", from+" -> "+backend)
+	// Rewrite the file so the plain key is not left in free pages
+	if from == keysource.Store && backend != keysource.Store {
+		if err := store.Vacuum(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	return from, nil
+}
+
+// rotateKey re-encrypts store under a new key and keeps it where the old
+// one was: every secret and shared blob, notification targets, the backup
+// chain key, the key sentinel and the copies sealed to approved devices
+// change in one transaction. It returns the number of secrets
+// re-encrypted.
+func rotateKey(store *db.Store, key []byte) (int, error) {
+	backend, err := keysource.Backend(store)
+	if err != nil {
+		return 0, err
+	}
+	// A keychain entry, TPM seal or enclave key only exists on the machine
+	// that made it
+	switch backend {
+	case keysource.Keychain:
+		if current, err := keysource.Load(store, nil); err != nil || !bytes.Equal(current, key) {
+			return 0, fmt.Errorf("the store key is kept in another machine's keychain; rotate it there")
+		}
+	case keysource.TPM:
+		if current, err := keysource.Load(store, nil); err != nil || !bytes.Equal(current, key) {
+			return 0, fmt.Errorf("the store key is sealed to another machine's TPM; rotate it there")
+		}
+		keysource.TPMPCRs = keysource.SealedPCRs(store)
+	case keysource.Enclave:
+		if current, err := keysource.Load(store, nil); err != nil || !bytes.Equal(current, key) {
+			return 0, fmt.Errorf("the store key is kept in another Mac's Secure Enclave; rotate it there")
+		}
+		keysource.EnclaveConfirm = keysource.EnclaveSettings(store)
+	}
+
+	newKey, err := crypto.GenerateKey()
+	if err != nil {
+		return 0, err
+	}
+	defer clear(newKey)
+	entries := map[string][]byte{}
+	for _, rekey := range []func() (map[string][]byte, error){
+		func() (map[string][]byte, error) { return notify.Rekey(store, key, newKey) },
+		func() (map[string][]byte, error) { return backup.Rekey(store, key, newKey) },
+		func() (map[string][]byte, error) { return device.Reseal(store, newKey) },
+		func() (map[string][]byte, error) { return gitsync.Rekey(store, key, newKey) },
+	} {
+		e, err := rekey()
+		if err != nil {
+			return 0, err
+		}
+		maps.Copy(entries, e)
+	}
+	if entries[sentinelConfig], err = crypto.NewSentinel(newKey); err != nil {
+		return 0, err
+	}
+
+	// The passphrase stays the same, so check it before wrapping with it
+	pending, err := keysource.Prepare(store, newKey, backend, func() (string, error) {
+		passphrase, err := readPassphrase("Passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		return passphrase, keysource.CheckPassphrase(store, passphrase)
+	})
+	if err != nil {
+		return 0, err
+	}
+	committed := false
+	defer func() { pending.Done(committed) }()
+
+	tx, err := store.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := tx.Reencrypt(func(ciphertext []byte, blob bool) ([]byte, string, error) {
+		plaintext, err := crypto.Decrypt(ciphertext, key)
+		if err != nil {
+			return nil, "", err
+		}
+		defer clear(plaintext)
+		var digest string
+		if blob {
+			if digest, err = crypto.Digest(plaintext, newKey); err != nil {
+				return nil, "", err
+			}
+		}
+		ciphertext, err = crypto.Encrypt(plaintext, newKey)
+		return ciphertext, digest, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range entries {
+		if err := tx.SetConfig(name, value); err != nil {
+			return 0, err
+		}
+	}
+	if err := pending.Apply(tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	committed = true
+	return n, nil
+}
+
+// secretExpiry returns when a secret written at now expires, from --ttl
+// or --expires, or zero if neither is set
+func secretExpiry(cmd *cobra.Command, now time.Time) (time.Time, error) {
+	ttl, _ := cmd.Flags().GetString("ttl")
+	expires, _ := cmd.Flags().GetString("expires")
+	switch {
+	case ttl != "" && expires != "":
+		return time.Time{}, fmt.Errorf("--ttl and --expires are mutually exclusive")
+	case ttl != "":
+		var d time.Duration
+		var err error
+		if days, ok := strings.CutSuffix(ttl, "d"); ok {
+			var n int
+			n, err = strconv.Atoi(days)
+			d = time.Duration(n) * 24 * time.Hour
+		} else {
+			d, err = time.ParseDuration(ttl)
+		}
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid --ttl '%s': expected a positive duration such as 24h or 30d", ttl)
+		}
+		return now.Add(d), nil
+	case expires != "":
+		if t, err := time.Parse(time.RFC3339, expires); err == nil {
+			return t, nil
+		}
+		t, err := time.ParseInLocation(time.DateOnly, expires, time.Local)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid --expires '%s': expected a date such as 2025-01-01 or an RFC 3339 time", expires)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// pamEnvironment fills in HOME and XDG_RUNTIME_DIR from $PAM_USER when
+// pam_exec left them unset, so the store and agent socket resolve as they
+// do in the user's session
+func pamEnvironment() {
+	u, err := user.Lookup(os.Getenv("PAM_USER"))
+	if err != nil {
+		return
+	}
+	if os.Getenv("HOME") == "" {
+		os.Setenv("HOME", u.HomeDir)
+	}
+	if os.Getenv("XDG_RUNTIME_DIR") == "" {
+		dir := filepath.Join("/run/user", u.Uid)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			os.Setenv("XDG_RUNTIME_DIR", dir)
+		}
+	}
+}
+
+// isProtected reports whether store's key is wrapped with a passphrase
+func isProtected(store *db.Store) bool {
+	backend, _ := keysource.Backend(store)
+	return backend == keysource.Passphrase
+}
+
+// setTPMPCRs binds keys sealed to the TPM from now on to the PCRs given
+// with --tpm-pcrs, exiting if they are invalid
+func setTPMPCRs(cmd *cobra.Command) {
+	pcrs, _ := cmd.Flags().GetString("tpm-pcrs")
+	pcrs, err := tpm.ParsePCRs(pcrs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --tpm-pcrs: %v\n", err)
+		exit(1)
+	}
+	keysource.TPMPCRs = pcrs
+}
+
+// setEnclaveConfirm makes keys kept in the Secure Enclave from now on ask
+// for Touch ID as often as --enclave-confirm says, exiting if it is invalid
+func setEnclaveConfirm(cmd *cobra.Command) {
+	confirm, _ := cmd.Flags().GetString("enclave-confirm")
+	if _, _, err := keysource.ParseConfirm(confirm); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --enclave-confirm: %v\n", err)
+		exit(1)
+	}
+	keysource.EnclaveConfirm = confirm
+}
+
+// enclaveFallback returns backend, or the keychain with a warning if
+// backend is the Secure Enclave and this machine has none
+func enclaveFallback(backend string) string {
+	if backend != keysource.Enclave {
+		return backend
+	}
+	if err := keysource.EnclaveAvailable(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v; keeping the key in the keychain instead\n", err)
+		return keysource.Keychain
+	}
+	return backend
+}
+
+// confirmReads asks the OS to confirm a person is reading those of keys
+// tagged confirm-read, once for all of them, recording the outcome in the
+// audit log
+func confirmReads(store *db.Store, keys []string) error {
+	var tagged []string
+	for _, key := range keys {
+		meta, err := store.SecretMeta(key)
+		if err != nil {
+			return fmt.Errorf("failed to get secret metadata: %w", err)
+		}
+		if meta.HasTags(presence.Tag) {
+			tagged = append(tagged, key)
+		}
+	}
+	if len(tagged) == 0 {
+		return nil
+	}
+	list := strings.Join(tagged, ", ")
+	if err := presence.Confirm("read " + list); err != nil {
+		store.Audit(localActor(store).Owner, "read-denied", list)
+		return fmt.Errorf("reading %s needs confirmation: %w", list, err)
+	}
+	store.Audit(localActor(store).Owner, "read-confirmed", list)
+	return nil
+}
+
+// sentinelConfig is the config entry holding the store's key sentinel
+const sentinelConfig = "key_sentinel"
+
+// initKey generates store's encryption key, keeps it with backend and
+// records its sentinel
+func initKey(store *db.Store, backend string) error {
+	if err := crypto.SelfTest(); err != nil {
+		return fmt.Errorf("crypto self-test failed: %w", err)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	if err := keysource.Save(store, key, backend, newPassphrase); err != nil {
+		return fmt.Errorf("failed to store encryption key: %w", err)
+	}
+	sentinel, err := crypto.NewSentinel(key)
+	if err == nil {
+		err = store.SetConfig(sentinelConfig, sentinel)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store key sentinel: %w", err)
+	}
+	return nil
+}
+
+// selfTest runs the crypto self-test and checks key against the store's
+// sentinel record. Stores that predate the sentinel get one, once key has
+// been shown to decrypt an existing secret.
+func selfTest(store *db.Store, key []byte) error {
+	if err := crypto.SelfTest(); err != nil {
+		return err
+	}
+
+	sentinel, err := store.GetConfig(sentinelConfig)
+	if err == nil {
+		return crypto.CheckSentinel(sentinel, key)
+	} else if err != db.ErrNotFound {
+		return err
+	}
+
+	keys, err := store.ListAllSecrets()
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		value, err := store.GetSecret(keys[0])
+		if err != nil {
+			return err
+		}
+		if _, err := crypto.Decrypt(value, key); err != nil {
+			return crypto.ErrWrongKey
+		}
+	}
+	if sentinel, err = crypto.NewSentinel(key); err != nil {
+		return err
+	}
+	// A read-only store keeps working without a sentinel
+	store.SetConfig(sentinelConfig, sentinel)
+	return nil
+}
+
+// backupIdentities returns the keys given with --identity and the
+// passphrase in LOCKBOX_BACKUP_PASSPHRASE, if set, for opening backups
+func backupIdentities(cmd *cobra.Command) ([]backup.Identity, error) {
+	files, _ := cmd.Flags().GetStringArray("identity")
+	var ids []backup.Identity
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity: %w", err)
+		}
+		key, err := bundle.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		ids = append(ids, backup.X25519Identity{Key: key})
+	}
+	if p := os.Getenv("LOCKBOX_BACKUP_PASSPHRASE"); p != "" {
+		ids = append(ids, backup.PassphraseIdentity{Passphrase: p})
+	}
+	return ids, nil
+}
+
+// openProfile opens the store of a profile, which must already exist
+func openProfile(name string) (*db.Store, []byte, error) {
+	dbPath, err := db.ProfilePath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("profile '%s' has no store; create it with 'lockbox --profile %s init'", name, name)
+	}
+	return openStoreAndKey(dbPath)
+}
+
+// printPromotion prints a promotion plan and returns how many secrets it
+// writes
+func printPromotion(items []promote.Item) int {
+	n := 0
+	for _, item := range items {
+		mark := map[string]string{promote.Add: "+", promote.Update: "~", promote.Same: "="}[item.Change]
+		fmt.Printf("  %s %s\n", mark, item.Key)
+		if item.Change != promote.Same {
+			n++
+		}
+	}
+	return n
+}
+
+// localReplicas returns the values of the store's secrets with when each
+// was last updated. Temporary secrets are left out.
+func localReplicas(store *db.Store, encKey []byte) (map[string]replicate.Secret, error) {
+	infos, err := store.ListSecretInfo()
+	if err != nil {
+		return nil, err
+	}
+	updated := map[string]time.Time{}
+	var keys []string
+	for _, info := range infos {
+		if info.Expires.IsZero() {
+			keys = append(keys, info.Key)
+			updated[info.Key] = info.Updated
+		}
+	}
+	secrets := make(map[string]replicate.Secret, len(keys))
+	err = bulk.Decrypt(store, encKey, keys, func(key string, value []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		secrets[key] = replicate.Secret{Value: value, Updated: updated[key]}
+		return nil
+	})
+	return secrets, err
+}
+
+// remoteReplicas returns the values of the remote's secrets with when each
+// was last updated. Temporary secrets are left out.
+func remoteReplicas(remote *client.Client) (map[string]replicate.Secret, error) {
+	infos, err := remote.ListSecretInfo()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		if info.Expires.IsZero() {
+			keys = append(keys, info.Key)
+		}
+	}
+	values, err := remote.Fetch(keys)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]replicate.Secret, len(keys))
+	for _, info := range infos {
+		if value, ok := values[info.Key]; ok {
+			secrets[info.Key] = replicate.Secret{Value: []byte(value), Updated: info.Updated}
+		}
+	}
+	return secrets, nil
+}
+
+// replicateSecrets copies the secrets of the current store to --remote
+// with push, or those of --remote to the store with pull. Keys the target
+// changed since the source did are left alone unless --force is set, and
+// nothing is written with --dry-run.
+func replicateSecrets(cmd *cobra.Command, push bool) {
+	remoteFlag, _ := cmd.Flags().GetString("remote")
+	force, _ := cmd.Flags().GetBool("force")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if remoteFlag == "" {
+		remoteFlag = os.Getenv("LOCKBOX_REMOTE")
+	}
+	if remoteFlag == "" {
+		fmt.Fprintf(os.Stderr, "Error: --remote is required\n")
+		exit(1)
+	}
+
+	store, encKey, err := getStoreAndKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+	remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+	defer remote.Close()
+
+	local, err := localReplicas(store, encKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer func() {
+		for _, sec := range local {
+			clear(sec.Value)
+		}
+	}()
+	remoteSecrets, err := remoteReplicas(remote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	source, target := local, remoteSecrets
+	verb, done, prep, from, to := "push", "Pushed", "to", "local", remoteFlag
+	if !push {
+		source, target = remoteSecrets, local
+		verb, done, prep, from, to = "pull", "Pulled", "from", remoteFlag, "local store"
+	}
+	items := replicate.Plan(source, target)
+	keys := replicate.Keys(items, force)
+	counts := replicate.Count(items)
+	skipped := counts[replicate.Conflict]
+	if force {
+		skipped = 0
+	}
+
+	porcelainOut := isPorcelain(cmd)
+	for _, item := range items {
+		if porcelainOut {
+			porcelain.Write(os.Stdout, verb, item.Change, item.Key, porcelain.Time(item.Source), porcelain.Time(item.Target))
+			continue
+		}
+		switch item.Change {
+		case replicate.Add:
+			fmt.Printf("  + %s\n", item.Key)
+		case replicate.Update:
+			fmt.Printf("  ~ %-32s  updated %s over %s\n", item.Key, item.Source.Local().Format(time.DateTime), item.Target.Local().Format(time.DateTime))
+		case replicate.Conflict:
+			fmt.Printf("  ! %-32s  %s updated %s, %s updated %s\n", item.Key, from, item.Source.Local().Format(time.DateTime), to, item.Target.Local().Format(time.DateTime))
+		}
+	}
+
+	if !dryRun && len(keys) > 0 {
+		if push {
+			values := make(map[string]string, len(keys))
+			for _, key := range keys {
+				values[key] = string(source[key].Value)
+			}
+			_, err = remote.SetSecrets(values)
+			if err == nil {
+				recordAccess(store, keys)
+			}
+		} else {
+			err = pullSecrets(store, encKey, source, keys, remoteFlag)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	if !porcelainOut {
+		switch {
+		case dryRun:
+			fmt.Printf("Would %s %d secrets %s %s (%d conflicting, %d unchanged)\n", verb, len(keys), prep, remoteFlag, skipped, counts[replicate.Same])
+		case len(keys) == 0 && skipped == 0:
+			fmt.Printf("Nothing to %s: %d secrets are the same on both sides\n", verb, counts[replicate.Same])
+		default:
+			fmt.Printf("%s %s %d secrets %s %s (%d unchanged)\n", output.OK, done, len(keys), prep, remoteFlag, counts[replicate.Same])
+		}
+	}
+	if skipped > 0 {
+		if !dryRun {
+			fmt.Fprintf(os.Stderr, "%s Skipped %d secrets changed later at the target (%s); rerun with --force to overwrite them\n", output.Warn, skipped, to)
+		}
+		exit(1)
+	}
+}
+
+// pullSecrets writes keys of the pulled secrets to store in one
+// transaction
+func pullSecrets(store *db.Store, encKey []byte, secrets map[string]replicate.Secret, keys []string, remote string) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	actor := localActor(store)
+	for _, key := range keys {
+		value := string(secrets[key].Value)
+		if _, err := batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: key, Value: &value}); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if err := tx.Audit(actor.Owner, "pull", fmt.Sprintf("from %s: %d secrets", remote, len(keys))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// openMergeSource opens the store file merged from through its key
+// backend, asking for its passphrase unless $LOCKBOX_MERGE_PASSPHRASE is
+// set
+func openMergeSource(path string) (*db.Store, []byte, error) {
+	// Opening a missing file would create an empty store
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, err
+	}
+	store, err := db.OpenStore(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	key, err := keysource.Load(store, func() (string, error) {
+		if passphrase, ok := os.LookupEnv("LOCKBOX_MERGE_PASSPHRASE"); ok {
+			return passphrase, nil
+		}
+		return prompt.Passphrase(fmt.Sprintf("Passphrase of %s: ", path))
+	})
+	if err == nil {
+		err = selfTest(store, key)
+	}
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return store, key, nil
+}
+
+// syncURLConfig is the config entry holding the repository 'lockbox sync'
+// last synced with
+const syncURLConfig = "sync_url"
+
+// applySync writes the Pull items of a git sync to store and deletes the
+// DeleteLocal ones, in one transaction
+func applySync(store *db.Store, encKey []byte, items []gitsync.Item, remote map[string]replicate.Secret, url string) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	actor := localActor(store)
+	pulled, deleted := 0, 0
+	for _, item := range items {
+		command := batch.Command{Op: "delete", Key: item.Key}
+		switch item.Action {
+		case gitsync.Pull:
+			value := string(remote[item.Key].Value)
+			command = batch.Command{Op: "set", Key: item.Key, Value: &value}
+			pulled++
+		case gitsync.DeleteLocal:
+			deleted++
+		default:
+			continue
+		}
+		if _, err := batch.Execute(tx, encKey, actor, command); err != nil {
+			return fmt.Errorf("%s: %w", item.Key, err)
+		}
+	}
+	if pulled+deleted == 0 {
+		return nil
+	}
+	if err := tx.Audit(actor.Owner, "sync", fmt.Sprintf("from %s: %d secrets set, %d deleted", url, pulled, deleted)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restoreArchive restores the secrets of the archive at path that --only
+// selects into the current store or the store of --to-profile
+func restoreArchive(cmd *cobra.Command, path string) {
+	if cmd.Flags().Changed("to") {
+		fmt.Fprintf(os.Stderr, "Error: --to rebuilds a store from a backup directory; restore an archive into a profile with --to-profile\n")
+		exit(1)
+	}
+	only, _ := cmd.Flags().GetStringArray("only")
+	profile, _ := cmd.Flags().GetString("to-profile")
+	strategy := archive.Overwrite
+	if noOverwrite, _ := cmd.Flags().GetBool("no-overwrite"); noOverwrite {
+		strategy = archive.Skip
+	}
+
+	var store *db.Store
+	var encKey []byte
+	var err error
+	if profile != "" {
+		store, encKey, err = openProfile(profile)
+	} else {
+		store, encKey, err = getStoreAndKey()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+	actor := localActor(store)
+	if !actor.Admin {
+		fmt.Fprintf(os.Stderr, "Error: only the store's owner can restore into it\n")
+		exit(1)
+	}
+
+	archives, err := openArchives(encKey, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	a := archives[0]
+	defer a.Wipe()
+	if len(only) > 0 {
+		if a, err = a.Select(only); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+			exit(1)
+		}
+	}
+
+	result, err := archive.Restore(store, encKey, a, strategy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	store.Audit(actor.Owner, "archive-restored", fmt.Sprintf("%s: %d created, %d overwritten, %d skipped", path, result.Created, result.Overwritten, result.Skipped))
+	fmt.Printf("%s Restored %d secret(s) from %s\n", output.OK, result.Created+result.Overwritten, path)
+	if result.Overwritten > 0 {
+		fmt.Printf("  %d overwritten\n", result.Overwritten)
+	}
+	if result.Skipped > 0 {
+		fmt.Printf("  %d skipped, already present\n", result.Skipped)
+	}
+}
+
+// printImportDiff prints what an import would do without storing
+// anything, as import-diff records when porcelain
+func printImportDiff(cmd *cobra.Command, store *db.Store, encKey []byte, secrets []provider.Secret) {
+	items, err := importdiff.Compare(store, encKey, secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if isPorcelain(cmd) {
+		for _, item := range items {
+			porcelain.Write(os.Stdout, "import-diff", item.Change, item.Key, item.Source)
+		}
+		return
+	}
+	for _, item := range items {
+		mark := map[string]string{importdiff.New: "+", importdiff.Changed: "~", importdiff.Identical: "="}[item.Change]
+		fmt.Printf("  %s %s <- %s\n", mark, item.Key, item.Source)
+	}
+	added, changed, identical := importdiff.Count(items)
+	fmt.Printf("%d new, %d changed, %d identical; nothing was imported\n", added, changed, identical)
+}
+
+// notifyEvent tells the store's notification targets about e, warning if
+// any cannot be reached. Events name the store by profile, or by host
+// when no profile is in use.
+func notifyEvent(store *db.Store, encKey []byte, e notify.Event) {
+	if e.Store == "" {
+		hostname, _ := os.Hostname()
+		e.Store = cmp.Or(os.Getenv("LOCKBOX_PROFILE"), hostname)
+	}
+	if err := notify.Send(store, encKey, e); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
+
+// importSecrets stores secrets read from another system in one
+// transaction. Existing keys are skipped unless --overwrite is set, and
+// nothing is stored with --dry-run or --diff.
+func importSecrets(cmd *cobra.Command, secrets []provider.Secret, from string) {
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	diff, _ := cmd.Flags().GetBool("diff")
+
+	store, encKey, err := getStoreAndKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+	if diff {
+		printImportDiff(cmd, store, encKey, secrets)
+		return
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer tx.Rollback()
+	existing, err := tx.ListSecrets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	exists := map[string]bool{}
+	for _, k := range existing {
+		exists[k] = true
+	}
+
+	actor := localActor(store)
+	imported, skipped := 0, 0
+	for _, sec := range secrets {
+		if exists[sec.Key] && !overwrite {
+			fmt.Printf("- %s exists, skipped (%s)\n", sec.Key, sec.Source)
+			skipped++
+			continue
+		}
+		if dryRun {
+			fmt.Printf("  %s <- %s\n", sec.Key, sec.Source)
+			imported++
+			continue
+		}
+		value := string(sec.Value)
+		if _, err := batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: sec.Key, Value: &value}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", sec.Source, err)
+			exit(1)
+		}
+		fmt.Printf("%s %s <- %s\n", output.OK, sec.Key, sec.Source)
+		imported++
+	}
+	if dryRun {
+		fmt.Printf("Would import %d secrets from %s (%d skipped)\n", imported, from, skipped)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	fmt.Printf("%s Imported %d secrets from %s (%d skipped)\n", output.OK, imported, from, skipped)
+}
+
+// exportSecrets writes the secrets selected by patterns, or all of them,
+// to p. Secrets that exist in p are skipped unless --overwrite is set, and
+// nothing is written with --dry-run.
+func exportSecrets(cmd *cobra.Command, patterns []string, p provider.Provider, label string) {
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	store, encKey, err := getStoreAndKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+
+	keys, err := store.ListSecrets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+		exit(1)
+	}
+	if len(patterns) > 0 {
+		if keys, err = selector.Resolve(keys, patterns); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+	names := map[string]string{}
+	for _, key := range keys {
+		if names[key], err = p.Name(key); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+	remote, err := p.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	exists := map[string]bool{}
+	for _, name := range remote {
+		exists[name] = true
+	}
+
+	exported, skipped := 0, 0
+	err = bulk.Decrypt(store, encKey, keys, func(key string, value []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		defer clear(value)
+		target := label + "/" + names[key]
+		if exists[names[key]] && !overwrite {
+			fmt.Printf("- %s exists, skipped (%s)\n", target, key)
+			skipped++
+			return nil
+		}
+		if !dryRun {
+			if err := p.Put(names[key], value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		fmt.Printf("%s %s -> %s\n", output.OK, key, target)
+		exported++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if dryRun {
+		fmt.Printf("Would export %d secrets to %s (%d skipped)\n", exported, label, skipped)
+		return
+	}
+	if c, ok := p.(provider.Committer); ok {
+		if err := c.Commit(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+	fmt.Printf("%s Exported %d secrets to %s (%d skipped)\n", output.OK, exported, label, skipped)
+}
+
+// hashiVault returns the Vault secret at --path on --addr ($VAULT_ADDR),
+// configured from the environment as the vault CLI is: the token from
+// $VAULT_TOKEN or ~/.vault-token, $VAULT_NAMESPACE, $VAULT_CACERT and
+// $VAULT_SKIP_VERIFY. It exits if --path is missing or no token is set.
+func hashiVault(cmd *cobra.Command) *provider.Vault {
+	path, _ := cmd.Flags().GetString("path")
+	if strings.Trim(path, "/") == "" {
+		fmt.Fprintf(os.Stderr, "Error: --path is required, such as secret/myapp\n")
+		exit(1)
+	}
+	addr, _ := cmd.Flags().GetString("addr")
+	if addr == "" {
+		addr = cmp.Or(os.Getenv("VAULT_ADDR"), "https://127.0.0.1:8200")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Error: no Vault token; set $VAULT_TOKEN or run 'vault login'\n")
+		exit(1)
+	}
+
+	config := &tls.Config{}
+	if ca := os.Getenv("VAULT_CACERT"); ca != "" {
+		pool, err := client.LoadCA(ca)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		config.RootCAs = pool
+	}
+	if skip, _ := strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY")); skip {
+		fmt.Fprintf(os.Stderr, "Warning: not verifying Vault's certificate; anyone on the network path can read the secrets\n")
+		config.InsecureSkipVerify = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &provider.Vault{
+		Addr:      addr,
+		Token:     token,
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Path:      strings.Trim(path, "/"),
+		Client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+// importStrategy returns what import does with existing secrets, from
+// --fail, --skip and --overwrite, exiting if more than one is set
+func importStrategy(cmd *cobra.Command) archive.Strategy {
+	strategy := archive.Fail
+	chosen := 0
+	for _, s := range []struct {
+		flag     string
+		strategy archive.Strategy
+	}{{"fail", archive.Fail}, {"skip", archive.Skip}, {"overwrite", archive.Overwrite}} {
+		if on, _ := cmd.Flags().GetBool(s.flag); on {
+			strategy = s.strategy
+			chosen++
+		}
+	}
+	if chosen > 1 {
+		fmt.Fprintf(os.Stderr, "Error: --overwrite, --skip and --fail are mutually exclusive\n")
+		exit(1)
+	}
+	return strategy
+}
+
+// importDotenv stores the variables of the .env file at path, or stdin for
+// -, in one transaction, handling existing secrets by strategy. With
+// --diff nothing is stored.
+func importDotenv(cmd *cobra.Command, path string, strategy archive.Strategy) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to read %s: %v\n", path, err)
+		exit(1)
+	}
+	entries, err := dotenv.Parse(data)
+	clear(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+		exit(1)
+	}
+
+	store, encKey, err := getStoreAndKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+	if diff, _ := cmd.Flags().GetBool("diff"); diff {
+		secrets := make([]provider.Secret, len(entries))
+		for i, e := range entries {
+			secrets[i] = provider.Secret{Key: e.Key, Source: fmt.Sprintf("%s:%d", path, e.Line), Value: []byte(e.Value)}
+		}
+		printImportDiff(cmd, store, encKey, secrets)
+		return
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer tx.Rollback()
+	existing, err := tx.ListSecrets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	exists := map[string]bool{}
+	for _, k := range existing {
+		exists[k] = true
+	}
+
+	actor := localActor(store)
+	var conflicts []string
+	created, overwritten, skipped := 0, 0, 0
+	for _, e := range entries {
+		if exists[e.Key] {
+			switch strategy {
+			case archive.Fail:
+				conflicts = append(conflicts, store.Qualify(e.Key))
+				continue
+			case archive.Skip:
+				skipped++
+				continue
+			}
+		}
+		value := e.Value
+		if _, err := batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: e.Key, Value: &value}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s:%d: %v\n", path, e.Line, err)
+			exit(1)
+		}
+		if exists[e.Key] {
+			overwritten++
+		} else {
+			created++
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d secret(s) already exist: %s\n", len(conflicts), strings.Join(conflicts, ", "))
+		fmt.Fprintf(os.Stderr, "Nothing was imported; keep them with --skip or replace them with --overwrite\n")
+		exit(1)
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	fmt.Printf("%s Imported %d secret(s) from %s\n", output.OK, created+overwritten, path)
+	if overwritten > 0 {
+		fmt.Printf("  %d overwritten\n", overwritten)
+	}
+	if skipped > 0 {
+		fmt.Printf("  %d skipped, already present\n", skipped)
+	}
+}
+
+// exportDotenv writes the secrets of the current vault as a .env file to
+// the file in args, or to stdout
+func exportDotenv(args []string) {
+	store, encKey, err := getStoreAndKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer store.Close()
+
+	keys, err := store.ListSecrets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+		exit(1)
+	}
+	var out bytes.Buffer
+	err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		out.WriteString(dotenv.Line(key, string(decrypted)))
+		clear(decrypted)
+		return nil
+	})
+	defer clear(out.Bytes())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	if len(args) == 0 {
+		os.Stdout.Write(out.Bytes())
+	} else {
+		if err := os.WriteFile(args[0], out.Bytes(), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		fmt.Printf("%s Exported %d secret(s) to %s\n", output.OK, len(keys), args[0])
+	}
+	recordAccess(store, keys)
+}
+
+// runHelper runs the setgid lockbox-helper (or LOCKBOX_HELPER) with args and
+// returns its stdout; its stderr is passed through
+func runHelper(args ...string) ([]byte, error) {
+	helper := os.Getenv("LOCKBOX_HELPER")
+	if helper == "" {
+		path, err := exec.LookPath("lockbox-helper")
+		if err != nil {
+			return nil, fmt.Errorf("lockbox-helper not found in PATH; multi-user mode requires it to be installed")
+		}
+		helper = path
+	}
+
+	cmd := exec.Command(helper, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("lockbox-helper %s failed: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// localActor returns the identity local commands write as: the calling OS
+// user, who administers the store when it owns the database file, is root
+// or holds the admin role
+func localActor(store *db.Store) batch.Actor {
+	id := policy.NewIdentity(uint32(os.Getuid()), uint32(os.Getgid()))
+	owner, ok := multiuser.PathOwner(store.Path())
+	actor := batch.Actor{
+		Owner:    policy.UserSubject(id.UID),
+		Subjects: id.Subjects(),
+		Admin:    os.Getuid() == 0 || !ok || owner == os.Getuid(),
+	}
+	if !actor.Admin {
+		actor.Admin = localGranted(store, actor.Subjects, rbac.Admin)
+	}
+	return actor
+}
+
+// localGranted reports whether a role bound on every key grants subjects
+// perm. Failing to load the roles grants nothing.
+func localGranted(store *db.Store, subjects []string, perm rbac.Permission) bool {
+	e, err := rbac.Load(store)
+	return err == nil && e.Granted(subjects, perm)
+}
+
+// canAudit reports whether the local user may read the audit and access
+// logs: admins and holders of a role with the audit permission
+func canAudit(store *db.Store) bool {
+	actor := localActor(store)
+	return actor.Admin || localGranted(store, actor.Subjects, rbac.Audit)
+}
+
+// quotaText describes a token quota of max units, where 0 means no limit
+func quotaText(max int, units string) string {
+	if max == 0 {
+		return "unlimited " + units
+	}
+	return fmt.Sprintf("%d %s", max, units)
+}
+
+// roleTarget parses the subject flags and optional pattern argument of
+// 'role assign' and 'role unassign', exiting on invalid input
+func roleTarget(cmd *cobra.Command, args []string) (string, string) {
+	username, _ := cmd.Flags().GetString("user")
+	group, _ := cmd.Flags().GetString("group")
+	tokenName, _ := cmd.Flags().GetString("token")
+	claim, _ := cmd.Flags().GetString("claim")
+
+	subject, err := policy.ParseSubject(username, group, tokenName, claim)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	pattern := "*"
+	if len(args) > 1 {
+		pattern = args[1]
+	}
+	if err := policy.ValidatePattern(pattern); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	return subject, pattern
+}
+
+// recordAccess logs that the local user read keys. Failing to log does
+// not fail the read.
+// snapshotValues decrypts the values held by the snapshot called name
+func snapshotValues(store *db.Store, encKey []byte, name string) (map[string]string, error) {
+	_, secrets, err := store.GetSnapshot(name)
+	if err == db.ErrNotFound {
+		return nil, fmt.Errorf("no snapshot '%s'", name)
+	} else if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(secrets))
+	for _, sec := range secrets {
+		decrypted, err := crypto.Decrypt(sec.Value, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt '%s' in snapshot '%s': %w", sec.Key, name, err)
+		}
+		values[sec.Key] = string(decrypted)
+	}
+	return values, nil
+}
+
+// helpReference collects the command tree, the HTTP API and the README for
+// 'lockbox help --web'
+func helpReference(root *cobra.Command) helpweb.Reference {
+	ref := helpweb.Reference{
+		GlobalFlags: helpFlags(root.PersistentFlags()),
+		Endpoints:   server.Endpoints,
+		Recipes:     helpweb.Recipes(readme),
+	}
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for _, c := range cmd.Commands() {
+			if !c.IsAvailableCommand() {
+				continue
+			}
+			ref.Commands = append(ref.Commands, helpweb.Command{
+				Path:  c.CommandPath(),
+				Usage: c.UseLine(),
+				Short: c.Short,
+				Long:  c.Long,
+				Flags: helpFlags(c.LocalNonPersistentFlags()),
+			})
+			walk(c)
+		}
+	}
+	walk(root)
+	return ref
+}
+
+// helpFlags lists the visible flags of fs
+func helpFlags(fs *pflag.FlagSet) []helpweb.Flag {
+	var flags []helpweb.Flag
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden {
+			return
+		}
+		flag := helpweb.Flag{Name: f.Name, Shorthand: f.Shorthand, Type: f.Value.Type(), Default: f.DefValue, Usage: f.Usage}
+		// Zero values go unmentioned, as in --help
+		switch flag.Default {
+		case "0", "[]", "0s", "false":
+			flag.Default = ""
+		}
+		flags = append(flags, flag)
+	})
+	return flags
+}
+
+// completeKeys returns a shell completion function offering the keys of
+// the current store and vault, for commands taking up to max keys or any
+// number for 0. The store is opened without its key, so completion never
+// prompts, and is not created if missing.
+func completeKeys(max int) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]cobra.Completion, cobra.ShellCompDirective) {
+		if max > 0 && len(args) >= max {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		// Persistent hooks do not run while completing
+		if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+			os.Setenv("LOCKBOX_PROFILE", profile)
+		}
+		vault := os.Getenv("LOCKBOX_VAULT")
+		if v, _ := cmd.Flags().GetString("vault"); v != "" {
+			vault = v
+		}
+		if vault == db.DefaultVault {
+			vault = ""
+		}
+
+		dbPath, err := db.ResolvePath()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		store, err := db.OpenStore(dbPath)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		defer store.Close()
+		keys, err := store.InVault(vault).ListSecrets()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+
+		var completions []cobra.Completion
+		for _, key := range keys {
+			if strings.HasPrefix(key, toComplete) && !slices.Contains(args, key) {
+				completions = append(completions, key)
+			}
+		}
+		return completions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// badValueFlags returns --strict and --skip-bad of env and run, exiting if
+// both are set
+func badValueFlags(cmd *cobra.Command) (strict, skipBad bool) {
+	strict, _ = cmd.Flags().GetBool("strict")
+	skipBad, _ = cmd.Flags().GetBool("skip-bad")
+	if strict && skipBad {
+		fmt.Fprintf(os.Stderr, "Error: --strict and --skip-bad are mutually exclusive\n")
+		exit(1)
+	}
+	return strict, skipBad
+}
+
+// checkValues decrypts every value of keys before anything is emitted, for
+// --strict, exiting with every key that fails. outcome says what did not
+// happen, such as "nothing was exported".
+func checkValues(store *db.Store, encKey []byte, keys []string, outcome string) {
+	failures := bulk.Check(store, encKey, keys)
+	if len(failures) == 0 {
+		return
+	}
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", output.Fail, f.Key, f.Err)
+	}
+	fmt.Fprintf(os.Stderr, "Error: %d of %d secret(s) cannot be decrypted; %s\n", len(failures), len(keys), outcome)
+	exit(1)
+}
+
+// reportSkipped warns about the keys --skip-bad left out, returning the
+// rest of keys
+func reportSkipped(keys, skipped []string) []string {
+	if len(skipped) == 0 {
+		return keys
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %d secret(s) skipped: %s\n", len(skipped), strings.Join(skipped, ", "))
+	return slices.DeleteFunc(slices.Clone(keys), func(k string) bool { return slices.Contains(skipped, k) })
+}
+
+func recordAccess(store *db.Store, keys []string) {
+	if err := store.RecordAccess("cli", localActor(store).Owner, keys); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
+
+// parseOwner resolves an --owner value: a policy subject such as gid:100
+// or token:ci, or a user name or UID
+func parseOwner(owner string) (string, error) {
+	if policy.ValidateSubject(owner) == nil {
+		return owner, nil
+	}
+	return policy.ParseSubject(owner, "", "", "")
+}
+
+// isPorcelain reports whether --porcelain output was requested
+func isPorcelain(cmd *cobra.Command) bool {
+	version, _ := cmd.Flags().GetString("porcelain")
+	return version != ""
+}
+
+// formatBytes formats a size in bytes for people
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// describeGC summarizes what a garbage collection pruned
+func describeGC(r gc.Result) string {
+	return fmt.Sprintf("reclaimed %s: %d audit events, %d reads, %d versions, %d orphaned rows", formatBytes(r.Reclaimed), r.AuditEvents, r.Accesses, r.Versions, r.Orphans)
+}
+
+// outputFormat returns the format --output asks for
+func outputFormat(cmd *cobra.Command) string {
+	format, _ := cmd.Flags().GetString("output")
+	return format
+}
+
+// keyFilter returns the filter --only, --prefix and --exclude ask for
+func keyFilter(cmd *cobra.Command) selector.Filter {
+	only, _ := cmd.Flags().GetStringSlice("only")
+	prefixes, _ := cmd.Flags().GetStringSlice("prefix")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	return selector.Filter{Only: only, Prefixes: prefixes, Exclude: exclude}
+}
+
+// filterValues returns the secrets of values that filter keeps, and their
+// keys in sorted order
+func filterValues(values map[string]string, filter selector.Filter) (map[string]string, []string, error) {
+	keys, err := filter.Apply(slices.Sorted(maps.Keys(values)))
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := make(map[string]string, len(keys))
+	for _, key := range keys {
+		kept[key] = values[key]
+	}
+	return kept, keys, nil
+}
+
+// writeOutput prints v in format, json or yaml
+func writeOutput(format string, v any) {
+	if err := output.Write(os.Stdout, format, v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write output: %v\n", err)
+		exit(1)
+	}
+}
+
+// setupStorePath returns the store of the profile called name in a setup,
+// where setup.DefaultProfile is the default store
+func setupStorePath(name string) (string, error) {
+	if name == setup.DefaultProfile {
+		return db.DefaultPath()
+	}
+	return db.ProfilePath(name)
+}
+
+// credentialsPath returns the file 'lockbox login' saves tokens to, next
+// to the local store
+func credentialsPath() (string, error) {
+	dbPath, err := db.ResolvePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "credentials.json"), nil
+}
+
+// remoteOptions returns client options for remote, authenticating with
+// LOCKBOX_TOKEN (and LOCKBOX_REFRESH_TOKEN) or else a token saved by
+// 'lockbox login', which is saved again whenever it is refreshed
+func remoteOptions(remote string) client.Options {
+	opts := remoteTLS()
+	if t := os.Getenv("LOCKBOX_TOKEN"); t != "" {
+		opts.Token, opts.RefreshToken = t, os.Getenv("LOCKBOX_REFRESH_TOKEN")
+		return opts
+	}
+	path, err := credentialsPath()
+	if err != nil {
+		return opts
+	}
+	cred, ok := client.LoadCredential(path, remote)
+	if !ok {
+		return opts
+	}
+	opts.Token, opts.RefreshToken = cred.Token, cred.RefreshToken
+	opts.OnRefresh = func(cred client.Credential) {
+		if err := client.SaveCredential(path, remote, cred); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	return opts
+}
+
+// remoteTLS returns client options verifying https remotes against --ca
+// ($LOCKBOX_CA), or not at all with --insecure ($LOCKBOX_INSECURE=1), and
+// responses against --verify-key ($LOCKBOX_VERIFY_KEY), exiting if the CA
+// file or key is unusable. --h2c ($LOCKBOX_H2C=1) talks HTTP/2 to plain
+// http remotes.
+func remoteTLS() client.Options {
+	opts := client.Options{H2C: os.Getenv("LOCKBOX_H2C") == "1"}
+	if hexKey := os.Getenv("LOCKBOX_VERIFY_KEY"); hexKey != "" {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			fmt.Fprintf(os.Stderr, "Error: invalid --verify-key; expected the hex Ed25519 key shown by 'lockbox serve --sign'\n")
+			exit(1)
+		}
+		opts.Verifier = &signing.Verifier{Name: bundle.Fingerprint(key), Key: key}
+	}
+	if ca := os.Getenv("LOCKBOX_CA"); ca != "" {
+		pool, err := client.LoadCA(ca)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		opts.RootCAs = pool
+	}
+	if os.Getenv("LOCKBOX_INSECURE") == "1" {
+		fmt.Fprintf(os.Stderr, "Warning: not verifying the server's certificate; anyone on the network path can read the secrets\n")
+		opts.Insecure = true
+	}
+	return opts
+}
+
+func main() {
+	if aws := os.Getenv("LOCKBOX_AWS"); aws != "" {
+		rotation.AWSCLI = aws
+		worm.AWSCLI = aws
+	}
+	if secretTool := os.Getenv("LOCKBOX_SECRET_TOOL"); secretTool != "" {
+		keysource.SecretTool = secretTool
+	}
+	if action := os.Getenv("LOCKBOX_POLKIT_ACTION"); action != "" {
+		presence.PolkitAction = action
+	}
+
+	rootCmd := &cobra.Command{
+		Use:   "lockbox",
+		Short: "Lockbox - A secure secret management CLI",
+		Long:  `Lockbox is a command-line tool for securely storing and managing secrets.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+				os.Setenv("LOCKBOX_PROFILE", profile)
+			}
+			if inWorkspace, _ := cmd.Flags().GetBool("workspace"); inWorkspace {
+				os.Setenv("LOCKBOX_WORKSPACE", "1")
+			}
+			if vault, _ := cmd.Flags().GetString("vault"); vault != "" {
+				os.Setenv("LOCKBOX_VAULT", vault)
+			}
+			if ca, _ := cmd.Flags().GetString("ca"); ca != "" {
+				os.Setenv("LOCKBOX_CA", ca)
+			}
+			if insecure, _ := cmd.Flags().GetBool("insecure"); insecure {
+				os.Setenv("LOCKBOX_INSECURE", "1")
+			}
+			if h2c, _ := cmd.Flags().GetBool("h2c"); h2c {
+				os.Setenv("LOCKBOX_H2C", "1")
+			}
+			if plain, _ := cmd.Flags().GetBool("plain"); plain {
+				os.Setenv("LOCKBOX_PLAIN", "1")
+			}
+			if key, _ := cmd.Flags().GetString("verify-key"); key != "" {
+				os.Setenv("LOCKBOX_VERIFY_KEY", key)
+			}
+			if version, _ := cmd.Flags().GetString("porcelain"); version != "" {
+				if err := porcelain.Validate(version); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if format := outputFormat(cmd); format != output.Text {
+				if err := output.Validate(format); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if isPorcelain(cmd) {
+					fmt.Fprintf(os.Stderr, "Error: --output cannot be combined with --porcelain\n")
+					exit(1)
+				}
+			}
+
+			// Report command, duration and result to a pushgateway on exit
+			gateway, _ := cmd.Flags().GetString("push-metrics")
+			if gateway == "" {
+				return
+			}
+
+			start := time.Now()
+			command := strings.ReplaceAll(strings.TrimPrefix(cmd.CommandPath(), "lockbox "), " ", "_")
+			instance, _ := os.Hostname()
+			exitHooks = append(exitHooks, func(code int) {
+				run := metrics.Run{
+					Command:  command,
+					Instance: instance,
+					Duration: time.Since(start),
+					ExitCode: code,
+					Finished: time.Now(),
+				}
+				if err := metrics.Push(gateway, run); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+			})
+		},
+	}
+
+	// Add --push-metrics flag to all commands
+	rootCmd.PersistentFlags().String("push-metrics", "", "Pushgateway URL to report command duration and result to (e.g., localhost:9091)")
+
+	// Add --profile flag to all commands
+	rootCmd.PersistentFlags().String("profile", "", "Use the store of a named profile, such as staging or prod (default $LOCKBOX_PROFILE)")
+
+	// Add --workspace flag to all commands
+	rootCmd.PersistentFlags().Bool("workspace", false, "Use the store of the .lockbox workspace at or above the current directory (default $LOCKBOX_WORKSPACE=1)")
+
+	// Add --vault flag to all commands
+	rootCmd.PersistentFlags().String("vault", "", "Use a named vault of the store, such as prod (default $LOCKBOX_VAULT, else the default vault)")
+
+	// Add --ca and --insecure flags to all commands, for https remotes
+	rootCmd.PersistentFlags().String("ca", "", "PEM file of the CA or self-signed certificate to verify https remotes with (default $LOCKBOX_CA)")
+	rootCmd.PersistentFlags().Bool("insecure", false, "Do not verify the certificate of https remotes (unsafe outside testing)")
+
+	// Add --h2c flag to all commands, for plain http remotes
+	rootCmd.PersistentFlags().Bool("h2c", false, "Talk HTTP/2 with prior knowledge to plain http remotes, multiplexing bulk fetches over one connection (default $LOCKBOX_H2C=1)")
+
+	// Add --verify-key flag to all commands, for servers signing responses
+	rootCmd.PersistentFlags().String("verify-key", "", "Hex Ed25519 key that remote responses must be signed by, from 'lockbox serve --sign' (default $LOCKBOX_VERIFY_KEY)")
+
+	// Add --porcelain flag to all commands
+	rootCmd.PersistentFlags().String("porcelain", "", "Print stable tab-separated records for scripts (format: v1)")
+	rootCmd.PersistentFlags().Lookup("porcelain").NoOptDefVal = porcelain.V1
+
+	// Add --output flag to all commands
+	rootCmd.PersistentFlags().StringP("output", "o", output.Text, "Output format of list, get and env: text, json or yaml")
+
+	// Add --plain flag to all commands
+	rootCmd.PersistentFlags().Bool("plain", false, "Print ASCII words instead of symbols and no colors, for screen readers and dumb terminals (default $LOCKBOX_PLAIN)")
+
+	// init command
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Initialize Lockbox",
+		Long:  `Initialize Lockbox by creating the store and generating an encryption key.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			// In multi-user mode the helper creates the caller's isolated directory
+			system, _ := cmd.Flags().GetBool("system")
+			backend, _ := cmd.Flags().GetString("key-backend")
+			if withPassphrase, _ := cmd.Flags().GetBool("passphrase"); withPassphrase {
+				backend = keysource.Passphrase
+			}
+			if !slices.Contains(keysource.Backends, backend) {
+				fmt.Fprintf(os.Stderr, "Error: unknown key backend '%s' (supported: %s)\n", backend, strings.Join(keysource.Backends, ", "))
+				exit(1)
+			}
+			setTPMPCRs(cmd)
+			setEnclaveConfirm(cmd)
+			backend = enclaveFallback(backend)
+			if system && os.Getenv("LOCKBOX_DB_PATH") == "" {
+				if _, err := runHelper("provision"); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			// Create store
+			store, err := db.NewStore()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Check if key already exists
+			_, err = keysource.Backend(store)
+			if err == nil {
+				fmt.Println("Lockbox is already initialized. Encryption key already exists.")
+				return
+			}
+			if err != keysource.ErrNotInitialized {
+				fmt.Fprintf(os.Stderr, "Error: failed to check for existing key: %v\n", err)
+				exit(1)
+			}
+
+			// Generate the key and store it as a hex string, or wherever
+			// --key-backend says
+			if err := initKey(store, backend); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Println(output.OK, "Lockbox initialized successfully")
+		},
+	}
+
+	initCmd.Flags().Bool("system", false, "Create the store under the system directory (multi-user mode, requires lockbox-helper)")
+	initCmd.Flags().String("key-backend", keysource.Store, "Where to keep the encryption key: store, passphrase, keychain, tpm or enclave")
+	initCmd.Flags().String("tpm-pcrs", "", "PCRs to bind a key sealed to the TPM to, such as 7 or 0+7 (default: none)")
+	initCmd.Flags().String("enclave-confirm", "", "How often a key kept in the Secure Enclave asks for Touch ID: never, always, or a duration of up to 5m within which unlocking the Mac counts (default: never)")
+	initCmd.Flags().Bool("passphrase", false, "Protect the encryption key with a passphrase asked for on use (same as --key-backend passphrase)")
+
+	// passphrase command - Wrap the encryption key with a passphrase
+	passphraseCmd := &cobra.Command{
+		Use:   "passphrase",
+		Short: "Protect the encryption key with a passphrase",
+		Long: `By default the encryption key is kept in the store next to the secrets it
+encrypts. With a passphrase the key is stored wrapped, and every command
+that decrypts asks for the passphrase unless 'lockbox unlock' cached the key
+or LOCKBOX_PASSPHRASE is set:
+  lockbox passphrase set
+  lockbox unlock --for 1h
+  lockbox lock
+  lockbox passphrase remove
+The wrapping key is derived with Argon2id. Keys wrapped with PBKDF2-SHA256
+by earlier versions still unlock; 'passphrase set' rewraps them. A
+forgotten passphrase cannot be recovered except from a recovery kit or
+escrow.`,
+	}
+
+	passphraseSetCmd := &cobra.Command{
+		Use:   "set",
+		Short: "Set or change the passphrase",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin of the store can set its passphrase\n")
+				exit(1)
+			}
+
+			from, err := moveKey(store, encKey, actor.Owner, keysource.Passphrase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Println(output.OK, "Encryption key is protected by the passphrase")
+			if from == keysource.Store {
+				fmt.Println("  Backups and copies made before now still hold the plain key")
+			}
+		},
+	}
+
+	passphraseRemoveCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Store the encryption key without a passphrase again",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin of the store can remove its passphrase\n")
+				exit(1)
+			}
+			if !isProtected(store) {
+				fmt.Println("Store has no passphrase")
+				return
+			}
+
+			if _, err := moveKey(store, encKey, actor.Owner, keysource.Store); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Println(output.OK, "Removed the passphrase; the encryption key is stored in the clear")
+		},
+	}
+
+	passphraseCmd.AddCommand(passphraseSetCmd, passphraseRemoveCmd)
+
+	// key-backend command - Show or change where the key is kept
+	keyBackendCmd := &cobra.Command{
+		Use:   "key-backend [store|passphrase|keychain|tpm|enclave]",
+		Short: "Show or change where the encryption key is kept",
+		Long: `Show where the store's encryption key is kept, or move it:
+  store       in the clear in the store's config (the default)
+  passphrase  in the store, wrapped with a passphrase ('lockbox passphrase')
+  keychain    in the OS keychain: macOS Keychain, the Secret Service on
+              Linux (through secret-tool) or the Windows Credential Manager
+  tpm         in the store, sealed to this machine's TPM 2.0 through
+              systemd-creds; --tpm-pcrs also binds it to the boot state
+  enclave     in the store, encrypted to a key in this Mac's Secure
+              Enclave; --enclave-confirm asks for Touch ID to unlock it
+With the keychain backend the store only names the keychain entry, so a
+copy of the database file alone does not decrypt anything. With the tpm
+backend the store only opens on this machine, and with --tpm-pcrs only
+while it boots the same firmware and bootloader: move the key to another
+backend before updating either, and seal it again afterwards. 'lockbox
+key-backend tpm --tpm-pcrs ...' reseals a sealed key to other PCRs.
+With the enclave backend the store only opens on this Mac; on a machine
+without a Secure Enclave the key goes to the keychain instead. 'lockbox
+key-backend enclave --enclave-confirm ...' changes how often Touch ID is
+asked for.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			current, err := keysource.Backend(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(args) == 0 {
+				fmt.Println(current)
+				return
+			}
+
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin of the store can move its key\n")
+				exit(1)
+			}
+			setTPMPCRs(cmd)
+			setEnclaveConfirm(cmd)
+			target := enclaveFallback(args[0])
+			// Sealing again binds the key to the PCRs as they are now
+			if target == keysource.TPM && current == keysource.TPM && cmd.Flags().Changed("tpm-pcrs") {
+				if err := keysource.Save(store, encKey, keysource.TPM, nil); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				store.Audit(actor.Owner, "key-resealed", cmp.Or(keysource.TPMPCRs, "no PCRs"))
+				fmt.Printf("%s Resealed the encryption key to the TPM (PCRs: %s)\n", output.OK, cmp.Or(keysource.TPMPCRs, "none"))
+				return
+			}
+			// Access control is fixed when an enclave key is made, so a
+			// new one is made
+			if target == keysource.Enclave && current == keysource.Enclave && cmd.Flags().Changed("enclave-confirm") {
+				if err := keysource.Save(store, encKey, keysource.Enclave, nil); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				confirm := cmp.Or(keysource.EnclaveConfirm, "never")
+				store.Audit(actor.Owner, "key-confirm-changed", confirm)
+				fmt.Printf("%s The encryption key now asks for Touch ID: %s\n", output.OK, confirm)
+				return
+			}
+			if target == current {
+				fmt.Printf("The key is already kept in the %s backend\n", current)
+				return
+			}
+			if _, err := moveKey(store, encKey, actor.Owner, target); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Moved the encryption key from the %s backend to the %s backend\n", output.OK, current, target)
+			if current == keysource.Store {
+				fmt.Println("  Backups and copies made before now still hold the plain key")
+			}
+		},
+	}
+	keyBackendCmd.Flags().String("tpm-pcrs", "", "PCRs to bind a key sealed to the TPM to, such as 7 or 0+7 (default: none)")
+	keyBackendCmd.Flags().String("enclave-confirm", "", "How often a key kept in the Secure Enclave asks for Touch ID: never, always, or a duration of up to 5m within which unlocking the Mac counts (default: never)")
+
+	// unlock command - Cache the unwrapped key for a while
+	unlockCmd := &cobra.Command{
+		Use:   "unlock [--for 15m]",
+		Short: "Unlock a passphrase protected store for a while",
+		Long: `Ask for the store's passphrase once and keep the unwrapped key in the
+kernel keyring of the current user until --for passes or 'lockbox lock'.
+The key never touches the disk. Only supported on Linux.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ttl, _ := cmd.Flags().GetDuration("for")
+			if ttl < time.Second {
+				fmt.Fprintf(os.Stderr, "Error: --for must be at least 1s\n")
+				exit(1)
+			}
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !isProtected(store) {
+				fmt.Println("Store has no passphrase; nothing to unlock")
+				return
+			}
+			if err := keycache.Put(store.Path(), encKey, ttl); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to cache key: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Unlocked for %s\n", output.OK, ttl)
+		},
+	}
+	unlockCmd.Flags().Duration("for", 15*time.Minute, "How long the store stays unlocked")
+
+	// lock command - Forget the cached key
+	lockCmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Lock a store unlocked with 'lockbox unlock'",
+		Long: `Forget the key cached by 'lockbox unlock' or held by 'lockbox agent', so the
+next command asks for the passphrase again. A running 'lockbox serve' keeps
+its key until it stops.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbPath, err := db.ResolvePath()
+			if err == nil {
+				err = keycache.Drop(dbPath)
+			}
+			if err == nil {
+				if err = agent.Drop(dbPath); err == agent.ErrNotRunning {
+					err = nil
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Println(output.OK, "Locked")
+		},
+	}
+
+	// agent command - Hold unwrapped keys in memory for later commands
+	agentCmd := &cobra.Command{
+		Use:   "agent [--idle 15m]",
+		Short: "Keep unlocked keys in memory so commands don't ask again",
+		Long: `Run a per-user agent, like ssh-agent, holding the unwrapped keys of
+passphrase protected stores in memory. After the agent starts, the first
+command to ask for a store's passphrase hands the key to it, and later
+get, run, env and other commands fetch it from the agent instead of asking.
+
+The agent listens on a unix socket in $XDG_RUNTIME_DIR, else in ~/.lockbox
+($LOCKBOX_AGENT_SOCK overrides it), that only the user can open. Keys are
+forgotten when unused for --idle, on 'lockbox agent lock' or SIGHUP, and
+when the agent stops. Unlike 'lockbox unlock' it works on every platform.
+  lockbox agent &
+  lockbox agent lock`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			idle, _ := cmd.Flags().GetDuration("idle")
+			if idle < time.Second {
+				fmt.Fprintf(os.Stderr, "Error: --idle must be at least 1s\n")
+				exit(1)
+			}
+			socket, err := agent.SocketPath()
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(socket), 0700)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if _, err := agent.Lock(); err != agent.ErrNotRunning {
+				fmt.Fprintf(os.Stderr, "Error: an agent is already running on %s\n", socket)
+				exit(1)
+			}
+			ln, err := server.ListenUnix(socket, 0600)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			a := agent.New(idle)
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			go func() {
+				for sig := range signals {
+					a.Lock()
+					if sig != syscall.SIGHUP {
+						ln.Close()
+						return
+					}
+				}
+			}()
+
+			fmt.Printf("%s Agent listening on %s; keys are forgotten after %s unused\n", output.OK, socket, idle)
+			if err := a.Serve(ln); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+	agentCmd.Flags().Duration("idle", 15*time.Minute, "Forget a key after this long without use")
+
+	agentLockCmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Make the agent forget every key",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			n, err := agent.Lock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Locked; the agent forgot the keys of %d store(s)\n", output.OK, n)
+		},
+	}
+	agentUnlockCmd := &cobra.Command{
+		Use:   "unlock [--from-pam-stdin]",
+		Short: "Hand the store's key to the running agent",
+		Long: `Unwrap the key of a passphrase protected store and hand it to the running
+agent, so later commands in the session need no passphrase.
+
+--from-pam-stdin reads the passphrase from stdin as pam_exec passes the
+login password with expose_authtok, up to a NUL byte or the end, and
+never prompts. With the same store passphrase as the login password an
+agent already running, such as one started by a systemd user unit or on
+screen unlock, is unlocked at login:
+  auth optional pam_exec.so expose_authtok seteuid quiet /usr/local/bin/lockbox agent unlock --from-pam-stdin
+Under PAM, HOME and XDG_RUNTIME_DIR are taken from $PAM_USER when unset,
+so the store and the agent's socket are found as in the session.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fromPAM, _ := cmd.Flags().GetBool("from-pam-stdin")
+			var passphrase string
+			var err error
+			if fromPAM {
+				pamEnvironment()
+				data, rerr := io.ReadAll(io.LimitReader(os.Stdin, 4096))
+				if rerr != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to read the passphrase: %v\n", rerr)
+					exit(1)
+				}
+				if i := bytes.IndexByte(data, 0); i >= 0 {
+					data = data[:i]
+				}
+				passphrase = strings.TrimRight(string(data), "\r\n")
+				clear(data)
+			}
+
+			dbPath, err := db.ResolvePath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if _, err := os.Stat(dbPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: no store at %s\n", dbPath)
+				exit(1)
+			}
+			store, err := db.OpenStore(dbPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !isProtected(store) {
+				fmt.Println("Store has no passphrase; nothing to unlock")
+				return
+			}
+			if _, err := agent.Get(store.Path()); err == agent.ErrNotRunning {
+				fmt.Fprintf(os.Stderr, "Error: %v; start it with 'lockbox agent'\n", err)
+				exit(1)
+			}
+			if !fromPAM {
+				if passphrase, err = readPassphrase("Passphrase: "); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			key, err := keysource.Unwrap(store, passphrase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer clear(key)
+			if err := selfTest(store, key); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: startup self-test failed: %v\n", err)
+				exit(1)
+			}
+			if err := agent.Add(store.Path(), key); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Unlocked %s in the agent\n", output.OK, store.Path())
+		},
+	}
+	agentUnlockCmd.Flags().Bool("from-pam-stdin", false, "Read the passphrase from stdin as passed by pam_exec expose_authtok, never prompting")
+	agentCmd.AddCommand(agentLockCmd, agentUnlockCmd)
+
+	// set command
+	setCmd := &cobra.Command{
+		Use:   "set KEY [VALUE | -]",
+		Short: "Set a secret",
+		Long: `Store a secret with the given key and value.
+
+Values given as arguments end up in shell history and are visible to
+other users in ps. With - or --stdin the value is read from stdin
+instead, less one trailing newline; without a value it is asked for on
+the terminal without echo. --file stores a file's contents unchanged, so
+keys, certificates and binary keystores round-trip through 'get --out':
+  pass show api | lockbox set API_KEY -
+  lockbox set API_KEY
+  lockbox set SSH_KEY --file ~/.ssh/id_ed25519
+
+New secrets are owned by the user creating them, or by --owner: a user,
+or a subject such as gid:100 or token:ci. Only the owner, or an admin of
+the store (root or the user owning the database file), may change or
+delete an owned secret.
+
+--tag and --description label the secret for 'lockbox list --tag'. Given
+tags replace the secret's tags (--tag '' removes them all); without them,
+overwriting a value keeps its tags and description:
+  lockbox set DB_PASSWORD --tag db --tag prod --description "Primary database"
+
+--ttl or --expires makes the secret expire. Expired secrets are kept, but
+env, run, get and the server treat them as missing and 'lockbox list
+--expired' shows them until 'lockbox prune' deletes them. Writing the
+secret again without either makes it permanent:
+  lockbox set PREVIEW_TOKEN --ttl 24h
+  lockbox set CONTRACTOR_KEY --expires 2025-01-01
+
+With --remote, the secret is set on a lockbox server instead, which needs
+the write permission on the key:
+  lockbox set API_KEY sk-123 --remote localhost:8100`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+			value, err := secretValue(cmd, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if remoteFlag, _ := cmd.Flags().GetString("remote"); remoteFlag != "" {
+				for _, flag := range []string{"owner", "tag", "description", "ttl", "expires"} {
+					if cmd.Flags().Changed(flag) {
+						fmt.Fprintf(os.Stderr, "Error: --%s cannot be used with --remote\n", flag)
+						exit(1)
+					}
+				}
+				remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+				_, err := remote.SetSecret(key, value)
+				remote.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "secret-set", key)
+					return
+				}
+				fmt.Printf("%s Secret '%s' set on %s\n", output.OK, key, remoteFlag)
+				return
+			}
+
+			var owner string
+			if o, _ := cmd.Flags().GetString("owner"); o != "" {
+				var err error
+				if owner, err = parseOwner(o); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			set := batch.Command{Op: "set", Key: key, Value: &value, Owner: owner}
+			if cmd.Flags().Changed("tag") {
+				tags, _ := cmd.Flags().GetStringArray("tag")
+				set.Tags = slices.DeleteFunc(tags, func(tag string) bool { return tag == "" })
+			}
+			if cmd.Flags().Changed("description") {
+				description, _ := cmd.Flags().GetString("description")
+				set.Description = &description
+			}
+			if set.Expires, err = secretExpiry(cmd, time.Now()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Encrypt and store the value; identical values share one
+			// ciphertext blob
+			if _, err := batch.Execute(store, encKey, localActor(store), set); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "secret-set", key)
+				return
+			}
+			fmt.Printf("%s Secret '%s' set successfully\n", output.OK, key)
+		},
+	}
+	setCmd.Flags().String("owner", "", "Owner of the secret: a user, or a subject such as gid:100 (default: you)")
+	setCmd.Flags().StringP("remote", "r", "", "Set the secret on a remote server instead of the local store")
+	setCmd.Flags().Bool("stdin", false, "Read the value from stdin, like a VALUE of -")
+	setCmd.Flags().String("file", "", "Read the value from a file, byte for byte, e.g. a private key or keystore")
+	setCmd.Flags().StringArray("tag", nil, "Tag the secret, e.g. prod; repeat for more, replacing its tags")
+	setCmd.Flags().String("description", "", "Describe the secret")
+	setCmd.Flags().String("ttl", "", "Expire the secret after this long, e.g. 24h or 30d")
+	setCmd.Flags().String("expires", "", "Expire the secret at this date or RFC 3339 time, e.g. 2025-01-01")
+
+	// edit command - Edit a secret in the user's editor
+	editCmd := &cobra.Command{
+		Use:   "edit KEY",
+		Short: "Edit a secret in your editor",
+		Long: `Open a secret in $VISUAL or $EDITOR and store it again once saved, for
+multiline values such as private keys and JSON service accounts. The
+value is written to a private temporary file, in memory-backed /dev/shm
+where available, which is overwritten and removed when the editor exits:
+  lockbox edit TLS_KEY
+  EDITOR="code --wait" lockbox edit GCP_SERVICE_ACCOUNT
+The secret keeps its owner, tags, description and expiry. A newline the
+editor adds at the end is dropped unless the value ended with one.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeKeys(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			keys, err = selector.Resolve(keys, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(keys) > 1 {
+				fmt.Fprintf(os.Stderr, "Error: %d secrets selected; edit one at a time\n", len(keys))
+				exit(1)
+			}
+			key := keys[0]
+			if err := confirmReads(store, keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			encrypted, err := store.GetSecret(key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to get secret: %v\n", err)
+				exit(1)
+			}
+			value, err := crypto.Decrypt(encrypted, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to decrypt secret: %v\n", err)
+				exit(1)
+			}
+			recordAccess(store, keys)
+
+			edited, err := editor.Edit(value, "")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if !bytes.HasSuffix(value, []byte("\n")) {
+				edited = bytes.TrimSuffix(edited, []byte("\n"))
+			}
+			if bytes.Equal(edited, value) {
+				fmt.Println("Secret unchanged")
+				return
+			}
+			if len(edited) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: value is empty; nothing saved\n")
+				exit(1)
+			}
+
+			// Setting a value makes it permanent unless given its expiry
+			expires, err := store.SecretExpiry(key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			updated := string(edited)
+			if _, err := batch.Execute(store, encKey, localActor(store), batch.Command{Op: "set", Key: key, Value: &updated, Expires: expires}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "secret-set", key)
+				return
+			}
+			fmt.Printf("%s Secret '%s' saved\n", output.OK, key)
+		},
+	}
+
+	// generate command - Store a random value without typing it
+	generateCmd := &cobra.Command{
+		Use:   "generate KEY [--length N] [--charset alnum|hex|base64] [--symbols]",
+		Short: "Store a randomly generated secret",
+		Long: `Generate a random value and store it under KEY, so API tokens and
+passwords are provisioned without ever being typed. Characters are drawn
+uniformly from --charset: letters and digits (alnum), lowercase hex, or
+URL-safe base64. --symbols adds punctuation that needs no escaping in
+double quotes, #%+,-./:=?@^_~, and ensures the value has at least one.
+The value is only printed with --print, once:
+  lockbox generate DB_PASSWORD --length 24 --symbols
+  lockbox generate WEBHOOK_SECRET --charset hex --length 64 --print
+An existing secret is only replaced with --force.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+			length, _ := cmd.Flags().GetInt("length")
+			charset, _ := cmd.Flags().GetString("charset")
+			symbols, _ := cmd.Flags().GetBool("symbols")
+			printValue, _ := cmd.Flags().GetBool("print")
+			force, _ := cmd.Flags().GetBool("force")
+
+			chars, ok := rotation.Charsets[charset]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: unknown charset '%s' (supported: alnum, hex, base64)\n", charset)
+				exit(1)
+			}
+			if symbols {
+				if charset != "alnum" {
+					fmt.Fprintf(os.Stderr, "Error: --symbols only applies to --charset alnum\n")
+					exit(1)
+				}
+				chars += rotation.Symbols
+			}
+			if length < 1 || length > 4096 {
+				fmt.Fprintf(os.Stderr, "Error: --length must be between 1 and 4096\n")
+				exit(1)
+			}
+
+			var owner string
+			if o, _ := cmd.Flags().GetString("owner"); o != "" {
+				var err error
+				if owner, err = parseOwner(o); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if _, err := store.GetSecret(key); err == nil && !force {
+				fmt.Fprintf(os.Stderr, "Error: secret '%s' already exists; use --force to replace it\n", key)
+				exit(1)
+			} else if err != nil && err != db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: failed to get secret: %v\n", err)
+				exit(1)
+			}
+
+			var value []byte
+			for value == nil || symbols && !bytes.ContainsAny(value, rotation.Symbols) {
+				if value, err = rotation.Random(length, chars); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			generated := string(value)
+			if _, err := batch.Execute(store, encKey, localActor(store), batch.Command{Op: "set", Key: key, Value: &generated, Owner: owner}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			switch {
+			case printValue:
+				os.Stdout.Write(value)
+			case isPorcelain(cmd):
+				porcelain.Write(os.Stdout, "secret-set", key)
+			default:
+				fmt.Printf("%s Secret '%s' set to a random %d-character %s value\n", output.OK, key, length, charset)
+			}
+		},
+	}
+	generateCmd.Flags().Int("length", 32, "Number of characters to generate")
+	generateCmd.Flags().String("charset", "alnum", "Characters to draw from: alnum, hex or base64")
+	generateCmd.Flags().Bool("symbols", false, "Add punctuation to alnum and use at least one")
+	generateCmd.Flags().Bool("print", false, "Print the value once after storing it")
+	generateCmd.Flags().Bool("force", false, "Replace an existing secret")
+	generateCmd.Flags().String("owner", "", "Owner of the secret: a user, or a subject such as gid:100 (default: you)")
+
+	// temp command - Secrets that delete themselves
+	tempCmd := &cobra.Command{
+		Use:   "temp",
+		Short: "Manage temporary secrets",
+		Long: `Temporary secrets are ordinary secrets that are deleted once they expire,
+for throwaway credentials handed out in a workshop or onboarding session:
+  lockbox temp set DEMO_API_KEY sk-demo-123 --for 2h
+  lockbox temp list
+Expired secrets are deleted the next time lockbox opens the store, and
+within a minute by 'lockbox serve'. Backups leave temporary secrets out
+unless the chain is started with --include-temp. Writing the key with
+'lockbox set' makes it permanent.`,
+	}
+
+	tempSetCmd := &cobra.Command{
+		Use:   "set KEY VALUE --for DURATION",
+		Short: "Set a secret that expires",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, value := args[0], args[1]
+			lifetime, _ := cmd.Flags().GetDuration("for")
+			if lifetime <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: --for must be positive\n")
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			tx, err := store.Begin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer tx.Rollback()
+			// A permanent secret is never turned into one that expires
+			if _, err := tx.GetSecret(key); err == nil {
+				if _, err := tx.TempExpiry(key); err == db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: '%s' is a permanent secret; delete it first or pick another key\n", key)
+					exit(1)
+				} else if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if _, err := batch.Execute(tx, encKey, localActor(store), batch.Command{Op: "set", Key: key, Value: &value}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			expires := time.Now().Add(lifetime)
+			if err := tx.SetTemporary(key, expires); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := tx.Commit(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "temp-set", key, porcelain.Time(expires))
+				return
+			}
+			fmt.Printf("%s Temporary secret '%s' set, expires %s\n", output.OK, key, expires.Local().Format(time.DateTime))
+		},
+	}
+	tempSetCmd.Flags().Duration("for", time.Hour, "How long the secret lives")
+
+	tempListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List temporary secrets and when they expire",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			temp, err := store.TempSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, t := range temp {
+					porcelain.Write(os.Stdout, "temp", t.Key, porcelain.Time(t.Expires))
+				}
+				return
+			}
+			if len(temp) == 0 {
+				fmt.Println("No temporary secrets found")
+				return
+			}
+			now := time.Now()
+			for _, t := range temp {
+				fmt.Printf("%-32s  expires %s (in %s)\n", t.Key, t.Expires.Local().Format(time.DateTime), t.Expires.Sub(now).Round(time.Minute))
+			}
+		},
+	}
+	tempCmd.AddCommand(tempSetCmd, tempListCmd)
+
+	// get command
+	getCmd := &cobra.Command{
+		Use:   "get KEY...",
+		Short: "Get a secret",
+		Long: `Retrieve and decrypt a secret by its key. Keys may be glob patterns;
+several secrets are printed as an object of key to value with --json, on
+one line, or with --output json or yaml:
+  lockbox get API_KEY
+  lockbox get 'DB_*' --json
+  lockbox get 'DB_*' -o yaml
+--out writes the value to a file instead, byte for byte, with --mode
+permissions (0600 by default):
+  lockbox get SSH_KEY --out ~/.ssh/id_ed25519
+  lockbox get TLS_CERT --out /etc/app/cert.pem --mode 0644
+Secrets tagged confirm-read ('lockbox set KEY --tag confirm-read') are only
+printed once Touch ID, Windows Hello or a polkit prompt confirms someone is
+at the machine.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeKeys(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			asJSON, _ := cmd.Flags().GetBool("json")
+			format := outputFormat(cmd)
+			out, _ := cmd.Flags().GetString("out")
+			fileMode, _ := cmd.Flags().GetString("mode")
+			mode, err := strconv.ParseUint(fileMode, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: invalid --mode '%s'\n", fileMode)
+				exit(1)
+			}
+			if out != "" && (asJSON || format != output.Text) {
+				fmt.Fprintf(os.Stderr, "Error: --out cannot be combined with --json or --output\n")
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			keys, err = selector.Resolve(keys, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(keys) > 1 && out != "" {
+				fmt.Fprintf(os.Stderr, "Error: %d secrets selected; --out writes one\n", len(keys))
+				exit(1)
+			}
+			if len(keys) > 1 && !asJSON && format == output.Text {
+				fmt.Fprintf(os.Stderr, "Error: %d secrets selected; use --json or --output to print several\n", len(keys))
+				exit(1)
+			}
+			if err := confirmReads(store, keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			values := map[string]string{}
+			err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+				if err != nil {
+					return err
+				}
+				values[key] = string(decrypted)
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			recordAccess(store, keys)
+
+			if out != "" {
+				if err := materialize.WriteFile(out, []byte(values[keys[0]]), os.FileMode(mode)); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "%s Secret '%s' written to %s\n", output.OK, keys[0], out)
+				return
+			}
+			if asJSON {
+				json.NewEncoder(os.Stdout).Encode(values)
+				return
+			}
+			if format != output.Text {
+				writeOutput(format, values)
+				return
+			}
+
+			// Print just the value with no extra formatting
+			fmt.Print(values[keys[0]])
+		},
+	}
+
+	getCmd.Flags().Bool("json", false, "Print the selected secrets as a JSON object of key to value")
+	getCmd.Flags().String("out", "", "Write the value to this file instead of printing it")
+	getCmd.Flags().String("mode", "0600", "Permissions of the file written by --out")
+
+	// autotype command - Type a secret into another window
+	autotypeCmd := &cobra.Command{
+		Use:   "autotype KEY",
+		Short: "Type a secret into another window",
+		Long: `Type a secret into the next window you switch to, through xdotool on
+X11, wtype on Wayland, System Events on macOS or SendKeys on Windows, for
+GUIs and remote desktop sessions that block paste. The value is never
+printed or put on a command line:
+  lockbox autotype VPN_PASSWORD
+  lockbox autotype RDP_PASSWORD --delay 5s
+Where the focused window cannot be told (Wayland and Windows), typing
+starts after --delay, 3s by default. macOS asks to allow your terminal
+under Accessibility the first time.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			delay, _ := cmd.Flags().GetDuration("delay")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			keys, err = selector.Resolve(keys, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(keys) > 1 {
+				fmt.Fprintf(os.Stderr, "Error: %d secrets selected; autotype types one\n", len(keys))
+				exit(1)
+			}
+			key := keys[0]
+			// Confirm before waiting, as the prompt takes the focus
+			if err := confirmReads(store, keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			var value string
+			err = bulk.Decrypt(store, encKey, keys, func(_ string, decrypted []byte, err error) error {
+				value = string(decrypted)
+				return err
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if delay == 0 {
+				fmt.Fprintf(os.Stderr, "Switch to the window to type %s into...\n", key)
+				err = autotype.WaitForFocus(timeout)
+				if err == autotype.ErrNoFocus {
+					delay, err = autotype.DefaultDelay, nil
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if delay > 0 {
+				fmt.Fprintf(os.Stderr, "Typing %s in %s; focus the window to type it into\n", key, delay)
+				time.Sleep(delay)
+			}
+			if err := autotype.Type(value); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to type secret: %v\n", err)
+				exit(1)
+			}
+			recordAccess(store, keys)
+			fmt.Printf("%s Typed '%s'\n", output.OK, key)
+		},
+	}
+
+	autotypeCmd.Flags().Duration("delay", 0, "Type after this long instead of when another window is focused")
+	autotypeCmd.Flags().Duration("timeout", time.Minute, "How long to wait for another window to be focused")
+
+	// exists command - Check for secrets without printing their values
+	existsCmd := &cobra.Command{
+		Use:   "exists KEY...",
+		Short: "Check whether secrets exist",
+		Long: `Report through the exit code whether secrets exist, printing nothing, so
+scripts can branch without a value ever reaching their logs:
+  if lockbox exists API_KEY; then ...; fi
+  lockbox exists --all DB_USER DB_PASSWORD || exit 1
+A glob pattern such as 'DB_*' exists when it matches any secret. The exit
+code is 0 when a key exists (every key with --all), 1 when not, and 2 when
+the store or remote cannot be read.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			all, _ := cmd.Flags().GetBool("all")
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+
+			var keys []string
+			if remoteFlag != "" {
+				remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+				var err error
+				keys, err = remote.ListSecrets()
+				remote.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(2)
+				}
+			} else {
+				store, _, err := getStoreAndKey()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(2)
+				}
+				keys, err = store.ListSecrets()
+				store.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+					exit(2)
+				}
+			}
+
+			found := 0
+			for _, arg := range args {
+				matched, err := selector.Match(keys, arg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(2)
+				}
+				if len(matched) > 0 {
+					found++
+				}
+			}
+			if found == 0 || (all && found < len(args)) {
+				exit(1)
+			}
+		},
+	}
+
+	existsCmd.Flags().Bool("all", false, "Require every key to exist instead of any")
+	existsCmd.Flags().StringP("remote", "r", "", "Check a remote server instead of the local store")
+
+	// sudo-get command - Read a group-shared system secret via the helper
+	sudoGetCmd := &cobra.Command{
+		Use:   "sudo-get KEY",
+		Short: "Get a shared system secret readable by a group",
+		Long: `Read a secret from the shared store of an OS group in multi-user mode.
+The setgid lockbox-helper checks that you belong to the group before
+decrypting, so shared stores stay unreadable to everyone else:
+  lockbox sudo-get --group deploy DEPLOY_KEY`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			group, _ := cmd.Flags().GetString("group")
+			if group == "" {
+				fmt.Fprintf(os.Stderr, "Error: --group is required\n")
+				exit(1)
+			}
+
+			value, err := runHelper("get", group, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			// Print just the value with no extra formatting
+			fmt.Print(string(value))
+		},
+	}
+
+	sudoGetCmd.Flags().String("group", "", "OS group owning the shared store")
+
+	// delete command
+	deleteCmd := &cobra.Command{
+		Use:   "delete KEY...",
+		Short: "Delete a secret",
+		Long: `Remove secrets by their keys. Deleting by glob pattern requires --force:
+  lockbox delete OLD_SECRET
+  lockbox delete 'TMP_*' --force
+With --remote, secrets are deleted on a lockbox server instead, which
+needs the write permission on each key.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeKeys(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			force, _ := cmd.Flags().GetBool("force")
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+
+			for _, arg := range args {
+				if selector.IsPattern(arg) && !force {
+					fmt.Fprintf(os.Stderr, "Error: '%s' is a pattern; use --force to delete every secret it matches\n", arg)
+					exit(1)
+				}
+			}
+
+			if remoteFlag != "" {
+				remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+				defer remote.Close()
+				keys, err := remote.ListSecrets()
+				if err == nil {
+					keys, err = selector.Resolve(keys, args)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				for _, key := range keys {
+					if err := remote.DeleteSecret(key); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: failed to delete secret: %v\n", err)
+						exit(1)
+					}
+					if isPorcelain(cmd) {
+						porcelain.Write(os.Stdout, "secret-deleted", key)
+						continue
+					}
+					fmt.Printf("%s Secret '%s' deleted on %s\n", output.OK, key, remoteFlag)
+				}
+				return
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			// Expired secrets can still be deleted
+			expired, err := store.ListExpiredSecrets(time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			keys = slices.Sorted(slices.Values(append(keys, expired...)))
+			keys, err = selector.Resolve(keys, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			actor := localActor(store)
+			for _, key := range keys {
+				// Delete the secret
+				if _, err := batch.Execute(store, nil, actor, batch.Command{Op: "delete", Key: key}); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to delete secret: %v\n", err)
+					exit(1)
+				}
+
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "secret-deleted", key)
+					continue
+				}
+				fmt.Printf("%s Secret '%s' deleted successfully\n", output.OK, key)
+			}
+		},
+	}
+
+	deleteCmd.Flags().Bool("force", false, "Allow deleting every secret matching a glob pattern")
+	deleteCmd.Flags().StringP("remote", "r", "", "Delete on a remote server instead of the local store")
+
+	// rename command
+	renameCmd := &cobra.Command{
+		Use:   "rename OLD_KEY NEW_KEY",
+		Short: "Rename a secret",
+		Long: `Move a secret to a new key, with its value, owner, tags and
+expiry, in one transaction. Renaming onto an existing secret requires
+--force, which replaces it:
+  lockbox rename DB_PASS DB_PASSWORD
+  lockbox rename STAGING_URL API_URL --force`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			force, _ := cmd.Flags().GetBool("force")
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if _, err := batch.Execute(store, nil, localActor(store), batch.Command{Op: "rename", Key: args[0], To: args[1], Force: force}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to rename secret: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "secret-renamed", args[0], args[1])
+				return
+			}
+			fmt.Printf("%s Secret '%s' renamed to '%s'\n", output.OK, args[0], args[1])
+		},
+	}
+
+	renameCmd.Flags().Bool("force", false, "Replace NEW_KEY if it exists")
+
+	// list command
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List all secrets",
+		Long: `Display all stored secret keys, or only those owned by --owner: a
+user, or a subject such as gid:100, or tagged with every --tag. Expired
+secrets are only listed, alone, with --expired.
+
+With --long, also show each secret's age since its last update, when it
+was last read, owner, status and tags: fresh (under 30 days, green), aging (under 90 days,
+yellow) or stale (red). --format json prints the same fields for scripts.
+
+--output json or yaml prints each secret's key, owner, tags, description,
+and creation, update and expiry times.
+  lockbox list --long --sort age
+  lockbox list --long --sort accessed    # never read first
+  lockbox list --tag prod --tag db
+  lockbox list -o json | jq -r '.[] | select(.owner == "") | .key'`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			long, _ := cmd.Flags().GetBool("long")
+			sortBy, _ := cmd.Flags().GetString("sort")
+			format, _ := cmd.Flags().GetString("format")
+			switch {
+			case sortBy != "name" && sortBy != "age" && sortBy != "accessed":
+				fmt.Fprintf(os.Stderr, "Error: unknown sort '%s' (supported: name, age, accessed)\n", sortBy)
+				exit(1)
+			case !slices.Contains(table.Formats, format):
+				fmt.Fprintf(os.Stderr, "Error: unknown format '%s' (supported: %s)\n", format, strings.Join(table.Formats, ", "))
+				exit(1)
+			}
+			owner, _ := cmd.Flags().GetString("owner")
+			if owner != "" {
+				var err error
+				if owner, err = parseOwner(owner); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Get all secrets
+			infos, err := store.ListSecretInfo()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			if owner != "" {
+				infos = slices.DeleteFunc(infos, func(info db.SecretInfo) bool { return info.Owner != owner })
+			}
+			if tags, _ := cmd.Flags().GetStringArray("tag"); len(tags) > 0 {
+				infos = slices.DeleteFunc(infos, func(info db.SecretInfo) bool { return !info.HasTags(tags...) })
+			}
+			expired, _ := cmd.Flags().GetBool("expired")
+			now := time.Now()
+			infos = slices.DeleteFunc(infos, func(info db.SecretInfo) bool { return info.Expired(now) != expired })
+			if long || sortBy == "accessed" {
+				if err := store.LoadAccessed(infos); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			switch sortBy {
+			case "age":
+				// Oldest first
+				slices.SortStableFunc(infos, func(a, b db.SecretInfo) int { return a.Updated.Compare(b.Updated) })
+			case "accessed":
+				// Never read first, then least recently read
+				slices.SortStableFunc(infos, func(a, b db.SecretInfo) int { return a.Accessed.Compare(b.Accessed) })
+			}
+
+			if isPorcelain(cmd) {
+				for _, info := range infos {
+					porcelain.Write(os.Stdout, "secret", info.Key, info.Owner)
+				}
+				return
+			}
+			if format := outputFormat(cmd); format != output.Text {
+				type record struct {
+					Key         string   `json:"key"`
+					Owner       string   `json:"owner"`
+					Tags        []string `json:"tags"`
+					Description string   `json:"description"`
+					CreatedAt   string   `json:"created_at"`
+					UpdatedAt   string   `json:"updated_at"`
+					ExpiresAt   string   `json:"expires_at"`
+				}
+				records := make([]record, 0, len(infos))
+				for _, info := range infos {
+					tags := append([]string{}, info.Tags...)
+					records = append(records, record{info.Key, info.Owner, tags, info.Description, porcelain.Time(info.Created), porcelain.Time(info.Updated), porcelain.Time(info.Expires)})
+				}
+				writeOutput(format, records)
+				return
+			}
+			if long || format != "table" {
+				t := table.Table{
+					Columns: []string{"key", "age_days", "updated", "accessed", "owner", "status", "tags"},
+					Headers: []string{"KEY", "AGE", "UPDATED", "ACCESSED", "OWNER", "STATUS", "TAGS"},
+				}
+				for _, info := range infos {
+					days := report.AgeDays(info.Updated, now)
+					status := report.Freshness(days)
+					color := map[string]table.Color{"fresh": table.Green, "aging": table.Yellow, "stale": table.Red}[status]
+					accessed := table.Cell{Text: "never", Value: ""}
+					if !info.Accessed.IsZero() {
+						accessed = table.Cell{Text: info.Accessed.Local().Format(time.DateOnly), Value: info.Accessed.UTC().Format(time.RFC3339)}
+					}
+					t.Add(
+						table.Cell{Text: info.Key},
+						table.Cell{Text: fmt.Sprintf("%dd", days), Value: days, Color: color},
+						table.Cell{Text: info.Updated.Local().Format(time.DateOnly), Value: info.Updated.UTC().Format(time.RFC3339)},
+						accessed,
+						table.Cell{Text: info.Owner},
+						table.Cell{Text: status, Color: color},
+						table.Cell{Text: strings.Join(info.Tags, ","), Value: append([]string{}, info.Tags...)},
+					)
+				}
+				if format == "table" && len(infos) == 0 {
+					fmt.Println("No secrets found")
+					return
+				}
+				if err := t.Write(os.Stdout, format, table.ColorEnabled(os.Stdout)); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				return
+			}
+			if len(infos) == 0 {
+				fmt.Println("No secrets found")
+				return
+			}
+
+			// Print each key on its own line
+			for _, info := range infos {
+				fmt.Println(info.Key)
+			}
+		},
+	}
+	listCmd.Flags().String("owner", "", "Only list secrets owned by this user or subject")
+	listCmd.Flags().StringArray("tag", nil, "Only list secrets with this tag; repeat to require several")
+	listCmd.Flags().Bool("expired", false, "List only expired secrets, which 'lockbox prune' deletes")
+	listCmd.Flags().BoolP("long", "l", false, "Show age, last read, owner, status and tags")
+	listCmd.Flags().String("sort", "name", "Sort by name, age (oldest first) or accessed (least recently read first)")
+	listCmd.Flags().String("format", "table", "Output format for --long: table or json")
+
+	// search command - Find secrets by key name or value
+	searchCmd := &cobra.Command{
+		Use:   "search PATTERN [--values] [--regex]",
+		Short: "Find secrets whose name, or value, matches PATTERN",
+		Long: `Print the keys containing PATTERN, ignoring case, or matching it whole if
+it is a glob such as 'DB_*'. With --regex PATTERN is a regular expression,
+matching anywhere unless anchored and used as given; add (?i) to ignore
+case. With --values, also print the keys whose values match; each value
+is decrypted to check it, unless the search index rules it out (see
+'lockbox search-index'):
+  lockbox search 'aws_*'
+  lockbox search --regex '^(STRIPE|PAYPAL)_'
+  lockbox search --values --regex 'BEGIN [A-Z ]*PRIVATE KEY'
+Secrets are read a page at a time and matches printed as they are found,
+in key order. Exits 1 when nothing matches.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			values, _ := cmd.Flags().GetBool("values")
+			regex, _ := cmd.Flags().GetBool("regex")
+
+			pattern, err := search.Compile(args[0], regex)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			var index *search.Index
+			if values {
+				if index, err = search.Load(store, key); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			found := 0
+			_, err = search.Search(store, key, index, pattern, values, func(k, in string) error {
+				found++
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "match", k, in)
+				} else {
+					fmt.Println(k)
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if found == 0 {
+				exit(1)
+			}
+		},
+	}
+	searchCmd.Flags().Bool("values", false, "Also search secret values")
+	searchCmd.Flags().BoolP("regex", "E", false, "Treat PATTERN as a regular expression")
+
+	searchIndexCmd := &cobra.Command{
+		Use:   "search-index",
+		Short: "Narrow 'search --values' with an encrypted index",
+		Long: `With the search index enabled, every write stores a Bloom filter of the
+value's three-character fragments, hashed with a key derived from the
+store key, so 'search --values' only decrypts values that may match.
+
+The index trades some secrecy for speed. Without the store key the
+filters cannot be tested against any text, but anyone who can read the
+database learns roughly how long each value is and which values share
+fragments, such as two URLs on the same host. Leave it off for stores
+whose values are few or short enough to decrypt on every search.
+  lockbox search-index enable
+  lockbox search --values example.com
+  lockbox search-index disable           # deletes the index`,
+	}
+
+	searchIndexEnableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Build the index and keep it up to date on every write",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can change search index settings\n")
+				exit(1)
+			}
+
+			n, err := search.Enable(store, key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "search-index-enabled", fmt.Sprintf("%d values", n))
+			fmt.Printf("%s Search index enabled (%d values indexed)\n", output.OK, n)
+		},
+	}
+
+	searchIndexDisableCmd := &cobra.Command{
+		Use:   "disable",
+		Short: "Stop maintaining the index and delete it",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can change search index settings\n")
+				exit(1)
+			}
+
+			if err := search.Disable(store); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "search-index-disabled", "")
+			fmt.Println(output.OK, "Search index disabled and deleted")
+		},
+	}
+
+	searchIndexStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether the index is on and how much of the store it covers",
+		Long: `Show whether the index is on and how many values have an up-to-date
+entry. Values restored from a backup or re-encrypted by a key rotation
+lose their entries until the next 'search --values' reads them, or
+'search-index enable' is run again.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			index, err := search.Load(store, key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if index == nil {
+				fmt.Println("Search index: disabled")
+				return
+			}
+			indexed, total, err := search.Coverage(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("Search index: enabled, %d of %d values indexed\n", indexed, total)
+		},
+	}
+	searchIndexCmd.AddCommand(searchIndexEnableCmd, searchIndexDisableCmd, searchIndexStatusCmd)
+
+	// report command - Inventory of secret metadata for security reviews
+	reportCmd := &cobra.Command{
+		Use:   "report [PATTERN...]",
+		Short: "Generate an inventory report of secrets",
+		Long: `Generate an inventory of all secrets, or of the given keys and glob
+patterns, for periodic security reviews. The report lists key names,
+owners, creation and update dates, age since the last update, how many
+other secrets share the same value, tags, expiry and when each was last
+read per the access log. It never contains secret values.
+
+Formats: md (Markdown, the default), csv and html.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			format, _ := cmd.Flags().GetString("format")
+			if !slices.Contains(report.Formats, format) {
+				fmt.Fprintf(os.Stderr, "Error: unknown report format '%s' (supported: %s)\n", format, strings.Join(report.Formats, ", "))
+				exit(1)
+			}
+			owner, _ := cmd.Flags().GetString("owner")
+			if owner != "" {
+				var err error
+				if owner, err = parseOwner(owner); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			infos, err := store.ListSecretInfo()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			if owner != "" {
+				infos = slices.DeleteFunc(infos, func(info db.SecretInfo) bool { return info.Owner != owner })
+			}
+			if len(args) > 0 {
+				var keys []string
+				for _, info := range infos {
+					keys = append(keys, info.Key)
+				}
+				if keys, err = selector.Resolve(keys, args); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				infos = slices.DeleteFunc(infos, func(info db.SecretInfo) bool { return !slices.Contains(keys, info.Key) })
+			}
+			if err := store.LoadAccessed(infos); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if err := report.Write(os.Stdout, format, report.Report{Generated: time.Now(), Secrets: infos}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to write report: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+	reportCmd.Flags().String("format", "md", "Report format: md, csv or html")
+	reportCmd.Flags().String("owner", "", "Only report secrets owned by this user or subject")
+
+	// env command - Export secrets as environment variables
+	envCmd := &cobra.Command{
+		Use:   "env [KEY...]",
+		Short: "Export secrets as environment variables",
+		Long: `Export all stored secrets in shell export format, or only the given
+keys and glob patterns.
+Can be used with eval or source to set environment variables:
+  eval $(lockbox env)
+  source <(lockbox env 'APP_*')
+With --output json or yaml the variables are printed as an object of name
+to value instead. --only, --prefix and --exclude narrow the secrets
+exported as for 'lockbox run':
+  lockbox env --prefix DB_ --exclude DB_ADMIN_PASSWORD
+A value that cannot be decrypted stops the export where it is. --strict
+decrypts every value first and prints nothing unless all succeed, naming
+each one that fails; --skip-bad warns about such values and leaves them
+out.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Get all secrets
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			if len(args) > 0 {
+				if keys, err = selector.Resolve(keys, args); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if keys, err = keyFilter(cmd).Apply(keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			strict, skipBad := badValueFlags(cmd)
+			if strict {
+				checkValues(store, encKey, keys, "nothing was exported")
+			}
+			var skipped []string
+
+			if format := outputFormat(cmd); format != output.Text {
+				values := map[string]string{}
+				err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+					if err != nil && skipBad {
+						fmt.Fprintf(os.Stderr, "Warning: %v; skipped\n", err)
+						skipped = append(skipped, key)
+						return nil
+					} else if err != nil {
+						return err
+					}
+					values[key] = string(decrypted)
+					return nil
+				})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				writeOutput(format, values)
+				recordAccess(store, reportSkipped(keys, skipped))
+				return
+			}
+
+			// Decrypt in parallel, writing values in key order through a
+			// bounded buffer
+			out := export.NewWriter(os.Stdout)
+			err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+				if err != nil && skipBad {
+					fmt.Fprintf(os.Stderr, "Warning: %v; skipped\n", err)
+					skipped = append(skipped, key)
+					return nil
+				} else if err != nil {
+					return err
+				}
+				out.Write(key, decrypted)
+				clear(decrypted)
+				return nil
+			})
+			if err != nil {
+				out.Flush()
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := out.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to write output: %v\n", err)
+				exit(1)
+			}
+			recordAccess(store, reportSkipped(keys, skipped))
+		},
+	}
+
+	// template command - Render a config file with secret values
+	templateCmd := &cobra.Command{
+		Use:   "template FILE",
+		Short: "Render a config file template with secret values",
+		Long: `Render a Go template with secret values substituted, to generate config
+files such as nginx.conf or application.yml without exporting every secret
+to the environment. Secrets are referenced by quoted key:
+  password: {{ secret "DB_PASSWORD" }}
+The rendered file is printed, or written with --out and --mode permissions
+(0600 by default). FILE - reads the template from stdin.
+  lockbox template nginx.conf.tmpl --out /etc/nginx/nginx.conf --mode 0640
+Only the secrets the template names are decrypted, and a missing one fails
+before anything is written.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			out, _ := cmd.Flags().GetString("out")
+			fileMode, _ := cmd.Flags().GetString("mode")
+			mode, err := strconv.ParseUint(fileMode, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: invalid --mode '%s'\n", fileMode)
+				exit(1)
+			}
+
+			var text []byte
+			if args[0] == "-" {
+				text, err = io.ReadAll(os.Stdin)
+			} else {
+				text, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read template: %v\n", err)
+				exit(1)
+			}
+			tmpl, err := render.Parse(filepath.Base(args[0]), string(text))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			for _, key := range tmpl.Keys() {
+				if !slices.Contains(keys, key) {
+					fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
+					exit(1)
+				}
+			}
+			keys = tmpl.Keys()
+			if err := confirmReads(store, keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			values := map[string]string{}
+			err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+				if err != nil {
+					return err
+				}
+				values[key] = string(decrypted)
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			recordAccess(store, keys)
+
+			var rendered bytes.Buffer
+			if err := tmpl.Execute(&rendered, values); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if out == "" {
+				os.Stdout.Write(rendered.Bytes())
+				return
+			}
+			if err := materialize.WriteFile(out, rendered.Bytes(), os.FileMode(mode)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "%s Rendered %d secret(s) into %s\n", output.OK, len(keys), out)
+		},
+	}
+
+	templateCmd.Flags().String("out", "", "Write the rendered file here instead of printing it")
+	templateCmd.Flags().String("mode", "0600", "Permissions of the file written by --out")
+
+	// import command - Bring secrets in from other systems
+	importCmd := &cobra.Command{
+		Use:   "import [FILE [--format lbx|dotenv] [--overwrite | --skip | --fail | --diff]]",
+		Short: "Import secrets from an archive, a .env file or other systems",
+		Long: `Restore the secrets of an archive written by 'lockbox export FILE.lbx', in
+every vault, into this store; import the variables of a .env file with
+--format dotenv; or import secrets from another system with one of the
+subcommands below:
+  lockbox import backup.lbx --skip
+  lockbox import --format dotenv .env
+Archived secrets keep their kind, owner and timestamps and are
+re-encrypted with this store's key. An archive from a store with another
+key can only be restored if it was exported with --include-key; its
+passphrase is then asked for, or read from $LOCKBOX_ARCHIVE_PASSPHRASE.
+.env files may use export prefixes, comments, and single or double quotes,
+with values spanning lines; variables in values are not expanded. Their
+variables go to the current vault.
+When secrets already exist, --fail (the default) imports nothing and lists
+them, --skip keeps them and --overwrite replaces them, archiving the old
+values to escrow. Everything is imported in one transaction.
+--diff imports nothing and instead shows which keys are new, changed or
+identical, comparing values by their keyed digest without printing them:
+  lockbox import --format dotenv .env --diff
+  lockbox import doppler --diff`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				cmd.Help()
+				return
+			}
+			strategy := importStrategy(cmd)
+			switch format, _ := cmd.Flags().GetString("format"); format {
+			case "lbx":
+			case "dotenv":
+				importDotenv(cmd, args[0], strategy)
+				return
+			default:
+				fmt.Fprintf(os.Stderr, "Error: unknown format %q; use lbx or dotenv\n", format)
+				exit(1)
+			}
+
+			if diff, _ := cmd.Flags().GetBool("diff"); diff {
+				fmt.Fprintf(os.Stderr, "Error: --diff compares .env files and the import subcommands, not archives\n")
+				exit(1)
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read archive: %v\n", err)
+				exit(1)
+			}
+			sealed, err := archive.Read(f)
+			f.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[0], err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can import an archive\n")
+				exit(1)
+			}
+
+			a, err := sealed.Open(encKey)
+			if err == archive.ErrWrongKey {
+				if len(sealed.Header.Key) == 0 {
+					fmt.Fprintf(os.Stderr, "Error: %s was exported from a store with another key; export it with --include-key to restore it here\n", args[0])
+					exit(1)
+				}
+				passphrase, perr := archivePassphrase(false)
+				if perr != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", perr)
+					exit(1)
+				}
+				archiveKey, kerr := sealed.UnwrapKey(passphrase)
+				if kerr != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", kerr)
+					exit(1)
+				}
+				a, err = sealed.Open(archiveKey)
+				clear(archiveKey)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[0], err)
+				exit(1)
+			}
+			defer a.Wipe()
+
+			result, err := archive.Restore(store, encKey, a, strategy)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				if _, ok := err.(*archive.ConflictError); ok {
+					fmt.Fprintf(os.Stderr, "Nothing was imported; keep them with --skip or replace them with --overwrite\n")
+				}
+				exit(1)
+			}
+			store.Audit(actor.Owner, "archive-imported", fmt.Sprintf("%s: %d created, %d overwritten, %d skipped", args[0], result.Created, result.Overwritten, result.Skipped))
+			fmt.Printf("%s Imported %d secret(s) from %s\n", output.OK, result.Created+result.Overwritten, args[0])
+			if result.Overwritten > 0 {
+				fmt.Printf("  %d overwritten\n", result.Overwritten)
+			}
+			if result.Skipped > 0 {
+				fmt.Printf("  %d skipped, already present\n", result.Skipped)
+			}
+		},
+	}
+	importCmd.Flags().String("format", "lbx", "Format of FILE: lbx (an archive) or dotenv (a .env file, - for stdin)")
+	importCmd.Flags().Bool("fail", false, "Restore nothing if any secret already exists (default)")
+	importCmd.Flags().Bool("skip", false, "Keep secrets that already exist")
+	importCmd.Flags().Bool("overwrite", false, "Replace secrets that already exist")
+	importCmd.Flags().Bool("diff", false, "Show new, changed and identical keys without importing anything")
+
+	importK8sCmd := &cobra.Command{
+		Use:   "k8s [--namespace NS] [--selector LABELS]",
+		Short: "Import Kubernetes Secrets",
+		Long: `Read Kubernetes Secrets through kubectl, using the current kubeconfig and
+context (or --context), and store their decoded fields, so a cluster's
+secrets can be snapshotted and reproduced locally:
+  lockbox import k8s --namespace prod --selector app=web
+Each field is stored under its own name, as envFrom exposes it, or with
+--prefix-name under NAME_field, with characters not valid in environment
+variables replaced by underscores. Service account tokens and Helm release
+secrets are skipped. Existing secrets are left alone unless --overwrite
+is given, and all secrets are written in one transaction.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := k8s.Options{}
+			opts.Namespace, _ = cmd.Flags().GetString("namespace")
+			opts.Selector, _ = cmd.Flags().GetString("selector")
+			opts.Context, _ = cmd.Flags().GetString("context")
+			opts.Kubectl = os.Getenv("LOCKBOX_KUBECTL")
+			prefixName, _ := cmd.Flags().GetBool("prefix-name")
+
+			k8sSecrets, err := k8s.Get(opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			entries, err := k8s.Entries(k8sSecrets, prefixName)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(entries) == 0 {
+				fmt.Println("No Kubernetes Secrets matched")
+				return
+			}
+
+			secrets := make([]provider.Secret, len(entries))
+			for i, e := range entries {
+				secrets[i] = provider.Secret{Key: e.Key, Source: e.Source(), Value: e.Value}
+			}
+			importSecrets(cmd, secrets, fmt.Sprintf("%d Kubernetes Secrets", len(k8sSecrets)))
+		},
+	}
+	importK8sCmd.Flags().StringP("namespace", "n", "", "Namespace to read (default: the context's namespace)")
+	importK8sCmd.Flags().StringP("selector", "l", "", "Label selector, such as app=web")
+	importK8sCmd.Flags().String("context", "", "kubeconfig context to use")
+	importK8sCmd.Flags().Bool("prefix-name", false, "Prefix each key with its Secret's name")
+
+	importAzureCmd := &cobra.Command{
+		Use:   "azure-kv --vault NAME",
+		Short: "Import the secrets of an Azure Key Vault",
+		Long: `Read every enabled secret of an Azure Key Vault through the az CLI, using
+its current login, and store it. Key Vault names cannot contain
+underscores, so dashes become underscores: db-url is stored as db_url.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			vault, _ := cmd.Flags().GetString("vault")
+			if vault == "" {
+				fmt.Fprintf(os.Stderr, "Error: --vault is required\n")
+				exit(1)
+			}
+			p := provider.Azure{Vault: vault, Binary: os.Getenv("LOCKBOX_AZ")}
+			secrets, err := provider.Import(p, vault)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			importSecrets(cmd, secrets, "Key Vault "+vault)
+		},
+	}
+	importAzureCmd.Flags().String("vault", "", "Key Vault name")
+
+	importGCPCmd := &cobra.Command{
+		Use:   "gcp-sm --project ID",
+		Short: "Import the secrets of a GCP Secret Manager project",
+		Long: `Read the latest version of every secret in a Google Cloud project through
+the gcloud CLI, using its current login, and store it under its name.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			project, _ := cmd.Flags().GetString("project")
+			if project == "" {
+				fmt.Fprintf(os.Stderr, "Error: --project is required\n")
+				exit(1)
+			}
+			p := &provider.GCP{Project: project, Binary: os.Getenv("LOCKBOX_GCLOUD")}
+			secrets, err := provider.Import(p, project)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			importSecrets(cmd, secrets, "project "+project)
+		},
+	}
+	importGCPCmd.Flags().String("project", "", "Google Cloud project ID")
+
+	importDopplerCmd := &cobra.Command{
+		Use:   "doppler [--project NAME] [--config NAME]",
+		Short: "Import the secrets of a Doppler config",
+		Long: `Download every secret of a Doppler config through the doppler CLI, using
+its current login, and store it under its name. Without --project and
+--config the ones set up for the current directory are used. The
+DOPPLER_* secrets Doppler adds to every config are not imported.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			project, _ := cmd.Flags().GetString("project")
+			config, _ := cmd.Flags().GetString("config")
+			secrets, err := provider.Doppler{Project: project, Config: config, Binary: os.Getenv("LOCKBOX_DOPPLER")}.Secrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			importSecrets(cmd, secrets, "Doppler")
+		},
+	}
+	importDopplerCmd.Flags().String("project", "", "Doppler project")
+	importDopplerCmd.Flags().String("config", "", "Doppler config, such as dev or prd")
+
+	importInfisicalCmd := &cobra.Command{
+		Use:   "infisical --env NAME [--project-id ID] [--path FOLDER]",
+		Short: "Import the secrets of an Infisical environment",
+		Long: `Export the secrets of one folder of an Infisical environment through the
+infisical CLI, using its current login, and store them under their names.
+Without --project-id the project linked by .infisical.json is used.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			env, _ := cmd.Flags().GetString("env")
+			if env == "" {
+				fmt.Fprintf(os.Stderr, "Error: --env is required\n")
+				exit(1)
+			}
+			projectID, _ := cmd.Flags().GetString("project-id")
+			folder, _ := cmd.Flags().GetString("path")
+			secrets, err := provider.Infisical{ProjectID: projectID, Env: env, Path: folder, Binary: os.Getenv("LOCKBOX_INFISICAL")}.Secrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			importSecrets(cmd, secrets, "Infisical "+env)
+		},
+	}
+	importInfisicalCmd.Flags().String("env", "", "Environment slug, such as dev or prod")
+	importInfisicalCmd.Flags().String("project-id", "", "Infisical project ID")
+	importInfisicalCmd.Flags().String("path", "/", "Folder to import")
+
+	importHashiVaultCmd := &cobra.Command{
+		Use:   "vault --path MOUNT/PATH [--addr URL]",
+		Short: "Import the fields of a HashiCorp Vault KV secret",
+		Long: `Read one secret of a Vault KV mount (version 1 or 2) through the Vault
+HTTP API and store each of its fields under its name:
+  lockbox import vault --path secret/myapp
+The server, token and TLS settings are taken from the environment as by
+the vault CLI: $VAULT_ADDR, $VAULT_TOKEN (else ~/.vault-token),
+$VAULT_NAMESPACE, $VAULT_CACERT and $VAULT_SKIP_VERIFY. Fields that are
+not strings are stored as JSON.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			p := hashiVault(cmd)
+			secrets, err := provider.Import(p, p.Path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(secrets) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: no secret at %s\n", p.Path)
+				exit(1)
+			}
+			importSecrets(cmd, secrets, "Vault "+p.Path)
+		},
+	}
+
+	for _, c := range []*cobra.Command{importK8sCmd, importAzureCmd, importGCPCmd, importDopplerCmd, importInfisicalCmd, importHashiVaultCmd} {
+		c.Flags().Bool("overwrite", false, "Replace secrets that already exist")
+		c.Flags().Bool("dry-run", false, "Show what would be imported without storing anything")
+		c.Flags().Bool("diff", false, "Show new, changed and identical keys without importing anything")
+	}
+	importCmd.AddCommand(importK8sCmd, importAzureCmd, importGCPCmd, importDopplerCmd, importInfisicalCmd, importHashiVaultCmd)
+
+	// export command - Mirror secrets to other systems
+	exportCmd := &cobra.Command{
+		Use:   "export [FILE [--format lbx|dotenv] [--include-key]]",
+		Short: "Export secrets to an archive, a .env file or other systems",
+		Long: `Write every secret of every vault to an archive, a single file encrypted
+and authenticated with the store key, to restore with 'lockbox import
+FILE.lbx'; write the secrets of the current vault as a .env file with
+--format dotenv (to stdout without FILE); or export secrets to another
+system with one of the subcommands below:
+  lockbox export backup.lbx --include-key
+  lockbox export --format dotenv > .env
+Without --include-key the archive can only be restored into a store with
+the same key. --include-key adds the key, wrapped with a passphrase that
+is asked for (or read from $LOCKBOX_ARCHIVE_PASSPHRASE), so the archive
+can be restored into any store by whoever knows the passphrase.
+Temporary secrets ('lockbox temp') are left out of archives.
+.env values are quoted and escaped as by 'lockbox env', so both shells
+and dotenv loaders read them back unchanged. The file holds the values in
+clear text.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 && !cmd.Flags().Changed("format") {
+				cmd.Help()
+				return
+			}
+			includeKey, _ := cmd.Flags().GetBool("include-key")
+			switch format, _ := cmd.Flags().GetString("format"); format {
+			case "lbx":
+			case "dotenv":
+				if includeKey {
+					fmt.Fprintf(os.Stderr, "Error: --include-key only applies to archives\n")
+					exit(1)
+				}
+				exportDotenv(args)
+				return
+			default:
+				fmt.Fprintf(os.Stderr, "Error: unknown format %q; use lbx or dotenv\n", format)
+				exit(1)
+			}
+			if len(args) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: exporting an archive needs a FILE\n")
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can export an archive\n")
+				exit(1)
+			}
+
+			var passphrase string
+			if includeKey {
+				if passphrase, err = archivePassphrase(true); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			var buf bytes.Buffer
+			header, err := archive.Write(&buf, store, encKey, passphrase, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := os.WriteFile(args[0], buf.Bytes(), 0600); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "archive-exported", args[0])
+			fmt.Printf("%s Exported %d secret(s) to %s\n", output.OK, header.Secrets, args[0])
+			if includeKey {
+				fmt.Println("  The archive includes the store key; keep its passphrase safe")
+			}
+		},
+	}
+	exportCmd.Flags().String("format", "lbx", "Format to write: lbx (an archive) or dotenv (a .env file)")
+	exportCmd.Flags().Bool("include-key", false, "Include the store key, wrapped with a passphrase")
+
+	exportAzureCmd := &cobra.Command{
+		Use:   "azure-kv --vault NAME [KEY...]",
+		Short: "Export secrets to an Azure Key Vault",
+		Long: `Write secrets, or only the given keys and patterns, to an Azure Key Vault
+through the az CLI. Underscores in keys become dashes, since Key Vault
+names cannot contain them; keys with other characters Key Vault does not
+allow are an error. Values are passed to az on stdin.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			vault, _ := cmd.Flags().GetString("vault")
+			if vault == "" {
+				fmt.Fprintf(os.Stderr, "Error: --vault is required\n")
+				exit(1)
+			}
+			exportSecrets(cmd, args, provider.Azure{Vault: vault, Binary: os.Getenv("LOCKBOX_AZ")}, vault)
+		},
+	}
+	exportAzureCmd.Flags().String("vault", "", "Key Vault name")
+
+	exportGCPCmd := &cobra.Command{
+		Use:   "gcp-sm --project ID [KEY...]",
+		Short: "Export secrets to GCP Secret Manager",
+		Long: `Write secrets, or only the given keys and patterns, to Secret Manager in a
+Google Cloud project through the gcloud CLI. A secret that exists gets a
+new version; one that does not is created with automatic replication.
+Values are passed to gcloud on stdin.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			project, _ := cmd.Flags().GetString("project")
+			if project == "" {
+				fmt.Fprintf(os.Stderr, "Error: --project is required\n")
+				exit(1)
+			}
+			exportSecrets(cmd, args, &provider.GCP{Project: project, Binary: os.Getenv("LOCKBOX_GCLOUD")}, project)
+		},
+	}
+	exportGCPCmd.Flags().String("project", "", "Google Cloud project ID")
+
+	exportHashiVaultCmd := &cobra.Command{
+		Use:   "vault --path MOUNT/PATH [--addr URL] [KEY...]",
+		Short: "Export secrets to a HashiCorp Vault KV secret",
+		Long: `Write secrets, or only the given keys and patterns, as the fields of one
+secret of a Vault KV mount (version 1 or 2) through the Vault HTTP API:
+  lockbox export vault --path secret/myapp 'DB_*'
+Fields already in the secret are kept, and every key is written in one
+new version. On KV v2 the write fails if someone else changed the secret
+meanwhile. The server, token and TLS settings are taken from the
+environment as by 'lockbox import vault'.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			p := hashiVault(cmd)
+			exportSecrets(cmd, args, p, p.Path)
+		},
+	}
+
+	for _, c := range []*cobra.Command{importHashiVaultCmd, exportHashiVaultCmd} {
+		c.Flags().String("path", "", "Mount and path of the secret, such as secret/myapp")
+		c.Flags().String("addr", "", "Vault server address (default $VAULT_ADDR)")
+	}
+	for _, c := range []*cobra.Command{exportAzureCmd, exportGCPCmd, exportHashiVaultCmd} {
+		c.Flags().Bool("overwrite", false, "Replace secrets that already exist in the provider")
+		c.Flags().Bool("dry-run", false, "Show what would be exported without writing anything")
+	}
+	exportCmd.AddCommand(exportAzureCmd, exportGCPCmd, exportHashiVaultCmd)
+
+	// batch command - Run JSON commands from stdin in one transaction
+	batchCmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Run newline-delimited JSON commands from stdin in one transaction",
+		Long: `Read one JSON command per line from stdin and run them all in a single
+transaction, printing one JSON result per command as it completes. For
+tools driving lockbox, this avoids a process and a commit per operation:
+  {"op":"set","key":"API_KEY","value":"sk-..."}
+  {"op":"get","key":"API_KEY"}
+  {"op":"delete","key":"OLD_KEY"}
+  {"op":"exists","key":"DB_URL"}
+  {"op":"list","key":"APP_*"}
+An optional "id" is echoed back in the result. The first failing command
+stops the batch and nothing is written. The last line is
+{"op":"commit","ok":true,"count":N} or {"op":"rollback","ok":false,...},
+and the exit code is 1 after a rollback.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if err := batch.Run(os.Stdin, os.Stdout, store, encKey, localActor(store)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	// console command - Interactive shell over one store connection
+	consoleCmd := &cobra.Command{
+		Use:   "console",
+		Short: "Start an interactive console",
+		Long: `Start an interactive shell with get, set, delete, list and exists. The
+store stays open and the key unlocked for the whole session, so commands
+run without a process start each. On a terminal the console offers line
+editing, history (up/down) and tab completion of commands and keys.
+
+'set KEY' without a value prompts for it without echo. History is kept in
+console_history next to the store, with the values of set commands
+redacted.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			guarded := crypto.NewGuardedKey(encKey)
+			defer guarded.Destroy()
+
+			history := filepath.Join(filepath.Dir(store.Path()), "console_history")
+			if err := console.New(store, guarded.Bytes(), console.Options{HistoryPath: history, Actor: localActor(store)}).Run(os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	// note command - Encrypted free-form notes
+	noteCmd := &cobra.Command{
+		Use:   "note",
+		Short: "Keep encrypted free-form notes",
+		Long: `Keep runbooks, recovery instructions and other free-form Markdown next
+to your secrets. Notes are encrypted like secrets but are a separate
+type: they are never exported by env or run and cannot be read remotely.
+'note add' and 'note edit' open $VISUAL or $EDITOR; 'note add' reads
+the note from stdin instead when it is not a terminal.
+  lockbox note add github-recovery
+  lockbox note show github-recovery
+  lockbox note search "recovery code"`,
+	}
+
+	// saveNote encrypts and stores the note called name
+	saveNote := func(store *db.Store, encKey []byte, key string, body []byte) {
+		encrypted, err := crypto.Encrypt(body, encKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to encrypt note: %v\n", err)
+			exit(1)
+		}
+		if err := store.SetKindSecret(note.Kind, key, encrypted); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to store note: %v\n", err)
+			exit(1)
+		}
+	}
+
+	// loadNote returns the decrypted note called name
+	loadNote := func(store *db.Store, encKey []byte, name string) (string, []byte) {
+		key, err := note.Key(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		encrypted, err := store.GetSecret(key)
+		if err == db.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "Error: note '%s' not found\n", name)
+			exit(1)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to get note: %v\n", err)
+			exit(1)
+		}
+		body, err := crypto.Decrypt(encrypted, encKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to decrypt note: %v\n", err)
+			exit(1)
+		}
+		return key, body
+	}
+
+	noteAddCmd := &cobra.Command{
+		Use:   "add NAME",
+		Short: "Write a new note in your editor, or from stdin",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := note.Key(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if _, err := store.GetSecret(key); err == nil {
+				fmt.Fprintf(os.Stderr, "Error: note '%s' already exists; use 'lockbox note edit'\n", args[0])
+				exit(1)
+			}
+
+			var body []byte
+			if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+				body, err = io.ReadAll(os.Stdin)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to read note: %v\n", err)
+					exit(1)
+				}
+			} else if body, err = editor.Edit([]byte("# "+args[0]+"\n\n"), ".md"); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if strings.TrimSpace(string(body)) == "" || strings.TrimSpace(string(body)) == "# "+args[0] {
+				fmt.Fprintf(os.Stderr, "Error: note is empty; nothing saved\n")
+				exit(1)
+			}
+
+			saveNote(store, encKey, key, body)
+			fmt.Printf("%s Note '%s' saved\n", output.OK, args[0])
+		},
+	}
+
+	noteEditCmd := &cobra.Command{
+		Use:   "edit NAME",
+		Short: "Edit a note in your editor",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			key, body := loadNote(store, encKey, args[0])
+			edited, err := editor.Edit(body, ".md")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if bytes.Equal(edited, body) {
+				fmt.Println("Note unchanged")
+				return
+			}
+			saveNote(store, encKey, key, edited)
+			fmt.Printf("%s Note '%s' saved\n", output.OK, args[0])
+		},
+	}
+
+	noteShowCmd := &cobra.Command{
+		Use:   "show NAME",
+		Short: "Print a note",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			_, body := loadNote(store, encKey, args[0])
+			os.Stdout.Write(body)
+			if len(body) > 0 && body[len(body)-1] != '\n' {
+				fmt.Println()
+			}
+		},
+	}
+
+	noteListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List note names",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListKindSecrets(note.Kind)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list notes: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, key := range keys {
+					porcelain.Write(os.Stdout, "note", note.Name(key))
+				}
+				return
+			}
+			if len(keys) == 0 {
+				fmt.Println("No notes found")
+				return
+			}
+			for _, key := range keys {
+				fmt.Println(note.Name(key))
+			}
+		},
+	}
+
+	noteSearchCmd := &cobra.Command{
+		Use:   "search TEXT",
+		Short: "Find notes whose name or text contains TEXT",
+		Long: `Decrypt every note and print the names and lines containing TEXT,
+ignoring case, as NAME or NAME:LINE: TEXT. Exits 1 when nothing matches.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListKindSecrets(note.Kind)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list notes: %v\n", err)
+				exit(1)
+			}
+
+			found := false
+			for _, key := range keys {
+				name := note.Name(key)
+				_, body := loadNote(store, encKey, name)
+				if strings.Contains(strings.ToLower(name), strings.ToLower(args[0])) {
+					fmt.Println(name)
+					found = true
+				}
+				for _, m := range note.Search(string(body), args[0]) {
+					fmt.Printf("%s:%d: %s\n", name, m.Line, m.Text)
+					found = true
+				}
+			}
+			if !found {
+				exit(1)
+			}
+		},
+	}
+
+	noteDeleteCmd := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a note",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := note.Key(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if err := store.DeleteSecret(key); err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: note '%s' not found\n", args[0])
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to delete note: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Note '%s' deleted\n", output.OK, args[0])
+		},
+	}
+	noteCmd.AddCommand(noteAddCmd, noteEditCmd, noteShowCmd, noteListCmd, noteSearchCmd, noteDeleteCmd)
+
+	// recovery command - Single-use recovery codes
+	recoveryCmd := &cobra.Command{
+		Use:   "recovery",
+		Short: "Track single-use recovery codes",
+		Long: `Keep the backup codes of two-factor logins and hand them out one at a
+time, so a code is never reused and you know when to generate new ones.
+Codes are encrypted and, like notes, never exported by env or run.
+  lockbox recovery add GITHUB --codes-file github-recovery-codes.txt
+  lockbox recovery use GITHUB
+  lockbox recovery status`,
+	}
+
+	recoveryAddCmd := &cobra.Command{
+		Use:   "add NAME --codes-file FILE",
+		Short: "Store a set of recovery codes, one per line ('-' reads stdin)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("codes-file")
+			replace, _ := cmd.Flags().GetBool("replace")
+			if path == "" {
+				fmt.Fprintf(os.Stderr, "Error: --codes-file is required\n")
+				exit(1)
+			}
+			key, err := recovery.Key(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			var text []byte
+			if path == "-" {
+				text, err = io.ReadAll(os.Stdin)
+			} else {
+				text, err = os.ReadFile(path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read codes: %v\n", err)
+				exit(1)
+			}
+			set, err := recovery.Parse(string(text), time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			data, err := set.Marshal()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if _, err := store.GetSecret(key); err == nil && !replace {
+				fmt.Fprintf(os.Stderr, "Error: recovery codes for '%s' already exist; use --replace for a new set\n", args[0])
+				exit(1)
+			}
+			encrypted, err := crypto.Encrypt(data, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to encrypt codes: %v\n", err)
+				exit(1)
+			}
+			if err := store.SetKindSecret(recovery.Kind, key, encrypted); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to store codes: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Stored %d recovery codes for '%s'\n", output.OK, len(set.Codes), args[0])
+			if path != "-" {
+				fmt.Printf("  You can now delete %s\n", path)
+			}
+		},
+	}
+
+	recoveryUseCmd := &cobra.Command{
+		Use:   "use NAME",
+		Short: "Print the next unused code and mark it used",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := recovery.Key(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Read and update in one transaction so a code is never handed
+			// out twice
+			tx, err := store.Begin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer tx.Rollback()
+
+			encrypted, err := tx.GetSecret(key)
+			if err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: no recovery codes for '%s'\n", args[0])
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to get codes: %v\n", err)
+				exit(1)
+			}
+			data, err := crypto.Decrypt(encrypted, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to decrypt codes: %v\n", err)
+				exit(1)
+			}
+			set, err := recovery.Unmarshal(data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			code, err := set.Use(time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v for '%s'; generate new ones and run 'lockbox recovery add %s --replace'\n", err, args[0], args[0])
+				exit(1)
+			}
+			if data, err = set.Marshal(); err == nil {
+				encrypted, err = crypto.Encrypt(data, encKey)
+			}
+			if err == nil {
+				err = tx.SetKindSecret(recovery.Kind, key, encrypted)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to mark code used: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Println(code)
+			remaining := set.Remaining()
+			if remaining <= recovery.DefaultLow {
+				fmt.Fprintf(os.Stderr, "Warning: only %d recovery codes left for '%s'; generate new ones soon\n", remaining, args[0])
+			} else {
+				fmt.Fprintf(os.Stderr, "%d recovery codes left\n", remaining)
+			}
+		},
+	}
+
+	recoveryStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show how many codes remain in each set",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			low, _ := cmd.Flags().GetInt("low")
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListKindSecrets(recovery.Kind)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list recovery codes: %v\n", err)
+				exit(1)
+			}
+			if len(keys) == 0 && !isPorcelain(cmd) {
+				fmt.Println("No recovery codes stored")
+				return
+			}
+
+			for _, key := range keys {
+				name := recovery.Name(key)
+				encrypted, err := store.GetSecret(key)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to get codes for '%s': %v\n", name, err)
+					exit(1)
+				}
+				data, err := crypto.Decrypt(encrypted, encKey)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to decrypt codes for '%s': %v\n", name, err)
+					exit(1)
+				}
+				set, err := recovery.Unmarshal(data)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+					exit(1)
+				}
+
+				remaining := set.Remaining()
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "recovery", name, strconv.Itoa(remaining), strconv.Itoa(len(set.Codes)), strconv.FormatBool(remaining <= low))
+					continue
+				}
+				mark := output.OK
+				if remaining <= low {
+					mark = output.Warn
+				}
+				fmt.Printf("%s %-20s %d of %d codes left (added %s)\n", mark, name, remaining, len(set.Codes), set.Added.Format(time.DateOnly))
+			}
+		},
+	}
+	recoveryAddCmd.Flags().String("codes-file", "", "File with one recovery code per line, or - for stdin")
+	recoveryAddCmd.Flags().Bool("replace", false, "Replace an existing set of codes")
+	recoveryStatusCmd.Flags().Int("low", recovery.DefaultLow, "Warn when this many codes or fewer remain")
+	recoveryCmd.AddCommand(recoveryAddCmd, recoveryUseCmd, recoveryStatusCmd)
+
+	// run command - Run a command with secrets in environment
+	runCmd := &cobra.Command{
+		Use:   "run -- command [args...]",
+		Short: "Run a command with secrets in environment",
+		Long: `Execute a command with all stored secrets set as environment variables.
+Usage:
+  lockbox run -- sh -c 'echo $SECRET_VAR'
+  lockbox run -- env | grep SECRET
+  lockbox run -- ./my-app
+
+--only, --prefix and --exclude scope the secrets the command sees:
+  lockbox run --prefix DB_ -- ./migrate
+  lockbox run --only API_KEY,API_URL -- ./client
+  lockbox run --exclude 'AWS_*' -- ./app
+--only takes keys and glob patterns that must exist; --exclude drops
+whatever its keys and patterns match.
+
+With --snapshot the command gets the values a snapshot holds instead of
+the current ones (see 'lockbox snapshot').
+
+A value that cannot be decrypted stops the command from starting. With
+--strict every value is still decrypted first, so each one that fails is
+named; --skip-bad warns about such values and runs the command without
+them. Both apply to the local store.`,
+		TraverseChildren: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Check for remote flag
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+			snapshotFlag, _ := cmd.Flags().GetString("snapshot")
+			filter := keyFilter(cmd)
+
+			var secrets map[string]string
+			var err error
+
+			if remoteFlag != "" && snapshotFlag != "" {
+				fmt.Fprintf(os.Stderr, "Error: --snapshot cannot be used with --remote\n")
+				exit(1)
+			}
+
+			if snapshotFlag != "" {
+				store, encKey, err := getStoreAndKey()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				defer store.Close()
+
+				secrets, err = snapshotValues(store, encKey, snapshotFlag)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				var keys []string
+				secrets, keys, err = filterValues(secrets, filter)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				recordAccess(store, keys)
+			} else if remoteFlag != "" {
+				// Fetch secrets from remote server over pooled connections
+				remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+				secrets, err = remote.FetchAll()
+				remote.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if secrets, _, err = filterValues(secrets, filter); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			} else {
+				// Get all secrets from local store
+				store, encKey, err := getStoreAndKey()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				defer store.Close()
+
+				keys, err := store.ListSecrets()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+					exit(1)
+				}
+				if keys, err = filter.Apply(keys); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				strict, skipBad := badValueFlags(cmd)
+				if strict {
+					checkValues(store, encKey, keys, "the command was not run")
+				}
+
+				secrets = make(map[string]string)
+				var skipped []string
+				err = bulk.Decrypt(store, encKey, keys, func(key string, decrypted []byte, err error) error {
+					if err != nil && skipBad {
+						fmt.Fprintf(os.Stderr, "Warning: %v; skipped\n", err)
+						skipped = append(skipped, key)
+						return nil
+					} else if err != nil {
+						return err
+					}
+					secrets[key] = string(decrypted)
+					return nil
+				})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				recordAccess(store, reportSkipped(keys, skipped))
+			}
+
+			// Build environment with secrets
+			env := os.Environ()
+			for key, value := range secrets {
+				env = append(env, fmt.Sprintf("%s=%s", key, value))
+			}
+
+			// Need at least one argument for the command
+			if len(args) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: no command provided\n")
+				fmt.Fprintf(os.Stderr, "Usage: lockbox run -- command [args...]\n")
+				exit(1)
+			}
+
+			// Execute the command
+			execCmd := exec.Command(args[0], args[1:]...)
+			execCmd.Env = env
+			execCmd.Stdin = os.Stdin
+			execCmd.Stdout = os.Stdout
+			execCmd.Stderr = os.Stderr
+
+			err = execCmd.Run()
+			if err != nil {
+				// Check if it's an exit error to get the exit code
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					exit(exitErr.ExitCode())
+				}
+				fmt.Fprintf(os.Stderr, "Error: failed to execute command: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	// native-host command - Serve credentials to a browser extension
+	nativeHostCmd := &cobra.Command{
+		Use:   "native-host",
+		Short: "Serve credentials to a browser extension over native messaging",
+		Long: `Answer a companion browser extension over the Chrome and Firefox native
+messaging protocol, so site logins can be filled without the clipboard.
+The browser starts this command itself once 'lockbox native-host install'
+has registered it.
+
+Only secrets tagged with the site's domain are offered, on https pages of
+that domain and its subdomains:
+  lockbox set GITHUB_PASSWORD --tag domain:github.com
+Every value handed out is first confirmed with Touch ID, Windows Hello or
+a polkit prompt, and recorded in the audit log.
+
+The extension sends {"type": "list", "url": URL} for the secrets offered on
+a page and {"type": "get", "url": URL, "key": KEY} for a value, with an
+optional "id" echoed in the response.`,
+		// The browser passes the extension's origin or manifest
+		Args: cobra.ArbitraryArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			h := nativehost.StoreHandler{Store: store, Key: encKey, Actor: localActor(store).Owner, Confirm: presence.Confirm}
+			if err := nativehost.Serve(os.Stdin, os.Stdout, h); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	nativeHostInstallCmd := &cobra.Command{
+		Use:   "install BROWSER EXTENSION_ID",
+		Short: "Let a browser extension start the native host",
+		Long: `Register the native host for the current user with BROWSER (chrome,
+chromium or firefox), allowing only the extension EXTENSION_ID to start it,
+against the store in use now:
+  lockbox native-host install chrome abcdefghijklmnopabcdefghijklmnop
+  lockbox native-host install firefox lockbox@example.com
+On Windows the manifest must be registered by hand.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir, err := nativehost.ManifestDir(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			exe, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			dbPath, err := db.ResolvePath()
+			if err == nil {
+				dbPath, err = filepath.Abs(dbPath)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			wrapper := filepath.Join(dir, nativehost.Name+".sh")
+			manifest, err := nativehost.Manifest(args[0], args[1], wrapper)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := os.WriteFile(wrapper, nativehost.Wrapper(exe, dbPath), 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			path := filepath.Join(dir, nativehost.Name+".json")
+			if err := os.WriteFile(path, manifest, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Installed the native host for %s at %s\n", output.OK, args[0], path)
+		},
+	}
+	nativeHostCmd.AddCommand(nativeHostInstallCmd)
+
+	// entrypoint command - Container ENTRYPOINT wrapper
+	entrypointCmd := &cobra.Command{
+		Use:   "entrypoint -- command [args...]",
+		Short: "Container entrypoint that injects remote secrets",
+		Long: `Drop-in Docker ENTRYPOINT wrapper. Fetches secrets once from
+LOCKBOX_REMOTE (or --remote), retrying while the server comes up, then
+execs the real entrypoint with the secrets in its environment.
+LOCKBOX_TOKEN, if set, is sent as a bearer token, refreshed with
+LOCKBOX_REFRESH_TOKEN when it has expired, and both are removed from the
+child's environment. As PID 1 lockbox stays resident as a minimal init,
+forwarding signals and reaping zombies:
+  ENTRYPOINT ["lockbox", "entrypoint", "--", "/docker-entrypoint.sh"]`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+			retries, _ := cmd.Flags().GetInt("retries")
+			retryDelay, _ := cmd.Flags().GetDuration("retry-delay")
+
+			if remoteFlag == "" {
+				remoteFlag = os.Getenv("LOCKBOX_REMOTE")
+			}
+			if remoteFlag == "" {
+				fmt.Fprintf(os.Stderr, "Error: LOCKBOX_REMOTE or --remote is required\n")
+				exit(1)
+			}
+
+			remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+			secrets, err := entrypoint.Fetch(remote.FetchAll, retries+1, retryDelay)
+			remote.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			env := entrypoint.MergeEnv(os.Environ(), secrets, "LOCKBOX_TOKEN", "LOCKBOX_REFRESH_TOKEN")
+			code, err := entrypoint.Run(args, env)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			exit(code)
+		},
+	}
+
+	entrypointCmd.Flags().StringP("remote", "r", "", "Remote server to fetch secrets from (default $LOCKBOX_REMOTE)")
+	entrypointCmd.Flags().Int("retries", 5, "Retries while the remote is unreachable")
+	entrypointCmd.Flags().Duration("retry-delay", time.Second, "Delay before the first retry, doubled after each attempt")
+
+	// materialize command - Write secrets to a shared directory
+	materializeCmd := &cobra.Command{
+		Use:   "materialize",
+		Short: "Write remote secrets to a directory and exit",
+		Long: `Fetch secrets from LOCKBOX_REMOTE (or --remote) and write them to a
+directory, for Kubernetes init containers sharing an emptyDir with the app.
+Files are written atomically with strict permissions. Re-runs compare a
+checksum and skip writing when nothing changed; files of deleted secrets
+are removed.
+  lockbox materialize --dir /shared --format files
+  lockbox materialize --dir /shared --format dotenv`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+			dir, _ := cmd.Flags().GetString("dir")
+			format, _ := cmd.Flags().GetString("format")
+			fileMode, _ := cmd.Flags().GetString("mode")
+			retries, _ := cmd.Flags().GetInt("retries")
+			retryDelay, _ := cmd.Flags().GetDuration("retry-delay")
+
+			if remoteFlag == "" {
+				remoteFlag = os.Getenv("LOCKBOX_REMOTE")
+			}
+			if remoteFlag == "" {
+				fmt.Fprintf(os.Stderr, "Error: LOCKBOX_REMOTE or --remote is required\n")
+				exit(1)
+			}
+			if dir == "" {
+				fmt.Fprintf(os.Stderr, "Error: --dir is required\n")
+				exit(1)
+			}
+			mode, err := strconv.ParseUint(fileMode, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: invalid --mode '%s'\n", fileMode)
+				exit(1)
+			}
+
+			remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+			secrets, err := entrypoint.Fetch(remote.FetchAll, retries+1, retryDelay)
+			remote.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			changed, err := materialize.Write(dir, secrets, materialize.Options{Format: format, Mode: os.FileMode(mode)})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if changed {
+				fmt.Printf("%s Wrote %d secrets to %s\n", output.OK, len(secrets), dir)
+			} else {
+				fmt.Printf("%s Secrets in %s are up to date\n", output.OK, dir)
+			}
+		},
+	}
+
+	materializeCmd.Flags().StringP("remote", "r", "", "Remote server to fetch secrets from (default $LOCKBOX_REMOTE)")
+	materializeCmd.Flags().String("dir", "", "Directory to write secrets to")
+	materializeCmd.Flags().String("format", materialize.FormatFiles, "Output format: files (one file per secret) or dotenv ("+materialize.DotenvFile+")")
+	materializeCmd.Flags().String("mode", "0400", "Permissions of written files")
+	materializeCmd.Flags().Int("retries", 5, "Retries while the remote is unreachable")
+	materializeCmd.Flags().Duration("retry-delay", time.Second, "Delay before the first retry, doubled after each attempt")
+
+	// Add --remote flag to run command
+	runCmd.Flags().StringP("remote", "r", "", "Remote server to fetch secrets from (e.g., localhost:8100 or unix:///run/lockbox.sock)")
+	runCmd.Flags().String("snapshot", "", "Use the values held by the snapshot NAME")
+	runCmd.Flags().StringSlice("only", nil, "Pass only these keys or patterns (comma-separated)")
+	runCmd.Flags().StringSlice("prefix", nil, "Pass only keys starting with this prefix (repeatable)")
+	runCmd.Flags().StringSlice("exclude", nil, "Leave out these keys or patterns (comma-separated)")
+
+	// serve command - Start HTTP server
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Start HTTP server for remote access",
+		Long: `Start an HTTP server to expose secrets for remote access.
+Endpoints:
+  GET /health - Returns {"status":"ok"}
+  GET /healthz - Liveness probe, same as /health
+  GET /readyz - Readiness checks as JSON, 503 when not ready
+  GET /secrets - Returns JSON array of all secret keys
+  GET /secrets/:key - Returns decrypted secret value as plain text
+  PUT /secrets/:key - Sets a secret to the request body
+  DELETE /secrets/:key - Deletes a secret
+  POST /secrets - Sets every secret in a JSON object of keys to values, all or none
+  GET /env - Returns all secrets in export KEY="value" format
+  /vaults/:vault/secrets, /vaults/:vault/secrets/:key, /vaults/:vault/env - The same for a named vault
+  GET /v1/kv/:key - Read-only Consul KV API for consul-template and envconsul
+  GET /v1/secret/data/:key - Read-only Vault KV v2 API, authenticated with 'lockbox token'
+  POST /v1/auth/oidc/login - Exchange an OIDC ID token for a short-lived token
+  POST /v1/auth/token/refresh - Redeem a refresh token for a new token
+
+Requests to /secrets, /env and /v1/kv/ that send a bearer token only see
+keys granted to the token, and only write keys it holds the write
+permission on.
+
+The server listens on 127.0.0.1 unless --bind names another address,
+such as 0.0.0.0 for devices paired with 'lockbox pair'. Requests without
+a token are only answered from and to localhost; others need a token.
+
+With --tls-cert and --tls-key the server speaks HTTPS. --auto-tls does so
+with a self-signed certificate for localhost, generated next to the store
+and renewed 30 days before it expires; clients connect with --remote
+https://localhost:PORT --ca pointing at it.
+
+With --socket the server listens on a unix socket instead of TCP; clients
+connect with --remote unix:///path/to/socket. Peers running as another OS
+user only see secrets granted to their UID or groups with 'lockbox policy'.
+
+The data key is unwrapped once into locked memory. Secrets are decrypted
+only when requested, and up to --cache-size values are kept for --cache-ttl.
+Any change to the store drops the cache within a second; SIGHUP drops it
+immediately. --cache-size 0 decrypts on every request.
+
+With --sign every response carries a Lockbox-Signature header: an Ed25519
+signature with the store's signing key over the body, status, request and
+time. Clients given the key with --verify-key reject responses that are
+unsigned, altered, answer another request or are more than five minutes
+old, so values cannot be substituted on the way even without TLS. /env
+streams, so its signature follows the body as a trailer.
+
+With --gc-interval the server runs 'lockbox gc' on that schedule, under
+the policy of --gc-keep-versions and --gc-audit-retention.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			port, _ := cmd.Flags().GetString("port")
+			bind, _ := cmd.Flags().GetString("bind")
+			maxBackupAge, _ := cmd.Flags().GetDuration("max-backup-age")
+			tlsCert, _ := cmd.Flags().GetString("tls-cert")
+			tlsKey, _ := cmd.Flags().GetString("tls-key")
+			autoTLS, _ := cmd.Flags().GetBool("auto-tls")
+			socket, _ := cmd.Flags().GetString("socket")
+			socketMode, _ := cmd.Flags().GetString("socket-mode")
+			oidcIssuer, _ := cmd.Flags().GetString("oidc-issuer")
+			oidcClientID, _ := cmd.Flags().GetString("oidc-client-id")
+			tokenTTL, _ := cmd.Flags().GetDuration("token-ttl")
+			refreshTTL, _ := cmd.Flags().GetDuration("refresh-ttl")
+			cacheSize, _ := cmd.Flags().GetInt("cache-size")
+			cacheTTL, _ := cmd.Flags().GetDuration("cache-ttl")
+			rotationInterval, _ := cmd.Flags().GetDuration("rotation-interval")
+			signResponses, _ := cmd.Flags().GetBool("sign")
+			gcInterval, _ := cmd.Flags().GetDuration("gc-interval")
+			gcKeep, _ := cmd.Flags().GetInt("gc-keep-versions")
+			gcRetention, _ := cmd.Flags().GetString("gc-audit-retention")
+			gcOpts := gc.Options{KeepVersions: gcKeep}
+			mode, err := strconv.ParseUint(socketMode, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: invalid --socket-mode '%s'\n", socketMode)
+				exit(1)
+			}
+			if (tlsCert == "") != (tlsKey == "") {
+				fmt.Fprintf(os.Stderr, "Error: --tls-cert and --tls-key must be given together\n")
+				exit(1)
+			}
+			if net.ParseIP(bind) == nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid --bind address '%s'\n", bind)
+				exit(1)
+			}
+			if socket != "" && cmd.Flags().Changed("bind") {
+				fmt.Fprintf(os.Stderr, "Error: --socket cannot be combined with --bind\n")
+				exit(1)
+			}
+			if socket != "" && (tlsCert != "" || autoTLS) {
+				fmt.Fprintf(os.Stderr, "Error: --socket cannot be combined with TLS\n")
+				exit(1)
+			}
+			if autoTLS && tlsCert != "" {
+				fmt.Fprintf(os.Stderr, "Error: --auto-tls cannot be combined with --tls-cert\n")
+				exit(1)
+			}
+			if (oidcIssuer == "") != (oidcClientID == "") {
+				fmt.Fprintf(os.Stderr, "Error: --oidc-issuer and --oidc-client-id must be given together\n")
+				exit(1)
+			}
+			if gcRetention != "" {
+				if gcOpts.AuditRetention, err = gc.ParseRetention(gcRetention); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			// Get store and key once for all handlers
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			// Keep the data key in locked memory for the life of the server
+			guarded := crypto.NewGuardedKey(encKey)
+			defer guarded.Destroy()
+			if !guarded.Locked() {
+				fmt.Fprintf(os.Stderr, "Warning: could not lock the encryption key in memory; it may be swapped to disk\n")
+			}
+
+			opts := server.Options{MaxBackupAge: maxBackupAge, TokenTTL: tokenTTL, RefreshTTL: refreshTTL}
+			if oidcIssuer != "" {
+				opts.OIDC = oidc.NewVerifier(oidc.Config{Issuer: oidcIssuer, ClientID: oidcClientID})
+			}
+			if cacheSize > 0 {
+				opts.Cache = server.NewCache(cacheSize, cacheTTL)
+
+				// SIGHUP drops every cached value
+				hup := make(chan os.Signal, 1)
+				signal.Notify(hup, syscall.SIGHUP)
+				go func() {
+					for range hup {
+						opts.Cache.Purge()
+					}
+				}()
+			}
+			if signResponses {
+				key, err := bundle.SigningKey(store)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				pub := key.Public().(ed25519.PublicKey)
+				opts.Signer = &signing.Signer{Name: bundle.Fingerprint(pub), Key: key}
+			}
+			handler := server.New(store, guarded.Bytes(), opts)
+
+			// Email a digest each period once one is configured
+			go digest.Schedule(cmd.Context(), store, guarded.Bytes(), time.Hour, func(err error) {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+					return
+				}
+				fmt.Printf("%s Sent digest\n", output.OK)
+			})
+
+			// Mirror history to append-only storage
+			go worm.Schedule(cmd.Context(), store, guarded.Bytes(), time.Minute, func(n int, err error) {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+			})
+
+			// Flag unusual reads
+			go anomaly.Schedule(cmd.Context(), store, time.Minute, anomaly.Options{}, func(found []anomaly.Anomaly, err error) {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+					return
+				}
+				for _, a := range anomaly.Group(found) {
+					fmt.Fprintf(os.Stderr, "Warning: unusual access: %s\n", a.Detail)
+					notifyEvent(store, guarded.Bytes(), notify.Event{Type: "anomaly", Key: a.Key, Detail: a.Detail})
+				}
+			})
+
+			// Delete temporary secrets as they expire, and any cached values,
+			// and remind of expired checkouts
+			go func() {
+				ticker := time.NewTicker(time.Minute)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-cmd.Context().Done():
+						return
+					case <-ticker.C:
+					}
+					n, err := store.ExpireTempSecrets(time.Now())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+					} else if n > 0 && opts.Cache != nil {
+						opts.Cache.Purge()
+					}
+					expired, err := store.ExpiredCheckouts(time.Now())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+					}
+					for _, c := range expired {
+						key := store.InVault(c.Vault).Qualify(c.Key)
+						fmt.Fprintf(os.Stderr, "Warning: checkout of %s by %s has expired\n", key, policy.Describe(c.Holder))
+						notifyEvent(store, guarded.Bytes(), notify.Event{Type: "checkout-expired", Key: key, From: policy.Describe(c.Holder)})
+					}
+				}
+			}()
+
+			// Rotate secrets as their rotation rules fall due
+			if rotationInterval > 0 {
+				go rotation.Schedule(cmd.Context(), store, guarded.Bytes(), localActor(store), rotationInterval, func(r rotation.Rule, err error) {
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+						if r.Key != "" {
+							notifyEvent(store, guarded.Bytes(), notify.Event{Type: "rotation-failed", Key: r.Key})
+						}
+						return
+					}
+					fmt.Printf("%s Rotated %s\n", output.OK, r.Key)
+					notifyEvent(store, guarded.Bytes(), notify.Event{Type: "rotation", Key: r.Key})
+				})
+			}
+
+			// Prune old history and orphaned data
+			if gcInterval > 0 {
+				go gc.Schedule(cmd.Context(), store, gcInterval, gcOpts, func(r gc.Result, err error) {
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+						return
+					}
+					store.Audit(localActor(store).Owner, "gc", describeGC(r))
+					fmt.Printf("%s Collected garbage, %s\n", output.OK, describeGC(r))
+				})
+			}
+
+			// A self-signed certificate for localhost, kept next to the store
+			if autoTLS {
+				var created bool
+				tlsCert, tlsKey, created, err = server.AutoTLS(filepath.Join(filepath.Dir(store.Path()), "tls"), time.Now())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to set up TLS: %v\n", err)
+					exit(1)
+				}
+				if created {
+					fmt.Printf("%s Generated a self-signed certificate: %s\n", output.OK, tlsCert)
+				}
+				fmt.Printf("  Clients trust it with --ca %s\n", tlsCert)
+			}
+
+			if opts.Signer != nil {
+				fmt.Printf("  Responses are signed; clients verify them with --verify-key %s\n", hex.EncodeToString(opts.Signer.Key.Public().(ed25519.PublicKey)))
+			}
+
+			// Start server on --bind, localhost by default, or on a unix
+			// socket without any TCP port
+			addr := net.JoinHostPort(bind, port)
+			srv := server.NewHTTPServer(addr, handler, opts)
+			switch {
+			case socket != "":
+				ln, lnErr := server.ListenUnix(socket, os.FileMode(mode))
+				if lnErr != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", lnErr)
+					exit(1)
+				}
+				fmt.Printf("%s Server listening on unix://%s\n", output.OK, socket)
+				err = srv.Serve(ln)
+			case tlsCert != "":
+				fmt.Printf("%s Server listening on https://%s\n", output.OK, addr)
+				err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+			default:
+				fmt.Printf("%s Server listening on http://%s\n", output.OK, addr)
+				err = srv.ListenAndServe()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: server failed: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	// Add --port flag to serve command
+	serveCmd.Flags().StringP("port", "p", "8100", "Port to listen on")
+	serveCmd.Flags().String("bind", "127.0.0.1", "Address to listen on; 0.0.0.0 accepts connections from other machines, which need a token")
+	serveCmd.Flags().Duration("max-backup-age", 0, "Fail readiness when the last backup is older than this (e.g., 24h)")
+	serveCmd.Flags().String("tls-cert", "", "TLS certificate file; serves HTTPS with HTTP/2 when set with --tls-key")
+	serveCmd.Flags().String("tls-key", "", "TLS private key file")
+	serveCmd.Flags().Bool("auto-tls", false, "Serve HTTPS with a self-signed certificate for localhost, generated next to the store")
+	serveCmd.Flags().String("socket", "", "Listen on this unix socket instead of a TCP port (e.g., /run/lockbox.sock)")
+	serveCmd.Flags().String("socket-mode", "0600", "Permissions of the unix socket; widen (e.g., 0666) to let other local users connect under policies")
+	serveCmd.Flags().String("oidc-issuer", "", "OIDC issuer URL to accept 'lockbox login' ID tokens from")
+	serveCmd.Flags().String("oidc-client-id", "", "OIDC client ID that login ID tokens must be issued to")
+	serveCmd.Flags().Duration("token-ttl", server.DefaultTokenTTL, "Lifetime of tokens issued by 'lockbox login'")
+	serveCmd.Flags().Duration("refresh-ttl", server.DefaultRefreshTTL, "How long 'lockbox login' sessions can be refreshed before logging in again")
+	serveCmd.Flags().Int("cache-size", server.DefaultCacheSize, "Number of decrypted values to keep in memory (0 disables the cache)")
+	serveCmd.Flags().Duration("cache-ttl", server.DefaultCacheTTL, "How long a decrypted value stays cached")
+	serveCmd.Flags().Duration("rotation-interval", time.Minute, "How often to rotate secrets whose rotation rules are due (0 disables)")
+	serveCmd.Flags().Bool("sign", false, "Sign every response with the store's Ed25519 key, for clients to verify with --verify-key")
+	serveCmd.Flags().Duration("gc-interval", 0, "How often to run 'lockbox gc' (0 disables)")
+	serveCmd.Flags().Int("gc-keep-versions", 0, "Escrowed versions the scheduled gc keeps of each secret (0 keeps all)")
+	serveCmd.Flags().String("gc-audit-retention", "", "Audit and access log retention of the scheduled gc, e.g. 180d (default: keep them)")
+
+	// login command - Exchange an OIDC login for a short-lived token
+	loginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Log in to a remote server with its identity provider",
+		Long: `Run the OIDC device flow against the identity provider configured on a
+remote server with --oidc-issuer, and exchange the ID token for a
+short-lived lockbox token. The token is saved and used automatically by
+'run --remote' and 'env --remote' until it expires; it sees only the keys
+granted to its claims with 'lockbox policy allow --claim'.
+  lockbox login --remote lockbox.internal:8100`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+			if remoteFlag == "" {
+				fmt.Fprintf(os.Stderr, "Error: --remote is required\n")
+				exit(1)
+			}
+			path, err := credentialsPath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			remote := client.New(remoteFlag, remoteTLS())
+			defer remote.Close()
+
+			config, err := remote.OIDCConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			provider, err := oidc.Discover(cmd.Context(), config.Issuer)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			idToken, err := provider.DeviceLogin(cmd.Context(), config.ClientID, func(code oidc.DeviceCode) {
+				if code.VerificationURIComplete != "" {
+					fmt.Fprintf(os.Stderr, "Open %s to log in (code %s)\n", code.VerificationURIComplete, code.UserCode)
+				} else {
+					fmt.Fprintf(os.Stderr, "Open %s and enter code %s\n", code.VerificationURI, code.UserCode)
+				}
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			cred, err := remote.Login(idToken)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := client.SaveCredential(path, remoteFlag, cred); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Printf("%s Logged in to %s until %s\n", output.OK, remoteFlag, cred.ExpiresAt.Local().Format(time.RFC3339))
+		},
+	}
+	loginCmd.Flags().StringP("remote", "r", "", "Remote server to log in to (e.g., localhost:8100)")
+
+	// status command - Report store readiness
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show store readiness",
+		Long: `Run the readiness checks (database reachable, key usable, disk writable,
+last backup age) against the local store or a remote server's /readyz.
+With --check the exit code is 1 when any check fails, for use in
+container health probes:
+  lockbox status --check
+  lockbox status --check --remote localhost:8100`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			check, _ := cmd.Flags().GetBool("check")
+			asJSON, _ := cmd.Flags().GetBool("json")
+			remoteFlag, _ := cmd.Flags().GetString("remote")
+			maxBackupAge, _ := cmd.Flags().GetDuration("max-backup-age")
+
+			var report health.Report
+			if remoteFlag != "" {
+				// Ask the remote server; 503 still carries a report body
+				resp, err := client.New(remoteFlag, remoteTLS()).Get("/readyz")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to fetch from remote: %v\n", err)
+					exit(1)
+				}
+				defer resp.Body.Close()
+
+				if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to decode remote response: %v\n", err)
+					exit(1)
+				}
+			} else {
+				store, encKey, err := getStoreAndKey()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				defer store.Close()
+
+				report = health.Readiness(store, encKey, health.Options{MaxBackupAge: maxBackupAge})
+			}
+
+			switch {
+			case asJSON:
+				json.NewEncoder(os.Stdout).Encode(report)
+			case isPorcelain(cmd):
+				for _, c := range report.Checks {
+					porcelain.Write(os.Stdout, "check", c.Name, c.Status, c.Message)
+				}
+				ready := "not-ready"
+				if report.Ready() {
+					ready = "ready"
+				}
+				porcelain.Write(os.Stdout, "status", ready)
+			default:
+				for _, c := range report.Checks {
+					if c.Message != "" {
+						fmt.Printf("%-10s %-8s %s\n", c.Name, c.Status, c.Message)
+					} else {
+						fmt.Printf("%-10s %s\n", c.Name, c.Status)
+					}
+				}
+				if report.Ready() {
+					fmt.Println(output.OK, "Lockbox is ready")
+				} else {
+					fmt.Println(output.Fail, "Lockbox is not ready")
+				}
+			}
+
+			if check && !report.Ready() {
+				exit(1)
+			}
+		},
+	}
+
+	statusCmd.Flags().Bool("check", false, "Exit with code 1 when any check fails")
+	statusCmd.Flags().Bool("json", false, "Print the report as JSON")
+	statusCmd.Flags().StringP("remote", "r", "", "Remote server to check (e.g., localhost:8100)")
+	statusCmd.Flags().Duration("max-backup-age", 0, "Fail when the last backup is older than this (e.g., 24h)")
+
+	// stats command - Summarise the store for monitoring
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show counts and ages of the store's contents",
+		Long: `Show secret counts by type, tag and profile, the size of the store on disk,
+version counts, the rotation rule gone longest without rotating, expired
+secrets and the time of the last backup. Nothing is decrypted, so the key
+is not needed.
+
+--json prints a stable schema for cron-based monitoring, versioned by its
+schema_version field:
+  lockbox stats --json | jq -e '.expired == 0'`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			asJSON, _ := cmd.Flags().GetBool("json")
+
+			store, err := db.NewStore()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to open store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			current := cmp.Or(os.Getenv("LOCKBOX_PROFILE"), setup.DefaultProfile)
+			names, err := db.ListProfiles()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			paths := map[string]string{}
+			for _, name := range append([]string{setup.DefaultProfile}, names...) {
+				if paths[name], err = setupStorePath(name); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			profiles, err := stats.CountProfiles(paths)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			st, err := stats.Collect(store, current, profiles, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			switch format := outputFormat(cmd); {
+			case asJSON:
+				writeOutput("json", st)
+			case format != output.Text:
+				writeOutput(format, st)
+			default:
+				stats.WriteText(os.Stdout, st)
+			}
+		},
+	}
+
+	statsCmd.Flags().Bool("json", false, "Print the stats as JSON (same as --output json)")
+
+	// verify command - Check the crypto backend and that every value decrypts
+	verifyCmd := &cobra.Command{
+		Use:   "verify [--quick]",
+		Short: "Check the crypto backend and that stored values decrypt",
+		Long: `Run the crypto self-test and check the encryption key against the store's
+sentinel record, as every command does on startup, then decrypt every
+stored value. With --quick only the startup checks are run. The exit
+code is 1 when any check fails.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			quick, _ := cmd.Flags().GetBool("quick")
+
+			// Opening the store runs the self-test and sentinel check
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			fmt.Println(output.OK, "Crypto self-test passed")
+			fmt.Println(output.OK, "Encryption key matches this store")
+			if quick {
+				return
+			}
+
+			keys, err := store.ListAllSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			failed := 0
+			bulk.Map(keys, bulk.Workers, func(k string) (struct{}, error) {
+				value, err := store.GetSecret(k)
+				if err == nil {
+					_, err = crypto.Decrypt(value, key)
+				}
+				return struct{}{}, err
+			}, func(k string, _ struct{}, err error) error {
+				if err != nil {
+					fmt.Printf("%s %s: %v\n", output.Fail, k, err)
+					failed++
+				}
+				return nil
+			})
+			if failed > 0 {
+				fmt.Fprintf(os.Stderr, "Error: %d of %d values cannot be decrypted\n", failed, len(keys))
+				exit(1)
+			}
+			fmt.Printf("%s All %d stored values decrypt\n", output.OK, len(keys))
+		},
+	}
+	verifyCmd.Flags().Bool("quick", false, "Only run the self-test and key check")
+
+	// upgrade-store command - Bring an old store up to the current format
+	upgradeStoreCmd := &cobra.Command{
+		Use:   "upgrade-store [--check]",
+		Short: "Upgrade an old store to the current format",
+		Long: `Bring a store written by an older release up to the current format:
+apply pending schema migrations, move values stored inline by the first
+release into shared blobs, and rebuild indexes. A copy of the store is
+written next to it first (or to --backup). With --check nothing is
+changed; the pending work is printed and the exit code is 1 if there is
+any.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			check, _ := cmd.Flags().GetBool("check")
+			backupPath, _ := cmd.Flags().GetString("backup")
+
+			path, err := db.ResolvePath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			st, err := db.Inspect(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if st.Current() {
+				fmt.Printf("%s Store is up to date (schema version %d)\n", output.OK, st.Version)
+				return
+			}
+			if st.Version < st.Latest {
+				fmt.Printf("Schema version %d -> %d (%d migrations)\n", st.Version, st.Latest, st.Latest-st.Version)
+			}
+			if st.Inline > 0 {
+				fmt.Printf("%d values stored inline will move to shared blobs\n", st.Inline)
+			}
+			if check {
+				exit(1)
+			}
+
+			if backupPath == "" {
+				backupPath = fmt.Sprintf("%s.pre-upgrade-%s", path, time.Now().Format("20060102-150405"))
+			}
+			if err := db.Backup(path, backupPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Backed up the store to %s\n", output.OK, backupPath)
+
+			// Opening the store applies the migrations
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can upgrade it\n")
+				exit(1)
+			}
+
+			inline, err := store.InlineSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			for _, k := range inline {
+				value, err := store.GetSecret(k)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				plaintext, err := crypto.Decrypt(value, key)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to decrypt '%s': %v\n", k, err)
+					exit(1)
+				}
+				digest, err := crypto.Digest(plaintext, key)
+				if err == nil {
+					err = store.MoveToBlob(k, digest)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if err := store.Reindex(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Store upgraded to schema version %d\n", output.OK, st.Latest)
+		},
+	}
+	upgradeStoreCmd.Flags().Bool("check", false, "Only report what would change")
+	upgradeStoreCmd.Flags().String("backup", "", "Where to write the pre-upgrade copy (default: next to the store)")
+
+	// gc command - Prune old history and orphaned data
+	gcCmd := &cobra.Command{
+		Use:   "gc [--keep-versions N] [--audit-retention DURATION]",
+		Short: "Prune old history and orphaned data",
+		Long: `Delete what the store no longer needs and return the space to the
+filesystem. Rows nothing refers to any more, such as unreferenced blobs
+and stale search index entries, are always removed. With
+--audit-retention, audit and access log entries older than the period go
+too, except audit events not yet shipped to WORM targets; with
+--keep-versions, the escrow archive keeps only the newest N versions of
+each secret. The database is pruned in one transaction:
+  lockbox gc --keep-versions 10 --audit-retention 180d
+'lockbox serve --gc-interval 24h' runs the same collection on a schedule.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			keep, _ := cmd.Flags().GetInt("keep-versions")
+			retentionFlag, _ := cmd.Flags().GetString("audit-retention")
+			opts := gc.Options{KeepVersions: keep}
+			if retentionFlag != "" {
+				var err error
+				if opts.AuditRetention, err = gc.ParseRetention(retentionFlag); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can collect garbage\n")
+				exit(1)
+			}
+
+			r, err := gc.Run(store, opts, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "gc", describeGC(r))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "gc", strconv.Itoa(r.AuditEvents), strconv.Itoa(r.Accesses), strconv.Itoa(r.Versions), strconv.Itoa(r.Orphans), strconv.FormatInt(r.Reclaimed, 10))
+				return
+			}
+			fmt.Printf("%s Reclaimed %s\n", output.OK, formatBytes(r.Reclaimed))
+			fmt.Printf("  Pruned %d audit events, %d reads, %d versions and %d orphaned rows\n", r.AuditEvents, r.Accesses, r.Versions, r.Orphans)
+		},
+	}
+	gcCmd.Flags().Int("keep-versions", 0, "Escrowed versions to keep of each secret (0 keeps all)")
+	gcCmd.Flags().String("audit-retention", "", "Prune audit and access log entries older than this, e.g. 180d (default: keep them)")
+
+	// prune command - Delete expired secrets
+	pruneCmd := &cobra.Command{
+		Use:   "prune [--dry-run]",
+		Short: "Delete expired secrets",
+		Long: `Delete the secrets of the current vault whose --ttl or --expires has
+passed (see 'lockbox set'). Expired secrets are already left out of env,
+run and the server; pruning removes them for good, archiving them to
+escrow like any delete. --dry-run prints what would be deleted:
+  lockbox list --expired
+  lockbox prune`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin of the store can prune it\n")
+				exit(1)
+			}
+
+			var keys []string
+			if dryRun {
+				keys, err = store.ListExpiredSecrets(time.Now())
+			} else {
+				keys, err = store.PruneExpired(time.Now())
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if !dryRun && len(keys) > 0 {
+				store.Audit(actor.Owner, "secrets-pruned", strings.Join(keys, ","))
+			}
+
+			if isPorcelain(cmd) {
+				record := map[bool]string{false: "secret-deleted", true: "secret-expired"}[dryRun]
+				for _, key := range keys {
+					porcelain.Write(os.Stdout, record, key)
+				}
+				return
+			}
+			if len(keys) == 0 {
+				fmt.Println("No expired secrets")
+				return
+			}
+			for _, key := range keys {
+				if dryRun {
+					fmt.Printf("Would delete '%s'\n", key)
+				} else {
+					fmt.Printf("%s Secret '%s' deleted\n", output.OK, key)
+				}
+			}
+		},
+	}
+	pruneCmd.Flags().Bool("dry-run", false, "Print the expired secrets without deleting them")
+
+	// config command - Export and import the setup of this machine's stores
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Export and import the setup of this machine's stores",
+		Long: `Capture how the stores on this machine are configured and apply the same
+setup elsewhere, making workstation setup scriptable. A setup holds each
+profile's vaults, custom roles, policies, rotation rules and notification
+targets, and the remotes logged in to. It never holds secret values: a
+notification target names the secret holding its webhook URL, such as
+NOTIFY_OPS_URL, and that secret must be set before the setup is imported.
+  lockbox config export > lockbox-setup.yaml
+  lockbox config import lockbox-setup.yaml`,
+	}
+
+	configExportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print the setup of every profile as YAML",
+		Long: `Print the setup of the default store and every profile as YAML, or as
+JSON with --output json. With --profile only that profile is exported.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			names := []string{cmp.Or(os.Getenv("LOCKBOX_PROFILE"), setup.DefaultProfile)}
+			if os.Getenv("LOCKBOX_PROFILE") == "" {
+				profiles, err := db.ListProfiles()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				names = append(names, profiles...)
+			}
+
+			s := setup.Setup{Format: setup.Format}
+			for _, name := range names {
+				dbPath, err := setupStorePath(name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+					if name == setup.DefaultProfile {
+						continue
+					}
+					fmt.Fprintf(os.Stderr, "Error: profile '%s' has no store; create it with 'lockbox --profile %s init'\n", name, name)
+					exit(1)
+				}
+				store, encKey, err := openStoreAndKey(dbPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: profile %s: %v\n", name, err)
+					exit(1)
+				}
+				actor := localActor(store)
+				if !actor.Admin {
+					fmt.Fprintf(os.Stderr, "Error: profile %s: only the store's owner can export its setup\n", name)
+					exit(1)
+				}
+				p, warnings, err := setup.Export(store, encKey, name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: profile %s: %v\n", name, err)
+					exit(1)
+				}
+				store.Audit(actor.Owner, "config-exported", "")
+				store.Close()
+				for _, w := range warnings {
+					fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+				}
+				s.Profiles = append(s.Profiles, p)
+
+				remotes, err := client.Remotes(filepath.Join(filepath.Dir(dbPath), "credentials.json"))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				for _, r := range remotes {
+					if !slices.Contains(s.Remotes, r) {
+						s.Remotes = append(s.Remotes, r)
+					}
+				}
+			}
+			if len(s.Profiles) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: Lockbox is not initialized; run 'lockbox init' first\n")
+				exit(1)
+			}
+			slices.Sort(s.Remotes)
+
+			format := outputFormat(cmd)
+			if format == output.Text {
+				format = "yaml"
+			}
+			writeOutput(format, s)
+		},
+	}
+
+	configImportCmd := &cobra.Command{
+		Use:   "import FILE | -",
+		Short: "Apply a setup written by 'config export'",
+		Long: `Apply a setup read from FILE, or stdin for -, to the stores on this
+machine. Profiles without a store get one, its key kept in --key-backend.
+Vaults, roles, policies, rotation rules and notification targets are
+created or replaced by name, and anything else already configured is
+kept, so importing the same setup twice changes nothing. Each profile is
+checked in full before anything in it is written. Remotes are not logged
+in to; run 'lockbox login' for each one listed.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			backend, _ := cmd.Flags().GetString("key-backend")
+			if !slices.Contains(keysource.Backends, backend) {
+				fmt.Fprintf(os.Stderr, "Error: unknown key backend '%s' (supported: %s)\n", backend, strings.Join(keysource.Backends, ", "))
+				exit(1)
+			}
+			setTPMPCRs(cmd)
+			setEnclaveConfirm(cmd)
+			backend = enclaveFallback(backend)
+
+			var data []byte
+			var err error
+			if args[0] == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read %s: %v\n", args[0], err)
+				exit(1)
+			}
+			var s setup.Setup
+			// JSON exports are read as JSON, the rest as YAML
+			if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+				err = json.Unmarshal(data, &s)
+			} else {
+				err = yaml.Unmarshal(data, &s)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[0], err)
+				exit(1)
+			}
+			if s.Format != setup.Format {
+				fmt.Fprintf(os.Stderr, "Error: %s: unsupported setup format '%s' (expected %s)\n", args[0], s.Format, setup.Format)
+				exit(1)
+			}
+
+			for _, p := range s.Profiles {
+				dbPath, err := setupStorePath(p.Name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+					store, err := db.OpenStore(dbPath)
+					if err == nil {
+						err = initKey(store, backend)
+						store.Close()
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: profile %s: failed to create store: %v\n", p.Name, err)
+						exit(1)
+					}
+					fmt.Printf("%s Created the store of profile %s\n", output.OK, p.Name)
+				}
+
+				store, encKey, err := openStoreAndKey(dbPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: profile %s: %v\n", p.Name, err)
+					exit(1)
+				}
+				actor := localActor(store)
+				if !actor.Admin {
+					fmt.Fprintf(os.Stderr, "Error: profile %s: only the store's owner can import a setup\n", p.Name)
+					exit(1)
+				}
+				r, err := setup.Apply(store, encKey, p, time.Now())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				detail := fmt.Sprintf("%d vaults, %d roles, %d policies, %d rotation rules, %d notification targets", r.Vaults, r.Roles, r.Policies, r.Rotation, r.Notify)
+				store.Audit(actor.Owner, "config-imported", detail)
+				store.Close()
+				fmt.Printf("%s Applied profile %s: %s\n", output.OK, p.Name, detail)
+				for _, w := range r.Warnings {
+					fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+				}
+			}
+			for _, remote := range s.Remotes {
+				fmt.Printf("  Log in to %s with 'lockbox login --remote %s'\n", remote, remote)
+			}
+		},
+	}
+	configImportCmd.Flags().String("key-backend", keysource.Store, "Where to keep the encryption key of stores the import creates: store, passphrase, keychain, tpm or enclave")
+	configImportCmd.Flags().String("tpm-pcrs", "", "PCRs to bind a key sealed to the TPM to, such as 7 or 0+7 (default: none)")
+	configImportCmd.Flags().String("enclave-confirm", "", "How often a key kept in the Secure Enclave asks for Touch ID: never, always, or a duration of up to 5m within which unlocking the Mac counts (default: never)")
+	configCmd.AddCommand(configExportCmd, configImportCmd)
+
+	// provision command - Set up a new server's store without a terminal
+	provisionCmd := &cobra.Command{
+		Use:   "provision --from-url URL [--key-from-tpm CREDENTIAL | --key-from-metadata | --passphrase-file FILE]",
+		Short: "Initialize the store from a seed archive without prompting",
+		Long: `Set up a new server's store from cloud-init or Ansible with nobody at a
+terminal: initialize the store if needed, fetch a seed archive, open it,
+and import its secrets. The seed is an archive written with
+'lockbox export seed.lbx --include-key', served over https (a presigned
+URL works) or baked into the image as a file:// URL.
+
+The seed's passphrase is never asked for. It is read from one of:
+  --key-from-tpm CREDENTIAL   a systemd credential sealed to this machine's
+                              TPM with 'systemd-creds encrypt --with-key=tpm2'
+  --key-from-metadata         the lockbox-bootstrap instance tag (AWS IMDSv2)
+                              or metadata attribute (GCP), which only the
+                              instance itself can read
+  --passphrase-file FILE      a file, such as one placed by Ansible
+  $LOCKBOX_ARCHIVE_PASSPHRASE
+For example:
+  lockbox provision --from-url https://seeds.example.com/web.lbx --key-from-tpm /etc/lockbox/seed.cred
+Provisioning again imports only secrets the store lacks, or replaces them
+with --overwrite, so it is safe to rerun.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetString("from-url")
+			credential, _ := cmd.Flags().GetString("key-from-tpm")
+			fromMetadata, _ := cmd.Flags().GetBool("key-from-metadata")
+			passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+			backend, _ := cmd.Flags().GetString("key-backend")
+			overwrite, _ := cmd.Flags().GetBool("overwrite")
+			if from == "" {
+				fmt.Fprintf(os.Stderr, "Error: --from-url is required\n")
+				exit(1)
+			}
+			if !slices.Contains(keysource.Backends, backend) {
+				fmt.Fprintf(os.Stderr, "Error: unknown key backend '%s' (supported: %s)\n", backend, strings.Join(keysource.Backends, ", "))
+				exit(1)
+			}
+			setTPMPCRs(cmd)
+			setEnclaveConfirm(cmd)
+			backend = enclaveFallback(backend)
+
+			// Find the passphrase before anything is written
+			var passphrase string
+			_, fromEnv := os.LookupEnv("LOCKBOX_ARCHIVE_PASSPHRASE")
+			sources := 0
+			for _, set := range []bool{credential != "", fromMetadata, passphraseFile != ""} {
+				if set {
+					sources++
+				}
+			}
+			switch {
+			case sources > 1:
+				fmt.Fprintf(os.Stderr, "Error: specify only one of --key-from-tpm, --key-from-metadata or --passphrase-file\n")
+				exit(1)
+			case credential != "":
+				unsealed, err := tpm.Unseal(credential)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				passphrase = strings.TrimSuffix(string(unsealed), "\n")
+			case fromMetadata:
+				var err error
+				if passphrase, err = provision.InstanceMetadata(cmd.Context(), provision.MetadataName); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			case passphraseFile != "":
+				data, err := os.ReadFile(passphraseFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to read passphrase: %v\n", err)
+					exit(1)
+				}
+				passphrase = strings.TrimSuffix(string(data), "\n")
+			case fromEnv:
+				passphrase = os.Getenv("LOCKBOX_ARCHIVE_PASSPHRASE")
+			default:
+				fmt.Fprintf(os.Stderr, "Error: no seed passphrase; use --key-from-tpm, --key-from-metadata, --passphrase-file or $LOCKBOX_ARCHIVE_PASSPHRASE\n")
+				exit(1)
+			}
+			if passphrase == "" {
+				fmt.Fprintf(os.Stderr, "Error: the seed passphrase is empty\n")
+				exit(1)
+			}
+
+			data, err := provision.Fetch(cmd.Context(), from)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			sealed, err := archive.Read(bytes.NewReader(data))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", provision.Redact(from), err)
+				exit(1)
+			}
+			if len(sealed.Header.Key) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: %s does not carry its key; export the seed with --include-key\n", provision.Redact(from))
+				exit(1)
+			}
+			seedKey, err := sealed.UnwrapKey(passphrase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			a, err := sealed.Open(seedKey)
+			clear(seedKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", provision.Redact(from), err)
+				exit(1)
+			}
+			defer a.Wipe()
+
+			store, err := db.NewStore()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create store: %v\n", err)
+				exit(1)
+			}
+			if _, err = keysource.Backend(store); err == keysource.ErrNotInitialized {
+				err = initKey(store, backend)
+				if err == nil {
+					fmt.Println(output.OK, "Lockbox initialized successfully")
+				}
+			}
+			store.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can provision it\n")
+				exit(1)
+			}
+
+			strategy := archive.Skip
+			if overwrite {
+				strategy = archive.Overwrite
+			}
+			result, err := archive.Restore(store, encKey, a, strategy)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "provisioned", fmt.Sprintf("%s: %d created, %d overwritten, %d skipped", provision.Redact(from), result.Created, result.Overwritten, result.Skipped))
+			fmt.Printf("%s Provisioned %d secret(s) from %s\n", output.OK, result.Created+result.Overwritten, provision.Redact(from))
+			if result.Skipped > 0 {
+				fmt.Printf("  %d skipped, already present\n", result.Skipped)
+			}
+		},
+	}
+	provisionCmd.Flags().String("from-url", "", "Seed archive to fetch: an https:// or file:// URL")
+	provisionCmd.Flags().String("key-from-tpm", "", "Read the seed passphrase from this systemd credential, sealed to the TPM")
+	provisionCmd.Flags().Bool("key-from-metadata", false, "Read the seed passphrase from the instance's lockbox-bootstrap tag or metadata attribute")
+	provisionCmd.Flags().String("passphrase-file", "", "Read the seed passphrase from this file")
+	provisionCmd.Flags().String("key-backend", keysource.Store, "Where to keep the encryption key if the store is created: store, passphrase, keychain, tpm or enclave")
+	provisionCmd.Flags().String("tpm-pcrs", "", "PCRs to bind a key sealed to the TPM to, such as 7 or 0+7 (default: none)")
+	provisionCmd.Flags().String("enclave-confirm", "", "How often a key kept in the Secure Enclave asks for Touch ID: never, always, or a duration of up to 5m within which unlocking the Mac counts (default: never)")
+	provisionCmd.Flags().Bool("overwrite", false, "Replace secrets the store already has")
+
+	// backup command - Full and incremental backups to a directory
+	backupCmd := &cobra.Command{
+		Use:   "backup DIR [--incremental --since last]",
+		Short: "Back up the store to a directory",
+		Long: `Back up the store to DIR. A full backup copies the whole store and starts
+a new chain; --incremental writes only the secrets added, changed or
+deleted since the last backup in DIR, which must be of this store:
+  lockbox backup /var/backups/lockbox
+  lockbox backup /var/backups/lockbox --incremental --since last
+DIR/manifest.json records every backup and its checksum. Check a chain
+with 'lockbox backup verify DIR' and rebuild the store from the full
+backup and its increments with 'lockbox backup restore DIR --to PATH'.
+Backups hold the store key, so protect them like the store, or seal the
+chain when taking its full backup: --compress gzip compresses its files
+and --recipient (an X25519 key from 'lockbox bundle keygen', repeatable)
+or --passphrase encrypts them, so restoring needs one of those rather
+than the store key. Increments are sealed like their chain.
+Temporary secrets ('lockbox temp') are left out unless the full backup
+is taken with --include-temp; its increments then hold them too.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			incremental, _ := cmd.Flags().GetBool("incremental")
+			since, _ := cmd.Flags().GetString("since")
+			if cmd.Flags().Changed("since") && !incremental {
+				fmt.Fprintf(os.Stderr, "Error: --since requires --incremental\n")
+				exit(1)
+			}
+			if since != "last" {
+				fmt.Fprintf(os.Stderr, "Error: unsupported --since %q; increments always follow the last backup\n", since)
+				exit(1)
+			}
+
+			opts := backup.Options{}
+			opts.Compression, _ = cmd.Flags().GetString("compress")
+			opts.IncludeTemp, _ = cmd.Flags().GetBool("include-temp")
+			recipientFiles, _ := cmd.Flags().GetStringArray("recipient")
+			passphrase, _ := cmd.Flags().GetBool("passphrase")
+			if incremental && (opts.Compression != "" || len(recipientFiles) > 0 || passphrase) {
+				fmt.Fprintf(os.Stderr, "Error: increments are sealed like their chain; set --compress, --recipient and --passphrase on the full backup\n")
+				exit(1)
+			}
+			if incremental && opts.IncludeTemp {
+				fmt.Fprintf(os.Stderr, "Error: increments hold temporary secrets only if their chain does; set --include-temp on the full backup\n")
+				exit(1)
+			}
+			for _, file := range recipientFiles {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to read recipient: %v\n", err)
+					exit(1)
+				}
+				pub, err := bundle.ParsePublicKey(data)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %v\n", file, err)
+					exit(1)
+				}
+				opts.Recipients = append(opts.Recipients, backup.X25519Recipient{Key: pub})
+			}
+			if passphrase {
+				p := os.Getenv("LOCKBOX_BACKUP_PASSPHRASE")
+				if p == "" {
+					fmt.Fprintf(os.Stderr, "Error: --passphrase reads LOCKBOX_BACKUP_PASSPHRASE, which is not set\n")
+					exit(1)
+				}
+				opts.Recipients = append(opts.Recipients, backup.PassphraseRecipient{Passphrase: p})
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can back it up\n")
+				exit(1)
+			}
+
+			if !incremental {
+				b, err := backup.Full(store, encKey, args[0], opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					notifyEvent(store, encKey, notify.Event{Type: "backup-failed", Target: args[0], Detail: err.Error()})
+					exit(1)
+				}
+				fmt.Printf("%s Full backup %s (revision %d)\n", output.OK, filepath.Join(args[0], b.File), b.Revision)
+				for _, r := range b.Recipients {
+					fmt.Printf("  encrypted to %s\n", r)
+				}
+				return
+			}
+			b, err := backup.Incremental(store, encKey, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				notifyEvent(store, encKey, notify.Event{Type: "backup-failed", Target: args[0], Detail: err.Error()})
+				exit(1)
+			}
+			fmt.Printf("%s Incremental backup %s (%d changes, revisions %d-%d)\n", output.OK, filepath.Join(args[0], b.File), b.Changes, b.Since, b.Revision)
+		},
+	}
+	backupCmd.Flags().Bool("incremental", false, "Only back up changes since the last backup")
+	backupCmd.Flags().String("since", "last", "Where the increment starts; only 'last' is supported")
+	backupCmd.Flags().String("compress", "", "Compress the chain's files: none or gzip")
+	backupCmd.Flags().StringArray("recipient", nil, "Encrypt the chain to this X25519 public key file (PEM, from 'lockbox bundle keygen'); repeatable")
+	backupCmd.Flags().Bool("passphrase", false, "Encrypt the chain to the passphrase in $LOCKBOX_BACKUP_PASSPHRASE")
+	backupCmd.Flags().Bool("include-temp", false, "Back up temporary secrets too")
+
+	backupVerifyCmd := &cobra.Command{
+		Use:   "verify DIR",
+		Short: "Check the backup chains in a directory",
+		Long: `Check every backup in DIR against its recorded checksum, and that each
+chain starts with a full backup and continues without gaps.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ids, err := backupIdentities(cmd)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			chain, err := backup.Verify(args[0], ids...)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			sealed := false
+			for _, b := range chain {
+				fmt.Printf("%s %s  %s  revision %d  %s\n", output.OK, b.File, b.Type, b.Revision, b.Created.Local().Format(time.DateTime))
+				sealed = sealed || len(b.Recipients) > 0
+			}
+			if sealed && len(ids) == 0 {
+				fmt.Println("  Checksums only: pass --identity or set LOCKBOX_BACKUP_PASSPHRASE to check encrypted contents")
+			}
+			fmt.Printf("%s Backups verified; the newest chain restores to revision %d\n", output.OK, chain[len(chain)-1].Revision)
+		},
+	}
+
+	backupRestoreCmd := &cobra.Command{
+		Use:   "restore DIR --to PATH | FILE.lbx [--only PATTERN]",
+		Short: "Rebuild a store from a backup chain, or restore secrets from an archive",
+		Long: `Verify the backups in DIR and rebuild the store as of the newest one at
+PATH: the chain's full backup with each increment applied in order. PATH
+must not exist; point LOCKBOX_DB_PATH at it to use the restored store.
+
+Given an archive written by 'lockbox export' instead, restore its secrets
+into the current store, or into the store of --to-profile, leaving every
+other secret alone. --only restores just the secrets its patterns select
+(repeatable; vault/KEY for other vaults than the default), so a single
+lost credential can be recovered from an older snapshot:
+  lockbox backup restore monday.lbx --only 'PROD_DB_*' --to-profile prod --no-overwrite
+Existing secrets are replaced, their old values archived to escrow when
+it is on, unless --no-overwrite keeps them.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if info, err := os.Stat(args[0]); err == nil && !info.IsDir() {
+				restoreArchive(cmd, args[0])
+				return
+			}
+			for _, name := range []string{"only", "to-profile", "no-overwrite"} {
+				if cmd.Flags().Changed(name) {
+					fmt.Fprintf(os.Stderr, "Error: --%s restores from an archive, not a backup directory\n", name)
+					exit(1)
+				}
+			}
+
+			to, _ := cmd.Flags().GetString("to")
+			if to == "" {
+				fmt.Fprintf(os.Stderr, "Error: --to is required\n")
+				exit(1)
+			}
+			ids, err := backupIdentities(cmd)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			chain, err := backup.Restore(args[0], to, ids...)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Restored %s from %d backups (revision %d)\n", output.OK, to, len(chain), chain[len(chain)-1].Revision)
+		},
+	}
+	backupRestoreCmd.Flags().String("to", "", "Path of the restored store")
+	backupRestoreCmd.Flags().StringArray("only", nil, "Restore only the secrets of an archive this key or pattern selects; repeatable")
+	backupRestoreCmd.Flags().String("to-profile", "", "Restore an archive into the store of this profile rather than the current one")
+	backupRestoreCmd.Flags().Bool("no-overwrite", false, "Keep secrets that already exist rather than replacing them")
+	for _, c := range []*cobra.Command{backupVerifyCmd, backupRestoreCmd} {
+		c.Flags().StringArray("identity", nil, "X25519 private key file (PEM) able to decrypt the chain; repeatable")
+	}
+	backupDiffCmd := &cobra.Command{
+		Use:   "diff OLD.lbx NEW.lbx",
+		Short: "Show keys added, removed or changed between two archives",
+		Long: `Open two archives written by 'lockbox export' and list the keys added,
+removed or changed from OLD to NEW with when each was last updated, to
+review what changed between scheduled snapshots. Values are compared in
+memory and never printed. Archives including their key are opened with
+the archive passphrase ($LOCKBOX_ARCHIVE_PASSPHRASE), others with the
+current store's key.
+  lockbox backup diff monday.lbx tuesday.lbx`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			archives, err := openArchives(nil, args...)
+			for _, a := range archives {
+				defer a.Wipe()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			diffs, unchanged := archive.Diff(archives[0], archives[1])
+			if isPorcelain(cmd) {
+				for _, d := range diffs {
+					porcelain.Write(os.Stdout, "backup-diff", d.Change, d.Key, porcelain.Time(d.Old), porcelain.Time(d.New))
+				}
+				return
+			}
+			counts := map[string]int{}
+			for _, d := range diffs {
+				counts[d.Change]++
+				switch d.Change {
+				case archive.Added:
+					fmt.Printf("  + %-32s  updated %s\n", d.Key, d.New.Local().Format(time.DateTime))
+				case archive.Removed:
+					fmt.Printf("  - %-32s  updated %s\n", d.Key, d.Old.Local().Format(time.DateTime))
+				case archive.Changed:
+					fmt.Printf("  ~ %-32s  updated %s -> %s\n", d.Key, d.Old.Local().Format(time.DateTime), d.New.Local().Format(time.DateTime))
+				}
+			}
+			fmt.Printf("%d added, %d removed, %d changed, %d unchanged\n", counts[archive.Added], counts[archive.Removed], counts[archive.Changed], unchanged)
+		},
+	}
+
+	backupCmd.AddCommand(backupVerifyCmd, backupRestoreCmd, backupDiffCmd)
+
+	// recovery-kit command - Break-glass recovery of the store's key
+	recoveryKitCmd := &cobra.Command{
+		Use:   "recovery-kit",
+		Short: "Print or restore from an offline recovery kit",
+		Long: `A recovery kit is a printable document holding the store's encryption key,
+its location and schema version, encrypted with a passphrase of its own
+($LOCKBOX_KIT_PASSPHRASE, or asked for). The kit code is printed both as a
+QR code and as text. Print it and keep it offline: with the store restored
+from a backup, the kit gets it open again on a new machine, even when the
+key was kept in the old machine's keychain or its passphrase is lost.
+  lockbox recovery-kit create --out kit.txt
+  lockbox recovery-kit restore kit.txt`,
+	}
+
+	recoveryKitCreateCmd := &cobra.Command{
+		Use:   "create [--out FILE]",
+		Short: "Write a recovery kit for the store",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			out, _ := cmd.Flags().GetString("out")
+
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can create a recovery kit\n")
+				exit(1)
+			}
+
+			backend, err := keysource.Backend(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			st, err := db.Inspect(store.Path())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			path, err := filepath.Abs(store.Path())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			passphrase, err := kitPassphrase(true)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			contents := recoverykit.Contents{Key: key, Store: path, Schema: st.Version, Backend: backend, Created: time.Now().UTC()}
+			code, err := recoverykit.Seal(contents, passphrase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			var doc bytes.Buffer
+			if err := recoverykit.Write(&doc, contents, code); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if out == "" {
+				store.Audit(actor.Owner, "kit-created", "stdout")
+				os.Stdout.Write(doc.Bytes())
+				return
+			}
+			if err := os.WriteFile(out, doc.Bytes(), 0600); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "kit-created", out)
+			fmt.Printf("%s Recovery kit written to %s\n", output.OK, out)
+			fmt.Println("  Print it, store it offline and delete the file")
+		},
+	}
+	recoveryKitCreateCmd.Flags().String("out", "", "File to write the kit to (default: stdout)")
+
+	recoveryKitRestoreCmd := &cobra.Command{
+		Use:   "restore FILE",
+		Short: "Open the store again with a recovery kit",
+		Long: `Read the kit code from FILE ('-' reads stdin), which may be the kit document
+or just the code scanned from its QR code, and save the key it holds for
+the store at --store, by default the location recorded in the kit. The
+store must already be back in place, for example restored with 'lockbox
+backup restore'; the key is checked against it before anything changes.
+The key is kept in --key-backend, by default where it was kept when the
+kit was made.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("store")
+			backend, _ := cmd.Flags().GetString("key-backend")
+			setTPMPCRs(cmd)
+			setEnclaveConfirm(cmd)
+
+			var text []byte
+			var err error
+			if args[0] == "-" {
+				text, err = io.ReadAll(os.Stdin)
+			} else {
+				text, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			code, err := recoverykit.Parse(string(text))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			passphrase, err := kitPassphrase(false)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			contents, err := recoverykit.Open(code, passphrase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer clear(contents.Key)
+
+			if path == "" {
+				path = contents.Store
+			}
+			if backend == "" {
+				backend = contents.Backend
+			}
+			if _, err := os.Stat(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: no store at %s; restore it first, e.g. with 'lockbox backup restore DIR --to %s'\n", path, path)
+				exit(1)
+			}
+
+			store, err := db.OpenStore(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to open store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if err := selfTest(store, contents.Key); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: the kit's key does not open %s: %v\n", path, err)
+				exit(1)
+			}
+			// Reseal to the PCRs the restored store was bound to, and keep
+			// asking for Touch ID as it did
+			if !cmd.Flags().Changed("tpm-pcrs") {
+				keysource.TPMPCRs = keysource.SealedPCRs(store)
+			}
+			if !cmd.Flags().Changed("enclave-confirm") {
+				keysource.EnclaveConfirm = keysource.EnclaveSettings(store)
+			}
+			backend = enclaveFallback(backend)
+
+			if err := keysource.Save(store, contents.Key, backend, newPassphrase); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(localActor(store).Owner, "kit-restored", backend)
+
+			fmt.Printf("%s Restored access to %s (key kept in %s)\n", output.OK, path, backend)
+			if resolved, err := db.ResolvePath(); err == nil && resolved != path {
+				fmt.Printf("  Set LOCKBOX_DB_PATH=%s to use it\n", path)
+			}
+		},
+	}
+	recoveryKitRestoreCmd.Flags().String("store", "", "Store to open (default: the location recorded in the kit)")
+	recoveryKitRestoreCmd.Flags().String("key-backend", "", "Where to keep the key: store, passphrase, keychain, tpm or enclave (default: as when the kit was made)")
+	recoveryKitRestoreCmd.Flags().String("tpm-pcrs", "", "PCRs to bind a key sealed to the TPM to, such as 7 or 0+7 (default: none)")
+	recoveryKitRestoreCmd.Flags().String("enclave-confirm", "", "How often a key kept in the Secure Enclave asks for Touch ID: never, always, or a duration of up to 5m within which unlocking the Mac counts (default: never)")
+	recoveryKitCmd.AddCommand(recoveryKitCreateCmd, recoveryKitRestoreCmd)
+
+	// device command - Enroll and approve the machines sharing a store
+	deviceCmd := &cobra.Command{
+		Use:   "device",
+		Short: "Enroll, approve and revoke devices sharing the store",
+		Long: `Every machine sharing a store, through sync or an agent, is enrolled as a
+device with a key pair of its own. Enrolling runs on the new machine and
+needs no store key: it saves the private key next to the store
+($LOCKBOX_DEVICE_KEY overrides where) and registers the device as pending.
+Once an admin approves it the store key is sealed to the device, which then
+opens the store with its own key.
+
+Revoking a device drops its copy of the key and rotates the store key, so
+it cannot read anything written from then on.
+  lockbox device enroll laptop
+  lockbox device approve laptop --fingerprint SHA256:...
+  lockbox device revoke laptop`,
+	}
+
+	deviceEnrollCmd := &cobra.Command{
+		Use:   "enroll NAME",
+		Short: "Enroll this machine as a device, pending approval",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dbPath, err := db.ResolvePath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, err := db.OpenStore(dbPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to open store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if err := device.ValidateName(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			keyPath := device.KeyPath(dbPath)
+			if data, err := os.ReadFile(keyPath); err == nil {
+				if priv, err := bundle.ParsePrivateKey(data); err == nil {
+					if d, err := device.Find(store, priv.PublicKey()); err == nil && d.Status != device.Revoked {
+						fmt.Fprintf(os.Stderr, "Error: this machine is already enrolled as device '%s' (%s)\n", d.Name, d.Status)
+						exit(1)
+					}
+				}
+			}
+
+			priv, err := bundle.GenerateKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			pem, err := bundle.MarshalPrivateKey(priv)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := os.WriteFile(keyPath, pem, 0600); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to save device key: %v\n", err)
+				exit(1)
+			}
+			actor := localActor(store)
+			d, err := device.Enroll(store, args[0], priv.PublicKey(), actor.Owner, time.Now())
+			if err != nil {
+				os.Remove(keyPath)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "device-enrolled", d.Name+" "+d.Fingerprint())
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "device-enrolled", d.Name, d.Fingerprint())
+				return
+			}
+			fmt.Printf("%s Enrolled device %s (%s)\n", output.OK, d.Name, d.Fingerprint())
+			fmt.Printf("  Key saved to %s; ask an admin to run 'lockbox device approve %s'\n", keyPath, d.Name)
+		},
+	}
+
+	deviceApproveCmd := &cobra.Command{
+		Use:   "approve NAME",
+		Short: "Approve a pending device, sealing the store key to it",
+		Long: `Approve a pending device. Check its fingerprint with whoever enrolled it
+first; --fingerprint refuses the approval if it does not match.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fingerprint, _ := cmd.Flags().GetString("fingerprint")
+
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can approve devices\n")
+				exit(1)
+			}
+			if fingerprint != "" {
+				d, err := device.Get(store, args[0])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if d.Fingerprint() != fingerprint {
+					fmt.Fprintf(os.Stderr, "Error: device '%s' has fingerprint %s, not %s\n", d.Name, d.Fingerprint(), fingerprint)
+					exit(1)
+				}
+			}
+
+			d, err := device.Approve(store, args[0], key, actor.Owner, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "device-approved", d.Name+" "+d.Fingerprint())
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "device-approved", d.Name, d.Fingerprint())
+				return
+			}
+			fmt.Printf("%s Approved device %s (%s)\n", output.OK, d.Name, d.Fingerprint())
+		},
+	}
+	deviceApproveCmd.Flags().String("fingerprint", "", "Only approve if the device key has this fingerprint")
+
+	deviceListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List devices with their status and when they were last seen",
+		Long: `List devices. A device is seen whenever it opens the store with its own
+key.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbPath, err := db.ResolvePath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			// Pending devices can check on themselves without the key
+			store, err := db.OpenStore(dbPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to open store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			devices, err := device.List(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				for _, d := range devices {
+					porcelain.Write(os.Stdout, "device", d.Name, d.Status, d.Fingerprint(), porcelain.Time(d.EnrolledAt), porcelain.Time(d.LastSeen))
+				}
+				return
+			}
+			if len(devices) == 0 {
+				fmt.Println("No devices enrolled")
+				return
+			}
+			for _, d := range devices {
+				seen := "never seen"
+				if !d.LastSeen.IsZero() {
+					seen = "last seen " + d.LastSeen.Local().Format(time.DateTime)
+				}
+				fmt.Printf("%-16s  %-8s  %s  %s\n", d.Name, d.Status, d.Fingerprint(), seen)
+			}
+		},
+	}
+
+	deviceRevokeCmd := &cobra.Command{
+		Use:   "revoke NAME",
+		Short: "Revoke a device and rotate the store key",
+		Long: `Revoke a device: its copy of the store key is dropped and the store key is
+rotated, re-encrypting every secret, so the device cannot read anything
+written from then on. Devices still approved get the new key. Backups,
+recovery kits and escrowed values made before the rotation still need the
+old key: make a new full backup and recovery kit afterwards.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can revoke devices\n")
+				exit(1)
+			}
+
+			d, err := device.Revoke(store, args[0], time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "device-revoked", d.Name+" "+d.Fingerprint())
+			n, err := rotateKey(store, key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: device '%s' is revoked but rotating the store key failed: %v\n", d.Name, err)
+				fmt.Fprintf(os.Stderr, "Run 'lockbox device revoke %s' again to retry\n", d.Name)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "key-rotated", fmt.Sprintf("%d secrets", n))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "device-revoked", d.Name, strconv.Itoa(n))
+				return
+			}
+			fmt.Printf("%s Revoked device %s\n", output.OK, d.Name)
+			fmt.Printf("%s Rotated the store key (%d secrets re-encrypted)\n", output.OK, n)
+			fmt.Println("  Make a new full backup and recovery kit: earlier ones need the old key")
+		},
+	}
+	deviceCmd.AddCommand(deviceEnrollCmd, deviceApproveCmd, deviceListCmd, deviceRevokeCmd)
+
+	vaultCmd := &cobra.Command{
+		Use:   "vault",
+		Short: "Keep isolated sets of secrets in one store",
+		Long: `A vault is a named set of secrets sharing the store's database, key,
+backups and devices. Every store has the default vault; --vault or
+$LOCKBOX_VAULT points any command at another one.
+  lockbox vault create prod
+  lockbox --vault prod set DB_URL postgres://...
+  lockbox --vault prod env
+
+Policies grant keys in a vault as VAULT/KEY, e.g. 'prod/DB_*'.`,
+	}
+
+	// openVaults opens the store for managing its vaults, which --vault
+	// does not scope
+	openVaults := func() (*db.Store, batch.Actor) {
+		os.Unsetenv("LOCKBOX_VAULT")
+		store, _, err := getStoreAndKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		return store, localActor(store)
+	}
+
+	vaultCreateCmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create an empty vault",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := db.ValidateVault(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, actor := openVaults()
+			defer store.Close()
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin can create vaults\n")
+				exit(1)
+			}
+
+			if err := store.CreateVault(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "vault-created", args[0])
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "vault-created", args[0])
+				return
+			}
+			fmt.Printf("%s Vault '%s' created\n", output.OK, args[0])
+			fmt.Printf("  Use it with 'lockbox --vault %s ...' or LOCKBOX_VAULT=%s\n", args[0], args[0])
+		},
+	}
+
+	vaultListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List vaults and how many secrets each holds",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _ := openVaults()
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			vaults, err := store.ListVaults()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			vaults = append([]db.Vault{{Name: db.DefaultVault, Secrets: len(keys)}}, vaults...)
+
+			if isPorcelain(cmd) {
+				for _, v := range vaults {
+					porcelain.Write(os.Stdout, "vault", v.Name, strconv.Itoa(v.Secrets), porcelain.Time(v.Created))
+				}
+				return
+			}
+			for _, v := range vaults {
+				created := ""
+				if !v.Created.IsZero() {
+					created = "created " + v.Created.Local().Format(time.DateTime)
+				}
+				fmt.Printf("%-16s  %5d secrets  %s\n", v.Name, v.Secrets, created)
+			}
+		},
+	}
+
+	vaultDeleteCmd := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a vault and every secret in it",
+		Long: `Delete a vault. A vault that still holds secrets, notes or other
+values is only deleted with --force; with escrow enabled each of them is
+archived first.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			force, _ := cmd.Flags().GetBool("force")
+			if args[0] == db.DefaultVault {
+				fmt.Fprintf(os.Stderr, "Error: the default vault cannot be deleted\n")
+				exit(1)
+			}
+			store, actor := openVaults()
+			defer store.Close()
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin can delete vaults\n")
+				exit(1)
+			}
+
+			if ok, err := store.HasVault(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			} else if !ok {
+				fmt.Fprintf(os.Stderr, "Error: no vault '%s'\n", args[0])
+				exit(1)
+			}
+			keys, err := store.InVault(args[0]).ListAllSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(keys) > 0 && !force {
+				fmt.Fprintf(os.Stderr, "Error: vault '%s' holds %d values; use --force to delete them with it\n", args[0], len(keys))
+				exit(1)
+			}
+
+			n, err := store.DeleteVault(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "vault-deleted", fmt.Sprintf("%s (%d values)", args[0], n))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "vault-deleted", args[0], strconv.Itoa(n))
+				return
+			}
+			fmt.Printf("%s Vault '%s' deleted with %d values\n", output.OK, args[0], n)
+		},
+	}
+	vaultDeleteCmd.Flags().Bool("force", false, "Delete the vault even if it is not empty")
+	vaultCmd.AddCommand(vaultCreateCmd, vaultListCmd, vaultDeleteCmd)
+
+	// workspace command - Project-local stores
+	workspaceCmd := &cobra.Command{
+		Use:   "workspace",
+		Short: "Manage a project-local store in a .lockbox directory",
+		Long: `A workspace is a .lockbox directory in a project holding a store of its
+own. With --workspace (or LOCKBOX_WORKSPACE=1) every command uses the store
+of the nearest workspace at or above the working directory, found the way
+git finds .git. The store in effect is, in order:
+  1. the profile of --profile or LOCKBOX_PROFILE
+  2. the workspace, with --workspace or LOCKBOX_WORKSPACE=1
+  3. the file at LOCKBOX_DB_PATH
+  4. the global store, ~/.lockbox/lockbox.db
+A profile and a workspace cannot be used together.
+  lockbox workspace init
+  lockbox --workspace set DB_URL postgres://localhost/dev
+  lockbox workspace status`,
+	}
+
+	workspaceInitCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a workspace in the current directory",
+		Long: `Create .lockbox/ in the current directory with a new store and a
+.gitignore keeping it out of git. With --commit the .gitignore lets the
+encrypted store be committed and shared with the project; its key must
+then be kept elsewhere, so the key backend defaults to passphrase and the
+store backend is refused.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			commit, _ := cmd.Flags().GetBool("commit")
+			backend, _ := cmd.Flags().GetString("key-backend")
+			if !cmd.Flags().Changed("key-backend") && commit {
+				backend = keysource.Passphrase
+			}
+			if !slices.Contains(keysource.Backends, backend) {
+				fmt.Fprintf(os.Stderr, "Error: unknown key backend '%s' (supported: %s)\n", backend, strings.Join(keysource.Backends, ", "))
+				exit(1)
+			}
+			if commit && backend == keysource.Store {
+				fmt.Fprintf(os.Stderr, "Error: a committed store must not hold its own key; use --key-backend passphrase, keychain or tpm\n")
+				exit(1)
+			}
+			backend = enclaveFallback(backend)
+
+			root, err := os.Getwd()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := workspace.Init(root, commit); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, err := db.OpenStore(workspace.StorePath(root))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create store: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if err := initKey(store, backend); err != nil {
+				store.Close()
+				os.Remove(workspace.StorePath(root))
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Printf("%s Created a workspace in %s\n", output.OK, filepath.Join(root, workspace.DirName))
+			if commit {
+				fmt.Printf("  Commit %s/ to share the encrypted store; its key is kept by the %s backend\n", workspace.DirName, backend)
+			}
+			fmt.Println("  Use it with 'lockbox --workspace ...' or LOCKBOX_WORKSPACE=1")
+		},
+	}
+	workspaceInitCmd.Flags().Bool("commit", false, "Let git commit the encrypted store")
+	workspaceInitCmd.Flags().String("key-backend", keysource.Store, "Where to keep the encryption key: store, passphrase, keychain, tpm or enclave (default passphrase with --commit)")
+
+	workspaceStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the workspace around the current directory and the store in effect",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			wd, err := os.Getwd()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			root, findErr := workspace.Find(wd)
+			if findErr != nil && findErr != workspace.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", findErr)
+				exit(1)
+			}
+			path, err := db.ResolvePath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			var source string
+			switch {
+			case os.Getenv("LOCKBOX_PROFILE") != "":
+				source = "profile " + os.Getenv("LOCKBOX_PROFILE")
+			case os.Getenv("LOCKBOX_WORKSPACE") == "1":
+				source = "workspace"
+			case os.Getenv("LOCKBOX_DB_PATH") != "":
+				source = "LOCKBOX_DB_PATH"
+			default:
+				source = "global"
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "workspace", root, strconv.FormatBool(root != "" && workspace.Committed(root)), path, source)
+				return
+			}
+			switch {
+			case root == "":
+				fmt.Printf("Workspace: none in %s or above\n", wd)
+			case workspace.Committed(root):
+				fmt.Printf("Workspace: %s (store committed to git)\n", root)
+			default:
+				fmt.Printf("Workspace: %s (store kept out of git)\n", root)
+			}
+			fmt.Printf("Store:     %s (%s)\n", path, source)
+			if root != "" && source != "workspace" {
+				fmt.Println("  The workspace is not in use; pass --workspace or set LOCKBOX_WORKSPACE=1")
+			}
+		},
+	}
+
+	workspaceCmd.AddCommand(workspaceInitCmd, workspaceStatusCmd)
+
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Keep the exact values a deploy used",
+		Long: `A snapshot is a named copy of the vault's secrets as they are when it
+is taken. It keeps those values through later sets, deletes and key
+rotations, so the environment of a deploy can be reproduced afterwards:
+  lockbox snapshot create deploy-2024-06-11
+  lockbox run --snapshot deploy-2024-06-11 -- ./my-app
+  lockbox snapshot show deploy-2024-06-11`,
+	}
+
+	snapshotCreateCmd := &cobra.Command{
+		Use:   "create NAME [KEY...]",
+		Short: "Snapshot the vault's secrets, or those matching KEY patterns",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin can create snapshots\n")
+				exit(1)
+			}
+
+			var keys []string
+			if len(args) > 1 {
+				if keys, err = store.ListSecrets(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+					exit(1)
+				}
+				if keys, err = selector.Resolve(keys, args[1:]); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			sn, err := store.CreateSnapshot(args[0], actor.Owner, keys, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "snapshot-created", fmt.Sprintf("%s (%d secrets)", sn.Name, sn.Secrets))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "snapshot-created", sn.Name, strconv.Itoa(sn.Secrets))
+				return
+			}
+			fmt.Printf("%s Snapshot '%s' holds %d secrets (revision %d)\n", output.OK, sn.Name, sn.Secrets, sn.Revision)
+			fmt.Printf("  Run with it: lockbox run --snapshot %s -- command\n", sn.Name)
+		},
+	}
+
+	snapshotListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the vault's snapshots",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			snapshots, err := store.ListSnapshots()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, sn := range snapshots {
+					porcelain.Write(os.Stdout, "snapshot", sn.Name, porcelain.Time(sn.Created), strconv.Itoa(sn.Secrets), strconv.FormatUint(sn.Revision, 10), sn.CreatedBy)
+				}
+				return
+			}
+			if len(snapshots) == 0 {
+				fmt.Println("No snapshots")
+				return
+			}
+			for _, sn := range snapshots {
+				fmt.Printf("%-24s  %s  %5d secrets  by %s\n", sn.Name, sn.Created.Local().Format(time.DateTime), sn.Secrets, sn.CreatedBy)
+			}
+		},
+	}
+
+	snapshotShowCmd := &cobra.Command{
+		Use:   "show NAME",
+		Short: "Show a snapshot's keys and whether they have changed since",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			sn, secrets, err := store.GetSnapshot(args[0])
+			if err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: no snapshot '%s'\n", args[0])
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			// Versions change when the store key is rotated, so compare values
+			status := func(sec db.SnapshotSecret) string {
+				current, err := store.GetSecret(sec.Key)
+				if err == db.ErrNotFound {
+					return "deleted"
+				} else if err != nil {
+					return "unknown"
+				}
+				old, err := crypto.Decrypt(sec.Value, encKey)
+				if err != nil {
+					return "unknown"
+				}
+				now, err := crypto.Decrypt(current, encKey)
+				if err != nil {
+					return "unknown"
+				}
+				if bytes.Equal(old, now) {
+					return "unchanged"
+				}
+				return "changed"
+			}
+
+			if isPorcelain(cmd) {
+				for _, sec := range secrets {
+					porcelain.Write(os.Stdout, "snapshot-secret", sec.Key, strconv.FormatUint(sec.Version, 10), status(sec))
+				}
+				return
+			}
+			fmt.Printf("Snapshot '%s', taken %s by %s at revision %d\n", sn.Name, sn.Created.Local().Format(time.DateTime), sn.CreatedBy, sn.Revision)
+			for _, sec := range secrets {
+				fmt.Printf("  %-32s  v%-4d  %s\n", sec.Key, sec.Version, status(sec))
+			}
+		},
+	}
+
+	snapshotDeleteCmd := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a snapshot and the values it holds",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only an admin can delete snapshots\n")
+				exit(1)
+			}
+
+			if err := store.DeleteSnapshot(args[0]); err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: no snapshot '%s'\n", args[0])
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "snapshot-deleted", args[0])
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "snapshot-deleted", args[0])
+				return
+			}
+			fmt.Printf("%s Snapshot '%s' deleted\n", output.OK, args[0])
+		},
+	}
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotListCmd, snapshotShowCmd, snapshotDeleteCmd)
+
+	// checkout command - Coordinate shared credentials
+	checkoutCmd := &cobra.Command{
+		Use:   "checkout KEY [--for DURATION] [--force]",
+		Short: "Record that you hold a shared secret",
+		Long: `Check out a shared credential, such as an admin account only one person
+should use at a time. The checkout records who holds it and until when,
+and notification targets are told. Checking out a secret someone else
+holds fails until their checkout expires, unless --force takes it over.
+When a checkout expires 'lockbox serve' sends a reminder; it lasts until
+'lockbox checkin'. Checkouts coordinate people: they do not stop anyone
+reading the secret.
+  lockbox checkout SHARED_ADMIN --for 1h
+  lockbox checkout list
+  lockbox checkin SHARED_ADMIN`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+			lifetime, _ := cmd.Flags().GetDuration("for")
+			force, _ := cmd.Flags().GetBool("force")
+			if lifetime <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: --for must be positive\n")
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+
+			expires := time.Now().Add(lifetime)
+			prev, err := store.CheckOut(key, actor.Owner, expires, force)
+			if err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
+				exit(1)
+			} else if err == db.ErrCheckedOut {
+				fmt.Fprintf(os.Stderr, "Error: '%s' is checked out by %s until %s; use --force to take it over\n",
+					key, policy.Describe(prev.Holder), prev.Expires.Local().Format(time.DateTime))
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			detail := "until " + expires.UTC().Format(time.DateTime) + " UTC"
+			if prev.Holder != "" && prev.Holder != actor.Owner {
+				detail += ", taking it over from " + policy.Describe(prev.Holder)
+			}
+			store.Audit(actor.Owner, "checkout", store.Qualify(key)+" "+detail)
+			notifyEvent(store, encKey, notify.Event{Type: "checkout", Key: store.Qualify(key), From: policy.Describe(actor.Owner), Detail: detail})
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "checked-out", key, actor.Owner, porcelain.Time(expires))
+				return
+			}
+			fmt.Printf("%s '%s' checked out until %s\n", output.OK, key, expires.Local().Format(time.DateTime))
+			if prev.Holder != "" && prev.Holder != actor.Owner {
+				fmt.Printf("  Taken over from %s\n", policy.Describe(prev.Holder))
+			}
+		},
+	}
+	checkoutCmd.Flags().Duration("for", time.Hour, "How long you hold the secret")
+	checkoutCmd.Flags().Bool("force", false, "Take the secret over from whoever holds it")
+
+	checkoutListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List checked out secrets and who holds them",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			checkouts, err := store.Checkouts()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			now := time.Now()
+			if isPorcelain(cmd) {
+				for _, c := range checkouts {
+					status := "active"
+					if c.Expired(now) {
+						status = "expired"
+					}
+					porcelain.Write(os.Stdout, "checkout", c.Key, c.Holder, porcelain.Time(c.At), porcelain.Time(c.Expires), status)
+				}
+				return
+			}
+			if len(checkouts) == 0 {
+				fmt.Println("No secrets checked out")
+				return
+			}
+			for _, c := range checkouts {
+				status := "until " + c.Expires.Local().Format(time.DateTime)
+				if c.Expired(now) {
+					status = "expired " + c.Expires.Local().Format(time.DateTime) + ", not checked in"
+				}
+				fmt.Printf("%-32s  %s  %s\n", c.Key, policy.Describe(c.Holder), status)
+			}
+		},
+	}
+	checkoutCmd.AddCommand(checkoutListCmd)
+
+	checkinCmd := &cobra.Command{
+		Use:   "checkin KEY [--force]",
+		Short: "Release a secret you checked out",
+		Long: `End your checkout of a shared secret. --force ends someone else's, for
+a holder who left without checking in.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+			force, _ := cmd.Flags().GetBool("force")
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+
+			c, err := store.CheckIn(key, actor.Owner, force)
+			if err == db.ErrNotFound {
+				fmt.Fprintf(os.Stderr, "Error: '%s' is not checked out\n", key)
+				exit(1)
+			} else if err == db.ErrCheckedOut {
+				fmt.Fprintf(os.Stderr, "Error: '%s' is checked out by %s; use --force to check it in for them\n", key, policy.Describe(c.Holder))
+				exit(1)
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			detail := store.Qualify(key)
+			if c.Holder != actor.Owner {
+				detail += " for " + policy.Describe(c.Holder)
+			}
+			store.Audit(actor.Owner, "checkin", detail)
+			notifyEvent(store, encKey, notify.Event{Type: "checkin", Key: store.Qualify(key), From: policy.Describe(actor.Owner)})
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "checked-in", key)
+				return
+			}
+			fmt.Printf("%s '%s' checked in\n", output.OK, key)
+		},
+	}
+	checkinCmd.Flags().Bool("force", false, "Check in a secret someone else holds")
+
+	// promote command - Copy secrets between profiles
+	promoteCmd := &cobra.Command{
+		Use:   "promote --from PROFILE --to PROFILE [--only PATTERN]...",
+		Short: "Copy secrets from one profile to another",
+		Long: `Copy secrets, or only those matching --only, from one profile's store to
+another's, re-encrypting them with the target's key. The plan is printed
+first: + for keys added to the target, ~ for keys changed and = for keys
+already equal, which are left alone. Promotions are recorded in the
+target's audit log.
+
+With --require-approval nothing is written yet. The request is held in the
+target with an approval code, and a different admin of the target applies
+it with 'lockbox promote approve'. Approval fails if a selected source
+value changed in between, so exactly what was requested is promoted.
+
+Examples:
+  lockbox promote --from staging --to prod --only 'APP_*' --dry-run
+  lockbox promote --from staging --to prod --only 'APP_*' --require-approval
+  lockbox promote approve --to prod lbx_...`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetString("from")
+			to, _ := cmd.Flags().GetString("to")
+			only, _ := cmd.Flags().GetStringArray("only")
+			requireApproval, _ := cmd.Flags().GetBool("require-approval")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if from == "" || to == "" {
+				fmt.Fprintf(os.Stderr, "Error: --from and --to are required\n")
+				exit(1)
+			}
+			if from == to {
+				fmt.Fprintf(os.Stderr, "Error: --from and --to are the same profile\n")
+				exit(1)
+			}
+
+			src, srcKey, err := openProfile(from)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer src.Close()
+			dst, dstKey, err := openProfile(to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer dst.Close()
+
+			items, err := promote.Plan(src, srcKey, dst, dstKey, only)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			changes := printPromotion(items)
+			if changes == 0 {
+				fmt.Printf("Nothing to promote: %d selected secrets are already in %s\n", len(items), to)
+				return
+			}
+			if dryRun {
+				fmt.Printf("Would promote %d secrets from %s to %s\n", changes, from, to)
+				return
+			}
+
+			actor := localActor(dst)
+			if requireApproval {
+				req := promote.Request{From: from, To: to, Items: items, RequestedBy: actor.Owner, RequestedAt: time.Now().UTC()}
+				code, err := promote.Propose(dst, req)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if err := dst.Audit(actor.Owner, "promote-requested", fmt.Sprintf("from %s: %s", from, promote.Summary(items))); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				notifyEvent(dst, dstKey, notify.Event{Type: "promotion-requested", Store: to, From: from, Target: to, Detail: fmt.Sprintf("%d secrets", changes)})
+				fmt.Printf("%s Promotion of %d secrets from %s to %s awaits approval\n", output.OK, changes, from, to)
+				fmt.Printf("  Another admin of %s approves it with:\n  lockbox promote approve --to %s %s\n", to, to, code)
+				return
+			}
+
+			tx, err := dst.Begin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer tx.Rollback()
+			n, err := promote.Apply(src, srcKey, tx, dstKey, actor, items)
+			if err == nil {
+				err = tx.Audit(actor.Owner, "promote", fmt.Sprintf("from %s: %s", from, promote.Summary(items)))
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			notifyEvent(dst, dstKey, notify.Event{Type: "promotion", Store: to, From: from, Target: to, Detail: fmt.Sprintf("%d secrets", n)})
+			fmt.Printf("%s Promoted %d secrets from %s to %s\n", output.OK, n, from, to)
+		},
+	}
+	promoteCmd.Flags().String("from", "", "Profile to copy secrets from")
+	promoteCmd.Flags().String("to", "", "Profile to copy secrets to")
+	promoteCmd.Flags().StringArray("only", nil, "Promote only keys matching this key or pattern (repeatable)")
+	promoteCmd.Flags().Bool("require-approval", false, "Hold the promotion until another admin approves it")
+	promoteCmd.Flags().Bool("dry-run", false, "Show the plan without writing anything")
+
+	promoteApproveCmd := &cobra.Command{
+		Use:   "approve --to PROFILE CODE",
+		Short: "Apply a promotion awaiting approval",
+		Long: `Apply the promotion held in the target profile under an approval code.
+Only an admin of the target other than the one who requested the promotion
+can approve it.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			to, _ := cmd.Flags().GetString("to")
+			if to == "" {
+				fmt.Fprintf(os.Stderr, "Error: --to is required\n")
+				exit(1)
+			}
+			dst, dstKey, err := openProfile(to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer dst.Close()
+			req, err := promote.Pending(dst, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			src, srcKey, err := openProfile(req.From)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer src.Close()
+
+			actor := localActor(dst)
+			tx, err := dst.Begin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer tx.Rollback()
+			err = promote.Approve(tx, args[0], req, actor)
+			var n int
+			if err == nil {
+				n, err = promote.Apply(src, srcKey, tx, dstKey, actor, req.Items)
+			}
+			if err == nil {
+				err = tx.Audit(actor.Owner, "promote", fmt.Sprintf("from %s: %s; requested by %s", req.From, promote.Summary(req.Items), req.RequestedBy))
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			printPromotion(req.Items)
+			notifyEvent(dst, dstKey, notify.Event{Type: "promotion", Store: to, From: req.From, Target: to, Detail: fmt.Sprintf("%d secrets", n)})
+			fmt.Printf("%s Promoted %d secrets from %s to %s, requested by %s\n", output.OK, n, req.From, to, policy.Describe(req.RequestedBy))
+		},
+	}
+	promoteApproveCmd.Flags().String("to", "", "Profile the promotion targets")
+
+	promoteListCmd := &cobra.Command{
+		Use:   "list --to PROFILE",
+		Short: "List promotions awaiting approval",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			to, _ := cmd.Flags().GetString("to")
+			if to == "" {
+				fmt.Fprintf(os.Stderr, "Error: --to is required\n")
+				exit(1)
+			}
+			dst, _, err := openProfile(to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer dst.Close()
+			reqs, err := promote.List(dst)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(reqs) == 0 {
+				fmt.Println("No promotions awaiting approval")
+				return
+			}
+			for _, req := range reqs {
+				fmt.Printf("%s  from %s by %s: %s\n", req.RequestedAt.Local().Format(time.DateTime), req.From, policy.Describe(req.RequestedBy), promote.Summary(req.Items))
+			}
+		},
+	}
+	promoteListCmd.Flags().String("to", "", "Profile to list promotions for")
+	promoteCmd.AddCommand(promoteApproveCmd, promoteListCmd)
+
+	// copy command - Copy secrets into another profile
+	copyCmd := &cobra.Command{
+		Use:   "copy KEY|PATTERN... --to-profile PROFILE",
+		Short: "Copy secrets into the store of another profile",
+		Long: `Copy the selected secrets of the current store into the store of another
+profile, re-encrypting them with that profile's key. Every profile's store
+has its own key, so a store's key never opens another's secrets. Keys
+already in the target with another value are only replaced with
+--overwrite. The copy is recorded in the target's audit log.
+
+A store can forbid copies out of it with 'lockbox policy copy-out deny';
+copy, promote and restoring its archives into another store then fail.
+
+Examples:
+  lockbox copy 'APP_*' --to-profile staging --dry-run
+  lockbox --profile staging copy DB_URL --to-profile dev --overwrite`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			to, _ := cmd.Flags().GetString("to-profile")
+			overwrite, _ := cmd.Flags().GetBool("overwrite")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if to == "" {
+				fmt.Fprintf(os.Stderr, "Error: --to-profile is required\n")
+				exit(1)
+			}
+
+			src, srcKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer src.Close()
+			dst, dstKey, err := openProfile(to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer dst.Close()
+			if a, err := os.Stat(src.Path()); err == nil {
+				if b, err := os.Stat(dst.Path()); err == nil && os.SameFile(a, b) {
+					fmt.Fprintf(os.Stderr, "Error: the current store is the store of profile %s\n", to)
+					exit(1)
+				}
+			}
+
+			items, err := promote.Plan(src, srcKey, dst, dstKey, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			changes := printPromotion(items)
+			var replaced []string
+			for _, item := range items {
+				if item.Change == promote.Update {
+					replaced = append(replaced, item.Key)
+				}
+			}
+			if len(replaced) > 0 && !overwrite && !dryRun {
+				fmt.Fprintf(os.Stderr, "Error: %s already in %s with another value; replace with --overwrite\n", strings.Join(replaced, ", "), to)
+				exit(1)
+			}
+			if changes == 0 {
+				fmt.Printf("Nothing to copy: %d selected secrets are already in %s\n", len(items), to)
+				return
+			}
+			if dryRun {
+				fmt.Printf("Would copy %d secrets to %s\n", changes, to)
+				return
+			}
+
+			from := cmp.Or(os.Getenv("LOCKBOX_PROFILE"), src.Path())
+			actor := localActor(dst)
+			tx, err := dst.Begin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer tx.Rollback()
+			n, err := promote.Apply(src, srcKey, tx, dstKey, actor, items)
+			if err == nil {
+				err = tx.Audit(actor.Owner, "copy", fmt.Sprintf("from %s: %s", from, promote.Summary(items)))
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Copied %d secrets to %s\n", output.OK, n, to)
+		},
+	}
+	copyCmd.Flags().String("to-profile", "", "Profile to copy secrets to")
+	copyCmd.Flags().Bool("overwrite", false, "Replace keys the target holds with another value")
+	copyCmd.Flags().Bool("dry-run", false, "Show the plan without writing anything")
+
+	// push and pull commands - Replicate secrets with a remote server
+	pushCmd := &cobra.Command{
+		Use:   "push --remote HOST:PORT",
+		Short: "Copy the store's secrets to a remote server",
+		Long: `Copy secrets from the current store to a server run by 'lockbox serve',
+such as from a laptop to a shared server. A key the server lacks is added
+and one whose value differs is updated when the local copy was updated
+later. A key updated later on the server conflicts: it is left alone and
+the command exits 1, unless --force overwrites it. Nothing is deleted and
+temporary secrets are not copied. 'lockbox pull' goes the other way.
+  lockbox push --remote vault.example.com:8443 --dry-run`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			replicateSecrets(cmd, true)
+		},
+	}
+	pullCmd := &cobra.Command{
+		Use:   "pull --remote HOST:PORT",
+		Short: "Copy a remote server's secrets to the store",
+		Long: `Copy secrets from a server run by 'lockbox serve' to the current store in
+one transaction. A key the store lacks is added and one whose value
+differs is updated when the server's copy was updated later. A key updated
+later in the store conflicts: it is left alone and the command exits 1,
+unless --force overwrites it. Nothing is deleted and temporary secrets are
+not copied.
+  lockbox pull --remote vault.example.com:8443 --dry-run`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			replicateSecrets(cmd, false)
+		},
+	}
+	for _, c := range []*cobra.Command{pushCmd, pullCmd} {
+		c.Flags().StringP("remote", "r", "", "Remote server to replicate with (default $LOCKBOX_REMOTE)")
+		c.Flags().Bool("dry-run", false, "Show what would change without writing anything")
+		c.Flags().Bool("force", false, "Overwrite conflicting secrets")
+	}
+
+	// merge command - Merge another store file into the current one
+	mergeCmd := &cobra.Command{
+		Use:   "merge OTHER.db",
+		Short: "Merge the secrets of another store file into this one",
+		Long: `Copy the secrets of another lockbox store file into the current store in
+one transaction, such as when consolidating per-project stores into one.
+The other store is opened through its own key backend; a passphrase is
+read from $LOCKBOX_MERGE_PASSPHRASE or asked for. Keys the current store
+lacks are added. A key both hold with different values is resolved by
+--strategy:
+  newer         take the other value when it was updated later (default)
+  prompt        ask for each key
+  prefer-local  keep the current value
+Values are never printed. Nothing is deleted, and temporary secrets are
+not copied. Both stores are read in the vault chosen with --vault.
+  lockbox merge ~/projects/api/lockbox.db --dry-run
+  lockbox merge ~/projects/api/lockbox.db --strategy prompt`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			strategy, _ := cmd.Flags().GetString("strategy")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			path := args[0]
+			if !slices.Contains(replicate.Strategies, strategy) {
+				fmt.Fprintf(os.Stderr, "Error: unknown strategy '%s' (supported: %s)\n", strategy, strings.Join(replicate.Strategies, ", "))
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if a, err := os.Stat(path); err == nil {
+				if b, err := os.Stat(store.Path()); err == nil && os.SameFile(a, b) {
+					fmt.Fprintf(os.Stderr, "Error: cannot merge a store into itself\n")
+					exit(1)
+				}
+			}
+			other, otherKey, err := openMergeSource(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer other.Close()
+
+			source, err := localReplicas(other, otherKey)
+			var target map[string]replicate.Secret
+			if err == nil {
+				target, err = localReplicas(store, encKey)
+			}
+			defer func() {
+				for _, m := range []map[string]replicate.Secret{source, target} {
+					for _, sec := range m {
+						clear(sec.Value)
+					}
+				}
+			}()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			items := replicate.Plan(source, target)
+			asked := map[string]bool{}
+			keys, err := replicate.Choose(items, strategy, func(item replicate.Item) (bool, error) {
+				asked[item.Key] = true
+				if dryRun {
+					return false, nil
+				}
+				for {
+					answer, err := prompt.Line(fmt.Sprintf("%s differs: here updated %s, in %s updated %s. Take theirs? [y/N] ",
+						item.Key, item.Target.Local().Format(time.DateTime), path, item.Source.Local().Format(time.DateTime)))
+					if err != nil {
+						return false, err
+					}
+					switch strings.ToLower(answer) {
+					case "y", "yes":
+						return true, nil
+					case "", "n", "no":
+						return false, nil
+					}
+				}
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			taken := map[string]bool{}
+			for _, key := range keys {
+				taken[key] = true
+			}
+			kept := 0
+			for _, item := range items {
+				action := "same"
+				switch {
+				case item.Change == replicate.Add:
+					action = "add"
+				case taken[item.Key]:
+					action = "take"
+				case dryRun && asked[item.Key]:
+					action = "ask"
+				case item.Change != replicate.Same:
+					action = "keep"
+					kept++
+				}
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "merge", action, item.Key)
+					continue
+				}
+				switch action {
+				case "add":
+					fmt.Printf("  + %s\n", item.Key)
+				case "take":
+					fmt.Printf("  ~ %-32s  theirs, updated %s over %s\n", item.Key, item.Source.Local().Format(time.DateTime), item.Target.Local().Format(time.DateTime))
+				case "keep":
+					fmt.Printf("  = %-32s  kept ours, updated %s; theirs %s\n", item.Key, item.Target.Local().Format(time.DateTime), item.Source.Local().Format(time.DateTime))
+				case "ask":
+					fmt.Printf("  ? %-32s  differs; would ask\n", item.Key)
+				}
+			}
+
+			counts := replicate.Count(items)
+			if dryRun {
+				if !isPorcelain(cmd) {
+					fmt.Printf("Would merge %d secrets from %s (%d kept, %d to ask about, %d unchanged)\n", len(keys), path, kept, len(asked), counts[replicate.Same])
+				}
+				return
+			}
+			if len(keys) > 0 {
+				tx, err := store.Begin()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				defer tx.Rollback()
+				actor := localActor(store)
+				for _, key := range keys {
+					value := string(source[key].Value)
+					if _, err = batch.Execute(tx, encKey, actor, batch.Command{Op: "set", Key: key, Value: &value}); err != nil {
+						err = fmt.Errorf("%s: %w", key, err)
+						break
+					}
+				}
+				if err == nil {
+					err = tx.Audit(actor.Owner, "merge", fmt.Sprintf("from %s: %d secrets", path, len(keys)))
+				}
+				if err == nil {
+					err = tx.Commit()
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if !isPorcelain(cmd) {
+				fmt.Printf("%s Merged %d secrets from %s (%d kept, %d unchanged)\n", output.OK, len(keys), path, kept, counts[replicate.Same])
+			}
+		},
+	}
+	mergeCmd.Flags().String("strategy", replicate.Newer, "How to resolve keys both stores hold: newer, prompt or prefer-local")
+	mergeCmd.Flags().Bool("dry-run", false, "Show what would change without writing anything")
+
+	// sync command - Sync secrets through a git repository
+	syncCmd := &cobra.Command{
+		Use:   "sync [URL]",
+		Short: "Sync secrets across machines through an encrypted git repository",
+		Long: `Merge the current vault's secrets with those in a git repository, commit
+and push the result. Each secret is a file encrypted with the store key,
+named by a keyed digest, so only ciphertext lands in git and the key
+stays local; every machine syncing the repository needs the same store
+key, such as an enrolled device.
+
+After the key is rotated, as by 'lockbox device revoke', the next sync
+re-encrypts the repository with the new key. Machines still holding the
+old key are then told to enroll again.
+
+A side that changed a secret since the last sync wins, deletions
+included; when both did the copy updated later wins and the key is
+reported as a conflict. The repository is remembered, so later syncs
+need no URL. git runs with your own configuration and credentials.
+  lockbox sync git@github.com:me/secrets.git
+  lockbox sync --dry-run`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			branch, _ := cmd.Flags().GetString("branch")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			var url string
+			if len(args) == 1 {
+				url = args[0]
+			} else if saved, err := store.GetConfig(syncURLConfig); err == nil {
+				url = string(saved)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: no repository to sync with; give its URL once with 'lockbox sync URL'\n")
+				exit(1)
+			}
+
+			// Keys rotated away from still read a repository not yet
+			// re-encrypted
+			previous, err := gitsync.PreviousKeys(store, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer func() {
+				for _, key := range previous {
+					clear(key)
+				}
+			}()
+			repo, err := gitsync.Open(gitsync.Dir(store.Path(), store.Vault(), url), url, branch, store.Vault(), encKey, previous)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			base, err := repo.Base()
+			var remote, local map[string]replicate.Secret
+			if err == nil {
+				remote, err = repo.Remote()
+			}
+			if err == nil {
+				local, err = localReplicas(store, encKey)
+			}
+			defer func() {
+				for _, m := range []map[string]replicate.Secret{base, remote, local} {
+					for _, sec := range m {
+						clear(sec.Value)
+					}
+				}
+			}()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			// On first contact show the fingerprint, which every machine
+			// sharing the key shows too
+			if synced, err := repo.Synced(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			} else if !synced && !isPorcelain(cmd) {
+				fingerprint, err := crypto.Fingerprint(encKey)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				fmt.Printf("First sync with %s; store fingerprint %s\n", url, fingerprint)
+				fmt.Println("  Check that 'lockbox fingerprint' shows the same on the other machines syncing it")
+			}
+
+			items := gitsync.Merge(base, local, remote)
+			counts := map[string]int{}
+			conflicts := 0
+			for _, item := range items {
+				counts[item.Action]++
+				if item.Conflict {
+					conflicts++
+				}
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "sync", item.Action, item.Key, strconv.FormatBool(item.Conflict))
+					continue
+				}
+				note := ""
+				if item.Conflict {
+					note = "  (changed on both sides; kept the later copy)"
+				}
+				fmt.Printf("  %-13s %s%s\n", item.Action, item.Key, note)
+			}
+			summary := fmt.Sprintf("%d pulled, %d pushed, %d deleted here, %d deleted there, %d conflicts",
+				counts[gitsync.Pull], counts[gitsync.Push], counts[gitsync.DeleteLocal], counts[gitsync.DeleteRemote], conflicts)
+			if dryRun {
+				if !isPorcelain(cmd) {
+					fmt.Printf("Would sync with %s: %s\n", url, summary)
+				}
+				return
+			}
+
+			if err := applySync(store, encKey, items, remote, url); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			host, _ := os.Hostname()
+			message := fmt.Sprintf("Sync from %s: %d pushed, %d deleted", host, counts[gitsync.Push], counts[gitsync.DeleteRemote])
+			if err := repo.Write(items, local, message); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if len(args) == 1 {
+				if err := store.SetConfig(syncURLConfig, []byte(url)); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if isPorcelain(cmd) {
+				return
+			}
+			if len(items) == 0 {
+				fmt.Printf("%s Already in sync with %s\n", output.OK, url)
+				return
+			}
+			fmt.Printf("%s Synced with %s: %s\n", output.OK, url, summary)
+		},
+	}
+	syncCmd.Flags().String("branch", "main", "Branch of the repository to sync")
+	syncCmd.Flags().Bool("dry-run", false, "Show what would change without writing anything")
+
+	// fingerprint command - Identify the store key for people to compare
+	fingerprintCmd := &cobra.Command{
+		Use:   "fingerprint",
+		Short: "Show the store's fingerprint to compare with other machines",
+		Long: `Print a short code identifying the store key, such as
+4F2A-91C0-7B44-E5D1-0A3C. It is a MAC keyed by the store key, so it
+reveals nothing about the key and only a machine holding the key shows
+the same code. Compare it by eye, over a channel you trust, before
+trusting a machine you sync or pair with:
+  - every machine syncing a repository needs the same store key, so all
+    show the same fingerprint; 'lockbox sync' shows it on the first sync
+  - 'lockbox pair' shows it, and the paired device receives the one of
+    the server it reached`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			fingerprint, err := crypto.Fingerprint(encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "fingerprint", fingerprint)
+				return
+			}
+			fmt.Println(fingerprint)
+		},
+	}
+
+	// rotation command - Rotate secrets on a schedule
+	rotationCmd := &cobra.Command{
+		Use:   "rotation",
+		Short: "Rotate secrets on a schedule",
+		Long: `Rotation rules replace a secret with a generated value on a schedule. The
+'serve' scheduler checks rules every minute, and 'rotation run' rotates
+due rules from cron or by hand.
+
+Each rotation generates a value, then runs the rule's hook with
+LOCKBOX_ROTATE_KEY, LOCKBOX_OLD_VALUE and LOCKBOX_NEW_VALUE in its
+environment to propagate it, e.g. by changing a database password. The new
+value is stored only if the hook exits 0; otherwise the secret is left
+unchanged and the failure is audited.
+
+Generators:
+  random:N   N letters and digits (default 32)
+  hex:N      N random bytes, hex encoded
+  base64:N   N random bytes, URL-safe base64
+  NAME:ARG   the plugin lockbox-generator-NAME on PATH, run with ARG; its
+             output is the new value
+
+Examples:
+  lockbox rotation add DB_PASSWORD --every 30d --generator random:32 --hook ./update-db.sh
+  lockbox rotation list
+  lockbox rotation run DB_PASSWORD`,
+	}
+
+	rotationAddCmd := &cobra.Command{
+		Use:   "add KEY --every INTERVAL [--generator SPEC] [--hook PATH]",
+		Short: "Add or replace a rotation rule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			everyFlag, _ := cmd.Flags().GetString("every")
+			generator, _ := cmd.Flags().GetString("generator")
+			hook, _ := cmd.Flags().GetString("hook")
+			awsIAM, _ := cmd.Flags().GetBool("aws-iam")
+			secretKey, _ := cmd.Flags().GetString("secret-key")
+			user, _ := cmd.Flags().GetString("user")
+			if everyFlag == "" {
+				fmt.Fprintf(os.Stderr, "Error: --every is required\n")
+				exit(1)
+			}
+			every, err := rotation.ParseEvery(everyFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			r := rotation.Rule{Key: args[0], Every: every, Created: time.Now().UTC()}
+			if awsIAM {
+				if cmd.Flags().Changed("generator") || hook != "" {
+					fmt.Fprintf(os.Stderr, "Error: --aws-iam cannot be combined with --generator or --hook\n")
+					exit(1)
+				}
+				if secretKey == "" {
+					var ok bool
+					if secretKey, ok = rotation.SecretKeyFor(args[0]); !ok {
+						fmt.Fprintf(os.Stderr, "Error: --secret-key is required when KEY does not end in ACCESS_KEY_ID\n")
+						exit(1)
+					}
+				}
+				r.Rotator, r.SecretKey, r.User = rotation.AWSIAM, secretKey, user
+				generator = rotation.AWSIAM
+			} else {
+				if secretKey != "" || user != "" {
+					fmt.Fprintf(os.Stderr, "Error: --secret-key and --user require --aws-iam\n")
+					exit(1)
+				}
+				if err := rotation.CheckSpec(generator); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				r.Generator = generator
+			}
+			if hook != "" {
+				// The scheduler runs elsewhere, so remember where the hook is
+				if hook, err = filepath.Abs(hook); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if info, err := os.Stat(hook); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+					fmt.Fprintf(os.Stderr, "Error: hook '%s' is not an executable file\n", hook)
+					exit(1)
+				}
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can add rotation rules\n")
+				exit(1)
+			}
+			for _, key := range []string{args[0], r.SecretKey} {
+				if _, err := store.GetSecret(key); key != "" && err != nil {
+					fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
+					exit(1)
+				}
+			}
+
+			r.Hook = hook
+			if err := rotation.Save(store, r); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s %s rotates every %s with %s, next %s\n", output.OK, r.Key, everyFlag, generator, r.Next().Local().Format(time.DateTime))
+		},
+	}
+	rotationAddCmd.Flags().String("every", "", "Rotation interval, such as 30d or 12h")
+	rotationAddCmd.Flags().String("generator", "random:32", "Generator of new values")
+	rotationAddCmd.Flags().String("hook", "", "Program that propagates the new value; it is stored only if this exits 0")
+	rotationAddCmd.Flags().Bool("aws-iam", false, "KEY is an AWS access key ID; rotate the key pair through IAM")
+	rotationAddCmd.Flags().String("secret-key", "", "Key holding the paired secret access key (default: KEY with ACCESS_KEY_ID replaced by SECRET_ACCESS_KEY)")
+	rotationAddCmd.Flags().String("user", "", "IAM user owning the access key (default: the key's own user)")
+
+	rotationListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List rotation rules",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			rules, err := rotation.List(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, r := range rules {
+					porcelain.Write(os.Stdout, "rotation", r.Key, strconv.FormatInt(int64(r.Every.Seconds()), 10), cmp.Or(r.Rotator, r.Generator), r.Hook, porcelain.Time(r.LastRotated), porcelain.Time(r.Next()))
+				}
+				return
+			}
+			if len(rules) == 0 {
+				fmt.Println("No rotation rules found")
+				return
+			}
+			for _, r := range rules {
+				last := "never"
+				if !r.LastRotated.IsZero() {
+					last = r.LastRotated.Local().Format(time.DateTime)
+				}
+				hook := r.Hook
+				if hook == "" {
+					hook = "no hook"
+				}
+				fmt.Printf("%s\tevery %s\t%s\t%s\tlast %s\tnext %s\n", r.Key, r.Every, cmp.Or(r.Rotator, r.Generator), hook, last, r.Next().Local().Format(time.DateTime))
+			}
+		},
+	}
+
+	rotationRemoveCmd := &cobra.Command{
+		Use:   "remove KEY",
+		Short: "Remove a rotation rule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can remove rotation rules\n")
+				exit(1)
+			}
+			if err := rotation.Remove(store, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s %s no longer rotates\n", output.OK, args[0])
+		},
+	}
+
+	rotationRunCmd := &cobra.Command{
+		Use:   "run [KEY...]",
+		Short: "Rotate due secrets, or the given ones now",
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			rules, err := rotation.List(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			byKey := map[string]rotation.Rule{}
+			for _, r := range rules {
+				byKey[r.Key] = r
+			}
+			now := time.Now().UTC()
+			var selected []rotation.Rule
+			for _, key := range args {
+				r, ok := byKey[key]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Error: no rotation rule for '%s'\n", key)
+					exit(1)
+				}
+				selected = append(selected, r)
+			}
+			if len(args) == 0 {
+				for _, r := range rules {
+					if !now.Before(r.Next()) {
+						selected = append(selected, r)
+					}
+				}
+			}
+
+			actor := localActor(store)
+			failed := 0
+			for _, r := range selected {
+				if err := rotation.Rotate(store, encKey, actor, r, now); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					notifyEvent(store, encKey, notify.Event{Type: "rotation-failed", Key: r.Key})
+					failed++
+					continue
+				}
+				fmt.Printf("%s Rotated %s\n", output.OK, r.Key)
+				notifyEvent(store, encKey, notify.Event{Type: "rotation", Key: r.Key})
+			}
+			if len(selected) == 0 {
+				fmt.Println("No rotations due")
+			}
+			if failed > 0 {
+				exit(1)
+			}
+		},
+	}
+	rotationCmd.AddCommand(rotationAddCmd, rotationListCmd, rotationRemoveCmd, rotationRunCmd)
+
+	// digest command - Email periodic summaries to admins
+	digestCmd := &cobra.Command{
+		Use:   "digest",
+		Short: "Email periodic digests of what needs attention",
+		Long: `Digests summarise the store for its admins: tokens expiring and rotations
+due within the next period, secrets unchanged for a long time without a
+rotation rule, failed authentication attempts and other audited activity.
+They name keys but never contain values.
+
+'lockbox serve' emails a digest once per period (default weekly) over SMTP.
+The SMTP credentials are secrets in this store, named by --username-key
+and --password-key.
+
+Examples:
+  lockbox set SMTP_USER lockbox@example.com
+  lockbox set SMTP_PASSWORD ...
+  lockbox digest config --smtp smtp.example.com:587 --from lockbox@example.com \
+    --to ops@example.com --username-key SMTP_USER --password-key SMTP_PASSWORD
+  lockbox digest show`,
+	}
+
+	digestConfigCmd := &cobra.Command{
+		Use:   "config --smtp HOST:PORT --from ADDRESS --to ADDRESS...",
+		Short: "Configure where digests are sent",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			server, _ := cmd.Flags().GetString("smtp")
+			from, _ := cmd.Flags().GetString("from")
+			to, _ := cmd.Flags().GetStringSlice("to")
+			usernameKey, _ := cmd.Flags().GetString("username-key")
+			passwordKey, _ := cmd.Flags().GetString("password-key")
+			everyFlag, _ := cmd.Flags().GetString("every")
+			if server == "" || from == "" || len(to) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: --smtp, --from and --to are required\n")
+				exit(1)
+			}
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --smtp must be HOST:PORT, e.g. smtp.example.com:587\n")
+				exit(1)
+			}
+			if (usernameKey == "") != (passwordKey == "") {
+				fmt.Fprintf(os.Stderr, "Error: --username-key and --password-key must be given together\n")
+				exit(1)
+			}
+			every, err := rotation.ParseEvery(everyFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can configure digests\n")
+				exit(1)
+			}
+			for _, key := range []string{usernameKey, passwordKey} {
+				if _, err := store.GetSecret(key); key != "" && err != nil {
+					fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
+					exit(1)
+				}
+			}
+			c := digest.Config{Server: server, From: from, To: to, UsernameKey: usernameKey, PasswordKey: passwordKey, Every: every}
+			if old, err := digest.LoadConfig(store); err == nil {
+				c.LastSent = old.LastSent
+			}
+			if err := digest.SaveConfig(store, c); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Digests go to %s every %s via %s\n", output.OK, strings.Join(to, ", "), everyFlag, server)
+		},
+	}
+	digestConfigCmd.Flags().String("smtp", "", "SMTP server as HOST:PORT; STARTTLS is used when offered")
+	digestConfigCmd.Flags().String("from", "", "Sender address")
+	digestConfigCmd.Flags().StringSlice("to", nil, "Recipient addresses (repeatable or comma-separated)")
+	digestConfigCmd.Flags().String("username-key", "", "Secret holding the SMTP username")
+	digestConfigCmd.Flags().String("password-key", "", "Secret holding the SMTP password")
+	digestConfigCmd.Flags().String("every", "7d", "How often to send a digest")
+
+	digestShowCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the digest that would be sent now",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			every := digest.DefaultEvery
+			if c, err := digest.LoadConfig(store); err == nil {
+				every = c.Every
+			}
+			d, err := digest.Build(store, time.Now().UTC(), every)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Print(d.Text())
+		},
+	}
+
+	digestSendCmd := &cobra.Command{
+		Use:   "send",
+		Short: "Send a digest now",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			c, err := digest.LoadConfig(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			now := time.Now().UTC()
+			d, err := digest.Build(store, now, c.Every)
+			if err == nil {
+				err = digest.Send(store, encKey, c, d)
+			}
+			if err == nil {
+				c.LastSent = now
+				err = digest.SaveConfig(store, c)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Sent digest to %s\n", output.OK, strings.Join(c.To, ", "))
+		},
+	}
+	digestCmd.AddCommand(digestConfigCmd, digestShowCmd, digestSendCmd)
+
+	// notify command - Post events to chat webhooks
+	notifyCmd := &cobra.Command{
+		Use:   "notify",
+		Short: "Post events to Slack, Discord or Matrix",
+		Long: `Notification targets are chat webhooks told about store events with short,
+templated messages that name keys but never contain values. Each target
+gets every event, or only those given with --events:
+
+  rotation              a secret was rotated
+  rotation-failed       a rotation failed and the old value is still in use
+  backup-failed         'lockbox backup' failed
+  promotion             secrets were promoted into this profile
+  promotion-requested   a promotion into this profile awaits approval
+  anomaly               'lockbox serve' noticed an unusual read
+  checkout              a secret was checked out
+  checkin               a secret was checked in
+  checkout-expired      a checkout ran out before the secret was checked in
+
+Webhook URLs embed credentials, so they are stored encrypted and only
+their host is shown.
+
+Examples:
+  lockbox notify add slack https://hooks.slack.com/services/T000/B000/XXXX --events rotation-failed,backup-failed
+  lockbox notify add discord https://discord.com/api/webhooks/1/abc
+  lockbox notify add matrix 'https://matrix.example.com/_matrix/client/v3/rooms/!room:example.com/send/m.room.message?access_token=...'
+  lockbox notify test slack`,
+	}
+
+	notifyAddCmd := &cobra.Command{
+		Use:   "add KIND URL [--name NAME] [--events EVENT,...]",
+		Short: "Add or replace a notification target",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, _ := cmd.Flags().GetString("name")
+			events, _ := cmd.Flags().GetStringSlice("events")
+			t := notify.Target{Name: cmp.Or(name, args[0]), Kind: args[0], URL: args[1], Events: events}
+			if err := t.Validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can add notification targets\n")
+				exit(1)
+			}
+			if err := notify.Add(store, encKey, t); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			which := "all events"
+			if len(events) > 0 {
+				which = strings.Join(events, ", ")
+			}
+			fmt.Printf("%s %s (%s at %s) is notified of %s\n", output.OK, t.Name, t.Kind, t.Host(), which)
+		},
+	}
+	notifyAddCmd.Flags().String("name", "", "Target name (default: KIND)")
+	notifyAddCmd.Flags().StringSlice("events", nil, "Events to send (default: all)")
+
+	notifyListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List notification targets",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			targets, err := notify.List(store, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, t := range targets {
+					porcelain.Write(os.Stdout, "notify", t.Name, t.Kind, t.Host(), strings.Join(t.Events, ","))
+				}
+				return
+			}
+			if len(targets) == 0 {
+				fmt.Println("No notification targets found")
+				return
+			}
+			for _, t := range targets {
+				events := "all events"
+				if len(t.Events) > 0 {
+					events = strings.Join(t.Events, ", ")
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", t.Name, t.Kind, t.Host(), events)
+			}
+		},
+	}
+
+	notifyRemoveCmd := &cobra.Command{
+		Use:   "remove NAME",
+		Short: "Remove a notification target",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can remove notification targets\n")
+				exit(1)
+			}
+			if err := notify.Remove(store, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Removed notification target %s\n", output.OK, args[0])
+		},
+	}
+
+	notifyTestCmd := &cobra.Command{
+		Use:   "test NAME",
+		Short: "Send a test message to a notification target",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			targets, err := notify.List(store, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			i := slices.IndexFunc(targets, func(t notify.Target) bool { return t.Name == args[0] })
+			if i < 0 {
+				fmt.Fprintf(os.Stderr, "Error: no notification target '%s'\n", args[0])
+				exit(1)
+			}
+			if err := notify.Post(targets[i], "lockbox: test notification from 'lockbox notify test'"); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Sent a test message to %s\n", output.OK, args[0])
+		},
+	}
+	notifyCmd.AddCommand(notifyAddCmd, notifyListCmd, notifyRemoveCmd, notifyTestCmd)
+
+	// worm command - Mirror history to append-only storage
+	wormCmd := &cobra.Command{
+		Use:   "worm",
+		Short: "Mirror the audit log and secret changes to append-only storage",
+		Long: `Ship every audit event and a digest of every secret change to write-once
+storage outside this machine, so history cannot be rewritten even by
+someone with full control of it. Records are hash-chained and signed with
+the store's signing key; they name keys and value digests, never values.
+  lockbox worm add syslog tls://logs.example.com:6514
+  lockbox worm add s3 audit-bucket --prefix lockbox/ --retain 365d
+  lockbox worm ship
+  lockbox worm verify records.jsonl --signer KEY
+'lockbox serve' ships new records every minute.`,
+	}
+
+	wormAddCmd := &cobra.Command{
+		Use:   "add syslog URL | add s3 BUCKET",
+		Short: "Add or replace a WORM target",
+		Long: `Add a remote syslog, as tcp://, udp:// or tls://HOST:PORT, or an S3 bucket
+with Object Lock enabled. Each ship writes one object under --prefix,
+locked in --mode for --retain. S3 objects are written with the aws CLI
+($LOCKBOX_AWS), using its usual credentials.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, _ := cmd.Flags().GetString("name")
+			prefix, _ := cmd.Flags().GetString("prefix")
+			mode, _ := cmd.Flags().GetString("mode")
+			retainFlag, _ := cmd.Flags().GetString("retain")
+			t := worm.Target{Name: cmp.Or(name, args[0]), Kind: args[0]}
+			if t.Kind == "s3" {
+				retain, err := bundle.ParseExpiry(retainFlag)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --retain: %v\n", err)
+					exit(1)
+				}
+				t.Bucket, t.Prefix, t.Mode, t.Retain = args[1], prefix, strings.ToUpper(mode), retain
+			} else {
+				t.Address = args[1]
+			}
+			if err := t.Validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can add WORM targets\n")
+				exit(1)
+			}
+			if err := worm.Add(store, t); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s %s ships history to %s\n", output.OK, t.Name, t)
+		},
+	}
+	wormAddCmd.Flags().String("name", "", "Target name (default: KIND)")
+	wormAddCmd.Flags().String("prefix", "", "S3 key prefix of shipped objects")
+	wormAddCmd.Flags().String("mode", "COMPLIANCE", "S3 Object Lock mode: COMPLIANCE or GOVERNANCE")
+	wormAddCmd.Flags().String("retain", "365d", "How long S3 objects stay locked, e.g. 365d")
+
+	wormListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List WORM targets and the signing key",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			targets, err := worm.List(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, t := range targets {
+					porcelain.Write(os.Stdout, "worm", t.Name, t.Kind, t.String())
+				}
+				return
+			}
+			if len(targets) == 0 {
+				fmt.Println("No WORM targets found")
+				return
+			}
+			for _, t := range targets {
+				fmt.Printf("%s\t%s\t%s\n", t.Name, t.Kind, t)
+			}
+			if pub, err := worm.PublicKey(store); err == nil {
+				fmt.Printf("Records are signed by %s\n", hex.EncodeToString(pub))
+			}
+		},
+	}
+
+	wormRemoveCmd := &cobra.Command{
+		Use:   "remove NAME",
+		Short: "Remove a WORM target",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can remove WORM targets\n")
+				exit(1)
+			}
+			if err := worm.Remove(store, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			// The removal itself is shipped to the remaining targets
+			store.Audit(actor.Owner, "worm-removed", args[0])
+			fmt.Printf("%s Removed WORM target %s\n", output.OK, args[0])
+		},
+	}
+
+	wormShipCmd := &cobra.Command{
+		Use:   "ship",
+		Short: "Ship new audit events and secret changes now",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			n, err := worm.Ship(store, encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Shipped %d records\n", output.OK, n)
+		},
+	}
+
+	wormVerifyCmd := &cobra.Command{
+		Use:   "verify FILE [--signer KEY]",
+		Short: "Check a copy of shipped records",
+		Long: `Check records collected from a WORM target, one JSON record per line (for
+syslog, the message part), for forged signatures, gaps and reordering.
+--signer is the public key shown by 'lockbox worm list', defaulting to
+this store's.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			signer, _ := cmd.Flags().GetString("signer")
+			var pub ed25519.PublicKey
+			if signer != "" {
+				key, err := hex.DecodeString(signer)
+				if err != nil || len(key) != ed25519.PublicKeySize {
+					fmt.Fprintf(os.Stderr, "Error: invalid --signer key\n")
+					exit(1)
+				}
+				pub = key
+			} else {
+				store, _, err := getStoreAndKey()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				pub, err = worm.PublicKey(store)
+				store.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer f.Close()
+			n, err := worm.Verify(f, pub)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s %d records verified\n", output.OK, n)
+		},
+	}
+	wormVerifyCmd.Flags().String("signer", "", "Hex Ed25519 public key the records must be signed by")
+
+	wormCmd.AddCommand(wormAddCmd, wormListCmd, wormRemoveCmd, wormShipCmd, wormVerifyCmd)
+
+	// audit command - Show the audit log
+	auditCmd := &cobra.Command{
+		Use:   "audit [--action ACTION]",
+		Short: "Show the audit log",
+		Long: `Show the store's audit log of administrative actions, such as promotions,
+oldest first. Entries name keys but never hold values.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			action, _ := cmd.Flags().GetString("action")
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !canAudit(store) {
+				fmt.Fprintf(os.Stderr, "Error: reading the audit log requires the audit permission\n")
+				exit(1)
+			}
+
+			events, err := store.AuditEvents(action)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, e := range events {
+					porcelain.Write(os.Stdout, "audit", strconv.FormatInt(e.ID, 10), porcelain.Time(e.At), e.Actor, e.Action, e.Detail)
+				}
+				return
+			}
+			if len(events) == 0 {
+				fmt.Println("No audit events found")
+				return
+			}
+			for _, e := range events {
+				fmt.Printf("%s  %s  %s  %s\n", e.At.Local().Format(time.DateTime), policy.Describe(e.Actor), e.Action, e.Detail)
+			}
+		},
+	}
+	auditCmd.Flags().String("action", "", "Show only events of this action, e.g. promote")
+
+	auditAnomaliesCmd := &cobra.Command{
+		Use:   "anomalies [--since 24h]",
+		Short: "Show unusual secret reads",
+		Long: `Show secret reads that stand out from the store's access baselines:
+  enumeration   an identity read more keys at once than it usually does
+  new-identity  the first read over the server by a token or address
+  dormant       a key was read after going unread for 90 days
+  unusual-hour  a key was read at an hour it is never read at
+Reads through get, env, run and the server are logged for 90 days. 'lockbox
+serve' checks for anomalies each minute and notifies targets subscribed to
+the anomaly event.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			sinceFlag, _ := cmd.Flags().GetString("since")
+			period, err := rotation.ParseEvery(sinceFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !canAudit(store) {
+				fmt.Fprintf(os.Stderr, "Error: reading the access log requires the audit permission\n")
+				exit(1)
+			}
+
+			found, err := anomaly.Find(store, time.Now().Add(-period), anomaly.Options{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if isPorcelain(cmd) {
+				for _, a := range found {
+					porcelain.Write(os.Stdout, "anomaly", porcelain.Time(a.At), a.Kind, a.Key, a.Identity, a.Detail)
+				}
+				return
+			}
+			if len(found) == 0 {
+				fmt.Println("No anomalies found")
+				return
+			}
+			for _, a := range found {
+				fmt.Printf("%s  %-12s  %s\n", a.At.Local().Format(time.DateTime), a.Kind, a.Detail)
+			}
+		},
+	}
+	auditAnomaliesCmd.Flags().String("since", "24h", "How far back to look, e.g. 24h or 7d")
+	auditCmd.AddCommand(auditAnomaliesCmd)
+
+	// policy command - Grant local users access over the unix socket
+	policyCmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Manage per-user and per-token access",
+		Long: `Grant OS users and groups access to secrets when they connect to
+'lockbox serve --socket', and API tokens access when they present a token.
+Peers are identified by SO_PEERCRED; patterns use glob syntax. The server's
+own user and root always have full access on the socket. Tokens issued by
+'lockbox login' also carry the ID token's claims as subjects. A policy
+grants the reader role; see 'lockbox role' for the others.
+  lockbox policy allow --user alice 'APP_*'
+  lockbox policy allow --group deploy 'DEPLOY_*'
+  lockbox policy allow --token ci 'CI_*'
+  lockbox policy allow --claim groups=platform 'PROD_*'
+  lockbox policy revoke --user alice 'APP_*'
+  lockbox policy list`,
+	}
+
+	policyAllowCmd := &cobra.Command{
+		Use:   "allow PATTERN",
+		Short: "Grant a user, group, token or claim access to keys matching PATTERN",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			username, _ := cmd.Flags().GetString("user")
+			group, _ := cmd.Flags().GetString("group")
+			tokenName, _ := cmd.Flags().GetString("token")
+			claim, _ := cmd.Flags().GetString("claim")
+
+			subject, err := policy.ParseSubject(username, group, tokenName, claim)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := policy.ValidatePattern(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if err := store.AddPolicy(subject, args[0], rbac.RoleReader); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "policy-allowed", subject, args[0])
+				return
+			}
+			fmt.Printf("%s Granted %s access to '%s'\n", output.OK, policy.Describe(subject), args[0])
+		},
+	}
+
+	policyRevokeCmd := &cobra.Command{
+		Use:   "revoke PATTERN",
+		Short: "Revoke a previously granted pattern",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			username, _ := cmd.Flags().GetString("user")
+			group, _ := cmd.Flags().GetString("group")
+			tokenName, _ := cmd.Flags().GetString("token")
+			claim, _ := cmd.Flags().GetString("claim")
+
+			subject, err := policy.ParseSubject(username, group, tokenName, claim)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if err := store.RemovePolicy(subject, args[0], rbac.RoleReader); err != nil {
+				if err == db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: no policy grants %s '%s'\n", policy.Describe(subject), args[0])
+					exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "policy-revoked", subject, args[0])
+				return
+			}
+			fmt.Printf("%s Revoked %s access to '%s'\n", output.OK, policy.Describe(subject), args[0])
+		},
+	}
+
+	policyListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List policies",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			policies, err := store.ListPolicies()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				for _, p := range policies {
+					porcelain.Write(os.Stdout, "policy", p.Subject, p.Pattern, p.Role)
+				}
+				return
+			}
+			if len(policies) == 0 {
+				fmt.Println("No policies found")
+				return
+			}
+			for _, p := range policies {
+				fmt.Printf("%s\t%s\t%s\n", policy.Describe(p.Subject), p.Pattern, p.Role)
+			}
+		},
+	}
+
+	for _, c := range []*cobra.Command{policyAllowCmd, policyRevokeCmd} {
+		c.Flags().String("user", "", "OS user name or UID")
+		c.Flags().String("group", "", "OS group name or GID")
+		c.Flags().String("token", "", "API token name")
+		c.Flags().String("claim", "", "OIDC claim as NAME=VALUE, for tokens issued by 'lockbox login'")
+	}
+	policyCopyOutCmd := &cobra.Command{
+		Use:   "copy-out [allow|deny]",
+		Short: "Show, allow or forbid copying this store's secrets to other stores",
+		Long: `With deny, secrets of the current store can no longer be copied into the
+store of another profile: copy and promote from it fail, and its archives
+restore only into a store with its key, so 'backup restore --to-profile'
+fails too. Without an argument the current setting is printed.
+  lockbox --profile prod policy copy-out deny`,
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"allow", "deny"},
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if len(args) == 0 {
+				forbidden, err := policy.CopyOutForbidden(store)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				setting := map[bool]string{false: "allow", true: "deny"}[forbidden]
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "copy-out", setting)
+					return
+				}
+				fmt.Printf("copy-out: %s\n", setting)
+				return
+			}
+			if args[0] != "allow" && args[0] != "deny" {
+				fmt.Fprintf(os.Stderr, "Error: expected allow or deny, got '%s'\n", args[0])
+				exit(1)
+			}
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can change copy-out\n")
+				exit(1)
+			}
+			if err := policy.SetCopyOut(store, args[0] == "allow"); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "copy-out", args[0])
+			if args[0] == "deny" {
+				fmt.Printf("%s Secrets of this store can no longer be copied to other stores\n", output.OK)
+			} else {
+				fmt.Printf("%s Secrets of this store may be copied to other stores\n", output.OK)
+			}
+		},
+	}
+	policyCmd.AddCommand(policyAllowCmd, policyRevokeCmd, policyListCmd, policyCopyOutCmd)
+
+	// role command - Role-based access
+	roleCmd := &cobra.Command{
+		Use:   "role",
+		Short: "Manage roles and assign them to users and tokens",
+		Long: `Roles are sets of permissions assigned to a user, group, token or claim on
+a key pattern:
+  read    read secret values
+  list    see secret names
+  write   set and delete secrets through the server
+  audit   read the audit and access logs
+  admin   manage the store: roles, tokens, keys and others' secrets
+The built-in roles are admin (everything), operator (read, list, write),
+reader (read, list) and auditor (list, audit). Audit and admin only count
+when assigned on '*', the default pattern. 'lockbox policy allow' assigns
+reader.
+  lockbox role list
+  lockbox role create deployer --permissions read,write
+  lockbox role assign auditor --user bob
+  lockbox role assign operator --token ci 'CI_*'
+  lockbox role unassign auditor --user bob`,
+	}
+
+	roleListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List roles and their permissions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			custom, err := store.ListRoles()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			for _, r := range append(slices.Clone(rbac.Builtin), custom...) {
+				kind := "custom"
+				if rbac.IsBuiltin(r.Name) {
+					kind = "built-in"
+				}
+				if isPorcelain(cmd) {
+					porcelain.Write(os.Stdout, "role", r.Name, strings.Join(r.Permissions, ","), kind)
+					continue
+				}
+				fmt.Printf("%-10s  %-8s  %s\n", r.Name, kind, strings.Join(r.Permissions, ","))
+			}
+		},
+	}
+
+	roleCreateCmd := &cobra.Command{
+		Use:   "create NAME --permissions PERMS",
+		Short: "Create or redefine a custom role",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			permsFlag, _ := cmd.Flags().GetString("permissions")
+			if err := rbac.ValidateName(args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			perms, err := rbac.ParsePermissions(permsFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: managing roles requires the admin role\n")
+				exit(1)
+			}
+
+			if err := store.SetRole(args[0], perms); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "role-created", args[0]+" "+strings.Join(perms, ","))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "role-created", args[0], strings.Join(perms, ","))
+				return
+			}
+			fmt.Printf("%s Role '%s' grants %s\n", output.OK, args[0], strings.Join(perms, ", "))
+		},
+	}
+	roleCreateCmd.Flags().String("permissions", "", "Comma-separated permissions: read, list, write, audit, admin")
+	roleCreateCmd.MarkFlagRequired("permissions")
+
+	roleDeleteCmd := &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a custom role and its assignments",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if rbac.IsBuiltin(args[0]) {
+				fmt.Fprintf(os.Stderr, "Error: '%s' is a built-in role\n", args[0])
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: managing roles requires the admin role\n")
+				exit(1)
+			}
+
+			if err := store.DeleteRole(args[0]); err != nil {
+				if err == db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: role '%s' not found\n", args[0])
+					exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "role-deleted", args[0])
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "role-deleted", args[0])
+				return
+			}
+			fmt.Printf("%s Deleted role '%s'\n", output.OK, args[0])
+		},
+	}
+
+	roleAssignCmd := &cobra.Command{
+		Use:   "assign ROLE [PATTERN]",
+		Short: "Assign a role to a user, group, token or claim",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			subject, pattern := roleTarget(cmd, args)
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: managing roles requires the admin role\n")
+				exit(1)
+			}
+			e, err := rbac.Load(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if !e.HasRole(args[0]) {
+				fmt.Fprintf(os.Stderr, "Error: role '%s' not found\n", args[0])
+				exit(1)
+			}
+
+			if err := store.AddPolicy(subject, pattern, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "role-assigned", args[0]+" "+subject+" "+pattern)
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "role-assigned", args[0], subject, pattern)
+				return
+			}
+			fmt.Printf("%s Assigned %s the %s role on '%s'\n", output.OK, policy.Describe(subject), args[0], pattern)
+		},
+	}
+
+	roleUnassignCmd := &cobra.Command{
+		Use:   "unassign ROLE [PATTERN]",
+		Short: "Take a role away from a user, group, token or claim",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			subject, pattern := roleTarget(cmd, args)
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			actor := localActor(store)
+			if !actor.Admin {
+				fmt.Fprintf(os.Stderr, "Error: managing roles requires the admin role\n")
+				exit(1)
+			}
+
+			if err := store.RemovePolicy(subject, pattern, args[0]); err != nil {
+				if err == db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: %s does not have the %s role on '%s'\n", policy.Describe(subject), args[0], pattern)
+					exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(actor.Owner, "role-unassigned", args[0]+" "+subject+" "+pattern)
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "role-unassigned", args[0], subject, pattern)
+				return
+			}
+			fmt.Printf("%s Took the %s role on '%s' from %s\n", output.OK, args[0], pattern, policy.Describe(subject))
+		},
+	}
+
+	for _, c := range []*cobra.Command{roleAssignCmd, roleUnassignCmd} {
+		c.Flags().String("user", "", "OS user name or UID")
+		c.Flags().String("group", "", "OS group name or GID")
+		c.Flags().String("token", "", "API token name")
+		c.Flags().String("claim", "", "OIDC claim as NAME=VALUE, for tokens issued by 'lockbox login'")
+	}
+	roleCmd.AddCommand(roleListCmd, roleCreateCmd, roleDeleteCmd, roleAssignCmd, roleUnassignCmd)
+
+	// token command - API tokens for remote clients and the Vault facade
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage API tokens for remote clients",
+		Long: `Create tokens for clients of 'lockbox serve', sent as a bearer token
+(LOCKBOX_TOKEN) or X-Vault-Token. A token sees the keys matching its
+--scope read:PATTERN grants and any granted with 'lockbox policy allow
+--token'. The token is printed once at creation; only its hash is stored.
+With --ttl the token expires; add --refresh to also print a refresh token,
+which clients redeem for a new token when the old one expires.
+
+Quotas limit what a leaked token can take: --max-reads caps the values it
+may read per UTC day, and --max-keys the distinct keys it may ever read.
+The server answers reads past a quota with 429 and records the breach in
+the audit log.
+  lockbox token create ci --scope 'read:CI_*' --max-reads 500 --max-keys 10
+  lockbox token create deploy --ttl 1h --refresh --scope 'read:APP_*'
+  lockbox token quota ci --max-reads 1000
+  lockbox token revoke ci`,
+	}
+
+	tokenCreateCmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a token and print it (and its refresh token with --refresh)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ttl, _ := cmd.Flags().GetDuration("ttl")
+			scopes, _ := cmd.Flags().GetStringArray("scope")
+			refreshable, _ := cmd.Flags().GetBool("refresh")
+			maxReads, _ := cmd.Flags().GetInt("max-reads")
+			maxKeys, _ := cmd.Flags().GetInt("max-keys")
+			if ttl < 0 {
+				fmt.Fprintf(os.Stderr, "Error: --ttl must not be negative\n")
+				exit(1)
+			}
+			if maxReads < 0 || maxKeys < 0 {
+				fmt.Fprintf(os.Stderr, "Error: quotas must not be negative\n")
+				exit(1)
+			}
+			if refreshable && ttl == 0 {
+				fmt.Fprintf(os.Stderr, "Error: --refresh requires --ttl\n")
+				exit(1)
+			}
+			for _, scope := range scopes {
+				if err := policy.ValidateScope(scope); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			t := db.Token{Name: args[0], Scopes: scopes, TTL: ttl, MaxReads: maxReads, MaxKeys: maxKeys}
+			if ttl > 0 {
+				t.ExpiresAt = time.Now().Add(ttl)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			tok, refresh, err := token.Issue(store, t, refreshable)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Fprintf(os.Stderr, "%s Created token '%s'; it will not be shown again\n", output.OK, args[0])
+			fmt.Println(tok)
+			if refresh != "" {
+				fmt.Println(refresh)
+			}
+		},
+	}
+
+	tokenListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List tokens",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			tokens, err := store.ListTokens()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			now := time.Now()
+			if isPorcelain(cmd) {
+				for _, t := range tokens {
+					status := "active"
+					switch {
+					case t.Revoked():
+						status = "revoked"
+					case t.Expired(now) && !t.Refreshable:
+						status = "expired"
+					}
+					refreshable := "no"
+					if t.Refreshable {
+						refreshable = "yes"
+					}
+					usage, err := store.TokenUsage(t.Name, now)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						exit(1)
+					}
+					porcelain.Write(os.Stdout, "token", t.Name, porcelain.Time(t.CreatedAt), porcelain.Time(t.ExpiresAt), status, refreshable, strings.Join(t.Scopes, ","),
+						strconv.Itoa(usage.Reads), strconv.Itoa(t.MaxReads), strconv.Itoa(usage.Keys), strconv.Itoa(t.MaxKeys))
+				}
+				return
+			}
+			if len(tokens) == 0 {
+				fmt.Println("No tokens found")
+				return
+			}
+			for _, t := range tokens {
+				status := "expires never"
+				switch {
+				case t.Revoked():
+					status = "revoked " + t.RevokedAt.Format(time.RFC3339)
+				case t.Expired(now) && !t.Refreshable:
+					status = "expired " + t.ExpiresAt.Format(time.RFC3339)
+				case !t.ExpiresAt.IsZero():
+					status = "expires " + t.ExpiresAt.Format(time.RFC3339)
+				}
+				if t.Refreshable && !t.Revoked() {
+					status += " (refreshable)"
+				}
+				var quotas []string
+				if t.MaxReads > 0 || t.MaxKeys > 0 {
+					usage, err := store.TokenUsage(t.Name, now)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						exit(1)
+					}
+					if t.MaxReads > 0 {
+						quotas = append(quotas, fmt.Sprintf("%d/%d reads today", usage.Reads, t.MaxReads))
+					}
+					if t.MaxKeys > 0 {
+						quotas = append(quotas, fmt.Sprintf("%d/%d keys", usage.Keys, t.MaxKeys))
+					}
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\n", t.Name, t.CreatedAt.Format(time.RFC3339), status, strings.Join(t.Scopes, ","), strings.Join(quotas, ", "))
+			}
+		},
+	}
+
+	tokenRevokeCmd := &cobra.Command{
+		Use:   "revoke NAME",
+		Short: "Revoke a token and its refresh token",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			if err := store.RevokeToken(args[0]); err != nil {
+				if err == db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: no live token '%s'\n", args[0])
+					exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "token-revoked", args[0])
+				return
+			}
+			fmt.Printf("%s Revoked token '%s'\n", output.OK, args[0])
+		},
+	}
+	tokenQuotaCmd := &cobra.Command{
+		Use:   "quota NAME [--max-reads N] [--max-keys N]",
+		Short: "Change the quotas of a token",
+		Long: `Change the quotas of a live token; flags left out keep their current
+value, and 0 removes a quota. Usage counted so far is kept.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			maxReads, _ := cmd.Flags().GetInt("max-reads")
+			maxKeys, _ := cmd.Flags().GetInt("max-keys")
+			if maxReads < 0 || maxKeys < 0 {
+				fmt.Fprintf(os.Stderr, "Error: quotas must not be negative\n")
+				exit(1)
+			}
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			tokens, err := store.ListTokens()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			i := slices.IndexFunc(tokens, func(t db.Token) bool { return t.Name == args[0] && !t.Revoked() })
+			if i < 0 {
+				fmt.Fprintf(os.Stderr, "Error: no live token '%s'\n", args[0])
+				exit(1)
+			}
+			if !cmd.Flags().Changed("max-reads") {
+				maxReads = tokens[i].MaxReads
+			}
+			if !cmd.Flags().Changed("max-keys") {
+				maxKeys = tokens[i].MaxKeys
+			}
+			if err := store.SetTokenQuota(args[0], maxReads, maxKeys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(localActor(store).Owner, "token-quota", fmt.Sprintf("%s reads/day=%d keys=%d", args[0], maxReads, maxKeys))
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "token-quota", args[0], strconv.Itoa(maxReads), strconv.Itoa(maxKeys))
+				return
+			}
+			fmt.Printf("%s Token '%s' may read %s per day and %s\n", output.OK, args[0], quotaText(maxReads, "values"), quotaText(maxKeys, "distinct keys"))
+		},
+	}
+	tokenQuotaCmd.Flags().Int("max-reads", 0, "Values the token may read per UTC day (0 for no limit)")
+	tokenQuotaCmd.Flags().Int("max-keys", 0, "Distinct keys the token may ever read (0 for no limit)")
+
+	tokenCreateCmd.Flags().Duration("ttl", 0, "Expire the token after this long (e.g., 1h); never by default")
+	tokenCreateCmd.Flags().Int("max-reads", 0, "Values the token may read per UTC day (default no limit)")
+	tokenCreateCmd.Flags().Int("max-keys", 0, "Distinct keys the token may ever read (default no limit)")
+	tokenCreateCmd.Flags().StringArray("scope", nil, "Grant read access to keys matching a pattern, as read:PATTERN (repeatable)")
+	tokenCreateCmd.Flags().Bool("refresh", false, "Also issue a refresh token that renews the token for another --ttl")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenQuotaCmd, tokenRevokeCmd)
+
+	// pair command - Pair a mobile device with the server over a QR code
+	pairCmd := &cobra.Command{
+		Use:   "pair NAME --scope read:PATTERN",
+		Short: "Pair a mobile device by showing a QR code",
+		Long: `Show a QR code for a device on the local network to scan. It holds the
+address of 'lockbox serve' and a one-time pairing code, which the device
+redeems at /v1/auth/pair for an API token called NAME carrying the
+--scope grants. The command waits until the device has paired or the
+code expires; the token is then managed with 'lockbox token':
+  lockbox pair phone --scope 'read:MOBILE_*'
+  lockbox pair tablet --scope 'read:*' --url https://nas.local:8100 --tls-cert cert.pem
+The server address is this machine's local network address and --port
+unless --url is given; serve listens there with 'lockbox serve --bind
+0.0.0.0'. The QR code is only shown once the server answers at that
+address. --tls-cert puts the fingerprint of the server's
+certificate in the code, so a self-signed certificate can be pinned.
+The store's fingerprint ('lockbox fingerprint') is shown too; the device
+receives the fingerprint of the server it reached when it pairs, so a
+mismatch reveals a device talking to another server.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			scopes, _ := cmd.Flags().GetStringArray("scope")
+			serverURL, _ := cmd.Flags().GetString("url")
+			port, _ := cmd.Flags().GetString("port")
+			certFile, _ := cmd.Flags().GetString("tls-cert")
+			ttl, _ := cmd.Flags().GetDuration("for")
+			if len(scopes) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: at least one --scope is required\n")
+				exit(1)
+			}
+			for _, scope := range scopes {
+				if err := policy.ValidateScope(scope); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if ttl <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: --for must be positive\n")
+				exit(1)
+			}
+
+			var certFingerprint string
+			if certFile != "" {
+				var err error
+				if certFingerprint, err = pairing.Fingerprint(certFile); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if serverURL == "" {
+				var err error
+				if serverURL, err = pairing.LocalURL(port, certFile != ""); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if err := pairing.Reachable(serverURL); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			fingerprint, err := crypto.Fingerprint(encKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			tokens, err := store.ListTokens()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if slices.ContainsFunc(tokens, func(t db.Token) bool { return t.Name == name }) {
+				fmt.Fprintf(os.Stderr, "Error: token '%s' already exists\n", name)
+				exit(1)
+			}
+
+			code, err := token.Generate()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			expires := time.Now().Add(ttl).Truncate(time.Second)
+			if err := store.CreatePairing(db.Pairing{Name: name, Scopes: scopes, ExpiresAt: expires}, token.Hash(code)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			store.Audit(localActor(store).Owner, "pairing-created", name)
+
+			uri := pairing.URI(serverURL, code, certFingerprint)
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "pairing", uri, porcelain.Time(expires), fingerprint)
+			} else {
+				symbol, err := qr.Encode([]byte(uri))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				fmt.Print(symbol.Text())
+				fmt.Printf("Scan to pair '%s' with %s; the code expires at %s\n", name, serverURL, expires.Format(time.Kitchen))
+				fmt.Printf("Once paired, check that the device shows the store fingerprint %s\n", fingerprint)
+			}
+
+			// Wait for the server to redeem the code
+			for {
+				pending, err := store.PairingPending(name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				if !pending {
+					break
+				}
+				time.Sleep(500 * time.Millisecond)
+			}
+			tokens, err = store.ListTokens()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if !slices.ContainsFunc(tokens, func(t db.Token) bool { return t.Name == name }) {
+				fmt.Fprintf(os.Stderr, "Error: the pairing code expired before '%s' paired\n", name)
+				exit(1)
+			}
+
+			if isPorcelain(cmd) {
+				porcelain.Write(os.Stdout, "paired", name)
+				return
+			}
+			fmt.Printf("%s Paired '%s'; revoke it with 'lockbox token revoke %s'\n", output.OK, name, name)
+		},
+	}
+	pairCmd.Flags().StringArray("scope", nil, "Grant the device read access to keys matching a pattern, as read:PATTERN (repeatable)")
+	pairCmd.Flags().String("url", "", "URL of 'lockbox serve' as the device reaches it (default: this machine's local address)")
+	pairCmd.Flags().StringP("port", "p", "8100", "Port of 'lockbox serve', for the default URL")
+	pairCmd.Flags().String("tls-cert", "", "Certificate of 'lockbox serve' for the device to pin; the default URL uses https")
+	pairCmd.Flags().Duration("for", 5*time.Minute, "How long the pairing code stays valid")
+
+	// bundle command - Read-only snapshots for third parties
+	bundleCmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Create and open read-only share bundles",
+		Long: `Share a read-only snapshot of selected secrets with a third party, such
+as an auditor, without giving them access to the store or server. The
+recipient generates a key pair and sends you the public key; the bundle
+is encrypted to it, signed by this store and refused once it expires.
+  lockbox bundle keygen auditor          # recipient: auditor.key, auditor.pub
+  lockbox bundle create --only 'PROD_*' --expires 7d --for auditor.pub
+  lockbox bundle verify lockbox.bundle   # anyone: signature and expiry
+  lockbox bundle open lockbox.bundle --key auditor.key
+
+Expiry is enforced by 'bundle open'; it cannot take back values a
+recipient has already decrypted.`,
+	}
+
+	bundleKeygenCmd := &cobra.Command{
+		Use:   "keygen NAME",
+		Short: "Generate a recipient key pair as NAME.key and NAME.pub",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := bundle.GenerateKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			priv, err := bundle.MarshalPrivateKey(key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			pub, err := bundle.MarshalPublicKey(key.PublicKey())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			for _, f := range []struct {
+				path string
+				data []byte
+				perm os.FileMode
+			}{{args[0] + ".key", priv, 0600}, {args[0] + ".pub", pub, 0644}} {
+				out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.perm)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				_, err = out.Write(f.data)
+				if closeErr := out.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to write %s: %v\n", f.path, err)
+					exit(1)
+				}
+			}
+
+			fmt.Printf("%s Wrote %s.key (keep private) and %s.pub (send to the bundle creator)\n", output.OK, args[0], args[0])
+			fmt.Printf("  Fingerprint: %s\n", bundle.Fingerprint(key.PublicKey().Bytes()))
+		},
+	}
+
+	bundleCreateCmd := &cobra.Command{
+		Use:   "create --for PUBKEY",
+		Short: "Write a signed, expiring bundle of secrets for a recipient",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			recipientPath, _ := cmd.Flags().GetString("for")
+			only, _ := cmd.Flags().GetStringArray("only")
+			expiresIn, _ := cmd.Flags().GetString("expires")
+			outPath, _ := cmd.Flags().GetString("out")
+			if recipientPath == "" {
+				fmt.Fprintf(os.Stderr, "Error: --for is required\n")
+				exit(1)
+			}
+
+			validity, err := bundle.ParseExpiry(expiresIn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			pemData, err := os.ReadFile(recipientPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			recipient, err := bundle.ParsePublicKey(pemData)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", recipientPath, err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+
+			keys, err := store.ListSecrets()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
+				exit(1)
+			}
+			if len(only) > 0 {
+				if keys, err = selector.Resolve(keys, only); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+
+			secrets := make(map[string]string, len(keys))
+			for _, key := range keys {
+				encrypted, err := store.GetSecret(key)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to get secret '%s': %v\n", key, err)
+					exit(1)
+				}
+				decrypted, err := crypto.Decrypt(encrypted, encKey)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to decrypt secret '%s': %v\n", key, err)
+					exit(1)
+				}
+				secrets[key] = string(decrypted)
+			}
+
+			signer, err := bundle.SigningKey(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			now := time.Now()
+			data, err := bundle.Create(secrets, recipient, signer, now, now.Add(validity))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if err := os.WriteFile(outPath, data, 0600); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to write bundle: %v\n", err)
+				exit(1)
+			}
+
+			fmt.Printf("%s Wrote %s with %d secrets, expiring %s\n", output.OK, outPath, len(secrets), now.Add(validity).Format(time.RFC3339))
+			fmt.Printf("  Recipient: %s\n", bundle.Fingerprint(recipient.Bytes()))
+			fmt.Printf("  Signer:    %s\n", bundle.Fingerprint(signer.Public().(ed25519.PublicKey)))
+		},
+	}
+
+	// openBundle reads and verifies the bundle at path, exiting on failure.
+	// A non-empty signer must match the bundle's signer fingerprint.
+	openBundle := func(path, signer string, key *ecdh.PrivateKey) (*bundle.Bundle, map[string]string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		var b *bundle.Bundle
+		var secrets map[string]string
+		if key != nil {
+			b, secrets, err = bundle.Open(data, key, time.Now())
+		} else {
+			b, err = bundle.Verify(data, time.Now())
 		}
-		return nil, nil, fmt.Errorf("failed to get encryption key: %w", err)
+		if err == bundle.ErrExpired {
+			fmt.Fprintf(os.Stderr, "Error: bundle expired at %s\n", b.Expires.Format(time.RFC3339))
+			exit(1)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if signer != "" && bundle.Fingerprint(b.Signer) != signer {
+			fmt.Fprintf(os.Stderr, "Error: bundle was signed by %s, not %s\n", bundle.Fingerprint(b.Signer), signer)
+			exit(1)
+		}
+		return b, secrets
 	}
 
-	// Decode hex-encoded key
-	key, err := hex.DecodeString(string(keyHex))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode encryption key: %w", err)
+	bundleVerifyCmd := &cobra.Command{
+		Use:   "verify FILE",
+		Short: "Check a bundle's signature and expiry without opening it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			signer, _ := cmd.Flags().GetString("signer")
+			b, _ := openBundle(args[0], signer, nil)
+
+			fmt.Printf("%s Bundle signature is valid\n", output.OK)
+			fmt.Printf("  Signer:    %s\n", bundle.Fingerprint(b.Signer))
+			fmt.Printf("  Recipient: %s\n", b.Recipient)
+			fmt.Printf("  Created:   %s\n", b.Created.Format(time.RFC3339))
+			fmt.Printf("  Expires:   %s\n", b.Expires.Format(time.RFC3339))
+		},
 	}
 
-	return store, key, nil
-}
+	bundleOpenCmd := &cobra.Command{
+		Use:   "open FILE --key KEYFILE",
+		Short: "Verify a bundle and print its secrets",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			keyPath, _ := cmd.Flags().GetString("key")
+			signer, _ := cmd.Flags().GetString("signer")
+			asJSON, _ := cmd.Flags().GetBool("json")
+			if keyPath == "" {
+				fmt.Fprintf(os.Stderr, "Error: --key is required\n")
+				exit(1)
+			}
 
-// fetchRemoteSecrets fetches secrets from a remote server
-func fetchRemoteSecrets(remote string) (map[string]string, error) {
-	url := fmt.Sprintf("http://%s/secrets", remote)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch secrets from remote: %w", err)
+			pemData, err := os.ReadFile(keyPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			key, err := bundle.ParsePrivateKey(pemData)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", keyPath, err)
+				exit(1)
+			}
+
+			b, secrets := openBundle(args[0], signer, key)
+			fmt.Fprintf(os.Stderr, "%s Bundle from %s, valid until %s\n", output.OK, bundle.Fingerprint(b.Signer), b.Expires.Format(time.RFC3339))
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(secrets)
+				return
+			}
+			keys := slices.Sorted(maps.Keys(secrets))
+			for _, k := range keys {
+				fmt.Print(export.Line(k, secrets[k]))
+			}
+		},
 	}
-	defer resp.Body.Close()
+	bundleCreateCmd.Flags().String("for", "", "Recipient public key file (PEM, from 'lockbox bundle keygen')")
+	bundleCreateCmd.Flags().StringArray("only", nil, "Only include keys matching this key or glob pattern (repeatable)")
+	bundleCreateCmd.Flags().String("expires", "7d", "How long the bundle can be opened, e.g. 7d or 12h")
+	bundleCreateCmd.Flags().String("out", "lockbox.bundle", "File to write the bundle to")
+	bundleVerifyCmd.Flags().String("signer", "", "Require this signer fingerprint")
+	bundleOpenCmd.Flags().String("key", "", "Recipient private key file (PEM)")
+	bundleOpenCmd.Flags().String("signer", "", "Require this signer fingerprint")
+	bundleOpenCmd.Flags().Bool("json", false, "Print the secrets as a JSON object")
+	bundleCmd.AddCommand(bundleKeygenCmd, bundleCreateCmd, bundleVerifyCmd, bundleOpenCmd)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("remote server returned status %d: %s", resp.StatusCode, body)
+	// escrow command - Archive secrets before they are deleted or overwritten
+	escrowCmd := &cobra.Command{
+		Use:   "escrow",
+		Short: "Archive secrets before they are deleted or overwritten",
+		Long: `With escrow enabled, every delete or overwrite of a secret, note or other
+stored value first appends the old ciphertext and its metadata to an
+append-only archive file, and the write fails if the archive cannot be
+written. Entries are sealed to a separate escrow key, so restoring a value
+takes both that key and the store key.
+  lockbox bundle keygen escrow           # keep escrow.key off this machine
+  lockbox escrow enable --archive /var/backups/lockbox.escrow --key escrow.pub
+  lockbox escrow list
+  lockbox escrow restore 3 --key escrow.key
+
+For protection against a compromised account, place the archive where the
+store's user can only append to it, e.g. with 'chattr +a'.`,
 	}
 
-	var keys []string
-	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
-		return nil, fmt.Errorf("failed to decode remote response: %w", err)
+	escrowEnableCmd := &cobra.Command{
+		Use:   "enable --archive FILE --key PUBKEY",
+		Short: "Archive every delete and overwrite to FILE",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			archivePath, _ := cmd.Flags().GetString("archive")
+			keyPath, _ := cmd.Flags().GetString("key")
+			if archivePath == "" {
+				fmt.Fprintf(os.Stderr, "Error: --archive is required\n")
+				exit(1)
+			}
+			if keyPath == "" {
+				fmt.Fprintf(os.Stderr, "Error: --key is required\n")
+				exit(1)
+			}
+
+			pemData, err := os.ReadFile(keyPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			recipient, err := bundle.ParsePublicKey(pemData)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", keyPath, err)
+				exit(1)
+			}
+			archivePath, err = filepath.Abs(archivePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			// Fail now rather than on the first delete if the file is unwritable
+			f, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			f.Close()
+
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can change escrow settings\n")
+				exit(1)
+			}
+
+			if err := escrow.Enable(store, archivePath, recipient); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("%s Escrow enabled: deletes and overwrites are archived to %s\n", output.OK, archivePath)
+			fmt.Printf("  Key: %s\n", bundle.Fingerprint(recipient.Bytes()))
+		},
 	}
 
-	secrets := make(map[string]string)
-	for _, key := range keys {
-		valueURL := fmt.Sprintf("http://%s/secrets/%s", remote, key)
-		valueResp, err := http.Get(valueURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch secret '%s' from remote: %w", key, err)
-		}
-		defer valueResp.Body.Close()
+	escrowDisableCmd := &cobra.Command{
+		Use:   "disable",
+		Short: "Stop archiving deletes and overwrites",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			store, _, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can change escrow settings\n")
+				exit(1)
+			}
+
+			if err := escrow.Disable(store); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Println(output.OK, "Escrow disabled; the archive file was left in place")
+		},
+	}
 
-		if valueResp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(valueResp.Body)
-			return nil, fmt.Errorf("remote server returned status %d for '%s': %s", valueResp.StatusCode, key, body)
+	// loadEscrow returns the archive path from --archive or the store's
+	// settings, and its entries
+	loadEscrow := func(cmd *cobra.Command, store *db.Store) (string, []escrow.Entry) {
+		archivePath, _ := cmd.Flags().GetString("archive")
+		if archivePath == "" {
+			archive, err := escrow.Load(store)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if archive == nil {
+				fmt.Fprintf(os.Stderr, "Error: escrow is not enabled; pass --archive to read an archive file\n")
+				exit(1)
+			}
+			archivePath = archive.Path
 		}
 
-		value, err := io.ReadAll(valueResp.Body)
+		entries, err := escrow.ReadFile(archivePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read secret '%s' from remote: %w", key, err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
 		}
-		secrets[key] = string(value)
-	}
-
-	return secrets, nil
-}
-
-func main() {
-	rootCmd := &cobra.Command{
-		Use:   "lockbox",
-		Short: "Lockbox - A secure secret management CLI",
-		Long:  `Lockbox is a command-line tool for securely storing and managing secrets.`,
+		return archivePath, entries
 	}
 
-	// init command
-	initCmd := &cobra.Command{
-		Use:   "init",
-		Short: "Initialize Lockbox",
-		Long:  `Initialize Lockbox by creating the store and generating an encryption key.`,
+	escrowListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List archived entries, oldest first",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			// Create store
-			store, err := db.NewStore()
+			store, _, err := getStoreAndKey()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to create store: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
 			defer store.Close()
 
-			// Check if key already exists
-			_, err = store.GetConfig("encryption_key")
-			if err == nil {
-				fmt.Println("Lockbox is already initialized. Encryption key already exists.")
+			archivePath, entries := loadEscrow(cmd, store)
+			if isPorcelain(cmd) {
+				for i, e := range entries {
+					porcelain.Write(os.Stdout, "escrow", strconv.Itoa(i+1), porcelain.Time(e.Time), e.Op, store.InVault(e.Vault).Qualify(e.Key))
+				}
 				return
 			}
-			if err != db.ErrNotFound {
-				fmt.Fprintf(os.Stderr, "Error: failed to check for existing key: %v\n", err)
-				os.Exit(1)
+			if len(entries) == 0 {
+				fmt.Printf("No entries in %s\n", archivePath)
+				return
+			}
+			for i, e := range entries {
+				fmt.Printf("%4d  %s  %-9s  %s\n", i+1, e.Time.Local().Format(time.DateTime), e.Op, store.InVault(e.Vault).Qualify(e.Key))
+			}
+		},
+	}
+
+	escrowRestoreCmd := &cobra.Command{
+		Use:   "restore ENTRY... --key KEYFILE",
+		Short: "Put archived values back into the store",
+		Long: `Restore the values archived in the given entries, numbered as in
+'lockbox escrow list', together with their owners. An existing secret
+is only replaced with --force; with escrow enabled its current value is
+archived first.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			keyPath, _ := cmd.Flags().GetString("key")
+			force, _ := cmd.Flags().GetBool("force")
+			if keyPath == "" {
+				fmt.Fprintf(os.Stderr, "Error: --key is required\n")
+				exit(1)
 			}
 
-			// Generate encryption key
-			key, err := crypto.GenerateKey()
+			pemData, err := os.ReadFile(keyPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			escrowKey, err := bundle.ParsePrivateKey(pemData)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to generate encryption key: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", keyPath, err)
+				exit(1)
 			}
 
-			// Store key as hex string
-			keyHex := hex.EncodeToString(key)
-			if err := store.SetConfig("encryption_key", []byte(keyHex)); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to store encryption key: %v\n", err)
-				os.Exit(1)
+			store, key, err := getStoreAndKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
+			defer store.Close()
+			if !localActor(store).Admin {
+				fmt.Fprintf(os.Stderr, "Error: only the store's owner can restore from escrow\n")
+				exit(1)
+			}
+
+			_, entries := loadEscrow(cmd, store)
+			for _, arg := range args {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 1 || n > len(entries) {
+					fmt.Fprintf(os.Stderr, "Error: no escrow entry '%s' (the archive has %d)\n", arg, len(entries))
+					exit(1)
+				}
+				a, err := entries[n-1].Open(escrowKey)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+
+				// Values go back to the vault they were archived from
+				target := store.InVault(a.Vault)
+				if ok, err := store.HasVault(a.Vault); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				} else if !ok {
+					fmt.Fprintf(os.Stderr, "Error: entry %d is from vault '%s', which no longer exists; create it with 'lockbox vault create %s'\n", n, a.Vault, a.Vault)
+					exit(1)
+				}
+
+				// The value must still decrypt with this store's key
+				plaintext, err := crypto.Decrypt(a.Value, key)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: entry %d for '%s' was not encrypted with this store's key\n", n, target.Qualify(a.Key))
+					exit(1)
+				}
+				if _, err := target.GetSecret(a.Key); err == nil && !force {
+					fmt.Fprintf(os.Stderr, "Error: '%s' already exists; use --force to replace it\n", target.Qualify(a.Key))
+					exit(1)
+				} else if err != nil && err != db.ErrNotFound {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
 
-			fmt.Println("✓ Lockbox initialized successfully")
+				if a.Kind == "" {
+					var digest string
+					digest, err = crypto.Digest(plaintext, key)
+					if err == nil {
+						err = target.SetSecretBlob(a.Key, digest, a.Value)
+					}
+				} else {
+					err = target.SetKindSecret(a.Kind, a.Key, a.Value)
+				}
+				if err == nil {
+					err = target.SetSecretOwner(a.Key, a.Owner)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				fmt.Printf("%s Restored '%s' as of %s\n", output.OK, target.Qualify(a.Key), a.Updated.Local().Format(time.DateTime))
+			}
 		},
 	}
+	escrowEnableCmd.Flags().String("archive", "", "Archive file to append to")
+	escrowEnableCmd.Flags().String("key", "", "Escrow public key file (PEM, from 'lockbox bundle keygen')")
+	escrowListCmd.Flags().String("archive", "", "Archive file to read (default: the enabled archive)")
+	escrowRestoreCmd.Flags().String("archive", "", "Archive file to read (default: the enabled archive)")
+	escrowRestoreCmd.Flags().String("key", "", "Escrow private key file (PEM)")
+	escrowRestoreCmd.Flags().Bool("force", false, "Replace secrets that already exist")
+	escrowCmd.AddCommand(escrowEnableCmd, escrowDisableCmd, escrowListCmd, escrowRestoreCmd)
 
-	// set command
-	setCmd := &cobra.Command{
-		Use:   "set KEY VALUE",
-		Short: "Set a secret",
-		Long:  `Store a secret with the given key and value.`,
-		Args:  cobra.ExactArgs(2),
+	// harden command - Generate confinement profiles
+	hardenCmd := &cobra.Command{
+		Use:   "harden",
+		Short: "Generate AppArmor or SELinux confinement profiles",
+		Long: `Emit a least-privilege confinement profile for the lockbox binary and
+serve daemon, tailored to the configured store path, socket and port.
+The AppArmor profile forbids exec unless --allow-run is given, so 'lockbox
+run' works only with it. Files are printed to stdout, or written to --out:
+  lockbox harden --generate-apparmor --socket /run/lockbox.sock
+  lockbox harden --generate-selinux --port 8100 --out ./selinux`,
+		Args: cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			key := args[0]
-			value := args[1]
+			apparmor, _ := cmd.Flags().GetBool("generate-apparmor")
+			selinux, _ := cmd.Flags().GetBool("generate-selinux")
+			socket, _ := cmd.Flags().GetString("socket")
+			port, _ := cmd.Flags().GetString("port")
+			outDir, _ := cmd.Flags().GetString("out")
+			allowRun, _ := cmd.Flags().GetBool("allow-run")
 
-			store, encKey, err := getStoreAndKey()
+			if apparmor == selinux {
+				fmt.Fprintf(os.Stderr, "Error: specify exactly one of --generate-apparmor or --generate-selinux\n")
+				exit(1)
+			}
+
+			binary, err := os.Executable()
+			if err == nil {
+				binary, err = filepath.EvalSymlinks(binary)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to locate lockbox binary: %v\n", err)
+				exit(1)
+			}
+			storePath, err := db.ResolvePath()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				exit(1)
+			}
+			if socket != "" {
+				socket, _ = filepath.Abs(socket)
 			}
-			defer store.Close()
 
-			// Encrypt the value
-			encrypted, err := crypto.Encrypt([]byte(value), encKey)
+			config := harden.Config{Binary: binary, StorePath: storePath, Socket: socket, Port: port, AllowRun: allowRun}
+			var files []harden.File
+			if apparmor {
+				files, err = harden.AppArmor(config)
+			} else {
+				files, err = harden.SELinux(config)
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to encrypt value: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
 
-			// Store the encrypted value
-			if err := store.SetSecret(key, encrypted); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to store secret: %v\n", err)
-				os.Exit(1)
+			if outDir == "" {
+				for _, f := range files {
+					// Mark file boundaries when a policy spans several files
+					if len(files) > 1 {
+						fmt.Printf("# ==> %s <==\n", f.Name)
+					}
+					fmt.Print(f.Content)
+				}
+				return
 			}
 
-			fmt.Printf("✓ Secret '%s' set successfully\n", key)
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create output directory: %v\n", err)
+				exit(1)
+			}
+			for _, f := range files {
+				path := filepath.Join(outDir, f.Name)
+				if err := os.WriteFile(path, []byte(f.Content), 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: failed to write %s: %v\n", path, err)
+					exit(1)
+				}
+				fmt.Printf("%s Wrote %s\n", output.OK, path)
+			}
 		},
 	}
 
-	// get command
-	getCmd := &cobra.Command{
-		Use:   "get KEY",
-		Short: "Get a secret",
-		Long:  `Retrieve and decrypt a secret by its key.`,
-		Args:  cobra.ExactArgs(1),
+	hardenCmd.Flags().Bool("generate-apparmor", false, "Generate an AppArmor profile")
+	hardenCmd.Flags().Bool("generate-selinux", false, "Generate an SELinux policy module (.te and .fc)")
+	hardenCmd.Flags().String("socket", "", "Unix socket the server listens on")
+	hardenCmd.Flags().StringP("port", "p", "8100", "TCP port the server listens on (empty for none)")
+	hardenCmd.Flags().String("out", "", "Write files to this directory instead of stdout")
+	hardenCmd.Flags().Bool("allow-run", false, "Let 'lockbox run' exec commands, which run unconfined (AppArmor)")
+
+	// podman-driver command - Podman shell secret driver
+	podmanDriverCmd := &cobra.Command{
+		Use:   "podman-driver",
+		Short: "Podman secret driver backed by lockbox",
+		Long: `Implements Podman's shell secret driver so 'podman secret create'
+stores secrets in lockbox and containers receive them natively. Podman
+passes the secret ID in $SECRET_ID and the value on stdin. Secrets stored
+this way are kept out of 'lockbox env' and 'lockbox run'.
+  lockbox podman-driver config >> ~/.config/containers/containers.conf
+  printf 's3cret' | podman secret create db_password -
+  podman run --secret db_password alpine cat /run/secrets/db_password`,
+	}
+
+	podmanConfigCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Print the containers.conf section enabling the driver",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			key := args[0]
+			binary, err := os.Executable()
+			if err != nil {
+				binary = "lockbox"
+			}
+			fmt.Print(podman.Config(binary))
+		},
+	}
+
+	podmanStoreCmd := &cobra.Command{
+		Use:   "store",
+		Short: "Store the secret on stdin under $SECRET_ID",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			id := os.Getenv("SECRET_ID")
+			if _, err := podman.Key(id); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			value, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read secret: %v\n", err)
+				exit(1)
+			}
 
 			store, encKey, err := getStoreAndKey()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
 			defer store.Close()
 
-			// Get the encrypted value
-			encrypted, err := store.GetSecret(key)
+			if err := podman.Store(store, encKey, id, value); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	podmanLookupCmd := &cobra.Command{
+		Use:   "lookup",
+		Short: "Print the secret stored under $SECRET_ID",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			id := os.Getenv("SECRET_ID")
+			if _, err := podman.Key(id); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+
+			store, encKey, err := getStoreAndKey()
 			if err != nil {
-				if err == db.ErrNotFound {
-					fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
-					os.Exit(1)
-				}
-				fmt.Fprintf(os.Stderr, "Error: failed to get secret: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
+			defer store.Close()
 
-			// Decrypt the value
-			decrypted, err := crypto.Decrypt(encrypted, encKey)
+			value, err := podman.Lookup(store, encKey, id)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to decrypt secret: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
-
-			// Print just the value with no extra formatting
-			fmt.Print(string(decrypted))
+			os.Stdout.Write(value)
 		},
 	}
 
-	// delete command
-	deleteCmd := &cobra.Command{
-		Use:   "delete KEY",
-		Short: "Delete a secret",
-		Long:  `Remove a secret by its key.`,
-		Args:  cobra.ExactArgs(1),
+	podmanDeleteCmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete the secret stored under $SECRET_ID",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			key := args[0]
+			id := os.Getenv("SECRET_ID")
+			if _, err := podman.Key(id); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
 
 			store, _, err := getStoreAndKey()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
 			defer store.Close()
 
-			// Delete the secret
-			if err := store.DeleteSecret(key); err != nil {
-				if err == db.ErrNotFound {
-					fmt.Fprintf(os.Stderr, "Error: secret '%s' not found\n", key)
-					os.Exit(1)
-				}
-				fmt.Fprintf(os.Stderr, "Error: failed to delete secret: %v\n", err)
-				os.Exit(1)
+			if err := podman.Delete(store, id); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
-
-			fmt.Printf("✓ Secret '%s' deleted successfully\n", key)
 		},
 	}
 
-	// list command
-	listCmd := &cobra.Command{
+	podmanListCmd := &cobra.Command{
 		Use:   "list",
-		Short: "List all secrets",
-		Long:  `Display all stored secret keys.`,
+		Short: "List stored secret IDs",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			store, _, err := getStoreAndKey()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
 			defer store.Close()
 
-			// Get all secrets
-			keys, err := store.ListSecrets()
+			ids, err := podman.List(store)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
 			}
-
-			if len(keys) == 0 {
-				fmt.Println("No secrets found")
-				return
+			for _, id := range ids {
+				fmt.Println(id)
 			}
-
-			// Print each key on its own line
-			fmt.Println(strings.Join(keys, "\n"))
 		},
 	}
 
-	// env command - Export secrets as environment variables
-	envCmd := &cobra.Command{
-		Use:   "env",
-		Short: "Export secrets as environment variables",
-		Long: `Export all stored secrets in shell export format.
-Can be used with eval or source to set environment variables:
-  eval $(lockbox env)
-  source <(lockbox env)`,
-		Args: cobra.NoArgs,
-		Run: func(cmd *cobra.Command, args []string) {
-			store, encKey, err := getStoreAndKey()
+	podmanDriverCmd.AddCommand(podmanConfigCmd, podmanStoreCmd, podmanLookupCmd, podmanDeleteCmd, podmanListCmd)
+
+	// Modify env command to support --remote flag
+	envCmdRun := envCmd.Run
+	envCmd.Run = func(cmd *cobra.Command, args []string) {
+		remoteFlag, _ := cmd.Flags().GetString("remote")
+		filter := keyFilter(cmd)
+
+		if remoteFlag != "" && (len(args) > 0 || !filter.IsZero()) {
+			// Fetch everything visible and select locally
+			remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+			secrets, err := remote.FetchAll()
+			remote.Close()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
-			defer store.Close()
-
-			// Get all secrets
-			keys, err := store.ListSecrets()
+			keys := slices.Sorted(maps.Keys(secrets))
+			if len(args) > 0 {
+				if keys, err = selector.Resolve(keys, args); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+			if keys, err = filter.Apply(keys); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			for _, key := range keys {
+				fmt.Print(export.Line(key, secrets[key]))
+			}
+		} else if remoteFlag != "" {
+			// Fetch from remote server
+			resp, err := client.New(remoteFlag, remoteOptions(remoteFlag)).Get("/env")
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
-				os.Exit(1)
+				fmt.Fprintf(os.Stderr, "Error: failed to fetch from remote: %v\n", err)
+				exit(1)
 			}
+			defer resp.Body.Close()
 
-			// For each key, get and decrypt the value
-			for _, key := range keys {
-				encrypted, err := store.GetSecret(key)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: failed to get secret '%s': %v\n", key, err)
-					os.Exit(1)
-				}
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Fprintf(os.Stderr, "Error: remote server returned status %d: %s\n", resp.StatusCode, body)
+				exit(1)
+			}
 
-				// Decrypt the value
-				decrypted, err := crypto.Decrypt(encrypted, encKey)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: failed to decrypt secret '%s': %v\n", key, err)
-					os.Exit(1)
-				}
+			// Print the response as it arrives; a cut-off stream is an error,
+			// not a shorter environment
+			if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: response from remote was cut off: %v\n", err)
+				exit(1)
+			}
+		} else {
+			// Use original local implementation
+			envCmdRun(cmd, args)
+		}
+	}
 
-				// Escape the value: surround with double quotes and escape special chars
-				value := string(decrypted)
-				escapedValue := strings.NewReplacer(
-					"\\", "\\\\",
-					"\"", "\\\"",
-					"$", "\\$",
-					"`", "\\`",
-				).Replace(value)
+	// Add --remote flag to env command
+	envCmd.Flags().StringP("remote", "r", "", "Remote server to fetch from (e.g., localhost:8100 or unix:///run/lockbox.sock)")
+	envCmd.Flags().StringSlice("only", nil, "Export only these keys or patterns (comma-separated)")
+	envCmd.Flags().StringSlice("prefix", nil, "Export only keys starting with this prefix (repeatable)")
+	envCmd.Flags().StringSlice("exclude", nil, "Leave out these keys or patterns (comma-separated)")
 
-				fmt.Printf("export %s=\"%s\"\n", key, escapedValue)
-			}
-		},
+	for _, c := range []*cobra.Command{envCmd, runCmd} {
+		c.Flags().Bool("strict", false, "Decrypt every value before starting, naming each that fails")
+		c.Flags().Bool("skip-bad", false, "Warn about values that cannot be decrypted and leave them out")
 	}
 
-	// run command - Run a command with secrets in environment
-	runCmd := &cobra.Command{
-		Use:   "run -- command [args...]",
-		Short: "Run a command with secrets in environment",
-		Long: `Execute a command with all stored secrets set as environment variables.
-Usage:
-  lockbox run -- sh -c 'echo $SECRET_VAR'
-  lockbox run -- env | grep SECRET
-  lockbox run -- ./my-app`,
-		TraverseChildren: true,
+	// lint command - Check secret references in templates and manifests
+	lintCmd := &cobra.Command{
+		Use:   "lint FILE...",
+		Short: "Check that secrets referenced by templates and manifests exist",
+		Long: `Check the secrets that templates and manifests refer to, so broken
+references fail CI instead of a deploy.
+
+Templates are consul-template or Vault agent files rendered against lockbox
+serve: {{ key "NAME" }}, {{ keyOrDefault "NAME" "x" }} and
+{{ with secret "secret/data/NAME" }}. Any file containing "{{" is read as a
+template. Other files are manifests listing one key per line, optionally as
+KEY=value lines like an .env.example; # starts a comment.
+
+Every reference must name an existing secret. keyOrDefault and keyExists
+lookups may name missing secrets. With --user, --group, --token or --claim
+the secrets must also be granted to that subject; with --remote they must
+be visible to the remote's credentials.
+  lockbox lint config.ctmpl app.manifest
+  lockbox lint --token ci deploy/*.tmpl`,
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			// Check for remote flag
 			remoteFlag, _ := cmd.Flags().GetString("remote")
+			username, _ := cmd.Flags().GetString("user")
+			group, _ := cmd.Flags().GetString("group")
+			tokenName, _ := cmd.Flags().GetString("token")
+			claim, _ := cmd.Flags().GetString("claim")
 
-			var secrets map[string]string
-			var err error
+			opts := lint.Options{Validate: server.ValidateKey}
+			checkPolicy := username != "" || group != "" || tokenName != "" || claim != ""
+			if remoteFlag != "" && checkPolicy {
+				fmt.Fprintf(os.Stderr, "Error: --remote cannot be combined with a policy subject\n")
+				exit(1)
+			}
 
 			if remoteFlag != "" {
-				// Fetch secrets from remote server
-				secrets, err = fetchRemoteSecrets(remoteFlag)
+				remote := client.New(remoteFlag, remoteOptions(remoteFlag))
+				keys, err := remote.ListSecrets()
+				remote.Close()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-					os.Exit(1)
+					exit(1)
 				}
+				opts.Keys = keys
 			} else {
-				// Get all secrets from local store
-				store, encKey, err := getStoreAndKey()
+				store, _, err := getStoreAndKey()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-					os.Exit(1)
+					exit(1)
 				}
 				defer store.Close()
 
-				keys, err := store.ListSecrets()
+				opts.Keys, err = store.ListSecrets()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: failed to list secrets: %v\n", err)
-					os.Exit(1)
+					exit(1)
 				}
 
-				secrets = make(map[string]string)
-				for _, key := range keys {
-					encrypted, err := store.GetSecret(key)
+				if checkPolicy {
+					subject, err := policy.ParseSubject(username, group, tokenName, claim)
 					if err != nil {
-						fmt.Fprintf(os.Stderr, "Error: failed to get secret '%s': %v\n", key, err)
-						os.Exit(1)
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						exit(1)
 					}
-
-					// Decrypt the value
-					decrypted, err := crypto.Decrypt(encrypted, encKey)
+					e, err := rbac.Load(store)
 					if err != nil {
-						fmt.Fprintf(os.Stderr, "Error: failed to decrypt secret '%s': %v\n", key, err)
-						os.Exit(1)
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						exit(1)
 					}
-
-					secrets[key] = string(decrypted)
+					subjects := []string{subject}
+					if tokenName != "" {
+						tokens, err := store.ListTokens()
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+							exit(1)
+						}
+						i := slices.IndexFunc(tokens, func(t db.Token) bool { return t.Name == tokenName })
+						if i < 0 {
+							fmt.Fprintf(os.Stderr, "Error: token '%s' not found\n", tokenName)
+							exit(1)
+						}
+						e, subjects = e.ForToken(tokens[i]), policy.TokenSubjects(tokens[i])
+					}
+					opts.Allowed = func(key string) bool { return e.Allows(subjects, rbac.Read, store.Qualify(key)) }
 				}
 			}
 
-			// Build environment with secrets
-			env := os.Environ()
-			for key, value := range secrets {
-				env = append(env, fmt.Sprintf("%s=%s", key, value))
+			refs, failed := 0, false
+			for _, path := range args {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				found := lint.Scan(data)
+				refs += len(found)
+				for _, p := range lint.Check(found, opts) {
+					if isPorcelain(cmd) {
+						porcelain.Write(os.Stdout, "problem", path, strconv.Itoa(p.Line), strconv.Itoa(p.Col), p.Key, p.Message)
+					} else {
+						fmt.Printf("%s:%s\n", path, p)
+					}
+					failed = true
+				}
 			}
-
-			// Need at least one argument for the command
-			if len(args) == 0 {
-				fmt.Fprintf(os.Stderr, "Error: no command provided\n")
-				fmt.Fprintf(os.Stderr, "Usage: lockbox run -- command [args...]\n")
-				os.Exit(1)
+			if failed {
+				exit(1)
 			}
-
-			// Execute the command
-			execCmd := exec.Command(args[0], args[1:]...)
-			execCmd.Env = env
-			execCmd.Stdin = os.Stdin
-			execCmd.Stdout = os.Stdout
-			execCmd.Stderr = os.Stderr
-
-			err = execCmd.Run()
-			if err != nil {
-				// Check if it's an exit error to get the exit code
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					os.Exit(exitErr.ExitCode())
-				}
-				fmt.Fprintf(os.Stderr, "Error: failed to execute command: %v\n", err)
-				os.Exit(1)
+			if isPorcelain(cmd) {
+				return
 			}
+			fmt.Printf("%s %d references in %d files OK\n", output.OK, refs, len(args))
 		},
 	}
 
-	// Add --remote flag to run command
-	runCmd.Flags().StringP("remote", "r", "", "Remote server to fetch secrets from (e.g., localhost:8100)")
+	lintCmd.Flags().StringP("remote", "r", "", "Check against the secrets visible on a remote server instead of the local store")
+	lintCmd.Flags().String("user", "", "Also require the secrets to be granted to this user (name or UID)")
+	lintCmd.Flags().String("group", "", "Also require the secrets to be granted to this group (name or GID)")
+	lintCmd.Flags().String("token", "", "Also require the secrets to be readable with this API token")
+	lintCmd.Flags().String("claim", "", "Also require the secrets to be granted to this OIDC claim (NAME=VALUE)")
 
-	// serve command - Start HTTP server
-	serveCmd := &cobra.Command{
-		Use:   "serve",
-		Short: "Start HTTP server for remote access",
-		Long: `Start an HTTP server to expose secrets for remote access.
-Endpoints:
-  GET /health - Returns {"status":"ok"}
-  GET /secrets - Returns JSON array of all secret keys
-  GET /secrets/:key - Returns decrypted secret value as plain text
-  GET /env - Returns all secrets in export KEY="value" format`,
-		Args: cobra.NoArgs,
+	fmtCmd := &cobra.Command{
+		Use:   "fmt FILE...",
+		Short: "Normalize the layout of templates and manifests",
+		Long: `Rewrite templates and manifests in canonical form: trailing whitespace
+and repeated blank lines are removed, template actions get one space inside
+their delimiters, and manifest keys are sorted and deduplicated within each
+block. With --check nothing is written; files that need formatting are
+listed and the exit code is 1.`,
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			port, _ := cmd.Flags().GetString("port")
-
-			// Get store and key once for all handlers
-			store, encKey, err := getStoreAndKey()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
-			}
-			defer store.Close()
-
-			// Health endpoint
-			http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-			})
+			check, _ := cmd.Flags().GetBool("check")
 
-			// Secrets list endpoint
-			http.HandleFunc("/secrets", func(w http.ResponseWriter, r *http.Request) {
-				keys, err := store.ListSecrets()
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "Error: %v", err)
-					return
+			unformatted := false
+			for _, path := range args {
+				info, err := os.Stat(path)
+				var data []byte
+				if err == nil {
+					data, err = os.ReadFile(path)
 				}
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(keys)
-			})
-
-			// Env endpoint - returns export format
-			http.HandleFunc("/env", func(w http.ResponseWriter, r *http.Request) {
-				keys, err := store.ListSecrets()
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "Error: %v", err)
-					return
-				}
-
-				w.Header().Set("Content-Type", "text/plain")
-
-				for _, key := range keys {
-					encrypted, err := store.GetSecret(key)
-					if err != nil {
-						w.WriteHeader(http.StatusInternalServerError)
-						fmt.Fprintf(w, "Error: %v", err)
-						return
-					}
-
-					decrypted, err := crypto.Decrypt(encrypted, encKey)
-					if err != nil {
-						w.WriteHeader(http.StatusInternalServerError)
-						fmt.Fprintf(w, "Error: %v", err)
-						return
-					}
-
-					value := string(decrypted)
-					escapedValue := strings.NewReplacer(
-						"\\", "\\\\",
-						"\"", "\\\"",
-						"$", "\\$",
-						"`", "\\`",
-					).Replace(value)
-
-					fmt.Fprintf(w, "export %s=\"%s\"\n", key, escapedValue)
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
 				}
-			})
 
-			// Secret get endpoint - handles /secrets/:key
-			http.HandleFunc("/secrets/", func(w http.ResponseWriter, r *http.Request) {
-				key := strings.TrimPrefix(r.URL.Path, "/secrets/")
-				if key == "" {
-					w.WriteHeader(http.StatusBadRequest)
-					fmt.Fprintf(w, "Error: no key specified")
-					return
+				formatted := lint.Format(data)
+				if bytes.Equal(formatted, data) {
+					continue
 				}
-
-				encrypted, err := store.GetSecret(key)
-				if err != nil {
-					if err == db.ErrNotFound {
-						w.WriteHeader(http.StatusNotFound)
-						fmt.Fprintf(w, "Error: secret '%s' not found", key)
-						return
-					}
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "Error: %v", err)
-					return
+				if check {
+					fmt.Println(path)
+					unformatted = true
+					continue
 				}
-
-				decrypted, err := crypto.Decrypt(encrypted, encKey)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "Error: %v", err)
-					return
+				if err := os.WriteFile(path, formatted, info.Mode().Perm()); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
 				}
-
-				w.Header().Set("Content-Type", "text/plain")
-				w.Write(decrypted)
-			})
-
-			// Start server on localhost only
-			addr := fmt.Sprintf("127.0.0.1:%s", port)
-			fmt.Printf("✓ Server listening on http://%s\n", addr)
-			if err := http.ListenAndServe(addr, nil); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: server failed: %v\n", err)
-				os.Exit(1)
-			}
-		},
-	}
-
-	// Add --port flag to serve command
-	serveCmd.Flags().StringP("port", "p", "8100", "Port to listen on")
-
-	// Modify env command to support --remote flag
-	envCmdRun := envCmd.Run
-	envCmd.Run = func(cmd *cobra.Command, args []string) {
-		remoteFlag, _ := cmd.Flags().GetString("remote")
-
-		if remoteFlag != "" {
-			// Fetch from remote server
-			url := fmt.Sprintf("http://%s/env", remoteFlag)
-			resp, err := http.Get(url)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to fetch from remote: %v\n", err)
-				os.Exit(1)
+				fmt.Printf("%s Formatted %s\n", output.OK, path)
 			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(resp.Body)
-				fmt.Fprintf(os.Stderr, "Error: remote server returned status %d: %s\n", resp.StatusCode, body)
-				os.Exit(1)
+			if unformatted {
+				exit(1)
 			}
-
-			// Print the response directly
-			io.Copy(os.Stdout, resp.Body)
-		} else {
-			// Use original local implementation
-			envCmdRun(cmd, args)
-		}
+		},
 	}
 
-	// Add --remote flag to env command
-	envCmd.Flags().StringP("remote", "r", "", "Remote server to fetch from (e.g., localhost:8100)")
+	fmtCmd.Flags().Bool("check", false, "List files that need formatting instead of rewriting them")
 
 	// learn command - Print instructions for AI agents
 	learnCmd := &cobra.Command{
@@ -641,12 +10775,110 @@ If you get connection errors:
 		},
 	}
 
+	// completion command - Print shell completion scripts
+	completionCmd := &cobra.Command{
+		Use:   "completion bash|zsh|fish|powershell",
+		Short: "Print a shell completion script",
+		Long: `Print the completion script for a shell. Besides commands and flags, the
+keys of the current store complete for get, delete and edit; completing
+never asks for a passphrase or decrypts anything.
+  source <(lockbox completion bash)                      # in ~/.bashrc
+  lockbox completion zsh > "${fpath[1]}/_lockbox"
+  lockbox completion fish > ~/.config/fish/completions/lockbox.fish
+  lockbox completion powershell | Out-String | Invoke-Expression   # in $PROFILE`,
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+		Run: func(cmd *cobra.Command, args []string) {
+			root := cmd.Root()
+			var err error
+			switch args[0] {
+			case "bash":
+				err = root.GenBashCompletionV2(os.Stdout, true)
+			case "zsh":
+				err = root.GenZshCompletion(os.Stdout)
+			case "fish":
+				err = root.GenFishCompletion(os.Stdout, true)
+			case "powershell":
+				err = root.GenPowerShellCompletionWithDesc(os.Stdout)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+
+	// help command - Cobra's help, plus a local HTML reference with --web
+	helpCmd := &cobra.Command{
+		Use:   "help [command]",
+		Short: "Help about any command",
+		Long: `Help provides help for any command in the application.
+Simply type lockbox help [path to command] for full details.
+
+With --web, serve a searchable HTML reference of every command and flag,
+the HTTP API of 'lockbox serve' and the README's recipes on localhost.
+It is built into the binary, so it works without internet access.`,
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]cobra.Completion, cobra.ShellCompDirective) {
+			var completions []cobra.Completion
+			parent, _, err := cmd.Root().Find(args)
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			for _, c := range parent.Commands() {
+				if c.IsAvailableCommand() && strings.HasPrefix(c.Name(), toComplete) {
+					completions = append(completions, cobra.CompletionWithDesc(c.Name(), c.Short))
+				}
+			}
+			return completions, cobra.ShellCompDirectiveNoFileComp
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			web, _ := cmd.Flags().GetBool("web")
+			if !web {
+				target, _, err := cmd.Root().Find(args)
+				if target == nil || err != nil {
+					cmd.Printf("Unknown help topic %#q\n", args)
+					cobra.CheckErr(cmd.Root().Usage())
+					return
+				}
+				target.InitDefaultHelpFlag()
+				cobra.CheckErr(target.Help())
+				return
+			}
+
+			handler, err := helpweb.Handler(helpReference(cmd.Root()))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			port, _ := cmd.Flags().GetString("port")
+			ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			url := "http://" + ln.Addr().String() + "/"
+			if len(args) > 0 {
+				url += "#q=" + strings.Join(args, "%20")
+			}
+			fmt.Printf("%s Serving the reference on %s (Ctrl-C to stop)\n", output.OK, url)
+			srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+			if err := srv.Serve(ln); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		},
+	}
+	helpCmd.Flags().Bool("web", false, "Serve a searchable HTML reference on localhost")
+	helpCmd.Flags().StringP("port", "p", "0", "Port for --web (0 picks a free one)")
+	rootCmd.SetHelpCommand(helpCmd)
+
 	// Add commands to root
-	rootCmd.AddCommand(initCmd, setCmd, getCmd, deleteCmd, listCmd, envCmd, runCmd, serveCmd, learnCmd)
+	rootCmd.AddCommand(initCmd, keyBackendCmd, passphraseCmd, unlockCmd, lockCmd, agentCmd, setCmd, editCmd, generateCmd, tempCmd, getCmd, autotypeCmd, existsCmd, sudoGetCmd, deleteCmd, renameCmd, listCmd, searchCmd, searchIndexCmd, reportCmd, envCmd, templateCmd, batchCmd, importCmd, exportCmd, consoleCmd, noteCmd, recoveryCmd, runCmd, entrypointCmd, materializeCmd, nativeHostCmd, serveCmd, loginCmd, statusCmd, statsCmd, verifyCmd, upgradeStoreCmd, gcCmd, pruneCmd, configCmd, provisionCmd, backupCmd, recoveryKitCmd, deviceCmd, vaultCmd, workspaceCmd, snapshotCmd, checkoutCmd, checkinCmd, promoteCmd, copyCmd, pushCmd, pullCmd, syncCmd, fingerprintCmd, mergeCmd, rotationCmd, digestCmd, notifyCmd, wormCmd, auditCmd, policyCmd, roleCmd, tokenCmd, pairCmd, bundleCmd, escrowCmd, hardenCmd, podmanDriverCmd, lintCmd, fmtCmd, learnCmd, completionCmd)
 
 	// Execute
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
+	exit(0)
 }